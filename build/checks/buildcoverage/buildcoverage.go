@@ -0,0 +1,390 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary buildcoverage verifies that source files touched by a change are
+// covered by a Bazel target and a BUILDUNIT, and that deleted source files are
+// no longer referenced by any target.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/presubmit/check"
+	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/libs/go/log"
+
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+)
+
+// sourceExts are the file extensions this check applies to.
+var sourceExts = map[string]bool{
+	".go":  true,
+	".c":   true,
+	".cc":  true,
+	".cpp": true,
+	".cxx": true,
+	".h":   true,
+	".hh":  true,
+	".hpp": true,
+}
+
+// queryFunc runs a bazel query with the extra options |args|, eg. an --output, and returns the
+// lines of its output.
+type queryFunc func(expr string, args ...string) ([]string, error)
+
+type checker struct {
+	mr    monorepo.Monorepo
+	query queryFunc
+	// loadUnits returns the target expressions of all build and test units.
+	loadUnits func() ([]string, error)
+}
+
+// source is a source file of the change.
+type source struct {
+	path    monorepo.Path
+	deleted bool
+	pkg     monorepo.Path
+	label   string
+	msg     string // the problem with the file, if any
+}
+
+func isSource(p monorepo.Path) bool {
+	for _, part := range strings.Split(string(p), "/") {
+		if part == "testdata" {
+			return false
+		}
+	}
+	return sourceExts[path.Ext(string(p))]
+}
+
+// findPkg returns the Bazel package that contains the file at p, ie. the
+// closest ancestor directory that has a BUILD or BUILD.bazel file.
+func (c *checker) findPkg(p monorepo.Path) (monorepo.Path, bool) {
+	dir := p
+	for dir != "" && dir != "." {
+		dir = dir.Dir()
+		if dir == "." {
+			dir = ""
+		}
+		for _, name := range []string{"BUILD.bazel", "BUILD"} {
+			if _, err := os.Stat(c.mr.ResolvePath(monorepo.Path(path.Join(string(dir), name)))); err == nil {
+				return dir, true
+			}
+		}
+	}
+	return "", false
+}
+
+// fileLabel returns the label of the file p inside package pkg.
+func fileLabel(pkg, p monorepo.Path) string {
+	target := strings.TrimPrefix(string(p), string(pkg)+"/")
+	if pkg == "" {
+		target = string(p)
+	}
+	return fmt.Sprintf("//%s:%s", pkg, target)
+}
+
+// pkgsExpr returns the query expression of all the targets of the packages of |sources|.
+func pkgsExpr(sources []*source) string {
+	seen := map[monorepo.Path]bool{}
+	var pkgs []string
+	for _, s := range sources {
+		if !seen[s.pkg] {
+			seen[s.pkg] = true
+			pkgs = append(pkgs, fmt.Sprintf("//%s:*", s.pkg))
+		}
+	}
+	sort.Strings(pkgs)
+	return strings.Join(pkgs, " + ")
+}
+
+// graphEdge matches the edges of "bazel query --output=graph --nograph:factored".
+var graphEdge = regexp.MustCompile(`^"(.+)" -> "(.+)"$`)
+
+// referencedBy returns the targets of their packages that directly reference each file of
+// |sources|, by label. The graph of the files and their references is got in a single query.
+// Files that aren't targets, eg. deleted files no rule references, are not in the graph.
+func (c *checker) referencedBy(sources []*source) (map[string][]string, error) {
+	// Labels of files that don't exist are errors unless a rule references them, so the files are
+	// picked from the targets of their packages.
+	var labels []string
+	for _, s := range sources {
+		labels = append(labels, regexp.QuoteMeta(s.label))
+	}
+	universe := pkgsExpr(sources)
+	expr := fmt.Sprintf("rdeps(%s, filter('^(%s)$', %s), 1)", universe, strings.Join(labels, "|"), universe)
+	lines, err := c.query(expr, "--output=graph", "--nograph:factored", "--graph:node_limit=-1")
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string][]string{}
+	for _, l := range lines {
+		if m := graphEdge.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+			refs[m[2]] = append(refs[m[2]], m[1])
+		}
+	}
+	return refs, nil
+}
+
+// inBuildUnits returns which of |targets| some build or test unit depends on.
+func (c *checker) inBuildUnits(targets []string) (map[string]bool, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	units, err := c.loadUnits()
+	if err != nil || len(units) == 0 {
+		return nil, err
+	}
+	expr := fmt.Sprintf("(%s) intersect deps(%s)", strings.Join(targets, " + "), strings.Join(units, " + "))
+	covered, err := c.query(expr)
+	if err != nil {
+		return nil, err
+	}
+	in := map[string]bool{}
+	for _, t := range covered {
+		in[t] = true
+	}
+	return in, nil
+}
+
+// ruleKind returns the kind of rule a file at p most likely belongs to.
+func ruleKind(p monorepo.Path) string {
+	switch {
+	case strings.HasSuffix(string(p), "_test.go"):
+		return "go_test"
+	case path.Ext(string(p)) == ".go":
+		return "go_library"
+	case strings.HasSuffix(path.Base(string(p)), "_test"+path.Ext(string(p))):
+		return "cc_test"
+	default:
+		return "cc_library"
+	}
+}
+
+// suggestTargets returns, for each of |sources|, the target of its package that it most likely
+// belongs to. The rules of all the packages are got in a single query.
+func (c *checker) suggestTargets(sources []*source) map[*source]string {
+	// Lines are "<kind> rule <label>".
+	lines, err := c.query(fmt.Sprintf("kind(rule, %s)", pkgsExpr(sources)), "--output=label_kind")
+	if err != nil {
+		log.Warningf("could not list the rules of the changed packages: %v", err)
+	}
+	type pkgKind struct {
+		pkg  string
+		kind string
+	}
+	first := map[pkgKind]string{}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) != 3 || fields[1] != "rule" {
+			continue
+		}
+		pk := pkgKind{strings.SplitN(fields[2], ":", 2)[0], fields[0]}
+		if _, ok := first[pk]; !ok {
+			first[pk] = fields[2]
+		}
+	}
+	suggestions := map[*source]string{}
+	for _, s := range sources {
+		kind := ruleKind(s.path)
+		if t, ok := first[pkgKind{fmt.Sprintf("//%s", s.pkg), kind}]; ok {
+			suggestions[s] = t
+		} else {
+			suggestions[s] = fmt.Sprintf("a new %s in //%s", kind, s.pkg)
+		}
+	}
+	return suggestions
+}
+
+// check sets the problems of |sources| with a few bazel queries for the whole change, whatever
+// its number of files.
+func (c *checker) check(sources []*source) error {
+	if len(sources) == 0 {
+		return nil
+	}
+	refs, err := c.referencedBy(sources)
+	if err != nil {
+		return err
+	}
+	var uncovered []*source
+	var targets []string
+	seen := map[string]bool{}
+	for _, s := range sources {
+		r := refs[s.label]
+		if s.deleted {
+			var msgs []string
+			for _, t := range r {
+				msgs = append(msgs, fmt.Sprintf("%s: deleted but still referenced, remove it from %s", s.path, t))
+			}
+			s.msg = strings.Join(msgs, "\n")
+			continue
+		}
+		if len(r) == 0 {
+			uncovered = append(uncovered, s)
+			continue
+		}
+		for _, t := range r {
+			if !seen[t] {
+				seen[t] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	if len(uncovered) > 0 {
+		suggestions := c.suggestTargets(uncovered)
+		for _, s := range uncovered {
+			s.msg = fmt.Sprintf("%s: not covered by any Bazel target, add this file to %s", s.path, suggestions[s])
+		}
+	}
+	sort.Strings(targets)
+	inUnits, err := c.inBuildUnits(targets)
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		r := refs[s.label]
+		if s.deleted || len(r) == 0 {
+			continue
+		}
+		sort.Strings(r)
+		covered := false
+		for _, t := range r {
+			covered = covered || inUnits[t]
+		}
+		if !covered {
+			s.msg = fmt.Sprintf("%s: not covered by any BUILDUNIT, add %s to a build_unit or test_unit", s.path, r[0])
+		}
+	}
+	return nil
+}
+
+func checkBuildCoverage(helper check.Helper, c *checker) (bool, error) {
+	var files []*source
+	var sources []*source
+	for _, f := range helper.OnlyCheck().Files {
+		p, err := c.mr.RelPath(f.Path)
+		if err != nil {
+			return false, err
+		}
+		if !isSource(p) {
+			continue
+		}
+		s := &source{path: p, deleted: f.Status == checkpb.Status_Delete}
+		files = append(files, s)
+		pkg, ok := c.findPkg(p)
+		switch {
+		case ok:
+			s.pkg = pkg
+			s.label = fileLabel(pkg, p)
+			sources = append(sources, s)
+		case !s.deleted:
+			s.msg = fmt.Sprintf("%s: not in any Bazel package, add a BUILD.bazel file to //%s", p, p.Dir())
+		}
+	}
+	if err := c.check(sources); err != nil {
+		return false, err
+	}
+	logs := strings.Builder{}
+	for _, s := range files {
+		if s.msg != "" {
+			logs.WriteString(s.msg)
+			logs.WriteRune('\n')
+		}
+	}
+	success := logs.Len() == 0
+	result := &buildpb.Result{
+		Name:    "check_build_coverage",
+		Success: success,
+		Logs:    check.LogsFromString("stderr", logs.String()),
+	}
+	helper.AddResult(result)
+	helper.MustWriteResult()
+	return success, nil
+}
+
+// unitTarget turns a target expression relative to dir into an absolute one.
+func unitTarget(dir monorepo.Path, t string) string {
+	switch {
+	case strings.HasPrefix(t, "//") || strings.HasPrefix(t, "@"):
+		return t
+	case strings.HasPrefix(t, ":"):
+		return fmt.Sprintf("//%s%s", dir, t)
+	default:
+		return fmt.Sprintf("//%s/%s", dir, t)
+	}
+}
+
+// unitTargets returns the Bazel targets of every build and test unit.
+func unitTargets(mr monorepo.Monorepo, bc build.Context) ([]string, error) {
+	files, err := build.DiscoverBuildUnitFiles(mr, bc)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, f := range files {
+		for _, bu := range f.Proto.BuildUnit {
+			if bu.Target != "" {
+				targets = append(targets, unitTarget(f.Dir, bu.Target))
+			}
+		}
+		for _, tu := range f.Proto.TestUnit {
+			for _, t := range tu.Target {
+				targets = append(targets, unitTarget(f.Dir, t))
+			}
+		}
+	}
+	return targets, nil
+}
+
+func main() {
+	flag.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+	ok, err := func() (bool, error) {
+		mr, _, err := monorepo.NewFromPwd()
+		if err != nil {
+			return false, err
+		}
+		bc, err := build.NewContext(mr)
+		if err != nil {
+			return false, err
+		}
+		c := &checker{
+			mr: mr,
+			query: func(expr string, args ...string) ([]string, error) {
+				return bc.BazelQuery(expr, func(o *build.Options) {
+					o.BazelQueryArgs = args
+				})
+			},
+			loadUnits: func() ([]string, error) {
+				return unitTargets(mr, bc)
+			},
+		}
+		return checkBuildCoverage(check.MustLoad(), c)
+	}()
+	if err != nil {
+		log.Error(err)
+	}
+	if err != nil || !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/presubmit/check/checkmock"
+
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+)
+
+// fakeBazel answers the queries of the checker from the rules of a package.
+type fakeBazel struct {
+	// rules maps the rules to their kind and the files they reference.
+	rules map[string]struct {
+		kind string
+		srcs []string
+	}
+	files   []string        // the files in the package
+	inUnits map[string]bool // the rules build or test units depend on
+	queries []string
+}
+
+var (
+	filterExpr    = regexp.MustCompile(`filter\('(.*)', `)
+	intersectExpr = regexp.MustCompile(`^\((.*)\) intersect deps\(`)
+)
+
+func (b *fakeBazel) query(expr string, args ...string) ([]string, error) {
+	b.queries = append(b.queries, expr+" "+strings.Join(args, " "))
+	var lines []string
+	switch {
+	case strings.HasPrefix(expr, "rdeps("):
+		if !strings.Contains(strings.Join(args, " "), "--output=graph") {
+			return nil, fmt.Errorf("rdeps without --output=graph")
+		}
+		files := regexp.MustCompile(filterExpr.FindStringSubmatch(expr)[1])
+		targets := append([]string{}, b.files...)
+		for _, r := range b.rules {
+			targets = append(targets, r.srcs...)
+		}
+		for _, f := range targets {
+			if !files.MatchString(f) {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("  %q", f))
+			for name, r := range b.rules {
+				for _, src := range r.srcs {
+					if src == f {
+						lines = append(lines, fmt.Sprintf("  %q -> %q", name, f))
+					}
+				}
+			}
+		}
+	case intersectExpr.MatchString(expr):
+		for _, t := range strings.Split(intersectExpr.FindStringSubmatch(expr)[1], " + ") {
+			if b.inUnits[t] {
+				lines = append(lines, t)
+			}
+		}
+	case strings.HasPrefix(expr, "kind(rule, "):
+		for name, r := range b.rules {
+			lines = append(lines, fmt.Sprintf("%s rule %s", r.kind, name))
+		}
+		sort.Strings(lines)
+	default:
+		return nil, fmt.Errorf("unexpected query %q", expr)
+	}
+	return lines, nil
+}
+
+func TestCheckBuildCoverage(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"foo/BUILD.bazel", "foo/foo.go", "foo/new.go", "foo/new_test.go", "foo/orphan.go", "nopkg/x.go"} {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type rule = struct {
+		kind string
+		srcs []string
+	}
+	newBazel := func() *fakeBazel {
+		return &fakeBazel{
+			rules: map[string]rule{
+				"//foo:foo":      {"go_library", []string{"//foo:foo.go", "//foo:new.go", "//foo:gone.go"}},
+				"//foo:orphan":   {"go_library", []string{"//foo:orphan.go"}},
+				"//foo:foo_test": {"go_test", nil},
+			},
+			files:   []string{"//foo:BUILD.bazel", "//foo:foo.go", "//foo:new.go", "//foo:new_test.go", "//foo:orphan.go"},
+			inUnits: map[string]bool{"//foo:foo": true},
+		}
+	}
+	testCases := []struct {
+		desc     string
+		file     string
+		status   checkpb.Status
+		wantLogs []string
+	}{
+		{
+			desc: "covered file",
+			file: "foo/foo.go",
+		},
+		{
+			desc:   "added covered file",
+			file:   "foo/new.go",
+			status: checkpb.Status_Create,
+		},
+		{
+			desc:   "not a source file",
+			file:   "foo/BUILD.bazel",
+			status: checkpb.Status_Create,
+		},
+		{
+			desc:     "added uncovered test",
+			file:     "foo/new_test.go",
+			status:   checkpb.Status_Create,
+			wantLogs: []string{"foo/new_test.go: not covered by any Bazel target, add this file to //foo:foo_test"},
+		},
+		{
+			desc:     "target not in BUILDUNIT",
+			file:     "foo/orphan.go",
+			status:   checkpb.Status_Create,
+			wantLogs: []string{"foo/orphan.go: not covered by any BUILDUNIT, add //foo:orphan"},
+		},
+		{
+			desc:     "no package",
+			file:     "nopkg/x.go",
+			status:   checkpb.Status_Create,
+			wantLogs: []string{"add a BUILD.bazel file to //nopkg"},
+		},
+		{
+			desc:     "deleted but referenced",
+			file:     "foo/gone.go",
+			status:   checkpb.Status_Delete,
+			wantLogs: []string{"foo/gone.go: deleted but still referenced, remove it from //foo:foo"},
+		},
+		{
+			desc:   "deleted and unreferenced",
+			file:   "foo/other.go",
+			status: checkpb.Status_Delete,
+		},
+	}
+	run := func(files []*checkpb.File) (*fakeBazel, bool, string) {
+		helper := checkmock.NewHelper(&checkpb.CheckerInvocation{
+			TriggeredChecks: []*checkpb.TriggeredCheck{{Files: files}},
+		})
+		bazel := newBazel()
+		c := &checker{
+			mr:    monorepo.New(root, nil),
+			query: bazel.query,
+			loadUnits: func() ([]string, error) {
+				return []string{"//foo:foo"}, nil
+			},
+		}
+		success, err := checkBuildCoverage(helper, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bazel, success, string(helper.Result.Results[0].Logs[0].Contents)
+	}
+	var all []*checkpb.File
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			file := &checkpb.File{Path: filepath.Join(root, tc.file), Status: tc.status}
+			all = append(all, file)
+			_, success, msg := run([]*checkpb.File{file})
+			if success != (len(tc.wantLogs) == 0) {
+				t.Fatalf("want success=%v, got %v", len(tc.wantLogs) == 0, success)
+			}
+			for _, want := range tc.wantLogs {
+				if !strings.Contains(msg, want) {
+					t.Errorf("want %q in logs, got %q", want, msg)
+				}
+			}
+		})
+	}
+
+	// The whole change is checked with one query of each kind.
+	bazel, _, msg := run(all)
+	for _, tc := range testCases {
+		for _, want := range tc.wantLogs {
+			if !strings.Contains(msg, want) {
+				t.Errorf("all files: want %q in logs, got %q", want, msg)
+			}
+		}
+	}
+	if len(bazel.queries) != 3 {
+		t.Errorf("all files: got %d queries, want 3: %q", len(bazel.queries), bazel.queries)
+	}
+}
+
+func TestUnitTarget(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{":foo", "//a/b:foo"},
+		{"//c:d", "//c:d"},
+		{"@repo//e:f", "@repo//e:f"},
+		{"...", "//a/b/..."},
+	} {
+		if got := unitTarget("a/b", tc.target); got != tc.want {
+			t.Errorf("unitTarget(%q) = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
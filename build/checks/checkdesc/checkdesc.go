@@ -25,6 +25,7 @@ import (
 
 	"sge-monorepo/build/cicd/presubmit/check"
 	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
 
 	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
 )
@@ -33,6 +34,7 @@ var flags = struct {
 	requiredRegexp    string
 	prohibitedRegexp  string
 	suppressionRegexp string
+	validateTags      bool
 }{}
 
 func match(regex, desc string) (bool, error) {
@@ -76,6 +78,11 @@ func checkdesc(helper check.Helper) (bool, error) {
 			logs.WriteString(fmt.Sprintf("CL description does not match required regex: %q\n", flags.requiredRegexp))
 		}
 	}
+	if flags.validateTags {
+		if err := p4lib.ParseTaggedDescription(desc).Validate(); err != nil {
+			logs.WriteString(fmt.Sprintf("CL description has %v\n", err))
+		}
+	}
 	success := logs.Len() == 0
 	result := &buildpb.Result{
 		Name:    "check_description",
@@ -91,6 +98,7 @@ func main() {
 	flag.StringVar(&flags.requiredRegexp, "required_regexp", "", "regex that is required")
 	flag.StringVar(&flags.prohibitedRegexp, "prohibited_regexp", "", "regex that is prohibited")
 	flag.StringVar(&flags.suppressionRegexp, "suppression_regexp", "", "regex that suppresses the check")
+	flag.BoolVar(&flags.validateTags, "validate_tags", false, "whether the tags of the description, eg. BUG= or Reviewed-by:, must be valid")
 	flag.Parse()
 	log.AddSink(log.NewGlog())
 	defer log.Shutdown()
@@ -33,6 +33,7 @@ func TestCheckDesc(t *testing.T) {
 		requiredRegex    string
 		prohibitedRegex  string
 		suppressionRegex string
+		validateTags     bool
 	}{
 		{
 			desc:    "empty case want error",
@@ -89,6 +90,22 @@ TESTED=yes very much
 			suppressionRegex: `NOTSUPPRESSED`,
 			wantErrLog:       "prohibited regex",
 		},
+		{
+			desc:         "valid tags",
+			clDesc:       "This CL is very good\n\nBUG=b/123\nTest: ran it",
+			validateTags: true,
+		},
+		{
+			desc:         "template tags",
+			clDesc:       "This CL is very good\n\nBUG=none\nTESTED=",
+			validateTags: true,
+		},
+		{
+			desc:         "invalid tags",
+			clDesc:       "This CL is very good\n\nBUG=soon",
+			validateTags: true,
+			wantErrLog:   "BUG=soon",
+		},
 	}
 	for _, tcl := range testCases {
 		tc := tcl
@@ -99,6 +116,7 @@ TESTED=yes very much
 			flags.requiredRegexp = tc.requiredRegex
 			flags.prohibitedRegexp = tc.prohibitedRegex
 			flags.suppressionRegexp = tc.suppressionRegex
+			flags.validateTags = tc.validateTags
 			success, err := checkdesc(helper)
 			if err := sgetest.CmpErr(err, tc.wantErr); err != nil {
 				t.Fatal(err)
@@ -34,6 +34,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"sge-monorepo/build/cicd/cirunner/runnertool"
 	"sge-monorepo/build/cicd/monorepo/universe"
@@ -52,7 +53,9 @@ import (
 func printUsage() {
 	fmt.Print(`
 Usage:
-    sge-ci-runner -invocation=<RUNNER_INVOCATION TEXTPB> [COMMAND]
+    sge-ci-runner -invocation=<RUNNER_INVOCATION TEXTPB> [-p4_commit_port=<PORT>] [COMMAND]
+    When P4PORT is a replica, -p4_commit_port is the address of the commit server. Whether changes
+    are submitted is checked there, and runs wait for their base CL to be replicated before syncing.
     Commands:
         prewarm
             Performs "deps" followed by "sync".
@@ -62,6 +65,11 @@ Usage:
         send-swarm-swarm <start|pass|fail>
             Sends an request to Swarm updating it about the state of the presubmit runs.
 
+        pull [-lanes=presubmit,postsubmit] [-once] [-poll=10s] [-fair_window=10]
+            Pulls requests from the queue of the environment and runs them, instead of running
+            the invocation. The -invocation flag isn't needed. Presubmits are shared fairly
+            between the projects configured in Ebert's /ebert/admin/queue/projects.
+
         <OTHER VALUES>
             All other values are informative, because the internal runner will be determined by
             the invocation proto.
@@ -91,7 +99,11 @@ func findTargetForInvocation(invocation *cirunnerpb.RunnerInvocation) (string, e
 	return "", fmt.Errorf("no valid invocation found")
 }
 
-var gInvocationPath = flag.String("invocation", "", "Path to the invocation text proto")
+var (
+	gInvocationPath     = flag.String("invocation", "", "Path to the invocation text proto")
+	gCommitPort         = flag.String("p4_commit_port", "", "Address of the commit server when P4PORT is a replica, eg. ssl:commit:1666.")
+	gReplicationTimeout = flag.Duration("replication_timeout", 5*time.Minute, "Maximum time to wait for the base CL of a run to be replicated.")
+)
 
 func loadInvocation() (*cirunnerpb.RunnerInvocation, error) {
 	if *gInvocationPath == "" {
@@ -108,12 +120,13 @@ func loadInvocation() (*cirunnerpb.RunnerInvocation, error) {
 	return invocation, nil
 }
 
-// clSubmited returns whether the CL is submitting by querying perforce.
+// clSubmited returns whether the CL is submitting by querying perforce. The commit server is
+// queried, as replicas may not know yet that the CL was submitted.
 func clSubmitted(p4 p4lib.P4, change int) (bool, error) {
 	if change == 0 {
 		return false, nil
 	}
-	describes, err := p4.Describe([]int{change})
+	describes, err := p4lib.CommitServer(p4).Describe([]int{change})
 	if err != nil || len(describes) != 1 {
 		return false, fmt.Errorf("could not obtain description for change %d: %v", change, err)
 	}
@@ -123,7 +136,7 @@ func clSubmitted(p4 p4lib.P4, change int) (bool, error) {
 
 // Email -------------------------------------------------------------------------------------------
 
-func sendPresubmitEmail() error {
+func sendPresubmitEmail(p4 p4lib.P4) error {
 	invocation, err := loadInvocation()
 	if err != nil {
 		return fmt.Errorf("could not load invocation proto: %v", err)
@@ -149,7 +162,6 @@ func sendPresubmitEmail() error {
 	}
 	cmd := emailFlagSet.Arg(0)
 	// Presubmit emails are only sent if the CL is not submitted.
-	p4 := p4lib.New()
 	submitted, err := clSubmitted(p4, int(invocation.Change))
 	if err != nil {
 		return fmt.Errorf("could not query if CL is submitted: %v", err)
@@ -244,6 +256,10 @@ func sync(p4 p4lib.P4, invocation *cirunnerpb.RunnerInvocation) (int, error) {
 		baseCl = changes[0].Cl
 	} else {
 		log.Infof("Explicit CL to sync to provided: %d", baseCl)
+		// Syncing a replica to a CL it doesn't have yet would silently sync an older state.
+		if err := p4lib.WaitForChange(p4, baseCl, *gReplicationTimeout); err != nil {
+			return 0, err
+		}
 	}
 	// The universe already defined all the code that we care about, so we can issue a
 	// blanket sync and that will get the correct code. We use a stdout option to stream to the
@@ -334,6 +350,11 @@ func forwardToInternalRunner(p4 p4lib.P4, cloudLogger cloudlog.CloudLogger) erro
 	if err != nil {
 		return fmt.Errorf("could not load invocation proto: %v", err)
 	}
+	return runInvocation(p4, cloudLogger, invocation)
+}
+
+// runInvocation syncs the P4 state of |invocation| and runs its internal runner.
+func runInvocation(p4 p4lib.P4, cloudLogger cloudlog.CloudLogger, invocation *cirunnerpb.RunnerInvocation) error {
 	log.Infof("Invocation proto:\n%s", proto.MarshalTextString(invocation))
 	// Not matter what happens, we always revert the p4 state to a clean slate.
 	defer func() {
@@ -483,7 +504,7 @@ func internalMain() int {
 		log.AddSink(cloudLogger)
 	}
 	defer log.Shutdown()
-	p4 := p4lib.New()
+	p4 := p4lib.WithCommitServer(p4lib.New(), *gCommitPort)
 	// In general what cirunner does comes from the invocation that indicates which internal_runner
 	// to invoke. It is possible to override what cirunner does by passing a command as first
 	// argument.
@@ -494,9 +515,11 @@ func internalMain() int {
 	var err error
 	switch cmd {
 	case "send-presubmit-email":
-		err = sendPresubmitEmail()
+		err = sendPresubmitEmail(p4)
 	case "send-swarm-request":
 		err = sendSwarmRequest(p4)
+	case "pull":
+		err = pullRequests(p4, cloudLogger)
 	default:
 		if err := forwardToInternalRunner(p4, cloudLogger); err != nil {
 			log.Errorf("error forwarding command: %v", err)
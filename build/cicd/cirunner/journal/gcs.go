@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// NewGCSStore returns a store that keeps journals as objects under |prefix| in a GCS bucket.
+// GCS object writes are atomic, readers either see the previous or the new version.
+func NewGCSStore(ctx context.Context, bucket, prefix string) (Store, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCS client: %v", err)
+	}
+	return &gcsStore{
+		ctx:    ctx,
+		bkt:    client.Bucket(bucket),
+		prefix: prefix,
+	}, nil
+}
+
+type gcsStore struct {
+	ctx    context.Context
+	bkt    *storage.BucketHandle
+	prefix string
+}
+
+func (gs *gcsStore) Write(name string, data []byte) error {
+	w := gs.bkt.Object(path.Join(gs.prefix, name)).NewWriter(gs.ctx)
+	w.ContentType = "text/plain"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (gs *gcsStore) Read(name string) ([]byte, error) {
+	r, err := gs.bkt.Object(path.Join(gs.prefix, name)).NewReader(gs.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (gs *gcsStore) Delete(name string) error {
+	return gs.bkt.Object(path.Join(gs.prefix, name)).Delete(gs.ctx)
+}
+
+func (gs *gcsStore) List() ([]string, error) {
+	var names []string
+	it := gs.bkt.Objects(gs.ctx, &storage.Query{Prefix: gs.prefix + "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		names = append(names, path.Base(attrs.Name))
+	}
+	return names, nil
+}
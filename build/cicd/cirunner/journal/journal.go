@@ -0,0 +1,319 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package journal keeps a crash-safe record of the progress of a CI run.
+//
+// A runner starts a journal when it begins a run and records every check it starts and completes.
+// The journal is rewritten atomically after every step to a local store, and on a best-effort basis
+// to any number of remote stores (eg. GCS) for diagnostics. If the runner crashes, the journal stays
+// in the RUNNING state. The next runner on the machine finds it with Orphans and can either resume
+// it (reusing the results of the completed checks) or abandon it, reporting it as failed. Local
+// stores lock the journals of live runs, so that they aren't mistaken for crashed ones, and drop
+// the journals of recovered runs, which only remote stores keep.
+package journal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"sge-monorepo/libs/go/clock"
+	"sge-monorepo/libs/go/files"
+	"sge-monorepo/libs/go/log"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	journalSuffix = ".journal.textpb"
+	lockSuffix    = ".lock"
+)
+
+// Journal is the record of a single CI run.
+type Journal struct {
+	mu      sync.Mutex
+	pb      *cirunnerpb.RunJournal
+	local   Store
+	remotes []Store
+	clock   clock.Clock
+	// unlock releases the lock of the journal in the local store, if it supports locking.
+	unlock func() error
+}
+
+// Option is a function that modifies the Journal on creation.
+type Option func(*Journal)
+
+// WithRemote adds a remote store the journal is mirrored to. Writes to remote stores are best effort.
+func WithRemote(s Store) Option {
+	return func(j *Journal) {
+		j.remotes = append(j.remotes, s)
+	}
+}
+
+// WithClock overrides the clock used for timestamping the journal.
+func WithClock(c clock.Clock) Option {
+	return func(j *Journal) {
+		j.clock = c
+	}
+}
+
+// Start creates the journal of a new run and persists it.
+func Start(runID string, invocation *cirunnerpb.RunnerInvocation, local Store, opts ...Option) (*Journal, error) {
+	j := &Journal{
+		local: local,
+		clock: clock.New(),
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if ls, ok := local.(lockingStore); ok {
+		if j.unlock, err = ls.tryLock(runID + journalSuffix); err != nil {
+			return nil, fmt.Errorf("could not lock journal of run %s: %v", runID, err)
+		}
+	}
+	now := j.clock.Now().Unix()
+	j.pb = &cirunnerpb.RunJournal{
+		State:      cirunnerpb.RunJournal_RUNNING,
+		RunId:      runID,
+		Invocation: invocation,
+		Host:       host,
+		Pid:        int64(os.Getpid()),
+		StartTime:  now,
+		UpdateTime: now,
+	}
+	if err := j.write(); err != nil {
+		j.release()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Orphans returns the journals in |store| left in the RUNNING state by runs that crashed. When the
+// store supports locking, journals locked by a live run are skipped and the returned journals are
+// locked until they are resumed or abandoned. Otherwise every running journal is returned, which
+// is only right when a single run at a time uses the store.
+func Orphans(store Store, opts ...Option) ([]*Journal, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("journal.Orphans %v", err)
+	}
+	var ret []*Journal
+	for _, name := range names {
+		if !strings.HasSuffix(name, journalSuffix) {
+			continue
+		}
+		pb, err := readRunning(store, name)
+		if err != nil {
+			return nil, fmt.Errorf("journal.Orphans %v", err)
+		}
+		if pb == nil {
+			continue
+		}
+		var unlock func() error
+		if ls, ok := store.(lockingStore); ok {
+			unlock, err = ls.tryLock(name)
+			if err == files.ErrLocked {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("journal.Orphans %v", err)
+			}
+			// The run may have completed before we took the lock.
+			if pb, err = readRunning(store, name); err != nil || pb == nil {
+				unlock()
+				if err != nil {
+					return nil, fmt.Errorf("journal.Orphans %v", err)
+				}
+				continue
+			}
+		}
+		j := &Journal{
+			pb:     pb,
+			local:  store,
+			clock:  clock.New(),
+			unlock: unlock,
+		}
+		for _, opt := range opts {
+			opt(j)
+		}
+		ret = append(ret, j)
+	}
+	return ret, nil
+}
+
+// readRunning reads the journal |name| of |store|, returning nil if it isn't running or is
+// corrupt.
+func readRunning(store Store, name string) (*cirunnerpb.RunJournal, error) {
+	data, err := store.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	pb := &cirunnerpb.RunJournal{}
+	if err := proto.UnmarshalText(string(data), pb); err != nil {
+		log.Warningf("skipping corrupt journal %s: %v", name, err)
+		return nil, nil
+	}
+	if pb.State != cirunnerpb.RunJournal_RUNNING {
+		return nil, nil
+	}
+	return pb, nil
+}
+
+// Proto returns a copy of the journal proto.
+func (j *Journal) Proto() *cirunnerpb.RunJournal {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return proto.Clone(j.pb).(*cirunnerpb.RunJournal)
+}
+
+// CheckStarted records that a check started running.
+func (j *Journal) CheckStarted(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pb.StartedCheck = append(j.pb.StartedCheck, name)
+	return j.write()
+}
+
+// CheckCompleted records the result of a check.
+func (j *Journal) CheckCompleted(name string, result *presubmitpb.CheckResult) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pb.CompletedCheck = append(j.pb.CompletedCheck, &cirunnerpb.RunJournal_CompletedCheck{
+		Name:   name,
+		Result: result,
+	})
+	return j.write()
+}
+
+// Complete marks the run as finished.
+func (j *Journal) Complete() error {
+	return j.finish(cirunnerpb.RunJournal_COMPLETED, "")
+}
+
+// Abandon marks a crashed run as reported failed by the run |runID|. The journal is then removed
+// from the local store, remote stores keep it.
+func (j *Journal) Abandon(runID string) error {
+	return j.finish(cirunnerpb.RunJournal_ABANDONED, runID)
+}
+
+// Resume marks a crashed run as continued by the run |runID|. The journal is then removed from the
+// local store, remote stores keep it.
+func (j *Journal) Resume(runID string) error {
+	return j.finish(cirunnerpb.RunJournal_RESUMED, runID)
+}
+
+// finish sets the final state of the run and releases the lock of the journal. The local journals
+// of recovered runs are deleted.
+func (j *Journal) finish(state cirunnerpb.RunJournal_State, recoveredBy string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.release()
+	j.pb.State = state
+	j.pb.RecoveredBy = recoveredBy
+	if err := j.write(); err != nil {
+		return err
+	}
+	if recoveredBy == "" {
+		return nil
+	}
+	name := j.pb.RunId + journalSuffix
+	if err := j.local.Delete(name); err != nil {
+		return fmt.Errorf("could not delete journal %s: %v", name, err)
+	}
+	return nil
+}
+
+// release releases the lock of the journal, if it holds one.
+func (j *Journal) release() {
+	if j.unlock == nil {
+		return
+	}
+	if err := j.unlock(); err != nil {
+		log.Warningf("could not unlock journal of run %s: %v", j.pb.GetRunId(), err)
+	}
+	j.unlock = nil
+}
+
+// CompletedResults returns the results of the completed checks keyed by check name.
+func (j *Journal) CompletedResults() map[string]*presubmitpb.CheckResult {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ret := map[string]*presubmitpb.CheckResult{}
+	for _, c := range j.pb.CompletedCheck {
+		ret[c.Name] = c.Result
+	}
+	return ret
+}
+
+// InterruptedCheck returns the check that was running when the run stopped, if any.
+func (j *Journal) InterruptedCheck() (string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	completed := map[string]bool{}
+	for _, c := range j.pb.CompletedCheck {
+		completed[c.Name] = true
+	}
+	for i := len(j.pb.StartedCheck) - 1; i >= 0; i-- {
+		if name := j.pb.StartedCheck[i]; !completed[name] {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Diagnostics returns a human readable description of a crashed run.
+func (j *Journal) Diagnostics() string {
+	pb := j.Proto()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Run %s on %s (pid %d) stopped unexpectedly.\n", pb.RunId, pb.Host, pb.Pid)
+	fmt.Fprintf(&sb, "Started at %s, last update at %s.\n",
+		time.Unix(pb.StartTime, 0).UTC().Format(time.RFC3339),
+		time.Unix(pb.UpdateTime, 0).UTC().Format(time.RFC3339))
+	if name, ok := j.InterruptedCheck(); ok {
+		fmt.Fprintf(&sb, "Interrupted while running %s.\n", name)
+	}
+	fmt.Fprintf(&sb, "%d checks completed:\n", len(pb.CompletedCheck))
+	for _, c := range pb.CompletedCheck {
+		status := "FAILED"
+		if c.Result.GetOverallResult().GetSuccess() {
+			status = "PASSED"
+		}
+		fmt.Fprintf(&sb, "- %s: %s\n", c.Name, status)
+	}
+	return sb.String()
+}
+
+// write persists the journal. Must be called with the lock held.
+func (j *Journal) write() error {
+	j.pb.UpdateTime = j.clock.Now().Unix()
+	name := j.pb.RunId + journalSuffix
+	data := []byte(proto.MarshalTextString(j.pb))
+	if err := j.local.Write(name, data); err != nil {
+		return fmt.Errorf("could not write journal %s: %v", name, err)
+	}
+	for _, r := range j.remotes {
+		if err := r.Write(name, data); err != nil {
+			log.Warningf("could not mirror journal %s: %v", name, err)
+		}
+	}
+	return nil
+}
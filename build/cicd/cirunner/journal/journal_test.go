@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/clock/mockclock"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func checkResult(success bool) *presubmitpb.CheckResult {
+	return &presubmitpb.CheckResult{
+		OverallResult: &buildpb.Result{Success: success},
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := mockclock.New()
+	mc.SetTime(time.Unix(1000, 0))
+	invocation := &cirunnerpb.RunnerInvocation{
+		Presubmit: &cirunnerpb.RunnerInvocation_Presubmit{Change: 123},
+	}
+
+	// A run that crashed while running "check b".
+	crashed, err := Start("crashed", invocation, store, WithClock(mc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []func() error{
+		func() error { return crashed.CheckStarted("check a") },
+		func() error { return crashed.CheckCompleted("check a", checkResult(true)) },
+		func() error { return crashed.CheckStarted("check b") },
+	} {
+		mc.Advance(10)
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The process of a crashed run no longer holds the lock of its journal.
+	crashed.release()
+	// A run still in progress.
+	running, err := Start("running", invocation, store, WithClock(mc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A run that finished.
+	finished, err := Start("finished", invocation, store, WithClock(mc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finished.Complete(); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := Orphans(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 {
+		t.Fatalf("want 1 orphan, got %d", len(orphans))
+	}
+	orphan := orphans[0]
+	pb := orphan.Proto()
+	if pb.RunId != "crashed" || pb.Invocation.Presubmit.Change != 123 {
+		t.Errorf("unexpected orphan: %v", pb)
+	}
+	if pb.StartTime != 1000 || pb.UpdateTime != 1030 {
+		t.Errorf("want start time 1000 and update time 1030, got %d and %d", pb.StartTime, pb.UpdateTime)
+	}
+	if got, ok := orphan.InterruptedCheck(); !ok || got != "check b" {
+		t.Errorf("InterruptedCheck()=%q, %t, want %q", got, ok, "check b")
+	}
+	results := orphan.CompletedResults()
+	if diff := cmp.Diff([]string{"check a"}, keys(results)); diff != "" {
+		t.Errorf("CompletedResults() diff (-want +got):\n%s", diff)
+	}
+	diag := orphan.Diagnostics()
+	for _, want := range []string{"Interrupted while running check b", "- check a: PASSED"} {
+		if !strings.Contains(diag, want) {
+			t.Errorf("want diagnostics containing %q, got:\n%s", want, diag)
+		}
+	}
+
+	if err := orphan.Abandon("new_run"); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err = Orphans(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("want no orphans after abandoning, got %d", len(orphans))
+	}
+	// The abandoned journal is deleted, and there are no temporary or stale lock files.
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"finished" + journalSuffix, "running" + journalSuffix, "running" + journalSuffix + lockSuffix}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Errorf("store contents diff (-want +got):\n%s", diff)
+	}
+
+	// The run in progress is an orphan once its process is gone.
+	running.release()
+	orphans, err = Orphans(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].Proto().RunId != "running" {
+		t.Fatalf("want the orphan of the running run, got %d orphans", len(orphans))
+	}
+	// Orphans are locked while they are recovered.
+	if orphans, err := Orphans(store); err != nil || len(orphans) != 0 {
+		t.Errorf("Orphans() of a locked orphan = %d orphans, %v, want none", len(orphans), err)
+	}
+	if err := orphans[0].Resume("new_run"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err = store.List(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"finished" + journalSuffix}, names); diff != "" {
+		t.Errorf("store contents after resuming diff (-want +got):\n%s", diff)
+	}
+}
+
+func keys(m map[string]*presubmitpb.CheckResult) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	return ret
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"sge-monorepo/libs/go/files"
+)
+
+// Store persists journals by name.
+type Store interface {
+	// Write stores |data| under |name|, replacing any previous version. Readers must never observe
+	// a partially written journal.
+	Write(name string, data []byte) error
+
+	// Read returns the data stored under |name|.
+	Read(name string) ([]byte, error)
+
+	// List returns the names of all stored journals.
+	List() ([]string, error)
+
+	// Delete removes the journal |name|.
+	Delete(name string) error
+}
+
+// lockingStore is implemented by stores that lock the journals of the runs in progress, which
+// tells them apart from the journals of crashed runs.
+type lockingStore interface {
+	Store
+
+	// tryLock takes the lock of the journal |name| and returns the function releasing it. Returns
+	// files.ErrLocked if the run owning the journal is still alive.
+	tryLock(name string) (func() error, error)
+}
+
+// NewFileStore returns a store that keeps journals as files within |dir|.
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// DefaultDir is the local directory in which runners keep their journals.
+func DefaultDir() string {
+	return filepath.Join(os.TempDir(), "cirunner-journal")
+}
+
+type fileStore struct {
+	dir string
+}
+
+func (fs *fileStore) Write(name string, data []byte) error {
+	// Write to a temporary file and rename, so that a crash mid-write keeps the previous version.
+	tmp, err := ioutil.TempFile(fs.dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(fs.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (fs *fileStore) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(fs.dir, name))
+}
+
+func (fs *fileStore) Delete(name string) error {
+	return os.Remove(filepath.Join(fs.dir, name))
+}
+
+// tryLock locks the file "<name>.lock" next to the journal. The lock is released by the OS when
+// the process exits, so the lock of a crashed run can always be taken.
+func (fs *fileStore) tryLock(name string) (func() error, error) {
+	path := filepath.Join(fs.dir, name+lockSuffix)
+	l, err := files.TryLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		// Remove the file while holding the lock, so no other process is waiting for it.
+		os.Remove(path)
+		return l.Unlock()
+	}, nil
+}
+
+func (fs *fileStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
@@ -54,12 +54,12 @@ func NewPresubmitContext(creds *runnertool.Credentials,
 	}
 	sc := creds.Swarm
 	swarmContext := swarm.New(sc.Host, int(sc.Port), sc.Username, sc.Password)
-	// We create an SSL unaware HTTP client.
+	// We create an SSL unaware HTTP client, reusing connections across the many requests.
 	swarmContext.Client = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+		Transport: swarm.NewTransport(&tls.Config{InsecureSkipVerify: true}),
 	}
+	// The runner makes many Swarm requests, fail them fast if Swarm is down.
+	swarmContext.Breaker = swarm.NewBreaker()
 	swarmReview, err := swarm.GetReview(swarmContext, int(presubmitpb.Review))
 	if err != nil {
 		return nil, fmt.Errorf("could not get swarm review %d: %v", int(presubmitpb.Review), err)
@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"sge-monorepo/build/cicd/cirunner/queue"
+	"sge-monorepo/build/cicd/cirunner/runnertool"
+	"sge-monorepo/libs/go/cloud/monitoring"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/log/cloudlog"
+	"sge-monorepo/libs/go/p4lib"
+
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// Pull --------------------------------------------------------------------------------------------
+
+// pullRequests pulls requests from the queue of the environment and runs them, until the first
+// one with -once.
+func pullRequests(p4 p4lib.P4, cloudLogger cloudlog.CloudLogger) error {
+	pullFlagSet := flag.NewFlagSet("pull", flag.ExitOnError)
+	lanesFlag := pullFlagSet.String("lanes", "presubmit,postsubmit", "Lanes to pull requests from. Lanes are pulled by priority, presubmit first.")
+	once := pullFlagSet.Bool("once", false, "Run a single request, waiting for one if the queue is empty, then exit.")
+	poll := pullFlagSet.Duration("poll", 10*time.Second, "How often to poll the queue when it's empty.")
+	fairWindow := pullFlagSet.Int("fair_window", queue.DefaultWindow, "How many waiting presubmits to choose from to share the runners fairly between projects. 0 runs them in order.")
+	if err := pullFlagSet.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	lanes, err := queue.ParseLanes(*lanesFlag)
+	if err != nil {
+		return err
+	}
+	credentials, err := runnertool.NewCredentials()
+	if err != nil {
+		return fmt.Errorf("could not load credentials: %v", err)
+	}
+	env := credentials.Environment
+	if env.QueueProject == "" || env.QueuePrefix == "" {
+		return fmt.Errorf("no queue configured in the environment")
+	}
+	q, err := queue.NewPubSubQueue(context.Background(), env.QueueProject, env.QueuePrefix)
+	if err != nil {
+		return err
+	}
+	deduper := queue.NewDeduper(p4)
+	scheduler := queue.NewScheduler(p4)
+	scheduler.Window = *fairWindow
+	metrics := newQueueMetrics()
+	log.Infof("Pulling %v requests from %s/%s", lanes, env.QueueProject, env.QueuePrefix)
+	for {
+		msg, err := scheduler.Pull(q, lanes...)
+		if err != nil {
+			log.Warningf("could not pull request: %v", err)
+			time.Sleep(*poll)
+			continue
+		}
+		if msg == nil {
+			time.Sleep(*poll)
+			continue
+		}
+		ran, err := handleRequest(p4, cloudLogger, deduper, msg, metrics)
+		if finishErr := scheduler.Finish(msg); finishErr != nil {
+			log.Warningf("could not finish request %s: %v", msg.Key, finishErr)
+		}
+		if err != nil {
+			log.Errorf("error running request %s: %v", msg.Key, err)
+		}
+		if ran && *once {
+			return err
+		}
+	}
+}
+
+// handleRequest runs the request of |msg| unless it's a duplicate, and returns whether it ran.
+// Requests are acked before running: runs are longer than the ack deadlines of the queue, and a
+// runner crashing midway is handled by the run journal, not by running the request again.
+func handleRequest(p4 p4lib.P4, cloudLogger cloudlog.CloudLogger, deduper *queue.Deduper, msg *queue.Message, metrics *monitoring.Client) (bool, error) {
+	claimed, err := deduper.Claim(msg.Request)
+	if err != nil {
+		if nackErr := msg.Nack(); nackErr != nil {
+			log.Warningf("could not give back request %s: %v", msg.Key, nackErr)
+		}
+		return false, fmt.Errorf("could not claim request: %v", err)
+	}
+	if err := msg.Ack(); err != nil {
+		return false, fmt.Errorf("could not ack request: %v", err)
+	}
+	if !claimed {
+		log.Infof("Dropping request %s, a duplicate of a run already started.", msg.Key)
+		return false, nil
+	}
+	wait := time.Since(time.Unix(0, msg.EnqueueTime))
+	if msg.Project != "" {
+		log.Infof("Running %s request %s of project %s, waited %v", msg.Lane, msg.Key, msg.Project, wait)
+		sendQueueWait(metrics, msg.Project, wait)
+	} else {
+		log.Infof("Running %s request %s, waited %v", msg.Lane, msg.Key, wait)
+	}
+	return true, runInvocation(p4, cloudLogger, msg.Invocation)
+}
+
+// queueWaitMetric is the time presubmit requests waited in the queue, by project.
+const queueWaitMetric = "cirunner/queue_wait"
+
+// newQueueMetrics returns the client queue waits are sent with, nil if metrics are unavailable,
+// eg. outside of GCE.
+func newQueueMetrics() *monitoring.Client {
+	metrics, err := monitoring.NewFromDefaultProject()
+	if err != nil {
+		log.Warningf("not sending queue metrics: %v", err)
+		return nil
+	}
+	if _, ok, err := metrics.GetCustomMetric(queueWaitMetric); err != nil {
+		log.Warningf("not sending queue metrics: could not get metric %q: %v", queueWaitMetric, err)
+		return nil
+	} else if !ok {
+		metric := &metricpb.MetricDescriptor{
+			Type: "custom.googleapis.com/" + queueWaitMetric,
+			Labels: []*labelpb.LabelDescriptor{
+				{
+					Key:         "project",
+					ValueType:   labelpb.LabelDescriptor_STRING,
+					Description: "Project of the presubmit",
+				},
+			},
+			MetricKind:  metricpb.MetricDescriptor_GAUGE,
+			ValueType:   metricpb.MetricDescriptor_INT64,
+			Unit:        "ms",
+			Description: "Milliseconds a presubmit request waited in the queue before running",
+		}
+		if _, err := metrics.CreateMetric(metric); err != nil {
+			log.Warningf("not sending queue metrics: could not create metric %q: %v", queueWaitMetric, err)
+			return nil
+		}
+	}
+	return metrics
+}
+
+func sendQueueWait(metrics *monitoring.Client, project string, wait time.Duration) {
+	if metrics == nil {
+		return
+	}
+	if err := metrics.SendInt64(monitoring.FromGCEInstance, queueWaitMetric, wait.Milliseconds(), monitoring.Label{Key: "project", Value: project}); err != nil {
+		log.Warningf("could not send queue wait of %s: %v", project, err)
+	}
+}
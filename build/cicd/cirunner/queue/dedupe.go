@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// claimKeyPrefix prefixes the p4 keys in which runners record the requests they started.
+const claimKeyPrefix = "cirunner-queue-"
+
+// Deduper collapses duplicate requests across runners. Runners claim every request they pull
+// before running it: the claim records when a runner started on the key of the request, and
+// requests with that key enqueued earlier are duplicates of the run.
+// Claims are kept in p4 keys, so clocks of Ebert and runners are assumed to be in sync.
+type Deduper struct {
+	p4  p4lib.P4
+	now func() time.Time
+}
+
+// NewDeduper returns a deduper keeping claims in the p4 keys of |p4|.
+func NewDeduper(p4 p4lib.P4) *Deduper {
+	return &Deduper{p4: p4, now: time.Now}
+}
+
+// Claim returns whether the caller should run |req|. It returns false when |req| is a duplicate
+// of a run already started, or when another runner claimed the same key concurrently.
+func (d *Deduper) Claim(req *Request) (bool, error) {
+	key := claimKeyPrefix + req.Key
+	current, err := d.p4.KeyGet(key)
+	if errors.Is(err, p4lib.ErrKeyNotFound) || (err == nil && current == "0") {
+		// Check-and-set can't create keys, but increments can, atomically: only the runner that
+		// creates the key gets "1".
+		current, err = d.p4.KeyInc(key)
+		if err != nil {
+			return false, fmt.Errorf("could not create claim %s: %v", key, err)
+		}
+		if current != "1" {
+			return false, nil
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("could not read claim %s: %v", key, err)
+	}
+	started, err := strconv.ParseInt(current, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid claim %s=%q: %v", key, current, err)
+	}
+	if req.EnqueueTime <= started {
+		return false, nil
+	}
+	now := strconv.FormatInt(d.now().UnixNano(), 10)
+	if err := d.p4.KeyCas(key, current, now); errors.Is(err, p4lib.ErrCasMismatch) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not claim %s: %v", key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,481 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+const (
+	// fairNamespace is the namespace of the p4 keys holding the projects and what they run.
+	fairNamespace = "cirunner-fair"
+	// DefaultProject is the project of the presubmits outside the paths of all projects.
+	DefaultProject = "default"
+	// DefaultWindow is how many waiting presubmits a scheduler chooses from.
+	DefaultWindow = 10
+	// staleRun is how long after its start a run is assumed to have crashed without finishing,
+	// and stops counting against its project.
+	staleRun = 12 * time.Hour
+	// fallbackScan is how many more waiting presubmits a scheduler looks at, in order, when those
+	// of its window all belong to projects over quota.
+	fallbackScan = 100
+	// maxCachedProjects bounds the number of requests whose project a scheduler caches.
+	maxCachedProjects = 10000
+	// projectCacheTTL is how long the project of a request is cached. Requests that are never run
+	// by this scheduler, eg. pulled by other runners, expire after it.
+	projectCacheTTL = staleRun
+)
+
+// Project is a part of the depot whose presubmits share a concurrency quota and a weighted share of
+// the runners.
+type Project struct {
+	Name string `json:"name"`
+	// Paths are depot path prefixes, eg. "//depot/game/". A presubmit belongs to the project with
+	// the most files of the change.
+	Paths []string `json:"paths"`
+	// Weight is the share of the runners the project gets relative to the other projects that
+	// have presubmits waiting. Defaults to 1.
+	Weight float64 `json:"weight,omitempty"`
+	// MaxRunning caps the presubmits of the project running at once, 0 meaning no cap.
+	MaxRunning int `json:"max_running,omitempty"`
+}
+
+func (p *Project) weight() float64 {
+	if p == nil || p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// projects is the value of the "projects" key.
+type projects struct {
+	Projects []*Project `json:"projects"`
+}
+
+func (ps *projects) find(name string) *Project {
+	for _, p := range ps.Projects {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// runs is the value of the "running-<project>" keys: the start time in unix nanoseconds of the
+// presubmits of the project running, by request key.
+type runs struct {
+	Running map[string]int64 `json:"running"`
+}
+
+// count returns the number of runs that aren't stale.
+func (r *runs) count(now time.Time) int {
+	n := 0
+	for _, started := range r.Running {
+		if now.Sub(time.Unix(0, started)) < staleRun {
+			n++
+		}
+	}
+	return n
+}
+
+// ProjectStatus is a project with the number of its presubmits running.
+type ProjectStatus struct {
+	Project
+	Running int `json:"running"`
+}
+
+// errOverQuota is returned when a project has as many presubmits running as its quota allows.
+var errOverQuota = errors.New("project over quota")
+
+// Scheduler pulls presubmit requests fairly between projects, so that the massive changes of a
+// team don't starve the presubmits of everybody else. Of the requests waiting it runs the one of
+// the project with the fewest presubmits running relative to its weight, and skips projects that
+// reached their quota. The projects and their running presubmits are kept in p4 keys shared by all
+// runners, and projects can be changed at runtime with SetProject.
+type Scheduler struct {
+	p4    p4lib.P4
+	store *p4lib.KeyStore
+	// Window is how many waiting presubmits are pulled to choose from.
+	Window int
+	now    func() time.Time
+
+	mu sync.Mutex
+	// byKey caches the project of requests, which takes a describe of their change.
+	byKey map[string]cachedProject
+}
+
+// cachedProject is the project of a request and when it was computed.
+type cachedProject struct {
+	name string
+	at   time.Time
+}
+
+// NewScheduler returns a scheduler keeping its state in the p4 keys of |p4|.
+func NewScheduler(p4 p4lib.P4) *Scheduler {
+	return &Scheduler{
+		p4:     p4,
+		store:  p4lib.NewKeyStore(p4, fairNamespace),
+		Window: DefaultWindow,
+		now:    time.Now,
+		byKey:  map[string]cachedProject{},
+	}
+}
+
+func (s *Scheduler) projects() (*projects, error) {
+	ps := &projects{}
+	if _, err := s.store.Get("projects", ps); err != nil {
+		return nil, fmt.Errorf("could not read projects: %v", err)
+	}
+	return ps, nil
+}
+
+// SetProject adds project |p| or replaces the project with the same name.
+func (s *Scheduler) SetProject(p *Project) error {
+	if p.Name == "" {
+		return fmt.Errorf("project without name")
+	}
+	// The default project can have a weight and a quota, its paths are the ones of no project.
+	if p.Name == DefaultProject && len(p.Paths) > 0 {
+		return fmt.Errorf("the %s project can't have paths", DefaultProject)
+	}
+	if p.Weight < 0 || p.MaxRunning < 0 {
+		return fmt.Errorf("project %s: weight and max running can't be negative", p.Name)
+	}
+	ps := &projects{}
+	return s.store.Update("projects", ps, func() error {
+		for i, existing := range ps.Projects {
+			if existing.Name == p.Name {
+				ps.Projects[i] = p
+				return nil
+			}
+		}
+		ps.Projects = append(ps.Projects, p)
+		sort.Slice(ps.Projects, func(i, j int) bool { return ps.Projects[i].Name < ps.Projects[j].Name })
+		return nil
+	})
+}
+
+// Status returns the projects with the number of their presubmits running, the default project
+// last.
+func (s *Scheduler) Status() ([]ProjectStatus, error) {
+	ps, err := s.projects()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, p := range ps.Projects {
+		names = append(names, p.Name)
+	}
+	if ps.find(DefaultProject) == nil {
+		names = append(names, DefaultProject)
+	}
+	var ret []ProjectStatus
+	for _, name := range names {
+		r, err := s.runs(name)
+		if err != nil {
+			return nil, err
+		}
+		st := ProjectStatus{Project: Project{Name: name}, Running: r.count(s.now())}
+		if p := ps.find(name); p != nil {
+			st.Project = *p
+		}
+		ret = append(ret, st)
+	}
+	return ret, nil
+}
+
+func (s *Scheduler) runs(project string) (*runs, error) {
+	r := &runs{}
+	if _, err := s.store.Get("running-"+project, r); err != nil {
+		return nil, fmt.Errorf("could not read running presubmits of %s: %v", project, err)
+	}
+	return r, nil
+}
+
+// projectOf returns the project of the presubmit request |req|, from the files of its change.
+func (s *Scheduler) projectOf(ps *projects, req *Request) (string, error) {
+	s.mu.Lock()
+	cached, ok := s.byKey[req.Key]
+	s.mu.Unlock()
+	if ok && s.now().Sub(cached.at) < projectCacheTTL {
+		return cached.name, nil
+	}
+	cl := int(req.Invocation.GetPresubmit().GetChange())
+	if cl == 0 {
+		return DefaultProject, nil
+	}
+	// Presubmits run on shelved changes, submitted ones have no shelf.
+	descs, err := s.p4.DescribeShelved(cl)
+	if err != nil || len(descs) == 0 || len(descs[0].Files) == 0 {
+		if descs, err = s.p4.Describe([]int{cl}); err != nil {
+			return "", fmt.Errorf("could not describe change %d: %v", cl, err)
+		}
+	}
+	name := DefaultProject
+	if len(descs) > 0 {
+		name = projectOfFiles(ps, descs[0].Files)
+	}
+	s.cacheProject(req.Key, name)
+	return name, nil
+}
+
+// cacheProject caches |name| as the project of the request with |key|. Expired entries are dropped
+// when the cache is full, and the whole cache if they aren't enough.
+func (s *Scheduler) cacheProject(key, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if len(s.byKey) >= maxCachedProjects {
+		for k, c := range s.byKey {
+			if now.Sub(c.at) >= projectCacheTTL {
+				delete(s.byKey, k)
+			}
+		}
+		if len(s.byKey) >= maxCachedProjects {
+			s.byKey = map[string]cachedProject{}
+		}
+	}
+	s.byKey[key] = cachedProject{name: name, at: now}
+}
+
+// projectOfFiles returns the project with the most of |files|.
+func projectOfFiles(ps *projects, files []p4lib.FileAction) string {
+	counts := map[string]int{}
+	for _, f := range files {
+		for _, p := range ps.Projects {
+			if matchesProject(p, f.DepotPath) {
+				counts[p.Name]++
+				break
+			}
+		}
+	}
+	best := DefaultProject
+	for _, p := range ps.Projects {
+		if counts[p.Name] > counts[best] {
+			best = p.Name
+		}
+	}
+	return best
+}
+
+func matchesProject(p *Project, depotPath string) bool {
+	for _, prefix := range p.Paths {
+		if strings.HasPrefix(depotPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidate is a pulled request and its project.
+type candidate struct {
+	msg     *Message
+	project string
+}
+
+// Pull pulls the next request from |q|. Requests of lanes other than the presubmit lane are pulled
+// in order. Of the waiting presubmits, up to Window are pulled, the one to run is chosen and
+// counted against its project, and the others are given back as soon as it is. If the projects of
+// all of them are over quota, the presubmits after them are looked at in order, and the first one
+// of a project under quota runs. Returns nil if no request can run, eg. when all waiting
+// presubmits belong to projects over quota. The Project of the chosen request is set, and Finish
+// must be called once it's done.
+func (s *Scheduler) Pull(q Queue, lanes ...Lane) (*Message, error) {
+	for _, lane := range lanes {
+		if lane != LanePresubmit || s.Window <= 0 {
+			msg, err := q.Pull(lane)
+			if err != nil || msg != nil {
+				return msg, err
+			}
+			continue
+		}
+		msg, err := s.pullPresubmit(q)
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *Scheduler) pullPresubmit(q Queue) (*Message, error) {
+	pulled, err := pullN(q, s.Window)
+	if err != nil || len(pulled) == 0 {
+		return nil, err
+	}
+	ps, err := s.projects()
+	if err != nil {
+		giveBack(pulled)
+		return nil, err
+	}
+	full := map[string]bool{}
+	chosen, err := s.choose(ps, s.candidates(ps, pulled), full)
+	if err == nil && chosen == nil {
+		// Rather than leaving the runner idle while the requests of other projects wait behind
+		// the window, fall back to the following requests in order.
+		var more []*Message
+		more, err = pullN(q, fallbackScan)
+		pulled = append(pulled, more...)
+		if err == nil {
+			chosen, err = s.startFirst(ps, s.candidates(ps, more), full)
+		}
+	}
+	var rest []*Message
+	for _, m := range pulled {
+		if chosen == nil || m != chosen.msg {
+			rest = append(rest, m)
+		}
+	}
+	giveBack(rest)
+	if err != nil || chosen == nil {
+		return nil, err
+	}
+	chosen.msg.Project = chosen.project
+	return chosen.msg, nil
+}
+
+// pullN pulls up to |n| presubmit requests from |q|, fewer if it runs out of them. Nothing is held
+// on errors.
+func pullN(q Queue, n int) ([]*Message, error) {
+	var pulled []*Message
+	for len(pulled) < n {
+		msg, err := q.Pull(LanePresubmit)
+		if err != nil {
+			giveBack(pulled)
+			return nil, err
+		}
+		if msg == nil {
+			break
+		}
+		pulled = append(pulled, msg)
+	}
+	return pulled, nil
+}
+
+// candidates returns the requests of |msgs| with their projects, in order.
+func (s *Scheduler) candidates(ps *projects, msgs []*Message) []*candidate {
+	var ret []*candidate
+	for _, m := range msgs {
+		name, err := s.projectOf(ps, m.Request)
+		if err != nil {
+			// Rather than holding the request, run it as part of the default project.
+			log.Warningf("could not get project of %s: %v", m.Key, err)
+			name = DefaultProject
+		}
+		ret = append(ret, &candidate{msg: m, project: name})
+	}
+	return ret
+}
+
+// choose returns the request to run among |candidates| and counts it against its project. Returns
+// nil if all their projects are over quota, which are added to |full|.
+func (s *Scheduler) choose(ps *projects, candidates []*candidate, full map[string]bool) (*candidate, error) {
+	running := map[string]int{}
+	for _, c := range candidates {
+		if _, ok := running[c.project]; ok {
+			continue
+		}
+		r, err := s.runs(c.project)
+		if err != nil {
+			return nil, err
+		}
+		running[c.project] = r.count(s.now())
+	}
+	// Oldest requests first among projects with the same share, so that a project's requests
+	// run in order.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		si := float64(running[ci.project]) / ps.find(ci.project).weight()
+		sj := float64(running[cj.project]) / ps.find(cj.project).weight()
+		if si != sj {
+			return si < sj
+		}
+		return ci.msg.EnqueueTime < cj.msg.EnqueueTime
+	})
+	return s.startFirst(ps, candidates, full)
+}
+
+// startFirst starts the first of |candidates| whose project isn't over quota and returns it, or
+// nil if there is none. Projects found over quota are added to |full| and skipped afterwards.
+func (s *Scheduler) startFirst(ps *projects, candidates []*candidate, full map[string]bool) (*candidate, error) {
+	for _, c := range candidates {
+		if full[c.project] {
+			continue
+		}
+		err := s.start(ps.find(c.project), c.project, c.msg.Key)
+		if errors.Is(err, errOverQuota) {
+			full[c.project] = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+// start counts the request with |key| as running in |project|, unless the project is over quota.
+func (s *Scheduler) start(p *Project, project, key string) error {
+	r := &runs{}
+	return s.store.Update("running-"+project, r, func() error {
+		now := s.now()
+		for k, started := range r.Running {
+			if now.Sub(time.Unix(0, started)) >= staleRun {
+				delete(r.Running, k)
+			}
+		}
+		if p != nil && p.MaxRunning > 0 && len(r.Running) >= p.MaxRunning {
+			return errOverQuota
+		}
+		if r.Running == nil {
+			r.Running = map[string]int64{}
+		}
+		r.Running[key] = now.UnixNano()
+		return nil
+	})
+}
+
+// Finish stops counting the request of |msg| against its project.
+func (s *Scheduler) Finish(msg *Message) error {
+	if msg.Project == "" {
+		return nil
+	}
+	s.mu.Lock()
+	delete(s.byKey, msg.Key)
+	s.mu.Unlock()
+	r := &runs{}
+	return s.store.Update("running-"+msg.Project, r, func() error {
+		delete(r.Running, msg.Key)
+		return nil
+	})
+}
+
+// giveBack nacks |msgs|, logging failures: the requests are delivered again at the end of their
+// ack deadline anyway.
+func giveBack(msgs []*Message) {
+	for _, m := range msgs {
+		if err := m.Nack(); err != nil {
+			log.Warningf("could not give back request %s: %v", m.Key, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// fairP4 has a change per CL touching the files of |changes|, and keys.
+type fairP4 struct {
+	*keysP4
+	changes map[int][]string
+}
+
+func (p4 *fairP4) KeySet(key, value string) error {
+	p4.mu.Lock()
+	defer p4.mu.Unlock()
+	p4.keys[key] = value
+	return nil
+}
+
+func (p4 *fairP4) DescribeShelved(cls ...int) ([]p4lib.Description, error) {
+	desc := p4lib.Description{Cl: cls[0]}
+	for _, f := range p4.changes[cls[0]] {
+		desc.Files = append(desc.Files, p4lib.FileAction{DepotPath: f})
+	}
+	return []p4lib.Description{desc}, nil
+}
+
+func (p4 *fairP4) Describe(cls []int) ([]p4lib.Description, error) {
+	return p4.DescribeShelved(cls...)
+}
+
+func TestScheduler(t *testing.T) {
+	p4 := &fairP4{
+		keysP4: &keysP4{keys: map[string]string{}},
+		changes: map[int][]string{
+			1: {"//depot/game/a.cc", "//depot/game/b.cc"},
+			2: {"//depot/game/c.cc"},
+			3: {"//depot/game/d.cc", "//depot/tools/x.go"},
+			4: {"//depot/tools/y.go"},
+			5: {"//depot/docs/z.md"},
+		},
+	}
+	s := NewScheduler(p4)
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	for _, p := range []*Project{
+		{Name: "game", Paths: []string{"//depot/game/"}, MaxRunning: 2},
+		{Name: "tools", Paths: []string{"//depot/tools/"}, Weight: 2},
+	} {
+		if err := s.SetProject(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetProject(&Project{Name: DefaultProject, Paths: []string{"//depot/"}}); err == nil {
+		t.Error("SetProject() of the default project with paths succeeded, want error")
+	}
+
+	q := NewMemoryQueue()
+	for _, cl := range []int64{1, 2, 3, 4} {
+		if err := q.Enqueue(NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: cl, Change: cl})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Enqueue(NewPostsubmitRequest()); err != nil {
+		t.Fatal(err)
+	}
+	pull := func(wantCl int64, wantProject string) *Message {
+		t.Helper()
+		msg, err := s.Pull(q, LanePresubmit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantCl == 0 {
+			if msg != nil {
+				t.Fatalf("Pull() = change %d, want none", msg.Invocation.Change)
+			}
+			return nil
+		}
+		if msg == nil {
+			t.Fatalf("Pull() = none, want change %d", wantCl)
+		}
+		if msg.Invocation.Change != wantCl || msg.Project != wantProject {
+			t.Fatalf("Pull() = change %d of %s, want change %d of %s", msg.Invocation.Change, msg.Project, wantCl, wantProject)
+		}
+		if err := msg.Ack(); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	// The oldest request first when nothing runs.
+	first := pull(1, "game")
+	// Then the other project, whose share is lower, even though its request is newer.
+	pull(4, "tools")
+	pull(2, "game")
+	// Game reached its quota.
+	pull(0, "")
+	if depth, err := q.Depth(); err != nil || depth[LanePresubmit] != 1 {
+		t.Errorf("Depth() = %v, %v, want the held request given back", depth, err)
+	}
+
+	status, err := s.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := map[string]int{}
+	for _, st := range status {
+		running[st.Name] = st.Running
+	}
+	if running["game"] != 2 || running["tools"] != 1 || running[DefaultProject] != 0 || len(running) != 3 {
+		t.Errorf("Status() running = %v, want game: 2, tools: 1, default: 0", running)
+	}
+
+	if err := s.Finish(first); err != nil {
+		t.Fatal(err)
+	}
+	// Change 3 touches more game files than tools files.
+	pull(3, "game")
+
+	// Runs that never finished stop counting after a while.
+	now = now.Add(staleRun)
+	if err := q.Enqueue(NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 5, Change: 5})); err != nil {
+		t.Fatal(err)
+	}
+	pull(5, DefaultProject)
+
+	// Other lanes are pulled in order.
+	msg, err := s.Pull(q, LanePresubmit, LanePostsubmit)
+	if err != nil || msg == nil || msg.Lane != LanePostsubmit || msg.Project != "" {
+		t.Errorf("Pull() = %+v, %v, want the postsubmit request", msg, err)
+	}
+}
+
+func TestSchedulerFallback(t *testing.T) {
+	p4 := &fairP4{
+		keysP4: &keysP4{keys: map[string]string{}},
+		changes: map[int][]string{
+			1: {"//depot/game/a.cc"},
+			2: {"//depot/game/b.cc"},
+			3: {"//depot/game/c.cc"},
+			4: {"//depot/tools/x.go"},
+		},
+	}
+	s := NewScheduler(p4)
+	s.Window = 2
+	if err := s.SetProject(&Project{Name: "game", Paths: []string{"//depot/game/"}, MaxRunning: 1}); err != nil {
+		t.Fatal(err)
+	}
+	q := NewMemoryQueue()
+	for _, cl := range []int64{1, 2, 3, 4} {
+		if err := q.Enqueue(NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: cl, Change: cl})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []int64
+	for {
+		msg, err := s.Pull(q, LanePresubmit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			break
+		}
+		got = append(got, msg.Invocation.Change)
+		if err := msg.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Game is over quota after change 1, the tools change behind the window runs anyway.
+	if len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Errorf("Pull() = changes %v, want 1 and 4", got)
+	}
+	if depth, err := q.Depth(); err != nil || depth[LanePresubmit] != 2 {
+		t.Errorf("Depth() = %v, %v, want the game requests given back", depth, err)
+	}
+}
+
+func TestSchedulerProjectCache(t *testing.T) {
+	s := NewScheduler(&fairP4{keysP4: &keysP4{keys: map[string]string{}}})
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	for i := 0; i < maxCachedProjects; i++ {
+		s.cacheProject(fmt.Sprint(i), DefaultProject)
+	}
+	now = now.Add(projectCacheTTL)
+	s.cacheProject("new", DefaultProject)
+	if len(s.byKey) != 1 {
+		t.Errorf("cached %d projects, want the expired ones dropped", len(s.byKey))
+	}
+	for i := 1; i < maxCachedProjects; i++ {
+		s.cacheProject(fmt.Sprint(i), DefaultProject)
+	}
+	s.cacheProject("newer", DefaultProject)
+	if len(s.byKey) > maxCachedProjects {
+		t.Errorf("cached %d projects, want at most %d", len(s.byKey), maxCachedProjects)
+	}
+}
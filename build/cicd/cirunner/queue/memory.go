@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NewMemoryQueue returns a queue kept in memory, for tests and local development. Requests whose
+// key is already waiting in their lane are dropped.
+func NewMemoryQueue() Queue {
+	return &memoryQueue{lanes: map[Lane][]*Request{}, pulled: map[*Request]bool{}}
+}
+
+type memoryQueue struct {
+	mu    sync.Mutex
+	lanes map[Lane][]*Request
+	// pulled are the requests pulled but not acked yet, which aren't given to other runners.
+	pulled map[*Request]bool
+	last   int64
+}
+
+func (mq *memoryQueue) Enqueue(req *Request) error {
+	if !isLane(req.Lane) {
+		return fmt.Errorf("unknown lane %q", req.Lane)
+	}
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	for _, r := range mq.lanes[req.Lane] {
+		if r.Key == req.Key && !mq.pulled[r] {
+			return nil
+		}
+	}
+	// Keep enqueue times strictly increasing, so that requests enqueued in a row are ordered.
+	now := time.Now().UnixNano()
+	if now <= mq.last {
+		now = mq.last + 1
+	}
+	mq.last = now
+	req.EnqueueTime = now
+	mq.lanes[req.Lane] = append(mq.lanes[req.Lane], req)
+	return nil
+}
+
+func (mq *memoryQueue) Pull(lanes ...Lane) (*Message, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	for _, lane := range lanes {
+		for _, r := range mq.lanes[lane] {
+			if mq.pulled[r] {
+				continue
+			}
+			req := r
+			mq.pulled[req] = true
+			return &Message{
+				Request: req,
+				ack: func() error {
+					mq.remove(req)
+					return nil
+				},
+				nack: func() error {
+					mq.mu.Lock()
+					defer mq.mu.Unlock()
+					delete(mq.pulled, req)
+					return nil
+				},
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (mq *memoryQueue) remove(req *Request) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	delete(mq.pulled, req)
+	reqs := mq.lanes[req.Lane]
+	for i, r := range reqs {
+		if r == req {
+			mq.lanes[req.Lane] = append(reqs[:i:i], reqs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (mq *memoryQueue) Depth() (map[Lane]int, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	depth := map[Lane]int{}
+	for _, lane := range Lanes {
+		n := 0
+		for _, r := range mq.lanes[lane] {
+			if !mq.pulled[r] {
+				n++
+			}
+		}
+		depth[lane] = n
+	}
+	return depth, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+
+	"github.com/golang/protobuf/proto"
+	monitoring "google.golang.org/api/monitoring/v3"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// Attributes of the Pub/Sub messages of requests.
+const (
+	keyAttribute  = "key"
+	laneAttribute = "lane"
+)
+
+// NewPubSubQueue returns a queue in Cloud Pub/Sub project |project|. Every lane is a topic named
+// "<prefix>-<lane>" with a subscription of the same name that runners pull from.
+// Pulled requests must be acked or nacked within the ack deadline of the subscriptions, otherwise
+// they are delivered again.
+func NewPubSubQueue(ctx context.Context, project, prefix string) (Queue, error) {
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Pub/Sub client: %v", err)
+	}
+	mon, err := monitoring.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create monitoring client: %v", err)
+	}
+	return &pubSubQueue{
+		ctx:     ctx,
+		ps:      ps,
+		mon:     mon,
+		project: project,
+		prefix:  prefix,
+	}, nil
+}
+
+type pubSubQueue struct {
+	ctx     context.Context
+	ps      *pubsub.Service
+	mon     *monitoring.Service
+	project string
+	prefix  string
+}
+
+func (pq *pubSubQueue) topic(lane Lane) string {
+	return fmt.Sprintf("projects/%s/topics/%s-%s", pq.project, pq.prefix, lane)
+}
+
+func (pq *pubSubQueue) subscriptionID(lane Lane) string {
+	return fmt.Sprintf("%s-%s", pq.prefix, lane)
+}
+
+func (pq *pubSubQueue) subscription(lane Lane) string {
+	return fmt.Sprintf("projects/%s/subscriptions/%s", pq.project, pq.subscriptionID(lane))
+}
+
+func (pq *pubSubQueue) Enqueue(req *Request) error {
+	if !isLane(req.Lane) {
+		return fmt.Errorf("unknown lane %q", req.Lane)
+	}
+	data, err := proto.Marshal(req.Invocation)
+	if err != nil {
+		return fmt.Errorf("could not marshal invocation: %v", err)
+	}
+	msg := &pubsub.PubsubMessage{
+		Data: base64.StdEncoding.EncodeToString(data),
+		Attributes: map[string]string{
+			keyAttribute:  req.Key,
+			laneAttribute: string(req.Lane),
+		},
+	}
+	call := pq.ps.Projects.Topics.Publish(pq.topic(req.Lane), &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{msg}})
+	if _, err := call.Context(pq.ctx).Do(); err != nil {
+		return fmt.Errorf("could not publish to %s: %v", pq.topic(req.Lane), err)
+	}
+	// Pub/Sub sets the publish time, which is what runners see as the enqueue time.
+	req.EnqueueTime = time.Now().UnixNano()
+	return nil
+}
+
+func (pq *pubSubQueue) Pull(lanes ...Lane) (*Message, error) {
+	for _, lane := range lanes {
+		sub := pq.subscription(lane)
+		call := pq.ps.Projects.Subscriptions.Pull(sub, &pubsub.PullRequest{
+			MaxMessages:       1,
+			ReturnImmediately: true,
+		})
+		resp, err := call.Context(pq.ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("could not pull from %s: %v", sub, err)
+		}
+		if len(resp.ReceivedMessages) == 0 {
+			continue
+		}
+		rm := resp.ReceivedMessages[0]
+		req, err := parseMessage(lane, rm.Message)
+		if err != nil {
+			// A message we can't parse would be delivered forever, drop it.
+			if ackErr := pq.ack(sub, rm.AckId); ackErr != nil {
+				return nil, fmt.Errorf("could not drop invalid message %s: %v", rm.Message.MessageId, ackErr)
+			}
+			return nil, fmt.Errorf("dropped invalid message %s from %s: %v", rm.Message.MessageId, sub, err)
+		}
+		ackID := rm.AckId
+		return &Message{
+			Request: req,
+			ack: func() error {
+				return pq.ack(sub, ackID)
+			},
+			nack: func() error {
+				// A zero deadline makes the message available again right away.
+				_, err := pq.ps.Projects.Subscriptions.ModifyAckDeadline(sub, &pubsub.ModifyAckDeadlineRequest{
+					AckIds:          []string{ackID},
+					ForceSendFields: []string{"AckDeadlineSeconds"},
+				}).Context(pq.ctx).Do()
+				return err
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+func (pq *pubSubQueue) ack(sub, ackID string) error {
+	_, err := pq.ps.Projects.Subscriptions.Acknowledge(sub, &pubsub.AcknowledgeRequest{AckIds: []string{ackID}}).Context(pq.ctx).Do()
+	return err
+}
+
+// parseMessage returns the request of Pub/Sub message |msg| pulled from |lane|.
+func parseMessage(lane Lane, msg *pubsub.PubsubMessage) (*Request, error) {
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode data: %v", err)
+	}
+	invocation := &cirunnerpb.RunnerInvocation{}
+	if err := proto.Unmarshal(data, invocation); err != nil {
+		return nil, fmt.Errorf("could not unmarshal invocation: %v", err)
+	}
+	published, err := time.Parse(time.RFC3339Nano, msg.PublishTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publish time %q: %v", msg.PublishTime, err)
+	}
+	return &Request{
+		Lane:        lane,
+		Key:         msg.Attributes[keyAttribute],
+		Invocation:  invocation,
+		EnqueueTime: published.UnixNano(),
+	}, nil
+}
+
+// Depth returns the number of undelivered messages of the subscriptions, from Cloud Monitoring.
+// The metric is sampled every minute, so it lags behind the queue by a couple of minutes.
+func (pq *pubSubQueue) Depth() (map[Lane]int, error) {
+	end := time.Now()
+	start := end.Add(-10 * time.Minute)
+	depth := map[Lane]int{}
+	for _, lane := range Lanes {
+		filter := fmt.Sprintf(`metric.type="pubsub.googleapis.com/subscription/num_undelivered_messages" AND resource.labels.subscription_id="%s"`, pq.subscriptionID(lane))
+		resp, err := pq.mon.Projects.TimeSeries.List("projects/" + pq.project).
+			Filter(filter).
+			IntervalStartTime(start.Format(time.RFC3339)).
+			IntervalEndTime(end.Format(time.RFC3339)).
+			Context(pq.ctx).
+			Do()
+		if err != nil {
+			return nil, fmt.Errorf("could not get depth of %s: %v", pq.subscriptionID(lane), err)
+		}
+		depth[lane] = 0
+		// Points are returned newest first.
+		for _, ts := range resp.TimeSeries {
+			if len(ts.Points) > 0 && ts.Points[0].Value != nil && ts.Points[0].Value.Int64Value != nil {
+				depth[lane] = int(*ts.Points[0].Value.Int64Value)
+			}
+		}
+	}
+	return depth, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue is a transport for CI requests that doesn't go through Jenkins: Ebert enqueues
+// presubmit and postsubmit requests and runners pull them directly.
+//
+// Requests go into priority lanes. Runners pull from the presubmit lane first, and only take
+// postsubmit requests when no presubmit is waiting. Requests for the same work, eg. two presubmit
+// requests for the same change, are collapsed by a Deduper.
+package queue
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strings"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/jenkins"
+)
+
+// Lane is a priority lane of a queue.
+type Lane string
+
+const (
+	LanePresubmit  Lane = "presubmit"
+	LanePostsubmit Lane = "postsubmit"
+)
+
+// Lanes are all the lanes, by decreasing priority.
+var Lanes = []Lane{LanePresubmit, LanePostsubmit}
+
+// ParseLanes parses a comma separated list of lanes, eg. "presubmit,postsubmit". The lanes are
+// returned by decreasing priority, whatever their order in |s|.
+func ParseLanes(s string) ([]Lane, error) {
+	wanted := map[Lane]bool{}
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if !isLane(Lane(l)) {
+			return nil, fmt.Errorf("unknown lane %q", l)
+		}
+		wanted[Lane(l)] = true
+	}
+	var lanes []Lane
+	for _, l := range Lanes {
+		if wanted[l] {
+			lanes = append(lanes, l)
+		}
+	}
+	if len(lanes) == 0 {
+		return nil, fmt.Errorf("no lanes in %q", s)
+	}
+	return lanes, nil
+}
+
+func isLane(l Lane) bool {
+	for _, lane := range Lanes {
+		if l == lane {
+			return true
+		}
+	}
+	return false
+}
+
+// Request is a request for a runner.
+type Request struct {
+	Lane Lane
+	// Key identifies the work requested. Requests with the same key enqueued before a runner
+	// started on one of them are duplicates.
+	Key string
+	// Invocation is what cirunner runs for the request.
+	Invocation *cirunnerpb.RunnerInvocation
+	// EnqueueTime is the time the request was enqueued at in unix nanoseconds, set by the queue.
+	EnqueueTime int64
+	// Project is the project the request was counted against when pulled by a Scheduler.
+	Project string
+}
+
+// NewPresubmitRequest returns the request of presubmit |presubmitpb|.
+func NewPresubmitRequest(presubmitpb *cirunnerpb.RunnerInvocation_Presubmit) *Request {
+	key := fmt.Sprintf("presubmit-%d-%d", presubmitpb.Review, presubmitpb.Change)
+	if len(presubmitpb.Only) > 0 {
+		only := append([]string{}, presubmitpb.Only...)
+		sort.Strings(only)
+		sum := sha1.Sum([]byte(strings.Join(only, ",")))
+		key += fmt.Sprintf("-%x", sum[:4])
+	}
+	return &Request{
+		Lane: LanePresubmit,
+		Key:  key,
+		Invocation: &cirunnerpb.RunnerInvocation{
+			Change:    presubmitpb.Change,
+			Presubmit: presubmitpb,
+		},
+	}
+}
+
+// NewPostsubmitRequest returns a postsubmit request. A postsubmit run handles all the changes
+// submitted since the previous one, so all waiting postsubmit requests are duplicates.
+func NewPostsubmitRequest() *Request {
+	return &Request{
+		Lane: LanePostsubmit,
+		Key:  "postsubmit",
+		Invocation: &cirunnerpb.RunnerInvocation{
+			Postsubmit: &cirunnerpb.RunnerInvocation_PostSubmit{},
+		},
+	}
+}
+
+// Message is a request pulled from a queue. It must be acked once handled, or nacked to give it
+// back to the queue.
+type Message struct {
+	*Request
+	ack  func() error
+	nack func() error
+}
+
+// Ack removes the request from the queue.
+func (m *Message) Ack() error {
+	return m.ack()
+}
+
+// Nack makes the request available to other runners again.
+func (m *Message) Nack() error {
+	return m.nack()
+}
+
+// Queue holds requests until runners pull them.
+type Queue interface {
+	// Enqueue adds |req| to its lane and sets its enqueue time.
+	Enqueue(req *Request) error
+
+	// Pull returns the oldest request of the first of |lanes| that has requests, or nil if they
+	// are all empty. It doesn't block.
+	Pull(lanes ...Lane) (*Message, error)
+
+	// Depth returns the number of requests waiting in every lane.
+	Depth() (map[Lane]int, error)
+}
+
+// NewRemote returns a jenkins.Remote that sends presubmit requests to |q| and all other requests
+// to |remote|, which can be nil if only presubmits are requested.
+func NewRemote(remote jenkins.Remote, q Queue) jenkins.Remote {
+	return &queueRemote{Remote: remote, q: q}
+}
+
+type queueRemote struct {
+	jenkins.Remote
+	q Queue
+}
+
+func (r *queueRemote) SendPresubmitRequest(presubmitpb *cirunnerpb.RunnerInvocation_Presubmit) error {
+	if err := r.q.Enqueue(NewPresubmitRequest(presubmitpb)); err != nil {
+		return fmt.Errorf("could not enqueue presubmit request: %v", err)
+	}
+	return nil
+}
+
+func (r *queueRemote) SendBuildRequest(label string, opts ...jenkins.UnitOption) error {
+	if r.Remote == nil {
+		return fmt.Errorf("no jenkins remote for build requests")
+	}
+	return r.Remote.SendBuildRequest(label, opts...)
+}
+
+func (r *queueRemote) SendPublishRequest(label string, opts ...jenkins.UnitOption) error {
+	if r.Remote == nil {
+		return fmt.Errorf("no jenkins remote for publish requests")
+	}
+	return r.Remote.SendPublishRequest(label, opts...)
+}
+
+func (r *queueRemote) SendTestRequest(label string, opts ...jenkins.UnitOption) error {
+	if r.Remote == nil {
+		return fmt.Errorf("no jenkins remote for test requests")
+	}
+	return r.Remote.SendTestRequest(label, opts...)
+}
+
+func (r *queueRemote) SendTaskRequest(label string, opts ...jenkins.UnitOption) error {
+	if r.Remote == nil {
+		return fmt.Errorf("no jenkins remote for task requests")
+	}
+	return r.Remote.SendTaskRequest(label, opts...)
+}
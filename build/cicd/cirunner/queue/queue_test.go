@@ -0,0 +1,247 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"encoding/base64"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/jenkins/mockjenkins"
+	"sge-monorepo/libs/go/p4lib"
+
+	"github.com/golang/protobuf/proto"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+func TestParseLanes(t *testing.T) {
+	lanes, err := ParseLanes("postsubmit, presubmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lanes) != 2 || lanes[0] != LanePresubmit || lanes[1] != LanePostsubmit {
+		t.Errorf("ParseLanes() = %v, want lanes by priority", lanes)
+	}
+	for _, s := range []string{"", "presubmit,nightly"} {
+		if _, err := ParseLanes(s); err == nil {
+			t.Errorf("ParseLanes(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestPresubmitKey(t *testing.T) {
+	a := NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 1, Change: 2})
+	if a.Key != "presubmit-1-2" || a.Lane != LanePresubmit || a.Invocation.Change != 2 {
+		t.Errorf("NewPresubmitRequest() = %+v", a)
+	}
+	b := NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 1, Change: 2, Only: []string{"x", "y"}})
+	c := NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 1, Change: 2, Only: []string{"y", "x"}})
+	if b.Key != c.Key {
+		t.Errorf("keys of the same selection differ: %q != %q", b.Key, c.Key)
+	}
+	if b.Key == a.Key {
+		t.Errorf("keys of a selection and of the whole presubmit are both %q", a.Key)
+	}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue()
+	post := NewPostsubmitRequest()
+	pre1 := NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 1, Change: 2})
+	pre2 := NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 3, Change: 4})
+	for _, req := range []*Request{post, pre1, pre2, NewPostsubmitRequest(), NewPresubmitRequest(pre1.Invocation.Presubmit)} {
+		if err := q.Enqueue(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantDepth := func(pre, post int) {
+		t.Helper()
+		depth, err := q.Depth()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth[LanePresubmit] != pre || depth[LanePostsubmit] != post {
+			t.Errorf("Depth() = %v, want %d presubmits and %d postsubmits", depth, pre, post)
+		}
+	}
+	// Duplicates of waiting requests are dropped.
+	wantDepth(2, 1)
+
+	pull := func(want *Request) *Message {
+		t.Helper()
+		msg, err := q.Pull(Lanes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			if msg != nil {
+				t.Fatalf("Pull() = %s, want nothing", msg.Key)
+			}
+			return nil
+		}
+		if msg == nil || msg.Request != want {
+			t.Fatalf("Pull() = %v, want %s", msg, want.Key)
+		}
+		return msg
+	}
+	// Presubmits go first, oldest first.
+	m := pull(pre1)
+	wantDepth(1, 1)
+	if err := m.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	m = pull(pre1)
+	if err := m.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	// A new request for the same work is no longer a duplicate once the first one was pulled.
+	again := NewPresubmitRequest(pre1.Invocation.Presubmit)
+	if err := q.Enqueue(again); err != nil {
+		t.Fatal(err)
+	}
+	if again.EnqueueTime <= pre1.EnqueueTime {
+		t.Errorf("EnqueueTime %d not after %d", again.EnqueueTime, pre1.EnqueueTime)
+	}
+	pull(pre2).Ack()
+	pull(again).Ack()
+	if msg, err := q.Pull(LanePresubmit); err != nil || msg != nil {
+		t.Errorf("Pull(presubmit) = %v, %v, want nothing", msg, err)
+	}
+	pull(post).Ack()
+	pull(nil)
+	wantDepth(0, 0)
+}
+
+// keysP4 keeps p4 keys in memory.
+type keysP4 struct {
+	p4lib.P4
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func (p4 *keysP4) KeyGet(key string) (string, error) {
+	p4.mu.Lock()
+	defer p4.mu.Unlock()
+	if v, ok := p4.keys[key]; ok {
+		return v, nil
+	}
+	return "0", p4lib.ErrKeyNotFound
+}
+
+func (p4 *keysP4) KeyInc(key string) (string, error) {
+	p4.mu.Lock()
+	defer p4.mu.Unlock()
+	n, _ := strconv.Atoi(p4.keys[key])
+	p4.keys[key] = strconv.Itoa(n + 1)
+	return p4.keys[key], nil
+}
+
+func (p4 *keysP4) KeyCas(key, oldval, newval string) error {
+	p4.mu.Lock()
+	defer p4.mu.Unlock()
+	if p4.keys[key] != oldval {
+		return p4lib.ErrCasMismatch
+	}
+	p4.keys[key] = newval
+	return nil
+}
+
+func TestDeduper(t *testing.T) {
+	p4 := &keysP4{keys: map[string]string{}}
+	d := NewDeduper(p4)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	req := func(enqueued time.Time) *Request {
+		return &Request{Key: "presubmit-1-2", EnqueueTime: enqueued.UnixNano()}
+	}
+	claim := func(r *Request, want bool) {
+		t.Helper()
+		got, err := d.Claim(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Claim(enqueued at %d) = %v, want %v", r.EnqueueTime, got, want)
+		}
+	}
+	first := req(now.Add(-2 * time.Minute))
+	claim(first, true)
+	// Redeliveries and requests enqueued before the run started are duplicates.
+	claim(first, false)
+	claim(req(now.Add(-time.Minute)), false)
+	// Requests enqueued after it started aren't.
+	now = now.Add(time.Hour)
+	claim(req(now.Add(-time.Minute)), true)
+
+	// Another runner creating the claim concurrently wins.
+	d.p4 = &incRaceP4{keysP4: p4}
+	claim(&Request{Key: "postsubmit", EnqueueTime: now.UnixNano()}, false)
+}
+
+// incRaceP4 behaves as if another runner created every key right before.
+type incRaceP4 struct {
+	*keysP4
+}
+
+func (p4 *incRaceP4) KeyInc(key string) (string, error) {
+	p4.keysP4.KeyInc(key)
+	return p4.keysP4.KeyInc(key)
+}
+
+func TestParseMessage(t *testing.T) {
+	want := NewPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 1, Change: 2, UpdateUrl: "https://swarm/update"})
+	data, err := proto.Marshal(want.Invocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseMessage(LanePresubmit, &pubsub.PubsubMessage{
+		Data:        base64.StdEncoding.EncodeToString(data),
+		Attributes:  map[string]string{keyAttribute: want.Key, laneAttribute: string(LanePresubmit)},
+		PublishTime: "2021-03-04T05:06:07.123456789Z",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != want.Key || got.Lane != LanePresubmit || !proto.Equal(got.Invocation, want.Invocation) {
+		t.Errorf("parseMessage() = %+v, want %+v", got, want)
+	}
+	if wantTime := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC).UnixNano(); got.EnqueueTime != wantTime {
+		t.Errorf("EnqueueTime = %d, want %d", got.EnqueueTime, wantTime)
+	}
+	if _, err := parseMessage(LanePresubmit, &pubsub.PubsubMessage{Data: "not base64!"}); err == nil {
+		t.Error("parseMessage() of invalid data succeeded")
+	}
+}
+
+func TestRemote(t *testing.T) {
+	q := NewMemoryQueue()
+	r := NewRemote(mockjenkins.NewRemote(), q)
+	if err := r.SendPresubmitRequest(&cirunnerpb.RunnerInvocation_Presubmit{Review: 1, Change: 2}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := q.Pull(LanePresubmit)
+	if err != nil || msg == nil || msg.Key != "presubmit-1-2" {
+		t.Errorf("Pull() = %v, %v, want the presubmit request", msg, err)
+	}
+	if err := r.SendBuildRequest("//foo:bar"); err != nil {
+		t.Errorf("SendBuildRequest() = %v, want it sent to jenkins", err)
+	}
+	if err := NewRemote(nil, q).SendBuildRequest("//foo:bar"); err == nil {
+		t.Error("SendBuildRequest() without jenkins succeeded")
+	}
+}
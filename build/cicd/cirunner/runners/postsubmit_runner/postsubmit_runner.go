@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -27,6 +28,8 @@ import (
 	"sge-monorepo/build/cicd/jenkins"
 	"sge-monorepo/build/cicd/monorepo"
 	"sge-monorepo/build/cicd/monorepo/p4path"
+	"sge-monorepo/build/cicd/presubmit/impact"
+	"sge-monorepo/build/cicd/presubmit/impact/gcs"
 	"sge-monorepo/build/cicd/sgeb/build"
 	"sge-monorepo/environment/envinstall"
 	"sge-monorepo/libs/go/clock"
@@ -75,6 +78,8 @@ type runner struct {
 	baseCL        int64
 	clock         clock.Clock
 	env           envinstall.EnvironmentType
+	// impactStore keeps the test impact map, nil if none is kept.
+	impactStore impact.Store
 }
 
 func newRunner() (*runner, error) {
@@ -106,6 +111,11 @@ func newRunner() (*runner, error) {
 	if r.env, err = envinstall.Environment(); err != nil {
 		return nil, fmt.Errorf("could not get environment: %v", err)
 	}
+	if bucket := creds.Environment.GetTestImpactBucket(); bucket != "" {
+		if r.impactStore, err = gcs.NewStore(context.Background(), bucket, gcs.DefaultObject); err != nil {
+			return nil, fmt.Errorf("could not open test impact map: %v", err)
+		}
+	}
 	return r, nil
 }
 
@@ -120,7 +130,11 @@ func (r *runner) run() error {
 	}
 	defer bc.Cleanup()
 	log.Info("Discovering postsubmits...")
-	pus, err := discoverPostSubmits(mr, bc)
+	bufs, err := build.DiscoverBuildUnitFiles(mr, bc)
+	if err != nil {
+		return err
+	}
+	pus, err := discoverPostSubmits(mr, bufs)
 	if err != nil {
 		return err
 	}
@@ -138,12 +152,58 @@ func (r *runner) run() error {
 			success = false
 		}
 	}
+	// The test impact map is only an optimization of presubmits, it doesn't fail the run.
+	if err := r.updateTestImpact(mr, bc, bufs, changedFiles); err != nil {
+		log.Warningf("could not update test impact map: %v", err)
+	}
 	if !success {
 		return &fail{}
 	}
 	return nil
 }
 
+var impactMaxMapped = flag.Int("impact_max_mapped", 200, "Maximum number of test units mapped in the test impact map per run.")
+
+// updateTestImpact updates the test impact map with the test units of the monorepo and the files
+// changed since the last run.
+func (r *runner) updateTestImpact(mr monorepo.Monorepo, bc build.Context, bufs []build.UnitFile, changedFiles []monorepo.Path) error {
+	if r.impactStore == nil {
+		return nil
+	}
+	start := time.Now()
+	var tests []monorepo.Label
+	for _, buf := range bufs {
+		var names []string
+		for _, tu := range buf.Proto.TestUnit {
+			names = append(names, tu.Name)
+		}
+		for _, btu := range buf.Proto.BuildTestUnit {
+			names = append(names, btu.Name)
+		}
+		for _, name := range names {
+			label, err := mr.NewLabel(buf.Dir, ":"+name)
+			if err != nil {
+				return err
+			}
+			tests = append(tests, label)
+		}
+	}
+	m, err := r.impactStore.Load()
+	if err != nil {
+		return err
+	}
+	mapped := impact.Update(m, tests, changedFiles, impact.BazelMapper(mr, bc), impact.UpdateOptions{
+		Cl:        r.baseCL,
+		Now:       r.clock.Now(),
+		MaxMapped: *impactMaxMapped,
+	})
+	if err := r.impactStore.Save(m); err != nil {
+		return err
+	}
+	log.Infof("updateTestImpact mapped %d of %d tests in %s", mapped, len(tests), time.Since(start))
+	return nil
+}
+
 func (r *runner) findChangedFiles(mr monorepo.Monorepo) ([]monorepo.Path, error) {
 	if r.baseCL == 0 {
 		return nil, nil
@@ -212,13 +272,10 @@ func (r *runner) findChangedFiles(mr monorepo.Monorepo) ([]monorepo.Path, error)
 	return paths, nil
 }
 
-// discoverPostSubmits searches the monorepo for any units with postsubmit set.
-func discoverPostSubmits(mr monorepo.Monorepo, bc build.Context) ([]postSubmitUnit, error) {
+// discoverPostSubmits searches the BUILDUNIT files of the monorepo for any units with postsubmit
+// set.
+func discoverPostSubmits(mr monorepo.Monorepo, bufs []build.UnitFile) ([]postSubmitUnit, error) {
 	start := time.Now()
-	bufs, err := build.DiscoverBuildUnitFiles(mr, bc)
-	if err != nil {
-		return nil, err
-	}
 	var ret []postSubmitUnit
 	for _, buf := range bufs {
 		for _, pu := range buf.Proto.PublishUnit {
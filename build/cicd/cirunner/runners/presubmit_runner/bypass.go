@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"sge-monorepo/build/cicd/presubmit"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/log/cloudlog"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+)
+
+// noPresubmit returns the safety checks to run instead of the whole presubmit if the CL asks to skip
+// it with a NO_PRESUBMIT tag and its author is allowed to. Returns nil if the whole presubmit must
+// run. Every request, honored or not, is audited in the cloud logs and on the review.
+func noPresubmit(p4 p4lib.P4, cloudLogger cloudlog.CloudLogger, psCtx *PresubmitContext, env *cirunnerpb.Environment, desc *p4lib.Description) ([]presubmit.Selector, error) {
+	reason, tagged, err := presubmit.ParseNoPresubmit(desc.Description)
+	if !tagged {
+		return nil, nil
+	}
+	if err != nil {
+		log.Warningf("Ignoring %s in change %d: %v", presubmit.NoPresubmitTag, desc.Cl, err)
+		psCtx.auditComment(fmt.Sprintf("%s ignored: %v. Running the full presubmit.", presubmit.NoPresubmitTag, err))
+		return nil, nil
+	}
+	policy := presubmit.BypassPolicy{Allowed: env.GetNoPresubmitAllowed()}
+	if policy.SafetyChecks, err = presubmit.ParseSelectors(env.GetNoPresubmitChecks()...); err != nil {
+		return nil, fmt.Errorf("invalid no_presubmit_checks: %v", err)
+	}
+	allowed, err := policy.Allows(p4, desc.User)
+	if err != nil {
+		return nil, err
+	}
+	cloudLogger.AddLabels(map[string]string{
+		"no_presubmit": fmt.Sprintf("%t", allowed),
+	})
+	if !allowed {
+		log.Warningf("AUDIT: %s is not allowed to skip the presubmit of change %d (reason: %q)", desc.User, desc.Cl, reason)
+		psCtx.auditComment(fmt.Sprintf("%s ignored: %s is not allowed to skip presubmits. Running the full presubmit.", presubmit.NoPresubmitTag, desc.User))
+		return nil, nil
+	}
+	checks := policy.Checks()
+	log.Warningf("AUDIT: %s skipped the presubmit of change %d (reason: %q), only running %v", desc.User, desc.Cl, reason, checks)
+	psCtx.auditComment(fmt.Sprintf("Presubmit skipped by %s with %s: %s\n\nOnly the safety checks %v were run.", desc.User, presubmit.NoPresubmitTag, reason, checks))
+	return checks, nil
+}
+
+// auditComment posts |body| on the review. Failures are only logged, the cloud logs hold the audit
+// entry too.
+func (ctx *PresubmitContext) auditComment(body string) {
+	comment := &swarm.Comment{
+		Topic: fmt.Sprintf("reviews/%d", ctx.presubmitpb.Review),
+		Body:  body,
+	}
+	if err := swarm.AddComment(ctx.swarmContext, comment); err != nil {
+		log.Warningf("could not post audit comment on review %d: %v", ctx.presubmitpb.Review, err)
+	}
+}
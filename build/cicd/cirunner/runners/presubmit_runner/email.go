@@ -19,9 +19,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"sge-monorepo/build/cicd/cirunner/ciemail"
 	"sge-monorepo/build/cicd/cirunner/runnertool"
+	"sge-monorepo/build/cicd/presubmit"
 	"sge-monorepo/libs/go/email"
 	"sge-monorepo/libs/go/swarm"
 
@@ -50,16 +52,12 @@ func NewPresubmitContext(creds *runnertool.Credentials,
 	}
 	sc := creds.Swarm
 	swarmContext := swarm.New(sc.Host, int(sc.Port), sc.Username, sc.Password)
-	// We create an SSL unaware HTTP client.
+	// We create an SSL unaware HTTP client, reusing connections across the many requests.
 	swarmContext.Client = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
-	swarmReview, err := swarm.GetReview(swarmContext, int(presubmitpb.Review))
-	if err != nil {
-		return nil, fmt.Errorf("could not get swarm review %d: %v", int(presubmitpb.Review), err)
+		Transport: swarm.NewTransport(&tls.Config{InsecureSkipVerify: true}),
 	}
+	// The runner makes many Swarm requests, fail them fast if Swarm is down.
+	swarmContext.Breaker = swarm.NewBreaker()
 	// Create the email client.
 	var emailClient email.Client
 	if creds.Email != nil {
@@ -70,6 +68,17 @@ func NewPresubmitContext(creds *runnertool.Credentials,
 			creds.Email.Password,
 		)
 	}
+	return newPresubmitContext(swarmContext, emailClient, presubmitpb)
+}
+
+// newPresubmitContext creates a |PresubmitContext| that talks to Swarm through |swarmContext|.
+// |emailClient| may be nil if the run doesn't send emails.
+func newPresubmitContext(swarmContext *swarm.Context, emailClient email.Client,
+	presubmitpb *cirunnerpb.RunnerInvocation_Presubmit) (*PresubmitContext, error) {
+	swarmReview, err := swarm.GetReview(swarmContext, int(presubmitpb.Review))
+	if err != nil {
+		return nil, fmt.Errorf("could not get swarm review %d: %v", int(presubmitpb.Review), err)
+	}
 	return &PresubmitContext{
 		presubmitpb:  presubmitpb,
 		swarmContext: swarmContext,
@@ -78,18 +87,40 @@ func NewPresubmitContext(creds *runnertool.Credentials,
 	}, nil
 }
 
-func (ctx *PresubmitContext) SendSwarmPass() error {
-	return ctx.SendSwarmRequest(swarm.TestRunPass)
+func (ctx *PresubmitContext) SendSwarmPass(summary *presubmit.Summary) error {
+	return ctx.SendSwarmRequest(swarm.TestRunPass, summary)
+}
+
+func (ctx *PresubmitContext) SendSwarmFail(summary *presubmit.Summary) error {
+	return ctx.SendSwarmRequest(swarm.TestRunFail, summary)
 }
 
-func (ctx *PresubmitContext) SendSwarmFail() error {
-	return ctx.SendSwarmRequest(swarm.TestRunFail)
+// SendSwarmPartial finishes the Swarm test run of a run restricted to the checks |only|. Partial
+// runs can't vouch for the change, so the test run fails even when the checks passed, with a
+// message saying so, and the review isn't marked as passed.
+func (ctx *PresubmitContext) SendSwarmPartial(only []string, success bool, summary *presubmit.Summary) error {
+	outcome := "failed"
+	if success {
+		outcome = "passed"
+	}
+	messages := []string{fmt.Sprintf("Partial presubmit of %s %s. Run the full presubmit before submitting.", strings.Join(only, ", "), outcome)}
+	if summary != nil && len(summary.Monorepos) > 1 {
+		messages = append(messages, summary.Messages()...)
+	}
+	_, err := swarm.SendTestRunMessages(ctx.swarmContext, swarm.TestRunFail, ctx.presubmitpb.UpdateUrl, ctx.presubmitpb.ResultsUrl, messages)
+	return err
 }
 
-func (ctx *PresubmitContext) SendSwarmRequest(t swarm.TestRunResponseType) error {
+// SendSwarmRequest updates the Swarm test run. If the change spans several monorepos, the update
+// lists the result of each, so that the review shows which monorepo failed.
+func (ctx *PresubmitContext) SendSwarmRequest(t swarm.TestRunResponseType, summary *presubmit.Summary) error {
 	update := ctx.presubmitpb.UpdateUrl
 	results := ctx.presubmitpb.ResultsUrl
-	if _, err := swarm.SendTestRunRequest(ctx.swarmContext, t, update, results); err != nil {
+	var messages []string
+	if summary != nil && len(summary.Monorepos) > 1 {
+		messages = summary.Messages()
+	}
+	if _, err := swarm.SendTestRunMessages(ctx.swarmContext, t, update, results, messages); err != nil {
 		return err
 	}
 	return nil
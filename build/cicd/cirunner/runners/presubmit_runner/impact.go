@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"sge-monorepo/build/cicd/presubmit/impact"
+	"sge-monorepo/build/cicd/presubmit/impact/gcs"
+	"sge-monorepo/libs/go/log"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+)
+
+var testImpact = flag.String("test_impact", "prioritize", "How the test impact map kept by postsubmit is used: off, prioritize (run affected tests first) or restrict (skip unaffected tests).")
+
+// loadTestImpact returns the test impact map kept in the environment, if any, and whether tests it
+// knows are unaffected are skipped. The map is an optimization: failing to load it runs the
+// presubmit as if there was none.
+func loadTestImpact(env *cirunnerpb.Environment) (*impact.Map, bool, error) {
+	switch *testImpact {
+	case "off":
+		return nil, false, nil
+	case "prioritize", "restrict":
+	default:
+		return nil, false, fmt.Errorf("invalid -test_impact %q, want off, prioritize or restrict", *testImpact)
+	}
+	if env.TestImpactBucket == "" {
+		return nil, false, nil
+	}
+	store, err := gcs.NewStore(context.Background(), env.TestImpactBucket, gcs.DefaultObject)
+	if err != nil {
+		log.Warningf("Could not open test impact map, running all tests: %v", err)
+		return nil, false, nil
+	}
+	m, err := store.Load()
+	if err != nil {
+		log.Warningf("Could not load test impact map, running all tests: %v", err)
+		return nil, false, nil
+	}
+	log.Infof("Using test impact map of CL %d (%d tests) to %s tests.", m.Cl, len(m.Tests), *testImpact)
+	return m, *testImpact == "restrict", nil
+}
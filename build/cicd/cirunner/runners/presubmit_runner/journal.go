@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"sge-monorepo/build/cicd/cirunner/journal"
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/presubmit"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/swarm"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+)
+
+// startJournal starts the journal of this presubmit run. Journals left behind by crashed runs are
+// either resumed, when they belong to the same Swarm test run, or reported as failed.
+// Journals are kept in |dir|. Returns the results of the checks that were completed by the resumed
+// runs.
+func startJournal(dir, runID string, invocation *cirunnerpb.RunnerInvocation, env *cirunnerpb.Environment, ctx *PresubmitContext) (*journal.Journal, map[string]*presubmitpb.CheckResult, error) {
+	local, err := journal.NewFileStore(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create journal store: %v", err)
+	}
+	var opts []journal.Option
+	if env.JournalBucket != "" {
+		if remote, err := journal.NewGCSStore(context.Background(), env.JournalBucket, "presubmit"); err != nil {
+			log.Warningf("Could not create GCS journal store, journaling locally only: %v", err)
+		} else {
+			opts = append(opts, journal.WithRemote(remote))
+		}
+	}
+	orphans, err := journal.Orphans(local, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous := map[string]*presubmitpb.CheckResult{}
+	for _, orphan := range orphans {
+		pb := orphan.Proto()
+		if sameTestRun(pb.Invocation, invocation) {
+			log.Infof("Resuming crashed run %s, %d checks already completed.", pb.RunId, len(pb.CompletedCheck))
+			for name, result := range orphan.CompletedResults() {
+				previous[name] = result
+			}
+			if err := orphan.Resume(runID); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		diagnostics := orphan.Diagnostics()
+		log.Warningf("Found crashed run:\n%s", diagnostics)
+		// We don't want dev environment talking to Swarm.
+		if env.Env == cirunnerpb.Environment_PROD {
+			if err := reportCrashedRun(ctx.swarmContext, pb.Invocation.GetPresubmit(), diagnostics); err != nil {
+				log.Warningf("Could not report crashed run %s: %v", pb.RunId, err)
+			}
+		}
+		if err := orphan.Abandon(runID); err != nil {
+			return nil, nil, err
+		}
+	}
+	j, err := journal.Start(runID, invocation, local, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return j, previous, nil
+}
+
+// sameTestRun returns whether two invocations are for the same Swarm test run. Swarm hands out a
+// different update url for every test run.
+func sameTestRun(lhs, rhs *cirunnerpb.RunnerInvocation) bool {
+	l, r := lhs.GetPresubmit(), rhs.GetPresubmit()
+	if l == nil || r == nil {
+		return false
+	}
+	return l.Change == r.Change && l.UpdateUrl != "" && l.UpdateUrl == r.UpdateUrl
+}
+
+// reportCrashedRun fails the Swarm test run of a crashed presubmit and leaves the diagnostics as a
+// comment on the review, so it does not stay "running" forever.
+func reportCrashedRun(sc *swarm.Context, ps *cirunnerpb.RunnerInvocation_Presubmit, diagnostics string) error {
+	if ps == nil {
+		return nil
+	}
+	if ps.UpdateUrl != "" {
+		if _, err := swarm.SendTestRunRequest(sc, swarm.TestRunFail, ps.UpdateUrl, ps.ResultsUrl); err != nil {
+			return err
+		}
+	}
+	if ps.Review == 0 {
+		return nil
+	}
+	return swarm.AddComment(sc, &swarm.Comment{
+		Topic: fmt.Sprintf("reviews/%d", ps.Review),
+		Body:  fmt.Sprintf("Presubmit runner crashed, the run was marked as failed.\n\n%s", diagnostics),
+	})
+}
+
+// journalListener records the progress of the presubmit in the journal.
+type journalListener struct {
+	journal *journal.Journal
+}
+
+func (jl *journalListener) OnPresubmitStart(mr monorepo.Monorepo, presubmitId string, checks []presubmit.Check) {
+}
+
+func (jl *journalListener) OnCheckStart(check presubmit.Check) {
+	if err := jl.journal.CheckStarted(check.Name()); err != nil {
+		log.Warningf("Could not journal start of %s: %v", check.Name(), err)
+	}
+}
+
+func (jl *journalListener) OnCheckResult(mdPath monorepo.Path, check presubmit.Check, result *presubmitpb.CheckResult) {
+	if err := jl.journal.CheckCompleted(check.Name(), result); err != nil {
+		log.Warningf("Could not journal result of %s: %v", check.Name(), err)
+	}
+}
+
+func (jl *journalListener) OnPresubmitEnd(success bool) {
+}
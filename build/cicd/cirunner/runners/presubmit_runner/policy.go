@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/presubmit"
+	"sge-monorepo/build/cicd/presubmit/policy"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+)
+
+// checkSubmitPolicy evaluates the submit policy of the environment, if it has one, against the
+// change |desc|, its review and the presubmit results in |summary|. Returns whether the change
+// satisfies the policy. Violations are posted on the review.
+func checkSubmitPolicy(p4 p4lib.P4, psCtx *PresubmitContext, env *cirunnerpb.Environment, desc *p4lib.Description, summary *presubmit.Summary) (bool, error) {
+	if env.GetSubmitPolicy() == "" {
+		return true, nil
+	}
+	p, err := policy.Load(p4, env.GetSubmitPolicy())
+	if err != nil {
+		return false, err
+	}
+	// The files of a pending change are those it has shelved.
+	change := desc
+	if shelved, err := p4.DescribeShelved(desc.Cl); err == nil && len(shelved) == 1 && len(shelved[0].Files) > 0 {
+		change = &shelved[0]
+	}
+	in := &policy.Input{
+		Change:    change,
+		Presubmit: &policy.Presubmit{Success: summary.Success()},
+		Now:       time.Now(),
+	}
+	for _, ms := range summary.Monorepos {
+		in.Presubmit.Passed = append(in.Presubmit.Passed, ms.Passed...)
+		for _, f := range ms.Failures {
+			in.Presubmit.Failed = append(in.Presubmit.Failed, f.Name)
+		}
+	}
+	if rid := int(psCtx.presubmitpb.Review); rid != 0 {
+		if in.Review, err = swarm.GetReview(psCtx.swarmContext, rid); err != nil {
+			return false, fmt.Errorf("could not get review %d: %v", rid, err)
+		}
+	}
+	violations := p.Evaluate(in)
+	if len(violations) == 0 {
+		return true, nil
+	}
+	lines := []string{fmt.Sprintf("Change %d violates the submit policy:", desc.Cl)}
+	for _, v := range violations {
+		lines = append(lines, "* "+v.String())
+	}
+	msg := strings.Join(lines, "\n")
+	log.Error(msg)
+	psCtx.auditComment(msg)
+	return false, nil
+}
@@ -22,22 +22,28 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"sge-monorepo/build/cicd/cicdfile"
+	"sge-monorepo/build/cicd/cirunner/journal"
 	"sge-monorepo/build/cicd/cirunner/runnertool"
 	"sge-monorepo/build/cicd/jenkins"
 	"sge-monorepo/build/cicd/monorepo/universe"
 	"sge-monorepo/build/cicd/presubmit"
+	"sge-monorepo/build/cicd/presubmit/explain"
 	"sge-monorepo/libs/go/cloud/monitoring"
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/log/cloudlog"
 	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
 
 	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
 
 	gouuid "github.com/nu7hatch/gouuid"
 )
 
+var strictP4Parsing = flag.Bool("strict_p4_parsing", true, "Whether to fail on p4 output the parsers don't understand, eg. after a server upgrade, rather than skip it and miss files of the change.")
+
 func performPresubmit(cloudLogger cloudlog.CloudLogger) error {
 	// Attempt to get the presubmit invocation.
 	helper := runnertool.MustLoad()
@@ -56,7 +62,67 @@ func performPresubmit(cloudLogger cloudlog.CloudLogger) error {
 	})
 	// Print a link to the review (this is useful for debugging/reference purposes).
 	log.Infof("Review: <REVIEW URL>/%d\n", int(presubmitpb.Review))
+	credentials, err := runnertool.NewCredentials()
+	if err != nil {
+		return fmt.Errorf("could not obtain credentials: %v", err)
+	}
+	u, err := universe.New()
+	if err != nil {
+		return fmt.Errorf("could not create univserse: %v", err)
+	}
+	presubmitContext, err := NewPresubmitContext(credentials, presubmitpb)
+	if err != nil {
+		return fmt.Errorf("could not obtain presubmit context: %v", err)
+	}
+	// We only want metrics in dev for now.
+	var metrics *monitoring.Client
+	if credentials.Environment.Env == cirunnerpb.Environment_DEV {
+		if m, err := monitoring.NewFromDefaultProject(); err != nil {
+			log.Warningf("Could not get monitoring client: %v", err)
+		} else {
+			metrics = m
+		}
+	}
 	p4 := p4lib.New()
+	if *strictP4Parsing {
+		p4 = p4lib.WithStrictParsing(p4)
+	}
+	run := &presubmitRun{
+		invocation:  helper.Invocation(),
+		env:         credentials.Environment,
+		p4:          p4,
+		universe:    u,
+		provider:    cicdfile.NewProvider(),
+		psCtx:       presubmitContext,
+		cloudLogger: cloudLogger,
+		metrics:     metrics,
+		journalDir:  journal.DefaultDir(),
+	}
+	if credentials.ShadowJenkins != nil {
+		run.shadowJenkins = jenkins.NewRemote(credentials.ShadowJenkins)
+	}
+	return run.run()
+}
+
+// presubmitRun holds everything a presubmit run takes from the CI machine: the invocation,
+// credentials, Perforce and Swarm. performPresubmit sets it up for real, the integration tests set
+// it up with fakes.
+type presubmitRun struct {
+	invocation    *cirunnerpb.RunnerInvocation
+	env           *cirunnerpb.Environment
+	p4            p4lib.P4
+	universe      universe.Universe
+	provider      cicdfile.Provider
+	psCtx         *PresubmitContext
+	cloudLogger   cloudlog.CloudLogger
+	metrics       *monitoring.Client
+	shadowJenkins jenkins.Remote
+	journalDir    string
+}
+
+func (r *presubmitRun) run() error {
+	presubmitpb := r.invocation.Presubmit
+	p4 := r.p4
 	// The CI system issues a presubmit run when the CL is submited. If that is the case, we don't
 	// want to do a presubmit run.
 	describes, err := p4.Describe([]int{int(presubmitpb.Change)})
@@ -67,80 +133,111 @@ func performPresubmit(cloudLogger cloudlog.CloudLogger) error {
 		log.Infof("change %d already submitted. Skipping presubmit.\n", presubmitpb.Change)
 		return nil
 	}
-	credentials, err := runnertool.NewCredentials()
-	if err != nil {
-		return fmt.Errorf("could not obtain credentials: %v", err)
-	}
 	// We send a presubmit request to a (possible) shadow jenkins system.
 	// Note that this is best effort and we don't block on any errors.
-	if credentials.ShadowJenkins != nil {
-		jenkinsRemote := jenkins.NewRemote(credentials.ShadowJenkins)
-		if err := jenkinsRemote.SendPresubmitRequest(presubmitpb); err != nil {
+	if r.shadowJenkins != nil {
+		if err := r.shadowJenkins.SendPresubmitRequest(presubmitpb); err != nil {
 			log.Warning("could not send shadow ci request: %v", err)
 		} else {
 			log.Info("Successfully sent shadow presubmit request.")
 		}
 	}
 	// Actually issue the presubmit.
-	u, err := universe.New()
+	presubmitContext := r.psCtx
+	clDescription := describes[0].Description
+	only, err := presubmit.ParseSelectors(presubmitpb.Only...)
 	if err != nil {
-		return fmt.Errorf("could not create univserse: %v", err)
+		return fmt.Errorf("invalid check selection: %v", err)
 	}
-	presubmitContext, err := NewPresubmitContext(credentials, presubmitpb)
+	// Runs restricted to some checks, eg. "/presubmit --only=gofmt", can't vouch for the whole
+	// change: they skip the submit policy and never pass the Swarm test run.
+	partial := len(presubmitpb.Only) > 0
+	safetyChecks, err := noPresubmit(p4, r.cloudLogger, presubmitContext, r.env, &describes[0])
 	if err != nil {
-		return fmt.Errorf("could not obtain presubmit context: %v", err)
+		return fmt.Errorf("could not check %s: %v", presubmit.NoPresubmitTag, err)
 	}
-	// We only want metrics in dev for now.
-	var metrics *monitoring.Client
-	if credentials.Environment.Env == cirunnerpb.Environment_DEV {
-		if m, err := monitoring.NewFromDefaultProject(); err != nil {
-			log.Warningf("Could not get monitoring client: %v", err)
-		} else {
-			metrics = m
-		}
+	if safetyChecks != nil {
+		only = safetyChecks
 	}
-	var clDescription string
-	if presubmitpb.Change != 0 {
-		descs, err := p4.Describe([]int{int(presubmitpb.Change)})
-		if err != nil {
-			return fmt.Errorf("could not get cl description for cl/%d", presubmitpb.Change)
+	presubmitId := newUuid()
+	// Label everything posted to Swarm with this run, as all runners share the same account.
+	presubmitContext.swarmContext = presubmitContext.swarmContext.WithActor(swarm.Actor{
+		Pipeline: "presubmit",
+		RunID:    presubmitId,
+		URL:      presubmitpb.ResultsUrl,
+	})
+	// The journal lets a restarted runner fail or resume this run if we crash midway.
+	j, previousResults, err := startJournal(r.journalDir, presubmitId, r.invocation, r.env, presubmitContext)
+	if err != nil {
+		return fmt.Errorf("could not start journal: %v", err)
+	}
+	defer func() {
+		if err := j.Complete(); err != nil {
+			log.Warningf("could not complete journal: %v", err)
 		}
-		clDescription = descs[0].Description
+	}()
+	impactMap, impactRestrict, err := loadTestImpact(r.env)
+	if err != nil {
+		return err
 	}
-	presubmitId := newUuid()
-	listener := NewPresubmitListener(metrics)
+	listener := NewPresubmitListener(r.metrics)
 	printer := presubmit.NewPrinter(func(opts *presubmit.PrinterOpts) {
 		opts.Logs = func(s string) {
 			log.Info(s)
 		}
 	})
-	runner := presubmit.NewRunner(u, p4, cicdfile.NewProvider(), func(options *presubmit.Options) {
+	imageCache, err := presubmit.DefaultImageCache()
+	if err != nil {
+		log.Warningf("could not find the checker image cache, images won't be cached: %v", err)
+	}
+	runner := presubmit.NewRunner(r.universe, p4, r.provider, func(options *presubmit.Options) {
 		options.CLDescription = clDescription
+		options.ImageCache = imageCache
 		options.PresubmitId = presubmitId
-		options.Listeners = append(options.Listeners, listener, printer)
+		options.PreviousResults = previousResults
+		options.Only = only
+		options.Impact = impactMap
+		options.ImpactRestrict = impactRestrict
+		options.Listeners = append(options.Listeners, listener, printer, &journalListener{journal: j})
 	})
 	success, err := runner.Run()
 	if err != nil {
 		return fmt.Errorf("could not run presubmit: %v", err)
 	}
+	saveExplanation(p4, runner, presubmitpb.Review, presubmitpb.Change, presubmitId)
+	if success && !partial {
+		if success, err = checkSubmitPolicy(p4, presubmitContext, r.env, &describes[0], runner.Summary()); err != nil {
+			return fmt.Errorf("could not check submit policy: %v", err)
+		}
+	}
 	if success {
 		// We don't want dev environment emailing people.
-		if credentials.Environment.Env == cirunnerpb.Environment_PROD {
+		if r.env.Env == cirunnerpb.Environment_PROD {
 			if err := presubmitContext.SendPassEmail(listener.results); err != nil {
 				return fmt.Errorf("could not send pass email: %v", err)
 			}
-			if err := presubmitContext.SendSwarmPass(); err != nil {
+			if partial {
+				err = presubmitContext.SendSwarmPartial(presubmitpb.Only, true, runner.Summary())
+			} else {
+				err = presubmitContext.SendSwarmPass(runner.Summary())
+			}
+			if err != nil {
 				return fmt.Errorf("could not send swarm pass: %v", err)
 			}
 		}
 	} else {
 		log.Error("Presubmit FAILED.")
 		// We don't want dev environment emailing people.
-		if credentials.Environment.Env == cirunnerpb.Environment_PROD {
+		if r.env.Env == cirunnerpb.Environment_PROD {
 			if err := presubmitContext.SendFailEmail(listener.results); err != nil {
 				return fmt.Errorf("could not send fail email: %v", err)
 			}
-			if err := presubmitContext.SendSwarmFail(); err != nil {
+			if partial {
+				err = presubmitContext.SendSwarmPartial(presubmitpb.Only, false, runner.Summary())
+			} else {
+				err = presubmitContext.SendSwarmFail(runner.Summary())
+			}
+			if err != nil {
 				return fmt.Errorf("could not send swarm fail: %v", err)
 			}
 		}
@@ -153,6 +250,28 @@ func performPresubmit(cloudLogger cloudlog.CloudLogger) error {
 	return err
 }
 
+// saveExplanation stores the graph of the checks the run triggered, for Ebert to show why they
+// ran. This is best effort: failures are only logged.
+func saveExplanation(p4 p4lib.P4, runner presubmit.Runner, review, change int64, presubmitId string) {
+	if review == 0 {
+		return
+	}
+	g, err := runner.Explain()
+	if err != nil {
+		log.Warningf("could not explain the presubmit: %v", err)
+		return
+	}
+	run := &explain.Run{
+		Change:      int(change),
+		PresubmitID: presubmitId,
+		Time:        time.Now(),
+		Graph:       g,
+	}
+	if err := explain.Save(p4, int(review), run); err != nil {
+		log.Warningf("could not save the presubmit explanation: %v", err)
+	}
+}
+
 func internalMain() int {
 	flag.Parse()
 	cloudLogger, err := cloudlog.New("presubmit_runner")
@@ -0,0 +1,390 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// End-to-end tests of the presubmit loop: a change is opened in a review, Ebert triggers a Swarm
+// test run, the runner runs the checks of the change with the real presubmit.Runner and posts the
+// results back to the test run. Perforce is faked with p4mock and Swarm with swarmfake. The checker
+// tool is this test binary, re-executed in checker mode.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/cicdfile"
+	"sge-monorepo/build/cicd/monorepo/universe"
+	"sge-monorepo/libs/go/email"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/sgetest"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/libs/go/swarm/swarmfake"
+
+	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	// checkerModeEnv makes the test binary act as the "lint" checker tool.
+	checkerModeEnv = "PRESUBMIT_RUNNER_TEST_CHECKER"
+
+	// lintError is what the "lint" checker fails on.
+	lintError = "LINT-ERROR"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(checkerModeEnv) != "" {
+		if err := runChecker(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// The checker tools started by the tests are copies of this binary.
+	os.Setenv(checkerModeEnv, "1")
+	os.Exit(m.Run())
+}
+
+// runChecker is the "lint" checker tool: it fails the files that contain lintError.
+func runChecker(args []string) error {
+	var invocationPath, resultPath string
+	for _, arg := range args {
+		if v := strings.TrimPrefix(arg, "--checker-invocation="); v != arg {
+			invocationPath = v
+		} else if v := strings.TrimPrefix(arg, "--checker-invocation-result="); v != arg {
+			resultPath = v
+		}
+	}
+	data, err := ioutil.ReadFile(invocationPath)
+	if err != nil {
+		return err
+	}
+	invocation := checkpb.CheckerInvocation{}
+	if err := proto.Unmarshal(data, &invocation); err != nil {
+		return err
+	}
+	result := checkpb.CheckerInvocationResult{}
+	for _, tc := range invocation.TriggeredChecks {
+		for _, f := range tc.Files {
+			content, err := ioutil.ReadFile(f.Path)
+			if err != nil {
+				return err
+			}
+			result.Results = append(result.Results, &buildpb.Result{
+				Name:    filepath.Base(f.Path),
+				Success: !strings.Contains(string(content), lintError),
+			})
+		}
+	}
+	data, err = proto.Marshal(&result)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(resultPath, data, 0666)
+}
+
+// ciHarness wires a fake depot, a fake Swarm and the presubmit runner together.
+type ciHarness struct {
+	t          *testing.T
+	wsDir      string
+	journalDir string
+	swarm      *swarmfake.Server
+	p4         p4mock.Mock
+	universe   universe.Universe
+	emails     *emailRecorder
+
+	// opened are the files opened in the change under test, by depot path.
+	opened      map[string]string
+	description p4lib.Description
+}
+
+func newCIHarness(t *testing.T) *ciHarness {
+	t.Helper()
+	wsDir := t.TempDir()
+	checker := "checker"
+	if runtime.GOOS == "windows" {
+		checker += ".exe"
+	}
+	files := map[string]string{
+		"game/MONOREPO":              "",
+		"game/WORKSPACE":             "",
+		"game/CICD":                  `presubmit { check { action: "lint" } }`,
+		"game/tools/checkers.textpb": fmt.Sprintf(`checker_tool { action: "lint" bin: "%s" }`, checker),
+	}
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyExecutable(filepath.Join(wsDir, "game", "tools", checker)); err != nil {
+		t.Fatal(err)
+	}
+	u, err := universe.NewFromDef(universe.Def{
+		{Name: "game", Root: "//game", ToolConfigs: []string{"tools/checkers.textpb"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &ciHarness{
+		t:          t,
+		wsDir:      wsDir,
+		journalDir: t.TempDir(),
+		swarm:      swarmfake.New(),
+		p4:         p4mock.New(),
+		universe:   u,
+		emails:     &emailRecorder{},
+		opened:     map[string]string{},
+	}
+	t.Cleanup(h.swarm.Close)
+	h.p4.WhereFunc = func(p string) (string, error) {
+		return filepath.Join(wsDir, filepath.FromSlash(strings.TrimPrefix(p, "//"))), nil
+	}
+	h.p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		var ret []p4lib.OpenedFile
+		for p := range h.opened {
+			ret = append(ret, p4lib.OpenedFile{Path: p, Status: p4lib.DiffChange})
+		}
+		return ret, nil
+	}
+	h.p4.DescribeFunc = func(cls []int) ([]p4lib.Description, error) {
+		return []p4lib.Description{h.description}, nil
+	}
+	return h
+}
+
+// copyExecutable copies the test binary to |dst|, to be used as the checker tool.
+func copyExecutable(dst string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openChange opens |files| (monorepo paths to contents) in change |cl| of |user|, and adds a
+// version of review |review| for it.
+func (h *ciHarness) openChange(review, cl int, user, desc string, files map[string]string) {
+	h.t.Helper()
+	if err := sgetest.WriteFiles(filepath.Join(h.wsDir, "game"), files); err != nil {
+		h.t.Fatal(err)
+	}
+	h.opened = map[string]string{}
+	for p, content := range files {
+		h.opened["//game/"+p] = content
+	}
+	h.description = p4lib.Description{Cl: cl, User: user, Description: desc, Status: "pending"}
+	r, ok := h.swarm.Review(review)
+	if !ok {
+		r = swarm.Review{ID: review, Author: user}
+	}
+	r.Changes = append(r.Changes, cl)
+	r.Versions = append(r.Versions, swarm.Version{Change: cl})
+	h.swarm.AddReview(r)
+}
+
+// triggerPresubmit creates a Swarm test run for the last version of |review|, as Ebert does, and
+// returns the invocation the CI passes to the runner.
+func (h *ciHarness) triggerPresubmit(review int) (*cirunnerpb.RunnerInvocation, *swarm.TestRun) {
+	h.t.Helper()
+	r, _ := h.swarm.Review(review)
+	version := len(r.Versions)
+	tr, err := swarm.CreateTestRun(h.swarm.Context(), review, version, fmt.Sprintf("token.v%d", version))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return &cirunnerpb.RunnerInvocation{
+		Presubmit: &cirunnerpb.RunnerInvocation_Presubmit{
+			Review:     int64(review),
+			Change:     int64(r.Versions[version-1].Change),
+			UpdateUrl:  swarmfake.UpdateURL(tr),
+			ResultsUrl: fmt.Sprintf("https://ci.invalid/presubmit/%d", tr.ID),
+		},
+	}, tr
+}
+
+// runPresubmit runs the presubmit runner on |invocation|.
+func (h *ciHarness) runPresubmit(invocation *cirunnerpb.RunnerInvocation) error {
+	h.t.Helper()
+	psCtx, err := newPresubmitContext(h.swarm.Context(), h.emails, invocation.Presubmit)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	run := &presubmitRun{
+		invocation:  invocation,
+		env:         &cirunnerpb.Environment{Env: cirunnerpb.Environment_PROD},
+		p4:          h.p4,
+		universe:    h.universe,
+		provider:    cicdfile.NewProvider(),
+		psCtx:       psCtx,
+		cloudLogger: &fakeCloudLogger{},
+		journalDir:  h.journalDir,
+	}
+	return run.run()
+}
+
+type emailRecorder struct {
+	sent []*email.Email
+}
+
+func (er *emailRecorder) Send(e *email.Email) error {
+	er.sent = append(er.sent, e)
+	return nil
+}
+
+type fakeCloudLogger struct{}
+
+func (*fakeCloudLogger) Valid() bool                        { return false }
+func (*fakeCloudLogger) AddLabels(map[string]string)        {}
+func (*fakeCloudLogger) DebugDepth(depth int, msg string)   {}
+func (*fakeCloudLogger) InfoDepth(depth int, msg string)    {}
+func (*fakeCloudLogger) WarningDepth(depth int, msg string) {}
+func (*fakeCloudLogger) ErrorDepth(depth int, msg string)   {}
+func (*fakeCloudLogger) Close()                             {}
+
+func updateStatuses(updates []swarmfake.Update) []string {
+	var ret []string
+	for _, u := range updates {
+		ret = append(ret, u.Status)
+	}
+	return ret
+}
+
+func TestPresubmitLoop(t *testing.T) {
+	h := newCIHarness(t)
+
+	// The first version of the review fails the lint check.
+	h.openChange(1, 100, "alice", "Add the thing.", map[string]string{
+		"src/thing.txt": "thing " + lintError + "\n",
+	})
+	invocation, tr := h.triggerPresubmit(1)
+	if err := h.runPresubmit(invocation); !isFailErr(err) {
+		t.Fatalf("got error %v, want a failed presubmit", err)
+	}
+	if diff := cmp.Diff([]string{"fail"}, updateStatuses(h.swarm.Updates(tr.ID))); diff != "" {
+		t.Errorf("test run %d updates diff (-want +got):\n%s", tr.ID, diff)
+	}
+	if r, _ := h.swarm.Review(1); r.TestStatus != "fail" {
+		t.Errorf("got review test status %q, want fail", r.TestStatus)
+	}
+	if len(h.emails.sent) != 1 || !strings.Contains(h.emails.sent[0].Subject, "Review 1") {
+		t.Errorf("want a presubmit email for review 1, got %v", h.emails.sent)
+	}
+
+	// The fix is a new version of the review, with a new test run.
+	h.openChange(1, 101, "alice", "Add the thing.", map[string]string{
+		"src/thing.txt": "thing\n",
+	})
+	invocation, rerun := h.triggerPresubmit(1)
+	if rerun.ID == tr.ID {
+		t.Fatalf("re-run reused test run %d", tr.ID)
+	}
+	if err := h.runPresubmit(invocation); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"pass"}, updateStatuses(h.swarm.Updates(rerun.ID))); diff != "" {
+		t.Errorf("test run %d updates diff (-want +got):\n%s", rerun.ID, diff)
+	}
+	if diff := cmp.Diff([]string{"fail"}, updateStatuses(h.swarm.Updates(tr.ID))); diff != "" {
+		t.Errorf("re-run updated the first test run (-want +got):\n%s", diff)
+	}
+	if r, _ := h.swarm.Review(1); r.TestStatus != "pass" {
+		t.Errorf("got review test status %q, want pass", r.TestStatus)
+	}
+	if len(h.emails.sent) != 2 {
+		t.Errorf("got %d emails, want 2", len(h.emails.sent))
+	}
+}
+
+func TestPresubmitSubmittedChange(t *testing.T) {
+	h := newCIHarness(t)
+	h.openChange(1, 100, "alice", "Add the thing.", map[string]string{
+		"src/thing.txt": "thing " + lintError + "\n",
+	})
+	invocation, tr := h.triggerPresubmit(1)
+	h.description.Status = "submitted"
+	if err := h.runPresubmit(invocation); err != nil {
+		t.Fatal(err)
+	}
+	if updates := h.swarm.Updates(tr.ID); len(updates) != 0 {
+		t.Errorf("submitted change updated its test run: %v", updates)
+	}
+	if len(h.emails.sent) != 0 {
+		t.Errorf("submitted change sent emails: %v", h.emails.sent)
+	}
+}
+
+func TestPresubmitAuditsBypass(t *testing.T) {
+	h := newCIHarness(t)
+	// Nobody is allowed to skip presubmits: the bypass is audited on the review and the whole
+	// presubmit runs.
+	h.openChange(1, 100, "bob", "Hotfix.\n\nNO_PRESUBMIT=build is on fire", map[string]string{
+		"src/thing.txt": "thing " + lintError + "\n",
+	})
+	invocation, tr := h.triggerPresubmit(1)
+	if err := h.runPresubmit(invocation); !isFailErr(err) {
+		t.Fatalf("got error %v, want a failed presubmit", err)
+	}
+	comments := h.swarm.Comments(1)
+	if len(comments) != 1 || !strings.Contains(comments[0].Body, "bob is not allowed to skip presubmits") {
+		t.Errorf("want an audit comment about bob, got %v", comments)
+	}
+	if diff := cmp.Diff([]string{"fail"}, updateStatuses(h.swarm.Updates(tr.ID))); diff != "" {
+		t.Errorf("test run %d updates diff (-want +got):\n%s", tr.ID, diff)
+	}
+}
+
+func TestPresubmitPartialRun(t *testing.T) {
+	h := newCIHarness(t)
+	h.openChange(1, 100, "alice", "Add the thing.", map[string]string{
+		"src/thing.txt": "thing\n",
+	})
+	// A run of only some checks passing doesn't pass the review.
+	invocation, tr := h.triggerPresubmit(1)
+	invocation.Presubmit.Only = []string{"lint"}
+	if err := h.runPresubmit(invocation); err != nil {
+		t.Fatal(err)
+	}
+	updates := h.swarm.Updates(tr.ID)
+	if diff := cmp.Diff([]string{"fail"}, updateStatuses(updates)); diff != "" {
+		t.Errorf("test run %d updates diff (-want +got):\n%s", tr.ID, diff)
+	}
+	if len(updates) != 1 || !strings.Contains(strings.Join(updates[0].Messages, "\n"), "Partial presubmit of lint passed") {
+		t.Errorf("want the update to say the run was partial, got %+v", updates)
+	}
+	if r, _ := h.swarm.Review(1); r.TestStatus == "pass" {
+		t.Errorf("partial run passed the review")
+	}
+}
@@ -130,6 +130,7 @@ func internalMain() error {
 			if helper != nil {
 				publishOpts.BaseCl = helper.Invocation().BaseCl
 				publishOpts.CiResultUrl = helper.Invocation().Publish.ResultsUrl
+				publishOpts.SinceCl = state.LastPublishedCl
 				opts.BazelBuildArgs = append(opts.BazelBuildArgs,
 					"--stamp",
 					fmt.Sprintf("--workspace_status_command=workspace_status_command.exe -base_cl=%d", helper.Invocation().BaseCl),
@@ -156,10 +157,16 @@ func internalMain() error {
 			state.LastEmailTime = nil
 			if len(results) > 0 {
 				wasHealthy := state.Success
+				body := fmt.Sprintf("%s was published successfully.", apu.label)
+				for _, r := range results {
+					if r.Changelog != nil {
+						body += "\n\n" + build.FormatChangelog(r.Name, r.Changelog)
+					}
+				}
 				e := email.Email{
 					ContentType: email.ContentTypeText,
 					Subject:     fmt.Sprintf("%s was published successfully", apu.label),
-					EmailBody:   fmt.Sprintf("%s was published successfully.", apu.label),
+					EmailBody:   body,
 				}
 				if err := notifier.OnSuccess(&e, wasHealthy); err != nil {
 					glog.Errorf("Failed to send email: %v\n", err)
@@ -185,6 +192,9 @@ func internalMain() error {
 			}
 		}
 		state.Success = success
+		if success && len(results) > 0 && helper != nil {
+			state.LastPublishedCl = helper.Invocation().BaseCl
+		}
 		newKeyVal := proto.MarshalTextString(&state)
 		if err := p4.KeySet(key, newKeyVal); err != nil {
 			glog.Errorf("Failed to set p4 key %s: %v\n", key, err)
@@ -122,6 +122,9 @@ func (r *remote) SendPresubmitRequest(presubmitpb *cirunnerpb.RunnerInvocation_P
 		"change":   strconv.Itoa(int(presubmitpb.Change)),
 		"swarmURL": presubmitpb.UpdateUrl,
 	}
+	if len(presubmitpb.Only) > 0 {
+		params["only"] = strings.Join(presubmitpb.Only, ",")
+	}
 	body, err := SendJenkinsRequest(r.creds, "POST", presubmitUrl, params)
 	if err != nil {
 		return fmt.Errorf("Could not send presubmit request: %v. Response:\n%s", err, body)
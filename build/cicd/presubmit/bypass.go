@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"strings"
+
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// NoPresubmitTag is the CL description tag asking to skip the presubmit, eg. for emergency
+// rollbacks. It's written as "NO_PRESUBMIT=<reason>".
+const NoPresubmitTag = p4lib.TagNoPresubmit
+
+// DefaultSafetyChecks are the checks still run on CLs skipping the presubmit when the bypass
+// policy doesn't list any.
+var DefaultSafetyChecks = []Selector{{Kind: KindBlockDeprecatedDeps}}
+
+// ParseNoPresubmit returns the reason given in the NO_PRESUBMIT tag of a CL description. Returns
+// false if the description has no such tag, and an error if the tag has no reason.
+func ParseNoPresubmit(description string) (string, bool, error) {
+	reason, ok := p4lib.ParseTaggedDescription(description).First(NoPresubmitTag)
+	if !ok {
+		return "", false, nil
+	}
+	if reason == "" {
+		return "", true, fmt.Errorf("%s needs a reason, eg. %s=rollback of cl/1234", NoPresubmitTag, NoPresubmitTag)
+	}
+	return reason, true, nil
+}
+
+// BypassPolicy tells who can skip presubmits and which checks still run when they do.
+type BypassPolicy struct {
+	// Allowed are the users, and the p4 groups as "group:<name>", allowed to skip presubmits.
+	Allowed []string
+
+	// SafetyChecks select the checks that run anyway. Defaults to DefaultSafetyChecks.
+	SafetyChecks []Selector
+}
+
+// Allows returns whether |user| can skip presubmits.
+func (bp *BypassPolicy) Allows(p4 p4lib.P4, user string) (bool, error) {
+	var groups []string
+	for _, a := range bp.Allowed {
+		if strings.HasPrefix(a, "group:") {
+			groups = append(groups, strings.TrimPrefix(a, "group:"))
+		} else if a == user {
+			return true, nil
+		}
+	}
+	if len(groups) == 0 {
+		return false, nil
+	}
+	// "p4 groups -i -u" lists the groups the user belongs to, including through subgroups.
+	out, err := p4.ExecCmd("groups", "-i", "-u", user)
+	if err != nil {
+		return false, fmt.Errorf("could not get groups of %s: %v", user, err)
+	}
+	member := map[string]bool{}
+	for _, g := range strings.Fields(out) {
+		member[g] = true
+	}
+	for _, g := range groups {
+		if member[g] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Checks returns the selectors of the checks to run when skipping the presubmit.
+func (bp *BypassPolicy) Checks() []Selector {
+	if len(bp.SafetyChecks) == 0 {
+		return DefaultSafetyChecks
+	}
+	return bp.SafetyChecks
+}
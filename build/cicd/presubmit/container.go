@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+)
+
+const (
+	// defaultContainerMount is where the monorepo is mounted in checker containers by default.
+	defaultContainerMount = "/monorepo"
+
+	// containerInvocationDir is where the invocation protos are mounted in checker containers.
+	containerInvocationDir = "/sgep"
+)
+
+var digestRegex = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// DefaultImageCache returns the default directory checker images are saved to.
+func DefaultImageCache() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sgep", "images"), nil
+}
+
+// docker runs the docker CLI and returns its trimmed stdout. Tests replace it.
+var docker = func(args ...string) (string, error) {
+	cmd := exec.Command("docker", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// imageMutex serializes image resolution, so that checks sharing an image pull it once.
+var imageMutex sync.Mutex
+
+// validateContainer checks that a container is pinned to an image digest.
+func validateContainer(c *checkpb.Container) error {
+	if c.Image == "" {
+		return fmt.Errorf("container has no image")
+	}
+	if strings.Contains(c.Image, "@") {
+		return fmt.Errorf("container image %q must not include a digest, use the digest field", c.Image)
+	}
+	if !digestRegex.MatchString(c.Digest) {
+		return fmt.Errorf("container image %s has invalid digest %q, want sha256:<64 hex digits>", c.Image, c.Digest)
+	}
+	if c.Mount != "" && !path.IsAbs(c.Mount) {
+		return fmt.Errorf("container mount %q is not an absolute path", c.Mount)
+	}
+	return nil
+}
+
+// imageRef returns the reference of the pinned image of a container.
+func imageRef(c *checkpb.Container) string {
+	return c.Image + "@" + c.Digest
+}
+
+// containerMount returns where the monorepo is mounted in a container.
+func containerMount(c *checkpb.Container) string {
+	if c.Mount != "" {
+		return c.Mount
+	}
+	return defaultContainerMount
+}
+
+// resolveImage makes the pinned image of a container available to docker and returns its id.
+// Images are looked up in docker first, then loaded from |cacheDir|, and pulled last. Pulled
+// images are saved to |cacheDir| so that they survive docker pruning images. Progress is written
+// to |logs|.
+func resolveImage(c *checkpb.Container, cacheDir string, logs io.Writer) (string, error) {
+	imageMutex.Lock()
+	defer imageMutex.Unlock()
+	ref := imageRef(c)
+	if id, err := docker("image", "inspect", "--format={{.Id}}", ref); err == nil && id != "" {
+		return id, nil
+	}
+	hex := strings.TrimPrefix(c.Digest, "sha256:")
+	tarPath := filepath.Join(cacheDir, hex+".tar")
+	idPath := filepath.Join(cacheDir, hex+".id")
+	if cacheDir != "" {
+		if idBytes, err := ioutil.ReadFile(idPath); err == nil {
+			id := strings.TrimSpace(string(idBytes))
+			// Loaded images don't keep the digest they were pulled by, look them up by id.
+			if _, err := docker("image", "inspect", id); err == nil {
+				return id, nil
+			}
+			_, err := docker("load", "-i", tarPath)
+			if err == nil {
+				return id, nil
+			}
+			fmt.Fprintf(logs, "could not load cached image %s: %v\n", ref, err)
+		}
+	}
+	fmt.Fprintf(logs, "Pulling %s\n", ref)
+	if _, err := docker("pull", ref); err != nil {
+		return "", err
+	}
+	id, err := docker("image", "inspect", "--format={{.Id}}", ref)
+	if err != nil {
+		return "", err
+	}
+	if cacheDir != "" {
+		if err := cacheImage(id, tarPath, idPath); err != nil {
+			fmt.Fprintf(logs, "could not cache image %s: %v\n", ref, err)
+		}
+	}
+	return id, nil
+}
+
+// cacheImage saves image |id| to |tarPath| and records its id in |idPath|.
+func cacheImage(id, tarPath, idPath string) error {
+	if err := os.MkdirAll(filepath.Dir(tarPath), 0755); err != nil {
+		return err
+	}
+	// Save to a temporary file, so that interrupted saves don't leave truncated images behind.
+	tmp := tarPath + ".tmp"
+	if _, err := docker("save", "-o", tmp, id); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, tarPath); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(idPath, []byte(id+"\n"), 0666)
+}
+
+// containerRunArgs returns the docker arguments that run a checker in container |c|. The
+// monorepo at |root| and |invocationDir| are mounted in the container, |env| are the names of the
+// environment variables passed through to the checker, and |bin| overrides the entrypoint of the
+// image if set.
+func containerRunArgs(c *checkpb.Container, imageID, root, invocationDir, bin string, env, args []string) []string {
+	mount := containerMount(c)
+	runArgs := []string{
+		"run", "--rm",
+		"-v", root + ":" + mount,
+		"-v", invocationDir + ":" + containerInvocationDir,
+		"-w", mount,
+	}
+	if !c.Network {
+		runArgs = append(runArgs, "--network=none")
+	}
+	for _, name := range env {
+		runArgs = append(runArgs, "-e", name)
+	}
+	if bin != "" {
+		runArgs = append(runArgs, "--entrypoint", bin)
+	}
+	runArgs = append(runArgs, imageID)
+	return append(runArgs, args...)
+}
+
+// envNames returns the names of "NAME=value" environment variables.
+func envNames(env []string) []string {
+	var names []string
+	for _, e := range env {
+		names = append(names, strings.SplitN(e, "=", 2)[0])
+	}
+	return names
+}
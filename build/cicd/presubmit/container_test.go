@@ -0,0 +1,153 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testDigest = "sha256:" + strings.Repeat("ab", 32)
+
+func TestValidateContainer(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		container *checkpb.Container
+		wantErr   bool
+	}{
+		{"pinned", &checkpb.Container{Image: "gcr.io/p/tidy", Digest: testDigest}, false},
+		{"no image", &checkpb.Container{Digest: testDigest}, true},
+		{"no digest", &checkpb.Container{Image: "gcr.io/p/tidy"}, true},
+		{"short digest", &checkpb.Container{Image: "gcr.io/p/tidy", Digest: "sha256:abc"}, true},
+		{"digest in image", &checkpb.Container{Image: "gcr.io/p/tidy@" + testDigest, Digest: testDigest}, true},
+		{"relative mount", &checkpb.Container{Image: "gcr.io/p/tidy", Digest: testDigest, Mount: "src"}, true},
+	} {
+		if err := validateContainer(tc.container); (err != nil) != tc.wantErr {
+			t.Errorf("%s: validateContainer() = %v, want error %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestContainerRunArgs(t *testing.T) {
+	c := &checkpb.Container{Image: "gcr.io/p/tidy", Digest: testDigest}
+	got := containerRunArgs(c, "sha256:id", "/src", "/tmp/sgep1", "/bin/tidy", []string{"SGE_CREDENTIAL_A"}, []string{"--flag"})
+	want := []string{
+		"run", "--rm",
+		"-v", "/src:/monorepo",
+		"-v", "/tmp/sgep1:/sgep",
+		"-w", "/monorepo",
+		"--network=none",
+		"-e", "SGE_CREDENTIAL_A",
+		"--entrypoint", "/bin/tidy",
+		"sha256:id", "--flag",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("containerRunArgs() diff (-want +got):\n%s", diff)
+	}
+	c.Mount = "/w"
+	c.Network = true
+	got = containerRunArgs(c, "sha256:id", "/src", "/tmp/sgep1", "", nil, nil)
+	want = []string{"run", "--rm", "-v", "/src:/w", "-v", "/tmp/sgep1:/sgep", "-w", "/w", "sha256:id"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("containerRunArgs() diff (-want +got):\n%s", diff)
+	}
+}
+
+// fakeDocker is a docker CLI that knows of a set of images, by reference and by id.
+type fakeDocker struct {
+	images   map[string]string
+	registry map[string]string
+	calls    []string
+}
+
+func (fd *fakeDocker) run(args ...string) (string, error) {
+	fd.calls = append(fd.calls, args[0])
+	switch args[0] {
+	case "image":
+		ref := args[len(args)-1]
+		if id, ok := fd.images[ref]; ok {
+			return id, nil
+		}
+		return "", fmt.Errorf("no such image: %s", ref)
+	case "pull":
+		id, ok := fd.registry[args[1]]
+		if !ok {
+			return "", fmt.Errorf("manifest unknown")
+		}
+		fd.images[args[1]] = id
+		fd.images[id] = id
+		return "", nil
+	case "save":
+		return "", ioutil.WriteFile(args[2], []byte(args[3]), 0666)
+	case "load":
+		b, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return "", err
+		}
+		fd.images[string(b)] = string(b)
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected docker %v", args)
+}
+
+func TestResolveImage(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	c := &checkpb.Container{Image: "gcr.io/p/tidy", Digest: testDigest}
+	fd := &fakeDocker{
+		images:   map[string]string{},
+		registry: map[string]string{imageRef(c): "sha256:id"},
+	}
+	defer func(d func(...string) (string, error)) { docker = d }(docker)
+	docker = fd.run
+
+	resolve := func(wantCalls ...string) {
+		t.Helper()
+		fd.calls = nil
+		id, err := resolveImage(c, cacheDir, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "sha256:id" {
+			t.Errorf("resolveImage() = %q, want sha256:id", id)
+		}
+		if diff := cmp.Diff(wantCalls, fd.calls); diff != "" {
+			t.Errorf("docker calls diff (-want +got):\n%s", diff)
+		}
+	}
+	// First use pulls the image and caches it.
+	resolve("image", "pull", "image", "save")
+	if _, err := os.Stat(filepath.Join(cacheDir, strings.TrimPrefix(testDigest, "sha256:")+".tar")); err != nil {
+		t.Errorf("image not cached: %v", err)
+	}
+	// Images docker knows are used as is.
+	resolve("image")
+	// Images pruned from docker are loaded from the cache.
+	fd.images = map[string]string{}
+	resolve("image", "image", "load")
+	// Loaded images are found by id.
+	resolve("image", "image")
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/libs/go/p4lib"
+
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// checkDeprecatedDeps fails when a changed BUILDUNIT file adds references to deprecated units.
+type checkDeprecatedDeps struct {
+	checkBase
+	file         changedFile
+	triggeredSet *triggeredSet
+}
+
+func (cd *checkDeprecatedDeps) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
+	mr := cd.triggeredSet.monorepo
+	pkgDir := cd.file.path.Dir()
+	bus, err := bc.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	old := &sgebpb.BuildUnits{}
+	if statusFromP4Status(cd.file.status) != checkpb.Status_Create {
+		depotPath := fmt.Sprintf("%s/%s", cd.triggeredSet.monorepoDef.Root, cd.file.path)
+		content, err := cd.triggeredSet.runner.p4.Print("-q", p4lib.AtHave().Of(depotPath))
+		if err != nil {
+			return nil, fmt.Errorf("could not get previous version of %s: %v", depotPath, err)
+		}
+		if err := proto.UnmarshalText(content, old); err != nil {
+			return nil, fmt.Errorf("could not parse previous version of %s: %v", depotPath, err)
+		}
+	}
+	deprecated, err := newDeprecatedDeps(mr, bc, pkgDir, old, bus)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []string
+	for _, d := range deprecated {
+		msgs = append(msgs, fmt.Sprintf("new dependency on deprecated unit: %s", d))
+	}
+	return &presubmitpb.CheckResult{
+		OverallResult: &buildpb.Result{
+			Name:    cd.name,
+			Success: len(msgs) == 0,
+			Logs:    build.LogsFromString("stderr", strings.Join(msgs, "\n")),
+		},
+	}, nil
+}
+
+func (cd *checkDeprecatedDeps) SortOrder() sortOrder {
+	return nil
+}
+
+func (cd *checkDeprecatedDeps) DurationBudget() time.Duration {
+	return 0
+}
+
+// newDeprecatedDeps returns a description of every deprecated unit referenced from |bus| that
+// was not already referenced from |old|. Both are BUILDUNIT files in |pkgDir|.
+func newDeprecatedDeps(mr monorepo.Monorepo, bc build.Context, pkgDir monorepo.Path, old, bus *sgebpb.BuildUnits) ([]string, error) {
+	seen := map[monorepo.Label]bool{}
+	for _, ref := range build.UnitRefs(old) {
+		// The previous version may hold labels that are no longer valid, those can't be
+		// referenced by the new version either.
+		if l, err := mr.NewLabel(pkgDir, ref); err == nil {
+			seen[l] = true
+		}
+	}
+	var ret []string
+	for _, ref := range build.UnitRefs(bus) {
+		l, err := mr.NewLabel(pkgDir, ref)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[l]; ok {
+			continue
+		}
+		seen[l] = true
+		refDir, err := mr.ResolveLabelPkgDir(l)
+		if err != nil {
+			return nil, err
+		}
+		refBus, err := bc.LoadBuildUnits(refDir)
+		if err != nil {
+			// Missing units are reported by the build and test checks.
+			continue
+		}
+		if u, ok := build.FindUnit(refBus, l.Target); ok && u.GetDeprecated() {
+			ret = append(ret, build.DeprecationMessage(l, u))
+		}
+	}
+	return ret, nil
+}
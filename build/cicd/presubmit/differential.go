@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+
+	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
+)
+
+// differentialTargets returns the Bazel targets to build instead of the whole build unit |label|
+// for the changed |files| matched by the presubmits of the check: the rule targets of the unit that
+// depend on them. Files that didn't trigger the check don't widen the build. Returns
+// nil when the whole unit must be built, eg. when the unit isn't a Bazel one, when changed files
+// can affect how Bazel loads packages, or when the mapping from files to targets is ambiguous.
+func differentialTargets(mr monorepo.Monorepo, bc build.Context, label monorepo.Label, files []changedFile) []string {
+	target, err := bazelTarget(mr, bc, label)
+	if err != nil || target == "" {
+		return nil
+	}
+	labels, ok := fileLabels(mr, files)
+	if !ok {
+		return nil
+	}
+	expr := fmt.Sprintf("kind(rule, rdeps(%s, set(%s)))", target, strings.Join(labels, " "))
+	targets, err := bc.BazelQuery(expr)
+	if err != nil {
+		log.Printf("WARNING: building all of %s, could not find the targets affected by the change: %v", label, err)
+		return nil
+	}
+	// No target of the unit depends on the changed files, eg. data files read at runtime, yet
+	// they triggered the check. Build everything to be safe.
+	if len(targets) == 0 {
+		return nil
+	}
+	return targets
+}
+
+// bazelTarget returns the Bazel target of build unit |label|, "" if it isn't a Bazel build unit.
+func bazelTarget(mr monorepo.Monorepo, bc build.Context, label monorepo.Label) (string, error) {
+	pkgDir, err := mr.ResolveLabelPkgDir(label)
+	if err != nil {
+		return "", err
+	}
+	bus, err := bc.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return "", err
+	}
+	for _, bu := range bus.BuildUnit {
+		if bu.Name != label.Target || bu.Target == "" {
+			continue
+		}
+		target, err := mr.NewLabel(pkgDir, bu.Target)
+		if err != nil {
+			return "", err
+		}
+		return string(target.TargetExpression()), nil
+	}
+	return "", nil
+}
+
+// fileLabels returns the Bazel labels of the changed |files|, or false if a file has no owning
+// package or can change the Bazel build graph itself.
+func fileLabels(mr monorepo.Monorepo, files []changedFile) ([]string, bool) {
+	var labels []string
+	for _, f := range files {
+		base := path.Base(string(f.path))
+		switch {
+		case base == "BUILD" || base == "BUILD.bazel" || base == "WORKSPACE" || strings.HasSuffix(base, ".bzl"):
+			return nil, false
+		case statusFromP4Status(f.status) == checkpb.Status_Delete:
+			// Deleted files are gone from the build graph, only their former dependents could
+			// tell what breaks.
+			return nil, false
+		}
+		pkg, ok := owningPackage(mr, f.path)
+		if !ok {
+			return nil, false
+		}
+		rel := strings.TrimPrefix(string(f.path), string(pkg))
+		rel = strings.TrimPrefix(rel, "/")
+		labels = append(labels, fmt.Sprintf("//%s:%s", pkg, rel))
+	}
+	return labels, len(labels) > 0
+}
+
+// owningPackage returns the closest directory of |p| with a BUILD file.
+func owningPackage(mr monorepo.Monorepo, p monorepo.Path) (monorepo.Path, bool) {
+	for dir := p.Dir(); ; dir = dir.Dir() {
+		for _, name := range []string{"BUILD", "BUILD.bazel"} {
+			if info, err := os.Stat(mr.ResolvePath(monorepo.NewPath(path.Join(string(dir), name)))); err == nil && !info.IsDir() {
+				return dir, true
+			}
+		}
+		if dir == "" {
+			return "", false
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"log"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/presubmit/durations"
+
+	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+)
+
+// NewDurationRecorder returns a presubmit listener that records the duration of every check run
+// into |store|. Records are written at the end of each presubmit set.
+func NewDurationRecorder(store *durations.Store) Listener {
+	return &durationRecorder{store: store}
+}
+
+type durationRecorder struct {
+	store   *durations.Store
+	records []durations.Record
+}
+
+func (dr *durationRecorder) OnPresubmitStart(mr monorepo.Monorepo, presubmitId string, checks []Check) {
+}
+
+func (dr *durationRecorder) OnCheckStart(check Check) {
+}
+
+func (dr *durationRecorder) OnCheckResult(mdPath monorepo.Path, check Check, result *presubmitpb.CheckResult) {
+	if result.DurationMs == 0 {
+		// Results from runners that predate duration tracking have no duration.
+		return
+	}
+	dr.records = append(dr.records, durations.Record{
+		Time:       time.Now(),
+		Check:      check.Name(),
+		DurationMs: result.DurationMs,
+		Success:    result.OverallResult.Success,
+	})
+}
+
+func (dr *durationRecorder) OnPresubmitEnd(success bool) {
+	// Failing to record durations must not fail the presubmit.
+	if err := dr.store.Append(dr.records...); err != nil {
+		log.Printf("could not record check durations: %v", err)
+	}
+	dr.records = nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package durations keeps a history of how long presubmit checks take to run.
+//
+// The history is stored as a file of JSON records, one per line, so that appending a run is cheap
+// and a corrupt line only loses a single record.
+package durations
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Record is the duration of a single check run.
+type Record struct {
+	// Time is when the check finished.
+	Time time.Time `json:"time"`
+
+	// Check is the name of the check, eg. "check gofmt" or "check_test //foo:test".
+	Check string `json:"check"`
+
+	DurationMs int64 `json:"duration_ms"`
+	Success    bool  `json:"success"`
+}
+
+// Duration returns the duration of the record.
+func (r Record) Duration() time.Duration {
+	return time.Duration(r.DurationMs) * time.Millisecond
+}
+
+// Store is a file backed history of check durations.
+type Store struct {
+	path string
+}
+
+// NewStore returns a store keeping its history at |path|. The file is created on first use.
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// DefaultPath returns the location of the check duration history of the current user.
+func DefaultPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sgep", "check_durations.jsonl"), nil
+}
+
+// Append adds |records| to the history.
+func (s *Store) Append(records ...Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// Load returns all records of the history that finished at or after |since|, oldest first. An
+// empty history is not an error. Lines that cannot be parsed are skipped.
+func (s *Store) Load(since time.Time) ([]Record, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if !r.Time.Before(since) {
+			records = append(records, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", s.path, err)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// Prune drops all records that finished before |before| from the history.
+func (s *Store) Prune(before time.Time) error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		// No history yet, nothing to prune.
+		return nil
+	}
+	records, err := s.Load(before)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so that a crash mid-write keeps the whole history.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Stats summarizes the durations of a check over a period of time.
+type Stats struct {
+	Check string
+
+	// Period is the start of the period summarized. Zero if the records were not split by period.
+	Period time.Time
+
+	Runs     int
+	Failures int
+	P50      time.Duration
+	P95      time.Duration
+	Max      time.Duration
+}
+
+// Summarize computes the duration stats of each check in |records|. If |period| is not zero, the
+// records are also split in periods of that length, so that trends can be seen over time. The
+// result is sorted by period, then by descending P95, so the slowest checks come first.
+func Summarize(records []Record, period time.Duration) []Stats {
+	type key struct {
+		check  string
+		period time.Time
+	}
+	byKey := map[key][]Record{}
+	for _, r := range records {
+		k := key{check: r.Check}
+		if period > 0 {
+			k.period = r.Time.UTC().Truncate(period)
+		}
+		byKey[k] = append(byKey[k], r)
+	}
+	var stats []Stats
+	for k, rs := range byKey {
+		durations := make([]time.Duration, 0, len(rs))
+		failures := 0
+		for _, r := range rs {
+			durations = append(durations, r.Duration())
+			if !r.Success {
+				failures++
+			}
+		}
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+		stats = append(stats, Stats{
+			Check:    k.check,
+			Period:   k.period,
+			Runs:     len(rs),
+			Failures: failures,
+			P50:      percentile(durations, 50),
+			P95:      percentile(durations, 95),
+			Max:      durations[len(durations)-1],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].Period.Equal(stats[j].Period) {
+			return stats[i].Period.Before(stats[j].Period)
+		}
+		if stats[i].P95 != stats[j].P95 {
+			return stats[i].P95 > stats[j].P95
+		}
+		return stats[i].Check < stats[j].Check
+	})
+	return stats
+}
+
+// percentile returns the nearest-rank |p|th percentile of |sorted|, which must not be empty.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package durations
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(filepath.Join(dir, "sgep", "durations.jsonl"))
+
+	// An empty history can be loaded and pruned.
+	if records, err := store.Load(time.Time{}); err != nil || len(records) != 0 {
+		t.Fatalf("Load of empty history: want no records, got %v, %v", records, err)
+	}
+	if err := store.Prune(time.Now()); err != nil {
+		t.Fatalf("Prune of empty history failed: %v", err)
+	}
+
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	old := Record{Time: day, Check: "check gofmt", DurationMs: 1000, Success: true}
+	newer := Record{Time: day.Add(48 * time.Hour), Check: "check_test //foo:test", DurationMs: 5000}
+	if err := store.Append(newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(old); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Record{old, newer}, got); diff != "" {
+		t.Errorf("Load mismatch (-want +got):\n%s", diff)
+	}
+	got, err = store.Load(day.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Record{newer}, got); diff != "" {
+		t.Errorf("Load since mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := store.Prune(day.Add(24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Load(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Record{newer}, got); diff != "" {
+		t.Errorf("Load after prune mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC).Truncate(week)
+	var records []Record
+	// 20 runs of a slow check, taking 1s to 20s.
+	for i := 1; i <= 20; i++ {
+		records = append(records, Record{
+			Time:       start.Add(time.Duration(i) * time.Hour),
+			Check:      "check_test //slow:test",
+			DurationMs: int64(i) * 1000,
+			Success:    i != 20,
+		})
+	}
+	// A fast check, run in two different weeks.
+	records = append(records,
+		Record{Time: start, Check: "check gofmt", DurationMs: 100, Success: true},
+		Record{Time: start.Add(week), Check: "check gofmt", DurationMs: 300, Success: true},
+	)
+
+	want := []Stats{
+		{Check: "check_test //slow:test", Runs: 20, Failures: 1, P50: 10 * time.Second, P95: 19 * time.Second, Max: 20 * time.Second},
+		{Check: "check gofmt", Runs: 2, P50: 100 * time.Millisecond, P95: 300 * time.Millisecond, Max: 300 * time.Millisecond},
+	}
+	if diff := cmp.Diff(want, Summarize(records, 0)); diff != "" {
+		t.Errorf("Summarize mismatch (-want +got):\n%s", diff)
+	}
+
+	want = []Stats{
+		{Check: "check_test //slow:test", Period: start, Runs: 20, Failures: 1, P50: 10 * time.Second, P95: 19 * time.Second, Max: 20 * time.Second},
+		{Check: "check gofmt", Period: start, Runs: 1, P50: 100 * time.Millisecond, P95: 100 * time.Millisecond, Max: 100 * time.Millisecond},
+		{Check: "check gofmt", Period: start.Add(week), Runs: 1, P50: 300 * time.Millisecond, P95: 300 * time.Millisecond, Max: 300 * time.Millisecond},
+	}
+	if diff := cmp.Diff(want, Summarize(records, week)); diff != "" {
+		t.Errorf("Summarize by week mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package explain describes why a change triggers the presubmit checks it does, as a graph going
+// from the changed files to the CICD presubmits whose patterns match them and on to the checks
+// those presubmits expand to.
+//
+// Graphs are plain data so that they can be stored as JSON, eg. by the presubmit runner for Ebert
+// to render, and written in the graphviz DOT language with WriteDot.
+package explain
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Kinds of nodes.
+const (
+	KindFile      = "file"
+	KindPresubmit = "presubmit"
+	KindCheck     = "check"
+)
+
+// Graph is the graph of the checks triggered by a change.
+type Graph struct {
+	// Nodes are the nodes of the graph, in the order they were added.
+	Nodes []Node `json:"nodes"`
+
+	// Edges go from files to presubmits and from presubmits to checks.
+	Edges []Edge `json:"edges"`
+
+	// Omitted is the number of changed files dropped by Truncate.
+	Omitted int `json:"omitted,omitempty"`
+
+	// nodeIndex and edgeIndex are the positions of the nodes by ID and of the edges by their ends.
+	// They are built lazily as graphs may come from JSON.
+	nodeIndex map[string]int
+	edgeIndex map[[2]string]bool
+}
+
+// Node is a changed file, a presubmit or a check.
+type Node struct {
+	// ID uniquely identifies the node in the graph.
+	ID string `json:"id"`
+
+	// Kind is one of KindFile, KindPresubmit or KindCheck.
+	Kind string `json:"kind"`
+
+	// Label is the human readable name of the node: a monorepo path, a CICD file with the index
+	// of the presubmit in it, or a check name.
+	Label string `json:"label"`
+
+	// Monorepo is the name of the monorepo the node belongs to.
+	Monorepo string `json:"monorepo"`
+}
+
+// Edge links two nodes.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Include is the include pattern of the presubmit that matched the file, for file edges.
+	Include string `json:"include,omitempty"`
+
+	// Exclude is set on file edges that did not trigger the presubmit, to the exclude pattern
+	// that ruled out a file matched by Include.
+	Exclude string `json:"exclude,omitempty"`
+}
+
+// Excluded returns whether the edge records a file excluded from a presubmit.
+func (e *Edge) Excluded() bool {
+	return e.Exclude != ""
+}
+
+// AddNode adds a node to the graph, unless there is one with the same ID already.
+func (g *Graph) AddNode(n Node) {
+	g.index()
+	if _, ok := g.nodeIndex[n.ID]; ok {
+		return
+	}
+	g.nodeIndex[n.ID] = len(g.Nodes)
+	g.Nodes = append(g.Nodes, n)
+}
+
+// AddEdge adds an edge to the graph, unless there is one between the same nodes already.
+func (g *Graph) AddEdge(e Edge) {
+	g.index()
+	key := [2]string{e.From, e.To}
+	if g.edgeIndex[key] {
+		return
+	}
+	g.edgeIndex[key] = true
+	g.Edges = append(g.Edges, e)
+}
+
+// Node returns the node with the given ID, or nil if there is none.
+func (g *Graph) Node(id string) *Node {
+	g.index()
+	if i, ok := g.nodeIndex[id]; ok {
+		return &g.Nodes[i]
+	}
+	return nil
+}
+
+// index builds the node and edge indices if needed.
+func (g *Graph) index() {
+	if g.nodeIndex != nil {
+		return
+	}
+	g.nodeIndex = map[string]int{}
+	g.edgeIndex = map[[2]string]bool{}
+	for i, n := range g.Nodes {
+		g.nodeIndex[n.ID] = i
+	}
+	for _, e := range g.Edges {
+		g.edgeIndex[[2]string{e.From, e.To}] = true
+	}
+}
+
+// Truncate keeps the first maxFiles file nodes, by label, and drops the others along with their
+// edges, so that changes touching many files still give graphs that can be stored and rendered.
+// Presubmits and checks are always kept.
+func (g *Graph) Truncate(maxFiles int) {
+	var files []string
+	labels := map[string]string{}
+	for _, n := range g.Nodes {
+		if n.Kind == KindFile {
+			files = append(files, n.ID)
+			labels[n.ID] = n.Label
+		}
+	}
+	if len(files) <= maxFiles {
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return labels[files[i]] < labels[files[j]]
+	})
+	dropped := map[string]bool{}
+	for _, id := range files[maxFiles:] {
+		dropped[id] = true
+	}
+	var nodes []Node
+	for _, n := range g.Nodes {
+		if !dropped[n.ID] {
+			nodes = append(nodes, n)
+		}
+	}
+	var edges []Edge
+	for _, e := range g.Edges {
+		if !dropped[e.From] {
+			edges = append(edges, e)
+		}
+	}
+	g.Nodes = nodes
+	g.Edges = edges
+	g.Omitted += len(dropped)
+	g.nodeIndex = nil
+	g.edgeIndex = nil
+}
+
+// WriteDot writes the graph in the graphviz DOT language. Nodes are grouped by monorepo, and
+// excluded files are linked to their presubmit with dashed edges.
+func (g *Graph) WriteDot(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph presubmit {\n")
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+	var monorepos []string
+	byMonorepo := map[string][]Node{}
+	for _, n := range g.Nodes {
+		if _, ok := byMonorepo[n.Monorepo]; !ok {
+			monorepos = append(monorepos, n.Monorepo)
+		}
+		byMonorepo[n.Monorepo] = append(byMonorepo[n.Monorepo], n)
+	}
+	for i, mr := range monorepos {
+		fmt.Fprintf(&sb, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&sb, "    label=%s;\n", quote(mr))
+		for _, n := range byMonorepo[mr] {
+			fmt.Fprintf(&sb, "    %s [label=%s, shape=%s];\n", quote(n.ID), quote(n.Label), shapes[n.Kind])
+		}
+		sb.WriteString("  }\n")
+	}
+	for _, e := range g.Edges {
+		var attrs []string
+		switch {
+		case e.Excluded():
+			attrs = append(attrs, "style=dashed", "color=red", "label="+quote("excluded by "+e.Exclude))
+		case e.Include != "":
+			attrs = append(attrs, "label="+quote(e.Include))
+		}
+		fmt.Fprintf(&sb, "  %s -> %s", quote(e.From), quote(e.To))
+		if len(attrs) > 0 {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(attrs, ", "))
+		}
+		sb.WriteString(";\n")
+	}
+	if g.Omitted > 0 {
+		fmt.Fprintf(&sb, "  omitted [label=%s, shape=plaintext];\n", quote(fmt.Sprintf("%d more files not shown", g.Omitted)))
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var shapes = map[string]string{
+	KindFile:      "note",
+	KindPresubmit: "box",
+	KindCheck:     "ellipse",
+}
+
+// quote returns s as a DOT quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package explain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func testGraph() *Graph {
+	g := &Graph{}
+	for _, f := range []string{"b.go", "a.go", "c_test.go"} {
+		g.AddNode(Node{ID: "file:" + f, Kind: KindFile, Label: f, Monorepo: "foo"})
+	}
+	g.AddNode(Node{ID: "ps", Kind: KindPresubmit, Label: "CICD[0]", Monorepo: "foo"})
+	g.AddNode(Node{ID: "ps", Kind: KindPresubmit, Label: "duplicate", Monorepo: "foo"})
+	g.AddNode(Node{ID: "check", Kind: KindCheck, Label: "check lint", Monorepo: "foo"})
+	g.AddEdge(Edge{From: "file:a.go", To: "ps", Include: "..."})
+	g.AddEdge(Edge{From: "file:b.go", To: "ps", Include: "..."})
+	g.AddEdge(Edge{From: "file:b.go", To: "ps", Include: "duplicate"})
+	g.AddEdge(Edge{From: "file:c_test.go", To: "ps", Include: "...", Exclude: "..._test.go"})
+	g.AddEdge(Edge{From: "ps", To: "check"})
+	return g
+}
+
+func TestGraph(t *testing.T) {
+	g := testGraph()
+	if len(g.Nodes) != 5 || len(g.Edges) != 4 {
+		t.Fatalf("got %d nodes and %d edges, want 5 and 4", len(g.Nodes), len(g.Edges))
+	}
+	if n := g.Node("ps"); n == nil || n.Label != "CICD[0]" {
+		t.Errorf(`Node("ps") = %v, want the first node added`, n)
+	}
+	if g.Edges[2].Excluded() == false || g.Edges[0].Excluded() {
+		t.Errorf("want only the c_test.go edge to be excluded")
+	}
+
+	// Graphs read back from JSON keep deduplicating.
+	b, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read Graph
+	if err := json.Unmarshal(b, &read); err != nil {
+		t.Fatal(err)
+	}
+	read.AddNode(Node{ID: "ps", Kind: KindPresubmit})
+	read.AddEdge(Edge{From: "ps", To: "check"})
+	if diff := cmp.Diff(g, &read, cmpopts.IgnoreUnexported(Graph{})); diff != "" {
+		t.Errorf("graph diff after JSON round trip (-want +got):\n%s", diff)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	g := testGraph()
+	g.Truncate(3)
+	if len(g.Nodes) != 5 || g.Omitted != 0 {
+		t.Errorf("Truncate(3) changed a graph with 3 files")
+	}
+	g.Truncate(1)
+	var got []string
+	for _, n := range g.Nodes {
+		got = append(got, n.ID)
+	}
+	want := []string{"file:a.go", "ps", "check"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("nodes diff (-want +got):\n%s", diff)
+	}
+	if len(g.Edges) != 2 || g.Omitted != 2 {
+		t.Errorf("got %d edges and %d omitted, want 2 and 2", len(g.Edges), g.Omitted)
+	}
+	// Dropped files can be added back.
+	g.AddNode(Node{ID: "file:b.go", Kind: KindFile})
+	if len(g.Nodes) != 4 {
+		t.Errorf("got %d nodes, want 4", len(g.Nodes))
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	g := testGraph()
+	g.Truncate(2)
+	var sb strings.Builder
+	if err := g.WriteDot(&sb); err != nil {
+		t.Fatal(err)
+	}
+	dot := sb.String()
+	for _, want := range []string{
+		"digraph presubmit {",
+		`subgraph cluster_0 {`,
+		`label="foo";`,
+		`"file:a.go" [label="a.go", shape=note];`,
+		`"ps" [label="CICD[0]", shape=box];`,
+		`"file:a.go" -> "ps" [label="..."];`,
+		`"ps" -> "check";`,
+		`omitted [label="1 more files not shown", shape=plaintext];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("WriteDot() missing %q, got:\n%s", want, dot)
+		}
+	}
+	if strings.Contains(dot, "c_test.go") {
+		t.Errorf("WriteDot() has truncated file c_test.go:\n%s", dot)
+	}
+
+	g = testGraph()
+	sb.Reset()
+	if err := g.WriteDot(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if want := `"file:c_test.go" -> "ps" [style=dashed, color=red, label="excluded by ..._test.go"];`; !strings.Contains(sb.String(), want) {
+		t.Errorf("WriteDot() missing %q, got:\n%s", want, sb.String())
+	}
+}
+
+func TestStore(t *testing.T) {
+	keys := map[string]string{}
+	p4 := p4mock.New()
+	p4.KeyGetFunc = func(key string) (string, error) {
+		if v, ok := keys[key]; ok {
+			return v, nil
+		}
+		return "0", p4lib.ErrKeyNotFound
+	}
+	p4.KeySetFunc = func(key, val string) error {
+		keys[key] = val
+		return nil
+	}
+	run, err := Load(p4, 42)
+	if err != nil || run != nil {
+		t.Fatalf("Load() = %v, %v; want nothing stored", run, err)
+	}
+	g := &Graph{}
+	for i := 0; i < MaxStoredFiles+10; i++ {
+		id := fmt.Sprintf("file:%04d", i)
+		g.AddNode(Node{ID: id, Kind: KindFile, Label: id})
+		g.AddEdge(Edge{From: id, To: "ps", Include: "..."})
+	}
+	g.AddNode(Node{ID: "ps", Kind: KindPresubmit})
+	want := &Run{Change: 43, PresubmitID: "id", Time: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), Graph: g}
+	if err := Save(p4, 42, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys[Namespace+"-42"]; !ok {
+		t.Errorf("got keys %v, want %s-42", keys, Namespace)
+	}
+	got, err := Load(p4, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(Graph{})); diff != "" {
+		t.Errorf("Load() diff (-want +got):\n%s", diff)
+	}
+	if got.Graph.Omitted != 10 || len(got.Graph.Edges) != MaxStoredFiles {
+		t.Errorf("got %d omitted files and %d edges, want 10 and %d", got.Graph.Omitted, len(got.Graph.Edges), MaxStoredFiles)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package explain
+
+import (
+	"strconv"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// Namespace is the namespace of the p4 keys holding the graph of the last presubmit run of each
+// review.
+const Namespace = "presubmit-explain"
+
+// MaxStoredFiles is how many changed files are kept in the stored graphs, so that they fit in a
+// p4 key.
+const MaxStoredFiles = 200
+
+// Run is the graph of a presubmit run of a review.
+type Run struct {
+	// Change is the shelved change the presubmit ran on.
+	Change int `json:"change"`
+
+	// PresubmitID identifies the presubmit run in the logs.
+	PresubmitID string `json:"presubmitId"`
+
+	// Time is when the presubmit ran.
+	Time time.Time `json:"time"`
+
+	Graph *Graph `json:"graph"`
+}
+
+// Save stores the graph of a presubmit run of a review, overwriting that of the previous run. The
+// graph is truncated to MaxStoredFiles files in place.
+func Save(p4 p4lib.P4, review int, run *Run) error {
+	run.Graph.Truncate(MaxStoredFiles)
+	return p4lib.NewKeyStore(p4, Namespace).Set(strconv.Itoa(review), run)
+}
+
+// Load returns the graph of the last presubmit run of a review, or nil if there is none.
+func Load(p4 p4lib.P4, review int) (*Run, error) {
+	var run Run
+	found, err := p4lib.NewKeyStore(p4, Namespace).Get(strconv.Itoa(review), &run)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &run, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"sort"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/presubmit/impact"
+)
+
+// testImpact returns whether the change affects test unit |tu| according to the test impact map
+// of the runner, Unknown if there is none.
+func (ts *triggeredSet) testImpact(tu monorepo.Label) impact.Verdict {
+	m := ts.runner.options.Impact
+	if m == nil {
+		return impact.Unknown
+	}
+	var files []monorepo.Path
+	for _, f := range ts.files {
+		files = append(files, f.path)
+	}
+	return m.Affects(tu, files, time.Now(), impact.DefaultMaxAge)
+}
+
+// skipUnaffected returns whether a check_test of a test that the change doesn't affect is skipped.
+// Tests are only skipped when restricting to affected tests, and never when explicitly selected.
+func (ts *triggeredSet) skipUnaffected(verdict impact.Verdict) bool {
+	return verdict == impact.Unaffected && ts.runner.options.ImpactRestrict && len(ts.runner.options.Only) == 0
+}
+
+// prioritizeByImpact moves the check_test checks of tests affected by the change first, and those
+// of unaffected tests last, keeping the order of the checks otherwise.
+func prioritizeByImpact(checks []Check) {
+	rank := func(c Check) int {
+		ct, ok := c.(*checkTest)
+		if !ok {
+			return 1
+		}
+		switch ct.impact {
+		case impact.Affected:
+			return 0
+		case impact.Unaffected:
+			return 2
+		}
+		return 1
+	}
+	sort.SliceStable(checks, func(i, j int) bool {
+		return rank(checks[i]) < rank(checks[j])
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs implements a test impact map store on Google Cloud Storage.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"sge-monorepo/build/cicd/presubmit/impact"
+
+	"cloud.google.com/go/storage"
+)
+
+// DefaultObject is the object CI keeps the test impact map in.
+const DefaultObject = "test_impact/map.json"
+
+// NewStore returns a store that keeps the map as object |name| in a GCS bucket. GCS object writes
+// are atomic, readers either see the previous or the new map.
+func NewStore(ctx context.Context, bucket, name string) (impact.Store, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCS client: %v", err)
+	}
+	return &gcsStore{
+		ctx: ctx,
+		obj: client.Bucket(bucket).Object(name),
+	}, nil
+}
+
+type gcsStore struct {
+	ctx context.Context
+	obj *storage.ObjectHandle
+}
+
+func (gs *gcsStore) Load() (*impact.Map, error) {
+	r, err := gs.obj.NewReader(gs.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return impact.New(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return impact.Decode(data)
+}
+
+func (gs *gcsStore) Save(m *impact.Map) error {
+	data, err := impact.Encode(m)
+	if err != nil {
+		return err
+	}
+	w := gs.obj.NewWriter(gs.ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package impact maps test units to the files they exercise, so that presubmits can run the tests
+// affected by a change first, or only those.
+//
+// The map is updated postsubmit from the Bazel dependencies of the test units, see Update, and is
+// never exact: it lags behind the depot, and files read at runtime or tests that aren't Bazel ones
+// are unknown to it. Lookups therefore fall back to "unknown" whenever the map can't vouch for a
+// test, and callers are expected to run unknown tests.
+package impact
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+)
+
+// DefaultMaxAge is how old the mapping of a test can be before it isn't trusted anymore.
+const DefaultMaxAge = 7 * 24 * time.Hour
+
+// Map is the mapping from test units to the files they exercise.
+type Map struct {
+	// Cl is the CL the map was last updated at.
+	Cl int64 `json:"cl"`
+
+	// Tests are the mappings, keyed by test unit label.
+	Tests map[string]*Entry `json:"tests"`
+}
+
+// Entry is the mapping of a single test unit.
+type Entry struct {
+	// Cl is the CL the files were computed at.
+	Cl int64 `json:"cl"`
+
+	// Time is when the files were computed.
+	Time time.Time `json:"time"`
+
+	// Files are the monorepo paths of the files exercised by the test, sorted.
+	Files []string `json:"files"`
+
+	// Unknown is set for tests that couldn't be mapped, eg. tests that aren't Bazel ones. Their
+	// files are only their BUILDUNIT file, so that they are mapped again when it changes.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// New returns an empty map.
+func New() *Map {
+	return &Map{Tests: map[string]*Entry{}}
+}
+
+// Verdict is whether a change affects a test.
+type Verdict int
+
+const (
+	// Unknown means that the map can't tell, eg. the test isn't mapped or its mapping is stale.
+	Unknown Verdict = iota
+	// Affected means that the change touches files exercised by the test.
+	Affected
+	// Unaffected means that the change touches none of the files exercised by the test.
+	Unaffected
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Affected:
+		return "affected"
+	case Unaffected:
+		return "unaffected"
+	}
+	return "unknown"
+}
+
+// Affects returns whether a change of |files| affects |test|. Mappings older than |maxAge| at |now|
+// are unknown. Files next to a mapped file, eg. new sources picked up by a glob, are considered
+// exercised by the test, and changes to the WORKSPACE are unknown to all tests.
+func (m *Map) Affects(test monorepo.Label, files []monorepo.Path, now time.Time, maxAge time.Duration) Verdict {
+	e, ok := m.Tests[test.String()]
+	if !ok || e.Unknown || now.Sub(e.Time) > maxAge {
+		return Unknown
+	}
+	return e.affects(files)
+}
+
+func (e *Entry) affects(files []monorepo.Path) Verdict {
+	mapped := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, f := range e.Files {
+		mapped[f] = true
+		dirs[path.Dir(f)] = true
+	}
+	verdict := Unaffected
+	for _, f := range files {
+		p := string(f)
+		switch {
+		case mapped[p] || dirs[path.Dir(p)]:
+			return Affected
+		case path.Base(p) == "WORKSPACE":
+			verdict = Unknown
+		}
+	}
+	return verdict
+}
+
+// Store keeps a map.
+type Store interface {
+	// Load returns the stored map, an empty one if there is none yet.
+	Load() (*Map, error)
+
+	// Save replaces the stored map with |m|.
+	Save(m *Map) error
+}
+
+// Decode parses a map written by Encode.
+func Decode(data []byte) (*Map, error) {
+	m := New()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("could not parse test impact map: %v", err)
+	}
+	if m.Tests == nil {
+		m.Tests = map[string]*Entry{}
+	}
+	return m, nil
+}
+
+// Encode returns the serialized map.
+func Encode(m *Map) ([]byte, error) {
+	for _, e := range m.Tests {
+		sort.Strings(e.Files)
+	}
+	return json.Marshal(m)
+}
+
+// NewFileStore returns a store that keeps the map in file |path|, eg. on a share or for local runs.
+func NewFileStore(path string) Store {
+	return &fileStore{path: path}
+}
+
+type fileStore struct {
+	path string
+}
+
+func (fs *fileStore) Load() (*Map, error) {
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return New(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+func (fs *fileStore) Save(m *Map) error {
+	data, err := Encode(m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so that readers never see a partial map.
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
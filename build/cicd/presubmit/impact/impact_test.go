@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impact
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func mustLabel(t *testing.T, l string) monorepo.Label {
+	t.Helper()
+	label, err := monorepo.New("", map[string]monorepo.Path{}).NewLabel("", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return label
+}
+
+func paths(ps ...string) []monorepo.Path {
+	var ret []monorepo.Path
+	for _, p := range ps {
+		ret = append(ret, monorepo.NewPath(p))
+	}
+	return ret
+}
+
+func TestAffects(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	m := New()
+	m.Tests["//foo:test"] = &Entry{Time: now.Add(-time.Hour), Files: []string{"foo/BUILD", "foo/foo.go", "lib/lib.go"}}
+	m.Tests["//old:test"] = &Entry{Time: now.Add(-30 * 24 * time.Hour), Files: []string{"old/old.go"}}
+	m.Tests["//script:test"] = &Entry{Time: now, Files: []string{"script/BUILDUNIT"}, Unknown: true}
+	testCases := []struct {
+		test  string
+		files []monorepo.Path
+		want  Verdict
+	}{
+		{"//foo:test", paths("lib/lib.go"), Affected},
+		{"//foo:test", paths("docs/README.md", "foo/BUILD"), Affected},
+		// New files next to mapped ones may be picked up by globs.
+		{"//foo:test", paths("lib/new.go"), Affected},
+		{"//foo:test", paths("docs/README.md"), Unaffected},
+		{"//foo:test", paths("WORKSPACE"), Unknown},
+		{"//old:test", paths("docs/README.md"), Unknown},
+		{"//script:test", paths("docs/README.md"), Unknown},
+		{"//new:test", paths("docs/README.md"), Unknown},
+	}
+	for _, tc := range testCases {
+		if got := m.Affects(mustLabel(t, tc.test), tc.files, now, DefaultMaxAge); got != tc.want {
+			t.Errorf("Affects(%s, %v) = %v, want %v", tc.test, tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	m := New()
+	m.Tests["//gone:test"] = &Entry{Time: now, Files: []string{"gone/gone.go"}}
+	m.Tests["//foo:test"] = &Entry{Cl: 1, Time: now, Files: []string{"foo/foo.go"}}
+	m.Tests["//bar:test"] = &Entry{Cl: 1, Time: now, Files: []string{"bar/bar.go"}}
+	m.Tests["//old:test"] = &Entry{Cl: 1, Time: now.Add(-5 * 24 * time.Hour), Files: []string{"old/old.go"}}
+	var mapped []string
+	mapper := func(test monorepo.Label) ([]string, error) {
+		mapped = append(mapped, test.String())
+		switch test.Target {
+		case "script":
+			return nil, ErrNoTargets
+		case "broken":
+			return nil, errors.New("query failed")
+		}
+		return []string{string(test.Pkg) + "/new.go", string(test.Pkg) + "/BUILD"}, nil
+	}
+	var tests []monorepo.Label
+	for _, l := range []string{"//foo:test", "//bar:test", "//old:test", "//new:script", "//new:broken"} {
+		tests = append(tests, mustLabel(t, l))
+	}
+
+	got := Update(m, tests, paths("foo/foo.go"), mapper, UpdateOptions{Cl: 2, Now: now, MaxMapped: 3})
+	if got != 2 {
+		t.Errorf("Update() = %d, want 2", got)
+	}
+	// Affected tests first, then old ones, then unmapped ones.
+	if want := []string{"//foo:test", "//old:test", "//new:script"}; !cmp.Equal(want, mapped) {
+		t.Errorf("mapped %v, want %v", mapped, want)
+	}
+	want := map[string]*Entry{
+		"//foo:test":   {Cl: 2, Time: now, Files: []string{"foo/BUILD", "foo/new.go"}},
+		"//bar:test":   {Cl: 1, Time: now, Files: []string{"bar/bar.go"}},
+		"//old:test":   {Cl: 2, Time: now, Files: []string{"old/BUILD", "old/new.go"}},
+		"//new:script": {Cl: 2, Time: now, Files: []string{"new/BUILDUNIT"}, Unknown: true},
+	}
+	if diff := cmp.Diff(want, m.Tests); diff != "" {
+		t.Errorf("map diff (-want +got):\n%s", diff)
+	}
+
+	// The next update maps the rest, changes to BUILDUNIT files remap unknown tests.
+	mapped = nil
+	Update(m, tests, paths("new/BUILDUNIT"), mapper, UpdateOptions{Cl: 3, Now: now})
+	if want := []string{"//new:script", "//new:broken"}; !cmp.Equal(want, mapped) {
+		t.Errorf("mapped %v, want %v", mapped, want)
+	}
+	if m.Cl != 3 {
+		t.Errorf("map CL = %d, want 3", m.Cl)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "impact", "map.json"))
+	m, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tests) != 0 {
+		t.Errorf("Load() of missing map = %v, want empty map", m)
+	}
+	m.Cl = 12
+	m.Tests["//foo:test"] = &Entry{Cl: 12, Time: time.Unix(1600000000, 0).UTC(), Files: []string{"foo/b.go", "foo/a.go"}}
+	if err := store.Save(m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(m, got); diff != "" {
+		t.Errorf("Load() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLabelPath(t *testing.T) {
+	for label, want := range map[string]string{
+		"//foo:bar.go":          "foo/bar.go",
+		"//foo:sub/bar.go":      "foo/sub/bar.go",
+		"//:WORKSPACE":          "WORKSPACE",
+		"@com_github_x//y:z.go": "",
+	} {
+		got, ok := labelPath(label)
+		if got != want || ok != (want != "") {
+			t.Errorf("labelPath(%s) = %q, %v, want %q", label, got, ok, want)
+		}
+	}
+}
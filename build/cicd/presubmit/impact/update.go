@@ -0,0 +1,235 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impact
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+)
+
+// ErrNoTargets is returned by mappers for test units that have no Bazel targets to analyze.
+var ErrNoTargets = errors.New("no Bazel targets")
+
+// Mapper returns the monorepo paths of the files exercised by test unit |test|.
+type Mapper func(test monorepo.Label) ([]string, error)
+
+// BazelMapper returns a mapper that lists the source and BUILD files of the Bazel dependencies of
+// test units, along with their BUILDUNIT file. The Bazel targets of a test unit are its own, and
+// those of the build units it references as bin or deps.
+func BazelMapper(mr monorepo.Monorepo, bc build.Context) Mapper {
+	return func(test monorepo.Label) ([]string, error) {
+		pkgDir, err := mr.ResolveLabelPkgDir(test)
+		if err != nil {
+			return nil, err
+		}
+		targets, err := testTargets(mr, bc, pkgDir, test)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 0 {
+			return nil, ErrNoTargets
+		}
+		set := fmt.Sprintf("set(%s)", strings.Join(targets, " "))
+		expr := fmt.Sprintf(`kind("source file", deps(%s)) + buildfiles(deps(%s))`, set, set)
+		labels, err := bc.BazelQuery(expr)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{path.Join(string(pkgDir), "BUILDUNIT")}
+		for _, l := range labels {
+			if p, ok := labelPath(l); ok {
+				files = append(files, p)
+			}
+		}
+		return files, nil
+	}
+}
+
+// testTargets returns the Bazel target expressions of test unit |test| in |pkgDir|.
+func testTargets(mr monorepo.Monorepo, bc build.Context, pkgDir monorepo.Path, test monorepo.Label) ([]string, error) {
+	bus, err := bc.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	var targets, units []string
+	for _, tu := range bus.TestUnit {
+		if tu.Name != test.Target {
+			continue
+		}
+		targets = append(targets, tu.Target...)
+		if strings.Contains(tu.Bin, ":") {
+			units = append(units, tu.Bin)
+		}
+		units = append(units, tu.Deps...)
+	}
+	for _, btu := range bus.BuildTestUnit {
+		if btu.Name == test.Target {
+			units = append(units, btu.BuildUnit)
+		}
+	}
+	var exprs []string
+	for _, t := range targets {
+		l, err := mr.NewLabel(pkgDir, t)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, string(l.TargetExpression()))
+	}
+	for _, u := range units {
+		l, err := mr.NewLabel(pkgDir, u)
+		if err != nil {
+			return nil, err
+		}
+		t, err := buildUnitTarget(mr, bc, l)
+		if err != nil {
+			return nil, err
+		}
+		if t != "" {
+			exprs = append(exprs, t)
+		}
+	}
+	return exprs, nil
+}
+
+// buildUnitTarget returns the Bazel target of build unit |label|, "" if it isn't a Bazel one.
+func buildUnitTarget(mr monorepo.Monorepo, bc build.Context, label monorepo.Label) (string, error) {
+	pkgDir, err := mr.ResolveLabelPkgDir(label)
+	if err != nil {
+		return "", err
+	}
+	bus, err := bc.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return "", err
+	}
+	for _, bu := range bus.BuildUnit {
+		if bu.Name != label.Target || bu.Target == "" {
+			continue
+		}
+		target, err := mr.NewLabel(pkgDir, bu.Target)
+		if err != nil {
+			return "", err
+		}
+		return string(target.TargetExpression()), nil
+	}
+	return "", nil
+}
+
+// labelPath returns the monorepo path of a file label of the main repository, eg.
+// "//foo:bar/baz.go" is "foo/bar/baz.go".
+func labelPath(label string) (string, bool) {
+	if !strings.HasPrefix(label, "//") {
+		// Files of external repositories.
+		return "", false
+	}
+	i := strings.Index(label, ":")
+	if i < 0 {
+		return "", false
+	}
+	return path.Join(label[2:i], label[i+1:]), true
+}
+
+// UpdateOptions configures an update of a map.
+type UpdateOptions struct {
+	// Cl is the CL the update is made at.
+	Cl int64
+
+	// Now is the time of the update.
+	Now time.Time
+
+	// MaxAge is how old mappings can be, see Map.Affects. Mappings are refreshed once half as old,
+	// so that they don't go stale. Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+
+	// MaxMapped limits how many tests are mapped by a single update, 0 means no limit. Tests
+	// affected by the changed files are mapped first, then those with the oldest mappings, then
+	// tests that aren't mapped yet.
+	MaxMapped int
+}
+
+// Update brings |m| up to date with the monorepo after a change of |changed| files: tests that
+// are gone are dropped, and tests that were affected by the change, have old mappings or aren't
+// mapped yet are mapped again with |mapper|. Tests that can't be mapped are recorded as unknown, so
+// that presubmits run them. Returns the number of tests mapped.
+func Update(m *Map, tests []monorepo.Label, changed []monorepo.Path, mapper Mapper, opts UpdateOptions) int {
+	if opts.MaxAge == 0 {
+		opts.MaxAge = DefaultMaxAge
+	}
+	exists := map[string]bool{}
+	for _, t := range tests {
+		exists[t.String()] = true
+	}
+	for name := range m.Tests {
+		if !exists[name] {
+			delete(m.Tests, name)
+		}
+	}
+	type candidate struct {
+		test monorepo.Label
+		// rank orders candidates: affected, old, then unmapped.
+		rank int
+		time time.Time
+	}
+	var candidates []candidate
+	for _, t := range tests {
+		e, ok := m.Tests[t.String()]
+		switch {
+		case !ok:
+			candidates = append(candidates, candidate{t, 2, time.Time{}})
+		case e.affects(changed) != Unaffected:
+			candidates = append(candidates, candidate{t, 0, e.Time})
+		case opts.Now.Sub(e.Time) > opts.MaxAge/2:
+			candidates = append(candidates, candidate{t, 1, e.Time})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].time.Before(candidates[j].time)
+	})
+	if opts.MaxMapped > 0 && len(candidates) > opts.MaxMapped {
+		candidates = candidates[:opts.MaxMapped]
+	}
+	mapped := 0
+	for _, c := range candidates {
+		name := c.test.String()
+		files, err := mapper(c.test)
+		if err != nil {
+			if !errors.Is(err, ErrNoTargets) {
+				log.Printf("WARNING: could not map the files of %s: %v", name, err)
+			}
+			m.Tests[name] = &Entry{
+				Cl:      opts.Cl,
+				Time:    opts.Now,
+				Files:   []string{path.Join(string(c.test.Pkg), "BUILDUNIT")},
+				Unknown: true,
+			}
+			continue
+		}
+		sort.Strings(files)
+		m.Tests[name] = &Entry{Cl: opts.Cl, Time: opts.Now, Files: files}
+		mapped++
+	}
+	m.Cl = opts.Cl
+	return mapped
+}
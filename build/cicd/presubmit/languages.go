@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"sge-monorepo/build/cicd/monorepo"
+)
+
+// languages maps the languages checker tools can declare to the patterns of the base names of
+// their files.
+var languages = map[string][]string{
+	"build":     {"BUILD", "BUILD.bazel"},
+	"bzl":       {"*.bzl"},
+	"cpp":       {"*.c", "*.cc", "*.cpp", "*.cxx", "*.h", "*.hh", "*.hpp"},
+	"csharp":    {"*.cs"},
+	"go":        {"*.go", "go.mod", "go.sum"},
+	"markdown":  {"*.md"},
+	"proto":     {"*.proto"},
+	"python":    {"*.py"},
+	"rust":      {"*.rs", "Cargo.toml"},
+	"sgeb":      {"BUILDUNIT"},
+	"shell":     {"*.sh", "*.bat", "*.cmd", "*.ps1"},
+	"textproto": {"*.textpb", "CICD", "BUILDUNIT"},
+	"workspace": {"WORKSPACE", "WORKSPACE.bazel"},
+}
+
+// fileLanguages returns the languages of the file at |p|, none if unknown. A file may be of
+// several languages, eg. BUILDUNIT files are both sgeb and text proto files.
+func fileLanguages(p monorepo.Path) []string {
+	base := path.Base(string(p))
+	var ret []string
+	for lang, patterns := range languages {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, base); ok {
+				ret = append(ret, lang)
+				break
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// detectLanguages returns the set of the languages of |files|.
+func detectLanguages(files []changedFile) map[string]bool {
+	ret := map[string]bool{}
+	for _, f := range files {
+		for _, lang := range fileLanguages(f.path) {
+			ret[lang] = true
+		}
+	}
+	return ret
+}
+
+// validateLanguages checks that the languages of |tool| are known.
+func validateLanguages(tool checkerTool) error {
+	for _, lang := range tool.toolPb.Languages {
+		if _, ok := languages[lang]; !ok {
+			return fmt.Errorf("checker tool %s: unknown language %q", tool.toolPb.Action, lang)
+		}
+	}
+	return nil
+}
+
+// handles returns whether |tool| looks at files of one of the languages |langs|. Tools without
+// languages handle all files.
+func (tool checkerTool) handles(langs map[string]bool) bool {
+	if len(tool.toolPb.Languages) == 0 {
+		return true
+	}
+	for _, lang := range tool.toolPb.Languages {
+		if langs[lang] {
+			return true
+		}
+	}
+	return false
+}
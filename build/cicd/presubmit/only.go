@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+)
+
+// Kinds of checks. Check names start with their kind.
+const (
+	KindCheck               = "check"
+	KindCheckBuild          = "check_build"
+	KindCheckTest           = "check_test"
+	KindCheckGen            = "check_gen"
+	KindBlockDeprecatedDeps = "block_deprecated_deps"
+)
+
+var checkKinds = map[string]bool{
+	KindCheck:               true,
+	KindCheckBuild:          true,
+	KindCheckTest:           true,
+	KindCheckGen:            true,
+	KindBlockDeprecatedDeps: true,
+}
+
+// Selector selects some of the triggered checks of a presubmit. Selectors are written as:
+//
+//      format                       check with action "format"
+//      check:format                 same as above
+//      check_test                   all check_test checks
+//      check_test://foo:tests       check_test of //foo:tests, or of the units of the suite
+//      check_build://foo/...        check_build of all the units under //foo
+type Selector struct {
+	// Kind is the kind of check selected, eg. "check_test".
+	Kind string
+
+	// Target is the action of a check, the label of a check_build/check_test/check_gen or the file of a
+	// block_deprecated_deps. Labels may end with "/..." to select all labels under a package. If
+	// empty, all checks of the kind are selected.
+	Target string
+}
+
+// String returns the selector as it's parsed by ParseSelectors.
+func (s Selector) String() string {
+	if s.Target == "" {
+		return s.Kind
+	}
+	return s.Kind + ":" + s.Target
+}
+
+// ParseSelectors parses comma separated lists of selectors, eg. "format,check_test://foo:tests".
+func ParseSelectors(specs ...string) ([]Selector, error) {
+	var selectors []Selector
+	for _, spec := range specs {
+		for _, s := range strings.Split(spec, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if checkKinds[s] {
+				selectors = append(selectors, Selector{Kind: s})
+				continue
+			}
+			if i := strings.Index(s, ":"); i > 0 && checkKinds[s[:i]] {
+				target := s[i+1:]
+				if target == "" {
+					return nil, fmt.Errorf("empty target in selector %q", s)
+				}
+				selectors = append(selectors, Selector{Kind: s[:i], Target: target})
+				continue
+			}
+			if strings.ContainsAny(s, ":/ ") {
+				return nil, fmt.Errorf("invalid selector %q: want an action name or <kind>:<target>", s)
+			}
+			selectors = append(selectors, Selector{Kind: KindCheck, Target: s})
+		}
+	}
+	return selectors, nil
+}
+
+// selection tracks which selectors of a run selected checks. A nil selection selects all checks.
+type selection struct {
+	selectors []Selector
+	matched   []bool
+}
+
+func newSelection(selectors []Selector) *selection {
+	return &selection{
+		selectors: selectors,
+		matched:   make([]bool, len(selectors)),
+	}
+}
+
+// selects returns whether a check of |kind| on |target| should run.
+func (s *selection) selects(kind, target string) bool {
+	if s == nil || len(s.selectors) == 0 {
+		return true
+	}
+	selected := false
+	for i, sel := range s.selectors {
+		if sel.Kind != kind {
+			continue
+		}
+		if sel.Target == "" || sel.Target == target {
+			s.matched[i] = true
+			selected = true
+		}
+	}
+	return selected
+}
+
+// selectsLabel returns whether a check of |kind| on |label| should run. Selector targets are
+// resolved as labels of |mr|, where omitting the target name defaults to |shorthand|.
+func (s *selection) selectsLabel(mr monorepo.Monorepo, kind string, label monorepo.Label, shorthand string) bool {
+	if s == nil || len(s.selectors) == 0 {
+		return true
+	}
+	selected := false
+	for i, sel := range s.selectors {
+		if sel.Kind != kind {
+			continue
+		}
+		if sel.Target == "" || labelMatches(mr, sel.Target, label, shorthand) {
+			s.matched[i] = true
+			selected = true
+		}
+	}
+	return selected
+}
+
+func labelMatches(mr monorepo.Monorepo, target string, label monorepo.Label, shorthand string) bool {
+	if strings.HasSuffix(target, "/...") {
+		prefix := strings.TrimSuffix(target, "...")
+		ls := label.String()
+		return strings.HasPrefix(ls, prefix) || strings.TrimSuffix(prefix, "/")+":"+label.Target == ls
+	}
+	want, err := mr.NewLabelWithShorthand("", target, shorthand)
+	if err != nil {
+		return target == label.String()
+	}
+	return want == label
+}
+
+// unmatched returns the selectors that didn't select any check.
+func (s *selection) unmatched() []Selector {
+	if s == nil {
+		return nil
+	}
+	var unmatched []Selector
+	for i, sel := range s.selectors {
+		if !s.matched[i] {
+			unmatched = append(unmatched, sel)
+		}
+	}
+	return unmatched
+}
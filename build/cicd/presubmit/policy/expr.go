@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// Expressions are CEL (https://github.com/google/cel-spec) with its standard definitions, eg.
+// review.approvals >= 2 && files.all(f, f.startsWith("//game/")). They are type checked when
+// compiled, so that unknown variables and functions are rejected before being evaluated.
+//
+// Variables are Go values: ints, strings, bools, slices and maps with string keys. Their fields
+// are only known when evaluated, a missing one is an evaluation error.
+
+// Expr is a compiled expression.
+type Expr struct {
+	src string
+	prg cel.Program
+}
+
+// CompileExpr compiles expression |src| over variables |vars|.
+func CompileExpr(src string, vars ...string) (*Expr, error) {
+	var opts []cel.EnvOption
+	for _, v := range vars {
+		opts = append(opts, cel.Declarations(decls.NewVar(v, decls.Dyn)))
+	}
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(src)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", src, iss.Err())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", src, err)
+	}
+	return &Expr{src: src, prg: prg}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression with the variables |vars|.
+func (e *Expr) Eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := e.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return v.Value(), nil
+}
+
+// EvalBool evaluates an expression that must be a bool.
+func (e *Expr) EvalBool(vars map[string]interface{}) (bool, error) {
+	v, err := e.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: got %s, want bool", e.src, v.Type().TypeName())
+	}
+	return b, nil
+}
+
+func (e *Expr) eval(vars map[string]interface{}) (ref.Val, error) {
+	v, _, err := e.prg.Eval(vars)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", e.src, err)
+	}
+	return v, nil
+}
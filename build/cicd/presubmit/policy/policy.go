@@ -0,0 +1,342 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy evaluates submit policies: rules, written as CEL expressions in a
+// presubmit.SubmitPolicy text proto, that a change must satisfy to be submitted. Different
+// projects gate submits differently, eg. with a minimum number of approvals, checks that must
+// have passed, or office hours for submits to some paths.
+//
+// Rules see the following variables:
+//
+//   cl.number, cl.user, cl.description   the change
+//   cl.files                             depot paths of its files
+//   review.id                            the review of the change, 0 if it has none
+//   review.author, review.state
+//   review.approvals, review.approvers   current up votes by users other than the author
+//   review.rejections                    current down votes
+//   review.votes                         current votes by user, eg. {"alice": 1}
+//   presubmit.ran                        whether the presubmit results are known
+//   presubmit.success
+//   presubmit.passed, presubmit.failed   names of the checks that passed and failed
+//   now.hour, now.minute, now.date       evaluation time in the time zone of the policy, with the
+//   now.weekday                          date as "2006-01-02" and weekdays from 0 for Sunday
+//
+// For example:
+//
+//   rule {
+//     name: "office-hours"
+//     include: "//game/release/..."
+//     condition: "now.weekday >= 1 && now.weekday <= 5 && now.hour >= 9 && now.hour < 17"
+//     message: "Release branches only take submits during office hours."
+//   }
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Policy is a compiled submit policy.
+type Policy struct {
+	rules []*rule
+	loc   *time.Location
+}
+
+type rule struct {
+	name      string
+	message   string
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	condition *Expr
+}
+
+// Input is the state of a change a policy is evaluated against.
+type Input struct {
+	Change *p4lib.Description
+	// Review is the review of the change, nil if it has none.
+	Review *swarm.Review
+	// Presubmit is the result of the presubmit of the change, nil if unknown.
+	Presubmit *Presubmit
+	Now       time.Time
+}
+
+// Presubmit is the result of a presubmit run.
+type Presubmit struct {
+	Success bool
+	Passed  []string
+	Failed  []string
+}
+
+// Violation is a rule a change doesn't satisfy.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Rule, v.Message)
+}
+
+// Compile compiles the policy |pb|.
+func Compile(pb *presubmitpb.SubmitPolicy) (*Policy, error) {
+	p := &Policy{loc: time.UTC}
+	if pb.TimeZone != "" {
+		loc, err := time.LoadLocation(pb.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %v", err)
+		}
+		p.loc = loc
+	}
+	names := map[string]bool{}
+	for _, r := range pb.Rule {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule without a name: %q", r.Condition)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Condition == "" {
+			return nil, fmt.Errorf("rule %s has no condition", r.Name)
+		}
+		cond, err := CompileExpr(r.Condition, ruleVars...)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		compiled := &rule{name: r.Name, message: r.Message, condition: cond}
+		for _, pattern := range r.Include {
+			compiled.include = append(compiled.include, patternRegexp(pattern))
+		}
+		for _, pattern := range r.Exclude {
+			compiled.exclude = append(compiled.exclude, patternRegexp(pattern))
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+// Parse compiles the text proto of a presubmit.SubmitPolicy.
+func Parse(text string) (*Policy, error) {
+	pb := &presubmitpb.SubmitPolicy{}
+	if err := proto.UnmarshalText(text, pb); err != nil {
+		return nil, fmt.Errorf("could not parse submit policy: %v", err)
+	}
+	return Compile(pb)
+}
+
+// Load compiles the submit policy at depot path |path|.
+func Load(p4 p4lib.P4, path string) (*Policy, error) {
+	text, err := p4.Print("-q", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read submit policy %s: %v", path, err)
+	}
+	p, err := Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+// patternRegexp converts a depot path pattern to a regexp: "..." matches any sequence of
+// characters and "*" any sequence of characters but "/".
+func patternRegexp(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "..."):
+			sb.WriteString(".*")
+			i += 3
+		case pattern[i] == '*':
+			sb.WriteString("[^/]*")
+			i++
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			i++
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func matchesAny(res []*regexp.Regexp, path string) bool {
+	for _, re := range res {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// applies returns whether the rule applies to a change with |files|.
+func (r *rule) applies(files []string) bool {
+	if len(r.include) == 0 && len(r.exclude) == 0 {
+		return true
+	}
+	for _, f := range files {
+		if (len(r.include) == 0 || matchesAny(r.include, f)) && !matchesAny(r.exclude, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleVars are the variables of the rules, see vars.
+var ruleVars = []string{"cl", "review", "presubmit", "now"}
+
+// vars returns the variables of the rules for |in|.
+func (p *Policy) vars(in *Input) map[string]interface{} {
+	cl := map[string]interface{}{
+		"number":      int64(0),
+		"user":        "",
+		"description": "",
+		"files":       []interface{}{},
+	}
+	if in.Change != nil {
+		var files []string
+		for _, f := range in.Change.Files {
+			files = append(files, f.DepotPath)
+		}
+		cl["number"] = int64(in.Change.Cl)
+		cl["user"] = in.Change.User
+		cl["description"] = in.Change.Description
+		cl["files"] = files
+	}
+	review := map[string]interface{}{
+		"id":         int64(0),
+		"author":     "",
+		"state":      "",
+		"approvals":  int64(0),
+		"approvers":  []interface{}{},
+		"rejections": int64(0),
+		"votes":      map[string]interface{}{},
+	}
+	if r := in.Review; r != nil {
+		votes := map[string]int{}
+		var approvers []string
+		rejections := 0
+		for user, p := range r.Participants {
+			if p.Vote.IsStale || p.Vote.Value == 0 {
+				continue
+			}
+			votes[user] = p.Vote.Value
+			if p.Vote.Value < 0 {
+				rejections++
+			} else if user != r.Author {
+				approvers = append(approvers, user)
+			}
+		}
+		sort.Strings(approvers)
+		review["id"] = int64(r.ID)
+		review["author"] = r.Author
+		review["state"] = r.State
+		review["approvals"] = int64(len(approvers))
+		review["approvers"] = approvers
+		review["rejections"] = int64(rejections)
+		review["votes"] = votes
+	}
+	presubmit := map[string]interface{}{
+		"ran":     false,
+		"success": false,
+		"passed":  []interface{}{},
+		"failed":  []interface{}{},
+	}
+	if ps := in.Presubmit; ps != nil {
+		presubmit["ran"] = true
+		presubmit["success"] = ps.Success
+		presubmit["passed"] = append([]string{}, ps.Passed...)
+		presubmit["failed"] = append([]string{}, ps.Failed...)
+	}
+	t := in.Now.In(p.loc)
+	now := map[string]interface{}{
+		"hour":    int64(t.Hour()),
+		"minute":  int64(t.Minute()),
+		"weekday": int64(t.Weekday()),
+		"date":    t.Format("2006-01-02"),
+	}
+	return map[string]interface{}{
+		"cl":        cl,
+		"review":    review,
+		"presubmit": presubmit,
+		"now":       now,
+	}
+}
+
+// Evaluate returns the rules of the policy that |in| violates, nil if it can be submitted. Rules
+// that fail to evaluate, eg. comparing a string to a number, are violated so that broken rules
+// don't let changes through.
+func (p *Policy) Evaluate(in *Input) []Violation {
+	var files []string
+	if in.Change != nil {
+		for _, f := range in.Change.Files {
+			files = append(files, f.DepotPath)
+		}
+	}
+	vars := p.vars(in)
+	var violations []Violation
+	for _, r := range p.rules {
+		if !r.applies(files) {
+			continue
+		}
+		ok, err := r.condition.EvalBool(vars)
+		if err != nil {
+			violations = append(violations, Violation{
+				Rule:    r.name,
+				Message: fmt.Sprintf("could not evaluate rule: %v", err),
+			})
+			continue
+		}
+		if ok {
+			continue
+		}
+		msg := r.message
+		if msg == "" {
+			msg = fmt.Sprintf("%s is false", r.condition)
+		}
+		violations = append(violations, Violation{Rule: r.name, Message: msg})
+	}
+	return violations
+}
+
+// Source loads a policy from a text proto in the depot and reloads it periodically, so that
+// submitted policy changes apply without restarting long running services.
+type Source struct {
+	file *p4lib.DepotFile
+}
+
+// NewSource returns a source loading the policy at depot path |path|.
+func NewSource(p4 p4lib.P4, path string) *Source {
+	return &Source{file: p4lib.NewDepotFile(p4, path, func(text string) (interface{}, error) {
+		return Parse(text)
+	})}
+}
+
+// Policy returns the latest policy. When the policy can't be loaded, the last one that could is
+// used. Returns an error if none could ever be loaded, as no policy would let every change through.
+func (s *Source) Policy() (*Policy, error) {
+	p, err := s.file.Get()
+	if err != nil {
+		return nil, err
+	}
+	return p.(*Policy), nil
+}
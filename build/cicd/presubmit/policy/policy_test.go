@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpr(t *testing.T) {
+	vars := map[string]interface{}{
+		"n":     3,
+		"name":  "alice",
+		"files": []string{"//game/a.cc", "//game/b.h", "//docs/c.md"},
+		"msg":   map[string]interface{}{"count": int64(2), "tags": []interface{}{"x"}},
+		"votes": map[string]int{"bob": 1},
+	}
+	tests := []struct {
+		expr    string
+		want    interface{}
+		wantErr bool
+	}{
+		{expr: "n >= 2 && name == 'alice'", want: true},
+		{expr: "!(n > 2) || false", want: false},
+		{expr: "n * 2 + 1 - msg.count", want: int64(5)},
+		{expr: "-n % 2", want: int64(-1)},
+		{expr: `"x" in msg.tags && !("y" in msg.tags)`, want: true},
+		{expr: "'tags' in msg", want: true},
+		{expr: "size(files) == 3 && name.size() == 5", want: true},
+		{expr: `files.exists(f, f.startsWith("//docs/"))`, want: true},
+		{expr: `files.all(f, f.startsWith("//game/"))`, want: false},
+		{expr: `files.filter(f, f.endsWith(".cc") || f.endsWith(".h")).size()`, want: int64(2)},
+		{expr: `name.matches("^a.*e$") && name.contains("lic")`, want: true},
+		{expr: `[1, 2] + [3] == [1, 2, 3]`, want: true},
+		{expr: `"a" + 'b' < "b"`, want: true},
+		{expr: `votes["bob"] == 1 && !("carol" in votes)`, want: true},
+		{expr: `files.map(f, f.size()).all(s, s > 5) && has(msg.count)`, want: true},
+		// Logical operators absorb the errors of the side that doesn't decide the result.
+		{expr: "n / 0 == 1 && false", want: false},
+		{expr: "name > 1", wantErr: true},
+		{expr: "msg.missing", wantErr: true},
+		{expr: "n / 0", wantErr: true},
+	}
+	names := []string{"n", "name", "files", "msg", "votes"}
+	for _, test := range tests {
+		e, err := CompileExpr(test.expr, names...)
+		if err != nil {
+			t.Errorf("CompileExpr(%q) failed: %v", test.expr, err)
+			continue
+		}
+		got, err := e.Eval(vars)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Eval(%q) = %v, want error", test.expr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", test.expr, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("Eval(%q) diff (-want +got):\n%s", test.expr, diff)
+		}
+	}
+	for _, bad := range []string{"n >", "(n", "'open", "n $ 2", "f(1)", "undefined", "n.nope()", "files.exists(1, true)", "files.exists(f, 1)", "n n"} {
+		if _, err := CompileExpr(bad, names...); err == nil {
+			t.Errorf("CompileExpr(%q): got no error", bad)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse(`
+		time_zone: "America/Los_Angeles"
+		rule {
+			name: "two-approvals"
+			condition: "review.approvals >= 2 && review.rejections == 0"
+			message: "Needs two approvals and no rejection."
+		}
+		rule {
+			name: "lint"
+			condition: "'check lint' in presubmit.passed"
+		}
+		rule {
+			name: "office-hours"
+			include: "//game/release/..."
+			exclude: "//game/release/*.md"
+			condition: "now.weekday >= 1 && now.weekday <= 5 && now.hour >= 9 && now.hour < 17"
+			message: "Release submits only during office hours."
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vote := func(v int, stale bool) swarm.Participant {
+		return swarm.Participant{Vote: swarm.Vote{Value: v, IsStale: stale}}
+	}
+	change := func(files ...string) *p4lib.Description {
+		desc := &p4lib.Description{Cl: 10, User: "alice"}
+		for _, f := range files {
+			desc.Files = append(desc.Files, p4lib.FileAction{DepotPath: f})
+		}
+		return desc
+	}
+	approved := &swarm.Review{ID: 9, Author: "alice", Participants: map[string]swarm.Participant{
+		"alice": vote(1, false), "bob": vote(1, false), "carol": vote(1, false),
+	}}
+	passed := &Presubmit{Success: true, Passed: []string{"check lint"}}
+	// Saturday 2021-04-03 10:00 and Monday 2021-04-05 10:00 in Los Angeles.
+	saturday := time.Date(2021, 4, 3, 17, 0, 0, 0, time.UTC)
+	monday := time.Date(2021, 4, 5, 17, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   *Input
+		want []string
+	}{
+		{
+			name: "allowed",
+			in:   &Input{Change: change("//game/release/a.cc"), Review: approved, Presubmit: passed, Now: monday},
+		},
+		{
+			name: "outside office hours",
+			in:   &Input{Change: change("//game/release/a.cc"), Review: approved, Presubmit: passed, Now: saturday},
+			want: []string{"office-hours"},
+		},
+		{
+			name: "excluded from office hours",
+			in:   &Input{Change: change("//game/release/notes.md", "//game/main/a.cc"), Review: approved, Presubmit: passed, Now: saturday},
+		},
+		{
+			name: "stale and author votes",
+			in: &Input{Change: change("//game/main/a.cc"), Presubmit: passed, Now: monday, Review: &swarm.Review{
+				Author: "alice", Participants: map[string]swarm.Participant{"alice": vote(1, false), "bob": vote(1, false), "carol": vote(1, true)},
+			}},
+			want: []string{"two-approvals"},
+		},
+		{
+			name: "no review nor presubmit",
+			in:   &Input{Change: change("//game/main/a.cc"), Now: monday},
+			want: []string{"two-approvals", "lint"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, v := range p.Evaluate(test.in) {
+				got = append(got, v.Rule)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Evaluate() violated rules diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		`rule { condition: "true" }`,
+		`rule { name: "a" }`,
+		`rule { name: "a" condition: "true" } rule { name: "a" condition: "true" }`,
+		`rule { name: "a" condition: "review." }`,
+		`rule { name: "a" condition: "reviews.approvals > 1" }`,
+		`time_zone: "Nowhere/Special" rule { name: "a" condition: "true" }`,
+	} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q): got no error", bad)
+		}
+	}
+	broken, err := Parse(`rule { name: "broken" condition: "review.author > 1" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := broken.Evaluate(&Input{Now: monday}); len(v) != 1 || v[0].Rule != "broken" {
+		t.Errorf("Evaluate() of a broken rule = %v, want it violated", v)
+	}
+}
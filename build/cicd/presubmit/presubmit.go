@@ -33,12 +33,16 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"sge-monorepo/build/cicd/cicdfile"
 	"sge-monorepo/build/cicd/monorepo"
 	"sge-monorepo/build/cicd/monorepo/p4path"
 	"sge-monorepo/build/cicd/monorepo/universe"
+	"sge-monorepo/build/cicd/presubmit/explain"
+	"sge-monorepo/build/cicd/presubmit/impact"
 	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/libs/go/credentials"
 	"sge-monorepo/libs/go/p4lib"
 
 	"sge-monorepo/build/cicd/presubmit/check/protos/checkpb"
@@ -54,6 +58,14 @@ type Runner interface {
 	// Run executes a presubmit run in the current CL. If there is no error, returns whether the
 	// presubmit run was successful or not.
 	Run() (bool, error)
+
+	// Summary returns the per monorepo results of the last run.
+	Summary() *Summary
+
+	// Explain returns the graph of the checks triggered by the CL, going from the changed files to
+	// the presubmits matching them and the checks they expand to, without running the checks. After
+	// Run, it returns the graph of the checks that ran.
+	Explain() (*explain.Graph, error)
 }
 
 // Listener is a receiver of presubmit events.
@@ -67,7 +79,8 @@ type Listener interface {
 	// OnCheckResult is called after a check has been completed.
 	OnCheckResult(mdPath monorepo.Path, check Check, result *presubmitpb.CheckResult)
 
-	// OnPresubmitEnd is called after the whole presubmit run has been completed.
+	// OnPresubmitEnd is called after the checks of a monorepo have been completed. Listeners
+	// implementing SummaryListener are also told about the whole run.
 	OnPresubmitEnd(success bool)
 }
 
@@ -107,6 +120,31 @@ type Options struct {
 
 	// Listeners get presubmit events defined by the Listener interface.
 	Listeners []Listener
+
+	// PreviousResults are results of checks from a previous, interrupted run, keyed by check name.
+	// Checks with a previous result are not run again; listeners get the previous result instead.
+	PreviousResults map[string]*presubmitpb.CheckResult
+
+	// Only restricts the run to the triggered checks matching any of these selectors. If empty, all
+	// triggered checks run. Checks that aren't triggered by the change are never run.
+	Only []Selector
+
+	// Credentials provides the credentials checker tools ask for. Defaults to
+	// credentials.Default().
+	Credentials credentials.Provider
+
+	// Impact maps test units to the files they exercise. If set, the check_test checks of tests
+	// affected by the change run first, and those of unaffected tests last. Tests the map knows
+	// nothing about, or only has a stale mapping of, count as possibly affected.
+	Impact *impact.Map
+
+	// ImpactRestrict skips the check_test checks of tests that Impact knows are unaffected by the
+	// change, unless checks are selected with Only.
+	ImpactRestrict bool
+
+	// ImageCache is the directory the images of checkers that run in containers are saved to, so
+	// that they are pulled once. If empty, images are only kept by docker.
+	ImageCache string
 }
 
 // funcWriter is a simple wrapper to enable functions to be exposed as Writers.
@@ -125,6 +163,9 @@ func NewRunner(u universe.Universe, p4 p4lib.P4, mdProvider cicdfile.Provider, o
 	for _, opt := range opts {
 		opt(&options)
 	}
+	if options.Credentials == nil {
+		options.Credentials = credentials.Default()
+	}
 	return &runner{
 		universe:   u,
 		p4:         p4,
@@ -138,6 +179,10 @@ type runner struct {
 	p4         p4lib.P4
 	mdProvider cicdfile.Provider
 	options    Options
+	selection  *selection
+	summary    Summary
+	// graph is the explanation of the last run.
+	graph *explain.Graph
 }
 
 // triggeredSet is a set of triggered presubmits in a monorepo.
@@ -147,6 +192,8 @@ type triggeredSet struct {
 	monorepoDef universe.MonorepoDef
 	tools       map[string]checkerTool
 	triggered   []triggered
+	// files are all the files of the change in the monorepo.
+	files []changedFile
 }
 
 func (ts *triggeredSet) String() string {
@@ -161,6 +208,9 @@ func (ts *triggeredSet) String() string {
 	for _, t := range ts.triggered {
 		_, _ = fmt.Fprintf(&sb, "- Dir: %s\n", t.psDir)
 		_, _ = fmt.Fprintf(&sb, "  - Files: %v\n", t.matchingFiles)
+		if len(t.excludedFiles) > 0 {
+			_, _ = fmt.Fprintf(&sb, "  - Excluded: %v\n", t.excludedFiles)
+		}
 		for _, c := range t.presubmit.Check {
 			_, _ = fmt.Fprintf(&sb, "  - Check: %s, args: %s\n", c.Action, c.Args)
 		}
@@ -176,10 +226,16 @@ func (ts *triggeredSet) String() string {
 
 // triggered is a presubmit that was triggered by the changed files.
 type triggered struct {
-	presubmit     *presubmitpb.Presubmit
+	presubmit *presubmitpb.Presubmit
+	// index is the position of the presubmit in its CICD file.
+	index         int
 	psDir         monorepo.Path
 	mdPath        monorepo.Path
 	matchingFiles []changedFile
+	// excludedFiles are the files matched by an include pattern of the presubmit but ruled out by
+	// an exclude one.
+	excludedFiles []changedFile
+	matcher       matcher
 }
 
 type checkerTool struct {
@@ -199,19 +255,54 @@ func (r *runner) Run() (bool, error) {
 	if r.options.PresubmitId == "" {
 		r.options.PresubmitId = newUuid()
 	}
+	r.selection = newSelection(r.options.Only)
+	r.summary = Summary{}
+	r.graph = &explain.Graph{}
 	sets, err := r.analyzeChange()
 	if err != nil {
 		return false, err
 	}
-	overallSuccess := true
 	for _, ts := range sets {
-		if success, err := ts.run(); err != nil {
+		ms, err := ts.run(r.graph)
+		if err != nil {
 			return false, err
-		} else {
-			overallSuccess = overallSuccess && success
+		}
+		r.summary.Monorepos = append(r.summary.Monorepos, ms)
+	}
+	for _, sel := range r.selection.unmatched() {
+		log.Printf("WARNING: %q did not select any triggered check", sel)
+	}
+	for _, l := range r.options.Listeners {
+		if sl, ok := l.(SummaryListener); ok {
+			sl.OnRunEnd(&r.summary)
 		}
 	}
-	return overallSuccess, nil
+	return r.summary.Success(), nil
+}
+
+func (r *runner) Summary() *Summary {
+	return &r.summary
+}
+
+func (r *runner) Explain() (*explain.Graph, error) {
+	if r.graph != nil {
+		return r.graph, nil
+	}
+	r.selection = newSelection(r.options.Only)
+	sets, err := r.analyzeChange()
+	if err != nil {
+		return nil, err
+	}
+	g := &explain.Graph{}
+	for _, ts := range sets {
+		bc, err := ts.buildContext()
+		if err != nil {
+			return nil, err
+		}
+		ts.discoverChecks(bc, g)
+		bc.Cleanup()
+	}
+	return g, nil
 }
 
 // analyzeChange returns all triggered presubmit sets in the depot based on the current p4 state.
@@ -245,7 +336,7 @@ func (r *runner) analyzeChange() ([]triggeredSet, error) {
 		if err != nil {
 			return nil, err
 		}
-		if len(triggered) == 0 {
+		if !hasMatches(triggered) {
 			continue
 		}
 		tools, err := toolsForMonorepo(mrDef, mr)
@@ -258,6 +349,7 @@ func (r *runner) analyzeChange() ([]triggeredSet, error) {
 			monorepoDef: mrDef,
 			tools:       tools,
 			triggered:   triggered,
+			files:       files,
 		})
 	}
 	sort.Slice(result, func(i, j int) bool {
@@ -279,36 +371,57 @@ func (r *runner) findTriggered(mr monorepo.Monorepo, files []changedFile) ([]tri
 	var ret []triggered
 	for _, md := range mdFiles {
 		psDir := md.Path.Dir()
-		for _, ps := range md.Proto.Presubmit {
+		for i, ps := range md.Proto.Presubmit {
 			matcher, err := newMatcher(mr, psDir, ps)
 			if err != nil {
 				return nil, err
 			}
-			var matchingFiles []changedFile
+			var matchingFiles, excludedFiles []changedFile
 			for _, f := range files {
-				if match, err := matcher.match(f.path); match {
-					matchingFiles = append(matchingFiles, f)
-				} else if err != nil {
+				include, exclude, err := matcher.explain(f.path)
+				if err != nil {
 					return nil, err
 				}
+				if include != "" && exclude == "" {
+					matchingFiles = append(matchingFiles, f)
+				} else if include != "" {
+					excludedFiles = append(excludedFiles, f)
+				}
 			}
-			if len(matchingFiles) == 0 {
+			if len(matchingFiles) == 0 && len(excludedFiles) == 0 {
 				continue
 			}
 			sort.Slice(matchingFiles, func(i, j int) bool {
 				return matchingFiles[i].path < matchingFiles[j].path
 			})
+			sort.Slice(excludedFiles, func(i, j int) bool {
+				return excludedFiles[i].path < excludedFiles[j].path
+			})
 			ret = append(ret, triggered{
 				presubmit:     ps,
+				index:         i,
 				psDir:         psDir,
 				matchingFiles: matchingFiles,
+				excludedFiles: excludedFiles,
 				mdPath:        md.Path,
+				matcher:       matcher,
 			})
 		}
 	}
 	return ret, nil
 }
 
+// hasMatches returns whether any of the presubmits is triggered by a file. Presubmits that only
+// have excluded files are kept to explain why they didn't trigger.
+func hasMatches(triggered []triggered) bool {
+	for _, t := range triggered {
+		if len(t.matchingFiles) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // matcher provides presubmit path matching.
 type matcher struct {
 	includes []p4path.Expr
@@ -362,6 +475,35 @@ func (m matcher) match(p monorepo.Path) (bool, error) {
 	return false, nil
 }
 
+// explain returns the first include and exclude expressions matching the path, or empty strings
+// if none does. The path matches if it has an include expression and no exclude one.
+func (m matcher) explain(p monorepo.Path) (include, exclude string, err error) {
+	for _, e := range m.includes {
+		match, err := e.Matches(p)
+		if err != nil {
+			return "", "", err
+		}
+		if match {
+			include = string(e)
+			break
+		}
+	}
+	if include == "" {
+		return "", "", nil
+	}
+	for _, e := range m.excludes {
+		match, err := e.Matches(p)
+		if err != nil {
+			return "", "", err
+		}
+		if match {
+			exclude = string(e)
+			break
+		}
+	}
+	return include, exclude, nil
+}
+
 func pathExprs(mr monorepo.Monorepo, dir monorepo.Path, patterns []string) ([]p4path.Expr, error) {
 	var ret []p4path.Expr
 	for _, p := range patterns {
@@ -388,7 +530,11 @@ func toolsForMonorepo(mrDef universe.MonorepoDef, mr monorepo.Monorepo) (map[str
 			return nil, fmt.Errorf("could not unmarshal checker tools %s: %v", mrp, err)
 		}
 		for _, tool := range toolsProto.CheckerTool {
-			ret[tool.Action] = checkerTool{mrp.Dir(), tool}
+			ct := checkerTool{mrp.Dir(), tool}
+			if err := validateLanguages(ct); err != nil {
+				return nil, fmt.Errorf("invalid checker tools %s: %v", mrp, err)
+			}
+			ret[tool.Action] = ct
 		}
 	}
 	return ret, nil
@@ -405,12 +551,28 @@ type Check interface {
 	// CicdFilePath is the path ot the CICD file containing the check.
 	CicdFilePath() monorepo.Path
 
+	// Monorepo is the name of the monorepo the check runs in.
+	Monorepo() string
+
 	// Run runs the check.
 	Run(bc build.Context) (*presubmitpb.CheckResult, error)
 
 	// SordOrder returns an order for the check to be sorted in.
 	// Used to run batch checks by their Bazel flags.
 	SortOrder() sortOrder
+
+	// DurationBudget is the expected maximum duration of the check. Zero means no budget.
+	DurationBudget() time.Duration
+}
+
+// OverBudget returns whether the check took longer than its duration budget to produce |result|.
+func OverBudget(check Check, result *presubmitpb.CheckResult) bool {
+	budget := check.DurationBudget()
+	return budget > 0 && result.DurationMs > budget.Milliseconds()
+}
+
+func budgetSeconds(seconds int32) time.Duration {
+	return time.Duration(seconds) * time.Second
 }
 
 type sortOrder []string
@@ -432,9 +594,69 @@ func cmpCheck(lhs, rhs Check) bool {
 	return false
 }
 
-// runSet runs all presubmits in a set. If there is no error, returns whether the presubmit run was
-// successful or not.
-func (ts *triggeredSet) run() (bool, error) {
+// run runs all presubmits in a set, adding them to the graph. If there is no error, returns the
+// results of the checks.
+func (ts *triggeredSet) run(g *explain.Graph) (MonorepoSummary, error) {
+	summary := MonorepoSummary{
+		Name: monorepoName(ts.monorepoDef),
+		Root: ts.monorepoDef.Root,
+	}
+	bc, err := ts.buildContext()
+	if err != nil {
+		return summary, err
+	}
+	defer bc.Cleanup()
+	presubmitId := ts.runner.options.PresubmitId
+	checks := ts.discoverChecks(bc, g)
+
+	sort.Slice(checks, func(i, j int) bool {
+		return cmpCheck(checks[i], checks[j])
+	})
+	prioritizeByImpact(checks)
+
+	// Run checks.
+	runStart := time.Now()
+	listeners := ts.runner.options.Listeners
+	for _, l := range listeners {
+		l.OnPresubmitStart(ts.monorepo, presubmitId, checks)
+	}
+	for _, c := range checks {
+		for _, l := range listeners {
+			l.OnCheckStart(c)
+		}
+		result, ok := ts.runner.options.PreviousResults[c.Name()]
+		if !ok {
+			start := time.Now()
+			var err error
+			result, err = c.Run(bc)
+			if err != nil {
+				result = errResult(c.Name(), err)
+			}
+			result.DurationMs = time.Since(start).Milliseconds()
+		}
+		summary.Checks++
+		if result.OverallResult.Success {
+			summary.Passed = append(summary.Passed, c.Name())
+		} else {
+			summary.Failures = append(summary.Failures, FailedCheck{
+				Name:     c.Name(),
+				CicdFile: c.CicdFilePath(),
+				Duration: time.Duration(result.DurationMs) * time.Millisecond,
+			})
+		}
+		for _, l := range listeners {
+			l.OnCheckResult(c.CicdFilePath(), c, result)
+		}
+	}
+	summary.Duration = time.Since(runStart)
+	for _, l := range listeners {
+		l.OnPresubmitEnd(summary.Success())
+	}
+	return summary, nil
+}
+
+// buildContext returns a build context for the monorepo of the set.
+func (ts *triggeredSet) buildContext() (build.Context, error) {
 	bc, err := build.NewContext(ts.monorepo, func(opts *build.Options) {
 		opts.Logs = ts.runner.options.Logs
 		opts.LogLevel = ts.runner.options.LogLevel
@@ -442,22 +664,50 @@ func (ts *triggeredSet) run() (bool, error) {
 		opts.BazelBuildArgs = ts.runner.options.BazelBuildArgs
 	})
 	if err != nil {
-		return false, fmt.Errorf("could not create build context: %v", err)
+		return nil, fmt.Errorf("could not create build context: %v", err)
 	}
-	defer bc.Cleanup()
-	presubmitId := ts.runner.options.PresubmitId
+	return bc, nil
+}
 
-	// Discover the checks that will be run.
+// discoverChecks returns the checks to run for the set, and adds the changed files, presubmits
+// and checks to the graph.
+func (ts *triggeredSet) discoverChecks(bc build.Context, g *explain.Graph) []Check {
+	mrName := monorepoName(ts.monorepoDef)
+	presubmitId := ts.runner.options.PresubmitId
+	selection := ts.runner.selection
 	var checks []Check
+	// add adds a check triggered by t.
+	add := func(t triggered, c Check) {
+		checks = append(checks, c)
+		ts.explainCheck(g, t, c.Name())
+	}
+	// also records that t triggers a check already added by another presubmit.
+	also := func(t triggered, name string) {
+		if g.Node(ts.checkNodeId(name)) != nil {
+			ts.explainCheck(g, t, name)
+		}
+	}
 	seen := map[monorepo.Label]bool{}
+	// builds are the check_build checks by unit, whose files grow with every presubmit triggering
+	// them.
+	builds := map[monorepo.Label]*checkBuild{}
+	seenUnitFiles := map[monorepo.Path]bool{}
 	for _, t := range ts.triggered {
+		ts.explainTriggered(g, t)
+		if len(t.matchingFiles) == 0 {
+			continue
+		}
+		langs := detectLanguages(t.matchingFiles)
 		for _, c := range t.presubmit.Check {
+			if !selection.selects(KindCheck, c.Action) {
+				continue
+			}
 			id := newUuid()
 			name := fmt.Sprintf("check %s", c.Action)
 			tool, ok := ts.tools[c.Action]
 			if !ok {
-				checks = append(checks, &failCheck{
-					checkBase: checkBase{id, presubmitId, name, t.mdPath},
+				add(t, &failCheck{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 					err:       fmt.Errorf("no such registered action %q", c.Action),
 				})
 				continue
@@ -469,8 +719,12 @@ func (ts *triggeredSet) run() (bool, error) {
 			if ts.runner.options.CLDescription == "" && tool.toolPb.NeedsClDescription {
 				continue
 			}
-			checks = append(checks, &checkAction{
-				checkBase:    checkBase{id, presubmitId, name, t.mdPath},
+			// Skip checkers that have nothing to look at, before building or pulling them.
+			if !tool.handles(langs) {
+				continue
+			}
+			add(t, &checkAction{
+				checkBase:    checkBase{id, presubmitId, name, t.mdPath, mrName},
 				check:        c,
 				tool:         tool,
 				triggered:    t,
@@ -478,6 +732,37 @@ func (ts *triggeredSet) run() (bool, error) {
 			})
 		}
 
+		// check_gen
+		for _, c := range t.presubmit.CheckGen {
+			id := newUuid()
+			name := fmt.Sprintf("check_gen %s", c.GenUnit)
+			guLabel, err := ts.monorepo.NewLabel(t.psDir, c.GenUnit)
+			if err != nil {
+				if !selection.selects(KindCheckGen, c.GenUnit) {
+					continue
+				}
+				add(t, &failCheck{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
+					err:       err,
+				})
+				continue
+			}
+			if _, ok := seen[guLabel]; ok {
+				// Already ran this check
+				also(t, fmt.Sprintf("check_gen %s", guLabel))
+				continue
+			}
+			if !selection.selectsLabel(ts.monorepo, KindCheckGen, guLabel, "gen") {
+				continue
+			}
+			seen[guLabel] = true
+			add(t, &checkGen{
+				checkBase: checkBase{id, presubmitId, fmt.Sprintf("check_gen %s", guLabel), t.mdPath, mrName},
+				label:     guLabel,
+				budget:    budgetSeconds(c.DurationBudgetSeconds),
+			})
+		}
+
 		// check_build and check_test doesn't support fixes.
 		if ts.runner.options.FixOnly {
 			continue
@@ -488,33 +773,49 @@ func (ts *triggeredSet) run() (bool, error) {
 			id := newUuid()
 			buLabel, err := ts.monorepo.NewLabel(t.psDir, c.BuildUnit)
 			if err != nil {
+				if !selection.selects(KindCheckBuild, c.BuildUnit) {
+					continue
+				}
 				id := newUuid()
 				name := fmt.Sprintf("check_build %s", c.BuildUnit)
-				checks = append(checks, &failCheck{
-					checkBase: checkBase{id, presubmitId, name, t.mdPath},
+				add(t, &failCheck{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 					err:       err,
 				})
 				continue
 			}
 			if _, ok := seen[buLabel]; ok {
 				// Already ran this check
+				if cb, ok := builds[buLabel]; ok {
+					cb.files = append(cb.files, t.matchingFiles...)
+				}
+				also(t, fmt.Sprintf("check_build %s", buLabel))
+				continue
+			}
+			if !selection.selectsLabel(ts.monorepo, KindCheckBuild, buLabel, "") {
 				continue
 			}
 			seen[buLabel] = true
 			name := fmt.Sprintf("check_build %s", buLabel)
 			sortOrder, err := bc.BazelArgs(buLabel)
 			if err != nil {
-				checks = append(checks, &failCheck{
-					checkBase: checkBase{id, presubmitId, name, t.mdPath},
+				add(t, &failCheck{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 					err:       err,
 				})
 				continue
 			}
-			checks = append(checks, &checkBuild{
-				checkBase: checkBase{id, presubmitId, name, t.mdPath},
-				label:     buLabel,
-				sortOrder: sortOrder,
-			})
+			cb := &checkBuild{
+				checkBase:    checkBase{id, presubmitId, name, t.mdPath, mrName},
+				label:        buLabel,
+				sortOrder:    sortOrder,
+				budget:       budgetSeconds(c.DurationBudgetSeconds),
+				fullBuild:    c.FullBuild,
+				triggeredSet: ts,
+				files:        append([]changedFile{}, t.matchingFiles...),
+			}
+			builds[buLabel] = cb
+			add(t, cb)
 		}
 
 		// check_test
@@ -523,8 +824,11 @@ func (ts *triggeredSet) run() (bool, error) {
 			name := fmt.Sprintf("check_test %s", c.TestUnit)
 			tuLabel, err := ts.monorepo.NewLabel(t.psDir, c.TestUnit)
 			if err != nil {
-				checks = append(checks, &failCheck{
-					checkBase: checkBase{id, presubmitId, name, t.mdPath},
+				if !selection.selects(KindCheckTest, c.TestUnit) {
+					continue
+				}
+				add(t, &failCheck{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 					err:       err,
 				})
 				continue
@@ -534,10 +838,12 @@ func (ts *triggeredSet) run() (bool, error) {
 				continue
 			}
 			seen[tuLabel] = true
+			// Selecting a test suite selects all its test units.
+			suiteSelected := selection.selectsLabel(ts.monorepo, KindCheckTest, tuLabel, "test")
 			testUnits, err := bc.ExpandTargetExpression(monorepo.TargetExpression(tuLabel.String()))
 			if err != nil {
-				checks = append(checks, &failCheck{
-					checkBase: checkBase{id, presubmitId, name, t.mdPath},
+				add(t, &failCheck{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 					err:       err,
 				})
 				continue
@@ -545,55 +851,114 @@ func (ts *triggeredSet) run() (bool, error) {
 			for _, tu := range testUnits {
 				if _, ok := seen[tu]; ok && tu != tuLabel {
 					// Already ran this check
+					also(t, fmt.Sprintf("check_test %s", tu))
+					continue
+				}
+				if !selection.selectsLabel(ts.monorepo, KindCheckTest, tu, "test") && !suiteSelected {
 					continue
 				}
 				seen[tu] = true
+				verdict := ts.testImpact(tu)
+				if ts.skipUnaffected(verdict) {
+					log.Printf("Skipping check_test %s, not affected by the change according to the test impact map at CL %d", tu, ts.runner.options.Impact.Cl)
+					continue
+				}
 				id := newUuid()
 				name := fmt.Sprintf("check_test %s", tu)
 				sortOrder, err := bc.BazelArgs(tu)
 				if err != nil {
-					checks = append(checks, &failCheck{
-						checkBase: checkBase{id, presubmitId, name, t.mdPath},
+					add(t, &failCheck{
+						checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 						err:       err,
 					})
 					continue
 				}
-				checks = append(checks, &checkTest{
-					checkBase: checkBase{id, presubmitId, name, t.mdPath},
+				add(t, &checkTest{
+					checkBase: checkBase{id, presubmitId, name, t.mdPath, mrName},
 					label:     tu,
 					sortOrder: sortOrder,
+					budget:    budgetSeconds(c.DurationBudgetSeconds),
+					impact:    verdict,
+				})
+			}
+		}
+
+		// block_deprecated_deps
+		if t.presubmit.BlockDeprecatedDeps {
+			for _, f := range t.matchingFiles {
+				if path.Base(string(f.path)) != "BUILDUNIT" || statusFromP4Status(f.status) == checkpb.Status_Delete {
+					continue
+				}
+				if _, ok := seenUnitFiles[f.path]; ok {
+					// Already ran this check
+					continue
+				}
+				if !selection.selects(KindBlockDeprecatedDeps, string(f.path)) {
+					continue
+				}
+				seenUnitFiles[f.path] = true
+				id := newUuid()
+				name := fmt.Sprintf("block_deprecated_deps %s", f.path)
+				add(t, &checkDeprecatedDeps{
+					checkBase:    checkBase{id, presubmitId, name, t.mdPath, mrName},
+					file:         f,
+					triggeredSet: ts,
 				})
 			}
 		}
 	}
+	return checks
+}
 
-	sort.Slice(checks, func(i, j int) bool {
-		return cmpCheck(checks[i], checks[j])
+// explainTriggered adds the presubmit and the files matched by its include patterns to the graph.
+func (ts *triggeredSet) explainTriggered(g *explain.Graph, t triggered) {
+	mrName := monorepoName(ts.monorepoDef)
+	psId := ts.presubmitNodeId(t)
+	g.AddNode(explain.Node{
+		ID:       psId,
+		Kind:     explain.KindPresubmit,
+		Label:    fmt.Sprintf("%s[%d]", t.mdPath, t.index),
+		Monorepo: mrName,
 	})
-
-	// Run checks.
-	success := true
-	listeners := ts.runner.options.Listeners
-	for _, l := range listeners {
-		l.OnPresubmitStart(ts.monorepo, presubmitId, checks)
-	}
-	for _, c := range checks {
-		for _, l := range listeners {
-			l.OnCheckStart(c)
-		}
-		result, err := c.Run(bc)
-		if err != nil {
-			result = errResult(c.Name(), err)
-		}
-		success = success && result.OverallResult.Success
-		for _, l := range listeners {
-			l.OnCheckResult(c.CicdFilePath(), c, result)
+	for _, files := range [][]changedFile{t.matchingFiles, t.excludedFiles} {
+		for _, f := range files {
+			fileId := fmt.Sprintf("file:%s/%s", ts.monorepoDef.Root, f.path)
+			g.AddNode(explain.Node{
+				ID:       fileId,
+				Kind:     explain.KindFile,
+				Label:    string(f.path),
+				Monorepo: mrName,
+			})
+			// The files were matched by findTriggered already, so this can't fail.
+			include, exclude, _ := t.matcher.explain(f.path)
+			g.AddEdge(explain.Edge{
+				From:    fileId,
+				To:      psId,
+				Include: include,
+				Exclude: exclude,
+			})
 		}
 	}
-	for _, l := range listeners {
-		l.OnPresubmitEnd(success)
-	}
-	return success, nil
+}
+
+// explainCheck adds the check with the given name to the graph, triggered by t.
+func (ts *triggeredSet) explainCheck(g *explain.Graph, t triggered, name string) {
+	checkId := ts.checkNodeId(name)
+	g.AddNode(explain.Node{
+		ID:       checkId,
+		Kind:     explain.KindCheck,
+		Label:    name,
+		Monorepo: monorepoName(ts.monorepoDef),
+	})
+	g.AddEdge(explain.Edge{From: ts.presubmitNodeId(t), To: checkId})
+}
+
+func (ts *triggeredSet) presubmitNodeId(t triggered) string {
+	return fmt.Sprintf("presubmit:%s/%s#%d", ts.monorepoDef.Root, t.mdPath, t.index)
+}
+
+func (ts *triggeredSet) checkNodeId(name string) string {
+	return fmt.Sprintf("check:%s:%s", ts.monorepoDef.Root, name)
 }
 
 type checkBase struct {
@@ -601,6 +966,7 @@ type checkBase struct {
 	presubmitId string
 	name        string
 	mdPath      monorepo.Path
+	monorepo    string
 }
 
 func (cb *checkBase) Id() string {
@@ -615,15 +981,29 @@ func (cb *checkBase) CicdFilePath() monorepo.Path {
 	return cb.mdPath
 }
 
+func (cb *checkBase) Monorepo() string {
+	return cb.monorepo
+}
+
 type checkBuild struct {
 	checkBase
-	label     monorepo.Label
-	sortOrder []string
+	label        monorepo.Label
+	sortOrder    []string
+	budget       time.Duration
+	fullBuild    bool
+	triggeredSet *triggeredSet
+	// files are the changed files matched by the presubmits triggering the check.
+	files []changedFile
 }
 
 func (cb *checkBuild) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
+	var targets []string
+	if !cb.fullBuild && cb.triggeredSet != nil {
+		targets = differentialTargets(cb.triggeredSet.monorepo, bc, cb.label, cb.files)
+	}
 	buildResult, err := bc.Build(cb.label, func(options *build.Options) {
 		options.LogLabels = checkLogLabels(cb.id, cb.presubmitId)
+		options.BazelTargets = targets
 	})
 	if err != nil && buildResult == nil {
 		return nil, err
@@ -647,10 +1027,17 @@ func (cb *checkBuild) SortOrder() sortOrder {
 	return cb.sortOrder
 }
 
+func (cb *checkBuild) DurationBudget() time.Duration {
+	return cb.budget
+}
+
 type checkTest struct {
 	checkBase
 	label     monorepo.Label
 	sortOrder []string
+	budget    time.Duration
+	// impact is whether the change affects the test according to the test impact map.
+	impact impact.Verdict
 }
 
 func (ct *checkTest) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
@@ -677,6 +1064,56 @@ func (ct *checkTest) SortOrder() sortOrder {
 	return ct.sortOrder
 }
 
+func (ct *checkTest) DurationBudget() time.Duration {
+	return ct.budget
+}
+
+type checkGen struct {
+	checkBase
+	label  monorepo.Label
+	budget time.Duration
+}
+
+// Run fails when generated files are stale, with a fix that regenerates them in a new CL.
+func (cg *checkGen) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
+	genResult, err := bc.Generate(cg.label, func(options *build.Options) {
+		options.LogLabels = checkLogLabels(cg.id, cg.presubmitId)
+	})
+	if err != nil && !build.IsFailed(err) {
+		return nil, err
+	}
+	var stale []string
+	for _, o := range genResult.Stale() {
+		stale = append(stale, string(o.Path))
+	}
+	result := &presubmitpb.CheckResult{
+		OverallResult: &buildpb.Result{
+			Name:    cg.name,
+			Success: len(stale) == 0,
+		},
+	}
+	if len(stale) > 0 {
+		fix := fmt.Sprintf("sgeb gen -fix %s", cg.label)
+		result.OverallResult.Cause = fmt.Sprintf("stale generated files: %s", strings.Join(stale, ", "))
+		result.SubResults = []*buildpb.Result{
+			{
+				Name:  cg.name,
+				Cause: fmt.Sprintf("regenerate them with %q", fix),
+				Fix:   fix,
+			},
+		}
+	}
+	return result, nil
+}
+
+func (cg *checkGen) SortOrder() sortOrder {
+	return nil
+}
+
+func (cg *checkGen) DurationBudget() time.Duration {
+	return cg.budget
+}
+
 type checkAction struct {
 	checkBase
 	check        *checkpb.Check
@@ -687,16 +1124,31 @@ type checkAction struct {
 
 // runCheck runs a single presubmit check.
 func (ca *checkAction) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
-	bin, _, err := bc.ResolveBin(ca.tool.dir, ca.tool.toolPb.Bin, func(options *build.Options) {
-		options.LogLabels = checkLogLabels(ca.id, ca.presubmitId)
-	})
-	if err != nil {
-		return nil, err
+	options := ca.triggeredSet.runner.options
+	container := ca.tool.toolPb.Container
+	// Checkers in containers see the monorepo at its mount in the container.
+	resolvePath := ca.triggeredSet.monorepo.ResolvePath
+	bin := ca.tool.toolPb.Bin
+	if container != nil {
+		if err := validateContainer(container); err != nil {
+			return nil, fmt.Errorf("checker %s: %v", ca.check.Action, err)
+		}
+		resolvePath = func(p monorepo.Path) string {
+			return path.Join(containerMount(container), string(p))
+		}
+	} else {
+		var err error
+		bin, _, err = bc.ResolveBin(ca.tool.dir, bin, func(options *build.Options) {
+			options.LogLabels = checkLogLabels(ca.id, ca.presubmitId)
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 	var files []*checkpb.File
 	for _, f := range ca.triggered.matchingFiles {
 		files = append(files, &checkpb.File{
-			Path:   ca.triggeredSet.monorepo.ResolvePath(f.path),
+			Path:   resolvePath(f.path),
 			Status: statusFromP4Status(f.status),
 		})
 	}
@@ -712,7 +1164,7 @@ func (ca *checkAction) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
 				Files: files,
 			},
 		},
-		ClDescription: ca.triggeredSet.runner.options.CLDescription,
+		ClDescription: options.CLDescription,
 		LogLabels:     logLabels,
 	}
 	invocationBytes, err := proto.Marshal(&invocation)
@@ -729,20 +1181,45 @@ func (ca *checkAction) Run(bc build.Context) (*presubmitpb.CheckResult, error) {
 	if err := ioutil.WriteFile(invocationPath, invocationBytes, 0666); err != nil {
 		return nil, fmt.Errorf("could not write invocation proto: %v", err)
 	}
+	checkerInvocationPath, checkerResultPath := invocationPath, resultPath
+	if container != nil {
+		checkerInvocationPath = path.Join(containerInvocationDir, "invocation.textpb")
+		checkerResultPath = path.Join(containerInvocationDir, "invocation-result.textpb")
+	}
 	args := []string{
-		"--checker-invocation=" + invocationPath,
-		"--checker-invocation-result=" + resultPath,
+		"--checker-invocation=" + checkerInvocationPath,
+		"--checker-invocation-result=" + checkerResultPath,
 	}
 	args = append(args, ca.check.Args...)
 	args = append(args, ca.tool.toolPb.Args...)
-	args = build.AddGlogFlags(ca.check.Action, ca.triggeredSet.runner.options.LogLevel, args)
-	cmd := exec.Command(bin, args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-	cmd.Dir = ca.triggeredSet.monorepo.Root
+	args = build.AddGlogFlags(ca.check.Action, options.LogLevel, args)
+	var env []string
+	if names := ca.tool.toolPb.Credentials; len(names) > 0 {
+		env, err = credentials.Inject(options.Credentials, names)
+		if err != nil {
+			return nil, fmt.Errorf("checker %s: %v", ca.check.Action, err)
+		}
+	}
 	var logs bytes.Buffer
 	writer := io.MultiWriter(&logs, funcWriter(func(p []byte) (n int, err error) {
-		return ca.triggeredSet.runner.options.Logs.Write(p)
+		return options.Logs.Write(p)
 	}))
+	var cmd *exec.Cmd
+	if container != nil {
+		imageID, err := resolveImage(container, options.ImageCache, writer)
+		if err != nil {
+			return nil, fmt.Errorf("checker %s: could not get image: %v", ca.check.Action, err)
+		}
+		// Credentials are passed through by name, so that they don't show up in docker arguments.
+		cmd = exec.Command("docker", containerRunArgs(container, imageID, ca.triggeredSet.monorepo.Root, tempDir, bin, envNames(env), args)...)
+	} else {
+		cmd = exec.Command(bin, args...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = ca.triggeredSet.monorepo.Root
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	cmd.Stdout = writer
 	cmd.Stderr = writer
 	cmdErr := cmd.Run()
@@ -772,6 +1249,10 @@ func (ca *checkAction) SortOrder() sortOrder {
 	return nil
 }
 
+func (ca *checkAction) DurationBudget() time.Duration {
+	return budgetSeconds(ca.check.DurationBudgetSeconds)
+}
+
 type failCheck struct {
 	checkBase
 	err error
@@ -785,6 +1266,10 @@ func (fa *failCheck) SortOrder() sortOrder {
 	return nil
 }
 
+func (fa *failCheck) DurationBudget() time.Duration {
+	return 0
+}
+
 func statusFromP4Status(status p4lib.ActionType) checkpb.Status {
 	switch status {
 	case p4lib.ActionAdd, p4lib.ActionMoveAdd, p4lib.ActionBranch:
@@ -878,6 +1363,10 @@ func (p *Printer) OnCheckResult(mdPath monorepo.Path, check Check, result *presu
 	}
 	// The name was already printed without a newline in OnCheckStart.
 	p.opts.Logs(fmt.Sprintf("%s\n", status))
+	if OverBudget(check, result) {
+		took := time.Duration(result.DurationMs) * time.Millisecond
+		p.opts.Logs(fmt.Sprintf("  WARNING: took %s, over its budget of %s\n", took, check.DurationBudget()))
+	}
 	if !success {
 		p.opts.Logs(fmt.Sprintf("  %s\n", mdPath))
 	}
@@ -901,6 +1390,14 @@ func (p *Printer) OnPresubmitEnd(success bool) {
 	p.opts.Logs(fmt.Sprintf("Presubmit %s. %d checks ran, %d failed.\n", status, p.checkCount, p.checkCount-p.checkPass))
 }
 
+// OnRunEnd prints the result of each monorepo when the change spans several.
+func (p *Printer) OnRunEnd(summary *Summary) {
+	if len(summary.Monorepos) < 2 {
+		return
+	}
+	p.opts.Logs(summary.String() + "\n")
+}
+
 func checkLogLabels(id, presubmitId string) map[string]string {
 	return map[string]string{
 		"presubmit-id":       presubmitId,
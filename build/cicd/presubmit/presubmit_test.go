@@ -16,17 +16,29 @@ package presubmit
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"sge-monorepo/build/cicd/cicdfile"
 	"sge-monorepo/build/cicd/monorepo"
 	"sge-monorepo/build/cicd/monorepo/universe"
+	"sge-monorepo/build/cicd/presubmit/durations"
+	"sge-monorepo/build/cicd/presubmit/explain"
+	"sge-monorepo/build/cicd/presubmit/impact"
 	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
+	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
 	"sge-monorepo/libs/go/p4lib"
 	"sge-monorepo/libs/go/p4lib/p4mock"
 	"sge-monorepo/libs/go/sgetest"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestMatcher(t *testing.T) {
@@ -264,3 +276,697 @@ func TestAnalyzeChange(t *testing.T) {
 		}
 	}
 }
+
+func TestNewDeprecatedDeps(t *testing.T) {
+	files := map[string]string{
+		"MONOREPO":  "",
+		"WORKSPACE": "",
+		"old/BUILDUNIT": `
+build_unit {
+  name: "old_tool"
+  bin: "old.exe"
+  deprecated: true
+  replacement: "//new:new_tool"
+}
+build_unit {
+  name: "legacy_tool"
+  bin: "legacy.exe"
+  deprecated: true
+}
+`,
+		"new/BUILDUNIT": `
+build_unit {
+  name: "new_tool"
+  bin: "new.exe"
+}
+`,
+		"foo/BUILDUNIT": `
+build_unit {
+  name: "foo"
+  bin: "//new:new_tool"
+  deps: "//old:legacy_tool"
+  deps: "//old:old_tool"
+}
+`,
+	}
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := build.NewContext(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	pkgDir := monorepo.NewPath("foo")
+	bus, err := bc.LoadBuildUnits(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &sgebpb.BuildUnits{
+		BuildUnit: []*sgebpb.BuildUnit{
+			{Name: "foo", Bin: "foo.exe", Deps: []string{"//old:legacy_tool"}},
+		},
+	}
+	got, err := newDeprecatedDeps(mr, bc, pkgDir, old, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"//old:old_tool is deprecated, use //new:new_tool instead"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("newDeprecatedDeps() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFileLabels(t *testing.T) {
+	files := map[string]string{
+		"MONOREPO":            "",
+		"WORKSPACE":           "",
+		"foo/BUILD":           "",
+		"foo/bar/BUILD.bazel": "",
+		"foo/lib.go":          "",
+		"foo/data/a.txt":      "",
+		"foo/bar/bar.go":      "",
+		"orphan/x.go":         "",
+	}
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		files []changedFile
+		want  []string
+		ok    bool
+	}{
+		{
+			name: "sources",
+			files: []changedFile{
+				{path: "foo/lib.go", status: p4lib.ActionEdit},
+				{path: "foo/data/a.txt", status: p4lib.ActionEdit},
+				{path: "foo/bar/bar.go", status: p4lib.ActionAdd},
+			},
+			want: []string{"//foo:lib.go", "//foo:data/a.txt", "//foo/bar:bar.go"},
+			ok:   true,
+		},
+		{
+			name:  "build file",
+			files: []changedFile{{path: "foo/bar/BUILD.bazel", status: p4lib.ActionEdit}},
+		},
+		{
+			name:  "deleted file",
+			files: []changedFile{{path: "foo/lib.go", status: p4lib.ActionDelete}},
+		},
+		{
+			name:  "no package",
+			files: []changedFile{{path: "orphan/x.go", status: p4lib.ActionEdit}},
+		},
+	}
+	for _, tc := range tests {
+		got, ok := fileLabels(mr, tc.files)
+		if ok != tc.ok {
+			t.Errorf("%s: fileLabels() ok = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: fileLabels() diff (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestDurations(t *testing.T) {
+	check := &checkTest{
+		checkBase: checkBase{name: "check_test //foo:test"},
+		budget:    2 * time.Second,
+	}
+	fast := &presubmitpb.CheckResult{
+		OverallResult: &buildpb.Result{Success: true},
+		DurationMs:    1500,
+	}
+	slow := &presubmitpb.CheckResult{
+		OverallResult: &buildpb.Result{Success: false},
+		DurationMs:    2500,
+	}
+	if OverBudget(check, fast) {
+		t.Errorf("want %dms to be within budget of %s", fast.DurationMs, check.budget)
+	}
+	if !OverBudget(check, slow) {
+		t.Errorf("want %dms to be over budget of %s", slow.DurationMs, check.budget)
+	}
+	if OverBudget(&failCheck{}, slow) {
+		t.Errorf("want checks without budget never to be over budget")
+	}
+
+	dir, err := ioutil.TempDir("", "durations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := durations.NewStore(filepath.Join(dir, "durations.jsonl"))
+	recorder := NewDurationRecorder(store)
+	recorder.OnCheckResult("", check, fast)
+	recorder.OnCheckResult("", check, slow)
+	recorder.OnCheckResult("", check, &presubmitpb.CheckResult{OverallResult: &buildpb.Result{}})
+	recorder.OnPresubmitEnd(false)
+	records, err := store.Load(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []durations.Record
+	for _, r := range records {
+		r.Time = time.Time{}
+		got = append(got, r)
+	}
+	want := []durations.Record{
+		{Check: "check_test //foo:test", DurationMs: 1500, Success: true},
+		{Check: "check_test //foo:test", DurationMs: 2500, Success: false},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("recorded durations mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	got, err := ParseSelectors("format, check_test://foo:tests", "check_build,check:lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Selector{
+		{Kind: KindCheck, Target: "format"},
+		{Kind: KindCheckTest, Target: "//foo:tests"},
+		{Kind: KindCheckBuild},
+		{Kind: KindCheck, Target: "lint"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseSelectors mismatch (-want +got):\n%s", diff)
+	}
+	for _, invalid := range []string{"check_test:", "//foo:tests", "foo bar"} {
+		if _, err := ParseSelectors(invalid); err == nil {
+			t.Errorf("ParseSelectors(%q): want error", invalid)
+		}
+	}
+
+	mr := monorepo.New(`C:\ws`, map[string]monorepo.Path{
+		"shared": monorepo.NewPath("shared"),
+	})
+	label := func(s string) monorepo.Label {
+		l, err := mr.NewLabel("", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	selectors, err := ParseSelectors("format,check_test://foo,check_build://bar/...,check_build://unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSelection(selectors)
+	testCases := []struct {
+		kind   string
+		target string
+		label  string
+		want   bool
+	}{
+		{kind: KindCheck, target: "format", want: true},
+		{kind: KindCheck, target: "lint", want: false},
+		{kind: KindCheckTest, label: "//foo:test", want: true},
+		{kind: KindCheckTest, label: "//foo:other", want: false},
+		{kind: KindCheckBuild, label: "//bar", want: true},
+		{kind: KindCheckBuild, label: "//bar/baz:qux", want: true},
+		{kind: KindCheckBuild, label: "//barn:barn", want: false},
+		{kind: KindBlockDeprecatedDeps, target: "foo/BUILDUNIT", want: false},
+	}
+	for _, tc := range testCases {
+		var got bool
+		if tc.label != "" {
+			got = s.selectsLabel(mr, tc.kind, label(tc.label), "test")
+		} else {
+			got = s.selects(tc.kind, tc.target)
+		}
+		if got != tc.want {
+			t.Errorf("selects(%s %s%s): want %t, got %t", tc.kind, tc.target, tc.label, tc.want, got)
+		}
+	}
+	wantUnmatched := []Selector{{Kind: KindCheckBuild, Target: "//unused"}}
+	if diff := cmp.Diff(wantUnmatched, s.unmatched()); diff != "" {
+		t.Errorf("unmatched mismatch (-want +got):\n%s", diff)
+	}
+
+	var all *selection
+	if !all.selects(KindCheck, "anything") || !all.selectsLabel(mr, KindCheckTest, label("//foo"), "test") {
+		t.Errorf("nil selection must select everything")
+	}
+}
+
+func TestImpact(t *testing.T) {
+	mr := monorepo.New(`C:\ws`, map[string]monorepo.Path{})
+	label := func(s string) monorepo.Label {
+		l, err := mr.NewLabel("", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	m := impact.New()
+	m.Tests["//foo:test"] = &impact.Entry{Time: time.Now(), Files: []string{"foo/foo.go"}}
+	m.Tests["//bar:test"] = &impact.Entry{Time: time.Now(), Files: []string{"bar/bar.go"}}
+	ts := &triggeredSet{
+		runner: &runner{options: Options{Impact: m, ImpactRestrict: true}},
+		files:  []changedFile{{path: monorepo.NewPath("foo/foo.go")}},
+	}
+	verdicts := map[string]impact.Verdict{}
+	var checks []Check
+	for _, l := range []string{"//bar:test", "//baz:test", "//foo:test"} {
+		verdicts[l] = ts.testImpact(label(l))
+		checks = append(checks, &checkTest{checkBase: checkBase{name: l}, impact: verdicts[l]})
+	}
+	checks = append([]Check{&failCheck{checkBase: checkBase{name: "check format"}}}, checks...)
+	wantVerdicts := map[string]impact.Verdict{
+		"//bar:test": impact.Unaffected,
+		"//baz:test": impact.Unknown,
+		"//foo:test": impact.Affected,
+	}
+	if diff := cmp.Diff(wantVerdicts, verdicts); diff != "" {
+		t.Errorf("verdicts mismatch (-want +got):\n%s", diff)
+	}
+	if !ts.skipUnaffected(verdicts["//bar:test"]) || ts.skipUnaffected(verdicts["//baz:test"]) {
+		t.Errorf("want only unaffected tests skipped")
+	}
+	ts.runner.options.Only = []Selector{{Kind: KindCheckTest}}
+	if ts.skipUnaffected(verdicts["//bar:test"]) {
+		t.Errorf("want selected tests never skipped")
+	}
+
+	prioritizeByImpact(checks)
+	var got []string
+	for _, c := range checks {
+		got = append(got, c.Name())
+	}
+	if want := []string{"//foo:test", "check format", "//baz:test", "//bar:test"}; !cmp.Equal(want, got) {
+		t.Errorf("prioritized checks: want %v, got %v", want, got)
+	}
+}
+
+func TestNoPresubmit(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		wantReason string
+		wantTagged bool
+		wantErr    bool
+	}{
+		{desc: "Fix the build\n\nBUG=1234\n"},
+		{desc: "Rollback of cl/1234\n\nNO_PRESUBMIT=prod is down\n", wantReason: "prod is down", wantTagged: true},
+		{desc: "Rollback\n  NO_PRESUBMIT = rollback \n", wantReason: "rollback", wantTagged: true},
+		{desc: "Rollback\nNO_PRESUBMIT=\n", wantTagged: true, wantErr: true},
+		{desc: "Mentions NO_PRESUBMIT=foo mid-line\n"},
+	}
+	for _, tc := range testCases {
+		reason, tagged, err := ParseNoPresubmit(tc.desc)
+		if reason != tc.wantReason || tagged != tc.wantTagged || (err != nil) != tc.wantErr {
+			t.Errorf("ParseNoPresubmit(%q) = %q, %t, %v; want %q, %t, error %t", tc.desc, reason, tagged, err, tc.wantReason, tc.wantTagged, tc.wantErr)
+		}
+	}
+
+	p4 := p4mock.New()
+	p4.ExecCmdFunc = func(args ...string) (string, error) {
+		if args[len(args)-1] == "carol" {
+			return "release-managers\noncall\n", nil
+		}
+		return "", nil
+	}
+	policy := BypassPolicy{Allowed: []string{"alice", "group:oncall"}}
+	for user, want := range map[string]bool{"alice": true, "bob": false, "carol": true} {
+		got, err := policy.Allows(p4, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Allows(%s) = %t, want %t", user, got, want)
+		}
+	}
+	if diff := cmp.Diff(DefaultSafetyChecks, policy.Checks()); diff != "" {
+		t.Errorf("Checks mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// summaryRecorder records the summary of a run.
+type summaryRecorder struct {
+	summary *Summary
+	checks  map[string]string
+}
+
+func (sr *summaryRecorder) OnPresubmitStart(monorepo.Monorepo, string, []Check) {}
+
+func (sr *summaryRecorder) OnCheckStart(Check) {}
+
+func (sr *summaryRecorder) OnCheckResult(mdPath monorepo.Path, check Check, result *presubmitpb.CheckResult) {
+	sr.checks[check.Name()] = check.Monorepo()
+}
+
+func (sr *summaryRecorder) OnPresubmitEnd(bool) {}
+
+func (sr *summaryRecorder) OnRunEnd(summary *Summary) {
+	sr.summary = summary
+}
+
+func TestSummary(t *testing.T) {
+	files := map[string]string{
+		"foo/MONOREPO":   "",
+		"foo/WORKSPACE":  "",
+		"foo/CICD_TEST":  `presubmit { check { action: "lint" } }`,
+		"bar/MONOREPO":   "",
+		"bar/WORKSPACE":  "",
+		"bar/CICD_TEST":  `presubmit { check { action: "fmt" } }`,
+		"quux/MONOREPO":  "",
+		"quux/WORKSPACE": "",
+	}
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	u, err := universe.NewFromDef(universe.Def{
+		{Name: "foo", Root: "//foo"},
+		{Root: "//bar"},
+		{Name: "quux", Root: "//quux"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p4 := p4mock.New()
+	p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		return []p4lib.OpenedFile{
+			{Path: "//foo/foo.txt", Status: p4lib.DiffChange},
+			{Path: "//bar/bar.txt", Status: p4lib.DiffChange},
+		}, nil
+	}
+	p4.WhereFunc = func(p string) (string, error) {
+		return filepath.Join(wsDir, p[2:]), nil
+	}
+	recorder := &summaryRecorder{checks: map[string]string{}}
+	mp := cicdfile.NewProviderWithFileName("CICD_TEST", ".test")
+	r := NewRunner(u, p4, mp, func(opts *Options) {
+		opts.Logs = ioutil.Discard
+		opts.Listeners = []Listener{recorder}
+		// "fmt" isn't a registered action either, but it passed in a previous run.
+		opts.PreviousResults = map[string]*presubmitpb.CheckResult{
+			"check fmt": {OverallResult: &buildpb.Result{Success: true}},
+		}
+	})
+	success, err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if success {
+		t.Errorf("want failed run")
+	}
+	if recorder.summary != r.Summary() {
+		t.Errorf("want listener to get the runner summary")
+	}
+	wantChecks := map[string]string{
+		"check fmt":  "//bar",
+		"check lint": "foo",
+	}
+	if diff := cmp.Diff(wantChecks, recorder.checks); diff != "" {
+		t.Errorf("check monorepos diff (-want +got):\n%s", diff)
+	}
+	got := r.Summary()
+	for i := range got.Monorepos {
+		got.Monorepos[i].Duration = 0
+		for j := range got.Monorepos[i].Failures {
+			got.Monorepos[i].Failures[j].Duration = 0
+		}
+	}
+	want := &Summary{
+		Monorepos: []MonorepoSummary{
+			{Name: "//bar", Root: "//bar", Checks: 1, Passed: []string{"check fmt"}},
+			{
+				Name:   "foo",
+				Root:   "//foo",
+				Checks: 1,
+				Failures: []FailedCheck{
+					{Name: "check lint", CicdFile: "CICD_TEST"},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Summary() diff (-want +got):\n%s", diff)
+	}
+	wantMessages := []string{
+		"presubmit failed in 1 of 2 monorepos: foo",
+		"//bar (//bar): PASSED, 1 checks ran in 0s",
+		"foo (//foo): FAILED, 1 of 1 checks failed in 0s: check lint",
+	}
+	if diff := cmp.Diff(wantMessages, got.Messages()); diff != "" {
+		t.Errorf("Messages() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	files := map[string]string{
+		"foo/MONOREPO":  "",
+		"foo/WORKSPACE": "",
+		"foo/CICD_TEST": `
+presubmit {
+  exclude: "..._test.go"
+  check { action: "lint" }
+}
+presubmit {
+  include: "docs/..."
+  check { action: "lint" }
+  check { action: "spell" }
+}`,
+		"bar/MONOREPO":  "",
+		"bar/WORKSPACE": "",
+		"bar/CICD_TEST": `presubmit { include: "src/..." exclude: "src/gen/..." check { action: "lint" } }`,
+	}
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	u, err := universe.NewFromDef(universe.Def{
+		{Name: "foo", Root: "//foo"},
+		{Name: "bar", Root: "//bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p4 := p4mock.New()
+	p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		return []p4lib.OpenedFile{
+			{Path: "//foo/a.go", Status: p4lib.DiffChange},
+			{Path: "//foo/a_test.go", Status: p4lib.DiffChange},
+			{Path: "//foo/docs/x.md", Status: p4lib.DiffAdd},
+			// Only excluded files don't trigger the monorepo.
+			{Path: "//bar/src/gen/gen.go", Status: p4lib.DiffChange},
+		}, nil
+	}
+	p4.WhereFunc = func(p string) (string, error) {
+		return filepath.Join(wsDir, p[2:]), nil
+	}
+	mp := cicdfile.NewProviderWithFileName("CICD_TEST", ".test")
+	r := NewRunner(u, p4, mp, func(opts *Options) {
+		opts.Logs = ioutil.Discard
+	})
+	g, err := r.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotEdges []string
+	for _, e := range g.Edges {
+		s := fmt.Sprintf("%s -> %s", g.Node(e.From).Label, g.Node(e.To).Label)
+		if e.Include != "" {
+			s += " +" + e.Include
+		}
+		if e.Exclude != "" {
+			s += " -" + e.Exclude
+		}
+		gotEdges = append(gotEdges, s)
+	}
+	wantEdges := []string{
+		"a.go -> CICD_TEST[0] +...",
+		"docs/x.md -> CICD_TEST[0] +...",
+		"a_test.go -> CICD_TEST[0] +... -..._test.go",
+		"CICD_TEST[0] -> check lint",
+		"docs/x.md -> CICD_TEST[1] +docs/...",
+		"CICD_TEST[1] -> check lint",
+		"CICD_TEST[1] -> check spell",
+	}
+	if diff := cmp.Diff(wantEdges, gotEdges); diff != "" {
+		t.Errorf("Explain() edges diff (-want +got):\n%s", diff)
+	}
+	if n := len(g.Nodes); n != 7 {
+		t.Errorf("Explain() has %d nodes, want 7", n)
+	}
+
+	// After a run, the graph is that of the run.
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ran, err := r.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(g, ran, cmpopts.IgnoreUnexported(explain.Graph{})); diff != "" {
+		t.Errorf("Explain() after Run diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckBuildFiles(t *testing.T) {
+	files := map[string]string{
+		"foo/MONOREPO":  "",
+		"foo/WORKSPACE": "",
+		"foo/BUILDUNIT": `
+build_unit { name: "lib" target: ":lib" }
+build_unit { name: "app" target: ":app" }`,
+		"foo/CICD_TEST": `
+presubmit {
+  include: "lib/..."
+  check_build { build_unit: "//:lib" }
+}
+presubmit {
+  include: "app/..."
+  check_build { build_unit: "//:lib" }
+  check_build { build_unit: "//:app" }
+}`,
+	}
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	u, err := universe.NewFromDef(universe.Def{{Name: "foo", Root: "//foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p4 := p4mock.New()
+	p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		return []p4lib.OpenedFile{
+			{Path: "//foo/app/main.go", Status: p4lib.DiffChange},
+			{Path: "//foo/docs/readme.md", Status: p4lib.DiffChange},
+			{Path: "//foo/lib/lib.go", Status: p4lib.DiffChange},
+		}, nil
+	}
+	p4.WhereFunc = func(p string) (string, error) {
+		return filepath.Join(wsDir, p[2:]), nil
+	}
+	r := NewRunner(u, p4, cicdfile.NewProviderWithFileName("CICD_TEST", ".test")).(*runner)
+	r.selection = newSelection(nil)
+	sets, err := r.analyzeChange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 {
+		t.Fatalf("want 1 triggered set, got %d", len(sets))
+	}
+	bc, err := sets[0].buildContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	got := map[string][]string{}
+	for _, c := range sets[0].discoverChecks(bc, &explain.Graph{}) {
+		if cb, ok := c.(*checkBuild); ok {
+			for _, f := range cb.files {
+				got[cb.Name()] = append(got[cb.Name()], string(f.path))
+			}
+		}
+	}
+	// Builds only look at the files of the presubmits triggering them.
+	want := map[string][]string{
+		"check_build //:lib": {"lib/lib.go", "app/main.go"},
+		"check_build //:app": {"app/main.go"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("check_build files diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	files := map[string]string{
+		"foo/MONOREPO":  "",
+		"foo/WORKSPACE": "",
+		"foo/tools.textpb": `
+checker_tool { action: "gofmt" bin: "gofmt.exe" languages: "go" }
+checker_tool { action: "rustfmt" bin: "rustfmt.exe" languages: "rust" }
+checker_tool { action: "buildfmt" bin: "buildifier.exe" languages: "build" languages: "bzl" }
+checker_tool { action: "lint" bin: "lint.exe" }`,
+		"foo/CICD_TEST": `
+presubmit {
+  check { action: "gofmt" }
+  check { action: "rustfmt" }
+  check { action: "buildfmt" }
+  check { action: "lint" }
+}`,
+	}
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	u, err := universe.NewFromDef(universe.Def{
+		{Name: "foo", Root: "//foo", ToolConfigs: []string{"tools.textpb"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p4 := p4mock.New()
+	p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		return []p4lib.OpenedFile{
+			{Path: "//foo/a.go", Status: p4lib.DiffChange},
+			{Path: "//foo/lib/defs.bzl", Status: p4lib.DiffAdd},
+		}, nil
+	}
+	p4.WhereFunc = func(p string) (string, error) {
+		return filepath.Join(wsDir, p[2:]), nil
+	}
+	r := NewRunner(u, p4, cicdfile.NewProviderWithFileName("CICD_TEST", ".test"), func(opts *Options) {
+		opts.Logs = ioutil.Discard
+	})
+	g, err := r.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range g.Nodes {
+		if n.Kind == explain.KindCheck {
+			got = append(got, n.Label)
+		}
+	}
+	// No rust file changed: rustfmt isn't needed.
+	want := []string{"check gofmt", "check buildfmt", "check lint"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("checks diff (-want +got):\n%s", diff)
+	}
+
+	got = fileLanguages(monorepo.NewPath("game/BUILDUNIT"))
+	if diff := cmp.Diff([]string{"sgeb", "textproto"}, got); diff != "" {
+		t.Errorf("fileLanguages(BUILDUNIT) diff (-want +got):\n%s", diff)
+	}
+
+	files["foo/tools.textpb"] = `checker_tool { action: "gofmt" bin: "gofmt.exe" languages: "golang" }`
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Explain(); err == nil || !strings.Contains(err.Error(), `unknown language "golang"`) {
+		t.Errorf("Explain() with an unknown language = %v, want an error", err)
+	}
+}
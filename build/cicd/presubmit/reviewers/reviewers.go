@@ -0,0 +1,356 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reviewers suggests reviewers for a change from the history of the files it touches: the
+// users who recently and frequently changed or reviewed them, and their OWNERS.
+//
+// Suggestions are advisory. They are shown in Ebert's reviewer picker and used by the auto-assign
+// bot for reviews nobody was asked to look at, but they never gate a submit.
+package reviewers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+)
+
+// Weights of the evidence that a user knows a changed file.
+const (
+	// ownerWeight is added for each changed file a user owns.
+	ownerWeight = 1.0
+	// authorWeight is added for each recent change a user made to a changed file, decayed with the
+	// age of the change.
+	authorWeight = 1.0
+	// reviewerWeight is added for each recent change a user reviewed, decayed the same way.
+	reviewerWeight = 0.5
+)
+
+// Options tune the suggestions. Zero values pick the defaults.
+type Options struct {
+	// Exclude are the users never suggested, eg. the author of the change or bots.
+	Exclude []string
+	// Max is the number of suggestions returned, 5 by default.
+	Max int
+	// MaxFiles is the number of changed files whose history is looked at, 50 by default. Changes
+	// touching more files are usually mechanical, and their first files are as good as any.
+	MaxFiles int
+	// MaxChanges is the number of past changes looked at for each file, 20 by default.
+	MaxChanges int
+	// HalfLife is how long it takes for a past change to count half as much, 90 days by default.
+	HalfLife time.Duration
+	// Now is the time the age of past changes is computed at, the current time by default.
+	Now time.Time
+}
+
+func (o *Options) withDefaults() Options {
+	ret := *o
+	if ret.Max <= 0 {
+		ret.Max = 5
+	}
+	if ret.MaxFiles <= 0 {
+		ret.MaxFiles = 50
+	}
+	if ret.MaxChanges <= 0 {
+		ret.MaxChanges = 20
+	}
+	if ret.HalfLife <= 0 {
+		ret.HalfLife = 90 * 24 * time.Hour
+	}
+	if ret.Now.IsZero() {
+		ret.Now = time.Now()
+	}
+	return ret
+}
+
+// Suggestion is a suggested reviewer, along with why they are suggested.
+type Suggestion struct {
+	User  string  `json:"user"`
+	Score float64 `json:"score"`
+	// Owned is the number of changed files the user owns.
+	Owned int `json:"owned"`
+	// Authored is the number of recent changes the user made to the changed files.
+	Authored int `json:"authored"`
+	// Reviewed is the number of recent changes to the changed files the user reviewed.
+	Reviewed int `json:"reviewed"`
+}
+
+// Reason describes why the user is suggested, eg. "owns 2 files, authored 3 recent changes".
+func (s *Suggestion) Reason() string {
+	var reasons []string
+	if s.Owned > 0 {
+		reasons = append(reasons, fmt.Sprintf("owns %s", plural(s.Owned, "file")))
+	}
+	if s.Authored > 0 {
+		reasons = append(reasons, fmt.Sprintf("authored %s", plural(s.Authored, "recent change")))
+	}
+	if s.Reviewed > 0 {
+		reasons = append(reasons, fmt.Sprintf("reviewed %s", plural(s.Reviewed, "recent change")))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// OwnersSource returns the owners of depot files, keyed by depot file. Files without owners may
+// be missing from the result.
+type OwnersSource func(files []string) (map[string][]string, error)
+
+// ReviewerSource returns the reviewers of submitted changes, keyed by change. Changes that weren't
+// reviewed may be missing from the result.
+type ReviewerSource func(cls []int) (map[int][]string, error)
+
+// Engine computes suggestions. Owners and Reviewers are optional, without them the suggestions
+// only come from the authors of past changes.
+type Engine struct {
+	P4        p4lib.P4
+	Owners    OwnersSource
+	Reviewers ReviewerSource
+}
+
+// Suggest returns the suggested reviewers of a change to depot |files|, best first.
+func (e *Engine) Suggest(files []string, opts Options) ([]Suggestion, error) {
+	opts = opts.withDefaults()
+	files = append([]string{}, files...)
+	sort.Strings(files)
+	if len(files) > opts.MaxFiles {
+		files = files[:opts.MaxFiles]
+	}
+	byUser := map[string]*Suggestion{}
+	suggestion := func(user string) *Suggestion {
+		s, ok := byUser[user]
+		if !ok {
+			s = &Suggestion{User: user}
+			byUser[user] = s
+		}
+		return s
+	}
+
+	if e.Owners != nil {
+		owners, err := e.Owners(files)
+		if err != nil {
+			return nil, fmt.Errorf("could not get owners: %v", err)
+		}
+		for _, f := range files {
+			for _, user := range owners[f] {
+				s := suggestion(user)
+				s.Owned++
+				s.Score += ownerWeight
+			}
+		}
+	}
+
+	changes, err := e.history(files, opts.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+	decay := func(c p4lib.Change) float64 {
+		age := opts.Now.Sub(time.Unix(c.DateUnix, 0))
+		if age < 0 {
+			age = 0
+		}
+		return math.Pow(0.5, float64(age)/float64(opts.HalfLife))
+	}
+	var cls []int
+	for cl, c := range changes {
+		cls = append(cls, cl)
+		s := suggestion(c.User)
+		s.Authored++
+		s.Score += authorWeight * decay(c)
+	}
+	if e.Reviewers != nil && len(cls) > 0 {
+		sort.Ints(cls)
+		reviewers, err := e.Reviewers(cls)
+		if err != nil {
+			return nil, fmt.Errorf("could not get reviewers of past changes: %v", err)
+		}
+		for _, cl := range cls {
+			c := changes[cl]
+			for _, user := range reviewers[cl] {
+				if user == c.User {
+					continue
+				}
+				s := suggestion(user)
+				s.Reviewed++
+				s.Score += reviewerWeight * decay(c)
+			}
+		}
+	}
+
+	for _, user := range opts.Exclude {
+		delete(byUser, user)
+	}
+	var ret []Suggestion
+	for _, s := range byUser {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score > ret[j].Score
+		}
+		return ret[i].User < ret[j].User
+	})
+	if len(ret) > opts.Max {
+		ret = ret[:opts.Max]
+	}
+	return ret, nil
+}
+
+// history returns the last |max| submitted changes of each file of |files|, keyed by CL. New files
+// have no history, so the changes of the files next to them are used instead.
+func (e *Engine) history(files []string, max int) (map[int]p4lib.Change, error) {
+	ret := map[int]p4lib.Change{}
+	changes := func(p string) (int, error) {
+		cs, err := e.P4.Changes("-s", "submitted", "-m", strconv.Itoa(max), p)
+		if err != nil && !isNotFound(err) {
+			return 0, fmt.Errorf("could not get the changes of %s: %v", p, err)
+		}
+		for _, c := range cs {
+			ret[c.Cl] = c
+		}
+		return len(cs), nil
+	}
+	dirs := map[string]bool{}
+	for _, f := range files {
+		n, err := changes(f)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			continue
+		}
+		// path.Dir would clean the leading "//" of depot paths.
+		dir := "//" + path.Dir(strings.TrimPrefix(f, "//"))
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if _, err := changes(dir + "/*"); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, p4lib.ErrFileNotFound) || strings.Contains(err.Error(), "no such file(s)")
+}
+
+// DepotOwners returns an OwnersSource reading OWNERS files from the depot. The owners of a file are
+// those of the closest OWNERS file in its directory or above, as in owners.FindClosestOwnersForFile.
+// OWNERS files list emails, whose user part is taken as the p4 user.
+func DepotOwners(p4 p4lib.P4) OwnersSource {
+	return func(files []string) (map[string][]string, error) {
+		candidates := map[string]bool{}
+		for _, f := range files {
+			for _, o := range ownersFiles(f) {
+				candidates[o] = true
+			}
+		}
+		var paths []string
+		for o := range candidates {
+			paths = append(paths, o)
+		}
+		sort.Strings(paths)
+		byFile := map[string][]string{}
+		if len(paths) > 0 {
+			details, err := p4.PrintEx(paths...)
+			if err != nil && !isNotFound(err) {
+				return nil, err
+			}
+			for _, d := range details {
+				// Deleted OWNERS files are printed empty, and own nothing.
+				if users := parseOwners(string(d.Content)); len(users) > 0 {
+					byFile[d.DepotFile] = users
+				}
+			}
+		}
+		ret := map[string][]string{}
+		for _, f := range files {
+			for _, o := range ownersFiles(f) {
+				if users, ok := byFile[o]; ok {
+					ret[f] = users
+					break
+				}
+			}
+		}
+		return ret, nil
+	}
+}
+
+// ownersFiles returns the OWNERS files that may apply to depot file |f|, closest first, eg.
+// "//depot/a/OWNERS" then "//depot/OWNERS" for "//depot/a/b.go".
+func ownersFiles(f string) []string {
+	var ret []string
+	dir := path.Dir(strings.TrimPrefix(f, "//"))
+	for dir != "." && dir != "/" {
+		ret = append(ret, "//"+dir+"/OWNERS")
+		dir = path.Dir(dir)
+	}
+	return ret
+}
+
+func parseOwners(data string) []string {
+	var users []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user := strings.SplitN(line, "@", 2)[0]
+		if !seen[user] {
+			seen[user] = true
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// SwarmReviewers returns a ReviewerSource looking up the participants of the Swarm reviews of
+// changes, other than their authors.
+func SwarmReviewers(ctx *swarm.Context) ReviewerSource {
+	return func(cls []int) (map[int][]string, error) {
+		rc, err := swarm.GetReviewsForChangelists(ctx, cls)
+		if err != nil {
+			return nil, err
+		}
+		ret := map[int][]string{}
+		for _, r := range rc.Reviews {
+			var users []string
+			for u := range r.Participants {
+				if u != r.Author {
+					users = append(users, u)
+				}
+			}
+			sort.Strings(users)
+			for _, cl := range append(r.Commits, r.Changes...) {
+				ret[cl] = users
+			}
+		}
+		return ret, nil
+	}
+}
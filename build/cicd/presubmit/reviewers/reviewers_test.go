@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reviewers
+
+import (
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSuggest(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) int64 {
+		return now.Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	}
+	history := map[string][]p4lib.Change{
+		"//depot/game/render.cc": {
+			{Cl: 30, User: "alice", DateUnix: daysAgo(1)},
+			{Cl: 20, User: "alice", DateUnix: daysAgo(10)},
+			{Cl: 10, User: "bob", DateUnix: daysAgo(720)},
+		},
+		"//depot/game/render.h": {
+			{Cl: 30, User: "alice", DateUnix: daysAgo(1)},
+		},
+		// The new file has no history, the changes next to it are used instead.
+		"//depot/tools/*": {
+			{Cl: 40, User: "carol", DateUnix: daysAgo(5)},
+		},
+	}
+	p4 := p4mock.New()
+	p4.ChangesFunc = func(args ...string) ([]p4lib.Change, error) {
+		if changes, ok := history[args[len(args)-1]]; ok {
+			return changes, nil
+		}
+		return nil, p4lib.ErrFileNotFound
+	}
+	owners := map[string]string{
+		"//depot/game/OWNERS": "# Rendering.\ndave@example.com\nalice@example.com\n",
+		"//depot/OWNERS":      "erin@example.com\n",
+	}
+	p4.PrintExFunc = func(files ...string) ([]p4lib.FileDetails, error) {
+		var ret []p4lib.FileDetails
+		for _, f := range files {
+			if content, ok := owners[f]; ok {
+				ret = append(ret, p4lib.FileDetails{DepotFile: f, Content: []byte(content)})
+			}
+		}
+		return ret, p4lib.ErrFileNotFound
+	}
+	e := &Engine{
+		P4:     p4,
+		Owners: DepotOwners(p4),
+		Reviewers: func(cls []int) (map[int][]string, error) {
+			return map[int][]string{30: {"dave", "frank"}, 20: {"alice"}}, nil
+		},
+	}
+	files := []string{"//depot/game/render.cc", "//depot/game/render.h", "//depot/tools/new.py"}
+	got, err := e.Suggest(files, Options{Now: now, Exclude: []string{"frank"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	reasons := map[string]string{}
+	for _, s := range got {
+		users = append(users, s.User)
+		reasons[s.User] = s.Reason()
+	}
+	// Alice owns the game files and changed them recently, Dave owns them and reviewed them, Erin
+	// owns the tools, Carol changed them a few days ago and Bob's change is two years old.
+	wantUsers := []string{"alice", "dave", "erin", "carol", "bob"}
+	if diff := cmp.Diff(wantUsers, users); diff != "" {
+		t.Errorf("suggested users diff (-want +got):\n%s", diff)
+	}
+	wantReasons := map[string]string{
+		"alice": "owns 2 files, authored 2 recent changes",
+		"dave":  "owns 2 files, reviewed 1 recent change",
+		"carol": "authored 1 recent change",
+		"erin":  "owns 1 file",
+		"bob":   "authored 1 recent change",
+	}
+	if diff := cmp.Diff(wantReasons, reasons); diff != "" {
+		t.Errorf("reasons diff (-want +got):\n%s", diff)
+	}
+
+	got, err = e.Suggest(files, Options{Now: now, Exclude: []string{"alice"}, Max: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].User != "dave" {
+		t.Errorf("got %v, want only dave without alice", got)
+	}
+}
+
+func TestOwnersFiles(t *testing.T) {
+	got := ownersFiles("//depot/a/b/c.go")
+	want := []string{"//depot/a/b/OWNERS", "//depot/a/OWNERS", "//depot/OWNERS"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ownersFiles diff (-want +got):\n%s", diff)
+	}
+}
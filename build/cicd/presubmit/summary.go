@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presubmit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/monorepo/universe"
+)
+
+// Summary is the result of a presubmit run, per monorepo touched by the change.
+type Summary struct {
+	// Monorepos are the summaries of the monorepos with triggered checks, sorted by root.
+	Monorepos []MonorepoSummary
+}
+
+// MonorepoSummary is the result of the checks that ran in a single monorepo.
+type MonorepoSummary struct {
+	// Name is the name of the monorepo, or its root if it has none.
+	Name string
+
+	// Root is the depot root of the monorepo, eg. "//some-depot".
+	Root string
+
+	// Checks is the number of checks that ran.
+	Checks int
+
+	// Passed are the names of the checks that passed, in the order they ran.
+	Passed []string
+
+	// Failures are the checks that failed, in the order they ran.
+	Failures []FailedCheck
+
+	// Duration is the time spent running the checks.
+	Duration time.Duration
+}
+
+// FailedCheck is a check that failed within a monorepo.
+type FailedCheck struct {
+	Name     string
+	CicdFile monorepo.Path
+	Duration time.Duration
+}
+
+// SummaryListener is a Listener that also wants the summary of the whole run, across monorepos.
+type SummaryListener interface {
+	Listener
+
+	// OnRunEnd is called once after the checks of all monorepos have run.
+	OnRunEnd(summary *Summary)
+}
+
+// Success returns whether no check failed in the monorepo.
+func (ms *MonorepoSummary) Success() bool {
+	return len(ms.Failures) == 0
+}
+
+// String returns a one line description of the monorepo result.
+func (ms *MonorepoSummary) String() string {
+	took := ms.Duration.Round(time.Second)
+	if ms.Success() {
+		return fmt.Sprintf("%s (%s): PASSED, %d checks ran in %s", ms.Name, ms.Root, ms.Checks, took)
+	}
+	var names []string
+	for _, f := range ms.Failures {
+		names = append(names, f.Name)
+	}
+	return fmt.Sprintf("%s (%s): FAILED, %d of %d checks failed in %s: %s", ms.Name, ms.Root, len(ms.Failures), ms.Checks, took, strings.Join(names, ", "))
+}
+
+// Success returns whether no check failed in any monorepo.
+func (s *Summary) Success() bool {
+	for i := range s.Monorepos {
+		if !s.Monorepos[i].Success() {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the names of the monorepos with failed checks.
+func (s *Summary) Failed() []string {
+	var failed []string
+	for _, ms := range s.Monorepos {
+		if !ms.Success() {
+			failed = append(failed, ms.Name)
+		}
+	}
+	return failed
+}
+
+// Messages returns a headline followed by one line per monorepo, suitable for a Swarm test run
+// update.
+func (s *Summary) Messages() []string {
+	var headline string
+	if failed := s.Failed(); len(failed) > 0 {
+		headline = fmt.Sprintf("presubmit failed in %d of %d monorepos: %s", len(failed), len(s.Monorepos), strings.Join(failed, ", "))
+	} else {
+		headline = fmt.Sprintf("presubmit was successful in %d monorepos", len(s.Monorepos))
+	}
+	messages := []string{headline}
+	for i := range s.Monorepos {
+		messages = append(messages, s.Monorepos[i].String())
+	}
+	return messages
+}
+
+func (s *Summary) String() string {
+	return strings.Join(s.Messages(), "\n")
+}
+
+// monorepoName returns the name identifying |def| in summaries and to listeners.
+func monorepoName(def universe.MonorepoDef) string {
+	if def.Name != "" {
+		return def.Name
+	}
+	return def.Root
+}
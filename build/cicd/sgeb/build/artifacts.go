@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+)
+
+// artifactFilter selects artifacts by matching their stable paths against glob patterns.
+type artifactFilter struct {
+	includes []string
+	excludes []string
+}
+
+// newArtifactFilter parses the artifact_filter patterns of a build unit.
+func newArtifactFilter(patterns []string) (*artifactFilter, error) {
+	f := &artifactFilter{}
+	for _, p := range patterns {
+		exclude := strings.HasPrefix(p, "-")
+		p = strings.TrimPrefix(p, "-")
+		if p == "" {
+			return nil, fmt.Errorf("empty artifact filter pattern")
+		}
+		// Validate the pattern upfront, so bad patterns fail the build instead of silently never
+		// matching.
+		for _, elem := range strings.Split(p, "/") {
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, fmt.Errorf("invalid artifact filter pattern %q: %v", p, err)
+			}
+		}
+		if exclude {
+			f.excludes = append(f.excludes, p)
+		} else {
+			f.includes = append(f.includes, p)
+		}
+	}
+	return f, nil
+}
+
+// match returns whether the artifact at |stablePath| passes the filter.
+func (f *artifactFilter) match(stablePath string) bool {
+	for _, p := range f.excludes {
+		if matchGlob(p, stablePath) {
+			return false
+		}
+	}
+	if len(f.includes) == 0 {
+		return true
+	}
+	for _, p := range f.includes {
+		if matchGlob(p, stablePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the artifacts of |as| that pass the filter.
+func (f *artifactFilter) apply(as *buildpb.ArtifactSet) *buildpb.ArtifactSet {
+	if as == nil {
+		return nil
+	}
+	var artifacts []*buildpb.Artifact
+	for _, a := range as.Artifacts {
+		if f.match(a.StablePath) {
+			artifacts = append(artifacts, a)
+		}
+	}
+	return &buildpb.ArtifactSet{
+		Tag:       as.Tag,
+		Artifacts: artifacts,
+	}
+}
+
+// matchGlob returns whether |name| matches |pattern|. Patterns are matched element by element with
+// path.Match, except for "**" elements which match any number of elements.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArtifactFilter(t *testing.T) {
+	artifacts := &buildpb.ArtifactSet{
+		Tag: "tag",
+		Artifacts: []*buildpb.Artifact{
+			{StablePath: "foo/foo.exe"},
+			{StablePath: "foo/foo.pdb"},
+			{StablePath: "foo/data/a.txt"},
+			{StablePath: "foo/data/sub/b.txt"},
+			{StablePath: "readme.txt"},
+		},
+	}
+	testCases := []struct {
+		patterns []string
+		want     []string
+	}{
+		{
+			patterns: nil,
+			want:     []string{"foo/foo.exe", "foo/foo.pdb", "foo/data/a.txt", "foo/data/sub/b.txt", "readme.txt"},
+		},
+		{
+			patterns: []string{"foo/*.exe"},
+			want:     []string{"foo/foo.exe"},
+		},
+		{
+			patterns: []string{"*.txt"},
+			want:     []string{"readme.txt"},
+		},
+		{
+			patterns: []string{"**/*.txt"},
+			want:     []string{"foo/data/a.txt", "foo/data/sub/b.txt", "readme.txt"},
+		},
+		{
+			patterns: []string{"foo/**", "-**/*.pdb"},
+			want:     []string{"foo/foo.exe", "foo/data/a.txt", "foo/data/sub/b.txt"},
+		},
+		{
+			patterns: []string{"-foo/data/**"},
+			want:     []string{"foo/foo.exe", "foo/foo.pdb", "readme.txt"},
+		},
+	}
+	for _, tc := range testCases {
+		f, err := newArtifactFilter(tc.patterns)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.patterns, err)
+			continue
+		}
+		filtered := f.apply(artifacts)
+		if filtered.Tag != "tag" {
+			t.Errorf("%v: want tag to be kept, got %q", tc.patterns, filtered.Tag)
+		}
+		var got []string
+		for _, a := range filtered.Artifacts {
+			got = append(got, a.StablePath)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%v: artifacts mismatch (-want +got):\n%s", tc.patterns, diff)
+		}
+	}
+
+	for _, patterns := range [][]string{{"-"}, {"foo/[.exe"}} {
+		if _, err := newArtifactFilter(patterns); err == nil {
+			t.Errorf("%v: want error", patterns)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// DefaultBazelRetries is the default of Options.BazelRetries.
+const DefaultBazelRetries = 2
+
+// Bazel exit codes of transient failures.
+// See https://docs.bazel.build/versions/master/guide.html#what-exit-code-will-i-get
+const (
+	bazelExitOOM           = 33
+	bazelExitInternalError = 37
+)
+
+// transientOutputs are the outputs of Bazel failures that a server restart usually fixes, with
+// their description.
+var transientOutputs = []struct {
+	output string
+	reason string
+}{
+	{"Server terminated abruptly", "Bazel server terminated abruptly"},
+	{"Server crashed during startup", "Bazel server crashed during startup"},
+	{"java.lang.OutOfMemoryError", "Bazel server ran out of memory"},
+}
+
+// transientBazelFailure returns why a Bazel command that failed with |exitCode| and |output| is
+// worth retrying after a server restart, or "" if the failure isn't transient, eg. a compile error.
+func transientBazelFailure(exitCode int, output string) string {
+	for _, t := range transientOutputs {
+		if strings.Contains(output, t.output) {
+			return t.reason
+		}
+	}
+	switch exitCode {
+	case bazelExitOOM:
+		return "Bazel ran out of memory"
+	case bazelExitInternalError:
+		return "Bazel internal error"
+	}
+	return ""
+}
+
+// shutdownBazel stops the Bazel server, the next command starts a fresh one.
+func (c *context) shutdownBazel(options Options) error {
+	bazelwsp, err := c.Monorepo.NewPath("", "//bin/windows/bazel.exe")
+	if err != nil {
+		return err
+	}
+	var args []string
+	args = append(args, options.BazelStartupArgs...)
+	args = append(args, "shutdown")
+	cmd := exec.Command(c.Monorepo.ResolvePath(bazelwsp), args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = c.Monorepo.Root
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("bazel shutdown failed: %v: %s", err, out)
+	}
+	return nil
+}
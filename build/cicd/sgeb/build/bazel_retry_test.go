@@ -0,0 +1,37 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestTransientBazelFailure(t *testing.T) {
+	tests := []struct {
+		exitCode int
+		output   string
+		want     string
+	}{
+		{1, "ERROR: foo/BUILD:3:1: C++ compilation of rule '//foo:bar' failed", ""},
+		{2, "ERROR: Unrecognized option: --bad", ""},
+		{37, "FATAL: bazel crashed due to an internal error.", "Bazel internal error"},
+		{33, "", "Bazel ran out of memory"},
+		{1, "Server terminated abruptly (error code: 14, error message: 'Socket closed')", "Bazel server terminated abruptly"},
+		{37, "Exception in thread: java.lang.OutOfMemoryError: Java heap space", "Bazel server ran out of memory"},
+	}
+	for _, tc := range tests {
+		if got := transientBazelFailure(tc.exitCode, tc.output); got != tc.want {
+			t.Errorf("transientBazelFailure(%d, %q) = %q, want %q", tc.exitCode, tc.output, got, tc.want)
+		}
+	}
+}
@@ -25,8 +25,16 @@ import (
 	bepb "bazel.io/src/main/java/com/google/devtools/build/lib/buildeventstream/proto"
 )
 
-// buildInvocationResult parses the BEP stream and returns a BuildInvocationResult.
-func buildInvocationResult(s *bep.Stream, label string) (*buildpb.BuildInvocationResult, error) {
+// buildInvocationResult parses the BEP stream and returns a BuildInvocationResult. The artifacts
+// are taken from |outputGroups|, or from the default output group if empty.
+func buildInvocationResult(s *bep.Stream, label string, outputGroups []string) (*buildpb.BuildInvocationResult, error) {
+	wantGroups := map[string]bool{}
+	for _, g := range outputGroups {
+		wantGroups[g] = true
+	}
+	if len(wantGroups) == 0 {
+		wantGroups["default"] = true
+	}
 	result := &buildpb.Result{
 		Name: label,
 	}
@@ -44,13 +52,13 @@ func buildInvocationResult(s *bep.Stream, label string) (*buildpb.BuildInvocatio
 				result.Success = true
 				artifacts := map[string]*buildpb.Artifact{}
 				for _, outputGroup := range tc.OutputGroup {
-					// We only care about the default output group.
-					// We do not issue build commands with output groups other than the default one.
-					if outputGroup.Name == "default" {
-						artifacts = map[string]*buildpb.Artifact{}
-						for n, f := range s.Depsets.Files(outputGroup.FileSets) {
-							artifacts[n] = fileToArtifact(f)
-						}
+					// Bazel also reports output groups that were not requested, eg. baseline
+					// coverage, which we don't care about.
+					if !wantGroups[outputGroup.Name] {
+						continue
+					}
+					for n, f := range s.Depsets.Files(outputGroup.FileSets) {
+						artifacts[n] = fileToArtifact(f)
 					}
 				}
 				var sortedArtifacts []*buildpb.Artifact
@@ -30,9 +30,10 @@ import (
 
 func TestGetBuildResults(t *testing.T) {
 	testCases := []struct {
-		desc   string
-		events []proto.Message
-		want   *buildpb.BuildInvocationResult
+		desc         string
+		events       []proto.Message
+		outputGroups []string
+		want         *buildpb.BuildInvocationResult
 	}{
 		{
 			desc: "Success case",
@@ -61,6 +62,32 @@ func TestGetBuildResults(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "Output groups",
+			events: []proto.Message{
+				namedSetOfFilesEvent("set-a", []string{"a.exe"}, nil),
+				namedSetOfFilesEvent("set-b", []string{"a.pdb"}, nil),
+				namedSetOfFilesEvent("set-c", []string{"a.lib"}, nil),
+				targetCompleteOutputGroupsEvent("//foo:foo", map[string]string{
+					"default":  "set-a",
+					"pdb_file": "set-b",
+					"lib":      "set-c",
+				}),
+			},
+			outputGroups: []string{"default", "pdb_file"},
+			want: &buildpb.BuildInvocationResult{
+				Result: &buildpb.Result{
+					Name:    "//foo:foo",
+					Success: true,
+				},
+				ArtifactSet: &buildpb.ArtifactSet{
+					Artifacts: []*buildpb.Artifact{
+						{StablePath: "a.exe", Uri: "file:///a.exe"},
+						{StablePath: "a.pdb", Uri: "file:///a.pdb"},
+					},
+				},
+			},
+		},
 		{
 			desc: "Indirect failure case",
 			events: []proto.Message{
@@ -122,7 +149,7 @@ func TestGetBuildResults(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		got, err := buildInvocationResult(s, "//foo:foo")
+		got, err := buildInvocationResult(s, "//foo:foo", tc.outputGroups)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -340,6 +367,34 @@ func targetCompleteEvent(label string, depsets ...string) *bepb.BuildEvent {
 	}
 }
 
+func targetCompleteOutputGroupsEvent(label string, depsetByGroup map[string]string) *bepb.BuildEvent {
+	var groups []*bepb.OutputGroup
+	for name, depset := range depsetByGroup {
+		groups = append(groups, &bepb.OutputGroup{
+			Name:     name,
+			FileSets: depsetIds([]string{depset}),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return &bepb.BuildEvent{
+		Id: &bepb.BuildEventId{
+			Id: &bepb.BuildEventId_TargetCompleted{
+				TargetCompleted: &bepb.BuildEventId_TargetCompletedId{
+					Label: label,
+				},
+			},
+		},
+		Payload: &bepb.BuildEvent_Completed{
+			Completed: &bepb.TargetComplete{
+				Success:     true,
+				OutputGroup: groups,
+			},
+		},
+	}
+}
+
 func targetFailedEvent(label string, cause *bepb.BuildEventId) *bepb.BuildEvent {
 	return &bepb.BuildEvent{
 		Id: &bepb.BuildEventId{
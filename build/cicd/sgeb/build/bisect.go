@@ -0,0 +1,238 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// BisectCandidate is a submitted CL a bisection may run a unit at.
+type BisectCandidate struct {
+	Cl          int64  `json:"cl"`
+	User        string `json:"user"`
+	Description string `json:"description"`
+}
+
+// BisectStep is the outcome of running the unit at a CL.
+type BisectStep struct {
+	Cl      int64   `json:"cl"`
+	Passed  bool    `json:"passed"`
+	Seconds float64 `json:"seconds"`
+}
+
+// BisectState is the state of a bisection. It is saved after every step so that an interrupted
+// bisection resumes where it stopped, and holds the verdict once the bisection is done.
+type BisectState struct {
+	Unit string `json:"unit"`
+	// Good is a CL the unit passes at, Bad a later CL it fails at.
+	Good int64 `json:"good"`
+	Bad  int64 `json:"bad"`
+	// Candidates are the CLs in (Good, Bad], ascending.
+	Candidates []BisectCandidate `json:"candidates"`
+	Steps      []BisectStep      `json:"steps"`
+	// FirstBad is the first CL the unit fails at, set once the bisection is done.
+	FirstBad *BisectCandidate `json:"first_bad,omitempty"`
+}
+
+// Bisect binary searches the CLs between a good and a bad CL for the first one a unit fails at.
+type Bisect struct {
+	// P4 lists the candidate CLs and syncs the workspace to them.
+	P4 p4lib.P4
+	// Dir holds the state of bisections, a file per unit and CL range.
+	Dir string
+	// Run runs the unit at the CL the workspace is synced to. Failures of the unit must be reported
+	// as failed errors, see IsFailed; any other error aborts the bisection.
+	Run func(cl int64) error
+	// Logs receives the progress of the bisection.
+	Logs io.Writer
+}
+
+// NewBisect returns a bisection that keeps its state in the output directory |outputDir|.
+func NewBisect(outputDir string, p4 p4lib.P4, run func(cl int64) error) *Bisect {
+	return &Bisect{
+		P4:   p4,
+		Dir:  filepath.Join(outputDir, "bisect"),
+		Run:  run,
+		Logs: os.Stdout,
+	}
+}
+
+// StatePath returns the file the state of the bisection of |unit| between |good| and |bad| is saved
+// to.
+func (b *Bisect) StatePath(unit monorepo.Label, good, bad int64) string {
+	return b.statePath(unit.String(), good, bad)
+}
+
+func (b *Bisect) statePath(unit string, good, bad int64) string {
+	return filepath.Join(b.Dir, fmt.Sprintf("%s@%d-%d.json", url.QueryEscape(unit), good, bad))
+}
+
+// Reset discards the saved state of the bisection of |unit| between |good| and |bad|.
+func (b *Bisect) Reset(unit monorepo.Label, good, bad int64) error {
+	if err := os.Remove(b.StatePath(unit, good, bad)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Bisect finds the first CL in (|good|, |bad|] that |unit| fails at, assuming it passes at |good|
+// and fails at |bad|. The workspace is left synced to the last CL the unit ran at.
+func (b *Bisect) Bisect(unit monorepo.Label, good, bad int64) (*BisectState, error) {
+	if good <= 0 || bad <= good {
+		return nil, UsageErrorf("the good CL must come before the bad CL, got good=%d bad=%d", good, bad)
+	}
+	state, err := b.load(unit, good, bad)
+	if err != nil {
+		return nil, err
+	}
+	if state.Candidates == nil {
+		if state.Candidates, err = b.candidates(good, bad); err != nil {
+			return nil, err
+		}
+		if err := b.save(state); err != nil {
+			return nil, err
+		}
+	}
+	passed := map[int64]bool{}
+	for _, s := range state.Steps {
+		passed[s.Cl] = s.Passed
+	}
+	// Invariant: the unit passes at lo (-1 being the good CL) and fails at hi.
+	lo, hi := -1, len(state.Candidates)-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		c := state.Candidates[mid]
+		ok, done := passed[c.Cl]
+		if !done {
+			remaining := hi - lo - 1
+			fmt.Fprintf(b.Logs, "Bisecting %s: %d CLs left to test (about %d steps), testing CL %d\n", unit, remaining, steps(remaining), c.Cl)
+			step, err := b.step(c.Cl)
+			if err != nil {
+				return nil, err
+			}
+			ok = step.Passed
+			state.Steps = append(state.Steps, *step)
+			if err := b.save(state); err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	state.FirstBad = &state.Candidates[hi]
+	if err := b.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// step syncs the workspace to |cl| and runs the unit.
+func (b *Bisect) step(cl int64) (*BisectStep, error) {
+	if _, err := b.P4.Sync([]string{fmt.Sprintf("//...@%d", cl)}); err != nil {
+		return nil, WithExitCode(fmt.Errorf("could not sync to CL %d: %v", cl, err), ExitInfra)
+	}
+	start := time.Now()
+	err := b.Run(cl)
+	if err != nil && !IsFailed(err) {
+		return nil, fmt.Errorf("could not run at CL %d: %w", cl, err)
+	}
+	passed := err == nil
+	verdict := "passed"
+	if !passed {
+		verdict = "failed"
+	}
+	fmt.Fprintf(b.Logs, "CL %d %s\n", cl, verdict)
+	return &BisectStep{Cl: cl, Passed: passed, Seconds: time.Since(start).Seconds()}, nil
+}
+
+// candidates returns the submitted CLs in (|good|, |bad|], ascending.
+func (b *Bisect) candidates(good, bad int64) ([]BisectCandidate, error) {
+	changes, err := b.P4.Changes("-l", "-s", "submitted", fmt.Sprintf("//...@%d,@%d", good+1, bad))
+	if err != nil {
+		return nil, WithExitCode(fmt.Errorf("could not list CLs between %d and %d: %v", good, bad, err), ExitInfra)
+	}
+	var ret []BisectCandidate
+	for _, c := range changes {
+		ret = append(ret, BisectCandidate{Cl: int64(c.Cl), User: c.User, Description: c.Description})
+	}
+	if len(ret) == 0 {
+		return nil, UsageErrorf("no submitted CLs between %d and %d", good, bad)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Cl < ret[j].Cl })
+	return ret, nil
+}
+
+func (b *Bisect) load(unit monorepo.Label, good, bad int64) (*BisectState, error) {
+	p := b.StatePath(unit, good, bad)
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return &BisectState{Unit: unit.String(), Good: good, Bad: bad}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &BisectState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not parse bisect state %s: %v", p, err)
+	}
+	fmt.Fprintf(b.Logs, "Resuming bisection of %s from %s, %d CLs tested\n", unit, p, len(state.Steps))
+	return state, nil
+}
+
+func (b *Bisect) save(state *BisectState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.statePath(state.Unit, state.Good, state.Bad), data, 0644)
+}
+
+// steps returns the number of steps needed to bisect |n| CLs.
+func steps(n int) int {
+	s := 0
+	for ; n > 0; n /= 2 {
+		s++
+	}
+	return s
+}
+
+// PrintBisectResult prints the verdict of a bisection.
+func PrintBisectResult(w io.Writer, state *BisectState) {
+	if state.FirstBad == nil {
+		fmt.Fprintf(w, "Bisection of %s between CL %d and CL %d is not done\n", state.Unit, state.Good, state.Bad)
+		return
+	}
+	fmt.Fprintf(w, "%s first fails at CL %d by %s, found in %d steps:\n", state.Unit, state.FirstBad.Cl, state.FirstBad.User, len(state.Steps))
+	for _, l := range strings.Split(strings.TrimSpace(state.FirstBad.Description), "\n") {
+		fmt.Fprintf(w, "    %s\n", l)
+	}
+}
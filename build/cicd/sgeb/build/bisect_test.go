@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBisect(t *testing.T) {
+	unit := monorepo.Label{Pkg: "game", Target: "tests"}
+	p4 := p4mock.New()
+	p4.ChangesFunc = func(args ...string) ([]p4lib.Change, error) {
+		if got, want := args[len(args)-1], "//...@101,@110"; got != want {
+			t.Errorf("Changes() range = %q, want %q", got, want)
+		}
+		var changes []p4lib.Change
+		// p4 lists the most recent CLs first.
+		for cl := 110; cl > 100; cl-- {
+			changes = append(changes, p4lib.Change{Cl: cl, User: "user", Description: fmt.Sprintf("CL %d\n", cl)})
+		}
+		return changes, nil
+	}
+	var synced int64
+	p4.SyncFunc = func(targets []string, options ...string) (string, error) {
+		if _, err := fmt.Sscanf(targets[0], "//...@%d", &synced); err != nil {
+			t.Fatal(err)
+		}
+		return "", nil
+	}
+	var ran []int64
+	b := NewBisect(t.TempDir(), p4, func(cl int64) error {
+		if cl != synced {
+			t.Errorf("ran at CL %d, synced to %d", cl, synced)
+		}
+		ran = append(ran, cl)
+		if cl >= 107 {
+			return &failed{unit}
+		}
+		return nil
+	})
+	b.Logs = ioutil.Discard
+	state, err := b.Bisect(unit, 100, 110)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.FirstBad == nil || state.FirstBad.Cl != 107 {
+		t.Fatalf("Bisect() first bad = %+v, want CL 107", state.FirstBad)
+	}
+	if len(ran) > 4 {
+		t.Errorf("Bisect() ran %d steps %v, want at most 4", len(ran), ran)
+	}
+
+	// Resuming a done bisection doesn't run anything.
+	steps := ran
+	ran = nil
+	state, err = b.Bisect(unit, 100, 110)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 0 || state.FirstBad.Cl != 107 {
+		t.Errorf("resumed Bisect() ran %v with first bad %d, want no runs and CL 107", ran, state.FirstBad.Cl)
+	}
+	var got []int64
+	for _, s := range state.Steps {
+		got = append(got, s.Cl)
+	}
+	if diff := cmp.Diff(steps, got); diff != "" {
+		t.Errorf("steps diff (-want +got):\n%s", diff)
+	}
+	var sb strings.Builder
+	PrintBisectResult(&sb, state)
+	if !strings.Contains(sb.String(), "first fails at CL 107") {
+		t.Errorf("PrintBisectResult() = %q, want the first bad CL", sb.String())
+	}
+
+	// Errors other than failures abort the bisection.
+	if err := b.Reset(unit, 100, 110); err != nil {
+		t.Fatal(err)
+	}
+	b.Run = func(cl int64) error {
+		return fmt.Errorf("no space left")
+	}
+	if _, err := b.Bisect(unit, 100, 110); err == nil {
+		t.Error("Bisect() with broken runs succeeded, want error")
+	}
+	if _, err := b.Bisect(unit, 110, 100); !IsUsage(err) {
+		t.Errorf("Bisect() with good after bad = %v, want usage error", err)
+	}
+}
@@ -16,8 +16,10 @@ package build
 
 import (
 	"bytes"
+	gocontext "context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -36,9 +38,11 @@ import (
 	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
 	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
 	"sge-monorepo/environment/envinstall"
+	"sge-monorepo/libs/go/credentials"
 	"sge-monorepo/libs/go/files"
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/log/cloudlog"
+	"sge-monorepo/libs/go/p4lib"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/timestamp"
@@ -62,6 +66,15 @@ type Context interface {
 	// BazelArgs returns the arguments of the given unit, if any. Used for sorting by sgep.
 	BazelArgs(label monorepo.Label) ([]string, error)
 
+	// BazelQuery runs "bazel query" of |expr| and returns the matching labels, or the lines of the
+	// output set by Options.BazelQueryArgs.
+	BazelQuery(expr string, opts ...Option) ([]string, error)
+
+	// DepsWhy explains why unit |from| depends on unit |to|: the chain of references between them
+	// across BUILDUNIT files and, for Bazel build units, the chain of Bazel targets. Returns an
+	// error if |from| doesn't depend on |to|.
+	DepsWhy(from, to monorepo.Label) (*DepChain, error)
+
 	// ExpandTargetExpression expands a target pattern and any test suites to a flat list of test units.
 	// If the label points to a test unit, a slice with only that test unit is returned.
 	ExpandTargetExpression(te monorepo.TargetExpression) ([]monorepo.Label, error)
@@ -84,6 +97,28 @@ type Context interface {
 
 	// RunTask runs a task unit.
 	RunTask(label monorepo.Label, args []string, opts ...Option) error
+
+	// Generate runs the generator of the gen unit pointed to by the label and compares its outputs
+	// with the checked-in files. If any is stale, the result is returned along with a "failed"
+	// error. Use WriteGenOutputs to update them.
+	Generate(guLabel monorepo.Label, opts ...Option) (*GenResult, error)
+
+	// Prefetch fetches what the units matched by the target expression and their dependencies
+	// need to be built, without building them: it builds and caches their tool binaries, installs
+	// the environment components they require and fetches the external repositories of their
+	// Bazel targets. Failures are reported in the result, an error is only returned if the units
+	// can't be loaded.
+	Prefetch(te monorepo.TargetExpression, opts ...Option) (*PrefetchResult, error)
+
+	// StartServices starts the service units pointed to by the labels and waits for them to be
+	// healthy. The services are kept alive until Stop is called on the result.
+	StartServices(labels []monorepo.Label, opts ...Option) (*Services, error)
+
+	// SuggestDeps builds the build unit pointed to by the label with the file accesses of its tool
+	// traced, and suggests the deps it is missing. A failing build is not an error: it is reported
+	// in the suggestion, as missing deps usually make builds fail. Use WriteSuggestedDeps to add
+	// the deps to the BUILDUNIT file.
+	SuggestDeps(buLabel monorepo.Label, opts ...Option) (*DepsSuggestion, error)
 }
 
 // failed signifies a build/test that executed to the end but had failures.
@@ -98,10 +133,11 @@ func (f failed) Error() string {
 	return fmt.Sprintf("%s failed", f.Label.String())
 }
 
-// IsFailed returns whether the error is a "build failed" error
+// IsFailed returns whether the error is a "build failed" error. See ExitCode for the classification
+// of other errors.
 func IsFailed(err error) bool {
-	_, ok := err.(*failed)
-	return ok
+	var f *failed
+	return errors.As(err, &f)
 }
 
 func maybeFailError(success bool, label monorepo.Label) error {
@@ -118,13 +154,16 @@ type context struct {
 	toolCache    map[monorepo.Label]string
 	toolCacheDir string
 	options      Options
+	// settings are the monorepo settings, loaded on first use.
+	settings *sgebpb.MonorepoSettings
 }
 
 // NewContext returns a new builder in the given pwd.
 func NewContext(mr monorepo.Monorepo, opts ...Option) (Context, error) {
 	options := Options{
-		Logs:     os.Stderr,
-		LogLevel: "ERROR",
+		Logs:         os.Stderr,
+		LogLevel:     "ERROR",
+		BazelRetries: DefaultBazelRetries,
 	}
 	for _, opt := range opts {
 		opt(&options)
@@ -135,6 +174,12 @@ func NewContext(mr monorepo.Monorepo, opts ...Option) (Context, error) {
 	if options.LogsDir == "" {
 		options.LogsDir = mr.ResolvePath("sgeb-logs")
 	}
+	if options.Credentials == nil {
+		options.Credentials = credentials.Default()
+	}
+	if options.P4 == nil {
+		options.P4 = p4lib.New()
+	}
 	toolCacheDir, err := ioutil.TempDir("", "sgeb")
 	if err != nil {
 		return nil, err
@@ -166,6 +211,11 @@ type Options struct {
 	// Eg: bazel build {BazelBuildArgs} //some/target
 	BazelBuildArgs []string
 
+	// BazelQueryArgs are options given to bazel query by BazelQuery, after --output=label. Eg.
+	// --output=graph gets the edges between the targets, BazelQuery then returns the lines of the
+	// output rather than labels.
+	BazelQueryArgs []string
+
 	// OutputDir is an absolute output directory for non-Bazel build units.
 	// If left blank "<monorepo>//sgeb-out" is used.
 	OutputDir string
@@ -179,6 +229,68 @@ type Options struct {
 
 	// Additional log labels to add to any build invocation.
 	LogLabels map[string]string
+
+	// NoResultCache disables reusing build results within the context. Long lived contexts set it,
+	// as sources can change between builds. Tool binaries are still cached.
+	NoResultCache bool
+
+	// InstallMissingEnv installs the environment components required by units when they are
+	// missing, instead of failing. Meant for CI machines.
+	InstallMissingEnv bool
+
+	// Credentials provides the credentials units ask for. Defaults to credentials.Default().
+	Credentials credentials.Provider
+
+	// P4 is used to query the changelogs of publish units. Defaults to p4lib.New().
+	P4 p4lib.P4
+
+	// BazelTargets, if set, are built instead of the target of Bazel build units, eg. to only
+	// build the targets affected by a change. Such builds have no artifacts and aren't cached.
+	BazelTargets []string
+
+	// BazelRetries is how many times a Bazel command is retried after a transient failure, eg. a
+	// Bazel server crash, restarting the Bazel server in between. Defaults to DefaultBazelRetries.
+	BazelRetries int
+
+	// Report, if set, records the units run and the metrics of the Bazel commands they ran.
+	Report *Report
+
+	// FailedTests, if set, records the targets that failed in Bazel test units.
+	FailedTests *FailedTests
+
+	// RerunFailed restricts Bazel test units to the targets recorded as failed in FailedTests at
+	// the same CL, like bazel's --test_filter. Units without recorded failures run all targets.
+	RerunFailed bool
+
+	// Signer, if set, signs the artifacts of the build units built, see SignArtifacts. The signed
+	// artifacts are also saved to SignaturesPath for `sgeb verify`.
+	Signer Signer
+
+	// Verifier, if set, verifies the artifacts of the build units of publish units against the
+	// signatures saved by an earlier signed build before running the publish tool, failing the
+	// publish if any doesn't verify. It can't be set with Signer, which would sign the artifacts
+	// being verified.
+	Verifier Verifier
+
+	// Context, if set, cancels the builds and tests run with the options: once it's done, the
+	// tools and Bazel commands they run are killed and no further units are started.
+	Context gocontext.Context
+
+	// traceFile, if set, is where the file accesses of the tool of the build unit being built are
+	// recorded. Its deps aren't traced. See SuggestDeps.
+	traceFile string
+
+	// sandboxDir, if set, is where the sandbox the tool of the build unit being built runs in is
+	// materialized, see sandbox. Its deps run in the workspace.
+	sandboxDir string
+}
+
+// ctx returns the context the commands run with the options are killed with.
+func (o *Options) ctx() gocontext.Context {
+	if o.Context == nil {
+		return gocontext.Background()
+	}
+	return o.Context
 }
 
 // PublishOption is a function that modifies either Options or the PublishOptions structure.
@@ -191,6 +303,11 @@ type PublishOptions struct {
 
 	// CiResultUrl is a URL pointing to the CI run result URL.
 	CiResultUrl string
+
+	// SinceCl is the base CL the publish unit was last published at. When set, the changes to the
+	// inputs of the unit after it are passed to the publish tool and recorded in the results, see
+	// buildpb.Changelog.
+	SinceCl int64
 }
 
 func (c *context) Build(buLabel monorepo.Label, opts ...Option) (*buildpb.BuildResult, error) {
@@ -199,15 +316,54 @@ func (c *context) Build(buLabel monorepo.Label, opts ...Option) (*buildpb.BuildR
 }
 
 func (c *context) buildWithCache(buLabel monorepo.Label, options Options) (*buildpb.BuildResult, error) {
-	if buildResult, ok := c.buildCache[buLabel]; ok {
+	if len(options.BazelTargets) > 0 {
+		return c.reportedBuild(buLabel, options)
+	}
+	if buildResult, ok := c.buildCache[buLabel]; ok && !options.NoResultCache {
+		options.Report.cached(buLabel, "build", buildResult.OverallResult.Success)
 		return buildResult, maybeFailError(buildResult.OverallResult.Success, buLabel)
 	}
+	buildResult, err := c.reportedBuild(buLabel, options)
+	if err == nil && options.Signer != nil {
+		if err := signBuildResult(buLabel, buildResult, options); err != nil {
+			return nil, err
+		}
+	}
+	// Builds that didn't run to completion, eg. killed ones, have nothing to reuse.
+	if buildResult != nil && options.ctx().Err() == nil {
+		c.buildCache[buLabel] = buildResult
+	}
+	return buildResult, err
+}
+
+// signBuildResult signs the artifacts of |result| with the signer of |options| and saves them.
+func signBuildResult(buLabel monorepo.Label, result *buildpb.BuildResult, options Options) error {
+	if result.BuildResult == nil || result.BuildResult.ArtifactSet == nil {
+		return nil
+	}
+	as := result.BuildResult.ArtifactSet
+	if err := SignArtifacts(options.Signer, as); err != nil {
+		return WithExitCode(fmt.Errorf("build unit %s: %v", buLabel, err), ExitInfra)
+	}
+	p := SignaturesPath(options.OutputDir, buLabel)
+	if err := SaveSignatures(p, as); err != nil {
+		return WithExitCode(fmt.Errorf("could not save the signatures of %s: %v", buLabel, err), ExitInfra)
+	}
+	return nil
+}
+
+// reportedBuild builds |buLabel| and records it in the report of |options|.
+func (c *context) reportedBuild(buLabel monorepo.Label, options Options) (*buildpb.BuildResult, error) {
+	u := options.Report.begin(buLabel, "build")
 	buildResult, err := c.build(buLabel, options)
-	c.buildCache[buLabel] = buildResult
+	options.Report.end(u, err == nil, buildResultBytes(buildResult))
 	return buildResult, err
 }
 
 func (c *context) build(buLabel monorepo.Label, options Options) (*buildpb.BuildResult, error) {
+	if err := options.ctx().Err(); err != nil {
+		return nil, err
+	}
 	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(buLabel)
 	if err != nil {
 		return nil, err
@@ -220,19 +376,57 @@ func (c *context) build(buLabel monorepo.Label, options Options) (*buildpb.Build
 	if !ok {
 		return nil, fmt.Errorf("cannot find build unit %q in pkg //%s", buLabel.Target, buLabel.Pkg)
 	}
+	warnDeprecated(options.Logs, buLabel, bu)
+	if err := checkRequiredEnv(options.Logs, buLabel, bu, options.InstallMissingEnv); err != nil {
+		return nil, err
+	}
+	if len(bu.Files) > 0 {
+		return c.buildFiles(buLabel, pkgDir, bu)
+	}
 	if bu.Target != "" {
 		// Bazel build unit.
 		target, err := c.Monorepo.NewLabel(pkgDir, bu.Target)
 		if err != nil {
 			return nil, err
 		}
+		filter, err := newArtifactFilter(bu.ArtifactFilter)
+		if err != nil {
+			return nil, fmt.Errorf("build unit %s: %v", buLabel, err)
+		}
 		targets := []monorepo.TargetExpression{target.TargetExpression()}
+		if len(options.BazelTargets) > 0 {
+			targets = nil
+			for _, t := range options.BazelTargets {
+				targets = append(targets, monorepo.TargetExpression(t))
+			}
+		}
+		args := bu.Args
+		if len(bu.OutputGroup) > 0 {
+			args = append(append([]string{}, bu.Args...), "--output_groups="+strings.Join(bu.OutputGroup, ","))
+		}
 		var logs bytes.Buffer
-		bepStream, err := c.runBazelCmd("build", targets, bu.Args, &logs, options)
+		bepStream, retries, err := c.runBazelCmd("build", targets, args, &logs, options)
 		success := err == nil
 		var result *buildpb.BuildInvocationResult
-		if bepStream != nil {
-			result, _ = buildInvocationResult(bepStream, target.String())
+		if bepStream != nil && len(options.BazelTargets) > 0 {
+			// The unit target wasn't built, there are no artifacts to report.
+			result = &buildpb.BuildInvocationResult{
+				Result: &buildpb.Result{
+					Name:    buLabel.String(),
+					Success: success,
+					Logs:    maybeErrorLogs(success, &logs),
+				},
+				ArtifactSet: &buildpb.ArtifactSet{},
+			}
+		} else if bepStream != nil {
+			result, _ = buildInvocationResult(bepStream, target.String(), bu.OutputGroup)
+			if result != nil {
+				as, err := collectArtifacts(result.ArtifactSet, bu.Links)
+				if err != nil {
+					return nil, fmt.Errorf("build unit %s: could not collect artifacts: %v", buLabel, err)
+				}
+				result.ArtifactSet = filter.apply(as)
+			}
 		} else {
 			// Cannot get BEP results, meaning the build completely failed. Synthesize a failed build result
 			// with the complete logs.
@@ -254,10 +448,13 @@ func (c *context) build(buLabel monorepo.Label, options Options) (*buildpb.Build
 				Name:    buLabel.String(),
 				Success: success,
 				Logs:    maybeErrorLogs(success, &logs),
+				Retries: retries,
 			},
 			BuildResult: result,
 		}, maybeFailError(success, buLabel)
 	} else {
+		traceFile, sandboxDir := options.traceFile, options.sandboxDir
+		options.traceFile, options.sandboxDir = "", ""
 		bin, binBuildResult, err := c.resolveBin(pkgDir, bu.Bin, options)
 		if err != nil && binBuildResult != nil {
 			return inheritBuildFailure(buLabel, binBuildResult)
@@ -270,6 +467,14 @@ func (c *context) build(buLabel monorepo.Label, options Options) (*buildpb.Build
 		} else if err != nil {
 			return nil, err
 		}
+		dir := c.Monorepo.Root
+		if sandboxDir != "" {
+			sb := &sandbox{mr: c.Monorepo, root: sandboxDir}
+			if inputs, err = sb.materialize(pkgDir, inputs); err != nil {
+				return nil, fmt.Errorf("build unit %s: could not create sandbox: %v", buLabel, err)
+			}
+			dir = sandboxDir
+		}
 		outputStablePath, err := c.outputStablePath("out", buLabel)
 		if err != nil {
 			return nil, err
@@ -300,14 +505,24 @@ func (c *context) build(buLabel monorepo.Label, options Options) (*buildpb.Build
 		args := []string{ih.InvocationArg(), ih.InvocationResultArg()}
 		args = append(args, bu.Args...)
 		args = AddGlogFlags(buLabel.Target, options.LogLevel, args)
+		env, err := toolEnv(&options, bu.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("build unit %s: %v", buLabel, err)
+		}
 		var logs bytes.Buffer
-		cmd := exec.Command(bin, args...)
+		cmd := exec.CommandContext(options.ctx(), bin, args...)
 		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		cmd.Dir = c.Monorepo.Root
+		cmd.Dir = dir
+		cmd.Env = env
 		writer := io.MultiWriter(&logs, options.Logs)
 		cmd.Stdout = writer
 		cmd.Stderr = writer
-		buildErr := cmd.Run()
+		var buildErr error
+		if traceFile != "" {
+			buildErr = tracer.run(cmd, traceFile)
+		} else {
+			buildErr = cmd.Run()
+		}
 		// For a failed build/test (non-zero exit code), improve the error message printed.
 		if _, ok := err.(*exec.ExitError); ok {
 			err = fmt.Errorf("%s failed", path.Base(bin))
@@ -406,6 +621,9 @@ func (c *context) expandTestSuite(l monorepo.Label, seen map[monorepo.Label]bool
 		if err != nil {
 			return nil, err
 		}
+		if err := c.checkVisibility(pkgDir, tuLabel, c.options); err != nil {
+			return nil, err
+		}
 		// The referenced test unit might itself be a test suite.
 		expandedTestUnits, err := c.expandTestSuite(tuLabel, seen)
 		if err != nil {
@@ -476,6 +694,16 @@ func (c *context) findAllTests(dir monorepo.Path, seen map[monorepo.Label]bool)
 }
 func (c *context) Test(tuLabel monorepo.Label, opts ...Option) (*buildpb.TestResult, error) {
 	options := c.cmdOpts(opts...)
+	u := options.Report.begin(tuLabel, "test")
+	result, err := c.test(tuLabel, options)
+	options.Report.end(u, err == nil, 0)
+	return result, err
+}
+
+func (c *context) test(tuLabel monorepo.Label, options Options) (*buildpb.TestResult, error) {
+	if err := options.ctx().Err(); err != nil {
+		return nil, err
+	}
 	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(tuLabel)
 	if err != nil {
 		return nil, err
@@ -491,10 +719,38 @@ func (c *context) Test(tuLabel monorepo.Label, opts ...Option) (*buildpb.TestRes
 	if !ok {
 		return nil, fmt.Errorf("cannot find test unit %q in pkg //%s", tuLabel.Target, tuLabel.Pkg)
 	}
+	warnDeprecated(options.Logs, tuLabel, tu)
+	if err := checkRequiredEnv(options.Logs, tuLabel, tu, options.InstallMissingEnv); err != nil {
+		return nil, err
+	}
+	serviceLabels, err := c.dependentServices(pkgDir, tu.Services, options)
+	if err != nil {
+		return nil, err
+	}
+	services, err := c.startServices(serviceLabels, options)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := services.Stop(); err != nil {
+			log.Warning(err)
+		}
+	}()
 	if len(tu.Target) > 0 {
 		// Bazel test unit.
+		targetNames := tu.Target
+		if options.RerunFailed && options.FailedTests != nil {
+			failed, err := options.FailedTests.Load(tuLabel)
+			if err != nil {
+				return nil, err
+			}
+			if len(failed) > 0 {
+				fmt.Fprintf(options.Logs, "Rerunning %d failed target(s) of %s\n", len(failed), tuLabel)
+				targetNames = failed
+			}
+		}
 		var targets []monorepo.TargetExpression
-		for _, t := range tu.Target {
+		for _, t := range targetNames {
 			te, err := c.Monorepo.NewTargetExpression(pkgDir, t)
 			if err != nil {
 				return nil, err
@@ -506,8 +762,11 @@ func (c *context) Test(tuLabel monorepo.Label, opts ...Option) (*buildpb.TestRes
 			"--build_tests_only",
 			"--keep_going",
 		}
+		for _, env := range services.Env() {
+			args = append(args, "--test_env="+env)
+		}
 		args = append(args, tu.Args...)
-		bepStream, err := c.runBazelCmd("test", targets, args, &logs, options)
+		bepStream, retries, err := c.runBazelCmd("test", targets, args, &logs, options)
 		success := err == nil
 		if err != nil && !IsFailed(err) {
 			return nil, err
@@ -516,11 +775,18 @@ func (c *context) Test(tuLabel monorepo.Label, opts ...Option) (*buildpb.TestRes
 		if err != nil {
 			return nil, err
 		}
+		// A failure without failed targets, eg. a broken build, keeps the previous record.
+		if failed := failedTestTargets(result); options.FailedTests != nil && (success || len(failed) > 0) {
+			if err := options.FailedTests.Record(tuLabel, failed); err != nil {
+				log.Warningf("could not record the failed tests of %s: %v", tuLabel, err)
+			}
+		}
 		return &buildpb.TestResult{
 			OverallResult: &buildpb.Result{
 				Name:    tuLabel.String(),
 				Success: success,
 				Logs:    maybeErrorLogs(success, &logs),
+				Retries: retries,
 			},
 			TestResult: result,
 		}, maybeFailError(success, tuLabel)
@@ -541,7 +807,7 @@ func (c *context) Test(tuLabel monorepo.Label, opts ...Option) (*buildpb.TestRes
 	ih, err := newInvocationHelper(&buildpb.ToolInvocation{
 		BuildUnitDir:   string(pkgDir),
 		Inputs:         inputs,
-		TestInvocation: &buildpb.TestInvocation{},
+		TestInvocation: &buildpb.TestInvocation{Services: services.Running()},
 		LogLabels:      logLabelsFromOptions(&options),
 	})
 	if err != nil {
@@ -551,9 +817,12 @@ func (c *context) Test(tuLabel monorepo.Label, opts ...Option) (*buildpb.TestRes
 	args := []string{ih.InvocationArg(), ih.InvocationResultArg()}
 	args = append(args, tu.Args...)
 	args = AddGlogFlags(tuLabel.Target, options.LogLevel, args)
-	cmd := exec.Command(bin, args...)
+	cmd := exec.CommandContext(options.ctx(), bin, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	cmd.Dir = c.Monorepo.Root
+	if env := services.Env(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	logs := &bytes.Buffer{}
 	writer := io.MultiWriter(logs, options.Logs)
 	cmd.Stdout = writer
@@ -595,6 +864,9 @@ func (c *context) testBuildTestUnit(label monorepo.Label, btu *sgebpb.BuildTestU
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkVisibility(relTo, buLabel, options); err != nil {
+		return nil, err
+	}
 	buildRes, err := c.buildWithCache(buLabel, options)
 	if err != nil {
 		fmt.Println(err)
@@ -613,7 +885,10 @@ func (c *context) testBuildTestUnit(label monorepo.Label, btu *sgebpb.BuildTestU
 
 func (c *context) Publish(puLabel monorepo.Label, args []string, opts ...PublishOption) ([]*buildpb.PublishResult, error) {
 	invocationTime := time.Now()
-	return c.publish(puLabel, invocationTime, args, opts...)
+	u := c.options.Report.begin(puLabel, "publish")
+	results, err := c.publish(puLabel, invocationTime, args, opts...)
+	c.options.Report.end(u, err == nil, publishResultBytes(results))
+	return results, err
 }
 
 func (c *context) publish(puLabel monorepo.Label, invocationTime time.Time, args []string, opts ...PublishOption) ([]*buildpb.PublishResult, error) {
@@ -629,6 +904,14 @@ func (c *context) publish(puLabel monorepo.Label, invocationTime time.Time, args
 	if !ok {
 		return nil, fmt.Errorf("cannot find publish unit %q in pkg //%s", puLabel.Target, puLabel.Pkg)
 	}
+	options := c.options
+	for _, opt := range opts {
+		opt(&options, &PublishOptions{})
+	}
+	warnDeprecated(options.Logs, puLabel, pu)
+	if err := checkRequiredEnv(options.Logs, puLabel, pu, options.InstallMissingEnv); err != nil {
+		return nil, err
+	}
 	// Regular publish unit or one with dependencies?
 	if pu.Bin != "" {
 		return c.publishSingle(pu, puLabel, pkgDir, invocationTime, args, opts...)
@@ -646,6 +929,9 @@ func (c *context) publishSingle(pu *sgebpb.PublishUnit, puLabel monorepo.Label,
 	for _, opt := range opts {
 		opt(&options, &publishOptions)
 	}
+	if options.Verifier != nil && options.Signer != nil {
+		return nil, UsageErrorf("can't both sign and verify the artifacts of publish unit %s", puLabel)
+	}
 	bin, binResult, err := c.resolveBin(pkgDir, pu.Bin, options)
 	if err != nil {
 		if binResult != nil {
@@ -659,6 +945,9 @@ func (c *context) publishSingle(pu *sgebpb.PublishUnit, puLabel monorepo.Label,
 		if err != nil {
 			return nil, err
 		}
+		if err := c.checkVisibility(pkgDir, buLabel, options); err != nil {
+			return nil, err
+		}
 		buildResult, err := c.Build(buLabel)
 		if err != nil {
 			if buildResult != nil {
@@ -666,12 +955,27 @@ func (c *context) publishSingle(pu *sgebpb.PublishUnit, puLabel monorepo.Label,
 			}
 			return nil, err
 		}
+		if options.Verifier != nil {
+			p := SignaturesPath(options.OutputDir, buLabel)
+			if err := VerifySavedSignatures(options.Verifier, buildResult.BuildResult.ArtifactSet, p); err != nil {
+				code := ExitInfra
+				if errors.Is(err, ErrBadSignature) {
+					code = ExitFailed
+				}
+				return nil, WithExitCode(fmt.Errorf("publish unit %s: artifacts of %s: %w", puLabel, buLabel, err), code)
+			}
+		}
 		artifactSet = append(artifactSet, buildResult.BuildResult.ArtifactSet)
 	}
 	logsDir, err := c.makeDir(options.LogsDir, "logs", puLabel)
 	if err != nil {
 		return nil, err
 	}
+	// The changelog is informative, failing to compute or post it doesn't fail the publish.
+	changelog, err := c.changelog(puLabel, pu, options, publishOptions)
+	if err != nil {
+		fmt.Fprintf(options.Logs, "WARNING: no changelog for %s: %v\n", puLabel, err)
+	}
 	ih, err := newInvocationHelper(&buildpb.ToolInvocation{
 		BuildUnitDir: string(pkgDir),
 		Inputs:       artifactSet,
@@ -683,6 +987,7 @@ func (c *context) publishSingle(pu *sgebpb.PublishUnit, puLabel monorepo.Label,
 			InvocationTime: &timestamp.Timestamp{
 				Seconds: invocationTime.Unix(),
 			},
+			Changelog: changelog,
 		},
 	})
 	if err != nil {
@@ -693,8 +998,13 @@ func (c *context) publishSingle(pu *sgebpb.PublishUnit, puLabel monorepo.Label,
 	cmdArgs = append(cmdArgs, pu.Args...)
 	cmdArgs = append(cmdArgs, args...)
 	cmdArgs = AddGlogFlags(puLabel.Target, options.LogLevel, cmdArgs)
+	env, err := toolEnv(&options, pu.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("publish unit %s: %v", puLabel, err)
+	}
 	cmd := exec.Command(bin, cmdArgs...)
 	cmd.Dir = c.Monorepo.Root
+	cmd.Env = env
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	cmd.Stdout = options.Logs
 	cmd.Stderr = options.Logs
@@ -706,6 +1016,16 @@ func (c *context) publishSingle(pu *sgebpb.PublishUnit, puLabel monorepo.Label,
 	if err != nil {
 		return nil, err
 	}
+	for _, r := range result.PublishResults {
+		if r.Changelog == nil {
+			r.Changelog = changelog
+		}
+	}
+	if len(result.PublishResults) > 0 {
+		if err := postChangelog(pu, puLabel, changelog, options); err != nil {
+			fmt.Fprintf(options.Logs, "WARNING: could not post the changelog of %s: %v\n", puLabel, err)
+		}
+	}
 	return result.PublishResults, nil
 }
 
@@ -716,6 +1036,9 @@ func (c *context) publishDeps(pu *sgebpb.PublishUnit, pkgDir monorepo.Path, invo
 		if err != nil {
 			return nil, err
 		}
+		if err := c.checkVisibility(pkgDir, dpuLabel, c.options); err != nil {
+			return nil, err
+		}
 		publishResults, err := c.publish(dpuLabel, invocationTime, args, opts...)
 		if err != nil {
 			return nil, err
@@ -734,6 +1057,35 @@ func (c *context) BazelArgs(label monorepo.Label) ([]string, error) {
 	return append([]string(nil), args...), nil
 }
 
+func (c *context) BazelQuery(expr string, opts ...Option) ([]string, error) {
+	options := c.cmdOpts(opts...)
+	bazelwsp, err := c.Monorepo.NewPath("", "//bin/windows/bazel.exe")
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	args = append(args, options.BazelStartupArgs...)
+	args = append(args, "query", "--output=label")
+	args = append(args, options.BazelQueryArgs...)
+	args = append(args, expr)
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.Monorepo.ResolvePath(bazelwsp), args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = c.Monorepo.Root
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("bazel query %q failed: %v: %s", expr, err, stderr.String())
+	}
+	var labels []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels, nil
+}
+
 func (c *context) bazelArgs(label monorepo.Label) ([]string, error) {
 	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(label)
 	if err != nil {
@@ -863,8 +1215,22 @@ func (ih *invocationHelper) Cleanup() {
 	os.RemoveAll(ih.dir)
 }
 
+// toolEnv returns the environment of a tool process that needs the credentials |names|, or nil for
+// the environment of sgeb if it needs none.
+func toolEnv(options *Options, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	env, err := credentials.Inject(options.Credentials, names)
+	if err != nil {
+		return nil, err
+	}
+	return append(os.Environ(), env...), nil
+}
+
 func (c *context) buildToolBinaryWithCache(binTarget monorepo.Label, options Options) (string, *buildpb.BuildResult, error) {
 	if p, ok := c.toolCache[binTarget]; ok {
+		options.Report.cached(binTarget, "build", true)
 		return p, nil, nil
 	}
 	p, br, err := c.buildToolBinary(binTarget, options)
@@ -885,6 +1251,13 @@ func (c *context) buildToolBinaryWithCache(binTarget monorepo.Label, options Opt
 	if err := copyBin(p, bin); err != nil {
 		return "", nil, fmt.Errorf("could not copy bin from %s to %s: %v", p, bin, err)
 	}
+	// Tools like py_binary need their runfiles tree next to them. Stage it with its links, rather
+	// than copying the whole tree they point to.
+	if runfiles := p + ".runfiles"; isDir(runfiles) {
+		if err := files.Stage(runfiles, bin+".runfiles"); err != nil {
+			return "", nil, fmt.Errorf("could not stage runfiles of %s: %v", p, err)
+		}
+	}
 	c.toolCache[binTarget] = bin
 	return bin, nil, nil
 }
@@ -910,6 +1283,13 @@ func (c *context) buildToolBinary(binTarget monorepo.Label, options Options) (st
 			continue
 		}
 		p := a.Uri[len("file:///"):]
+		// Bazel may output the tool as a link, and runfiles trees next to it.
+		if resolved, err := resolveLink(p); err == nil {
+			p = resolved
+		}
+		if isDir(p) {
+			continue
+		}
 		if ok, err := files.IsExecutable(p); err != nil {
 			return "", nil, fmt.Errorf("failed to get executable status of %s: %v", p, err)
 		} else if !ok {
@@ -923,11 +1303,37 @@ func (c *context) buildToolBinary(binTarget monorepo.Label, options Options) (st
 	return execs[0], nil, nil
 }
 
-// runBazelCmd executes a bazel command and parses the BEP stream for a build result.
-func (c *context) runBazelCmd(cmdName string, targets []monorepo.TargetExpression, args []string, logs io.Writer, options Options) (*bep.Stream, error) {
+// runBazelCmd executes a bazel command and parses the BEP stream for a build result. Transient
+// failures, eg. Bazel server crashes, are retried up to options.BazelRetries times, and returned.
+func (c *context) runBazelCmd(cmdName string, targets []monorepo.TargetExpression, args []string, logs io.Writer, options Options) (*bep.Stream, []*buildpb.Retry, error) {
+	var retries []*buildpb.Retry
+	for {
+		var attempt bytes.Buffer
+		bepStream, exitCode, err := c.runBazelOnce(cmdName, targets, args, io.MultiWriter(logs, &attempt), options)
+		// A killed command isn't a transient failure.
+		if err == nil || len(retries) >= options.BazelRetries || options.ctx().Err() != nil {
+			return bepStream, retries, err
+		}
+		reason := transientBazelFailure(exitCode, attempt.String())
+		if reason == "" {
+			return bepStream, retries, err
+		}
+		retries = append(retries, &buildpb.Retry{Reason: reason, ExitCode: int32(exitCode)})
+		msg := fmt.Sprintf("%s, restarting the Bazel server and retrying (%d/%d)", reason, len(retries), options.BazelRetries)
+		log.Warning(msg)
+		fmt.Fprintf(logs, "sgeb: %s\n", msg)
+		if err := c.shutdownBazel(options); err != nil {
+			log.Warningf("could not shut down the Bazel server: %v", err)
+		}
+	}
+}
+
+// runBazelOnce executes a bazel command and parses the BEP stream for a build result. Returns the
+// exit code of Bazel, -1 if it couldn't run.
+func (c *context) runBazelOnce(cmdName string, targets []monorepo.TargetExpression, args []string, logs io.Writer, options Options) (*bep.Stream, int, error) {
 	bazelwsp, err := c.Monorepo.NewPath("", "//bin/windows/bazel.exe")
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	bazel := c.Monorepo.ResolvePath(bazelwsp)
 	var cmdArgs []string
@@ -937,7 +1343,7 @@ func (c *context) runBazelCmd(cmdName string, targets []monorepo.TargetExpressio
 	cmdArgs = append(cmdArgs, args...)
 	bepDir, err := ioutil.TempDir("", "bep")
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	defer os.RemoveAll(bepDir)
 	bepFile := path.Join(bepDir, "bep")
@@ -945,7 +1351,7 @@ func (c *context) runBazelCmd(cmdName string, targets []monorepo.TargetExpressio
 	for _, t := range targets {
 		cmdArgs = append(cmdArgs, string(t))
 	}
-	cmd := exec.Command(bazel, cmdArgs...)
+	cmd := exec.CommandContext(options.ctx(), bazel, cmdArgs...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	cmd.Dir = c.Monorepo.Root
 
@@ -954,11 +1360,11 @@ func (c *context) runBazelCmd(cmdName string, targets []monorepo.TargetExpressio
 	glogFlagName := "stderrthreshold"
 	f := flag.Lookup(glogFlagName)
 	if f == nil {
-		return nil, fmt.Errorf("could not look up glog flag %q", glogFlagName)
+		return nil, -1, fmt.Errorf("could not look up glog flag %q", glogFlagName)
 	}
 	oldVal := f.Value.String()
 	if err := flag.Set(glogFlagName, options.LogLevel); err != nil {
-		return nil, fmt.Errorf("could not set glog flag %q: %v", glogFlagName, err)
+		return nil, -1, fmt.Errorf("could not set glog flag %q: %v", glogFlagName, err)
 	}
 	defer flag.Set(glogFlagName, oldVal)
 	logger := log.New()
@@ -969,28 +1375,41 @@ func (c *context) runBazelCmd(cmdName string, targets []monorepo.TargetExpressio
 		var err error
 		cl, err = cloudlog.New("sgeb", cloudlog.WithLabels(options.LogLabels))
 		if err != nil {
-			return nil, fmt.Errorf("could not obtain a cloud logger: %v", err)
+			return nil, -1, fmt.Errorf("could not obtain a cloud logger: %v", err)
 		}
 		logger.AddSink(cl)
 	}
 	cmd.Stderr = io.MultiWriter(logs, log.NewInfoLogger(logger))
 
 	buildErr := cmd.Run()
+	exitCode := 0
 	if exitErr, ok := buildErr.(*exec.ExitError); ok {
-		switch exitErr.ExitCode() {
+		exitCode = exitErr.ExitCode()
+		// See https://docs.bazel.build/versions/master/guide.html#what-exit-code-will-i-get
+		switch exitCode {
 		case 1, 3, 4:
-			// build/test failed exit code. See:
-			// https://docs.bazel.build/versions/master/guide.html#what-exit-code-will-i-get
+			// build/test failed exit code.
 			buildErr = &failed{}
+		case 2:
+			// Command line problem, bad or illegal flags or command combination.
+			return nil, exitCode, WithExitCode(buildErr, ExitUsage)
+		case 8:
+			// Build interrupted.
+			return nil, exitCode, WithExitCode(buildErr, ExitCancelled)
 		default:
-			return nil, buildErr
+			return nil, exitCode, WithExitCode(buildErr, ExitInfra)
 		}
+	} else if buildErr != nil {
+		return nil, -1, buildErr
 	}
 	bepStream, err := readBepStream(bepFile)
 	if err != nil && buildErr == nil {
-		return nil, err
+		return nil, exitCode, err
 	}
-	return bepStream, buildErr
+	if bepStream != nil {
+		options.Report.addBazel(bazelMetrics(bepStream))
+	}
+	return bepStream, exitCode, buildErr
 }
 
 func readBepStream(p string) (*bep.Stream, error) {
@@ -1026,6 +1445,9 @@ func (c *context) resolveBin(relTo monorepo.Path, bin string, options Options) (
 		if err != nil {
 			return "", nil, err
 		}
+		if err := c.checkVisibility(relTo, binTarget, options); err != nil {
+			return "", nil, err
+		}
 		// Build unit whose tool is another build unit.
 		binAbsPath, buildResult, err = c.buildToolBinaryWithCache(binTarget, options)
 		if err != nil {
@@ -1045,6 +1467,9 @@ func (c *context) buildDeps(relTo monorepo.Path, deps []string, options Options)
 		if err != nil {
 			return nil, nil, err
 		}
+		if err := c.checkVisibility(relTo, dl, options); err != nil {
+			return nil, nil, err
+		}
 		br, err := c.buildWithCache(dl, options)
 		if err != nil {
 			return nil, br, err
@@ -1213,6 +1638,8 @@ type validationUnit struct {
 	hasBin     bool
 	hasEnvVars bool
 	hasDeps    bool
+	hasArgs    bool
+	hasFiles   bool
 }
 
 func validateBuildUnits(bu *sgebpb.BuildUnits) error {
@@ -1226,6 +1653,8 @@ func validateBuildUnits(bu *sgebpb.BuildUnits) error {
 			hasBin:     bu.Bin != "",
 			hasEnvVars: len(bu.EnvVars) > 0,
 			hasDeps:    len(bu.Deps) > 0,
+			hasArgs:    len(bu.Args) > 0,
+			hasFiles:   len(bu.Files) > 0,
 		})
 	}
 	for _, tu := range bu.TestUnit {
@@ -1241,6 +1670,28 @@ func validateBuildUnits(bu *sgebpb.BuildUnits) error {
 	for _, ts := range bu.TestSuite {
 		names = append(names, ts.Name)
 	}
+	for _, gu := range bu.GenUnit {
+		names = append(names, gu.Name)
+		if gu.Bin == "" || len(gu.Output) == 0 {
+			return fmt.Errorf("gen unit %q must have a bin and outputs", gu.Name)
+		}
+	}
+	for _, su := range bu.ServiceUnit {
+		names = append(names, su.Name)
+		if su.Bin == "" {
+			return fmt.Errorf("service unit %q must have a bin", su.Name)
+		}
+		ports := map[string]bool{}
+		for _, port := range su.Port {
+			if port == "" || ports[port] {
+				return fmt.Errorf("service unit %q has an empty or duplicate port %q", su.Name, port)
+			}
+			ports[port] = true
+		}
+		if hc := su.HealthCheck; hc != nil && hc.Port != "" && !ports[hc.Port] {
+			return fmt.Errorf("service unit %q health checks unknown port %q", su.Name, hc.Port)
+		}
+	}
 	for _, pu := range bu.PublishUnit {
 		names = append(names, pu.Name)
 		hasBuildUnits := pu.Bin != "" && len(pu.BuildUnit) > 0
@@ -1264,8 +1715,20 @@ func validateBuildUnits(bu *sgebpb.BuildUnits) error {
 		}
 		seen[name] = true
 	}
+	// Data-only build units must have files only.
+	for _, u := range units {
+		if !u.hasFiles {
+			continue
+		}
+		if u.hasTarget || u.hasBin || u.hasArgs || u.hasEnvVars || u.hasDeps {
+			return fmt.Errorf("data-only build unit %q must not have target, bin, args, env vars or deps", u.name)
+		}
+	}
 	// Must have one of target and bin, but not both
 	for _, u := range units {
+		if u.hasFiles {
+			continue
+		}
 		if u.hasTarget && u.hasBin {
 			return fmt.Errorf("build/test unit %q must not have both target and bin", u.name)
 		}
@@ -1329,6 +1792,7 @@ func copyBin(sp, dp string) error {
 // PrintBuildResult prints the overall result for a Build execution.
 // If there are <= maxResults artifacts or maxResults == -1 we print the produced artifacts.
 func PrintBuildResult(logs io.Writer, l monorepo.Label, result *buildpb.BuildResult, maxResults int) {
+	printRetries(l, result.OverallResult)
 	if result.OverallResult.Success {
 		artifacts := result.BuildResult.GetArtifactSet().GetArtifacts()
 		if len(artifacts) > 0 {
@@ -1358,6 +1822,13 @@ func PrintBuildResult(logs io.Writer, l monorepo.Label, result *buildpb.BuildRes
 	PrintFailedBuildResult(logs, result)
 }
 
+// printRetries prints the transient failures retried to get |result|, if any.
+func printRetries(l monorepo.Label, result *buildpb.Result) {
+	for _, r := range result.GetRetries() {
+		fmt.Printf("%s retried after a transient failure: %s (exit code %d)\n", l, r.Reason, r.ExitCode)
+	}
+}
+
 func printArtifacts(artifacts []*buildpb.Artifact) string {
 	var result bytes.Buffer
 	for _, output := range artifacts {
@@ -1386,6 +1857,7 @@ func PrintFailedBuildResult(logs io.Writer, result *buildpb.BuildResult) {
 
 // PrintTestResult prints the overall result for a Test execution.
 func PrintTestResult(logs io.Writer, l monorepo.Label, result *buildpb.TestResult) {
+	printRetries(l, result.OverallResult)
 	if result.OverallResult.Success {
 		fmt.Printf("%s PASSED\n", l)
 		return
@@ -1522,11 +1994,34 @@ type UnitFile struct {
 
 // DiscoverBuildUnitFiles recursively searches the monorepo for any BUILDUNIT files
 func DiscoverBuildUnitFiles(mr monorepo.Monorepo, bc Context) ([]UnitFile, error) {
+	dirs, err := FindBuildUnitDirs(mr)
+	if err != nil {
+		return nil, err
+	}
 	var ret []UnitFile
+	for _, dir := range dirs {
+		bus, err := bc.LoadBuildUnits(dir)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, UnitFile{bus, dir})
+	}
+	return ret, nil
+}
+
+// FindBuildUnitDirs returns the directories of the monorepo that have a BUILDUNIT file, skipping
+// the output trees, see IsOutputTree.
+func FindBuildUnitDirs(mr monorepo.Monorepo) ([]monorepo.Path, error) {
+	var ret []monorepo.Path
 	if err := filepath.Walk(mr.Root, func(p string, info os.FileInfo, err error) error {
 		// TODO: Ignore dirs?
 		// Experiments show that it this function takes ~8 seconds without ignoring directories,
 		// and ~.5 seconds if third_party is excluded.
+		if err == nil && info.IsDir() && p != mr.Root {
+			if dir, err := mr.RelPath(p); err == nil && IsOutputTree(dir) {
+				return filepath.SkipDir
+			}
+		}
 		if filepath.Base(p) != "BUILDUNIT" {
 			return nil
 		}
@@ -1534,11 +2029,7 @@ func DiscoverBuildUnitFiles(mr monorepo.Monorepo, bc Context) ([]UnitFile, error
 		if err != nil {
 			return err
 		}
-		bus, err := bc.LoadBuildUnits(dir)
-		if err != nil {
-			return err
-		}
-		ret = append(ret, UnitFile{bus, dir})
+		ret = append(ret, dir)
 		return nil
 	}); err != nil {
 		return nil, err
@@ -1546,6 +2037,13 @@ func DiscoverBuildUnitFiles(mr monorepo.Monorepo, bc Context) ([]UnitFile, error
 	return ret, nil
 }
 
+// IsOutputTree returns whether monorepo directory |dir| is in one of the trees build outputs go
+// to, which have no BUILDUNIT files of their own: sgeb-out and the bazel-* links.
+func IsOutputTree(dir monorepo.Path) bool {
+	top := strings.SplitN(string(dir), "/", 2)[0]
+	return top == "sgeb-out" || strings.HasPrefix(top, "bazel-")
+}
+
 func (c *context) RunCron(label monorepo.Label, args []string, opts ...Option) error {
 	options := c.cmdOpts(opts...)
 	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(label)
@@ -1560,6 +2058,10 @@ func (c *context) RunCron(label monorepo.Label, args []string, opts ...Option) e
 	if !ok {
 		return fmt.Errorf("cannot find cron unit %q in pkg //%s", label.Target, label.Pkg)
 	}
+	warnDeprecated(options.Logs, label, cu)
+	if err := checkRequiredEnv(options.Logs, label, cu, options.InstallMissingEnv); err != nil {
+		return err
+	}
 	bin, binResult, err := c.resolveBin(pkgDir, cu.Bin, options)
 	if err != nil {
 		if binResult != nil {
@@ -1600,6 +2102,10 @@ func (c *context) RunTask(label monorepo.Label, args []string, opts ...Option) e
 	if !ok {
 		return fmt.Errorf("cannot find task unit %q in pkg //%s", label.Target, label.Pkg)
 	}
+	warnDeprecated(options.Logs, label, tu)
+	if err := checkRequiredEnv(options.Logs, label, tu, options.InstallMissingEnv); err != nil {
+		return err
+	}
 	bin, binResult, err := c.resolveBin(pkgDir, tu.Bin, options)
 	if err != nil {
 		if binResult != nil {
@@ -15,6 +15,8 @@
 package build
 
 import (
+	gocontext "context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
@@ -247,6 +249,30 @@ func TestValidateBuildUnits(t *testing.T) {
 			},
 			wantErr: "deps",
 		},
+		{
+			desc: "data-only build unit",
+			input: &sgebpb.BuildUnits{
+				BuildUnit: []*sgebpb.BuildUnit{
+					{
+						Name:  "foo",
+						Files: []string{"**/*.json"},
+					},
+				},
+			},
+		},
+		{
+			desc: "data-only build unit must not have bin",
+			input: &sgebpb.BuildUnits{
+				BuildUnit: []*sgebpb.BuildUnit{
+					{
+						Name:  "foo",
+						Files: []string{"**/*.json"},
+						Bin:   "foo",
+					},
+				},
+			},
+			wantErr: "data-only",
+		},
 		{
 			desc: "can have just trigger_paths",
 			input: &sgebpb.BuildUnits{
@@ -279,6 +305,58 @@ func TestValidateBuildUnits(t *testing.T) {
 			},
 			wantErr: "trigger_paths and frequency",
 		},
+		{
+			desc: "valid service unit",
+			input: &sgebpb.BuildUnits{
+				ServiceUnit: []*sgebpb.ServiceUnit{
+					{
+						Name:        "server",
+						Bin:         "//tools/server",
+						Port:        []string{"grpc", "http"},
+						HealthCheck: &sgebpb.HealthCheck{Port: "http", HttpPath: "/healthz"},
+					},
+				},
+			},
+		},
+		{
+			desc: "service unit must have a bin",
+			input: &sgebpb.BuildUnits{
+				ServiceUnit: []*sgebpb.ServiceUnit{
+					{
+						Name: "server",
+						Port: []string{"http"},
+					},
+				},
+			},
+			wantErr: "must have a bin",
+		},
+		{
+			desc: "service unit with duplicate ports",
+			input: &sgebpb.BuildUnits{
+				ServiceUnit: []*sgebpb.ServiceUnit{
+					{
+						Name: "server",
+						Bin:  "//tools/server",
+						Port: []string{"http", "http"},
+					},
+				},
+			},
+			wantErr: "duplicate port",
+		},
+		{
+			desc: "service unit health checks unknown port",
+			input: &sgebpb.BuildUnits{
+				ServiceUnit: []*sgebpb.ServiceUnit{
+					{
+						Name:        "server",
+						Bin:         "//tools/server",
+						Port:        []string{"grpc"},
+						HealthCheck: &sgebpb.HealthCheck{Port: "http"},
+					},
+				},
+			},
+			wantErr: "unknown port",
+		},
 	}
 	for _, tc := range testCases {
 		err := validateBuildUnits(tc.input)
@@ -385,3 +463,44 @@ test_unit {
 		}
 	}
 }
+
+func TestBuildCanceled(t *testing.T) {
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, map[string]string{
+		"MONOREPO":       "",
+		"WORKSPACE":      "",
+		"data/BUILDUNIT": "build_unit {\n  name: \"configs\"\n  files: \"*.json\"\n}\n",
+		"data/a.json":    "{}",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewContext(mr, func(o *Options) {
+		o.Logs = ioutil.Discard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	l, err := mr.NewLabel("", "//data:configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	_, err = bc.Build(l, func(o *Options) {
+		o.Context = ctx
+	})
+	if !errors.Is(err, gocontext.Canceled) {
+		t.Fatalf("Build(canceled) = %v, want %v", err, gocontext.Canceled)
+	}
+	if got := ExitCode(err); got != ExitCancelled {
+		t.Errorf("ExitCode(%v) = %d, want %d", err, got, ExitCancelled)
+	}
+	if _, err := bc.Build(l); err != nil {
+		t.Errorf("Build() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+	"sge-monorepo/libs/go/credentials"
+	"sge-monorepo/libs/go/p4lib"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// DefaultChangelogMax is the default maximum number of changes listed in a changelog.
+const DefaultChangelogMax = 50
+
+// changelog returns the changes affecting the inputs of publish unit |pu| since
+// |publishOptions.SinceCl|, nil if that CL isn't known.
+func (c *context) changelog(puLabel monorepo.Label, pu *sgebpb.PublishUnit, options Options, publishOptions PublishOptions) (*buildpb.Changelog, error) {
+	since, base := publishOptions.SinceCl, publishOptions.BaseCl
+	if since <= 0 {
+		return nil, nil
+	}
+	ret := &buildpb.Changelog{FromCl: since, ToCl: base}
+	if base > 0 && base <= since {
+		return ret, nil
+	}
+	paths, err := c.changelogPaths(puLabel)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the inputs of %s: %v", puLabel, err)
+	}
+	to := "@now"
+	if base > 0 {
+		to = fmt.Sprintf("@%d", base)
+	}
+	args := []string{"-s", "submitted", "-l"}
+	for _, p := range paths {
+		args = append(args, fmt.Sprintf("%s@%d,%s", p, since+1, to))
+	}
+	changes, err := options.P4.Changes(args...)
+	if err != nil && !errors.Is(err, p4lib.ErrFileNotFound) && !strings.Contains(err.Error(), "no such file(s)") {
+		return nil, fmt.Errorf("could not get the changes of %s: %v", puLabel, err)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Cl > changes[j].Cl
+	})
+	max := int(pu.GetChangelog().GetMaxChanges())
+	if max <= 0 {
+		max = DefaultChangelogMax
+	}
+	if len(changes) > max {
+		changes = changes[:max]
+		ret.Truncated = true
+	}
+	for _, ch := range changes {
+		ret.Changes = append(ret.Changes, &buildpb.ChangelogEntry{
+			Cl:          int64(ch.Cl),
+			User:        ch.User,
+			Description: strings.TrimSpace(ch.Description),
+			Time:        &timestamp.Timestamp{Seconds: ch.DateUnix},
+		})
+	}
+	return ret, nil
+}
+
+// changelogPaths returns the p4 paths of the inputs of publish unit |puLabel|: the packages of the
+// units it references, transitively, and the packages of the Bazel dependencies of its Bazel build
+// units. Subpackages are included, so the paths may cover more than the inputs.
+func (c *context) changelogPaths(puLabel monorepo.Label) ([]string, error) {
+	pkgs := map[monorepo.Path]bool{}
+	var targets []string
+	seen := map[monorepo.Label]bool{}
+	queue := []monorepo.Label{puLabel}
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		if seen[l] {
+			continue
+		}
+		seen[l] = true
+		pkgDir, err := c.Monorepo.ResolveLabelPkgDir(l)
+		if err != nil {
+			return nil, err
+		}
+		pkgs[pkgDir] = true
+		bus, err := c.LoadBuildUnits(pkgDir)
+		if err != nil {
+			return nil, err
+		}
+		target, err := c.bazelTarget(l)
+		if err != nil {
+			return nil, err
+		}
+		if target != "" {
+			targets = append(targets, target)
+		}
+		for _, r := range refsOf(bus, l.Target) {
+			dep, err := c.Monorepo.NewLabel(pkgDir, r.ref)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", l, err)
+			}
+			queue = append(queue, dep)
+		}
+	}
+	if len(targets) > 0 {
+		deps, err := c.BazelQuery(fmt.Sprintf("deps(%s)", strings.Join(targets, " + ")))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deps {
+			// External dependencies, eg. "@com_github_golang_glog//:glog", aren't in the depot.
+			if !strings.HasPrefix(d, "//") {
+				continue
+			}
+			if i := strings.Index(d, ":"); i >= 0 {
+				pkgs[monorepo.Path(d[2:i])] = true
+			}
+		}
+	}
+	var sorted []string
+	for p := range pkgs {
+		sorted = append(sorted, string(p))
+	}
+	sort.Strings(sorted)
+	var paths []string
+	var last string
+	for i, p := range sorted {
+		// Skip the packages under the previous one, which already covers them.
+		if i > 0 && (last == "" || strings.HasPrefix(p, last+"/")) {
+			continue
+		}
+		last = p
+		paths = append(paths, filepath.ToSlash(filepath.Join(c.Monorepo.ResolvePath(monorepo.Path(p)), "...")))
+	}
+	return paths, nil
+}
+
+// FormatChangelog renders |changelog| of what was published as |name|, eg. a publish unit label or
+// a package name, as text with the first line of the description of each change, eg. for emails or
+// chat messages.
+func FormatChangelog(name string, changelog *buildpb.Changelog) string {
+	var sb strings.Builder
+	to := "head"
+	if changelog.ToCl > 0 {
+		to = fmt.Sprintf("CL %d", changelog.ToCl)
+	}
+	fmt.Fprintf(&sb, "%s published at %s, changes since CL %d:\n", name, to, changelog.FromCl)
+	if len(changelog.Changes) == 0 {
+		sb.WriteString("  (none)\n")
+	}
+	for _, ch := range changelog.Changes {
+		summary := strings.SplitN(ch.Description, "\n", 2)[0]
+		fmt.Fprintf(&sb, "  CL %d by %s: %s\n", ch.Cl, ch.User, strings.TrimSpace(summary))
+	}
+	if changelog.Truncated {
+		sb.WriteString("  ... and more changes not listed.\n")
+	}
+	return sb.String()
+}
+
+// postChangelog posts the changelog of publish unit |label| to the chat webhook of |pu|, if it has
+// one. Only CI publishes, which have a base CL, post, so that local publishes don't spam the chat.
+func postChangelog(pu *sgebpb.PublishUnit, label monorepo.Label, changelog *buildpb.Changelog, options Options) error {
+	name := pu.GetChangelog().GetChatWebhookCredential()
+	if name == "" || changelog == nil || changelog.ToCl == 0 || len(changelog.Changes) == 0 {
+		return nil
+	}
+	url, err := credentials.Get(options.Credentials, name)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"text": FormatChangelog(label.String(), changelog)})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(strings.TrimSpace(url), "application/json; charset=UTF-8", bytes.NewReader(body))
+	if err != nil {
+		// The URL holds the key of the webhook, keep it out of the logs.
+		return fmt.Errorf("could not post to chat webhook %q", name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("chat webhook %q returned %s: %s", name, resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+	"sge-monorepo/libs/go/credentials"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/sgetest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChangelog(t *testing.T) {
+	files := map[string]string{
+		"MONOREPO":  "",
+		"WORKSPACE": "",
+		"game/BUILDUNIT": `
+publish_unit {
+  name: "publish"
+  bin: "publish.exe"
+  build_unit: "//game/assets:cook"
+  changelog {
+    max_changes: 2
+    chat_webhook_credential: "release_chat"
+  }
+}
+`,
+		"game/assets/BUILDUNIT": `
+build_unit {
+  name: "cook"
+  bin: "//tools/cooker:cooker"
+  deps: "//engine:shaders"
+}
+`,
+		"tools/cooker/BUILDUNIT": `
+build_unit {
+  name: "cooker"
+  bin: "build.exe"
+}
+`,
+		"engine/BUILDUNIT": `
+build_unit {
+  name: "shaders"
+  bin: "shaders.exe"
+}
+`,
+	}
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatalf("could not load monorepo from %s: %v", wsDir, err)
+	}
+	var gotArgs []string
+	p4 := p4mock.New()
+	p4.ChangesFunc = func(args ...string) ([]p4lib.Change, error) {
+		gotArgs = args
+		return []p4lib.Change{
+			{Cl: 110, User: "alice", Description: "Faster shaders.\n\nDetails.", DateUnix: 1600000000},
+			{Cl: 130, User: "bob", Description: "Cook textures in parallel.", DateUnix: 1600000200},
+			{Cl: 120, User: "carol", Description: "Fix the cooker.", DateUnix: 1600000100},
+		}, nil
+	}
+	credsDir := t.TempDir()
+	var posted string
+	chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct{ Text string }
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("could not decode chat message: %v", err)
+		}
+		posted = msg.Text
+	}))
+	defer chat.Close()
+	if err := ioutil.WriteFile(filepath.Join(credsDir, "release_chat"), []byte(chat.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewContext(mr, func(o *Options) {
+		o.P4 = p4
+		o.Credentials = credentials.Dir(credsDir)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	c := bc.(*context)
+
+	label, err := mr.NewLabel("", "//game:publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus, err := c.LoadBuildUnits("game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pu, _ := c.findPublishUnit(bus, label)
+
+	if changelog, err := c.changelog(label, pu, c.options, PublishOptions{BaseCl: 200}); err != nil || changelog != nil {
+		t.Errorf("changelog without a previous publish = %v, %v; want none", changelog, err)
+	}
+
+	changelog, err := c.changelog(label, pu, c.options, PublishOptions{BaseCl: 200, SinceCl: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.ToSlash(mr.Root)
+	wantArgs := []string{
+		"-s", "submitted", "-l",
+		root + "/engine/...@101,@200",
+		root + "/game/...@101,@200",
+		root + "/tools/cooker/...@101,@200",
+	}
+	if diff := cmp.Diff(wantArgs, gotArgs); diff != "" {
+		t.Errorf("p4 changes args diff (-want +got):\n%s", diff)
+	}
+	want := `//game:publish published at CL 200, changes since CL 100:
+  CL 130 by bob: Cook textures in parallel.
+  CL 120 by carol: Fix the cooker.
+  ... and more changes not listed.
+`
+	if got := FormatChangelog(label.String(), changelog); got != want {
+		t.Errorf("FormatChangelog() = %q, want %q", got, want)
+	}
+
+	if err := postChangelog(pu, label, changelog, c.options); err != nil {
+		t.Fatal(err)
+	}
+	if posted != want {
+		t.Errorf("posted %q, want %q", posted, want)
+	}
+	// Local publishes, without a base CL, don't post.
+	posted = ""
+	changelog.ToCl = 0
+	if err := postChangelog(pu, label, changelog, c.options); err != nil {
+		t.Fatal(err)
+	}
+	if posted != "" {
+		t.Errorf("local publish posted %q", posted)
+	}
+	if !strings.HasPrefix(FormatChangelog(label.String(), changelog), "//game:publish published at head") {
+		t.Errorf("changelog of a local publish doesn't say it's at head: %q", FormatChangelog(label.String(), changelog))
+	}
+
+	pu.Changelog = &sgebpb.ChangelogConfig{}
+	changelog, err = c.changelog(label, pu, c.options, PublishOptions{BaseCl: 200, SinceCl: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changelog.Changes) != 3 || changelog.Truncated {
+		t.Errorf("got %d changes, truncated %v; want all 3 with the default maximum", len(changelog.Changes), changelog.Truncated)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// Exit codes of sgeb and sgep. Scripts rely on them, so they must not change. Codes are ordered by
+// severity.
+const (
+	// ExitSuccess means the command succeeded.
+	ExitSuccess = 0
+	// ExitFailed means a build, test, presubmit check or unit binary ran and failed.
+	ExitFailed = 1
+	// ExitUsage means the command was invoked wrongly, eg. bad flags or labels.
+	ExitUsage = 2
+	// ExitInfra means an infrastructure or internal error kept the command from running to the end.
+	ExitInfra = 3
+	// ExitCancelled means the command was interrupted.
+	ExitCancelled = 4
+)
+
+// exitError attaches an exit code to an error.
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// WithExitCode returns |err| classified with exit code |code|. Returns nil if |err| is nil.
+func WithExitCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{err: err, code: code}
+}
+
+// UsageErrorf returns an error classified as a usage error.
+func UsageErrorf(format string, args ...interface{}) error {
+	return WithExitCode(fmt.Errorf(format, args...), ExitUsage)
+}
+
+// IsUsage returns whether the error is a usage error.
+func IsUsage(err error) bool {
+	return ExitCode(err) == ExitUsage
+}
+
+// IsCancelled returns whether the error means the operation was interrupted.
+func IsCancelled(err error) bool {
+	return ExitCode(err) == ExitCancelled
+}
+
+// IsInfra returns whether the error is an infrastructure or internal error, ie. not a failure of
+// what was built or run, nor a usage error.
+func IsInfra(err error) bool {
+	return ExitCode(err) == ExitInfra
+}
+
+// ExitCode returns the exit code for a command that returned |err|:
+//   - nil is ExitSuccess.
+//   - Errors classified with WithExitCode get their code.
+//   - Failed builds and tests (see IsFailed) and binaries exiting with an error are ExitFailed.
+//   - Binaries that crashed are ExitInfra, and binaries that were interrupted are ExitCancelled.
+//   - Cancelled contexts are ExitCancelled.
+//   - Any other error is ExitInfra.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	if IsFailed(err) {
+		return ExitFailed
+	}
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		return processExitCode(execErr)
+	}
+	if errors.Is(err, gocontext.Canceled) {
+		return ExitCancelled
+	}
+	return ExitInfra
+}
+
+// NTSTATUS codes binaries exit with on Windows when they crash or are interrupted.
+const (
+	// statusError is the severity of NTSTATUS errors, eg. 0xC0000005 for access violations.
+	statusError = 0xC0000000
+	// statusControlCExit is the exit code of processes killed by Ctrl+C.
+	statusControlCExit = 0xC000013A
+)
+
+// processExitCode classifies the exit of a binary: it failed, unless it was killed by a signal or
+// a Windows exception, which are crashes, or interrupted.
+func processExitCode(err *exec.ExitError) int {
+	if ws, ok := err.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		if ws.Signal() == syscall.SIGINT {
+			return ExitCancelled
+		}
+		return ExitInfra
+	}
+	switch status := uint32(err.ExitCode()); {
+	case status == statusControlCExit:
+		return ExitCancelled
+	case status >= statusError:
+		return ExitInfra
+	}
+	return ExitFailed
+}
+
+// WorstExitCode returns the exit code of the most severe of |errs|. Cancellation is the most severe,
+// followed by infrastructure errors, usage errors and failures.
+func WorstExitCode(errs ...error) int {
+	worst := ExitSuccess
+	for _, err := range errs {
+		if code := ExitCode(err); code > worst {
+			worst = code
+		}
+	}
+	return worst
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+)
+
+func TestExitCode(t *testing.T) {
+	failedErr := &failed{monorepo.Label{Pkg: "foo", Target: "bar"}}
+	testCases := []struct {
+		name string
+		err  error
+		want int
+		// unix is set for the cases that need a Unix shell.
+		unix bool
+	}{
+		{name: "success", err: nil, want: ExitSuccess},
+		{name: "failed", err: failedErr, want: ExitFailed},
+		{name: "wrapped failed", err: fmt.Errorf("building deps: %w", failedErr), want: ExitFailed},
+		{name: "binary failed", err: fmt.Errorf("tool: %w", runScript(t, "exit 1")), want: ExitFailed},
+		{name: "binary crashed", err: runScript(t, "kill -SEGV $$"), want: ExitInfra, unix: true},
+		{name: "binary interrupted", err: runScript(t, "kill -INT $$"), want: ExitCancelled, unix: true},
+		{name: "usage", err: UsageErrorf("must pass build unit to build command"), want: ExitUsage},
+		{name: "cancelled", err: fmt.Errorf("waiting: %w", gocontext.Canceled), want: ExitCancelled},
+		{name: "classified", err: WithExitCode(failedErr, ExitInfra), want: ExitInfra},
+		{name: "other", err: errors.New("could not read BEP stream"), want: ExitInfra},
+	}
+	for _, tc := range testCases {
+		if tc.unix && runtime.GOOS == "windows" {
+			continue
+		}
+		if got := ExitCode(tc.err); got != tc.want {
+			t.Errorf("%s: ExitCode(%v) = %d, want %d", tc.name, tc.err, got, tc.want)
+		}
+	}
+	if !IsFailed(fmt.Errorf("wrapped: %w", failedErr)) {
+		t.Errorf("IsFailed of wrapped failure = false, want true")
+	}
+	if got := WorstExitCode(failedErr, nil, errors.New("infra"), UsageErrorf("usage")); got != ExitInfra {
+		t.Errorf("WorstExitCode() = %d, want %d", got, ExitInfra)
+	}
+	if got := WorstExitCode(); got != ExitSuccess {
+		t.Errorf("WorstExitCode() = %d, want %d", got, ExitSuccess)
+	}
+	if WithExitCode(nil, ExitInfra) != nil {
+		t.Errorf("WithExitCode(nil) != nil")
+	}
+}
+
+// runScript returns the error of the shell script |script|, which must fail.
+func runScript(t *testing.T, script string) error {
+	cmd := exec.Command("sh", "-c", script)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/c", script)
+	}
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("running %q: got %v, want an exit error", script, err)
+	}
+	return err
+}
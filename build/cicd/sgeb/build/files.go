@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"sge-monorepo/build/cicd/monorepo"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+)
+
+// buildFiles builds a data-only build unit, returning its files as artifacts.
+func (c *context) buildFiles(buLabel monorepo.Label, pkgDir monorepo.Path, bu *sgebpb.BuildUnit) (*buildpb.BuildResult, error) {
+	filter, err := newArtifactFilter(bu.Files)
+	if err != nil {
+		return nil, fmt.Errorf("build unit %s: %v", buLabel, err)
+	}
+	if len(filter.includes) == 0 {
+		return nil, fmt.Errorf("build unit %s: files must have at least one including pattern", buLabel)
+	}
+	as, err := globFiles(c.Monorepo.ResolvePath(pkgDir), string(pkgDir), filter)
+	if err != nil {
+		return nil, fmt.Errorf("build unit %s: %v", buLabel, err)
+	}
+	if len(as.Artifacts) == 0 {
+		return nil, fmt.Errorf("build unit %s: no files match %v", buLabel, bu.Files)
+	}
+	return &buildpb.BuildResult{
+		OverallResult: &buildpb.Result{
+			Name:    buLabel.String(),
+			Success: true,
+		},
+		BuildResult: &buildpb.BuildInvocationResult{
+			Result: &buildpb.Result{
+				Name:    buLabel.String(),
+				Success: true,
+			},
+			ArtifactSet: as,
+		},
+	}, nil
+}
+
+// globFiles returns the files under |dir| whose path relative to |dir| passes |filter|, sorted by
+// path. Stable paths are prefixed with |stablePrefix|. BUILDUNIT files and hidden directories are
+// never included.
+func globFiles(dir, stablePrefix string, filter *artifactFilter) (*buildpb.ArtifactSet, error) {
+	var rels []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != dir && info.Name()[0] == '.' {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "BUILDUNIT" || !filter.match(rel) {
+			return nil
+		}
+		rels = append(rels, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rels)
+	as := &buildpb.ArtifactSet{}
+	hasher := sha256.New()
+	for _, rel := range rels {
+		stablePath := path.Join(stablePrefix, rel)
+		abs := path.Join(filepath.ToSlash(dir), rel)
+		sum, err := hashFile(abs)
+		if err != nil {
+			return nil, err
+		}
+		// Hash the paths too, so that renames change the hash.
+		fmt.Fprintf(hasher, "%s\x00%s\n", stablePath, sum)
+		as.Artifacts = append(as.Artifacts, &buildpb.Artifact{
+			Tag:        rel,
+			StablePath: stablePath,
+			Uri:        fmt.Sprintf("file:///%s", abs),
+		})
+	}
+	as.ContentHash = hex.EncodeToString(hasher.Sum(nil))
+	return as, nil
+}
+
+// hashFile returns the hex SHA-256 of the contents of the file at |p|.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("could not hash %s: %v", p, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
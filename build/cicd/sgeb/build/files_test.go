@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildFiles(t *testing.T) {
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	files := map[string]string{
+		"MONOREPO":                     "",
+		"WORKSPACE":                    "",
+		"data/BUILDUNIT":               "build_unit {\n  name: \"configs\"\n  files: \"**/*.json\"\n  files: \"-tmp/**\"\n}\n",
+		"data/a.json":                  "{}",
+		"data/sub/b.json":              "[]",
+		"data/sub/readme.txt":          "not data",
+		"data/tmp/c.json":              "{}",
+		"data/.hidden/d.json":          "{}",
+		"other/BUILDUNIT":              "build_unit {\n  name: \"none\"\n  files: \"*.json\"\n}\n",
+		"other/sub/not_top_level.json": "{}",
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(path.Join(wsDir, path.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(wsDir, p), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewContext(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	build := func(s string) (string, []string, error) {
+		t.Helper()
+		l, err := mr.NewLabel("", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := bc.Build(l, func(o *Options) {
+			o.Logs = ioutil.Discard
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		as := result.BuildResult.ArtifactSet
+		var paths []string
+		for _, a := range as.Artifacts {
+			paths = append(paths, a.StablePath)
+		}
+		return as.ContentHash, paths, nil
+	}
+
+	hash, paths, err := build("//data:configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"data/a.json", "data/sub/b.json"}, paths); diff != "" {
+		t.Errorf("artifacts mismatch (-want +got):\n%s", diff)
+	}
+	if len(hash) != 64 {
+		t.Errorf("content hash = %q, want a hex SHA-256", hash)
+	}
+	// Changing the contents of any file changes the hash.
+	if err := ioutil.WriteFile(path.Join(wsDir, "data/sub/b.json"), []byte("[1]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	as, err := globFiles(path.Join(wsDir, "data"), "data", &artifactFilter{includes: []string{"**/*.json"}, excludes: []string{"tmp/**"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as.ContentHash == hash {
+		t.Errorf("content hash didn't change with the contents of a file")
+	}
+	if _, _, err := build("//other:none"); err == nil {
+		t.Errorf("building a data-only unit without matching files: want error")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+)
+
+// GenResult is the result of running the generator of a gen unit.
+type GenResult struct {
+	// Outputs are the outputs of the gen unit, in the order they are declared.
+	Outputs []GenOutput
+}
+
+// GenOutput is a file produced by the generator of a gen unit.
+type GenOutput struct {
+	// Path is the monorepo path of the checked-in file.
+	Path monorepo.Path
+
+	// Content is the generated content.
+	Content []byte
+
+	// Stale is whether the checked-in file is missing or differs from the generated content.
+	Stale bool
+}
+
+// Stale returns the outputs whose checked-in files are stale.
+func (r *GenResult) Stale() []GenOutput {
+	var stale []GenOutput
+	for _, o := range r.Outputs {
+		if o.Stale {
+			stale = append(stale, o)
+		}
+	}
+	return stale
+}
+
+func (c *context) Generate(guLabel monorepo.Label, opts ...Option) (*GenResult, error) {
+	options := c.cmdOpts(opts...)
+	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(guLabel)
+	if err != nil {
+		return nil, err
+	}
+	bus, err := c.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	gu, ok := c.findGenUnit(bus, guLabel)
+	if !ok {
+		return nil, fmt.Errorf("cannot find gen unit %q in pkg //%s", guLabel.Target, guLabel.Pkg)
+	}
+	warnDeprecated(options.Logs, guLabel, gu)
+	if err := checkRequiredEnv(options.Logs, guLabel, gu, options.InstallMissingEnv); err != nil {
+		return nil, err
+	}
+	bin, binResult, err := c.resolveBin(pkgDir, gu.Bin, options)
+	if err != nil {
+		if binResult != nil {
+			PrintFailedBuildResult(options.Logs, binResult)
+		}
+		return nil, err
+	}
+	outDir, err := ioutil.TempDir("", "sgeb-gen")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(outDir)
+	ih, err := newInvocationHelper(&buildpb.ToolInvocation{
+		BuildUnitDir:  string(pkgDir),
+		GenInvocation: &buildpb.GenInvocation{OutputDir: outDir},
+		LogLabels:     logLabelsFromOptions(&options),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer ih.Cleanup()
+	cmdArgs := []string{ih.InvocationArg()}
+	cmdArgs = append(cmdArgs, gu.Args...)
+	cmd := exec.Command(bin, cmdArgs...)
+	cmd.Dir = c.Monorepo.Root
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Stdout = options.Logs
+	cmd.Stderr = options.Logs
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("generator of %s failed: %v", guLabel, err)
+	}
+	result, err := compareGenOutputs(c.Monorepo, pkgDir, gu.Output, outDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", guLabel, err)
+	}
+	return result, maybeFailError(len(result.Stale()) == 0, guLabel)
+}
+
+// compareGenOutputs compares the |outputs| of a gen unit of package |pkgDir|, generated in
+// |outDir|, with their checked-in files. Line endings are ignored, as workspaces may check out
+// text files with CRLF.
+func compareGenOutputs(mr monorepo.Monorepo, pkgDir monorepo.Path, outputs []string, outDir string) (*GenResult, error) {
+	result := &GenResult{}
+	for _, o := range outputs {
+		p, err := mr.NewPath(pkgDir, o)
+		if err != nil {
+			return nil, err
+		}
+		generated, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(o)))
+		if err != nil {
+			return nil, fmt.Errorf("generator did not produce %s: %v", o, err)
+		}
+		stale := false
+		checkedIn, err := ioutil.ReadFile(mr.ResolvePath(p))
+		if os.IsNotExist(err) {
+			stale = true
+		} else if err != nil {
+			return nil, err
+		} else {
+			stale = !bytes.Equal(normalizeNewlines(generated), normalizeNewlines(checkedIn))
+		}
+		result.Outputs = append(result.Outputs, GenOutput{
+			Path:    p,
+			Content: generated,
+			Stale:   stale,
+		})
+	}
+	return result, nil
+}
+
+func normalizeNewlines(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+}
+
+// WriteGenOutputs overwrites the checked-in files of the stale outputs of |result| with the
+// generated content, and returns their local paths. Files synced read-only are made writable.
+func WriteGenOutputs(mr monorepo.Monorepo, result *GenResult) ([]string, error) {
+	var written []string
+	for _, o := range result.Stale() {
+		p := mr.ResolvePath(o.Path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(p); err == nil {
+			if err := os.Chmod(p, 0644); err != nil {
+				return nil, fmt.Errorf("could not make %s writable: %v", p, err)
+			}
+		}
+		if err := ioutil.WriteFile(p, o.Content, 0644); err != nil {
+			return nil, err
+		}
+		written = append(written, p)
+	}
+	return written, nil
+}
+
+func (c *context) findGenUnit(bus *sgebpb.BuildUnits, l monorepo.Label) (*sgebpb.GenUnit, bool) {
+	for _, gu := range bus.GenUnit {
+		if gu.Name == l.Target {
+			return gu, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+	"sge-monorepo/libs/go/sgetest"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGenOutputs(t *testing.T) {
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	outDir, err := ioutil.TempDir("", "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+	if err := sgetest.WriteFiles(wsDir, map[string]string{
+		"WORKSPACE":         "",
+		"api/gen/fresh.go":  "package gen\r\n",
+		"api/gen/stale.go":  "package old\n",
+		"api/gen/unrelated": "",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sgetest.WriteFiles(outDir, map[string]string{
+		"gen/fresh.go":   "package gen\n",
+		"gen/stale.go":   "package gen\n",
+		"gen/missing.go": "package gen\n",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Synced files are read-only.
+	if err := os.Chmod(filepath.Join(wsDir, "api/gen/stale.go"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	mr := monorepo.New(wsDir, nil)
+	outputs := []string{"gen/fresh.go", "gen/stale.go", "gen/missing.go"}
+	result, err := compareGenOutputs(mr, "api", outputs, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotStale []monorepo.Path
+	for _, o := range result.Stale() {
+		gotStale = append(gotStale, o.Path)
+	}
+	wantStale := []monorepo.Path{"api/gen/stale.go", "api/gen/missing.go"}
+	if diff := cmp.Diff(wantStale, gotStale); diff != "" {
+		t.Errorf("stale outputs diff (-want +got):\n%s", diff)
+	}
+
+	written, err := WriteGenOutputs(mr, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 {
+		t.Errorf("want 2 files written, got %v", written)
+	}
+	result, err = compareGenOutputs(mr, "api", outputs, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale := result.Stale(); len(stale) != 0 {
+		t.Errorf("want no stale outputs after writing them, got %v", stale)
+	}
+
+	_, err = compareGenOutputs(mr, "api", []string{"gen/other.go"}, outDir)
+	if err == nil || !strings.Contains(err.Error(), "did not produce") {
+		t.Errorf("want error for outputs the generator did not produce, got %v", err)
+	}
+}
+
+func TestValidateGenUnits(t *testing.T) {
+	testCases := []struct {
+		buildUnits string
+		wantErr    bool
+	}{
+		{buildUnits: `gen_unit { name: "gen" bin: "//tools:protogen" output: "api.pb.go" }`},
+		{buildUnits: `gen_unit { name: "gen" output: "api.pb.go" }`, wantErr: true},
+		{buildUnits: `gen_unit { name: "gen" bin: "//tools:protogen" }`, wantErr: true},
+		{buildUnits: `
+gen_unit { name: "gen" bin: "//tools:protogen" output: "api.pb.go" }
+build_unit { name: "gen" bin: "gen.exe" }`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		bus := &sgebpb.BuildUnits{}
+		if err := proto.UnmarshalText(tc.buildUnits, bus); err != nil {
+			t.Fatal(err)
+		}
+		err := validateBuildUnits(bus)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateBuildUnits(%s) error = %v, want error: %t", tc.buildUnits, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kms signs and verifies the artifacts of sgeb build units with Cloud KMS asymmetric keys.
+package kms
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+
+	kmsapi "cloud.google.com/go/kms/apiv1"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+
+	"sge-monorepo/build/cicd/sgeb/build"
+)
+
+// Key is a Cloud KMS asymmetric signing key version, implementing build.Signer and build.Verifier.
+// Signing needs the cloudkms.signer role on the key, verifying only cloudkms.publicKeyViewer, as
+// signatures are verified locally with the public key.
+//
+// Usage:
+//      key, err := kms.New(ctx, "projects/p/locations/global/keyRings/sgeb/cryptoKeys/artifacts/cryptoKeyVersions/1")
+//      ...
+//      defer key.Close()
+//      bc, err := build.NewContext(mr, func(o *build.Options) { o.Signer = key })
+type Key struct {
+	ctx    context.Context
+	client *kmsapi.KeyManagementClient
+	name   string
+
+	mu       sync.Mutex
+	verifier *build.PublicKeyVerifier
+}
+
+// New returns the key version with resource name |name|. The key must use a SHA-256 algorithm,
+// eg. EC_SIGN_P256_SHA256.
+func New(ctx context.Context, name string) (*Key, error) {
+	client, err := kmsapi.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create KMS client: %v", err)
+	}
+	return &Key{ctx: ctx, client: client, name: name}, nil
+}
+
+// Close closes the connection to Cloud KMS.
+func (k *Key) Close() error {
+	return k.client.Close()
+}
+
+func (k *Key) Key() string {
+	return k.name
+}
+
+func (k *Key) Sign(digest []byte) ([]byte, error) {
+	resp, err := k.client.AsymmetricSign(k.ctx, &kmspb.AsymmetricSignRequest{
+		Name: k.name,
+		Digest: &kmspb.Digest{
+			Digest: &kmspb.Digest_Sha256{Sha256: digest},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not sign with %s: %v", k.name, err)
+	}
+	return resp.Signature, nil
+}
+
+func (k *Key) Verify(digest, signature []byte) error {
+	v, err := k.publicKey()
+	if err != nil {
+		return err
+	}
+	return v.Verify(digest, signature)
+}
+
+// publicKey fetches the public key of the key version on first use.
+func (k *Key) publicKey() (*build.PublicKeyVerifier, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.verifier != nil {
+		return k.verifier, nil
+	}
+	resp, err := k.client.GetPublicKey(k.ctx, &kmspb.GetPublicKeyRequest{Name: k.name})
+	if err != nil {
+		return nil, fmt.Errorf("could not get the public key of %s: %v", k.name, err)
+	}
+	alg := resp.Algorithm.String()
+	if !strings.HasSuffix(alg, "_SHA256") {
+		return nil, fmt.Errorf("%s uses algorithm %s, want a SHA-256 one", k.name, alg)
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("could not decode the public key of %s", k.name)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the public key of %s: %v", k.name, err)
+	}
+	k.verifier = &build.PublicKeyVerifier{
+		KeyName:   k.name,
+		PublicKey: pub,
+		PSS:       strings.Contains(alg, "_PSS_"),
+	}
+	return k.verifier, nil
+}
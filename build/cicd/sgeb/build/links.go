@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+	"sge-monorepo/libs/go/files"
+)
+
+// resolveLink returns the slash separated path |p| resolves to, following all the links in it.
+func resolveLink(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", fmt.Errorf("dangling link %s: %v", p, err)
+	}
+	abs, err := filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(abs), nil
+}
+
+// isDir returns whether |p| is a directory, following links.
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+// collectArtifacts returns the artifacts of |as| with directories, eg. runfiles trees, expanded
+// into artifacts for their files, and links handled as |mode| says. Bazel reports a directory
+// output as a single file:/// URI, which tools and copies can't consume. With the default mode,
+// |as| is returned as is.
+// Artifacts that are not local files, or that don't exist locally (eg. outputs left remote), are
+// kept as they are.
+func collectArtifacts(as *buildpb.ArtifactSet, mode sgebpb.LinkMode) (*buildpb.ArtifactSet, error) {
+	if as == nil || mode == sgebpb.LinkMode_DEFAULT_LINKS {
+		return as, nil
+	}
+	lc := &linkCollector{mode: mode}
+	for _, a := range as.Artifacts {
+		if err := lc.collect(a); err != nil {
+			return nil, err
+		}
+	}
+	return &buildpb.ArtifactSet{
+		Tag:         as.Tag,
+		Artifacts:   lc.artifacts,
+		ContentHash: as.ContentHash,
+	}, nil
+}
+
+type linkCollector struct {
+	mode      sgebpb.LinkMode
+	artifacts []*buildpb.Artifact
+}
+
+func (lc *linkCollector) collect(a *buildpb.Artifact) error {
+	p := artifactPath(a)
+	if p == "" {
+		lc.artifacts = append(lc.artifacts, a)
+		return nil
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		lc.artifacts = append(lc.artifacts, a)
+		return nil
+	}
+	if files.IsLink(info) {
+		if lc.mode == sgebpb.LinkMode_PRESERVE_LINKS {
+			lc.artifacts = append(lc.artifacts, a)
+			return nil
+		}
+		if p, err = resolveLink(p); err != nil {
+			return fmt.Errorf("artifact %s: %v", a.StablePath, err)
+		}
+		if info, err = os.Stat(p); err != nil {
+			return err
+		}
+	}
+	if !info.IsDir() {
+		lc.artifacts = append(lc.artifacts, &buildpb.Artifact{
+			Tag:        a.Tag,
+			StablePath: a.StablePath,
+			Uri:        fmt.Sprintf("file:///%s", p),
+		})
+		return nil
+	}
+	return lc.expand(p, a.StablePath, a.Tag, map[string]bool{})
+}
+
+// expand adds an artifact tagged |tag| for every file under the directory |dir|, with stable paths
+// under |stablePath|. |visiting| are the resolved directories being expanded, to stop at link
+// cycles.
+func (lc *linkCollector) expand(dir, stablePath, tag string, visiting map[string]bool) error {
+	resolved, err := resolveLink(dir)
+	if err != nil {
+		return err
+	}
+	if visiting[resolved] {
+		return fmt.Errorf("link cycle at %s", dir)
+	}
+	visiting[resolved] = true
+	defer delete(visiting, resolved)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		sp := path.Join(stablePath, info.Name())
+		if files.IsLink(info) {
+			if lc.mode == sgebpb.LinkMode_PRESERVE_LINKS {
+				lc.artifacts = append(lc.artifacts, &buildpb.Artifact{
+					Tag:        tag,
+					StablePath: sp,
+					Uri:        fmt.Sprintf("file:///%s", p),
+				})
+				continue
+			}
+			target, err := resolveLink(p)
+			if err != nil {
+				return fmt.Errorf("artifact %s: %v", sp, err)
+			}
+			if info, err = os.Stat(target); err != nil {
+				return err
+			}
+			p = target
+		}
+		if info.IsDir() {
+			if err := lc.expand(p, sp, tag, visiting); err != nil {
+				return err
+			}
+			continue
+		}
+		lc.artifacts = append(lc.artifacts, &buildpb.Artifact{
+			Tag:        tag,
+			StablePath: sp,
+			Uri:        fmt.Sprintf("file:///%s", p),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// symlink creates a link, skipping the test where the user can't create links, eg. on Windows
+// without developer mode.
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		if runtime.GOOS == "windows" {
+			t.Skipf("can't create symlinks: %v", err)
+		}
+		t.Fatal(err)
+	}
+}
+
+func TestCollectArtifacts(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.ToSlash(root)
+	files := map[string]string{
+		"src/data.txt":                "data",
+		"src/lib/a.so":                "a",
+		"out/tool":                    "tool",
+		"out/tool.runfiles/plain.txt": "plain",
+	}
+	for p, content := range files {
+		abs := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(abs, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink(t, filepath.Join(root, "src", "data.txt"), filepath.Join(root, "out", "tool.runfiles", "data.txt"))
+	symlink(t, filepath.Join(root, "src", "lib"), filepath.Join(root, "out", "tool.runfiles", "lib"))
+	symlink(t, filepath.Join(root, "out", "tool"), filepath.Join(root, "out", "alias"))
+	artifact := func(stablePath, p string) *buildpb.Artifact {
+		return &buildpb.Artifact{StablePath: stablePath, Uri: fmt.Sprintf("file:///%s", p)}
+	}
+	as := &buildpb.ArtifactSet{
+		Artifacts: []*buildpb.Artifact{
+			artifact("pkg/alias", root+"/out/alias"),
+			artifact("pkg/tool.runfiles", root+"/out/tool.runfiles"),
+			artifact("pkg/remote", root+"/out/remote"),
+			{StablePath: "pkg/inline", Contents: []byte("inline")},
+		},
+	}
+	collected := func(mode sgebpb.LinkMode) map[string]string {
+		got, err := collectArtifacts(as, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := map[string]string{}
+		for _, a := range got.Artifacts {
+			ret[a.StablePath] = strings.TrimPrefix(artifactPath(a), root+"/")
+		}
+		return ret
+	}
+	if got, err := collectArtifacts(as, sgebpb.LinkMode_DEFAULT_LINKS); err != nil || got != as {
+		t.Errorf("collectArtifacts() with the default mode = %v, %v, want the artifacts as is", got, err)
+	}
+	wantResolved := map[string]string{
+		"pkg/alias":                   "out/tool",
+		"pkg/tool.runfiles/data.txt":  "src/data.txt",
+		"pkg/tool.runfiles/lib/a.so":  "src/lib/a.so",
+		"pkg/tool.runfiles/plain.txt": "out/tool.runfiles/plain.txt",
+		"pkg/remote":                  "out/remote",
+		"pkg/inline":                  "",
+	}
+	if diff := cmp.Diff(wantResolved, collected(sgebpb.LinkMode_RESOLVE_LINKS)); diff != "" {
+		t.Errorf("resolved artifacts diff (-want +got):\n%s", diff)
+	}
+	wantPreserved := map[string]string{
+		"pkg/alias":                   "out/alias",
+		"pkg/tool.runfiles/data.txt":  "out/tool.runfiles/data.txt",
+		"pkg/tool.runfiles/lib":       "out/tool.runfiles/lib",
+		"pkg/tool.runfiles/plain.txt": "out/tool.runfiles/plain.txt",
+		"pkg/remote":                  "out/remote",
+		"pkg/inline":                  "",
+	}
+	if diff := cmp.Diff(wantPreserved, collected(sgebpb.LinkMode_PRESERVE_LINKS)); diff != "" {
+		t.Errorf("preserved artifacts diff (-want +got):\n%s", diff)
+	}
+
+	// Links that can't be resolved fail collection, unless links are preserved.
+	symlink(t, filepath.Join(root, "out"), filepath.Join(root, "out", "tool.runfiles", "loop"))
+	if _, err := collectArtifacts(as, sgebpb.LinkMode_RESOLVE_LINKS); err == nil || !strings.Contains(err.Error(), "link cycle") {
+		t.Errorf("got error %v, want a link cycle", err)
+	}
+	if err := os.Remove(filepath.Join(root, "out", "tool.runfiles", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, filepath.Join(root, "missing"), filepath.Join(root, "out", "tool.runfiles", "dangling"))
+	if _, err := collectArtifacts(as, sgebpb.LinkMode_RESOLVE_LINKS); err == nil || !strings.Contains(err.Error(), "dangling link") {
+		t.Errorf("got error %v, want a dangling link", err)
+	}
+	if _, err := collectArtifacts(as, sgebpb.LinkMode_PRESERVE_LINKS); err != nil {
+		t.Errorf("preserving a dangling link failed: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Runfiles trees on Windows link directories with junctions, which need no privilege to create.
+func TestCollectArtifactsJunction(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib := filepath.Join(root, "src", "lib")
+	runfiles := filepath.Join(root, "out", "tool.runfiles")
+	for _, dir := range []string{lib, runfiles} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(lib, "a.dll"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("cmd", "/c", "mklink", "/J", filepath.Join(runfiles, "lib"), lib).CombinedOutput(); err != nil {
+		t.Fatalf("could not create junction: %v: %s", err, out)
+	}
+	root = filepath.ToSlash(root)
+	as := &buildpb.ArtifactSet{
+		Artifacts: []*buildpb.Artifact{
+			{StablePath: "pkg/tool.runfiles", Uri: fmt.Sprintf("file:///%s/out/tool.runfiles", root)},
+		},
+	}
+	collected := func(mode sgebpb.LinkMode) map[string]string {
+		got, err := collectArtifacts(as, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := map[string]string{}
+		for _, a := range got.Artifacts {
+			ret[a.StablePath] = strings.TrimPrefix(artifactPath(a), root+"/")
+		}
+		return ret
+	}
+	if diff := cmp.Diff(map[string]string{
+		"pkg/tool.runfiles/lib/a.dll": "src/lib/a.dll",
+	}, collected(sgebpb.LinkMode_RESOLVE_LINKS)); diff != "" {
+		t.Errorf("resolved artifacts diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{
+		"pkg/tool.runfiles/lib": "out/tool.runfiles/lib",
+	}, collected(sgebpb.LinkMode_PRESERVE_LINKS)); diff != "" {
+		t.Errorf("preserved artifacts diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+)
+
+// OutputFile is a file produced by a build unit.
+type OutputFile struct {
+	// Path is the stable path of the file.
+	Path string `json:"path"`
+	// Digest is the hex SHA-256 of the file contents.
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// OutputSnapshot is the files a build of a unit produced. Artifacts are hashed when the snapshot
+// is taken, as later builds overwrite them, so that snapshots can be saved and compared with
+// DiffOutputs after the fact.
+type OutputSnapshot struct {
+	Unit string `json:"unit"`
+	// Source describes what the unit was built from, eg. "workspace" or "CL 1234".
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	// Files are sorted by path.
+	Files []OutputFile `json:"files"`
+}
+
+// SnapshotOutputs hashes the artifacts of a build of |unit|. Artifacts without a stable path, eg.
+// logs, and artifacts that aren't files are skipped. Directory artifacts are expanded to the files
+// they contain.
+func SnapshotOutputs(unit monorepo.Label, source string, result *buildpb.BuildResult) (*OutputSnapshot, error) {
+	s := &OutputSnapshot{
+		Unit:   unit.String(),
+		Source: source,
+		Time:   time.Now(),
+	}
+	if result == nil || result.BuildResult == nil || result.BuildResult.ArtifactSet == nil {
+		return s, nil
+	}
+	for _, a := range result.BuildResult.ArtifactSet.Artifacts {
+		if a.StablePath == "" {
+			continue
+		}
+		if len(a.Contents) > 0 {
+			sum := sha256.Sum256(a.Contents)
+			s.Files = append(s.Files, OutputFile{
+				Path:   a.StablePath,
+				Digest: hex.EncodeToString(sum[:]),
+				Size:   int64(len(a.Contents)),
+			})
+			continue
+		}
+		p := artifactPath(a)
+		if p == "" {
+			continue
+		}
+		files, err := snapshotPath(p, a.StablePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not snapshot artifact %s: %v", a.StablePath, err)
+		}
+		s.Files = append(s.Files, files...)
+	}
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].Path < s.Files[j].Path
+	})
+	return s, nil
+}
+
+// snapshotPath hashes the file at |p|, or the files under it if it's a directory.
+func snapshotPath(p, stablePath string) ([]OutputFile, error) {
+	var files []OutputFile
+	err := filepath.Walk(p, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(p, fp)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(fp)
+		if err != nil {
+			return err
+		}
+		files = append(files, OutputFile{
+			Path:   path.Join(stablePath, filepath.ToSlash(rel)),
+			Digest: sum,
+			Size:   info.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// OutputSnapshotPath returns the file the snapshot of |unit| built from |source| is saved to by
+// default.
+func OutputSnapshotPath(outputDir string, unit monorepo.Label, source string) string {
+	return filepath.Join(outputDir, "outputs", fmt.Sprintf("%s@%s.json", url.QueryEscape(unit.String()), url.QueryEscape(source)))
+}
+
+// Save writes the snapshot to |p|.
+func (s *OutputSnapshot) Save(p string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+// LoadOutputSnapshot reads a snapshot saved with Save.
+func LoadOutputSnapshot(p string) (*OutputSnapshot, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	s := &OutputSnapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("could not parse output snapshot %s: %v", p, err)
+	}
+	return s, nil
+}
+
+// ChangedOutput is a file produced by both builds with different contents.
+type ChangedOutput struct {
+	Path string     `json:"path"`
+	Base OutputFile `json:"base"`
+	Head OutputFile `json:"head"`
+}
+
+// SizeDelta returns how many bytes the file grew by.
+func (c *ChangedOutput) SizeDelta() int64 {
+	return c.Head.Size - c.Base.Size
+}
+
+// OutputDiff is the difference between the files produced by two builds.
+type OutputDiff struct {
+	Unit string `json:"unit"`
+	// Base and Head are the sources of the compared snapshots.
+	Base    string          `json:"base"`
+	Head    string          `json:"head"`
+	Added   []OutputFile    `json:"added"`
+	Removed []OutputFile    `json:"removed"`
+	Changed []ChangedOutput `json:"changed"`
+	// Unchanged is the number of files identical in both builds.
+	Unchanged int `json:"unchanged"`
+}
+
+// DiffOutputs compares the files of two snapshots of the same unit.
+func DiffOutputs(base, head *OutputSnapshot) *OutputDiff {
+	d := &OutputDiff{
+		Unit: head.Unit,
+		Base: base.Source,
+		Head: head.Source,
+	}
+	baseFiles := map[string]OutputFile{}
+	for _, f := range base.Files {
+		baseFiles[f.Path] = f
+	}
+	for _, f := range head.Files {
+		b, ok := baseFiles[f.Path]
+		delete(baseFiles, f.Path)
+		switch {
+		case !ok:
+			d.Added = append(d.Added, f)
+		case b.Digest != f.Digest:
+			d.Changed = append(d.Changed, ChangedOutput{Path: f.Path, Base: b, Head: f})
+		default:
+			d.Unchanged++
+		}
+	}
+	// Keep the order of the base snapshot for removed files.
+	for _, f := range base.Files {
+		if _, ok := baseFiles[f.Path]; ok {
+			d.Removed = append(d.Removed, f)
+		}
+	}
+	return d
+}
+
+// Empty returns whether both builds produced the same files.
+func (d *OutputDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// SizeDelta returns how many bytes the outputs grew by.
+func (d *OutputDiff) SizeDelta() int64 {
+	var n int64
+	for _, f := range d.Added {
+		n += f.Size
+	}
+	for _, f := range d.Removed {
+		n -= f.Size
+	}
+	for _, c := range d.Changed {
+		n += c.SizeDelta()
+	}
+	return n
+}
+
+// PrintOutputDiff prints a report of the differences between two builds.
+func PrintOutputDiff(w io.Writer, d *OutputDiff) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Outputs of %s, %s vs %s:\n", d.Unit, d.Base, d.Head)
+	if d.Empty() {
+		fmt.Fprintf(&buf, "  identical, %d files\n", d.Unchanged)
+		_, _ = w.Write(buf.Bytes())
+		return
+	}
+	for _, f := range d.Added {
+		fmt.Fprintf(&buf, "  A %s (%s, %s)\n", f.Path, formatBytes(f.Size), shortDigest(f.Digest))
+	}
+	for _, f := range d.Removed {
+		fmt.Fprintf(&buf, "  D %s (%s, %s)\n", f.Path, formatBytes(f.Size), shortDigest(f.Digest))
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(&buf, "  M %s (%s, %s -> %s)\n", c.Path, formatBytesDelta(c.SizeDelta()), shortDigest(c.Base.Digest), shortDigest(c.Head.Digest))
+	}
+	fmt.Fprintf(&buf, "%d added, %d removed, %d changed, %d unchanged, %s\n", len(d.Added), len(d.Removed), len(d.Changed), d.Unchanged, formatBytesDelta(d.SizeDelta()))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// shortDigest returns the first 12 characters of a digest, enough to tell files apart in reports.
+func shortDigest(digest string) string {
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+func formatBytesDelta(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
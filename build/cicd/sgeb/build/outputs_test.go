@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestSnapshotOutputs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"bin/tool.exe":        "tool",
+		"data/maps/a.map":     "map a",
+		"data/maps/sub/b.map": "map b",
+	}
+	for p, content := range files {
+		abs := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(abs, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uri := func(p string) string {
+		return fmt.Sprintf("file:///%s", filepath.ToSlash(filepath.Join(dir, p)))
+	}
+	result := &buildpb.BuildResult{
+		BuildResult: &buildpb.BuildInvocationResult{
+			ArtifactSet: &buildpb.ArtifactSet{
+				Artifacts: []*buildpb.Artifact{
+					{StablePath: "tool.exe", Uri: uri("bin/tool.exe")},
+					{StablePath: "maps", Uri: uri("data/maps")},
+					{StablePath: "version.txt", Contents: []byte("1.2")},
+					{Tag: "stderr", Uri: uri("bin/tool.exe")},
+					{StablePath: "remote.bin", Uri: "gs://bucket/remote.bin"},
+				},
+			},
+		},
+	}
+	unit := monorepo.Label{Pkg: "foo", Target: "bar"}
+	s, err := SnapshotOutputs(unit, "workspace", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range s.Files {
+		got = append(got, fmt.Sprintf("%s %d %s", f.Path, f.Size, f.Digest[:8]))
+	}
+	want := []string{
+		"maps/a.map 5 " + sha("map a"),
+		"maps/sub/b.map 5 " + sha("map b"),
+		"tool.exe 4 " + sha("tool"),
+		"version.txt 3 " + sha("1.2"),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SnapshotOutputs() files diff (-want +got):\n%s", diff)
+	}
+
+	p := OutputSnapshotPath(dir, unit, s.Source)
+	if err := s.Save(p); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOutputSnapshot(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(s, loaded, cmpopts.EquateApproxTime(0)); diff != "" {
+		t.Errorf("LoadOutputSnapshot() diff (-want +got):\n%s", diff)
+	}
+}
+
+// sha returns the first 8 characters of the hex SHA-256 of |s|.
+func sha(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func TestDiffOutputs(t *testing.T) {
+	base := &OutputSnapshot{
+		Unit:   "//foo:bar",
+		Source: "CL 10",
+		Files: []OutputFile{
+			{Path: "a.txt", Digest: "aaaa", Size: 10},
+			{Path: "b.txt", Digest: "bbbb", Size: 2048},
+			{Path: "c.txt", Digest: "cccc", Size: 5},
+		},
+	}
+	head := &OutputSnapshot{
+		Unit:   "//foo:bar",
+		Source: "workspace",
+		Files: []OutputFile{
+			{Path: "a.txt", Digest: "aaaa", Size: 10},
+			{Path: "b.txt", Digest: "bbbc", Size: 1024},
+			{Path: "d.txt", Digest: "dddd", Size: 7},
+		},
+	}
+	d := DiffOutputs(base, head)
+	want := &OutputDiff{
+		Unit:      "//foo:bar",
+		Base:      "CL 10",
+		Head:      "workspace",
+		Added:     []OutputFile{{Path: "d.txt", Digest: "dddd", Size: 7}},
+		Removed:   []OutputFile{{Path: "c.txt", Digest: "cccc", Size: 5}},
+		Changed:   []ChangedOutput{{Path: "b.txt", Base: base.Files[1], Head: head.Files[1]}},
+		Unchanged: 1,
+	}
+	if diff := cmp.Diff(want, d); diff != "" {
+		t.Errorf("DiffOutputs() diff (-want +got):\n%s", diff)
+	}
+	if d.Empty() {
+		t.Errorf("Empty() = true, want false")
+	}
+	if got, want := d.SizeDelta(), int64(7-5-1024); got != want {
+		t.Errorf("SizeDelta() = %d, want %d", got, want)
+	}
+	var sb strings.Builder
+	PrintOutputDiff(&sb, d)
+	wantReport := `Outputs of //foo:bar, CL 10 vs workspace:
+  A d.txt (7 B, dddd)
+  D c.txt (5 B, cccc)
+  M b.txt (-1.0 KiB, bbbb -> bbbc)
+1 added, 1 removed, 1 changed, 1 unchanged, -1022 B
+`
+	if diff := cmp.Diff(wantReport, sb.String()); diff != "" {
+		t.Errorf("PrintOutputDiff() diff (-want +got):\n%s", diff)
+	}
+
+	same := DiffOutputs(base, base)
+	if !same.Empty() || same.Unchanged != 3 {
+		t.Errorf("DiffOutputs(base, base) = %+v, want 3 unchanged files", same)
+	}
+	sb.Reset()
+	PrintOutputDiff(&sb, same)
+	if want := "Outputs of //foo:bar, CL 10 vs CL 10:\n  identical, 3 files\n"; sb.String() != want {
+		t.Errorf("PrintOutputDiff() = %q, want %q", sb.String(), want)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+)
+
+// PrefetchResult is what Prefetch fetched ahead of the builds of a target expression.
+type PrefetchResult struct {
+	// Units are the units matched by the target expression and the units they depend on.
+	Units []monorepo.Label
+
+	// Tools are the tool binaries that were built and cached.
+	Tools []monorepo.Label
+
+	// Env are the environment components that were installed.
+	Env []string
+
+	// BazelTargets are the targets whose external repositories were fetched.
+	BazelTargets []string
+
+	// Failures are the prefetches that failed. Prefetching is best effort, a failure doesn't stop
+	// the others.
+	Failures []PrefetchFailure
+}
+
+// PrefetchFailure is a prefetch that failed.
+type PrefetchFailure struct {
+	// What is what couldn't be fetched, eg. a tool label.
+	What string
+	Err  error
+}
+
+// prefetchPlan is what a target expression needs to be fetched before it can be built.
+type prefetchPlan struct {
+	units []monorepo.Label
+	// tools maps tool labels to the package of a unit that uses them, for visibility checks.
+	tools        map[monorepo.Label]monorepo.Path
+	env          []string
+	bazelTargets []string
+}
+
+func (c *context) Prefetch(te monorepo.TargetExpression, opts ...Option) (*PrefetchResult, error) {
+	options := c.cmdOpts(opts...)
+	plan, err := c.prefetchPlan(te)
+	if err != nil {
+		return nil, err
+	}
+	result := &PrefetchResult{Units: plan.units}
+	fail := func(what string, err error) {
+		fmt.Fprintf(options.Logs, "sgeb: could not prefetch %s: %v\n", what, err)
+		result.Failures = append(result.Failures, PrefetchFailure{What: what, Err: err})
+	}
+
+	// Environment components first, tool builds may require them.
+	if missing, err := missingEnv(plan.env); err != nil {
+		fail("environment components", err)
+	} else if len(missing) > 0 {
+		fmt.Fprintf(options.Logs, "Installing environment components %s\n", strings.Join(missing, ", "))
+		if err := installEnv(missing); err != nil {
+			fail(strings.Join(missing, ", "), err)
+		} else {
+			result.Env = missing
+		}
+	}
+
+	var tools []monorepo.Label
+	for l := range plan.tools {
+		tools = append(tools, l)
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].String() < tools[j].String() })
+	for _, l := range tools {
+		fmt.Fprintf(options.Logs, "Building tool %s\n", l)
+		if _, _, err := c.resolveBin(plan.tools[l], l.String(), options); err != nil {
+			fail(l.String(), err)
+			continue
+		}
+		result.Tools = append(result.Tools, l)
+	}
+
+	if len(plan.bazelTargets) > 0 {
+		fmt.Fprintf(options.Logs, "Fetching external repositories of %d Bazel targets\n", len(plan.bazelTargets))
+		if err := c.fetchBazel(plan.bazelTargets, options); err != nil {
+			fail("Bazel repositories", err)
+		} else {
+			result.BazelTargets = plan.bazelTargets
+		}
+	}
+	return result, nil
+}
+
+// prefetchPlan finds the units matched by |te| and their dependencies, and collects the tools,
+// environment components and Bazel targets they need. Tools are not followed: building them
+// fetches everything they need.
+func (c *context) prefetchPlan(te monorepo.TargetExpression) (*prefetchPlan, error) {
+	roots, err := c.prefetchRoots(te)
+	if err != nil {
+		return nil, err
+	}
+	plan := &prefetchPlan{tools: map[monorepo.Label]monorepo.Path{}}
+	seen := map[monorepo.Label]bool{}
+	seenEnv := map[string]bool{}
+	seenTarget := map[string]bool{}
+	addTarget := func(pkgDir monorepo.Path, t string) error {
+		target, err := c.Monorepo.NewLabel(pkgDir, t)
+		if err != nil {
+			return err
+		}
+		s := string(target.TargetExpression())
+		if !seenTarget[s] {
+			seenTarget[s] = true
+			plan.bazelTargets = append(plan.bazelTargets, s)
+		}
+		return nil
+	}
+	queue := roots
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		if seen[l] {
+			continue
+		}
+		seen[l] = true
+		plan.units = append(plan.units, l)
+		pkgDir, err := c.Monorepo.ResolveLabelPkgDir(l)
+		if err != nil {
+			return nil, err
+		}
+		bus, err := c.LoadBuildUnits(pkgDir)
+		if err != nil {
+			return nil, err
+		}
+		if !hasUnit(bus, l.Target) {
+			return nil, fmt.Errorf("cannot find unit %q in pkg //%s", l.Target, l.Pkg)
+		}
+		if u, ok := FindUnit(bus, l.Target); ok {
+			for _, e := range u.GetRequiresEnv() {
+				if !seenEnv[e] {
+					seenEnv[e] = true
+					plan.env = append(plan.env, e)
+				}
+			}
+		}
+		if bu, ok := c.findBuildUnit(bus, l); ok && bu.Target != "" {
+			if err := addTarget(pkgDir, bu.Target); err != nil {
+				return nil, fmt.Errorf("%s: %v", l, err)
+			}
+		}
+		if tu, ok := c.findTestUnit(bus, l); ok {
+			for _, t := range tu.Target {
+				if err := addTarget(pkgDir, t); err != nil {
+					return nil, fmt.Errorf("%s: %v", l, err)
+				}
+			}
+		}
+		for _, r := range refsOf(bus, l.Target) {
+			dep, err := c.Monorepo.NewLabel(pkgDir, r.ref)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", l, err)
+			}
+			if r.via == "bin" {
+				if _, ok := plan.tools[dep]; !ok {
+					plan.tools[dep] = pkgDir
+				}
+				continue
+			}
+			queue = append(queue, dep)
+		}
+		if ts := findTestSuite(bus, l.Target); ts != nil {
+			for _, tu := range ts.TestUnit {
+				if tu != "..." {
+					continue
+				}
+				// Test suites can include all the tests under their package.
+				tests, err := c.findAllTests(pkgDir, map[monorepo.Label]bool{})
+				if err != nil {
+					return nil, err
+				}
+				queue = append(queue, tests...)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// prefetchRoots returns the units matched by |te|: all units under a directory for "dir/...",
+// else the unit it points to.
+func (c *context) prefetchRoots(te monorepo.TargetExpression) ([]monorepo.Label, error) {
+	if !strings.HasSuffix(string(te), "/...") {
+		l, err := c.Monorepo.NewLabel("", string(te))
+		if err != nil {
+			return nil, err
+		}
+		return []monorepo.Label{l}, nil
+	}
+	l, err := c.Monorepo.NewLabel("", string(te)[:len(te)-4])
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := c.Monorepo.ResolveLabelPkgDir(l)
+	if err != nil {
+		return nil, err
+	}
+	var roots []monorepo.Label
+	err = filepath.Walk(c.Monorepo.ResolvePath(pkg), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filepath.Base(p) != "BUILDUNIT" || info.IsDir() {
+			return nil
+		}
+		buDir := strings.ReplaceAll(filepath.Dir(p), "\\", "/") // bu cache doesn't check '/' vs '\'
+		bus, err := c.buCache.loadBuildUnits(buDir)
+		if err != nil {
+			return err
+		}
+		pkgDir, err := c.Monorepo.RelPath(buDir)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, u := range Units(bus) {
+			names = append(names, u.GetName())
+		}
+		for _, btu := range bus.BuildTestUnit {
+			names = append(names, btu.Name)
+		}
+		for _, name := range names {
+			ul, err := c.Monorepo.NewLabel(pkgDir, ":"+name)
+			if err != nil {
+				return err
+			}
+			roots = append(roots, ul)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// findTestSuite returns the test suite named |name|, nil if there is none.
+func findTestSuite(bus *sgebpb.BuildUnits, name string) *sgebpb.TestSuite {
+	for _, ts := range bus.TestSuite {
+		if ts.Name == name {
+			return ts
+		}
+	}
+	return nil
+}
+
+// fetchBazel runs "bazel fetch" of the targets, which downloads the external repositories they
+// depend on without building anything.
+func (c *context) fetchBazel(targets []string, options Options) error {
+	bazelwsp, err := c.Monorepo.NewPath("", "//bin/windows/bazel.exe")
+	if err != nil {
+		return err
+	}
+	var args []string
+	args = append(args, options.BazelStartupArgs...)
+	args = append(args, "fetch")
+	args = append(args, targets...)
+	cmd := exec.Command(c.Monorepo.ResolvePath(bazelwsp), args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = c.Monorepo.Root
+	cmd.Stdout = options.Logs
+	cmd.Stderr = options.Logs
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("bazel fetch failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/sgetest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrefetchPlan(t *testing.T) {
+	files := map[string]string{
+		"MONOREPO":  "",
+		"WORKSPACE": "",
+		"game/BUILDUNIT": `
+publish_unit {
+  name: "publish"
+  bin: "//tools/uploader:uploader"
+  build_unit: ":game"
+  build_unit: "//game/assets:cook"
+}
+
+build_unit {
+  name: "game"
+  target: "//game/src:game"
+  requires_env: "vs2019"
+}
+`,
+		"game/assets/BUILDUNIT": `
+build_unit {
+  name: "cook"
+  bin: "//tools/cooker:cooker"
+  deps: "//engine:shaders"
+  requires_env: "vs2019"
+  requires_env: "ue4-prereqs"
+}
+`,
+		"tools/cooker/BUILDUNIT": `
+build_unit {
+  name: "cooker"
+  target: ":cooker_bin"
+}
+`,
+		"tools/uploader/BUILDUNIT": `
+build_unit {
+  name: "uploader"
+  bin: "build.exe"
+}
+`,
+		"engine/BUILDUNIT": `
+build_unit {
+  name: "shaders"
+  bin: "//tools/cooker:cooker"
+}
+
+test_unit {
+  name: "shaders_test"
+  target: ":shaders_test"
+}
+`,
+	}
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatalf("could not load monorepo from %s: %v", wsDir, err)
+	}
+	bc, err := NewContext(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+
+	type plan struct {
+		Units        []string
+		Tools        []string
+		Env          []string
+		BazelTargets []string
+	}
+	testCases := []struct {
+		name    string
+		te      string
+		want    plan
+		wantErr bool
+	}{
+		{
+			name: "unit",
+			te:   "//game:publish",
+			want: plan{
+				Units:        []string{"//engine:shaders", "//game/assets:cook", "//game:game", "//game:publish"},
+				Tools:        []string{"//tools/cooker:cooker", "//tools/uploader:uploader"},
+				Env:          []string{"ue4-prereqs", "vs2019"},
+				BazelTargets: []string{"//game/src:game"},
+			},
+		},
+		{
+			name: "directory",
+			te:   "//engine/...",
+			want: plan{
+				Units:        []string{"//engine:shaders", "//engine:shaders_test"},
+				Tools:        []string{"//tools/cooker:cooker"},
+				BazelTargets: []string{"//engine:shaders_test"},
+			},
+		},
+		{
+			name: "tools are not followed",
+			te:   "//game/assets:cook",
+			want: plan{
+				Units: []string{"//engine:shaders", "//game/assets:cook"},
+				Tools: []string{"//tools/cooker:cooker"},
+				Env:   []string{"ue4-prereqs", "vs2019"},
+			},
+		},
+		{
+			name:    "unknown unit",
+			te:      "//game:nope",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := bc.(*context).prefetchPlan(monorepo.TargetExpression(tc.te))
+			if tc.wantErr {
+				if err == nil {
+					t.Error("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got plan
+			for _, l := range p.units {
+				got.Units = append(got.Units, l.String())
+			}
+			for l := range p.tools {
+				got.Tools = append(got.Tools, l.String())
+			}
+			got.Env = p.env
+			got.BazelTargets = p.bazelTargets
+			for _, s := range [][]string{got.Units, got.Tools, got.Env, got.BazelTargets} {
+				sort.Strings(s)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("plan diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
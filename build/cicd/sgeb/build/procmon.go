@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// procmonTracer traces file accesses with Sysinternals Process Monitor, which records them
+// through its kernel driver on Windows. Process Monitor needs administrator rights.
+type procmonTracer struct{}
+
+// procmonOperations are the operations through which tools look for and read files.
+var procmonOperations = map[string]bool{
+	"CreateFile":     true,
+	"QueryOpen":      true,
+	"Load Image":     true,
+	"Process Create": true,
+}
+
+// procmonChildRegex matches the detail of "Process Create" events, capturing the child's pid.
+var procmonChildRegex = regexp.MustCompile(`^PID: (\d+),`)
+
+func procmonPath() (string, error) {
+	for _, name := range []string{"Procmon64.exe", "Procmon.exe"} {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("tracing file accesses needs Process Monitor (Procmon64.exe) in the PATH")
+}
+
+// run captures all events in a backing file while |cmd| runs, then saves them as CSV in
+// |traceFile|, after a first line with the pid of |cmd|. Events of other processes are filtered
+// out when reading the trace, as Process Monitor filters can only be set from its UI.
+func (procmonTracer) run(cmd *exec.Cmd, traceFile string) error {
+	procmon, err := procmonPath()
+	if err != nil {
+		return err
+	}
+	backing := traceFile + ".pml"
+	capture := exec.Command(procmon, "/AcceptEula", "/Quiet", "/Minimized", "/BackingFile", backing)
+	if err := capture.Start(); err != nil {
+		return fmt.Errorf("could not start Process Monitor: %v", err)
+	}
+	defer os.Remove(backing)
+	if out, err := exec.Command(procmon, "/WaitForIdle").CombinedOutput(); err != nil {
+		capture.Process.Kill()
+		return fmt.Errorf("Process Monitor didn't start capturing: %v: %s", err, out)
+	}
+	runErr := cmd.Start()
+	pid := 0
+	if runErr == nil {
+		pid = cmd.Process.Pid
+		runErr = cmd.Wait()
+	}
+	if out, err := exec.Command(procmon, "/Terminate").CombinedOutput(); err != nil {
+		capture.Process.Kill()
+		return fmt.Errorf("could not stop Process Monitor: %v: %s", err, out)
+	}
+	capture.Wait()
+	if pid == 0 {
+		return runErr
+	}
+	csvFile := traceFile + ".csv"
+	defer os.Remove(csvFile)
+	if out, err := exec.Command(procmon, "/AcceptEula", "/Quiet", "/OpenLog", backing, "/SaveAs", csvFile).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not save the trace of Process Monitor: %v: %s", err, out)
+	}
+	events, err := ioutil.ReadFile(csvFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(traceFile, append([]byte(fmt.Sprintf("%d\n", pid)), events...), 0644); err != nil {
+		return err
+	}
+	return runErr
+}
+
+func (procmonTracer) accesses(traceFile, dir string) ([]fileAccess, error) {
+	f, err := os.Open(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcmon(f, dir)
+}
+
+// parseProcmon returns the file accesses of a trace saved by procmonTracer: the pid of the
+// traced process, then the events in CSV, as exported by Process Monitor. Only the events of the
+// traced process and its children are kept.
+func parseProcmon(r io.Reader, dir string) ([]fileAccess, error) {
+	br := bufio.NewReader(r)
+	first, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("could not read the traced pid: %v", err)
+	}
+	root, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the traced pid %q: %v", first, err)
+	}
+	// Exports start with a byte order mark.
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\ufeff" {
+		br.Discard(3)
+	}
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the trace header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"PID", "Operation", "Path", "Result", "Detail"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("the trace has no %s column", name)
+		}
+	}
+	dir = strings.ReplaceAll(dir, `\`, "/")
+	traced := map[int]bool{root: true}
+	var accesses []fileAccess
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) < len(header) {
+			continue
+		}
+		pid, err := strconv.Atoi(record[columns["PID"]])
+		if err != nil || !traced[pid] {
+			continue
+		}
+		op := record[columns["Operation"]]
+		if !procmonOperations[op] {
+			continue
+		}
+		if op == "Process Create" {
+			if m := procmonChildRegex.FindStringSubmatch(record[columns["Detail"]]); m != nil {
+				child, _ := strconv.Atoi(m[1])
+				traced[child] = true
+			}
+		}
+		p := strings.ReplaceAll(record[columns["Path"]], `\`, "/")
+		if p == "" || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "HK") {
+			// Devices, pipes and registry keys.
+			continue
+		}
+		if !isWindowsAbs(p) {
+			p = path.Join(dir, p)
+		}
+		result := record[columns["Result"]]
+		accesses = append(accesses, fileAccess{
+			path:    path.Clean(p),
+			missing: result == "NAME NOT FOUND" || result == "PATH NOT FOUND",
+		})
+	}
+	return accesses, nil
+}
+
+// isWindowsAbs returns whether slash separated |p| is an absolute Windows path, eg. "C:/foo".
+// filepath.IsAbs only knows about the paths of the platform sgeb runs on.
+func isWindowsAbs(p string) bool {
+	return len(p) >= 3 && p[1] == ':' && p[2] == '/'
+}
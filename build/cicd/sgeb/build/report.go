@@ -0,0 +1,328 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sge-monorepo/build/cicd/bep"
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	bepb "bazel.io/src/main/java/com/google/devtools/build/lib/buildeventstream/proto"
+)
+
+// Report is the report card of an sgeb invocation: where the time went, what was reused and what
+// was produced. Set Options.Report to have a context record the units it runs into a report.
+// Reports are safe for concurrent use, and a nil report records nothing.
+type Report struct {
+	Command string `json:"command"`
+	// StartTime is the unix time of the start of the invocation.
+	StartTime int64 `json:"startTime"`
+	// WallTimeMs is the duration of the invocation, set by Finish.
+	WallTimeMs int64 `json:"wallTimeMs"`
+	Success    bool  `json:"success"`
+	// Units are the units run by the invocation in the order they started. Units run by other
+	// units, eg. the build units of a test unit, are also listed so their times overlap.
+	Units []*UnitReport `json:"units"`
+	// Bazel sums the metrics of all the Bazel commands run by the invocation.
+	Bazel BazelMetrics `json:"bazel"`
+
+	mu      sync.Mutex
+	start   time.Time
+	running []*UnitReport
+}
+
+// UnitReport is the report of a unit run by an invocation.
+type UnitReport struct {
+	Label string `json:"label"`
+	// Kind is "build", "test" or "publish".
+	Kind       string `json:"kind"`
+	Success    bool   `json:"success"`
+	DurationMs int64  `json:"durationMs"`
+	// Cached is set when the result of an earlier run of the unit in the invocation was reused.
+	Cached bool `json:"cached,omitempty"`
+	// ArtifactBytes is the size of the artifacts built or the files published by the unit.
+	ArtifactBytes int64 `json:"artifactBytes,omitempty"`
+	// Bazel are the metrics of the Bazel commands run by the unit itself.
+	Bazel BazelMetrics `json:"bazel"`
+
+	start time.Time
+}
+
+// BazelMetrics are metrics of Bazel commands, from their build event streams.
+type BazelMetrics struct {
+	Commands int `json:"commands"`
+	// ActionsCreated counts the actions of the build graph, ActionsExecuted the ones that weren't
+	// cache hits.
+	ActionsCreated  int64 `json:"actionsCreated"`
+	ActionsExecuted int64 `json:"actionsExecuted"`
+	// CriticalPathMs is the duration of the critical path of the commands.
+	CriticalPathMs int64 `json:"criticalPathMs"`
+}
+
+func (m *BazelMetrics) add(o BazelMetrics) {
+	m.Commands += o.Commands
+	m.ActionsCreated += o.ActionsCreated
+	m.ActionsExecuted += o.ActionsExecuted
+	m.CriticalPathMs += o.CriticalPathMs
+}
+
+// NewReport returns an empty report of invocation |command| starting now.
+func NewReport(command string) *Report {
+	now := time.Now()
+	return &Report{
+		Command:   command,
+		StartTime: now.Unix(),
+		start:     now,
+	}
+}
+
+// begin records the start of unit |label| of |kind|.
+func (r *Report) begin(label monorepo.Label, kind string) *UnitReport {
+	if r == nil {
+		return nil
+	}
+	u := &UnitReport{Label: label.String(), Kind: kind, start: time.Now()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Units = append(r.Units, u)
+	r.running = append(r.running, u)
+	return u
+}
+
+// end records the end of unit |u| which produced |artifactBytes|.
+func (r *Report) end(u *UnitReport, success bool, artifactBytes int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u.Success = success
+	u.DurationMs = time.Since(u.start).Milliseconds()
+	u.ArtifactBytes = artifactBytes
+	for i := len(r.running) - 1; i >= 0; i-- {
+		if r.running[i] == u {
+			r.running = append(r.running[:i], r.running[i+1:]...)
+			break
+		}
+	}
+}
+
+// cached records that the result of unit |label| of |kind| was reused.
+func (r *Report) cached(label monorepo.Label, kind string, success bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Units = append(r.Units, &UnitReport{Label: label.String(), Kind: kind, Success: success, Cached: true})
+}
+
+// addBazel records the metrics of a Bazel command, run by the innermost running unit.
+func (r *Report) addBazel(m BazelMetrics) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Bazel.add(m)
+	if n := len(r.running); n > 0 {
+		r.running[n-1].Bazel.add(m)
+	}
+}
+
+// Finish records the end of the invocation.
+func (r *Report) Finish(success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Success = success
+	r.WallTimeMs = time.Since(r.start).Milliseconds()
+}
+
+// CacheHits returns the number of units whose results were reused.
+func (r *Report) CacheHits() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, u := range r.Units {
+		if u.Cached {
+			n++
+		}
+	}
+	return n
+}
+
+// ArtifactBytes returns the size of the artifacts produced by the invocation.
+func (r *Report) ArtifactBytes() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, u := range r.Units {
+		n += u.ArtifactBytes
+	}
+	return n
+}
+
+// Slowest returns the |max| slowest units that ran, slowest first.
+func (r *Report) Slowest(max int) []*UnitReport {
+	r.mu.Lock()
+	var units []*UnitReport
+	for _, u := range r.Units {
+		if !u.Cached {
+			units = append(units, u)
+		}
+	}
+	r.mu.Unlock()
+	sort.SliceStable(units, func(i, j int) bool {
+		return units[i].DurationMs > units[j].DurationMs
+	})
+	if len(units) > max {
+		units = units[:max]
+	}
+	return units
+}
+
+// Print prints a summary of the report with its |max| slowest units.
+func (r *Report) Print(w io.Writer, max int) {
+	fmt.Fprintf(w, "sgeb report card for %s: %s wall time\n", r.Command, formatMs(r.WallTimeMs))
+	if slowest := r.Slowest(max); len(slowest) > 0 {
+		fmt.Fprintf(w, "  Slowest units:\n")
+		for _, u := range slowest {
+			status := ""
+			if !u.Success {
+				status = " (failed)"
+			}
+			fmt.Fprintf(w, "    %8s  %-7s %s%s\n", formatMs(u.DurationMs), u.Kind, u.Label, status)
+		}
+	}
+	fmt.Fprintf(w, "  Cache hits: %d of %d units\n", r.CacheHits(), len(r.Units))
+	fmt.Fprintf(w, "  Artifacts: %s\n", formatBytes(r.ArtifactBytes()))
+	if r.Bazel.Commands > 0 {
+		fmt.Fprintf(w, "  Bazel: %d command(s), %d of %d actions executed, critical path %s\n",
+			r.Bazel.Commands, r.Bazel.ActionsExecuted, r.Bazel.ActionsCreated, formatMs(r.Bazel.CriticalPathMs))
+	}
+}
+
+// Write writes the report as JSON to file |p|.
+func (r *Report) Write(p string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+func formatMs(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).Round(100 * time.Millisecond).String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// criticalPathRe matches the critical path log of Bazel, eg. "Critical Path: 12.34s, ...".
+var criticalPathRe = regexp.MustCompile(`Critical Path: ([\d.]+)s`)
+
+// bazelMetrics returns the metrics of the Bazel command of build event stream |s|.
+func bazelMetrics(s *bep.Stream) BazelMetrics {
+	m := BazelMetrics{Commands: 1}
+	for _, be := range s.Events {
+		switch p := be.Payload.(type) {
+		case *bepb.BuildEvent_BuildMetrics:
+			m.ActionsCreated += p.BuildMetrics.GetActionSummary().GetActionsCreated()
+			m.ActionsExecuted += p.BuildMetrics.GetActionSummary().GetActionsExecuted()
+		case *bepb.BuildEvent_BuildToolLogs:
+			for _, f := range p.BuildToolLogs.GetLog() {
+				if f.Name != "critical path" {
+					continue
+				}
+				if match := criticalPathRe.FindSubmatch(f.GetContents()); match != nil {
+					if secs, err := strconv.ParseFloat(string(match[1]), 64); err == nil {
+						m.CriticalPathMs += int64(secs * 1000)
+					}
+				}
+			}
+		}
+	}
+	return m
+}
+
+// artifactBytes returns the size of |artifacts|. The sizes of files that can't be read are
+// skipped.
+func artifactBytes(artifacts []*buildpb.Artifact) int64 {
+	var n int64
+	for _, a := range artifacts {
+		if len(a.Contents) > 0 {
+			n += int64(len(a.Contents))
+			continue
+		}
+		if !strings.HasPrefix(a.Uri, "file:///") {
+			continue
+		}
+		p := strings.TrimPrefix(a.Uri, "file:///")
+		if !filepath.IsAbs(p) {
+			p = "/" + p
+		}
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			n += info.Size()
+		}
+	}
+	return n
+}
+
+// buildResultBytes returns the size of the artifacts of |result|.
+func buildResultBytes(result *buildpb.BuildResult) int64 {
+	if result == nil || result.BuildResult == nil || result.BuildResult.ArtifactSet == nil {
+		return 0
+	}
+	return artifactBytes(result.BuildResult.ArtifactSet.Artifacts)
+}
+
+// publishResultBytes returns the size of the files published in |results|.
+func publishResultBytes(results []*buildpb.PublishResult) int64 {
+	var n int64
+	for _, r := range results {
+		for _, f := range r.Files {
+			n += f.Size
+		}
+	}
+	return n
+}
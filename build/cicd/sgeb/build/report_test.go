@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sge-monorepo/build/cicd/bep"
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	bepb "bazel.io/src/main/java/com/google/devtools/build/lib/buildeventstream/proto"
+)
+
+func TestReport(t *testing.T) {
+	r := NewReport("test")
+	test := r.begin(monorepo.Label{Pkg: "foo", Target: "tests"}, "test")
+	bin := r.begin(monorepo.Label{Pkg: "foo", Target: "bin"}, "build")
+	r.addBazel(BazelMetrics{Commands: 1, ActionsCreated: 10, ActionsExecuted: 4, CriticalPathMs: 2000})
+	bin.start = bin.start.Add(-3 * time.Second)
+	r.end(bin, true, 1024)
+	r.cached(monorepo.Label{Pkg: "foo", Target: "bin"}, "build", true)
+	r.addBazel(BazelMetrics{Commands: 1, ActionsCreated: 5, ActionsExecuted: 5, CriticalPathMs: 1000})
+	r.end(test, false, 0)
+	r.Finish(false)
+
+	if got, want := r.Bazel, (BazelMetrics{Commands: 2, ActionsCreated: 15, ActionsExecuted: 9, CriticalPathMs: 3000}); got != want {
+		t.Errorf("Bazel = %+v, want %+v", got, want)
+	}
+	if got, want := bin.Bazel, (BazelMetrics{Commands: 1, ActionsCreated: 10, ActionsExecuted: 4, CriticalPathMs: 2000}); got != want {
+		t.Errorf("bin Bazel = %+v, want %+v", got, want)
+	}
+	if got, want := test.Bazel.Commands, 1; got != want {
+		t.Errorf("test Bazel commands = %d, want %d", got, want)
+	}
+	if got, want := r.CacheHits(), 1; got != want {
+		t.Errorf("CacheHits() = %d, want %d", got, want)
+	}
+	if got, want := r.ArtifactBytes(), int64(1024); got != want {
+		t.Errorf("ArtifactBytes() = %d, want %d", got, want)
+	}
+	slowest := r.Slowest(1)
+	if len(slowest) != 1 || slowest[0] != bin {
+		t.Errorf("Slowest(1) = %v, want [%v]", slowest, bin)
+	}
+	if got := r.Slowest(5); len(got) != 2 {
+		t.Errorf("Slowest(5) returned %d units, want 2 as cached units didn't run", len(got))
+	}
+
+	buf := &bytes.Buffer{}
+	r.Print(buf, 5)
+	for _, want := range []string{
+		"report card for test",
+		"//foo:bin",
+		"//foo:tests (failed)",
+		"Cache hits: 1 of 3 units",
+		"Artifacts: 1.0 KiB",
+		"9 of 15 actions executed, critical path 3s",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Print() = %q, want it to contain %q", buf.String(), want)
+		}
+	}
+
+	p := filepath.Join(t.TempDir(), "sgeb-out", "report.json")
+	if err := r.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Report
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Command != "test" || got.Success || len(got.Units) != 3 || got.Bazel != r.Bazel {
+		t.Errorf("written report = %+v, want %+v", &got, r)
+	}
+}
+
+func TestNilReport(t *testing.T) {
+	var r *Report
+	u := r.begin(monorepo.Label{Pkg: "foo", Target: "bin"}, "build")
+	r.addBazel(BazelMetrics{Commands: 1})
+	r.cached(monorepo.Label{Pkg: "foo", Target: "bin"}, "build", true)
+	r.end(u, true, 1)
+}
+
+func TestBazelMetrics(t *testing.T) {
+	s := &bep.Stream{
+		Events: map[uint64]*bepb.BuildEvent{
+			1: {
+				Payload: &bepb.BuildEvent_BuildMetrics{
+					BuildMetrics: &bepb.BuildMetrics{
+						ActionSummary: &bepb.BuildMetrics_ActionSummary{
+							ActionsCreated:  120,
+							ActionsExecuted: 7,
+						},
+					},
+				},
+			},
+			2: {
+				Payload: &bepb.BuildEvent_BuildToolLogs{
+					BuildToolLogs: &bepb.BuildToolLogs{
+						Log: []*bepb.File{
+							{Name: "elapsed time", File: &bepb.File_Contents{Contents: []byte("12.300000")}},
+							{Name: "critical path", File: &bepb.File_Contents{Contents: []byte("Critical Path: 4.52s, Remote (0.00% of the time): [queue: 0.00%]")}},
+						},
+					},
+				},
+			},
+		},
+	}
+	got := bazelMetrics(s)
+	want := BazelMetrics{Commands: 1, ActionsCreated: 120, ActionsExecuted: 7, CriticalPathMs: 4520}
+	if got != want {
+		t.Errorf("bazelMetrics() = %+v, want %+v", got, want)
+	}
+}
+
+func TestArtifactBytes(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "out.bin")
+	if err := ioutil.WriteFile(p, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := &buildpb.BuildResult{
+		BuildResult: &buildpb.BuildInvocationResult{
+			ArtifactSet: &buildpb.ArtifactSet{
+				Artifacts: []*buildpb.Artifact{
+					{Uri: "file:///" + filepath.ToSlash(p)},
+					{Uri: "file:///" + filepath.ToSlash(filepath.Join(dir, "missing"))},
+					{Contents: []byte("hello")},
+					{Uri: "gs://bucket/remote"},
+				},
+			},
+		},
+	}
+	if got, want := buildResultBytes(result), int64(105); got != want {
+		t.Errorf("buildResultBytes() = %d, want %d", got, want)
+	}
+	if got := buildResultBytes(nil); got != 0 {
+		t.Errorf("buildResultBytes(nil) = %d, want 0", got)
+	}
+	published := []*buildpb.PublishResult{
+		{Files: []*buildpb.PublishedFile{{Size: 10}, {Size: 20}}},
+		{Files: []*buildpb.PublishedFile{{Size: 5}}},
+	}
+	if got, want := publishResultBytes(published), int64(35); got != want {
+		t.Errorf("publishResultBytes() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// FailedTests records the targets that failed in Bazel test units by unit and CL, so that the next
+// run of a unit at the same CL can rerun only them, see Options.RerunFailed.
+type FailedTests struct {
+	// Dir holds a file per unit and CL.
+	Dir string
+	// Cl is the CL the tests run at, eg. the CL the workspace is synced to, 0 if unknown.
+	Cl int64
+}
+
+// NewFailedTests returns the failed tests at |cl| recorded in the output directory |outputDir|.
+func NewFailedTests(outputDir string, cl int64) *FailedTests {
+	return &FailedTests{Dir: filepath.Join(outputDir, "failed_tests"), Cl: cl}
+}
+
+type failedTestsFile struct {
+	Unit    string   `json:"unit"`
+	Cl      int64    `json:"cl"`
+	Targets []string `json:"targets"`
+}
+
+func (ft *FailedTests) path(unit monorepo.Label, cl int64) string {
+	return filepath.Join(ft.Dir, fmt.Sprintf("%s@%d.json", url.QueryEscape(unit.String()), cl))
+}
+
+// Load returns the targets of |unit| that failed in its last run, nil if none did or it didn't run.
+// Without a record at the CL, the failures recorded at an unknown CL are returned.
+func (ft *FailedTests) Load(unit monorepo.Label) ([]string, error) {
+	data, err := ioutil.ReadFile(ft.path(unit, ft.Cl))
+	if os.IsNotExist(err) && ft.Cl != 0 {
+		data, err = ioutil.ReadFile(ft.path(unit, 0))
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f failedTestsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("could not parse failed tests of %s: %v", unit, err)
+	}
+	return f.Targets, nil
+}
+
+// Record records |targets| as the failed targets of |unit|, clearing the record if there are none,
+// along with the one at an unknown CL that Load falls back to.
+func (ft *FailedTests) Record(unit monorepo.Label, targets []string) error {
+	p := ft.path(unit, ft.Cl)
+	if len(targets) == 0 {
+		for _, p := range []string{p, ft.path(unit, 0)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(&failedTestsFile{Unit: unit.String(), Cl: ft.Cl, Targets: targets}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ft.Dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+// failedTestTargets returns the targets that failed in |result|, sorted.
+func failedTestTargets(result *buildpb.TestInvocationResult) []string {
+	seen := map[string]bool{}
+	var targets []string
+	for _, r := range result.GetResults() {
+		// Tests report a result per shard and attempt.
+		if r.Success || seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+		targets = append(targets, r.Name)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// HaveCl returns the latest submitted CL synced to the workspace of |p4|.
+func HaveCl(p4 p4lib.P4) (int64, error) {
+	changes, err := p4.Changes("-m1", "-s", "submitted", "//...#have")
+	if err != nil {
+		return 0, fmt.Errorf("could not get the CL the workspace is synced to: %v", err)
+	}
+	if len(changes) == 0 {
+		return 0, fmt.Errorf("could not get the CL the workspace is synced to: no changes")
+	}
+	return int64(changes[0].Cl), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFailedTests(t *testing.T) {
+	dir := t.TempDir()
+	unit := monorepo.Label{Pkg: "game", Target: "tests"}
+	ft := NewFailedTests(dir, 120)
+	if got, err := ft.Load(unit); err != nil || got != nil {
+		t.Fatalf("Load() of a unit without record = %v, %v, want none", got, err)
+	}
+	result := &buildpb.TestInvocationResult{Results: []*buildpb.Result{
+		{Name: "//game:b_test", Success: false},
+		{Name: "//game:a_test", Success: true},
+		{Name: "//game:c_test", Success: false},
+		// Another shard of b_test.
+		{Name: "//game:b_test", Success: false},
+	}}
+	want := []string{"//game:b_test", "//game:c_test"}
+	if err := ft.Record(unit, failedTestTargets(result)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ft.Load(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Load() diff (-want +got):\n%s", diff)
+	}
+	// Failures are keyed by CL.
+	if got, err := NewFailedTests(dir, 121).Load(unit); err != nil || got != nil {
+		t.Errorf("Load() at another CL = %v, %v, want none", got, err)
+	}
+	if err := ft.Record(unit, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ft.Load(unit); err != nil || got != nil {
+		t.Errorf("Load() after clearing = %v, %v, want none", got, err)
+	}
+}
+
+func TestFailedTestsUnknownCl(t *testing.T) {
+	dir := t.TempDir()
+	unit := monorepo.Label{Pkg: "game", Target: "tests"}
+	// Runs without -cl record at an unknown CL, which runs at a CL fall back to.
+	if err := NewFailedTests(dir, 0).Record(unit, []string{"//game:a_test"}); err != nil {
+		t.Fatal(err)
+	}
+	ft := NewFailedTests(dir, 120)
+	got, err := ft.Load(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"//game:a_test"}, got); diff != "" {
+		t.Errorf("Load() diff (-want +got):\n%s", diff)
+	}
+	// Records at the CL come first.
+	if err := ft.Record(unit, []string{"//game:b_test"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ft.Load(unit); err != nil || len(got) != 1 || got[0] != "//game:b_test" {
+		t.Errorf("Load() = %v, %v, want the failures at the CL", got, err)
+	}
+	// Passing clears both.
+	if err := ft.Record(unit, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ft.Load(unit); err != nil || got != nil {
+		t.Errorf("Load() after clearing = %v, %v, want none", got, err)
+	}
+}
+
+func TestHaveCl(t *testing.T) {
+	p4 := p4mock.New()
+	p4.ChangesFunc = func(args ...string) ([]p4lib.Change, error) {
+		if diff := cmp.Diff([]string{"-m1", "-s", "submitted", "//...#have"}, args); diff != "" {
+			t.Errorf("Changes() args diff (-want +got):\n%s", diff)
+		}
+		return []p4lib.Change{{Cl: 42}}, nil
+	}
+	cl, err := HaveCl(p4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl != 42 {
+		t.Errorf("HaveCl() = %d, want 42", cl)
+	}
+}
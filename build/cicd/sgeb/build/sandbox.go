@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/libs/go/files"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// sandbox is a directory mirroring the monorepo with only the files a build unit declares: the
+// files at the root of the monorepo, eg. MONOREPO and WORKSPACE, its package and the artifacts of
+// its deps. Tools run in it in strict mode, so that reading any other file of the monorepo fails
+// as it would on a clean machine, rather than succeeding because the workspace happens to have it.
+type sandbox struct {
+	mr   monorepo.Monorepo
+	root string
+}
+
+// materialize materializes the sandbox of the unit of package |pkgDir| with the artifacts
+// |inputs|. Returns the inputs with the artifacts of the monorepo pointing into the sandbox.
+func (sb *sandbox) materialize(pkgDir monorepo.Path, inputs []*buildpb.ArtifactSet) ([]*buildpb.ArtifactSet, error) {
+	if err := os.MkdirAll(sb.root, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(sb.mr.Root)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			if err := linkOrCopy(filepath.Join(sb.mr.Root, e.Name()), filepath.Join(sb.root, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// The files of the root package are the ones at the root, materialized above.
+	if pkgDir != "" {
+		if err := linkOrCopy(sb.mr.ResolvePath(pkgDir), filepath.Join(sb.root, filepath.FromSlash(string(pkgDir)))); err != nil {
+			return nil, fmt.Errorf("could not materialize package %s: %v", pkgDir, err)
+		}
+	}
+	var ret []*buildpb.ArtifactSet
+	for _, as := range inputs {
+		as = proto.Clone(as).(*buildpb.ArtifactSet)
+		for _, a := range as.GetArtifacts() {
+			p, ok := sb.path(artifactPath(a))
+			if !ok {
+				continue
+			}
+			if err := linkOrCopy(filepath.FromSlash(artifactPath(a)), p); err != nil {
+				return nil, fmt.Errorf("could not materialize artifact %s: %v", a.Uri, err)
+			}
+			a.Uri = fmt.Sprintf("file:///%s", p)
+		}
+		ret = append(ret, as)
+	}
+	return ret, nil
+}
+
+// path returns the path in the sandbox of the absolute, slash separated path |abs| of a file of
+// the monorepo, and whether it is in the monorepo.
+func (sb *sandbox) path(abs string) (string, bool) {
+	root := filepath.ToSlash(sb.mr.Root)
+	if abs == "" || !isUnder(abs, root) {
+		return "", false
+	}
+	return filepath.Join(sb.root, filepath.FromSlash(strings.TrimPrefix(abs, root))), true
+}
+
+// monorepoAccess returns |acc| in the monorepo if it happened in the sandbox. Files that exist in
+// the monorepo but were missing from the sandbox are the undeclared inputs strict mode blocked,
+// and are reported as read.
+func (sb *sandbox) monorepoAccess(acc fileAccess) fileAccess {
+	root := filepath.ToSlash(sb.root)
+	if !isUnder(acc.path, root) {
+		return acc
+	}
+	acc.path = filepath.ToSlash(sb.mr.Root) + strings.TrimPrefix(acc.path, root)
+	if acc.missing {
+		_, err := os.Stat(filepath.FromSlash(acc.path))
+		acc.missing = err != nil
+	}
+	return acc
+}
+
+// linkOrCopy makes the file or directory |src| available at |dst|, hard linking files where it
+// can to avoid copying large inputs, and copying them otherwise, eg. across volumes.
+func linkOrCopy(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		children, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := linkOrCopy(filepath.Join(src, child.Name()), filepath.Join(dst, child.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		// Already there, eg. an artifact in the package of the unit.
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return files.CopyEx(src, dst, info.Mode().Perm())
+}
@@ -0,0 +1,452 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+	"sge-monorepo/libs/go/log"
+)
+
+const (
+	// serviceHost is the host services listen on.
+	serviceHost = "localhost"
+	// defaultHealthTimeout is how long services have to become healthy by default.
+	defaultHealthTimeout = 30 * time.Second
+	// healthCheckInterval is the time between health checks while a service starts.
+	healthCheckInterval = 200 * time.Millisecond
+	// serviceStopTimeout is how long Stop waits for a killed service to exit.
+	serviceStopTimeout = 10 * time.Second
+)
+
+// Service is a running service unit.
+type Service struct {
+	Label monorepo.Label
+	// Ports are the ports the service listens on, by name.
+	Ports map[string]int
+	// LogPath is the file the output of the service is written to, across restarts.
+	LogPath string
+
+	su      *sgebpb.ServiceUnit
+	bin     string
+	args    []string
+	dir     string
+	ih      *invocationHelper
+	logFile *os.File
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	restarts int
+	stopping bool
+	// exitErr is set when the service exited for good.
+	exitErr error
+	// done is closed once the service exited for good or was stopped.
+	done chan struct{}
+}
+
+// Services are service units started together, see Context.StartServices.
+type Services struct {
+	services []*Service
+}
+
+// List returns the services, in the order they were started.
+func (s *Services) List() []*Service {
+	return s.services
+}
+
+// Running returns the services as passed to the tools of dependent units.
+func (s *Services) Running() []*buildpb.RunningService {
+	var running []*buildpb.RunningService
+	for _, svc := range s.services {
+		rs := &buildpb.RunningService{
+			Label: svc.Label.String(),
+			Host:  serviceHost,
+			Ports: map[string]int32{},
+		}
+		for name, port := range svc.Ports {
+			rs.Ports[name] = int32(port)
+		}
+		running = append(running, rs)
+	}
+	return running
+}
+
+// Env returns the ports of the services as "SGE_SERVICE_<NAME>_<PORT>=<port>" environment
+// variables, eg. SGE_SERVICE_ASSET_SERVER_HTTP=50123 for port "http" of //tools:asset_server.
+func (s *Services) Env() []string {
+	var env []string
+	for _, svc := range s.services {
+		var names []string
+		for name := range svc.Ports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			env = append(env, fmt.Sprintf("%s=%d", ServiceEnvVar(svc.Label, name), svc.Ports[name]))
+		}
+	}
+	return env
+}
+
+// ServiceEnvVar returns the name of the environment variable holding port |port| of service
+// unit |label|.
+func ServiceEnvVar(label monorepo.Label, port string) string {
+	sanitize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, strings.ToUpper(s))
+	}
+	return fmt.Sprintf("SGE_SERVICE_%s_%s", sanitize(label.Target), sanitize(port))
+}
+
+// Stop stops the services, in the reverse order they were started.
+func (s *Services) Stop() error {
+	var errs []string
+	for i := len(s.services) - 1; i >= 0; i-- {
+		if err := s.services[i].stop(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not stop services: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Wait blocks until one of the services exits for good, and returns why.
+func (s *Services) Wait() error {
+	cases := make(chan *Service, len(s.services))
+	for _, svc := range s.services {
+		go func(svc *Service) {
+			<-svc.done
+			cases <- svc
+		}(svc)
+	}
+	svc := <-cases
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.exitErr
+}
+
+func (c *context) StartServices(labels []monorepo.Label, opts ...Option) (*Services, error) {
+	options := c.cmdOpts(opts...)
+	return c.startServices(labels, options)
+}
+
+// startServices starts the service units in order and waits for each to be healthy. If one fails
+// to start, the ones already started are stopped.
+func (c *context) startServices(labels []monorepo.Label, options Options) (*Services, error) {
+	services := &Services{}
+	for _, l := range labels {
+		svc, err := c.startService(l, options)
+		if err != nil {
+			if serr := services.Stop(); serr != nil {
+				log.Warning(serr)
+			}
+			return nil, err
+		}
+		services.services = append(services.services, svc)
+	}
+	return services, nil
+}
+
+// dependentServices resolves the service units listed by a unit of package |pkgDir|.
+func (c *context) dependentServices(pkgDir monorepo.Path, names []string, options Options) ([]monorepo.Label, error) {
+	var labels []monorepo.Label
+	for _, name := range names {
+		l, err := c.Monorepo.NewLabel(pkgDir, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.checkVisibility(pkgDir, l, options); err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+	}
+	return labels, nil
+}
+
+func (c *context) startService(label monorepo.Label, options Options) (*Service, error) {
+	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(label)
+	if err != nil {
+		return nil, err
+	}
+	bus, err := c.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	su, ok := c.findServiceUnit(bus, label)
+	if !ok {
+		return nil, fmt.Errorf("cannot find service unit %q in pkg //%s", label.Target, label.Pkg)
+	}
+	warnDeprecated(options.Logs, label, su)
+	if err := checkRequiredEnv(options.Logs, label, su, options.InstallMissingEnv); err != nil {
+		return nil, err
+	}
+	bin, binResult, err := c.resolveBin(pkgDir, su.Bin, options)
+	if err != nil {
+		if binResult != nil {
+			PrintFailedBuildResult(options.Logs, binResult)
+		}
+		return nil, err
+	}
+	ports := map[string]int{}
+	invPorts := map[string]int32{}
+	for _, name := range su.Port {
+		port, err := freePort()
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not find a free port: %v", label, err)
+		}
+		ports[name] = port
+		invPorts[name] = int32(port)
+	}
+	logsDir, err := c.makeDir(options.LogsDir, "logs", label)
+	if err != nil {
+		return nil, err
+	}
+	logPath := filepath.Join(logsDir, "service.log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not create log file: %v", label, err)
+	}
+	ih, err := newInvocationHelper(&buildpb.ToolInvocation{
+		BuildUnitDir:      string(pkgDir),
+		LogsDir:           logsDir,
+		LogLabels:         logLabelsFromOptions(&options),
+		ServiceInvocation: &buildpb.ServiceInvocation{Ports: invPorts},
+	})
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	args := []string{ih.InvocationArg()}
+	args = append(args, su.Args...)
+	svc := &Service{
+		Label:   label,
+		Ports:   ports,
+		LogPath: logPath,
+		su:      su,
+		bin:     bin,
+		args:    AddGlogFlags(label.Target, options.LogLevel, args),
+		dir:     c.Monorepo.Root,
+		ih:      ih,
+		logFile: logFile,
+		done:    make(chan struct{}),
+	}
+	fmt.Fprintf(options.Logs, "Starting service %s, logs in %s\n", label, logPath)
+	if err := svc.start(); err != nil {
+		ih.Cleanup()
+		logFile.Close()
+		return nil, fmt.Errorf("could not start service %s: %v", label, err)
+	}
+	go svc.watch()
+	if err := svc.waitHealthy(); err != nil {
+		svc.stop()
+		return nil, fmt.Errorf("service %s is not healthy: %v\n%s", label, err, tailLog(logPath, 20))
+	}
+	return svc, nil
+}
+
+func (c *context) findServiceUnit(bus *sgebpb.BuildUnits, l monorepo.Label) (*sgebpb.ServiceUnit, bool) {
+	for _, su := range bus.ServiceUnit {
+		if su.Name == l.Target {
+			return su, true
+		}
+	}
+	return nil, false
+}
+
+// start starts the process of the service. Must be called with mu held or before watch.
+func (s *Service) start() error {
+	cmd := exec.Command(s.bin, s.args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = s.dir
+	cmd.Stdout = s.logFile
+	cmd.Stderr = s.logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.cmd = cmd
+	return nil
+}
+
+// watch waits for the service to exit and restarts it, up to the max restarts of the unit.
+func (s *Service) watch() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		cmd := s.cmd
+		s.mu.Unlock()
+		err := cmd.Wait()
+
+		s.mu.Lock()
+		if s.stopping {
+			s.mu.Unlock()
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		if s.restarts >= int(s.su.MaxRestarts) {
+			s.exitErr = fmt.Errorf("service %s %v, see %s", s.Label, err, s.LogPath)
+			s.mu.Unlock()
+			log.Warning(s.exitErr)
+			return
+		}
+		s.restarts++
+		log.Warningf("service %s %v, restarting it (%d/%d)", s.Label, err, s.restarts, s.su.MaxRestarts)
+		fmt.Fprintf(s.logFile, "sgeb: service %v, restarting it (%d/%d)\n", err, s.restarts, s.su.MaxRestarts)
+		if err := s.start(); err != nil {
+			s.exitErr = fmt.Errorf("could not restart service %s: %v", s.Label, err)
+			s.mu.Unlock()
+			log.Warning(s.exitErr)
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// waitHealthy waits for the health check of the service to pass, or for its timeout.
+func (s *Service) waitHealthy() error {
+	hc := s.su.HealthCheck
+	port := ""
+	if hc != nil && hc.Port != "" {
+		port = hc.Port
+	} else if len(s.su.Port) > 0 {
+		port = s.su.Port[0]
+	}
+	if port == "" {
+		return nil
+	}
+	timeout := defaultHealthTimeout
+	if hc != nil && hc.TimeoutSeconds > 0 {
+		timeout = time.Duration(hc.TimeoutSeconds) * time.Second
+	}
+	addr := net.JoinHostPort(serviceHost, strconv.Itoa(s.Ports[port]))
+	var httpPath string
+	if hc != nil {
+		httpPath = hc.HttpPath
+	}
+	deadline := time.Now().Add(timeout)
+	var err error
+	for {
+		if err = checkHealth(addr, httpPath); err == nil {
+			return nil
+		}
+		select {
+		case <-s.done:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.exitErr
+		case <-time.After(healthCheckInterval):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not healthy after %v: %v", timeout, err)
+		}
+	}
+}
+
+// checkHealth returns nil if |addr| accepts connections and, if |httpPath| is set, answers a GET
+// of it with a 2xx status.
+func checkHealth(addr, httpPath string) error {
+	if httpPath == "" {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if !strings.HasPrefix(httpPath, "/") {
+		httpPath = "/" + httpPath
+	}
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + addr + httpPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: %s", httpPath, resp.Status)
+	}
+	return nil
+}
+
+// stop kills the service and waits for it to exit.
+func (s *Service) stop() error {
+	s.mu.Lock()
+	s.stopping = true
+	cmd := s.cmd
+	s.mu.Unlock()
+	defer s.ih.Cleanup()
+	defer s.logFile.Close()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			log.Warningf("could not kill service %s: %v", s.Label, err)
+		}
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(serviceStopTimeout):
+		return fmt.Errorf("service %s did not exit after %v", s.Label, serviceStopTimeout)
+	}
+}
+
+// freePort returns a local port that is free at the time of the call.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(serviceHost, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// tailLog returns the last |n| lines of the log file at |p|.
+func tailLog(p string, n int) string {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return string(bytes.Join(lines, []byte("\n")))
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServicesEnv(t *testing.T) {
+	services := &Services{
+		services: []*Service{
+			{
+				Label: monorepo.Label{Pkg: "tools/asset-server", Target: "asset-server"},
+				Ports: map[string]int{"http": 8080, "grpc_api": 9090},
+			},
+			{
+				Label: monorepo.Label{Pkg: "tools/emulator", Target: "emulator"},
+				Ports: map[string]int{"tcp": 1234},
+			},
+		},
+	}
+	want := []string{
+		"SGE_SERVICE_ASSET_SERVER_GRPC_API=9090",
+		"SGE_SERVICE_ASSET_SERVER_HTTP=8080",
+		"SGE_SERVICE_EMULATOR_TCP=1234",
+	}
+	if diff := cmp.Diff(want, services.Env()); diff != "" {
+		t.Errorf("Env() diff (-want +got):\n%s", diff)
+	}
+	running := services.Running()
+	wantRunning := &buildpb.RunningService{
+		Label: "//tools/emulator:emulator",
+		Host:  "localhost",
+		Ports: map[string]int32{"tcp": 1234},
+	}
+	if len(running) != 2 || !proto.Equal(running[1], wantRunning) {
+		t.Errorf("Running() = %v, want second service %v", running, wantRunning)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	healthy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	if err := checkHealth(addr, ""); err != nil {
+		t.Errorf("checkHealth(%q, \"\") = %v, want nil", addr, err)
+	}
+	if err := checkHealth(addr, "healthz"); err != nil {
+		t.Errorf("checkHealth(%q, healthz) = %v, want nil", addr, err)
+	}
+	healthy = false
+	if err := checkHealth(addr, "/healthz"); err == nil {
+		t.Errorf("checkHealth(%q, /healthz) succeeded for an unhealthy service", addr)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := net.JoinHostPort(serviceHost, strconv.Itoa(port))
+	if err := checkHealth(closed, ""); err == nil {
+		t.Errorf("checkHealth(%q, \"\") succeeded for a closed port", closed)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ErrBadSignature is returned when an artifact is unsigned, modified after being signed, or signed
+// with another key.
+var ErrBadSignature = errors.New("bad artifact signature")
+
+// Signer signs the artifacts of build units, see Options.Signer.
+type Signer interface {
+	// Key identifies the key signatures are made with, and is recorded along them.
+	Key() string
+	// Sign returns the signature of the SHA-256 |digest|.
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Verifier verifies the signatures of artifacts, see Options.Verifier.
+type Verifier interface {
+	// Key identifies the key signatures are verified with. Artifacts signed with other keys fail
+	// verification.
+	Key() string
+	// Verify returns ErrBadSignature if |signature| isn't a signature of the SHA-256 |digest|.
+	Verify(digest, signature []byte) error
+}
+
+// PublicKeyVerifier verifies signatures with an ECDSA or RSA public key, eg. the public half of a
+// Cloud KMS key.
+type PublicKeyVerifier struct {
+	// KeyName is returned by Key.
+	KeyName string
+	// PublicKey is an *ecdsa.PublicKey or an *rsa.PublicKey.
+	PublicKey crypto.PublicKey
+	// PSS is whether RSA signatures use PSS padding instead of PKCS #1 v1.5.
+	PSS bool
+}
+
+func (v *PublicKeyVerifier) Key() string {
+	return v.KeyName
+}
+
+func (v *PublicKeyVerifier) Verify(digest, signature []byte) error {
+	switch pub := v.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, signature) {
+			return ErrBadSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		var err error
+		if v.PSS {
+			err = rsa.VerifyPSS(pub, crypto.SHA256, digest, signature, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature)
+		}
+		if err != nil {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", v.PublicKey)
+}
+
+// ArtifactDigest returns the SHA-256 of artifact |a|: of its contents for inlined artifacts, of the
+// file it points to, or of the paths and digests of the files under the directory it points to.
+// Returns nil for artifacts that are neither, eg. remote URIs.
+func ArtifactDigest(a *buildpb.Artifact) ([]byte, error) {
+	if len(a.Contents) > 0 {
+		sum := sha256.Sum256(a.Contents)
+		return sum[:], nil
+	}
+	p := artifactPath(a)
+	if p == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		digest, err := hashFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return hex.DecodeString(digest)
+	}
+	// snapshotPath walks the files in lexical order, so the digest is stable. Hash the paths too,
+	// so that renames change the digest.
+	files, err := snapshotPath(p, "")
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(hasher, "%s\x00%s\n", f.Path, f.Digest)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// SignArtifacts signs the artifacts of |as| that have a stable path and a digest, replacing their
+// previous signatures. Logs and other artifacts without a stable path aren't signed.
+func SignArtifacts(s Signer, as *buildpb.ArtifactSet) error {
+	if as == nil {
+		return nil
+	}
+	for _, a := range as.Artifacts {
+		if a.StablePath == "" {
+			continue
+		}
+		digest, err := ArtifactDigest(a)
+		if err != nil {
+			return fmt.Errorf("could not hash artifact %s: %v", a.StablePath, err)
+		}
+		if digest == nil {
+			continue
+		}
+		sig, err := s.Sign(digest)
+		if err != nil {
+			return fmt.Errorf("could not sign artifact %s: %v", a.StablePath, err)
+		}
+		a.Signature = &buildpb.ArtifactSignature{
+			Key:       s.Key(),
+			Digest:    hex.EncodeToString(digest),
+			Signature: sig,
+		}
+	}
+	return nil
+}
+
+// VerifyArtifacts checks that every artifact of |as| SignArtifacts would sign was signed with the
+// key of |v| and hasn't changed since. If any didn't, the error wraps ErrBadSignature and lists all
+// the artifacts that failed verification.
+func VerifyArtifacts(v Verifier, as *buildpb.ArtifactSet) error {
+	if as == nil {
+		return nil
+	}
+	var bad []string
+	for _, a := range as.Artifacts {
+		if a.StablePath == "" {
+			continue
+		}
+		digest, err := ArtifactDigest(a)
+		if err != nil {
+			return fmt.Errorf("could not hash artifact %s: %v", a.StablePath, err)
+		}
+		if digest == nil {
+			continue
+		}
+		reason, err := verifyArtifact(v, a.Signature, digest)
+		if err != nil {
+			return fmt.Errorf("could not verify artifact %s: %v", a.StablePath, err)
+		}
+		if reason != "" {
+			bad = append(bad, fmt.Sprintf("%s (%s)", a.StablePath, reason))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%w: %s", ErrBadSignature, strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// verifyArtifact returns why signature |sig| of an artifact with |digest| doesn't verify, or "".
+// Errors are for failures to verify at all, eg. to fetch the key.
+func verifyArtifact(v Verifier, sig *buildpb.ArtifactSignature, digest []byte) (string, error) {
+	switch {
+	case sig == nil:
+		return "unsigned", nil
+	case sig.Key != v.Key():
+		return fmt.Sprintf("signed with %s", sig.Key), nil
+	case sig.Digest != hex.EncodeToString(digest):
+		return "modified after signing", nil
+	}
+	if err := v.Verify(digest, sig.Signature); errors.Is(err, ErrBadSignature) {
+		return "invalid signature", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// VerifySavedSignatures checks that the artifacts of |as| are the ones signed by the build that
+// saved the signed artifact set |p|, with the key of |v|. Artifacts are matched by stable path; the
+// error wraps ErrBadSignature if |p| doesn't exist or any artifact doesn't verify, see
+// VerifyArtifacts.
+func VerifySavedSignatures(v Verifier, as *buildpb.ArtifactSet, p string) error {
+	if as == nil {
+		return nil
+	}
+	saved, err := LoadSignatures(p)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: no signed build, build the unit with a signing key first", ErrBadSignature)
+	} else if err != nil {
+		return err
+	}
+	sigs := map[string]*buildpb.ArtifactSignature{}
+	for _, a := range saved.Artifacts {
+		if a.StablePath != "" {
+			sigs[a.StablePath] = a.Signature
+		}
+	}
+	signed := proto.Clone(as).(*buildpb.ArtifactSet)
+	for _, a := range signed.Artifacts {
+		a.Signature = sigs[a.StablePath]
+	}
+	return VerifyArtifacts(v, signed)
+}
+
+// SignaturesPath returns the file the signed artifacts of |unit| are saved to.
+func SignaturesPath(outputDir string, unit monorepo.Label) string {
+	return filepath.Join(outputDir, "signatures", url.QueryEscape(unit.String())+".textpb")
+}
+
+// SaveSignatures writes the signed artifact set |as| to |p|, for `sgeb verify` to check it later.
+func SaveSignatures(p string, as *buildpb.ArtifactSet) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, []byte(proto.MarshalTextString(as)), 0644)
+}
+
+// LoadSignatures reads an artifact set saved with SaveSignatures.
+func LoadSignatures(p string) (*buildpb.ArtifactSet, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	as := &buildpb.ArtifactSet{}
+	if err := proto.UnmarshalText(string(data), as); err != nil {
+		return nil, fmt.Errorf("could not parse signatures %s: %v", p, err)
+	}
+	return as, nil
+}
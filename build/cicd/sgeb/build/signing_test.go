@@ -0,0 +1,243 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/libs/go/sgetest"
+)
+
+// testSigner signs with a local ECDSA key.
+type testSigner struct {
+	PublicKeyVerifier
+	priv *ecdsa.PrivateKey
+}
+
+func newTestSigner(t *testing.T, name string) *testSigner {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{
+		PublicKeyVerifier: PublicKeyVerifier{KeyName: name, PublicKey: &priv.PublicKey},
+		priv:              priv,
+	}
+}
+
+func (s *testSigner) Sign(digest []byte) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, s.priv, digest)
+}
+
+func TestSignArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	if err := sgetest.WriteFiles(dir, map[string]string{
+		"bin/tool.exe":       "tool",
+		"pak/data/a.bin":     "a",
+		"pak/data/sub/b.bin": "b",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	artifacts := func() *buildpb.ArtifactSet {
+		return &buildpb.ArtifactSet{
+			Artifacts: []*buildpb.Artifact{
+				{StablePath: "bin/tool.exe", Uri: "file:///" + filepath.ToSlash(filepath.Join(dir, "bin/tool.exe"))},
+				{StablePath: "pak/data", Uri: "file:///" + filepath.ToSlash(filepath.Join(dir, "pak/data"))},
+				{StablePath: "version.txt", Contents: []byte("1.0")},
+				// Logs aren't signed.
+				{Tag: "stderr", Contents: []byte("warning")},
+			},
+		}
+	}
+	signer := newTestSigner(t, "key1")
+	as := artifacts()
+	if err := SignArtifacts(signer, as); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range as.Artifacts {
+		if signed := a.Signature != nil; signed != (a.StablePath != "") {
+			t.Errorf("%s: signed = %t, want %t", a.StablePath, signed, !signed)
+		}
+	}
+	if err := VerifyArtifacts(signer, as); err != nil {
+		t.Errorf("VerifyArtifacts() = %v, want nil", err)
+	}
+
+	p := filepath.Join(dir, "signatures.textpb")
+	if err := SaveSignatures(p, as); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSignatures(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyArtifacts(signer, loaded); err != nil {
+		t.Errorf("VerifyArtifacts(loaded signatures) = %v, want nil", err)
+	}
+
+	// Another key doesn't verify the signatures, nor unsigned artifacts.
+	if err := VerifyArtifacts(newTestSigner(t, "key2"), as); !errors.Is(err, ErrBadSignature) || !strings.Contains(err.Error(), "bin/tool.exe (signed with key1)") {
+		t.Errorf("VerifyArtifacts(other key) = %v, want signed with key1", err)
+	}
+	if err := VerifyArtifacts(signer, artifacts()); !errors.Is(err, ErrBadSignature) || !strings.Contains(err.Error(), "version.txt (unsigned)") {
+		t.Errorf("VerifyArtifacts(unsigned) = %v, want unsigned", err)
+	}
+	forged := newTestSigner(t, "key1")
+	forgedAs := artifacts()
+	if err := SignArtifacts(forged, forgedAs); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyArtifacts(signer, forgedAs); !errors.Is(err, ErrBadSignature) || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("VerifyArtifacts(forged) = %v, want invalid signature", err)
+	}
+
+	// Modifying, adding or renaming files after signing fails verification.
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin/tool.exe"), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "pak/data/sub/b.bin"), filepath.Join(dir, "pak/data/sub/c.bin")); err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyArtifacts(signer, as)
+	if !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("VerifyArtifacts(modified) = %v, want ErrBadSignature", err)
+	}
+	for _, want := range []string{"bin/tool.exe (modified after signing)", "pak/data (modified after signing)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("VerifyArtifacts(modified) = %v, want %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "version.txt") {
+		t.Errorf("VerifyArtifacts(modified) = %v, want version.txt to verify", err)
+	}
+}
+
+func TestBuildSigned(t *testing.T) {
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, map[string]string{
+		"MONOREPO":       "",
+		"WORKSPACE":      "",
+		"data/BUILDUNIT": "build_unit {\n  name: \"configs\"\n  files: \"*.json\"\n}\n",
+		"data/a.json":    "{}",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := newTestSigner(t, "key1")
+	bc, err := NewContext(mr, func(o *Options) {
+		o.Logs = ioutil.Discard
+		o.Signer = signer
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	l, err := mr.NewLabel("", "//data:configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := bc.Build(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyArtifacts(signer, result.BuildResult.ArtifactSet); err != nil {
+		t.Errorf("VerifyArtifacts(build result) = %v, want nil", err)
+	}
+	saved, err := LoadSignatures(SignaturesPath(mr.ResolvePath("sgeb-out"), l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyArtifacts(signer, saved); err != nil {
+		t.Errorf("VerifyArtifacts(saved signatures) = %v, want nil", err)
+	}
+}
+
+func TestVerifySavedSignatures(t *testing.T) {
+	wsDir := t.TempDir()
+	if err := sgetest.WriteFiles(wsDir, map[string]string{
+		"MONOREPO":       "",
+		"WORKSPACE":      "",
+		"data/BUILDUNIT": "build_unit {\n  name: \"configs\"\n  files: \"*.json\"\n}\n",
+		"data/a.json":    "{}",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := mr.NewLabel("", "//data:configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := newTestSigner(t, "key1")
+	p := SignaturesPath(mr.ResolvePath("sgeb-out"), l)
+	// buildUnsigned builds the unit without signing it, as publish does.
+	buildUnsigned := func() *buildpb.ArtifactSet {
+		t.Helper()
+		bc, err := NewContext(mr, func(o *Options) {
+			o.Logs = ioutil.Discard
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Cleanup()
+		result, err := bc.Build(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.BuildResult.ArtifactSet
+	}
+
+	if err := VerifySavedSignatures(signer, buildUnsigned(), p); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("VerifySavedSignatures(never signed) = %v, want ErrBadSignature", err)
+	}
+	bc, err := NewContext(mr, func(o *Options) {
+		o.Logs = ioutil.Discard
+		o.Signer = signer
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	if _, err := bc.Build(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySavedSignatures(signer, buildUnsigned(), p); err != nil {
+		t.Errorf("VerifySavedSignatures(signed build) = %v, want nil", err)
+	}
+	if err := VerifySavedSignatures(newTestSigner(t, "key1"), buildUnsigned(), p); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("VerifySavedSignatures(other key) = %v, want ErrBadSignature", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(wsDir, "data/a.json"), []byte(`{"tampered": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySavedSignatures(signer, buildUnsigned(), p); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("VerifySavedSignatures(modified input) = %v, want ErrBadSignature", err)
+	}
+}
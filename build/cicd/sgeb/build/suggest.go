@@ -0,0 +1,580 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// DepsSuggestion are the deps a build unit is missing, found by tracing the files its tool reads.
+type DepsSuggestion struct {
+	Label monorepo.Label
+	// BuildUnitFile is the monorepo path of the BUILDUNIT file of the unit.
+	BuildUnitFile monorepo.Path
+	// Result is the result of the traced build, if the tool wrote one.
+	Result *buildpb.BuildResult
+	// BuildErr is the error of the traced build. Missing deps usually make builds fail.
+	BuildErr error
+	// Deps are the deps to add, sorted by dep.
+	Deps []SuggestedDep
+	// Unowned are the monorepo files outside of the unit's package that the tool read and no
+	// build unit provides, sorted.
+	Unowned []monorepo.Path
+}
+
+// SuggestedDep is a dep a build unit is missing.
+type SuggestedDep struct {
+	// Dep is the dep as it is written in the BUILDUNIT file, eg. "//foo:bar" or ":bar".
+	Dep   string
+	Label monorepo.Label
+	// Files are the monorepo paths of the files the dep provides that the tool read, or tried to
+	// read, sorted.
+	Files []monorepo.Path
+}
+
+// fileAccess is a file a tool accessed.
+type fileAccess struct {
+	// path is the absolute, slash separated path of the file.
+	path string
+	// missing is set when the file didn't exist.
+	missing bool
+}
+
+// fileTracer records the files the tools of build units access.
+type fileTracer interface {
+	// run runs |cmd| and records the files it and its children access in |traceFile|. Returns the
+	// error of the command, or why it couldn't be traced, in which case |traceFile| isn't written.
+	run(cmd *exec.Cmd, traceFile string) error
+	// accesses returns the file accesses recorded in |traceFile|. Relative paths are relative to
+	// |dir|.
+	accesses(traceFile, dir string) ([]fileAccess, error)
+}
+
+// tracer traces the tools run by SuggestDeps, nil where tracing isn't supported. Tests replace it.
+var tracer = defaultTracer()
+
+func defaultTracer() fileTracer {
+	switch runtime.GOOS {
+	case "linux":
+		return straceTracer{}
+	case "windows":
+		return procmonTracer{}
+	}
+	return nil
+}
+
+// straceTracer traces file accesses with strace, which is only available on Linux.
+type straceTracer struct{}
+
+// straceCalls are the system calls through which tools look for and read files.
+var straceCalls = "open,openat,stat,lstat,newfstatat,statx,access,faccessat,faccessat2,execve"
+
+// straceRegex matches the calls of straceCalls in strace output, capturing the quoted path and
+// the rest of the line. Lines may be prefixed with the pid of the process.
+var straceRegex = regexp.MustCompile(`^(?:\d+\s+)?(?:open|openat|stat|lstat|newfstatat|statx|access|faccessat|faccessat2|execve)\([^"]*("(?:[^"\\]|\\.)*")(.*)$`)
+
+func (straceTracer) run(cmd *exec.Cmd, traceFile string) error {
+	strace, err := exec.LookPath("strace")
+	if err != nil {
+		return fmt.Errorf("tracing file accesses needs strace: %v", err)
+	}
+	args := []string{"-f", "-qq", "-s", "4096", "-e", "trace=" + straceCalls, "-o", traceFile, "--", cmd.Path}
+	args = append(args, cmd.Args[1:]...)
+	traced := exec.Command(strace, args...)
+	traced.Dir = cmd.Dir
+	traced.Env = cmd.Env
+	traced.Stdin = cmd.Stdin
+	traced.Stdout = cmd.Stdout
+	traced.Stderr = cmd.Stderr
+	traced.SysProcAttr = cmd.SysProcAttr
+	return traced.Run()
+}
+
+func (straceTracer) accesses(traceFile, dir string) ([]fileAccess, error) {
+	f, err := os.Open(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseStrace(bufio.NewScanner(f), dir)
+}
+
+// parseStrace returns the file accesses of strace output.
+func parseStrace(scanner *bufio.Scanner, dir string) ([]fileAccess, error) {
+	scanner.Buffer(nil, 1<<20)
+	var accesses []fileAccess
+	for scanner.Scan() {
+		m := straceRegex.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		p, err := strconv.Unquote(m[1])
+		if err != nil || p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		accesses = append(accesses, fileAccess{
+			path:    filepath.ToSlash(filepath.Clean(p)),
+			missing: strings.Contains(m[2], "= -1 ENOENT"),
+		})
+	}
+	return accesses, scanner.Err()
+}
+
+// SuggestDeps builds the build unit in strict mode, with the file accesses of its tool traced, and
+// suggests the deps it is missing: the build units providing the files the tool read that are
+// neither in the unit's package nor provided by its deps. In strict mode, the tool runs in a
+// sandbox with only the files the unit declares, so undeclared reads fail even when the workspace
+// has the files, and are reported. Files the tool looked for and didn't find are reported if a
+// unit provides them, as that is how missing deps usually fail builds. Tracing uses strace on
+// Linux and Process Monitor on Windows; SuggestDeps fails on other platforms.
+func (c *context) SuggestDeps(buLabel monorepo.Label, opts ...Option) (*DepsSuggestion, error) {
+	if tracer == nil {
+		return nil, UsageErrorf("suggesting deps traces tools with strace on Linux or Process Monitor on Windows, none is available on %s", runtime.GOOS)
+	}
+	options := c.cmdOpts(opts...)
+	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(buLabel)
+	if err != nil {
+		return nil, err
+	}
+	bus, err := c.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	bu, ok := c.findBuildUnit(bus, buLabel)
+	if !ok {
+		return nil, fmt.Errorf("cannot find build unit %q in pkg //%s", buLabel.Target, buLabel.Pkg)
+	}
+	if bu.Bin == "" || len(bu.Files) > 0 {
+		return nil, fmt.Errorf("build unit %s has no bin tool to trace", buLabel)
+	}
+	traceDir, err := ioutil.TempDir("", "sgeb-trace")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(traceDir)
+	traceFile := filepath.Join(traceDir, "trace")
+	sandboxDir := filepath.Join(traceDir, "root")
+	result, buildErr := c.build(buLabel, withTraceFile(options, traceFile, sandboxDir))
+	if !fileExists(traceFile) {
+		// The tool didn't run, eg. because a dep failed to build.
+		if buildErr == nil {
+			buildErr = fmt.Errorf("the tool of %s wasn't traced", buLabel)
+		}
+		return nil, buildErr
+	}
+	accesses, err := tracer.accesses(traceFile, sandboxDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file accesses of %s: %v", buLabel, err)
+	}
+	sb := &sandbox{mr: c.Monorepo, root: sandboxDir}
+	for i, acc := range accesses {
+		accesses[i] = sb.monorepoAccess(acc)
+	}
+	// The bin and the deps were built by the traced build, they come from the cache.
+	bin, _, err := c.resolveBin(pkgDir, bu.Bin, options)
+	if err != nil {
+		return nil, err
+	}
+	inputs, _, err := c.buildDeps(pkgDir, bu.Deps, options)
+	if err != nil {
+		return nil, err
+	}
+	a := &accessAnalysis{
+		c:         c,
+		label:     buLabel,
+		pkgDir:    pkgDir,
+		outputDir: filepath.ToSlash(options.OutputDir),
+		logsDir:   filepath.ToSlash(options.LogsDir),
+		deps:      map[monorepo.Label]bool{buLabel: true},
+		allowed:   []string{path.Dir(filepath.ToSlash(bin))},
+	}
+	for _, d := range bu.Deps {
+		l, err := c.Monorepo.NewLabel(pkgDir, d)
+		if err != nil {
+			return nil, err
+		}
+		a.deps[l] = true
+	}
+	for _, as := range inputs {
+		for _, art := range as.GetArtifacts() {
+			if p := artifactPath(art); p != "" {
+				a.allowed = append(a.allowed, p)
+			}
+		}
+	}
+	suggestion, err := a.analyze(accesses)
+	if err != nil {
+		return nil, err
+	}
+	suggestion.Result = result
+	suggestion.BuildErr = buildErr
+	suggestion.BuildUnitFile = monorepo.NewPath(path.Join(string(pkgDir), "BUILDUNIT"))
+	return suggestion, nil
+}
+
+// withTraceFile returns |options| running the tool of the unit being built in a sandbox in
+// |sandboxDir| and tracing it into |traceFile|.
+func withTraceFile(options Options, traceFile, sandboxDir string) Options {
+	options.traceFile = traceFile
+	options.sandboxDir = sandboxDir
+	return options
+}
+
+// artifactPath returns the absolute, slash separated path of a file artifact, empty for other
+// artifacts.
+func artifactPath(a *buildpb.Artifact) string {
+	if !strings.HasPrefix(a.Uri, "file:///") {
+		return ""
+	}
+	p := strings.TrimPrefix(a.Uri, "file:///")
+	if !filepath.IsAbs(p) {
+		p = "/" + p
+	}
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// accessAnalysis maps the files read by the tool of a build unit to the units providing them.
+type accessAnalysis struct {
+	c         *context
+	label     monorepo.Label
+	pkgDir    monorepo.Path
+	outputDir string
+	logsDir   string
+	// deps are the unit and its declared deps.
+	deps map[monorepo.Label]bool
+	// allowed are the files and directories the unit may read besides its package.
+	allowed []string
+	// units are all the BUILDUNIT files of the monorepo, loaded when first needed.
+	units []UnitFile
+}
+
+func (a *accessAnalysis) analyze(accesses []fileAccess) (*DepsSuggestion, error) {
+	suggestion := &DepsSuggestion{Label: a.label}
+	byDep := map[monorepo.Label]map[monorepo.Path]bool{}
+	unowned := map[monorepo.Path]bool{}
+	for _, acc := range accesses {
+		p, ok := a.relevantPath(acc.path)
+		if !ok {
+			continue
+		}
+		owner, found, err := a.owner(acc.path, p)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case found && a.deps[owner]:
+		case found:
+			if byDep[owner] == nil {
+				byDep[owner] = map[monorepo.Path]bool{}
+			}
+			byDep[owner][p] = true
+		case !acc.missing && !isUnder(string(p), string(a.pkgDir)) && !strings.HasPrefix(acc.path, a.outputDir+"/"):
+			unowned[p] = true
+		}
+	}
+	for l, files := range byDep {
+		dep := l.String()
+		if dir, err := a.c.Monorepo.ResolveLabelPkgDir(l); err == nil && dir == a.pkgDir {
+			dep = ":" + l.Target
+		}
+		suggestion.Deps = append(suggestion.Deps, SuggestedDep{Dep: dep, Label: l, Files: sortedPaths(files)})
+	}
+	sort.Slice(suggestion.Deps, func(i, j int) bool {
+		return suggestion.Deps[i].Dep < suggestion.Deps[j].Dep
+	})
+	suggestion.Unowned = sortedPaths(unowned)
+	return suggestion, nil
+}
+
+// relevantPath returns the monorepo path of a file accessed by the tool, and whether the access
+// matters: files outside of the monorepo, including outputs when the output directory is elsewhere,
+// hidden files, logs, BUILDUNIT files and the inputs the unit is allowed to read don't.
+func (a *accessAnalysis) relevantPath(abs string) (monorepo.Path, bool) {
+	root := filepath.ToSlash(a.c.Monorepo.Root)
+	if !isUnder(abs, root) || abs == root || isUnder(abs, a.logsDir) || path.Base(abs) == "BUILDUNIT" {
+		return "", false
+	}
+	for _, allowed := range a.allowed {
+		if isUnder(abs, allowed) {
+			return "", false
+		}
+	}
+	rel := strings.TrimPrefix(abs, root+"/")
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+	return monorepo.NewPath(rel), true
+}
+
+// owner returns the build unit providing the file at |abs|, |p| in the monorepo: the non-Bazel
+// unit that outputs it, the Bazel build unit whose target package contains it, or the data-only
+// build unit whose files match it.
+func (a *accessAnalysis) owner(abs string, p monorepo.Path) (monorepo.Label, bool, error) {
+	if isUnder(abs, a.outputDir) {
+		return a.outputOwner(strings.TrimPrefix(abs, a.outputDir+"/"))
+	}
+	if isUnder(string(p), string(a.pkgDir)) {
+		return monorepo.Label{}, false, nil
+	}
+	if err := a.loadUnits(); err != nil {
+		return monorepo.Label{}, false, err
+	}
+	if rel, ok := bazelOutputPath(string(p)); ok {
+		return a.bazelOwner(rel)
+	}
+	return a.filesOwner(string(p))
+}
+
+// outputOwner returns the unit whose output directory contains |rel|, relative to the output
+// directory. Output directories are <pkg>/<name>.out.
+func (a *accessAnalysis) outputOwner(rel string) (monorepo.Label, bool, error) {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if !strings.HasSuffix(part, ".out") {
+			continue
+		}
+		dir := monorepo.NewPath(path.Join(parts[:i]...))
+		bus, err := a.c.LoadBuildUnits(dir)
+		if err != nil {
+			// Not a package.
+			continue
+		}
+		name := strings.TrimSuffix(part, ".out")
+		for _, bu := range bus.BuildUnit {
+			if bu.Name == name {
+				l, err := a.c.Monorepo.NewLabel(dir, ":"+name)
+				return l, err == nil, err
+			}
+		}
+	}
+	return monorepo.Label{}, false, nil
+}
+
+// bazelOutputPath returns the package path of a file in the Bazel output trees of the monorepo.
+func bazelOutputPath(p string) (string, bool) {
+	parts := strings.Split(p, "/")
+	switch {
+	case len(parts) > 1 && parts[0] == "bazel-bin":
+		return path.Join(parts[1:]...), true
+	case len(parts) > 3 && parts[0] == "bazel-out" && parts[2] == "bin":
+		return path.Join(parts[3:]...), true
+	}
+	return "", false
+}
+
+// bazelOwner returns the Bazel build unit whose target is in the deepest package containing
+// |rel|, preferring targets named after the file.
+func (a *accessAnalysis) bazelOwner(rel string) (monorepo.Label, bool, error) {
+	var best monorepo.Label
+	bestDir, bestNamed, found := "", false, false
+	stem := strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	for _, uf := range a.units {
+		for _, bu := range uf.Proto.BuildUnit {
+			if bu.Target == "" {
+				continue
+			}
+			target, err := a.c.Monorepo.NewLabel(uf.Dir, bu.Target)
+			if err != nil {
+				continue
+			}
+			dir := string(target.Pkg)
+			if !isUnder(rel, dir) && dir != "" {
+				continue
+			}
+			named := target.Target == stem
+			if found && (len(dir) < len(bestDir) || len(dir) == len(bestDir) && (bestNamed || !named)) {
+				continue
+			}
+			l, err := a.c.Monorepo.NewLabel(uf.Dir, ":"+bu.Name)
+			if err != nil {
+				return monorepo.Label{}, false, err
+			}
+			best, bestDir, bestNamed, found = l, dir, named, true
+		}
+	}
+	return best, found, nil
+}
+
+// filesOwner returns the data-only build unit in the deepest package whose files match |p|.
+func (a *accessAnalysis) filesOwner(p string) (monorepo.Label, bool, error) {
+	var best monorepo.Label
+	bestDir, found := "", false
+	for _, uf := range a.units {
+		dir := string(uf.Dir)
+		if !isUnder(p, dir) && dir != "" || found && len(dir) <= len(bestDir) {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+		for _, bu := range uf.Proto.BuildUnit {
+			if len(bu.Files) == 0 {
+				continue
+			}
+			filter, err := newArtifactFilter(bu.Files)
+			if err != nil || !filter.match(rel) {
+				continue
+			}
+			l, err := a.c.Monorepo.NewLabel(uf.Dir, ":"+bu.Name)
+			if err != nil {
+				return monorepo.Label{}, false, err
+			}
+			best, bestDir, found = l, dir, true
+			break
+		}
+	}
+	return best, found, nil
+}
+
+func (a *accessAnalysis) loadUnits() error {
+	if a.units != nil {
+		return nil
+	}
+	units, err := DiscoverBuildUnitFiles(a.c.Monorepo, a.c)
+	if err != nil {
+		return fmt.Errorf("could not load build units: %v", err)
+	}
+	a.units = append([]UnitFile{}, units...)
+	return nil
+}
+
+// isUnder returns whether slash separated path |p| is |dir| or under it.
+func isUnder(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+func sortedPaths(set map[monorepo.Path]bool) []monorepo.Path {
+	var paths []monorepo.Path
+	for p := range set {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
+// buildUnitRegex matches the start of a top-level build_unit block of a BUILDUNIT file.
+var buildUnitRegex = regexp.MustCompile(`(?m)^build_unit\s*:?\s*\{`)
+
+// addDeps adds |deps| to the deps of build unit |name| in BUILDUNIT file |content|, keeping the
+// rest of the file as is. New deps go after the existing ones, or after the name of the unit.
+func addDeps(content []byte, name string, deps []string) ([]byte, error) {
+	if len(deps) == 0 {
+		return content, nil
+	}
+	s := string(content)
+	nameRegex := regexp.MustCompile(`(?m)^([ \t]*)name\s*:\s*"` + regexp.QuoteMeta(name) + `"[^\n]*\n`)
+	depsRegex := regexp.MustCompile(`(?m)^([ \t]*)deps\s*:[^\n]*\n`)
+	for _, loc := range buildUnitRegex.FindAllStringIndex(s, -1) {
+		end := blockEnd(s, loc[1])
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated build_unit block")
+		}
+		block := s[loc[1]:end]
+		m := nameRegex.FindStringSubmatchIndex(block)
+		if m == nil {
+			continue
+		}
+		insertAt, indent := loc[1]+m[1], block[m[2]:m[3]]
+		if all := depsRegex.FindAllStringSubmatchIndex(block, -1); len(all) > 0 {
+			last := all[len(all)-1]
+			insertAt, indent = loc[1]+last[1], block[last[2]:last[3]]
+		}
+		var lines strings.Builder
+		for _, d := range deps {
+			fmt.Fprintf(&lines, "%sdeps: %s\n", indent, strconv.Quote(d))
+		}
+		out := s[:insertAt] + lines.String() + s[insertAt:]
+		// Make sure the edit kept the file valid.
+		bus := &sgebpb.BuildUnits{}
+		if err := proto.UnmarshalText(out, bus); err != nil {
+			return nil, fmt.Errorf("adding deps would break the BUILDUNIT file: %v", err)
+		}
+		return []byte(out), nil
+	}
+	return nil, fmt.Errorf("cannot find build unit %q", name)
+}
+
+// blockEnd returns the index of the brace closing the block starting at |start|, after its
+// opening brace, skipping strings and comments. Returns -1 if the block isn't closed.
+func blockEnd(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			quote := s[i]
+			for i++; i < len(s) && s[i] != quote; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// WriteSuggestedDeps adds the suggested deps to the BUILDUNIT file of the unit and returns its
+// absolute path.
+func WriteSuggestedDeps(mr monorepo.Monorepo, suggestion *DepsSuggestion) (string, error) {
+	p := mr.ResolvePath(suggestion.BuildUnitFile)
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	var deps []string
+	for _, d := range suggestion.Deps {
+		deps = append(deps, d.Dep)
+	}
+	content, err = addDeps(content, suggestion.Label.Target, deps)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", p, err)
+	}
+	if err := os.Chmod(p, 0644); err != nil {
+		return "", fmt.Errorf("could not make %s writable: %v", p, err)
+	}
+	return p, ioutil.WriteFile(p, content, 0644)
+}
@@ -0,0 +1,336 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/sgetest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseStrace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("strace paths are unix paths")
+	}
+	trace := `1234 execve("/ws/tools/cook", ["/ws/tools/cook"], 0x7ffd /* 20 vars */) = 0
+1234 openat(AT_FDCWD, "/ws/data/a.png", O_RDONLY|O_CLOEXEC) = 3
+1234 openat(AT_FDCWD, "data/b.png", O_RDONLY <unfinished ...>
+1235 stat("/ws/sgeb-out/x.out/lib", 0x7ffd) = -1 ENOENT (No such file or directory)
+1234 <... openat resumed>) = 4
+1236 access("/ws/with \"quotes\"", R_OK) = 0
+1234 write(1, "hello", 5) = 5
+1234 +++ exited with 1 +++
+`
+	got, err := parseStrace(bufio.NewScanner(strings.NewReader(trace)), "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileAccess{
+		{path: "/ws/tools/cook"},
+		{path: "/ws/data/a.png"},
+		{path: "/ws/data/b.png"},
+		{path: "/ws/sgeb-out/x.out/lib", missing: true},
+		{path: `/ws/with "quotes"`},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(fileAccess{})); diff != "" {
+		t.Errorf("parseStrace() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseProcmon(t *testing.T) {
+	trace := "100\n" + "\ufeff" + `"Time of Day","Process Name","PID","Operation","Path","Result","Detail"
+"10:00:00.1","cook.exe","100","CreateFile","C:\ws\data\a.png","SUCCESS","Desired Access: Generic Read"
+"10:00:00.2","cook.exe","100","QueryOpen","C:\ws\sgeb-out\x.out\lib","NAME NOT FOUND",""
+"10:00:00.3","cook.exe","100","RegOpenKey","HKLM\Software\Cook","SUCCESS",""
+"10:00:00.4","cook.exe","100","Process Create","C:\tools\helper.exe","SUCCESS","PID: 101, Command line: helper.exe"
+"10:00:00.5","helper.exe","101","Load Image","C:\ws\with ""quotes"".dll","SUCCESS",""
+"10:00:00.6","helper.exe","101","ReadFile","C:\ws\data\a.png","SUCCESS","Offset: 0"
+"10:00:00.7","explorer.exe","200","CreateFile","C:\ws\other.txt","SUCCESS",""
+"10:00:00.8","cook.exe","100","CreateFile","\\.\Pipe\cook","SUCCESS",""
+"10:00:00.9","cook.exe","100","CreateFile","C:\ws\missing\b.png","PATH NOT FOUND",""
+`
+	got, err := parseProcmon(strings.NewReader(trace), `C:\ws`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileAccess{
+		{path: "C:/ws/data/a.png"},
+		{path: "C:/ws/sgeb-out/x.out/lib", missing: true},
+		{path: "C:/tools/helper.exe"},
+		{path: `C:/ws/with "quotes".dll`},
+		{path: "C:/ws/missing/b.png", missing: true},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(fileAccess{})); diff != "" {
+		t.Errorf("parseProcmon() diff (-want +got):\n%s", diff)
+	}
+}
+
+// fakeTracer returns a fixed set of file accesses of the monorepo for any traced tool, made from
+// the directory the tool runs in, eg. the sandbox. Accesses to files missing from there fail.
+type fakeTracer struct {
+	root     string
+	accessed []fileAccess
+	// dir is the directory the last traced tool ran in.
+	dir string
+	// present are the files of |check| that the directory had when the tool ran.
+	check   []string
+	present []string
+}
+
+func (ft *fakeTracer) run(cmd *exec.Cmd, traceFile string) error {
+	ft.dir = filepath.ToSlash(cmd.Dir)
+	ft.present = nil
+	for _, f := range ft.check {
+		if _, err := os.Stat(filepath.Join(cmd.Dir, f)); err == nil {
+			ft.present = append(ft.present, f)
+		}
+	}
+	if err := ioutil.WriteFile(traceFile, nil, 0644); err != nil {
+		return err
+	}
+	return cmd.Run()
+}
+
+func (ft *fakeTracer) accesses(string, string) ([]fileAccess, error) {
+	var ret []fileAccess
+	for _, acc := range ft.accessed {
+		if isUnder(acc.path, ft.root) && !isUnder(acc.path, ft.root+"/sgeb-out") {
+			acc.path = ft.dir + strings.TrimPrefix(acc.path, ft.root)
+			if _, err := os.Stat(acc.path); err != nil {
+				acc.missing = true
+			}
+		}
+		ret = append(ret, acc)
+	}
+	return ret, nil
+}
+
+func TestSuggestDeps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tool is a shell script")
+	}
+	files := map[string]string{
+		"MONOREPO":  "",
+		"WORKSPACE": "",
+		"game/BUILDUNIT": `
+build_unit {
+  name: "cook"
+  bin: "cook.sh"
+  deps: ":declared"
+}
+
+build_unit {
+  name: "declared"
+  files: "declared/**"
+}
+
+build_unit {
+  name: "sibling"
+  bin: "cook.sh"
+}
+`,
+		"game/cook.sh":          "#!/bin/sh\nexit 1\n",
+		"game/src.txt":          "",
+		"game/declared/a.txt":   "",
+		"data/BUILDUNIT":        "build_unit {\n  name: \"textures\"\n  files: \"**/*.png\"\n}\n",
+		"data/a.png":            "",
+		"engine/BUILDUNIT":      "build_unit {\n  name: \"engine\"\n  target: \":engine\"\n}\n",
+		"docs/readme.md":        "",
+		"docs/BUILDUNIT":        "",
+		"tools/other/BUILDUNIT": "build_unit {\n  name: \"other\"\n  bin: \"other.exe\"\n}\n",
+	}
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(wsDir, "game", "cook.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.ToSlash(mr.Root)
+	ft := &fakeTracer{root: root, check: []string{"MONOREPO", "game/src.txt", "game/declared/a.txt", "data/a.png"}, accessed: []fileAccess{
+		{path: root + "/game/cook.sh"},
+		{path: root + "/game/src.txt"},
+		{path: root + "/game/BUILDUNIT"},
+		{path: root + "/game/declared/a.txt"},
+		{path: root + "/sgeb-out/game/cook.out/tmp"},
+		{path: root + "/data/a.png"},
+		{path: root + "/data/missing.png", missing: true},
+		{path: root + "/sgeb-out/game/sibling.out/x.bin", missing: true},
+		{path: root + "/bazel-bin/engine/engine.exe"},
+		{path: root + "/docs/readme.md"},
+		{path: root + "/docs/missing.md", missing: true},
+		{path: root + "/.git/config"},
+		{path: "/usr/lib/libc.so"},
+	}}
+	defer func(t fileTracer) { tracer = t }(tracer)
+	tracer = ft
+	bc, err := NewContext(mr, func(o *Options) {
+		o.Logs = ioutil.Discard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+	l, err := mr.NewLabel("", "//game:cook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Where tools can't be traced, eg. on Windows, SuggestDeps fails before building.
+	tracer = nil
+	if _, err := bc.SuggestDeps(l); !IsUsage(err) {
+		t.Errorf("SuggestDeps() without a tracer: got error %v, want a usage error", err)
+	}
+	tracer = ft
+	suggestion, err := bc.SuggestDeps(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suggestion.BuildErr == nil {
+		t.Errorf("SuggestDeps() has no build error, want the failure of the tool")
+	}
+	// In strict mode, the tool only has the files of its package and deps.
+	if ft.dir == root {
+		t.Errorf("the tool ran in the workspace, want a sandbox")
+	}
+	if diff := cmp.Diff([]string{"MONOREPO", "game/src.txt", "game/declared/a.txt"}, ft.present); diff != "" {
+		t.Errorf("files in the sandbox diff (-want +got):\n%s", diff)
+	}
+	type dep struct {
+		Dep   string
+		Files []monorepo.Path
+	}
+	var got []dep
+	for _, d := range suggestion.Deps {
+		got = append(got, dep{d.Dep, d.Files})
+	}
+	want := []dep{
+		{"//data:textures", []monorepo.Path{"data/a.png", "data/missing.png"}},
+		{"//engine:engine", []monorepo.Path{"bazel-bin/engine/engine.exe"}},
+		{":sibling", []monorepo.Path{"sgeb-out/game/sibling.out/x.bin"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SuggestDeps() deps diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]monorepo.Path{"docs/readme.md"}, suggestion.Unowned); diff != "" {
+		t.Errorf("SuggestDeps() unowned diff (-want +got):\n%s", diff)
+	}
+
+	p, err := WriteSuggestedDeps(mr, suggestion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new context, as contexts cache BUILDUNIT files.
+	fresh, err := NewContext(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Cleanup()
+	units, err := fresh.LoadBuildUnits("game")
+	if err != nil {
+		t.Fatalf("could not load %s: %v", p, err)
+	}
+	wantDeps := []string{":declared", "//data:textures", "//engine:engine", ":sibling"}
+	if diff := cmp.Diff(wantDeps, units.BuildUnit[0].Deps); diff != "" {
+		t.Errorf("deps after WriteSuggestedDeps diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddDeps(t *testing.T) {
+	content := `# Tools.
+build_unit {
+  name: "tool"
+  bin: "tool.exe"
+  env_vars { key: "X" value: "}" }
+}
+
+build_unit {
+    name: "cook"  # The cooker.
+    bin: "//tools:tool"
+}
+
+build_unit {
+  name: "pack"
+  deps: ":cook"
+  args: "--fast"
+}
+`
+	for _, tc := range []struct {
+		name    string
+		unit    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "after name",
+			unit: "cook",
+			want: `build_unit {
+    name: "cook"  # The cooker.
+    deps: "//a:b"
+    deps: ":c"
+    bin: "//tools:tool"
+}`,
+		},
+		{
+			name: "after deps",
+			unit: "pack",
+			want: `build_unit {
+  name: "pack"
+  deps: ":cook"
+  deps: "//a:b"
+  deps: ":c"
+  args: "--fast"
+}`,
+		},
+		{
+			name:    "unknown unit",
+			unit:    "missing",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := addDeps([]byte(content), tc.unit, []string{"//a:b", ":c"})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("addDeps() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(got), tc.want) {
+				t.Errorf("addDeps() = %s, want it to contain %s", got, tc.want)
+			}
+		})
+	}
+}
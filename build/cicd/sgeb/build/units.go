@@ -0,0 +1,199 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+	"sge-monorepo/environment/envinstall"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// Unit is the ownership, deprecation and environment information common to all units that carry
+// it. It is implemented by the build, test, publish, task, cron, gen and service unit protos.
+type Unit interface {
+	GetName() string
+	GetOwner() []string
+	GetDeprecated() bool
+	GetReplacement() string
+	GetRequiresEnv() []string
+}
+
+// UnitInfo is a unit found in a BUILDUNIT file along with its kind.
+type UnitInfo struct {
+	Unit
+	// Kind is the name of the unit kind as written in the BUILDUNIT file, eg. "build_unit".
+	Kind string
+}
+
+// Units returns all units in a BUILDUNIT file that carry ownership and deprecation information.
+func Units(bus *sgebpb.BuildUnits) []UnitInfo {
+	var ret []UnitInfo
+	for _, u := range bus.BuildUnit {
+		ret = append(ret, UnitInfo{u, "build_unit"})
+	}
+	for _, u := range bus.TestUnit {
+		ret = append(ret, UnitInfo{u, "test_unit"})
+	}
+	for _, u := range bus.PublishUnit {
+		ret = append(ret, UnitInfo{u, "publish_unit"})
+	}
+	for _, u := range bus.TaskUnit {
+		ret = append(ret, UnitInfo{u, "task_unit"})
+	}
+	for _, u := range bus.CronUnit {
+		ret = append(ret, UnitInfo{u, "cron_unit"})
+	}
+	for _, u := range bus.GenUnit {
+		ret = append(ret, UnitInfo{u, "gen_unit"})
+	}
+	for _, u := range bus.ServiceUnit {
+		ret = append(ret, UnitInfo{u, "service_unit"})
+	}
+	return ret
+}
+
+// FindUnit returns the unit with the given name, regardless of its kind.
+func FindUnit(bus *sgebpb.BuildUnits, name string) (UnitInfo, bool) {
+	for _, u := range Units(bus) {
+		if u.GetName() == name {
+			return u, true
+		}
+	}
+	return UnitInfo{}, false
+}
+
+// HasOwner returns whether |owner| is one of the owners of the unit. The comparison is case
+// insensitive.
+func HasOwner(u Unit, owner string) bool {
+	for _, o := range u.GetOwner() {
+		if strings.EqualFold(o, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeprecationMessage returns a human readable message about a deprecated unit.
+func DeprecationMessage(label monorepo.Label, u Unit) string {
+	msg := fmt.Sprintf("%s is deprecated", label)
+	if u.GetReplacement() != "" {
+		msg = fmt.Sprintf("%s, use %s instead", msg, u.GetReplacement())
+	}
+	if len(u.GetOwner()) > 0 {
+		msg = fmt.Sprintf("%s (owners: %s)", msg, strings.Join(u.GetOwner(), ", "))
+	}
+	return msg
+}
+
+// UnitRefs returns all references to other units made from within a BUILDUNIT file, as written in
+// the file. Binaries are only included when they are explicit build unit labels.
+func UnitRefs(bus *sgebpb.BuildUnits) []string {
+	var refs []string
+	addBin := func(bin string) {
+		if strings.Contains(bin, ":") {
+			refs = append(refs, bin)
+		}
+	}
+	for _, bu := range bus.BuildUnit {
+		addBin(bu.Bin)
+		refs = append(refs, bu.Deps...)
+	}
+	for _, tu := range bus.TestUnit {
+		addBin(tu.Bin)
+		refs = append(refs, tu.Deps...)
+		refs = append(refs, tu.Services...)
+	}
+	for _, ts := range bus.TestSuite {
+		for _, tu := range ts.TestUnit {
+			if tu != "..." {
+				refs = append(refs, tu)
+			}
+		}
+	}
+	for _, btu := range bus.BuildTestUnit {
+		refs = append(refs, btu.BuildUnit)
+	}
+	for _, pu := range bus.PublishUnit {
+		addBin(pu.Bin)
+		refs = append(refs, pu.BuildUnit...)
+		refs = append(refs, pu.PublishUnit...)
+	}
+	for _, tu := range bus.TaskUnit {
+		addBin(tu.Bin)
+	}
+	for _, cu := range bus.CronUnit {
+		addBin(cu.Bin)
+	}
+	for _, gu := range bus.GenUnit {
+		addBin(gu.Bin)
+	}
+	for _, su := range bus.ServiceUnit {
+		addBin(su.Bin)
+	}
+	return refs
+}
+
+// warnDeprecated prints a warning to the logs if the unit is deprecated.
+func warnDeprecated(logs io.Writer, label monorepo.Label, u Unit) {
+	if !u.GetDeprecated() {
+		return
+	}
+	fmt.Fprintf(logs, "WARNING: %s\n", DeprecationMessage(label, u))
+}
+
+// missingEnv returns which of the environment components are not installed. Replaced by tests.
+var missingEnv = envinstall.MissingComponents
+
+// installEnv installs the environment components. Replaced by tests.
+var installEnv = func(names []string) error {
+	p4 := p4lib.WithWarningHandler(p4lib.New(), func(w p4lib.Warning) {
+		log.Warning(w)
+	})
+	m, err := envinstall.NewManager(p4)
+	if err != nil {
+		return err
+	}
+	return m.InstallComponents(names...)
+}
+
+// checkRequiredEnv verifies that the environment components required by the unit are installed.
+// If |install| is set missing components are installed, otherwise an error explaining how to
+// install them is returned.
+func checkRequiredEnv(logs io.Writer, label monorepo.Label, u Unit, install bool) error {
+	if len(u.GetRequiresEnv()) == 0 {
+		return nil
+	}
+	missing, err := missingEnv(u.GetRequiresEnv())
+	if err != nil {
+		return fmt.Errorf("%s: %v", label, err)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if !install {
+		return fmt.Errorf("%s requires %s", label, envinstall.InstallInstructions(missing))
+	}
+	fmt.Fprintf(logs, "%s requires missing environment components, installing %s\n", label, strings.Join(missing, ", "))
+	if err := installEnv(missing); err != nil {
+		return fmt.Errorf("%s: could not install environment components: %v", label, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFindUnit(t *testing.T) {
+	bus := &sgebpb.BuildUnits{}
+	content := `
+build_unit {
+  name: "old_tool"
+  bin: "tool.exe"
+  owner: "alice"
+  deprecated: true
+  replacement: "//tools/new:new_tool"
+}
+publish_unit {
+  name: "publish"
+  build_unit: ":old_tool"
+  bin: "//build/publishers/cl_publisher"
+  owner: "Bob"
+}
+`
+	if err := proto.UnmarshalText(content, bus); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := FindUnit(bus, "old_tool")
+	if !ok {
+		t.Fatal("could not find unit old_tool")
+	}
+	if u.Kind != "build_unit" || !u.GetDeprecated() {
+		t.Errorf("want deprecated build_unit, got %s (deprecated: %t)", u.Kind, u.GetDeprecated())
+	}
+	l := monorepo.Label{Pkg: "tools/old", Target: "old_tool"}
+	want := "//tools/old:old_tool is deprecated, use //tools/new:new_tool instead (owners: alice)"
+	if got := DeprecationMessage(l, u); got != want {
+		t.Errorf("DeprecationMessage()=%q, want %q", got, want)
+	}
+	var logs bytes.Buffer
+	warnDeprecated(&logs, l, u)
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("want warning containing %q, got %q", want, logs.String())
+	}
+	pu, ok := FindUnit(bus, "publish")
+	if !ok {
+		t.Fatal("could not find unit publish")
+	}
+	if !HasOwner(pu, "bob") || HasOwner(pu, "alice") {
+		t.Errorf("want publish to be owned by bob only, got %v", pu.GetOwner())
+	}
+	logs.Reset()
+	warnDeprecated(&logs, l, pu)
+	if logs.Len() != 0 {
+		t.Errorf("want no warning for non-deprecated unit, got %q", logs.String())
+	}
+	if _, ok := FindUnit(bus, "missing"); ok {
+		t.Errorf("want missing unit not to be found")
+	}
+}
+
+func TestUnitRefs(t *testing.T) {
+	bus := &sgebpb.BuildUnits{
+		BuildUnit: []*sgebpb.BuildUnit{
+			{Name: "a", Bin: "//tools:builder", Deps: []string{":b"}},
+			{Name: "b", Bin: "checked_in.exe"},
+		},
+		TestSuite: []*sgebpb.TestSuite{
+			{Name: "suite", TestUnit: []string{"...", "//foo:test"}},
+		},
+		BuildTestUnit: []*sgebpb.BuildTestUnit{
+			{Name: "build_test", BuildUnit: ":a"},
+		},
+		PublishUnit: []*sgebpb.PublishUnit{
+			{Name: "publish", Bin: "//publishers:cl", BuildUnit: []string{":a"}},
+		},
+	}
+	got := UnitRefs(bus)
+	sort.Strings(got)
+	want := []string{"//foo:test", "//publishers:cl", "//tools:builder", ":a", ":a", ":b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("UnitRefs() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckRequiredEnv(t *testing.T) {
+	installed := map[string]bool{"vc-redist": true}
+	defer func(missing func([]string) ([]string, error), install func([]string) error) {
+		missingEnv, installEnv = missing, install
+	}(missingEnv, installEnv)
+	missingEnv = func(names []string) ([]string, error) {
+		var missing []string
+		for _, n := range names {
+			if !installed[n] {
+				missing = append(missing, n)
+			}
+		}
+		return missing, nil
+	}
+	installEnv = func(names []string) error {
+		for _, n := range names {
+			installed[n] = true
+		}
+		return nil
+	}
+
+	l := monorepo.Label{Pkg: "game", Target: "editor"}
+	bu := &sgebpb.BuildUnit{Name: "editor", RequiresEnv: []string{"vc-redist", "vs2019"}}
+	var logs bytes.Buffer
+	err := checkRequiredEnv(&logs, l, bu, false)
+	if err == nil || !strings.Contains(err.Error(), "vs2019") || !strings.Contains(err.Error(), "sgeb run //environment") {
+		t.Fatalf("checkRequiredEnv() = %v, want error with install instructions for vs2019", err)
+	}
+	if installed["vs2019"] {
+		t.Errorf("vs2019 was installed without install set")
+	}
+	if err := checkRequiredEnv(&logs, l, bu, true); err != nil {
+		t.Fatalf("checkRequiredEnv(install) failed: %v", err)
+	}
+	if !installed["vs2019"] {
+		t.Errorf("vs2019 was not installed")
+	}
+	if err := checkRequiredEnv(&logs, l, bu, false); err != nil {
+		t.Errorf("checkRequiredEnv() after install failed: %v", err)
+	}
+}
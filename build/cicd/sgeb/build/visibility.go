@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+)
+
+const (
+	// PublicVisibility makes a unit visible from every package. Units without visibility are public.
+	PublicVisibility = "//visibility:public"
+	// PrivateVisibility makes a unit visible from its own package only.
+	PrivateVisibility = "//visibility:private"
+)
+
+// unitVisibility returns the visibility of unit |l| and whether it is a unit that has one. Test
+// suites, build test units, cron units and task units have none.
+func unitVisibility(bus *sgebpb.BuildUnits, l monorepo.Label) ([]string, bool) {
+	for _, bu := range bus.BuildUnit {
+		if bu.Name == l.Target {
+			return bu.Visibility, true
+		}
+	}
+	for _, tu := range bus.TestUnit {
+		if tu.Name == l.Target {
+			return tu.Visibility, true
+		}
+	}
+	for _, pu := range bus.PublishUnit {
+		if pu.Name == l.Target {
+			return pu.Visibility, true
+		}
+	}
+	for _, su := range bus.ServiceUnit {
+		if su.Name == l.Target {
+			return su.Visibility, true
+		}
+	}
+	return nil, false
+}
+
+// IsVisible returns whether a unit of package |pkg| with visibility |vis| can be referenced from
+// the BUILDUNIT file of package |from|.
+func IsVisible(mr monorepo.Monorepo, pkg monorepo.Path, vis []string, from monorepo.Path) (bool, error) {
+	if len(vis) == 0 || pkg == from {
+		return true, nil
+	}
+	for _, v := range vis {
+		switch v {
+		case PublicVisibility:
+			return true, nil
+		case PrivateVisibility:
+			continue
+		}
+		l, err := mr.NewLabel(pkg, v)
+		if err != nil {
+			return false, fmt.Errorf("invalid visibility %q: %v", v, err)
+		}
+		dir, err := mr.ResolveLabelPkgDir(l)
+		if err != nil {
+			return false, fmt.Errorf("invalid visibility %q: %v", v, err)
+		}
+		switch l.Target {
+		case "__pkg__":
+			if dir == from {
+				return true, nil
+			}
+		case "__subpackages__":
+			if dir == "" || dir.IsParentOf(from) {
+				return true, nil
+			}
+		default:
+			return false, fmt.Errorf("invalid visibility %q, want %s, %s, //<pkg>:__pkg__ or //<pkg>:__subpackages__", v, PublicVisibility, PrivateVisibility)
+		}
+	}
+	return false, nil
+}
+
+// checkVisibility checks that unit |l| can be referenced from the BUILDUNIT file of package |from|.
+// Unless the monorepo enforces visibility, references to units that are not visible only print a
+// warning. Units that can't be loaded are left to the caller to report.
+func (c *context) checkVisibility(from monorepo.Path, l monorepo.Label, options Options) error {
+	pkg, err := c.Monorepo.ResolveLabelPkgDir(l)
+	if err != nil {
+		return nil
+	}
+	bus, err := c.LoadBuildUnits(pkg)
+	if err != nil {
+		return nil
+	}
+	vis, ok := unitVisibility(bus, l)
+	if !ok {
+		return nil
+	}
+	visible, err := IsVisible(c.Monorepo, pkg, vis, from)
+	if err != nil {
+		return fmt.Errorf("%s: %v", l, err)
+	}
+	if visible {
+		return nil
+	}
+	msg := fmt.Sprintf("%s is not visible from //%s, its visibility is %v", l, from, vis)
+	if c.monorepoSettings().GetEnforceVisibility() {
+		return fmt.Errorf("%s", msg)
+	}
+	fmt.Fprintf(options.Logs, "WARNING: %s. This will fail once visibility is enforced.\n", msg)
+	return nil
+}
+
+// monorepoSettings returns the settings of the BUILDUNIT file at the root of the monorepo, if any.
+func (c *context) monorepoSettings() *sgebpb.MonorepoSettings {
+	if c.settings == nil {
+		c.settings = &sgebpb.MonorepoSettings{}
+		if fileExists(c.Monorepo.ResolvePath("BUILDUNIT")) {
+			if bus, err := c.LoadBuildUnits(""); err == nil && bus.MonorepoSettings != nil {
+				c.settings = bus.MonorepoSettings
+			}
+		}
+	}
+	return c.settings
+}
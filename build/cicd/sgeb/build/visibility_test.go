@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/sgetest"
+)
+
+func TestIsVisible(t *testing.T) {
+	mr := monorepo.New("/ws", nil)
+	testCases := []struct {
+		vis     []string
+		from    monorepo.Path
+		want    bool
+		wantErr bool
+	}{
+		{vis: nil, from: "other", want: true},
+		{vis: []string{PublicVisibility}, from: "other", want: true},
+		{vis: []string{PrivateVisibility}, from: "tools/private", want: true},
+		{vis: []string{PrivateVisibility}, from: "tools/private/sub", want: false},
+		{vis: []string{"//game:__pkg__"}, from: "game", want: true},
+		{vis: []string{"//game:__pkg__"}, from: "game/sub", want: false},
+		{vis: []string{"//game:__subpackages__"}, from: "game/sub", want: true},
+		{vis: []string{"//game:__subpackages__"}, from: "gameplay", want: false},
+		{vis: []string{"//:__subpackages__"}, from: "anything/at/all", want: true},
+		{vis: []string{":__subpackages__"}, from: "tools/private/sub", want: true},
+		{vis: []string{"//game:__pkg__", "//tools:__subpackages__"}, from: "tools/other", want: true},
+		{vis: []string{"//game:everything"}, from: "other", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := IsVisible(mr, "tools/private", tc.vis, tc.from)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("IsVisible(%v, %s) error = %v, want error: %t", tc.vis, tc.from, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("IsVisible(%v, %s) = %t, want %t", tc.vis, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestCheckVisibility(t *testing.T) {
+	files := map[string]string{
+		"MONOREPO":  "",
+		"WORKSPACE": "",
+		"game/BUILDUNIT": `
+test_suite {
+  name: "private_tests"
+  test_unit: "//tools/private:test"
+}
+test_suite {
+  name: "public_tests"
+  test_unit: "//tools/public:test"
+}
+`,
+		"tools/private/BUILDUNIT": `
+test_unit {
+  name: "test"
+  bin: "nop"
+  visibility: "//tools:__subpackages__"
+}
+`,
+		"tools/public/BUILDUNIT": `
+test_unit {
+  name: "test"
+  bin: "nop"
+}
+`,
+	}
+	for _, enforced := range []bool{false, true} {
+		if enforced {
+			files["BUILDUNIT"] = `
+monorepo_settings {
+  enforce_visibility: true
+}
+`
+		}
+		wsDir, err := ioutil.TempDir("", "ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(wsDir)
+		if err := sgetest.WriteFiles(wsDir, files); err != nil {
+			t.Fatal(err)
+		}
+		mr, err := monorepo.NewFromDir(wsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		bc, err := NewContext(mr, func(o *Options) { o.Logs = &logs })
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bc.Cleanup()
+
+		if _, err := bc.ExpandTargetExpression("//game:public_tests"); err != nil {
+			t.Errorf("enforced=%t: expanding public_tests failed: %v", enforced, err)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("enforced=%t: want no warning for public_tests, got %q", enforced, logs.String())
+		}
+		_, err = bc.ExpandTargetExpression("//game:private_tests")
+		const msg = "//tools/private:test is not visible from //game"
+		if enforced {
+			if err == nil || !strings.Contains(err.Error(), msg) {
+				t.Errorf("enforced=%t: got error %v, want %q", enforced, err, msg)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("enforced=%t: expanding private_tests failed: %v", enforced, err)
+			}
+			if !strings.Contains(logs.String(), "WARNING: "+msg) {
+				t.Errorf("enforced=%t: want warning %q, got %q", enforced, msg, logs.String())
+			}
+		}
+	}
+}
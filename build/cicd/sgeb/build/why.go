@@ -0,0 +1,230 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/protos/sgebpb"
+)
+
+// DepLink is a unit within a dependency chain.
+type DepLink struct {
+	Label monorepo.Label
+	// Via is the BUILDUNIT field through which the previous unit of the chain references this one,
+	// eg. "deps" or "bin". Empty for the first unit.
+	Via string
+}
+
+// DepChain explains why a unit depends on another.
+type DepChain struct {
+	// Units is the shortest chain of unit references from the dependent unit to the dependency,
+	// both included. Empty if the units are only related through Bazel.
+	Units []DepLink
+	// Bazel is a chain of Bazel targets from the target of the dependent unit to the target of the
+	// dependency, when both are Bazel build units and one depends on the other.
+	Bazel []string
+}
+
+// unitRef is a reference to a unit as written in a BUILDUNIT file.
+type unitRef struct {
+	ref string
+	via string
+}
+
+// refsOf returns the references to other units made by unit |name|. Binaries are only included
+// when they are explicit build unit labels, as in UnitRefs.
+func refsOf(bus *sgebpb.BuildUnits, name string) []unitRef {
+	var refs []unitRef
+	add := func(via string, rs ...string) {
+		for _, r := range rs {
+			refs = append(refs, unitRef{r, via})
+		}
+	}
+	addBin := func(bin string) {
+		if strings.Contains(bin, ":") {
+			add("bin", bin)
+		}
+	}
+	for _, bu := range bus.BuildUnit {
+		if bu.Name == name {
+			addBin(bu.Bin)
+			add("deps", bu.Deps...)
+		}
+	}
+	for _, tu := range bus.TestUnit {
+		if tu.Name == name {
+			addBin(tu.Bin)
+			add("deps", tu.Deps...)
+			add("services", tu.Services...)
+		}
+	}
+	for _, ts := range bus.TestSuite {
+		if ts.Name != name {
+			continue
+		}
+		for _, tu := range ts.TestUnit {
+			if tu != "..." {
+				add("test_unit", tu)
+			}
+		}
+	}
+	for _, btu := range bus.BuildTestUnit {
+		if btu.Name == name {
+			add("build_unit", btu.BuildUnit)
+		}
+	}
+	for _, pu := range bus.PublishUnit {
+		if pu.Name == name {
+			addBin(pu.Bin)
+			add("build_unit", pu.BuildUnit...)
+			add("publish_unit", pu.PublishUnit...)
+		}
+	}
+	for _, tu := range bus.TaskUnit {
+		if tu.Name == name {
+			addBin(tu.Bin)
+		}
+	}
+	for _, cu := range bus.CronUnit {
+		if cu.Name == name {
+			addBin(cu.Bin)
+		}
+	}
+	for _, gu := range bus.GenUnit {
+		if gu.Name == name {
+			addBin(gu.Bin)
+		}
+	}
+	for _, su := range bus.ServiceUnit {
+		if su.Name == name {
+			addBin(su.Bin)
+		}
+	}
+	return refs
+}
+
+func (c *context) DepsWhy(from, to monorepo.Label) (*DepChain, error) {
+	fromTarget, err := c.bazelTarget(from)
+	if err != nil {
+		return nil, err
+	}
+	toTarget, err := c.bazelTarget(to)
+	if err != nil {
+		return nil, err
+	}
+	units, err := c.unitChain(from, to)
+	if err != nil {
+		return nil, err
+	}
+	chain := &DepChain{Units: units}
+	if fromTarget != "" && toTarget != "" {
+		chain.Bazel, err = c.BazelQuery(fmt.Sprintf("somepath(%s, %s)", fromTarget, toTarget))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(chain.Units) == 0 && len(chain.Bazel) == 0 {
+		return nil, fmt.Errorf("%s does not depend on %s", from, to)
+	}
+	return chain, nil
+}
+
+// unitChain returns the shortest chain of unit references from |from| to |to|, nil if there is
+// none.
+func (c *context) unitChain(from, to monorepo.Label) ([]DepLink, error) {
+	type reached struct {
+		parent monorepo.Label
+		via    string
+	}
+	seen := map[monorepo.Label]reached{from: {}}
+	queue := []monorepo.Label{from}
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		if l == to {
+			var chain []DepLink
+			for cur := to; cur != from; cur = seen[cur].parent {
+				chain = append([]DepLink{{Label: cur, Via: seen[cur].via}}, chain...)
+			}
+			return append([]DepLink{{Label: from}}, chain...), nil
+		}
+		pkgDir, err := c.Monorepo.ResolveLabelPkgDir(l)
+		if err != nil {
+			return nil, err
+		}
+		bus, err := c.LoadBuildUnits(pkgDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range refsOf(bus, l.Target) {
+			dep, err := c.Monorepo.NewLabel(pkgDir, r.ref)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", l, err)
+			}
+			if _, ok := seen[dep]; ok {
+				continue
+			}
+			seen[dep] = reached{l, r.via}
+			queue = append(queue, dep)
+		}
+	}
+	return nil, nil
+}
+
+// bazelTarget returns the Bazel target of build unit |label|, "" if it isn't a Bazel build unit.
+// Returns an error if there is no unit |label|.
+func (c *context) bazelTarget(label monorepo.Label) (string, error) {
+	pkgDir, err := c.Monorepo.ResolveLabelPkgDir(label)
+	if err != nil {
+		return "", err
+	}
+	bus, err := c.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return "", err
+	}
+	if !hasUnit(bus, label.Target) {
+		return "", fmt.Errorf("cannot find unit %q in pkg //%s", label.Target, label.Pkg)
+	}
+	bu, ok := c.findBuildUnit(bus, label)
+	if !ok || bu.Target == "" {
+		return "", nil
+	}
+	target, err := c.Monorepo.NewLabel(pkgDir, bu.Target)
+	if err != nil {
+		return "", err
+	}
+	return string(target.TargetExpression()), nil
+}
+
+// hasUnit returns whether there is a unit of any kind named |name|.
+func hasUnit(bus *sgebpb.BuildUnits, name string) bool {
+	if _, ok := FindUnit(bus, name); ok {
+		return true
+	}
+	for _, ts := range bus.TestSuite {
+		if ts.Name == name {
+			return true
+		}
+	}
+	for _, btu := range bus.BuildTestUnit {
+		if btu.Name == name {
+			return true
+		}
+	}
+	return false
+}
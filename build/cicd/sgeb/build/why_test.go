@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/sgetest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDepsWhy(t *testing.T) {
+	files := map[string]string{
+		"MONOREPO":  "",
+		"WORKSPACE": "",
+		"game/BUILDUNIT": `
+publish_unit {
+  name: "publish"
+  publish_unit: "//game/assets:publish"
+}
+`,
+		"game/assets/BUILDUNIT": `
+publish_unit {
+  name: "publish"
+  bin: "publish.exe"
+  build_unit: ":cook"
+}
+
+build_unit {
+  name: "cook"
+  bin: "//tools/cooker:cooker"
+  deps: "//engine:shaders"
+}
+`,
+		"tools/cooker/BUILDUNIT": `
+build_unit {
+  name: "cooker"
+  bin: "build.exe"
+}
+`,
+		"engine/BUILDUNIT": `
+build_unit {
+  name: "shaders"
+  bin: "shaders.exe"
+}
+
+test_unit {
+  name: "shaders_test"
+  bin: "test.exe"
+  deps: ":shaders"
+}
+`,
+	}
+	wsDir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wsDir)
+	if err := sgetest.WriteFiles(wsDir, files); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := monorepo.NewFromDir(wsDir)
+	if err != nil {
+		t.Fatalf("could not load monorepo from %s: %v", wsDir, err)
+	}
+	bc, err := NewContext(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Cleanup()
+
+	type link struct {
+		Label string
+		Via   string
+	}
+	testCases := []struct {
+		name    string
+		from    string
+		to      string
+		want    []link
+		wantErr bool
+	}{
+		{
+			name: "chain",
+			from: "//game:publish",
+			to:   "//tools/cooker:cooker",
+			want: []link{
+				{"//game:publish", ""},
+				{"//game/assets:publish", "publish_unit"},
+				{"//game/assets:cook", "build_unit"},
+				{"//tools/cooker:cooker", "bin"},
+			},
+		},
+		{
+			name: "shortest",
+			from: "//game/assets:cook",
+			to:   "//engine:shaders",
+			want: []link{
+				{"//game/assets:cook", ""},
+				{"//engine:shaders", "deps"},
+			},
+		},
+		{
+			name:    "no dependency",
+			from:    "//engine:shaders_test",
+			to:      "//tools/cooker:cooker",
+			wantErr: true,
+		},
+		{
+			name:    "unknown unit",
+			from:    "//game:publish",
+			to:      "//engine:nope",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			from, err := mr.NewLabel("", tc.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to, err := mr.NewLabel("", tc.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain, err := bc.DepsWhy(from, to)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("DepsWhy(%s, %s) = %v, want error", tc.from, tc.to, chain)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DepsWhy(%s, %s) failed: %v", tc.from, tc.to, err)
+			}
+			var got []link
+			for _, l := range chain.Units {
+				got = append(got, link{l.Label.String(), l.Via})
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("DepsWhy(%s, %s) diff (-want +got):\n%s", tc.from, tc.to, diff)
+			}
+			if len(chain.Bazel) != 0 {
+				t.Errorf("DepsWhy(%s, %s) has Bazel chain %v for units without targets", tc.from, tc.to, chain.Bazel)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// WorkspaceState is the state of a workspace saved by SaveWorkspace: the revisions of the files it
+// has and its opened files, set aside in a shelf.
+type WorkspaceState struct {
+	p4 p4lib.P4
+	// have maps depot paths to the revisions the workspace had.
+	have map[string]int
+	// opened are the files that were opened, with their CLs.
+	opened []p4lib.OpenedFile
+	// shelf is the change the opened files are shelved in, 0 if none were opened.
+	shelf int
+}
+
+// SaveWorkspace records the files the workspace has and shelves and reverts its opened files, so
+// that the workspace can be synced elsewhere and restored with Restore. The shelf is logged, to
+// recover the opened files by hand if sgeb is interrupted.
+func SaveWorkspace(p4 p4lib.P4) (*WorkspaceState, error) {
+	files, err := p4.Have("//...")
+	if err != nil {
+		return nil, fmt.Errorf("could not list the files of the workspace: %v", err)
+	}
+	opened, err := p4.Opened("")
+	if err != nil {
+		return nil, fmt.Errorf("could not list opened files: %v", err)
+	}
+	s := &WorkspaceState{p4: p4, have: map[string]int{}, opened: opened}
+	for _, f := range files {
+		s.have[f.DepotPath] = f.Revision
+	}
+	if len(opened) == 0 {
+		return s, nil
+	}
+	shelf, err := p4.Change("sgeb: opened files set aside while the workspace is synced elsewhere")
+	if err != nil {
+		return nil, fmt.Errorf("could not create a change to shelve opened files: %v", err)
+	}
+	s.shelf = shelf
+	c := strconv.Itoa(shelf)
+	if out, err := p4.ExecCmd("reopen", "-c", c, "//..."); err != nil {
+		s.undo()
+		return nil, fmt.Errorf("could not move opened files to CL %d: %v: %s", shelf, err, out)
+	}
+	if out, err := p4.ExecCmd("shelve", "-c", c); err != nil {
+		s.undo()
+		return nil, fmt.Errorf("could not shelve opened files: %v: %s", err, out)
+	}
+	log.Infof("Shelved %d opened files in CL %d. If sgeb is interrupted, restore them with: p4 unshelve -s %d -c %d", len(opened), shelf, shelf, shelf)
+	if out, err := p4.Revert([]string{"//..."}, "-w", "-c", c); err != nil {
+		return nil, fmt.Errorf("could not revert shelved files: %v: %s", err, out)
+	}
+	return s, nil
+}
+
+// Restore syncs the workspace back to the revisions it had, unshelves its opened files into their
+// original CLs and deletes the shelf.
+func (s *WorkspaceState) Restore() error {
+	files, err := s.p4.Have("//...")
+	if err != nil {
+		return fmt.Errorf("could not list the files of the workspace: %v", err)
+	}
+	// Only sync the files whose revision changed, and remove those the workspace didn't have.
+	var targets []string
+	synced := map[string]bool{}
+	for _, f := range files {
+		synced[f.DepotPath] = true
+		if rev, ok := s.have[f.DepotPath]; !ok {
+			targets = append(targets, f.DepotPath+"#none")
+		} else if rev != f.Revision {
+			targets = append(targets, fmt.Sprintf("%s#%d", f.DepotPath, rev))
+		}
+	}
+	for path, rev := range s.have {
+		if !synced[path] {
+			targets = append(targets, fmt.Sprintf("%s#%d", path, rev))
+		}
+	}
+	if err := syncFiles(s.p4, targets); err != nil {
+		return err
+	}
+	if s.shelf == 0 {
+		return nil
+	}
+	c := strconv.Itoa(s.shelf)
+	if out, err := s.p4.Unshelve(s.shelf, "-c", c); err != nil {
+		return fmt.Errorf("could not unshelve CL %d: %v: %s", s.shelf, err, out)
+	}
+	if err := s.reopen(); err != nil {
+		return err
+	}
+	if out, err := s.p4.ExecCmd("shelve", "-d", "-c", c); err != nil {
+		return fmt.Errorf("could not delete shelf %d: %v: %s", s.shelf, err, out)
+	}
+	return s.deleteChange()
+}
+
+// undo moves the opened files back to their CLs and deletes the shelf change when they couldn't
+// be shelved. Errors are only logged, the files are still opened in any case.
+func (s *WorkspaceState) undo() {
+	if err := s.reopen(); err != nil {
+		log.Error(err)
+	}
+	if err := s.deleteChange(); err != nil {
+		log.Error(err)
+	}
+}
+
+// reopen moves the opened files back from the shelf change to their original CLs.
+func (s *WorkspaceState) reopen() error {
+	byCl := map[int][]string{}
+	for _, f := range s.opened {
+		byCl[f.CL] = append(byCl[f.CL], f.Path)
+	}
+	for cl, paths := range byCl {
+		c := "default"
+		if cl != 0 {
+			c = strconv.Itoa(cl)
+		}
+		args := append([]string{"reopen", "-c", c}, paths...)
+		if out, err := s.p4.ExecCmd(args...); err != nil {
+			return fmt.Errorf("could not move files back to CL %s: %v: %s", c, err, out)
+		}
+	}
+	return nil
+}
+
+// deleteChange deletes the change that held the opened files.
+func (s *WorkspaceState) deleteChange() error {
+	c := strconv.Itoa(s.shelf)
+	if out, err := s.p4.ExecCmd("change", "-d", c); err != nil {
+		return fmt.Errorf("could not delete CL %d: %v: %s", s.shelf, err, out)
+	}
+	return nil
+}
+
+// syncFiles syncs |targets|, passing them in a file as they can be too many for the command line.
+func syncFiles(p4 p4lib.P4, targets []string) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	file, err := ioutil.TempFile("", "sync_invocation")
+	if err != nil {
+		return fmt.Errorf("could not create temp file for sync invocation: %v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(strings.Join(targets, "\n") + "\n")
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write into temp file: %v", err)
+	}
+	abs, err := filepath.Abs(file.Name())
+	if err != nil {
+		return fmt.Errorf("could not obtain abs path for temp file: %v", err)
+	}
+	// -x is a flag to load arguments from a file.
+	if out, err := p4.ExecCmd("-x", abs, "sync"); err != nil {
+		return fmt.Errorf("could not sync %d files back: %v: %s", len(targets), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWorkspaceState(t *testing.T) {
+	p4 := p4mock.New()
+	var cmds []string
+	have := []p4lib.File{
+		{DepotPath: "//a", Revision: 3},
+		{DepotPath: "//b", Revision: 1},
+		{DepotPath: "//c", Revision: 2},
+	}
+	p4.HaveFunc = func(patterns ...string) ([]p4lib.File, error) {
+		return have, nil
+	}
+	p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		return []p4lib.OpenedFile{
+			{Path: "//a", Status: p4lib.ActionEdit, CL: 0},
+			{Path: "//d", Status: p4lib.ActionAdd, CL: 12},
+		}, nil
+	}
+	p4.ChangeFunc = func(desc string) (int, error) {
+		return 99, nil
+	}
+	p4.ExecCmdFunc = func(args ...string) (string, error) {
+		if args[0] == "-x" {
+			b, err := ioutil.ReadFile(args[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			args = append(strings.Fields(string(b)), args[2:]...)
+		}
+		cmds = append(cmds, strings.Join(args, " "))
+		return "", nil
+	}
+	p4.RevertFunc = func(paths []string, opts ...string) (string, error) {
+		cmds = append(cmds, "revert "+strings.Join(append(opts, paths...), " "))
+		return "", nil
+	}
+	p4.UnshelveFunc = func(cl int, args ...string) (string, error) {
+		cmds = append(cmds, "unshelve "+strings.Join(args, " "))
+		return "", nil
+	}
+
+	s, err := SaveWorkspace(p4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"reopen -c 99 //...",
+		"shelve -c 99",
+		"revert -w -c 99 //...",
+	}
+	if diff := cmp.Diff(want, cmds); diff != "" {
+		t.Errorf("SaveWorkspace() commands diff (-want +got):\n%s", diff)
+	}
+
+	// At the CL, //a is at another revision, //b is gone and //e is new.
+	cmds = nil
+	have = []p4lib.File{
+		{DepotPath: "//a", Revision: 2},
+		{DepotPath: "//c", Revision: 2},
+		{DepotPath: "//e", Revision: 1},
+	}
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"//a#3 //e#none //b#1 sync",
+		"unshelve -c 99",
+		"reopen -c default //a",
+		"reopen -c 12 //d",
+		"shelve -d -c 99",
+		"change -d 99",
+	}
+	// The reopens are in any order.
+	if len(cmds) == len(want) && cmds[2] == want[3] {
+		cmds[2], cmds[3] = cmds[3], cmds[2]
+	}
+	if diff := cmp.Diff(want, cmds); diff != "" {
+		t.Errorf("Restore() commands diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWorkspaceStateNoOpenedFiles(t *testing.T) {
+	p4 := p4mock.New()
+	p4.HaveFunc = func(patterns ...string) ([]p4lib.File, error) {
+		return []p4lib.File{{DepotPath: "//a", Revision: 3}}, nil
+	}
+	p4.OpenedFunc = func(change string) ([]p4lib.OpenedFile, error) {
+		return nil, nil
+	}
+	s, err := SaveWorkspace(p4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to sync or unshelve: no other command runs.
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+}
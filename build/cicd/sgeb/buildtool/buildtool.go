@@ -60,6 +60,11 @@ type Helper interface {
 	// This call is valid only for build invocations.
 	DeclareOutput(p string) (filePath string, stablePath string)
 
+	// DeclareGenOutput returns the file path to write the output |p| of a gen unit to, given as in
+	// the unit's output field.
+	// This call is valid only for gen invocations.
+	DeclareGenOutput(p string) string
+
 	// MustWriteBuildResult writes a build result to --tool-invocation-result.
 	MustWriteBuildResult(result *buildpb.BuildInvocationResult)
 
@@ -124,6 +129,10 @@ func (h *helper) DeclareOutput(p string) (filePath string, stablePath string) {
 	return
 }
 
+func (h *helper) DeclareGenOutput(p string) string {
+	return path.Join(h.invocation.GenInvocation.OutputDir, p)
+}
+
 func (h *helper) resolvePath(relTo monorepo.Path, p string) (string, error) {
 	mrp, err := h.monorepo.NewPath(relTo, p)
 	if err != nil {
@@ -56,6 +56,10 @@ func (h *Helper) DeclareOutput(p string) (filepath, stablePath string) {
     panic("implement me")
 }
 
+func (h *Helper) DeclareGenOutput(p string) string {
+    panic("implement me")
+}
+
 func (h *Helper) MustWriteBuildResult(*buildpb.BuildInvocationResult) {
 }
 
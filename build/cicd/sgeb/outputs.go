@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/libs/go/log"
+)
+
+type diffOutputsRequest struct {
+	// unit is the build unit to compare the outputs of. Not needed to compare two saved snapshots.
+	unit monorepo.Label
+
+	// cl, if set, builds the base at this CL.
+	cl int64
+
+	// base and head, if set, are saved snapshots to use instead of building.
+	base string
+	head string
+
+	// save only builds the unit in the workspace and saves its snapshot.
+	save bool
+
+	// json prints the diff as JSON.
+	json bool
+}
+
+// diffOutputs compares the outputs of two builds of a unit. The head is the workspace unless a
+// snapshot is given, and the base a snapshot or a build at a CL. Builds save their snapshot to
+// sgeb-out/outputs so that they can be compared later on. Returns a failed error if the outputs
+// differ.
+func diffOutputs(mr monorepo.Monorepo, bc build.Context, newContext func() (build.Context, error), req diffOutputsRequest) error {
+	outDir := mr.ResolvePath("sgeb-out")
+	if req.base == "" && req.cl == 0 && !req.save {
+		return build.UsageErrorf("must pass -cl or -base to diff-outputs, or -save to only snapshot the outputs")
+	}
+	// Load the base first, as building the head overwrites the snapshot of the workspace.
+	var base, head *build.OutputSnapshot
+	var err error
+	if req.base != "" {
+		if base, err = build.LoadOutputSnapshot(req.base); err != nil {
+			return build.WithExitCode(err, build.ExitUsage)
+		}
+	}
+	if req.head != "" {
+		if head, err = build.LoadOutputSnapshot(req.head); err != nil {
+			return build.WithExitCode(err, build.ExitUsage)
+		}
+	} else {
+		if head, err = snapshotOutputs(bc, req.unit, "workspace", outDir); err != nil {
+			return err
+		}
+	}
+	if req.save {
+		return nil
+	}
+	if base == nil {
+		if base, err = snapshotOutputsAt(newContext, req.unit, req.cl, outDir); err != nil {
+			return err
+		}
+	}
+	if base.Unit != head.Unit {
+		log.Warningf("comparing the outputs of different units, %s and %s", base.Unit, head.Unit)
+	}
+	d := build.DiffOutputs(base, head)
+	if req.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	} else {
+		build.PrintOutputDiff(os.Stdout, d)
+	}
+	if !d.Empty() {
+		return build.WithExitCode(fmt.Errorf("outputs of %s differ", d.Unit), build.ExitFailed)
+	}
+	return nil
+}
+
+// snapshotOutputs builds |unit| and saves the snapshot of its outputs.
+func snapshotOutputs(bc build.Context, unit monorepo.Label, source, outDir string) (*build.OutputSnapshot, error) {
+	fmt.Printf("Building %s (%s)\n", unit, source)
+	result, err := bc.Build(unit)
+	if err != nil {
+		if result != nil {
+			build.PrintBuildResult(os.Stderr, unit, result, defaultMaxResults)
+		}
+		return nil, err
+	}
+	s, err := build.SnapshotOutputs(unit, source, result)
+	if err != nil {
+		return nil, err
+	}
+	p := build.OutputSnapshotPath(outDir, unit, source)
+	if err := s.Save(p); err != nil {
+		return nil, fmt.Errorf("could not save output snapshot: %v", err)
+	}
+	fmt.Printf("Saved %d outputs to %s\n", len(s.Files), p)
+	return s, nil
+}
+
+// snapshotOutputsAt syncs the workspace to |cl|, builds |unit| with a new context and restores the
+// workspace. Opened files are shelved and reverted while building at the CL, so that they don't
+// leak into the base, and unshelved afterwards.
+func snapshotOutputsAt(newContext func() (build.Context, error), unit monorepo.Label, cl int64, outDir string) (*build.OutputSnapshot, error) {
+	p4 := newP4()
+	state, err := build.SaveWorkspace(p4)
+	if err != nil {
+		return nil, build.WithExitCode(err, build.ExitInfra)
+	}
+	defer func() {
+		if err := state.Restore(); err != nil {
+			log.Errorf("could not restore the workspace: %v", err)
+		}
+	}()
+	if _, err := p4.Sync([]string{fmt.Sprintf("//...@%d", cl)}); err != nil {
+		return nil, build.WithExitCode(fmt.Errorf("could not sync to CL %d: %v", cl, err), build.ExitInfra)
+	}
+	// BUILDUNIT files and build results are cached by the context, so the CL gets its own.
+	bc, err := newContext()
+	if err != nil {
+		return nil, err
+	}
+	defer bc.Cleanup()
+	return snapshotOutputs(bc, unit, fmt.Sprintf("CL %d", cl), outDir)
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+)
+
+type queryRequest struct {
+	// dir limits the query to units under this monorepo directory.
+	dir monorepo.Path
+
+	// owner, if set, only lists units owned by it.
+	owner string
+
+	// deprecated only lists deprecated units.
+	deprecated bool
+}
+
+type queryResult struct {
+	label monorepo.Label
+	unit  build.UnitInfo
+}
+
+// query lists the units within |unitFiles| matching the request.
+func query(mr monorepo.Monorepo, unitFiles []build.UnitFile, req queryRequest) ([]queryResult, error) {
+	var results []queryResult
+	for _, uf := range unitFiles {
+		if req.dir != "" && !req.dir.IsParentOf(uf.Dir) {
+			continue
+		}
+		for _, u := range build.Units(uf.Proto) {
+			if req.owner != "" && !build.HasOwner(u, req.owner) {
+				continue
+			}
+			if req.deprecated && !u.GetDeprecated() {
+				continue
+			}
+			label, err := mr.NewLabel(uf.Dir, ":"+u.GetName())
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, queryResult{label, u})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].label.String() < results[j].label.String()
+	})
+	return results, nil
+}
+
+func printQueryResults(w io.Writer, results []queryResult) {
+	for _, r := range results {
+		line := fmt.Sprintf("%s %s", r.unit.Kind, r.label)
+		if len(r.unit.GetOwner()) > 0 {
+			line = fmt.Sprintf("%s owners=%s", line, strings.Join(r.unit.GetOwner(), ","))
+		}
+		if r.unit.GetDeprecated() {
+			line = fmt.Sprintf("%s DEPRECATED", line)
+			if r.unit.GetReplacement() != "" {
+				line = fmt.Sprintf("%s replacement=%s", line, r.unit.GetReplacement())
+			}
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// printDepChain prints the unit chain, with the field through which each unit is referenced, then
+// the Bazel chain.
+func printDepChain(w io.Writer, chain *build.DepChain) {
+	for _, l := range chain.Units {
+		if l.Via == "" {
+			fmt.Fprintln(w, l.Label)
+			continue
+		}
+		fmt.Fprintf(w, "  -> %s (%s)\n", l.Label, l.Via)
+	}
+	if len(chain.Bazel) > 0 {
+		fmt.Fprintln(w, "Bazel targets:")
+		for i, t := range chain.Bazel {
+			if i == 0 {
+				fmt.Fprintf(w, "  %s\n", t)
+				continue
+			}
+			fmt.Fprintf(w, "  -> %s\n", t)
+		}
+	}
+}
+
+// printDepsSuggestion prints the outcome of the traced build, the suggested deps with the files
+// that need them, and the files read that no unit provides.
+func printDepsSuggestion(w io.Writer, suggestion *build.DepsSuggestion) {
+	if suggestion.BuildErr != nil {
+		fmt.Fprintf(w, "The build of %s failed, missing deps may be the cause\n", suggestion.Label)
+	}
+	if len(suggestion.Deps) == 0 {
+		fmt.Fprintln(w, "No missing deps found")
+	} else {
+		fmt.Fprintf(w, "Suggested deps for %s:\n", suggestion.Label)
+	}
+	for _, d := range suggestion.Deps {
+		fmt.Fprintf(w, "  deps: %q\n", d.Dep)
+		for _, f := range d.Files {
+			fmt.Fprintf(w, "    %s\n", f)
+		}
+	}
+	if len(suggestion.Unowned) > 0 {
+		fmt.Fprintln(w, "Files read that no build unit provides:")
+		for _, f := range suggestion.Unowned {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+}
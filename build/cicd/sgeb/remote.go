@@ -65,7 +65,7 @@ func remote(req remoteRequest) error {
 		return fmt.Errorf("could not get current user: %w", err)
 	}
 	// Clear the key before sending the request.
-	p4 := p4lib.New()
+	p4 := newP4()
 	key := p4Key(u.Username, req.label)
 	if err := p4.KeySet(key, "0"); err != nil {
 		return fmt.Errorf("could not send P4 key %q: %w", key, err)
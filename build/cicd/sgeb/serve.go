@@ -0,0 +1,458 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/libs/go/log"
+
+	"sge-monorepo/build/cicd/sgeb/protos/servicepb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type serveRequest struct {
+	// port to listen to on localhost. 0 picks a free port.
+	port int
+
+	// infoFile is where the address and token of the server are written for clients to find.
+	infoFile string
+
+	// watchInterval is how long BUILDUNIT files must be left alone before changes are reloaded.
+	// When file notifications aren't available it's how often BUILDUNIT files are checked for
+	// changes.
+	watchInterval time.Duration
+
+	// rescanInterval is how often the monorepo is scanned for new BUILDUNIT files when file
+	// notifications aren't available.
+	rescanInterval time.Duration
+
+	// logLevel is the default log level of build and test tools.
+	logLevel string
+}
+
+// serveInfo is written to the info file so that clients can connect to the server.
+type serveInfo struct {
+	Address string `json:"address"`
+	Token   string `json:"token"`
+	Pid     int    `json:"pid"`
+}
+
+// serve runs sgeb as a gRPC service until interrupted.
+func serve(mr monorepo.Monorepo, req serveRequest) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	s := &server{mr: mr, logLevel: req.logLevel}
+	gen, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.gen = gen
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		s.watch(ctx, req.watchInterval, req.rescanInterval)
+	}()
+	// The watcher may be swapping generations, the last one is cleaned up once it stopped and the
+	// builds using it are done.
+	defer func() {
+		cancel()
+		<-watched
+		s.buildMu.Lock()
+		defer s.buildMu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.gen.bc.Cleanup()
+	}()
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", req.port))
+	if err != nil {
+		return fmt.Errorf("could not listen on port %d: %v", req.port, err)
+	}
+	info := serveInfo{
+		Address: lis.Addr().String(),
+		Token:   token,
+		Pid:     os.Getpid(),
+	}
+	if err := writeServeInfo(req.infoFile, info); err != nil {
+		lis.Close()
+		return err
+	}
+	defer os.Remove(req.infoFile)
+
+	gs := grpc.NewServer(grpc.UnaryInterceptor(authInterceptor(token)))
+	servicepb.RegisterSgebServer(gs, s)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		log.Infof("Stopping sgeb server.")
+		gs.GracefulStop()
+	}()
+
+	fmt.Printf("Serving on %s, serve info written to %s\n", info.Address, req.infoFile)
+	return gs.Serve(lis)
+}
+
+// server implements the Sgeb gRPC service.
+type server struct {
+	servicepb.UnimplementedSgebServer
+
+	mr       monorepo.Monorepo
+	logLevel string
+
+	// buildMu serializes builds and tests. Build contexts are not safe for concurrent use.
+	buildMu sync.Mutex
+
+	// mu guards gen.
+	mu  sync.RWMutex
+	gen *generation
+}
+
+// generation is the warm state derived from the BUILDUNIT files of the monorepo. It is replaced
+// as a whole whenever a BUILDUNIT file changes.
+type generation struct {
+	bc        build.Context
+	unitFiles []build.UnitFile
+
+	// mtimes are the modification times of the BUILDUNIT files, keyed by absolute path.
+	mtimes map[string]time.Time
+}
+
+// load discovers and loads all the BUILDUNIT files into a new generation.
+func (s *server) load() (*generation, error) {
+	bc, err := build.NewContext(s.mr, func(options *build.Options) {
+		options.LogLevel = s.logLevel
+		options.NoResultCache = true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create build context: %v", err)
+	}
+	unitFiles, err := build.DiscoverBuildUnitFiles(s.mr, bc)
+	if err != nil {
+		bc.Cleanup()
+		return nil, fmt.Errorf("could not discover BUILDUNIT files: %v", err)
+	}
+	gen := &generation{
+		bc:        bc,
+		unitFiles: unitFiles,
+		mtimes:    map[string]time.Time{},
+	}
+	for _, uf := range unitFiles {
+		p := filepath.Join(s.mr.ResolvePath(uf.Dir), "BUILDUNIT")
+		info, err := os.Stat(p)
+		if err != nil {
+			bc.Cleanup()
+			return nil, err
+		}
+		gen.mtimes[p] = info.ModTime()
+	}
+	return gen, nil
+}
+
+// watch reloads the BUILDUNIT files whenever one of them changes, or a new one appears. Changes
+// are watched with the file notifications of the OS, or polled if these aren't available.
+func (s *server) watch(ctx context.Context, interval, rescanInterval time.Duration) {
+	w, err := newFileWatcher(s.mr)
+	if err != nil {
+		log.Warningf("Could not watch the monorepo, polling BUILDUNIT files instead: %v", err)
+		s.poll(ctx, interval, rescanInterval)
+		return
+	}
+	defer w.Close()
+	// Editors and syncs touch many files at once, changes are reloaded after |interval| of quiet.
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events():
+			if !ok {
+				log.Warningf("Stopped watching the monorepo, polling BUILDUNIT files instead.")
+				s.poll(ctx, interval, rescanInterval)
+				return
+			}
+			if s.current().affectedBy(s.mr, ev) {
+				settled = time.After(interval)
+			}
+		case <-settled:
+			settled = nil
+			s.reload()
+		}
+	}
+}
+
+// poll checks the BUILDUNIT files for changes every |interval| and scans the monorepo for new ones
+// every |rescanInterval|, reloading them when needed.
+func (s *server) poll(ctx context.Context, interval, rescanInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastScan := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		gen := s.current()
+		changed := gen.modified()
+		if !changed && time.Since(lastScan) >= rescanInterval {
+			lastScan = time.Now()
+			var err error
+			if changed, err = gen.newFiles(s.mr); err != nil {
+				log.Warningf("Could not scan for BUILDUNIT files: %v", err)
+			}
+		}
+		if changed {
+			s.reload()
+		}
+	}
+}
+
+// current returns the current generation.
+func (s *server) current() *generation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gen
+}
+
+// reload replaces the current generation with a newly loaded one.
+func (s *server) reload() {
+	log.Infof("BUILDUNIT files changed, reloading.")
+	newGen, err := s.load()
+	if err != nil {
+		// Keep serving the previous generation, a half edited BUILDUNIT file might not parse.
+		log.Warningf("Could not reload BUILDUNIT files: %v", err)
+		return
+	}
+	// Taking buildMu waits for in-flight builds on the previous generation.
+	s.buildMu.Lock()
+	s.mu.Lock()
+	old := s.gen
+	s.gen = newGen
+	s.mu.Unlock()
+	s.buildMu.Unlock()
+	old.bc.Cleanup()
+}
+
+// modified returns whether any of the BUILDUNIT files of the generation changed or disappeared.
+func (gen *generation) modified() bool {
+	for p, mtime := range gen.mtimes {
+		info, err := os.Stat(p)
+		if err != nil || !info.ModTime().Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// newFiles returns whether there are BUILDUNIT files not known to the generation.
+func (gen *generation) newFiles(mr monorepo.Monorepo) (bool, error) {
+	dirs, err := build.FindBuildUnitDirs(mr)
+	if err != nil {
+		return false, err
+	}
+	for _, dir := range dirs {
+		if _, ok := gen.mtimes[filepath.Join(mr.ResolvePath(dir), "BUILDUNIT")]; !ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// withContext runs |fn| with the build context of the current generation, unless |ctx| is done
+// by the time the previous builds are.
+func (s *server) withContext(ctx context.Context, fn func(bc build.Context) error) error {
+	s.buildMu.Lock()
+	defer s.buildMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn(s.current().bc)
+}
+
+// requestOptions directs the logs of a single request to |logs| and kills its builds once |ctx|
+// is done, eg. the client went away.
+func (s *server) requestOptions(ctx context.Context, logs io.Writer, logLevel string) build.Option {
+	return func(options *build.Options) {
+		options.Context = ctx
+		options.Logs = logs
+		if logLevel != "" {
+			options.LogLevel = logLevel
+		}
+	}
+}
+
+func (s *server) Build(ctx context.Context, req *servicepb.BuildRequest) (*servicepb.BuildResponse, error) {
+	label, err := s.mr.NewLabel("", req.Label)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid label %q: %v", req.Label, err)
+	}
+	log.Infof("Building %s", label)
+	var logs bytes.Buffer
+	resp := &servicepb.BuildResponse{}
+	err = s.withContext(ctx, func(bc build.Context) error {
+		result, err := bc.Build(label, s.requestOptions(ctx, &logs, req.LogLevel))
+		resp.Result = result
+		return err
+	})
+	resp.Logs = logs.String()
+	if ctx.Err() != nil {
+		return nil, canceled(ctx)
+	}
+	// Failed builds are reported through the result.
+	if err != nil && !build.IsFailed(err) {
+		return nil, status.Errorf(codes.Internal, "could not build %s: %v", label, err)
+	}
+	return resp, nil
+}
+
+func (s *server) Test(ctx context.Context, req *servicepb.TestRequest) (*servicepb.TestResponse, error) {
+	te, err := s.mr.NewTargetExpressionWithShorthand("", req.Target, "test")
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid target %q: %v", req.Target, err)
+	}
+	var logs bytes.Buffer
+	resp := &servicepb.TestResponse{}
+	err = s.withContext(ctx, func(bc build.Context) error {
+		testUnits, err := bc.ExpandTargetExpression(te)
+		if err != nil {
+			return err
+		}
+		for _, tu := range testUnits {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			log.Infof("Testing %s", tu)
+			result, err := bc.Test(tu, s.requestOptions(ctx, &logs, req.LogLevel))
+			ur := &servicepb.TestResponse_UnitResult{
+				Label:  tu.String(),
+				Result: result,
+			}
+			if err != nil && !build.IsFailed(err) {
+				ur.Error = err.Error()
+			}
+			resp.UnitResult = append(resp.UnitResult, ur)
+		}
+		return nil
+	})
+	resp.Logs = logs.String()
+	if ctx.Err() != nil {
+		return nil, canceled(ctx)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not expand %s: %v", req.Target, err)
+	}
+	return resp, nil
+}
+
+func (s *server) Query(ctx context.Context, req *servicepb.QueryRequest) (*servicepb.QueryResponse, error) {
+	qr := queryRequest{
+		owner:      req.Owner,
+		deprecated: req.Deprecated,
+	}
+	if req.Dir != "" {
+		p, err := s.mr.NewPath("", req.Dir)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid dir %q: %v", req.Dir, err)
+		}
+		qr.dir = p
+	}
+	results, err := query(s.mr, s.current().unitFiles, qr)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	resp := &servicepb.QueryResponse{}
+	for _, r := range results {
+		resp.Unit = append(resp.Unit, &servicepb.QueryResponse_Unit{
+			Label:       r.label.String(),
+			Kind:        r.unit.Kind,
+			Owner:       r.unit.GetOwner(),
+			Deprecated:  r.unit.GetDeprecated(),
+			Replacement: r.unit.GetReplacement(),
+		})
+	}
+	return resp, nil
+}
+
+// canceled returns the status of a request whose |ctx| is done before it completed.
+func canceled(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, "request deadline exceeded")
+	}
+	return status.Error(codes.Canceled, "request canceled")
+}
+
+// authInterceptor rejects calls that don't carry |token| as bearer token. The server only listens
+// on localhost, the token keeps other users of the machine from running builds as us.
+func authInterceptor(token string) grpc.UnaryServerInterceptor {
+	want := []byte("Bearer " + token)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(v), want) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeServeInfo writes |info| so that only the current user can read it.
+func writeServeInfo(p string, info serveInfo) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, content, 0600); err != nil {
+		return fmt.Errorf("could not write serve info to %s: %v", p, err)
+	}
+	return nil
+}
@@ -16,46 +16,110 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"sge-monorepo/build/cicd/monorepo"
 	"sge-monorepo/build/cicd/sgeb/build"
+	"sge-monorepo/build/cicd/sgeb/build/kms"
+	"sge-monorepo/environment/envinstall"
 	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
 )
 
 const defaultMaxResults = 10
 
+// reportedCommands are the commands that print a report card when they end.
+var reportedCommands = map[string]bool{
+	"build":   true,
+	"test":    true,
+	"publish": true,
+}
+
 func printUsage() {
 	fmt.Println(`Usage:
-sgeb [-log_level=level -remote] build|test|publish|run <unit>`)
+sgeb [-log_level=level -remote -install_env -bazel_retries=n -report -signing_key=key -verify_key=key] build|test|publish|run <unit>
+sgeb test [-rerun_failed -cl=cl] <unit>
+sgeb bisect -good=cl -bad=cl [-reset] <unit>
+sgeb diff-outputs [-cl=cl | -base=file] [-head=file] [-save] [-json] <build unit>
+sgeb publish [-since_cl=cl -verify_signatures] <unit> [args...]
+sgeb -verify_key=key verify [-signatures=file] <build unit>
+sgeb gen [-fix] <unit>
+sgeb query [-owner=owner -deprecated] [<dir>/...]
+sgeb deps -why <unit> <dependency>
+sgeb deps -suggest [-fix] <build unit>
+sgeb prefetch <target expression>...
+sgeb service <unit>...
+sgeb serve [-port=port -info_file=file]`)
 	fmt.Println("  -log_level: One of INFO, WARNING, ERROR, FATAL")
 }
 
-func sgeb() error {
+func sgeb() (err error) {
 	log.AddSink(log.NewGlog())
 	defer log.Shutdown()
 	flags := struct {
-		logLevel string
-		remote   bool
-		change   int
+		logLevel   string
+		remote     bool
+		change     int
+		installEnv bool
+		retries    int
+		report     bool
+		signingKey string
+		verifyKey  string
 	}{}
 	flag.StringVar(&flags.logLevel, "log_level", "ERROR", "log level. One of INFO, WARNING, ERROR, FATAL")
 	flag.BoolVar(&flags.remote, "remote", false, "Whether this should be run on a remote machine within the dev environment")
 	flag.IntVar(&flags.change, "c", 0, "For remote runs, unshelve this CL before running the command on the remote machine.")
+	flag.BoolVar(&flags.installEnv, "install_env", envinstall.IsCloud(), "Install the environment components required by units when missing. Defaults to true in CI.")
+	flag.IntVar(&flags.retries, "bazel_retries", build.DefaultBazelRetries, "How many times Bazel commands are retried after a transient failure, eg. a Bazel server crash.")
+	flag.BoolVar(&flags.report, "report", true, "Print a report card of the time and resources used by build, test and publish commands, and write it to sgeb-out/report.json.")
+	flag.StringVar(&flags.signingKey, "signing_key", "", "Resource name of the Cloud KMS key version to sign the artifacts of build units with.")
+	flag.StringVar(&flags.verifyKey, "verify_key", "", "Resource name of the Cloud KMS key version to verify the signatures of artifacts with. Only needs access to its public key.")
 	flag.Parse()
 
 	mr, rel, err := monorepo.NewFromPwd()
 	if err != nil {
 		return fmt.Errorf("could not locate WORKSPACE: %v", err)
 	}
-	bc, err := build.NewContext(mr, func(options *build.Options) {
+	var report *build.Report
+	if flags.report && !flags.remote && reportedCommands[flag.Arg(0)] {
+		report = build.NewReport(flag.Arg(0))
+		defer func() {
+			finishReport(mr, report, err == nil)
+		}()
+	}
+	var signingKey, verifyKey *kms.Key
+	if flags.signingKey != "" && !flags.remote {
+		if signingKey, err = kms.New(context.Background(), flags.signingKey); err != nil {
+			return build.WithExitCode(err, build.ExitInfra)
+		}
+		defer signingKey.Close()
+	}
+	if flags.verifyKey != "" && !flags.remote {
+		if verifyKey, err = kms.New(context.Background(), flags.verifyKey); err != nil {
+			return build.WithExitCode(err, build.ExitInfra)
+		}
+		defer verifyKey.Close()
+	}
+	contextOpts := func(options *build.Options) {
 		options.LogLevel = flags.logLevel
-	})
+		options.InstallMissingEnv = flags.installEnv
+		options.BazelRetries = flags.retries
+		options.Report = report
+		if signingKey != nil {
+			options.Signer = signingKey
+		}
+	}
+	bc, err := build.NewContext(mr, contextOpts)
 	if err != nil {
 		return fmt.Errorf("could not create build context: %v", err)
 	}
@@ -71,12 +135,12 @@ func sgeb() error {
 		flagSet := flag.NewFlagSet("build", flag.ExitOnError)
 		_ = flagSet.Parse(flag.Args()[1:])
 		if flagSet.NArg() == 0 {
-			return fmt.Errorf("must pass build unit to build command")
+			return build.UsageErrorf("must pass build unit to build command")
 		}
 		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
 		bu, err := mr.NewLabel(rel, target)
 		if err != nil {
-			return err
+			return build.WithExitCode(err, build.ExitUsage)
 		}
 		fmt.Printf("Building %s\n", bu)
 		if flags.remote {
@@ -94,9 +158,11 @@ func sgeb() error {
 		return err
 	case "test":
 		flagSet := flag.NewFlagSet("test", flag.ExitOnError)
+		rerunFailed := flagSet.Bool("rerun_failed", false, "Only run the targets of Bazel test units that failed in their last run at the same CL.")
+		cl := flagSet.Int64("cl", 0, "CL the tests run at, which the failed targets are recorded by. With -rerun_failed, defaults to the CL the workspace is synced to.")
 		_ = flagSet.Parse(flag.Args()[1:])
 		if flagSet.NArg() == 0 {
-			return fmt.Errorf("must pass test unit to test command")
+			return build.UsageErrorf("must pass test unit to test command")
 		}
 		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
 		if flags.remote {
@@ -109,16 +175,27 @@ func sgeb() error {
 		}
 		te, err := mr.NewTargetExpressionWithShorthand(rel, target, "test")
 		if err != nil {
-			return err
+			return build.WithExitCode(err, build.ExitUsage)
 		}
 		testUnits, err := bc.ExpandTargetExpression(te)
 		if err != nil {
 			return err
 		}
+		// Finding the CL the workspace is synced to scans the whole workspace, so other runs
+		// record failed tests at an unknown CL, which reruns fall back to.
+		if *cl == 0 && *rerunFailed {
+			if *cl, err = build.HaveCl(p4lib.New()); err != nil {
+				log.Warningf("rerunning the targets that failed at any CL: %v", err)
+			}
+		}
+		testOpts := func(o *build.Options) {
+			o.FailedTests = build.NewFailedTests(o.OutputDir, *cl)
+			o.RerunFailed = *rerunFailed
+		}
 		var errs []error
 		for _, tu := range testUnits {
 			fmt.Printf("Testing %s\n", tu)
-			result, err := bc.Test(tu)
+			result, err := bc.Test(tu, testOpts)
 			if result != nil {
 				build.PrintTestResult(os.Stderr, tu, result)
 			}
@@ -130,20 +207,82 @@ func sgeb() error {
 			}
 		}
 		if len(errs) != 0 {
-			return fmt.Errorf("sgeb test FAILED")
+			return build.WithExitCode(fmt.Errorf("sgeb test FAILED"), build.WorstExitCode(errs...))
+		}
+		return nil
+	case "bisect":
+		flagSet := flag.NewFlagSet("bisect", flag.ExitOnError)
+		good := flagSet.Int64("good", 0, "CL the unit passes at.")
+		bad := flagSet.Int64("bad", 0, "Later CL the unit fails at.")
+		reset := flagSet.Bool("reset", false, "Discard the saved state of a previous bisection of the unit between the same CLs instead of resuming it.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() == 0 {
+			return build.UsageErrorf("must pass build or test unit to bisect command")
+		}
+		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
+		unit, err := mr.NewLabel(rel, target)
+		if err != nil {
+			return build.WithExitCode(err, build.ExitUsage)
 		}
+		b := build.NewBisect(mr.ResolvePath("sgeb-out"), newP4(), func(cl int64) error {
+			// BUILDUNIT files and build results are cached by the context, so each CL gets its own.
+			bc, err := build.NewContext(mr, contextOpts)
+			if err != nil {
+				return err
+			}
+			defer bc.Cleanup()
+			return runBisectUnit(mr, bc, unit)
+		})
+		if *reset {
+			if err := b.Reset(unit, *good, *bad); err != nil {
+				return err
+			}
+		}
+		state, err := b.Bisect(unit, *good, *bad)
+		if err != nil {
+			return err
+		}
+		build.PrintBisectResult(os.Stdout, state)
+		fmt.Printf("Verdict written to %s\n", b.StatePath(unit, *good, *bad))
 		return nil
+	case "diff-outputs":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with diff-outputs")
+		}
+		flagSet := flag.NewFlagSet("diff-outputs", flag.ExitOnError)
+		var req diffOutputsRequest
+		flagSet.Int64Var(&req.cl, "cl", 0, "Build the base at this CL. The workspace is synced back afterwards and must not have opened files.")
+		flagSet.StringVar(&req.base, "base", "", "Output snapshot to compare against instead of building the base, eg. one saved with -save.")
+		flagSet.StringVar(&req.head, "head", "", "Output snapshot to compare instead of building the unit in the workspace.")
+		flagSet.BoolVar(&req.save, "save", false, "Only build the unit in the workspace and save the snapshot of its outputs.")
+		flagSet.BoolVar(&req.json, "json", false, "Print the differences as JSON.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() == 0 && (req.base == "" || req.head == "") {
+			return build.UsageErrorf("must pass build unit to diff-outputs command")
+		}
+		if flagSet.NArg() > 0 {
+			bu, err := mr.NewLabel(rel, strings.ReplaceAll(flagSet.Arg(0), `\`, `/`))
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			req.unit = bu
+		}
+		return diffOutputs(mr, bc, func() (build.Context, error) {
+			return build.NewContext(mr, contextOpts)
+		}, req)
 	case "publish":
 		flagSet := flag.NewFlagSet("publish", flag.ExitOnError)
+		sinceCl := flagSet.Int64("since_cl", 0, "CL the publish unit was last published at, to list the changes published since.")
+		verify := flagSet.Bool("verify_signatures", false, "Verify the artifacts of the build units against the signatures saved by their last signed build before running the publish tool. Needs -verify_key.")
 		_ = flagSet.Parse(flag.Args()[1:])
 		// First argument is binary to run, all other arguments are forwarded to the binary.
 		if flagSet.NArg() == 0 {
-			return fmt.Errorf("must pass publish unit to publish command")
+			return build.UsageErrorf("must pass publish unit to publish command")
 		}
 		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
 		pu, err := mr.NewLabelWithShorthand(rel, target, "publish")
 		if err != nil {
-			return err
+			return build.WithExitCode(err, build.ExitUsage)
 		}
 		fmt.Printf("Publishing %s\n", pu)
 		publishArgs := flagSet.Args()[1:]
@@ -156,32 +295,68 @@ func sgeb() error {
 				args:     publishArgs,
 			})
 		}
-		results, err := bc.Publish(pu, publishArgs)
+		if *verify && verifyKey == nil {
+			return build.UsageErrorf("must pass -verify_key with -verify_signatures")
+		}
+		if *verify && signingKey != nil {
+			return build.UsageErrorf("cannot use -signing_key with -verify_signatures, publish would sign the artifacts it verifies")
+		}
+		results, err := bc.Publish(pu, publishArgs, func(o *build.Options, po *build.PublishOptions) {
+			po.SinceCl = *sinceCl
+			if *verify {
+				o.Verifier = verifyKey
+			}
+		})
 		if err != nil {
 			return err
 		}
 		if len(results) > 0 {
 			for _, r := range results {
 				fmt.Printf("Published %s successfully\n", r.Name)
+				if r.Changelog != nil {
+					fmt.Print(build.FormatChangelog(r.Name, r.Changelog))
+				}
 			}
 		} else {
 			fmt.Println("Nothing to publish (no changes detected?)")
 		}
 		return nil
+	case "verify":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with verify")
+		}
+		flagSet := flag.NewFlagSet("verify", flag.ExitOnError)
+		signatures := flagSet.String("signatures", "", "Signed artifacts to verify, instead of the ones saved by the last build of the unit.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if verifyKey == nil {
+			return build.UsageErrorf("must pass -verify_key to verify command")
+		}
+		p := *signatures
+		if p == "" {
+			if flagSet.NArg() == 0 {
+				return build.UsageErrorf("must pass build unit to verify command")
+			}
+			bu, err := mr.NewLabel(rel, strings.ReplaceAll(flagSet.Arg(0), `\`, `/`))
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			p = build.SignaturesPath(mr.ResolvePath("sgeb-out"), bu)
+		}
+		return verifySignatures(verifyKey, p)
 	case "run":
 		if flags.remote {
-			return errors.New("cannot use -remote with run")
+			return build.UsageErrorf("cannot use -remote with run")
 		}
 		flagSet := flag.NewFlagSet("run", flag.ExitOnError)
 		_ = flagSet.Parse(flag.Args()[1:])
 		// First argument is binary to run, all other arguments are forwarded to the binary.
 		if flagSet.NArg() == 0 {
-			return fmt.Errorf("must pass build unit to run command")
+			return build.UsageErrorf("must pass build unit to run command")
 		}
 		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
 		bu, err := mr.NewLabel(rel, target)
 		if err != nil {
-			return err
+			return build.WithExitCode(err, build.ExitUsage)
 		}
 		fmt.Printf("Building %s\n", bu)
 		p, result, err := bc.ResolveBin("", bu.String())
@@ -199,53 +374,363 @@ func sgeb() error {
 		return cmd.Run()
 	case "cron":
 		if flags.remote {
-			return errors.New("cannot use -remote with cron")
+			return build.UsageErrorf("cannot use -remote with cron")
 		}
 		flagSet := flag.NewFlagSet("cron", flag.ExitOnError)
 		_ = flagSet.Parse(flag.Args()[1:])
 		// First argument is binary to run, all other arguments are forwarded to the binary.
 		if flagSet.NArg() == 0 {
-			return fmt.Errorf("must pass cron unit to cron command")
+			return build.UsageErrorf("must pass cron unit to cron command")
 		}
 		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
 		cu, err := mr.NewLabelWithShorthand(rel, target, "cron")
 		if err != nil {
-			return err
+			return build.WithExitCode(err, build.ExitUsage)
 		}
 		fmt.Printf("Running %s\n", cu)
 		cronArgs := flagSet.Args()[1:]
 		return bc.RunCron(cu, cronArgs)
 	case "task":
 		if flags.remote {
-			return errors.New("cannot use -remote with task")
+			return build.UsageErrorf("cannot use -remote with task")
 		}
 		flagSet := flag.NewFlagSet("task", flag.ExitOnError)
 		_ = flagSet.Parse(flag.Args()[1:])
 		// First argument is binary to run, all other arguments are forwarded to the binary.
 		if flagSet.NArg() == 0 {
-			return fmt.Errorf("must pass task unit to task command")
+			return build.UsageErrorf("must pass task unit to task command")
 		}
 		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
 		cu, err := mr.NewLabelWithShorthand(rel, target, "task")
 		if err != nil {
-			return err
+			return build.WithExitCode(err, build.ExitUsage)
 		}
 		fmt.Printf("Running %s\n", cu)
 		taskArgs := flagSet.Args()[1:]
 		return bc.RunTask(cu, taskArgs)
+	case "gen":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with gen")
+		}
+		flagSet := flag.NewFlagSet("gen", flag.ExitOnError)
+		fix := flagSet.Bool("fix", false, "Overwrite stale generated files and open them in a new CL.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() == 0 {
+			return build.UsageErrorf("must pass gen unit to gen command")
+		}
+		target := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
+		gu, err := mr.NewLabelWithShorthand(rel, target, "gen")
+		if err != nil {
+			return build.WithExitCode(err, build.ExitUsage)
+		}
+		fmt.Printf("Generating %s\n", gu)
+		result, err := bc.Generate(gu)
+		if err != nil && !build.IsFailed(err) {
+			return err
+		}
+		stale := result.Stale()
+		for _, o := range stale {
+			fmt.Printf("Stale: %s\n", o.Path)
+		}
+		if len(stale) == 0 || !*fix {
+			return err
+		}
+		return fixGenerated(mr, gu, result)
+	case "query":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with query")
+		}
+		flagSet := flag.NewFlagSet("query", flag.ExitOnError)
+		var req queryRequest
+		flagSet.StringVar(&req.owner, "owner", "", "Only list units owned by this user or group.")
+		flagSet.BoolVar(&req.deprecated, "deprecated", false, "Only list deprecated units.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() > 0 {
+			dir := strings.ReplaceAll(flagSet.Arg(0), `\`, `/`)
+			dir = strings.TrimSuffix(strings.TrimSuffix(dir, "..."), "/")
+			p, err := mr.NewPath(rel, dir)
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			req.dir = p
+		}
+		unitFiles, err := build.DiscoverBuildUnitFiles(mr, bc)
+		if err != nil {
+			return err
+		}
+		results, err := query(mr, unitFiles, req)
+		if err != nil {
+			return err
+		}
+		printQueryResults(os.Stdout, results)
+		return nil
+	case "deps":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with deps")
+		}
+		flagSet := flag.NewFlagSet("deps", flag.ExitOnError)
+		why := flagSet.Bool("why", false, "Explain why the first unit depends on the second one.")
+		suggest := flagSet.Bool("suggest", false, "Trace the files the tool of a build unit reads and suggest the deps it is missing.")
+		fix := flagSet.Bool("fix", false, "With -suggest, add the suggested deps to the BUILDUNIT file and open it in a new CL.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if *suggest && flagSet.NArg() == 1 {
+			bu, err := mr.NewLabel(rel, strings.ReplaceAll(flagSet.Arg(0), `\`, `/`))
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			fmt.Printf("Tracing %s\n", bu)
+			suggestion, err := bc.SuggestDeps(bu)
+			if err != nil {
+				return err
+			}
+			printDepsSuggestion(os.Stdout, suggestion)
+			if len(suggestion.Deps) == 0 || !*fix {
+				return nil
+			}
+			return fixDeps(mr, suggestion)
+		}
+		if !*why || flagSet.NArg() != 2 {
+			return build.UsageErrorf("usage: sgeb deps -why <unit> <dependency> | sgeb deps -suggest [-fix] <build unit>")
+		}
+		var labels []monorepo.Label
+		for _, arg := range flagSet.Args() {
+			l, err := mr.NewLabel(rel, strings.ReplaceAll(arg, `\`, `/`))
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			labels = append(labels, l)
+		}
+		chain, err := bc.DepsWhy(labels[0], labels[1])
+		if err != nil {
+			return err
+		}
+		printDepChain(os.Stdout, chain)
+		return nil
+	case "prefetch":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with prefetch")
+		}
+		flagSet := flag.NewFlagSet("prefetch", flag.ExitOnError)
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() == 0 {
+			return build.UsageErrorf("must pass a target expression to prefetch command")
+		}
+		failures := 0
+		for _, arg := range flagSet.Args() {
+			te, err := mr.NewTargetExpression(rel, strings.ReplaceAll(arg, `\`, `/`))
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			fmt.Printf("Prefetching %s\n", te)
+			result, err := bc.Prefetch(te)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d units: built %d tools, installed %d environment components, fetched %d Bazel targets\n", len(result.Units), len(result.Tools), len(result.Env), len(result.BazelTargets))
+			for _, f := range result.Failures {
+				fmt.Printf("Failed: %s: %v\n", f.What, f.Err)
+			}
+			failures += len(result.Failures)
+		}
+		if failures > 0 {
+			return build.WithExitCode(fmt.Errorf("%d prefetches failed", failures), build.ExitInfra)
+		}
+		return nil
+	case "service":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with service")
+		}
+		flagSet := flag.NewFlagSet("service", flag.ExitOnError)
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() == 0 {
+			return build.UsageErrorf("must pass service units to service command")
+		}
+		var labels []monorepo.Label
+		for _, arg := range flagSet.Args() {
+			l, err := mr.NewLabelWithShorthand(rel, strings.ReplaceAll(arg, `\`, `/`), "")
+			if err != nil {
+				return build.WithExitCode(err, build.ExitUsage)
+			}
+			labels = append(labels, l)
+		}
+		services, err := bc.StartServices(labels)
+		if err != nil {
+			return err
+		}
+		for _, svc := range services.List() {
+			fmt.Printf("%s is running, logs in %s\n", svc.Label, svc.LogPath)
+			for name, port := range svc.Ports {
+				fmt.Printf("  %s: localhost:%d\n", name, port)
+			}
+		}
+		fmt.Println("Press Ctrl+C to stop the services")
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		exited := make(chan error, 1)
+		go func() {
+			exited <- services.Wait()
+		}()
+		select {
+		case <-sigs:
+			// Let another Ctrl+C kill sgeb if stopping the services hangs.
+			signal.Stop(sigs)
+			return services.Stop()
+		case err := <-exited:
+			if serr := services.Stop(); serr != nil {
+				log.Warning(serr)
+			}
+			return err
+		}
+	case "serve":
+		if flags.remote {
+			return build.UsageErrorf("cannot use -remote with serve")
+		}
+		flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+		req := serveRequest{logLevel: flags.logLevel}
+		flagSet.IntVar(&req.port, "port", 0, "Port to listen to on localhost. By default a free port is picked.")
+		flagSet.StringVar(&req.infoFile, "info_file", filepath.Join(mr.ResolvePath("sgeb-out"), "serve.json"), "File to write the server address and auth token to.")
+		flagSet.DurationVar(&req.watchInterval, "watch_interval", 2*time.Second, "How long BUILDUNIT files must be left alone before changes are reloaded, or how often they are polled without file notifications.")
+		flagSet.DurationVar(&req.rescanInterval, "rescan_interval", time.Minute, "How often the monorepo is scanned for new BUILDUNIT files without file notifications.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		return serve(mr, req)
 	default:
-		return fmt.Errorf("unknown command: %q", flag.Arg(0))
+		return build.UsageErrorf("unknown command: %q", flag.Arg(0))
 	}
 }
 
+// fixGenerated overwrites the stale outputs of gen unit |gu| and opens them in a new CL.
+func fixGenerated(mr monorepo.Monorepo, gu monorepo.Label, result *build.GenResult) error {
+	paths, err := build.WriteGenOutputs(mr, result)
+	if err != nil {
+		return fmt.Errorf("could not write generated files: %v", err)
+	}
+	cb := p4lib.NewChangeBuilder(newP4(), fmt.Sprintf("Regenerate %s\n\nGenerated with sgeb gen -fix %s.", gu, gu))
+	cb.Reconcile(paths...)
+	change, err := cb.Build()
+	if err != nil {
+		return fmt.Errorf("could not open regenerated files: %v", err)
+	}
+	fmt.Printf("Opened %d regenerated files in CL %d\n", len(paths), change.CL)
+	return nil
+}
+
+// fixDeps adds the suggested deps to the BUILDUNIT file of the unit and opens it in a new CL.
+func fixDeps(mr monorepo.Monorepo, suggestion *build.DepsSuggestion) error {
+	p, err := build.WriteSuggestedDeps(mr, suggestion)
+	if err != nil {
+		return fmt.Errorf("could not add deps: %v", err)
+	}
+	l := suggestion.Label
+	cb := p4lib.NewChangeBuilder(newP4(), fmt.Sprintf("Add missing deps of %s\n\nSuggested by sgeb deps -suggest -fix %s.", l, l))
+	cb.Reconcile(p)
+	change, err := cb.Build()
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", p, err)
+	}
+	fmt.Printf("Added %d deps to %s in CL %d\n", len(suggestion.Deps), p, change.CL)
+	return nil
+}
+
+// verifySignatures verifies the signed artifacts saved to |p| with |v|. Returns a failed error if
+// any artifact was modified since it was signed, or isn't signed with the key of |v|.
+func verifySignatures(v build.Verifier, p string) error {
+	as, err := build.LoadSignatures(p)
+	if err != nil {
+		return build.WithExitCode(fmt.Errorf("could not load signed artifacts, build the unit with -signing_key first: %v", err), build.ExitUsage)
+	}
+	if err := build.VerifyArtifacts(v, as); errors.Is(err, build.ErrBadSignature) {
+		return build.WithExitCode(err, build.ExitFailed)
+	} else if err != nil {
+		return build.WithExitCode(err, build.ExitInfra)
+	}
+	signed := 0
+	for _, a := range as.Artifacts {
+		if a.Signature != nil {
+			signed++
+		}
+	}
+	fmt.Printf("Verified the signatures of %d artifacts in %s\n", signed, p)
+	return nil
+}
+
+// runBisectUnit tests |unit| if it is a test unit, or builds it otherwise.
+func runBisectUnit(mr monorepo.Monorepo, bc build.Context, unit monorepo.Label) error {
+	pkgDir, err := mr.ResolveLabelPkgDir(unit)
+	if err != nil {
+		return err
+	}
+	bus, err := bc.LoadBuildUnits(pkgDir)
+	if err != nil {
+		return err
+	}
+	u, ok := build.FindUnit(bus, unit.Target)
+	if !ok {
+		for _, btu := range bus.BuildTestUnit {
+			if btu.Name == unit.Target {
+				u.Kind = "build_test_unit"
+			}
+		}
+	}
+	switch u.Kind {
+	case "test_unit", "build_test_unit":
+		result, err := bc.Test(unit)
+		if result != nil {
+			build.PrintTestResult(os.Stderr, unit, result)
+		}
+		return err
+	case "build_unit":
+		result, err := bc.Build(unit)
+		if result != nil {
+			build.PrintBuildResult(os.Stderr, unit, result, defaultMaxResults)
+		}
+		return err
+	}
+	return build.UsageErrorf("%s is not a build or test unit", unit)
+}
+
+// newP4 returns a P4 that prints the advisory messages of the server, eg. maintenance windows.
+func newP4() p4lib.P4 {
+	return p4lib.WithWarningHandler(p4lib.New(), func(w p4lib.Warning) {
+		fmt.Fprintf(os.Stderr, "WARNING: Perforce %s: %s\n", w.Kind, w.Message)
+	})
+}
+
+// finishReport prints the report card of the invocation and writes it to sgeb-out.
+func finishReport(mr monorepo.Monorepo, report *build.Report, success bool) {
+	report.Finish(success)
+	report.Print(os.Stderr, 5)
+	p := filepath.Join(mr.ResolvePath("sgeb-out"), "report.json")
+	if err := report.Write(p); err != nil {
+		log.Warningf("could not write report card to %s: %v", p, err)
+	}
+}
+
+// main exits with one of the build.Exit* codes, see docs/sgeb.md.
 func main() {
-	if err := sgeb(); err == nil {
+	// Interrupts also reach the processes sgeb runs, which make sgeb return once they exit. Only the
+	// first interrupt is caught, so that another one kills sgeb if cleaning up hangs.
+	var interrupted int32
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		atomic.StoreInt32(&interrupted, 1)
+	}()
+
+	err := sgeb()
+	if err == nil {
 		fmt.Printf("sgeb %s succeeded\n", flag.Arg(0))
-	} else {
-		fmt.Println(err)
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			fmt.Println(string(exitErr.Stderr))
-		}
-		os.Exit(1)
+		return
+	}
+	fmt.Println(err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		fmt.Println(string(exitErr.Stderr))
+	}
+	code := build.ExitCode(err)
+	if atomic.LoadInt32(&interrupted) == 1 {
+		code = build.ExitCancelled
 	}
+	os.Exit(code)
 }
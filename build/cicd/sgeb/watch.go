@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/cicd/sgeb/build"
+)
+
+// watchEvent is a change to a file or directory of the monorepo reported by the file watcher.
+type watchEvent struct {
+	// path is the monorepo path of the file or directory, empty when the watcher lost events and
+	// anything may have changed.
+	path monorepo.Path
+	// added is set when the file or directory was created or moved in. New directories may bring
+	// BUILDUNIT files with them.
+	added bool
+}
+
+// fileWatcher watches the monorepo for changes with the file notifications of the OS, see
+// newFileWatcher.
+type fileWatcher interface {
+	// Events receives the changes to the monorepo outside of its output trees. It is closed if
+	// the watcher fails.
+	Events() <-chan watchEvent
+	Close() error
+}
+
+// watchedDir returns whether the changes in monorepo directory |dir| are watched: output trees
+// and hidden directories, eg. .git, have no BUILDUNIT files.
+func watchedDir(dir monorepo.Path) bool {
+	if dir == "." {
+		return true
+	}
+	if build.IsOutputTree(dir) {
+		return false
+	}
+	for _, part := range strings.Split(string(dir), "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// affectedBy returns whether |ev| may change the BUILDUNIT files of the generation: a BUILDUNIT
+// file changed, a directory with known BUILDUNIT files was removed or renamed, or a directory with
+// BUILDUNIT files appeared.
+func (gen *generation) affectedBy(mr monorepo.Monorepo, ev watchEvent) bool {
+	if ev.path == "" || path.Base(string(ev.path)) == "BUILDUNIT" {
+		return true
+	}
+	abs := mr.ResolvePath(ev.path)
+	info, err := os.Stat(abs)
+	if os.IsNotExist(err) {
+		for _, uf := range gen.unitFiles {
+			if uf.Dir == ev.path || strings.HasPrefix(string(uf.Dir), string(ev.path)+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	if err != nil || !ev.added || !info.IsDir() {
+		return false
+	}
+	err = filepath.Walk(abs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if dir, err := mr.RelPath(p); err != nil || !watchedDir(dir) {
+				return filepath.SkipDir
+			}
+		} else if info.Name() == "BUILDUNIT" {
+			return io.EOF
+		}
+		return nil
+	})
+	return err == io.EOF
+}
@@ -0,0 +1,30 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows,!linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"sge-monorepo/build/cicd/monorepo"
+)
+
+// newFileWatcher fails, file notifications are only supported on Windows and Linux. The server
+// polls BUILDUNIT files instead.
+func newFileWatcher(mr monorepo.Monorepo) (fileWatcher, error) {
+	return nil, fmt.Errorf("file notifications aren't supported on %s", runtime.GOOS)
+}
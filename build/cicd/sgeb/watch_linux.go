@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/libs/go/log"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask are the inotify events that may change BUILDUNIT files.
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// inotifyWatcher watches the monorepo with inotify. inotify doesn't watch trees, so every watched
+// directory has its own watch, added as directories appear.
+type inotifyWatcher struct {
+	mr     monorepo.Monorepo
+	file   *os.File
+	fd     int
+	events chan watchEvent
+	// done is closed by Close, so that the reader stops sending events nobody reads.
+	done chan struct{}
+
+	// mu guards dirs, the monorepo directories of the watch descriptors.
+	mu   sync.Mutex
+	dirs map[int]monorepo.Path
+}
+
+// newFileWatcher watches the directories of the monorepo outside of its output trees.
+func newFileWatcher(mr monorepo.Monorepo) (fileWatcher, error) {
+	// A non blocking descriptor lets Close interrupt the reads of the watcher.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("could not create inotify instance: %v", err)
+	}
+	w := &inotifyWatcher{
+		mr:     mr,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		events: make(chan watchEvent, 64),
+		done:   make(chan struct{}),
+		dirs:   map[int]monorepo.Path{},
+	}
+	if err := w.addTree(mr.Root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan watchEvent {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+// send sends |ev| unless the watcher is closed. Returns whether it was sent.
+func (w *inotifyWatcher) send(ev watchEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// addTree watches directory |root| and its subdirectories.
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		dir, err := w.mr.RelPath(p)
+		if err != nil || !watchedDir(dir) {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			// Most likely ENOSPC, see /proc/sys/fs/inotify/max_user_watches.
+			return fmt.Errorf("could not watch %s: %v", p, err)
+		}
+		w.mu.Lock()
+		w.dirs[wd] = dir
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// read sends the events of the inotify instance until it's closed. Only the events of BUILDUNIT
+// files and directories are sent, writes to the other files of the monorepo can't change units.
+func (w *inotifyWatcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(raw.Len)]
+			off += unix.SizeofInotifyEvent + int(raw.Len)
+			if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+				if !w.send(watchEvent{}) {
+					return
+				}
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[int(raw.Wd)]
+			if raw.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || raw.Mask&unix.IN_IGNORED != 0 {
+				continue
+			}
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			p := monorepo.NewPath(filepath.ToSlash(filepath.Join(string(dir), string(name))))
+			isDir := raw.Mask&unix.IN_ISDIR != 0
+			if !watchedDir(p) || !isDir && string(name) != "BUILDUNIT" {
+				continue
+			}
+			ev := watchEvent{path: p, added: raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0}
+			if ev.added && isDir {
+				if err := w.addTree(w.mr.ResolvePath(p)); err != nil {
+					log.Warningf("%v", err)
+				}
+			}
+			if !w.send(ev) {
+				return
+			}
+		}
+	}
+}
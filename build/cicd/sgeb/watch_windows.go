@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf16"
+
+	"sge-monorepo/build/cicd/monorepo"
+
+	"golang.org/x/sys/windows"
+)
+
+// rdcwMask are the changes that may change BUILDUNIT files.
+const rdcwMask = windows.FILE_NOTIFY_CHANGE_FILE_NAME | windows.FILE_NOTIFY_CHANGE_DIR_NAME | windows.FILE_NOTIFY_CHANGE_LAST_WRITE
+
+// rdcwWatcher watches the monorepo tree with ReadDirectoryChangesW.
+type rdcwWatcher struct {
+	dir windows.Handle
+	// stop is signaled by Close to interrupt the pending read.
+	stop   windows.Handle
+	events chan watchEvent
+	done   chan struct{}
+}
+
+// newFileWatcher watches the monorepo with a single ReadDirectoryChangesW of its whole tree.
+func newFileWatcher(mr monorepo.Monorepo) (fileWatcher, error) {
+	root, err := windows.UTF16PtrFromString(mr.Root)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := windows.CreateFile(root, windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", mr.Root, err)
+	}
+	stop, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(dir)
+		return nil, err
+	}
+	w := &rdcwWatcher{
+		dir:    dir,
+		stop:   stop,
+		events: make(chan watchEvent, 64),
+		done:   make(chan struct{}),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *rdcwWatcher) Events() <-chan watchEvent {
+	return w.events
+}
+
+func (w *rdcwWatcher) Close() error {
+	close(w.done)
+	return windows.SetEvent(w.stop)
+}
+
+// send sends |ev| unless the watcher is closed. Returns whether it was sent.
+func (w *rdcwWatcher) send(ev watchEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// read sends the changes to BUILDUNIT files and directories of the monorepo until the watcher is
+// closed. Removed entries can't be told apart, so all removals are sent.
+func (w *rdcwWatcher) read() {
+	defer close(w.events)
+	defer windows.CloseHandle(w.stop)
+	defer windows.CloseHandle(w.dir)
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return
+	}
+	defer windows.CloseHandle(event)
+	buf := make([]byte, 64*1024)
+	for {
+		ov := windows.Overlapped{HEvent: event}
+		if err := windows.ReadDirectoryChanges(w.dir, &buf[0], uint32(len(buf)), true, rdcwMask, nil, &ov, 0); err != nil {
+			return
+		}
+		i, err := windows.WaitForMultipleObjects([]windows.Handle{event, w.stop}, false, windows.INFINITE)
+		if err != nil || i != windows.WAIT_OBJECT_0 {
+			windows.CancelIoEx(w.dir, &ov)
+			var n uint32
+			windows.GetOverlappedResult(w.dir, &ov, &n, true)
+			return
+		}
+		var n uint32
+		if err := windows.GetOverlappedResult(w.dir, &ov, &n, false); err != nil {
+			return
+		}
+		if n == 0 {
+			// The buffer overflowed, changes were lost.
+			if !w.send(watchEvent{}) {
+				return
+			}
+			continue
+		}
+		for _, ev := range parseNotifications(buf[:n]) {
+			if !w.send(ev) {
+				return
+			}
+		}
+	}
+}
+
+// parseNotifications returns the events of FILE_NOTIFY_INFORMATION records that may change
+// BUILDUNIT files: changes to BUILDUNIT files, entries added, which may be directories, and
+// entries removed, outside of the output trees.
+func parseNotifications(buf []byte) []watchEvent {
+	var events []watchEvent
+	for off := 0; off+12 <= len(buf); {
+		next := int(binary.LittleEndian.Uint32(buf[off:]))
+		action := binary.LittleEndian.Uint32(buf[off+4:])
+		nameLen := int(binary.LittleEndian.Uint32(buf[off+8:]))
+		if off+12+nameLen > len(buf) {
+			break
+		}
+		name := make([]uint16, nameLen/2)
+		for i := range name {
+			name[i] = binary.LittleEndian.Uint16(buf[off+12+2*i:])
+		}
+		p := monorepo.NewPath(strings.ReplaceAll(string(utf16.Decode(name)), `\`, "/"))
+		added := action == windows.FILE_ACTION_ADDED || action == windows.FILE_ACTION_RENAMED_NEW_NAME
+		removed := action == windows.FILE_ACTION_REMOVED || action == windows.FILE_ACTION_RENAMED_OLD_NAME
+		if watchedDir(p) && (added || removed || path.Base(string(p)) == "BUILDUNIT") {
+			events = append(events, watchEvent{path: p, added: added})
+		}
+		if next == 0 {
+			break
+		}
+		off += next
+	}
+	return events
+}
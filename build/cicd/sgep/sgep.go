@@ -15,51 +15,120 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"sge-monorepo/build/cicd/cicdfile"
 	"sge-monorepo/build/cicd/monorepo"
 	"sge-monorepo/build/cicd/monorepo/universe"
 	"sge-monorepo/build/cicd/presubmit"
+	"sge-monorepo/build/cicd/presubmit/durations"
+	"sge-monorepo/build/cicd/sgeb/build"
 	"sge-monorepo/libs/go/p4lib"
 
 	"sge-monorepo/build/cicd/presubmit/protos/presubmitpb"
 )
 
 var flags = struct {
-	change   string
-	logLevel string
+	change        string
+	logLevel      string
+	durationsFile string
+	only          string
+	imageCache    string
+	explain       string
 }{}
 
+// durationsMaxAge is how long check durations are kept in the history.
+const durationsMaxAge = 90 * 24 * time.Hour
+
 func sgep() int {
+	only, err := presubmit.ParseSelectors(flags.only)
+	if err != nil {
+		fmt.Println(err)
+		return build.ExitUsage
+	}
+	if flags.explain != "" && flags.explain != "json" && flags.explain != "dot" {
+		fmt.Printf("unsupported -explain format %q, want json or dot\n", flags.explain)
+		return build.ExitUsage
+	}
 	u, err := universe.New()
 	if err != nil {
 		fmt.Println(err)
-		return 1
+		return build.ExitInfra
 	}
 	p4 := p4lib.New()
 	printer := presubmit.NewPrinter(func(opts *presubmit.PrinterOpts) {
 		opts.Verbose = flags.logLevel != "ERROR"
 	})
+	listeners := []presubmit.Listener{printer}
+	var store *durations.Store
+	if flags.durationsFile != "" {
+		store = durations.NewStore(flags.durationsFile)
+		listeners = append(listeners, presubmit.NewDurationRecorder(store))
+	}
 	runner := presubmit.NewRunner(u, p4, cicdfile.NewProvider(), func(opts *presubmit.Options) {
 		opts.LogLevel = flags.logLevel
 		opts.Change = flags.change
-		opts.Listeners = append(opts.Listeners, printer)
+		opts.Only = only
+		opts.ImageCache = flags.imageCache
+		opts.Listeners = append(opts.Listeners, listeners...)
 	})
+	if flags.explain != "" {
+		return sgepExplain(runner)
+	}
 	success, err := runner.Run()
 	if err != nil {
 		fmt.Println(err)
-		return 1
+		return exitCode(err)
+	}
+	if store != nil {
+		if err := store.Prune(time.Now().Add(-durationsMaxAge)); err != nil {
+			fmt.Printf("could not prune check durations: %v\n", err)
+		}
 	}
 	if !success {
-		return 1
+		return build.ExitFailed
 	}
-	return 0
+	return build.ExitSuccess
+}
+
+// sgepExplain prints the graph of the checks triggered by the change instead of running them.
+func sgepExplain(runner presubmit.Runner) int {
+	g, err := runner.Explain()
+	if err != nil {
+		fmt.Println(err)
+		return exitCode(err)
+	}
+	if flags.explain == "dot" {
+		err = g.WriteDot(os.Stdout)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(g)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return build.ExitInfra
+	}
+	return build.ExitSuccess
+}
+
+// exitCode returns the exit code for an error running a presubmit. Checks that fail don't make the
+// run return an error, so errors are infrastructure errors unless classified otherwise.
+func exitCode(err error) int {
+	if code := build.ExitCode(err); code != build.ExitFailed {
+		return code
+	}
+	return build.ExitInfra
 }
 
 type fixCollector struct {
@@ -101,26 +170,89 @@ func (f *fixCollector) applyFixes() error {
 }
 
 func sgepFix() int {
+	only, err := presubmit.ParseSelectors(flags.only)
+	if err != nil {
+		fmt.Println(err)
+		return build.ExitUsage
+	}
 	u, err := universe.New()
 	if err != nil {
 		fmt.Println(err)
-		return 1
+		return build.ExitInfra
 	}
 	p4 := p4lib.New()
 	fixes := fixCollector{}
 	runner := presubmit.NewRunner(u, p4, cicdfile.NewProvider(), func(opts *presubmit.Options) {
 		opts.FixOnly = true
+		opts.Only = only
+		opts.ImageCache = flags.imageCache
 		opts.Listeners = append(opts.Listeners, &fixes)
 	})
 	if _, err := runner.Run(); err != nil {
 		fmt.Println(err)
-		return 1
+		return exitCode(err)
 	}
 	if err := fixes.applyFixes(); err != nil {
 		fmt.Println(err)
-		return 1
+		return build.ExitFailed
 	}
-	return 0
+	return build.ExitSuccess
+}
+
+// sgepSlowChecks prints duration stats of the checks run by previous presubmits, slowest first.
+func sgepSlowChecks(args []string) int {
+	fs := flag.NewFlagSet("slow-checks", flag.ExitOnError)
+	days := fs.Int("days", 30, "number of days of history to report on")
+	weekly := fs.Bool("weekly", false, "report each week separately, to show trends over time")
+	limit := fs.Int("limit", 20, "maximum number of checks to report per period, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		fmt.Println(err)
+		return build.ExitUsage
+	}
+	if flags.durationsFile == "" {
+		fmt.Println("no check durations file, set one with -durations_file")
+		return build.ExitUsage
+	}
+	records, err := durations.NewStore(flags.durationsFile).Load(time.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		fmt.Println(err)
+		return build.ExitInfra
+	}
+	if len(records) == 0 {
+		fmt.Printf("no check durations recorded in the last %d days\n", *days)
+		return build.ExitSuccess
+	}
+	var period time.Duration
+	if *weekly {
+		period = 7 * 24 * time.Hour
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if *weekly {
+		fmt.Fprint(w, "WEEK\t")
+	}
+	fmt.Fprintln(w, "CHECK\tRUNS\tFAILED\tP50\tP95\tMAX")
+	// Stats are sorted by period, so the count restarts whenever the period changes.
+	var current time.Time
+	reported := 0
+	for _, s := range durations.Summarize(records, period) {
+		if !s.Period.Equal(current) {
+			current = s.Period
+			reported = 0
+		}
+		if *limit > 0 && reported >= *limit {
+			continue
+		}
+		reported++
+		if *weekly {
+			fmt.Fprintf(w, "%s\t", s.Period.Format("2006-01-02"))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", s.Check, s.Runs, s.Failures, s.P50.Round(time.Second/10), s.P95.Round(time.Second/10), s.Max.Round(time.Second/10))
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Println(err)
+		return build.ExitInfra
+	}
+	return build.ExitSuccess
 }
 
 func main() {
@@ -128,12 +260,46 @@ func main() {
 	flag.StringVar(&flags.change, "change", "", changeDesc)
 	flag.StringVar(&flags.change, "c", "", changeDesc+" (shorthand)")
 	flag.StringVar(&flags.logLevel, "log_level", "ERROR", "glog log level")
+	flag.StringVar(&flags.only, "only", "", "comma separated checks to restrict the presubmit run to, eg. format,check_test://foo:tests")
+	flag.StringVar(&flags.explain, "explain", "", "print why the change triggers its checks as a json or dot graph, instead of running them")
+	defaultDurationsFile, err := durations.DefaultPath()
+	if err != nil {
+		fmt.Printf("could not find the default check durations file: %v\n", err)
+	}
+	flag.StringVar(&flags.durationsFile, "durations_file", defaultDurationsFile, "file keeping the history of check durations")
+	defaultImageCache, err := presubmit.DefaultImageCache()
+	if err != nil {
+		fmt.Printf("could not find the default checker image cache: %v\n", err)
+	}
+	flag.StringVar(&flags.imageCache, "image_cache", defaultImageCache, "directory the images of containerized checkers are saved to")
 	flag.Parse()
+
+	// Interrupts also reach the checks being run, which make sgep return once they exit. Only the
+	// first interrupt is caught, so that another one kills sgep if cleaning up hangs.
+	var interrupted int32
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		atomic.StoreInt32(&interrupted, 1)
+	}()
+	// Exit codes are the build.Exit* codes, see docs/sgep.md.
+	exit := func(code int) {
+		if code != build.ExitSuccess && atomic.LoadInt32(&interrupted) == 1 {
+			code = build.ExitCancelled
+		}
+		os.Exit(code)
+	}
+
 	if flag.NArg() == 0 {
-		os.Exit(sgep())
+		exit(sgep())
 	} else if flag.NArg() == 1 && flag.Arg(0) == "fix" {
-		os.Exit(sgepFix())
+		exit(sgepFix())
+	} else if flag.NArg() >= 1 && flag.Arg(0) == "slow-checks" {
+		exit(sgepSlowChecks(flag.Args()[1:]))
 	} else {
 		fmt.Println("unsupported command")
+		exit(build.ExitUsage)
 	}
 }
@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"sge-monorepo/build/cicd/sgeb/buildtool"
 	"sge-monorepo/build/packagemanifest"
@@ -44,6 +45,7 @@ var flags = struct {
 	change      string
 	submitCl    bool
 	description sgeflag.StringList
+	lockWait    time.Duration
 }{}
 
 func main() {
@@ -52,6 +54,7 @@ func main() {
 	flag.StringVar(&flags.change, "c", "", "change to add files to. If omitted a new CL is created.")
 	flag.BoolVar(&flags.submitCl, "submit_cl", false, "submits the CL after it is created")
 	flag.Var(&flags.description, "desc", "additional lines of description to add to the CL")
+	flag.DurationVar(&flags.lockWait, "lock_wait", 0, "how long to wait for destination files exclusively opened (+l) by other workspaces to be released")
 	flag.Parse()
 	glog.Info("application start")
 	glog.Infof("%v", os.Args)
@@ -235,7 +238,10 @@ func updateFile(p4 p4lib.P4, srcPath, destPath string) (bool, error) {
 }
 
 func publishFile(p4 p4lib.P4, change int, srcPath, destPath string) error {
-	if _, err := p4.Edit([]string{destPath}, change); err != nil {
+	wait := func(lerr *p4lib.ExclusiveLockError) {
+		glog.Infof("waiting for exclusively opened files: %v", lerr)
+	}
+	if _, err := p4lib.EditWithLockWait(p4, []string{destPath}, change, flags.lockWait, wait); err != nil {
 		return fmt.Errorf("p4 edit failed: %v", err)
 	}
 	glog.Infof("copying %s -> %s\n", srcPath, destPath)
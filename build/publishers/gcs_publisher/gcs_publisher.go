@@ -16,11 +16,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"os/user"
@@ -31,6 +30,7 @@ import (
 
 	"sge-monorepo/build/cicd/sgeb/buildtool"
 	"sge-monorepo/build/cicd/sgeb/protos/buildpb"
+	"sge-monorepo/libs/go/cloud/chunkupload"
 
 	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
@@ -41,6 +41,8 @@ var flags = struct {
 	bucket            string
 	uploadChangedOnly bool
 	appendTimestamp   bool
+	chunked           bool
+	chunkPrefix       string
 }{}
 
 func main() {
@@ -48,6 +50,8 @@ func main() {
 	flag.StringVar(&flags.bucket, "bucket", "", "GCS Bucket to publish to")
 	flag.BoolVar(&flags.uploadChangedOnly, "upload_changed_only", false, "whether we only upload changed files")
 	flag.BoolVar(&flags.appendTimestamp, "append_timestamp", false, "whether a timestamp should be appended to the file uploaded to the bucket")
+	flag.BoolVar(&flags.chunked, "chunked", false, "whether to only upload the chunks of the file that changed since earlier uploads and assemble it in the bucket, for large files")
+	flag.StringVar(&flags.chunkPrefix, "chunk_prefix", ".chunks", "directory of the bucket holding the chunks of -chunked uploads")
 	flag.Parse()
 	glog.Info("application start")
 	glog.Infof("%v", os.Args)
@@ -132,18 +136,10 @@ func publish() error {
 }
 
 func publishFile(helper buildtool.Helper, bkt *storage.BucketHandle, srcPath, destPath string) (int64, int64, error) {
-	r, err := os.Open(srcPath)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer r.Close()
-
-	obj := bkt.Object(destPath)
-	w := obj.NewWriter(context.Background())
-
+	var metadata map[string]string
 	change := helper.Invocation().GetPublishInvocation().GetBaseCl()
 	if change != 0 {
-		w.Metadata = map[string]string{
+		metadata = map[string]string{
 			"p4-change": fmt.Sprintf("%d", change),
 		}
 	} else {
@@ -152,11 +148,31 @@ func publishFile(helper buildtool.Helper, bkt *storage.BucketHandle, srcPath, de
 			glog.Warningf("can't determine user: %v", err)
 			usr = &user.User{Username: "<unknown>"}
 		}
-		w.Metadata = map[string]string{
+		metadata = map[string]string{
 			"p4-change": fmt.Sprintf("%s - %v", usr.Username, time.Now()),
 		}
 	}
 
+	if flags.chunked {
+		uploader := chunkupload.New(chunkupload.NewGCSBucket(bkt), flags.chunkPrefix)
+		result, err := uploader.UploadFile(context.Background(), srcPath, destPath, metadata)
+		if err != nil {
+			return 0, 0, err
+		}
+		fmt.Printf("uploaded %d of %d chunks (%d of %d bytes)\n", result.Uploaded, result.Chunks, result.UploadedBytes, result.Size)
+		return result.Generation, result.Size, nil
+	}
+
+	r, err := os.Open(srcPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	obj := bkt.Object(destPath)
+	w := obj.NewWriter(context.Background())
+	w.Metadata = metadata
+
 	_, err = io.Copy(w, r)
 	if err != nil {
 		return 0, 0, err
@@ -169,6 +185,8 @@ func publishFile(helper buildtool.Helper, bkt *storage.BucketHandle, srcPath, de
 	return attrs.Generation, attrs.Size, nil
 }
 
+// filesEqual compares the CRC32C checksums of |src| and |dest|. Unlike MD5 hashes, they are set
+// on composite objects, such as the ones uploaded with -chunked.
 func filesEqual(bkt *storage.BucketHandle, src, dest string) (bool, error) {
 	attrs, err := bkt.Object(dest).Attrs(context.Background())
 	if err != nil {
@@ -181,18 +199,18 @@ func filesEqual(bkt *storage.BucketHandle, src, dest string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return bytes.Equal(srcHash, attrs.MD5), nil
+	return srcHash == attrs.CRC32C, nil
 }
 
-func hashFile(p string) ([]byte, error) {
+func hashFile(p string) (uint32, error) {
 	f, err := os.Open(p)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer f.Close()
-	hash := md5.New()
+	hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
 	if _, err := io.Copy(hash, f); err != nil {
-		return nil, err
+		return 0, err
 	}
-	return hash.Sum(nil), nil
+	return hash.Sum32(), nil
 }
@@ -13,7 +13,8 @@
 @rem limitations under the License.
 
 @rem This script will generate all the protos associated with the monorepo.
-@rem You will need to install protoc and also make sure that protoc-gen-go in path.
+@rem You will need to install protoc and also make sure that protoc-gen-go and protoc-gen-go-grpc
+@rem are in path.
 
 set root=%~dp0%
 pushd %root%\repobuilder
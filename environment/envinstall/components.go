@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envinstall
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// vsBuildToolsPath is where the Visual Studio build tools are installed.
+const vsBuildToolsPath = `C:\Toolchain\BuildTools`
+
+// component is a dependency installed by envinstall that units can require.
+type component struct {
+	// description is a human readable description of the component.
+	description string
+	// installed returns whether the component is installed in the Windows installation at
+	// |sysroot|.
+	installed func(sysroot string) bool
+	// install installs the component.
+	install func(m manager) error
+}
+
+var components = map[string]component{
+	"vs2019": {
+		description: "Visual Studio 2019 build tools",
+		installed: func(string) bool {
+			return exists(filepath.Join(vsBuildToolsPath, "MSBuild"))
+		},
+		install: manager.installVSDependencies,
+	},
+	"ue4-prereqs": {
+		description: "Unreal Engine 4 prerequisites",
+		installed: func(sysroot string) bool {
+			// The prerequisites install the DirectX end-user runtime, which has no other way to
+			// be detected.
+			return exists(filepath.Join(sysroot, "System32", "XInput1_3.dll"))
+		},
+		install: manager.installUnrealPrereqs,
+	},
+	"vc-redist": {
+		description: "Visual C++ Redistributable",
+		installed: func(sysroot string) bool {
+			return exists(filepath.Join(sysroot, "System32", "vcruntime140.dll"))
+		},
+		install: manager.installVCRedist,
+	},
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Components returns the names of all the components that can be required.
+func Components() []string {
+	var names []string
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MissingComponents returns which of the components in |names| are not installed in this machine.
+// Unknown component names are an error.
+func MissingComponents(names []string) ([]string, error) {
+	if err := checkComponents(names); err != nil {
+		return nil, err
+	}
+	sysroot := os.Getenv("SYSTEMROOT")
+	var missing []string
+	for _, name := range names {
+		if !components[name].installed(sysroot) {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// InstallInstructions returns a human readable explanation of how to install the |missing|
+// components.
+func InstallInstructions(missing []string) string {
+	var sb strings.Builder
+	sb.WriteString("the following environment components are not installed:\n")
+	for _, name := range missing {
+		desc := name
+		if c, ok := components[name]; ok {
+			desc = c.description
+		}
+		fmt.Fprintf(&sb, "  %s: %s\n", name, desc)
+	}
+	sb.WriteString("Install them by running (as administrator):\n")
+	sb.WriteString("  sgeb run //environment\n")
+	return sb.String()
+}
+
+func checkComponents(names []string) error {
+	for _, name := range names {
+		if _, ok := components[name]; !ok {
+			return fmt.Errorf("unknown environment component %q, want one of %s", name, strings.Join(Components(), ", "))
+		}
+	}
+	return nil
+}
+
+func (m manager) InstallComponents(names ...string) error {
+	if err := checkComponents(names); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	output, err := m.p4.Sync([]string{"//sge/environment/data/..."})
+	if err != nil {
+		return err
+	}
+	fmt.Println(output)
+	for _, name := range names {
+		c := components[name]
+		if err := c.install(m); err != nil {
+			return fmt.Errorf("could not install %s: %v", c.description, err)
+		}
+	}
+	return nil
+}
@@ -63,7 +63,7 @@ func (m manager) installVSDependencies() error {
 	args := []string{
 		m.asDataPath("vs_buildtools.exe"),
 		"--quiet", "--wait", "--norestart", "--nocache",
-		"--installPath", `C:\Toolchain\BuildTools`,
+		"--installPath", vsBuildToolsPath,
 		"--channelUri", m.asDataPath("VisualStudio.chman"),
 		"--installChannelUri", m.asDataPath("VisualStudio.chman"),
 		"--add", "Microsoft.Net.Component.4.6.2.SDK",
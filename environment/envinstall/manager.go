@@ -57,6 +57,10 @@ type Manager interface {
 	// SyncAndInstallDependencies performs a full install of all the known dependencies.
 	// Will also update the current installed version marker.
 	SyncAndInstallDependencies() error
+
+	// InstallComponents syncs the dependencies and installs only the named components. See
+	// Components for the known names.
+	InstallComponents(names ...string) error
 }
 
 // IsCloud returns whether we are running on a jenkins machine.
@@ -15,6 +15,7 @@ require (
 	github.com/atotto/clipboard v0.1.4
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/protobuf v1.4.3
+	github.com/google/cel-go v0.7.2
 	github.com/google/go-cmp v0.5.4
 	github.com/hashicorp/go-version v1.2.1
 	github.com/julvo/htmlgo v0.0.0-20200505154053-2e9f4b95a223
@@ -41,10 +42,12 @@ require (
 	sge-monorepo/build/cicd/presubmit/check/protos/checkpb v0.0.0-00010101000000-000000000000
 	sge-monorepo/build/cicd/presubmit/protos/presubmitpb v0.0.0-00010101000000-000000000000
 	sge-monorepo/build/cicd/sgeb/protos/buildpb v0.0.0-00010101000000-000000000000
+	sge-monorepo/build/cicd/sgeb/protos/servicepb v0.0.0-00010101000000-000000000000
 	sge-monorepo/build/cicd/sgeb/protos/sgebpb v0.0.0-00010101000000-000000000000
 	sge-monorepo/build/packagemanifest/protos/packagemanifestpb v0.0.0-00010101000000-000000000000
 	sge-monorepo/build/publishers/docker_publisher/protos/dockerpushconfigpb v0.0.0-00010101000000-000000000000
 	sge-monorepo/tools/bazel2vs/protos/msbuildpb v0.0.0-00010101000000-000000000000
+	sge-monorepo/tools/ebert/linkify/protos/linkifypb v0.0.0-00010101000000-000000000000
 	sge-monorepo/tools/p4_benchmark/protos/benchmarkpb v0.0.0-00010101000000-000000000000 // indirect
 	sge-monorepo/tools/vendor_bender/protos/licensepb v0.0.0-00010101000000-000000000000
 	sge-monorepo/tools/vendor_bender/protos/manifestpb v0.0.0-00010101000000-000000000000
@@ -66,12 +69,14 @@ replace (
 	sge-monorepo/build/cicd/presubmit/check/protos/checkpb => ./proto-gen/sge-monorepo/build/cicd/presubmit/check/protos/checkpb
 	sge-monorepo/build/cicd/presubmit/protos/presubmitpb => ./proto-gen/sge-monorepo/build/cicd/presubmit/protos/presubmitpb
 	sge-monorepo/build/cicd/sgeb/protos/buildpb => ./proto-gen/sge-monorepo/build/cicd/sgeb/protos/buildpb
+	sge-monorepo/build/cicd/sgeb/protos/servicepb => ./proto-gen/sge-monorepo/build/cicd/sgeb/protos/servicepb
 	sge-monorepo/build/cicd/sgeb/protos/sgebpb => ./proto-gen/sge-monorepo/build/cicd/sgeb/protos/sgebpb
 	sge-monorepo/build/packagemanifest/protos/packagemanifestpb => ./proto-gen/sge-monorepo/build/packagemanifest/protos/packagemanifestpb
 	sge-monorepo/build/publishers/docker_publisher/protos/dockerpushconfigpb => ./proto-gen/sge-monorepo/build/publishers/docker_publisher/protos/dockerpushconfigpb
 
 	// tools
 	sge-monorepo/tools/bazel2vs/protos/msbuildpb => ./proto-gen/sge-monorepo/tools/bazel2vs/protos/msbuildpb
+	sge-monorepo/tools/ebert/linkify/protos/linkifypb => ./proto-gen/sge-monorepo/tools/ebert/linkify/protos/linkifypb
 	sge-monorepo/tools/p4_benchmark/protos/benchmarkpb => ./proto-gen/sge-monorepo/tools/p4_benchmark/protos/benchmarkpb
 	sge-monorepo/tools/vendor_bender/protos/licensepb => ./proto-gen/sge-monorepo/tools/vendor_bender/protos/licensepb
 	sge-monorepo/tools/vendor_bender/protos/manifestpb => ./proto-gen/sge-monorepo/tools/vendor_bender/protos/manifestpb
@@ -0,0 +1,359 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chunkupload uploads large files to Cloud Storage incrementally. Files are split into
+// content-defined chunks, so that an edit only changes the chunks around it, and chunks are stored
+// by content hash: uploading a new version of a file only uploads the chunks that changed since
+// any earlier upload. The file is then assembled from its chunks in the bucket with compose
+// requests, without downloading anything.
+//
+// Uploads are resumable: chunks uploaded by an interrupted upload, eg. a CI run that was retried,
+// are not uploaded again.
+package chunkupload
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// Chunk sizes. Chunks are cut where a rolling hash of the content matches a mask, about every
+// 2 MiB past MinChunkSize, and at MaxChunkSize at the latest.
+const (
+	MinChunkSize = 512 << 10
+	MaxChunkSize = 8 << 20
+)
+
+// maxComposeSources is the maximum number of objects a compose request can combine.
+const maxComposeSources = 32
+
+// ErrNotExist is returned by Bucket.Read for objects that don't exist.
+var ErrNotExist = errors.New("object doesn't exist")
+
+// Bucket is the part of a Cloud Storage bucket the uploader uses, see NewGCSBucket.
+type Bucket interface {
+	// Exists returns whether object |name| exists.
+	Exists(ctx context.Context, name string) (bool, error)
+	// Read returns the content of object |name|, or ErrNotExist.
+	Read(ctx context.Context, name string) ([]byte, error)
+	// Write creates or overwrites object |name|.
+	Write(ctx context.Context, name string, data []byte) error
+	// Compose creates or overwrites object |dst| with the concatenation of objects |srcs| and
+	// |metadata|, and returns its generation and size.
+	Compose(ctx context.Context, dst string, srcs []string, metadata map[string]string) (int64, int64, error)
+	// Delete deletes object |name|.
+	Delete(ctx context.Context, name string) error
+}
+
+// Chunk is a chunk of a file.
+type Chunk struct {
+	// Hash is the hex SHA-256 of the chunk, which names its object.
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest lists the chunks of an uploaded file in order.
+type Manifest struct {
+	Size   int64   `json:"size"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Result is the outcome of an upload.
+type Result struct {
+	// Generation and Size of the uploaded object.
+	Generation int64
+	Size       int64
+	// Chunks is the number of chunks of the file, of which Uploaded chunks weighing UploadedBytes
+	// were uploaded.
+	Chunks        int
+	Uploaded      int
+	UploadedBytes int64
+}
+
+// Uploader uploads files to a bucket by chunks.
+type Uploader struct {
+	Bucket Bucket
+	// Prefix is the directory of the bucket holding the chunks and manifests, eg. ".chunks". The
+	// chunks must outlive every object composed from them: lifecycle rules must not delete them.
+	Prefix string
+	// Parallelism is how many chunks are uploaded at once. Defaults to 4.
+	Parallelism int
+}
+
+// New returns an uploader to |bucket| keeping chunks under |prefix|.
+func New(bucket Bucket, prefix string) *Uploader {
+	return &Uploader{Bucket: bucket, Prefix: prefix, Parallelism: 4}
+}
+
+func (u *Uploader) chunkObject(hash string) string {
+	return path.Join(u.Prefix, "chunks", hash)
+}
+
+func (u *Uploader) manifestObject(dst string) string {
+	return path.Join(u.Prefix, "manifests", dst+".json")
+}
+
+// tempObject returns the name of temporary object |i| of |level| of the upload |id| of |dst|. The
+// id keeps concurrent uploads of the same object from composing each other's temporary objects.
+func (u *Uploader) tempObject(dst, id string, level, i int) string {
+	return path.Join(u.Prefix, "tmp", fmt.Sprintf("%s.%s.%d.%d", dst, id, level, i))
+}
+
+// uploadID returns a random id for the temporary objects of an upload.
+func uploadID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// UploadFile uploads the file at |src| to object |dst| with |metadata|.
+func (u *Uploader) UploadFile(ctx context.Context, src, dst string, metadata map[string]string) (*Result, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return u.Upload(ctx, f, dst, metadata)
+}
+
+// Upload uploads the content of |r| to object |dst| with |metadata|.
+func (u *Uploader) Upload(ctx context.Context, r io.Reader, dst string, metadata map[string]string) (*Result, error) {
+	// Chunks of the previous version are known to exist.
+	known := map[string]bool{}
+	if prev, err := u.readManifest(ctx, dst); err != nil {
+		return nil, err
+	} else if prev != nil {
+		for _, c := range prev.Chunks {
+			known[c.Hash] = true
+		}
+	}
+
+	result := &Result{}
+	manifest := &Manifest{}
+	parallelism := u.Parallelism
+	if parallelism <= 0 {
+		parallelism = 4
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+	err := Split(r, func(data []byte) error {
+		sum := sha256.Sum256(data)
+		c := Chunk{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		manifest.Chunks = append(manifest.Chunks, c)
+		manifest.Size += c.Size
+		if known[c.Hash] {
+			return nil
+		}
+		known[c.Hash] = true
+		mu.Lock()
+		failed := uploadErr != nil
+		mu.Unlock()
+		if failed {
+			return nil
+		}
+		// Split reuses its buffer.
+		data = append([]byte(nil), data...)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			uploaded, err := u.uploadChunk(ctx, c.Hash, data)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				return
+			}
+			if uploaded {
+				result.Uploaded++
+				result.UploadedBytes += c.Size
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", dst, err)
+	}
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+	result.Chunks = len(manifest.Chunks)
+	var srcs []string
+	for _, c := range manifest.Chunks {
+		srcs = append(srcs, u.chunkObject(c.Hash))
+	}
+	result.Generation, result.Size, err = u.compose(ctx, dst, srcs, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.writeManifest(ctx, dst, manifest); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// uploadChunk uploads the chunk with |hash| unless it's already in the bucket, and returns whether
+// it uploaded it.
+func (u *Uploader) uploadChunk(ctx context.Context, hash string, data []byte) (bool, error) {
+	name := u.chunkObject(hash)
+	exists, err := u.Bucket.Exists(ctx, name)
+	if err != nil {
+		return false, fmt.Errorf("could not check chunk %s: %v", name, err)
+	}
+	if exists {
+		return false, nil
+	}
+	if err := u.Bucket.Write(ctx, name, data); err != nil {
+		return false, fmt.Errorf("could not upload chunk %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// compose assembles |dst| from |srcs|. As a compose request takes at most 32 sources, larger files
+// are composed by levels of temporary objects, deleted afterwards.
+func (u *Uploader) compose(ctx context.Context, dst string, srcs []string, metadata map[string]string) (int64, int64, error) {
+	id, err := uploadID()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not generate upload id: %v", err)
+	}
+	var temps []string
+	defer func() {
+		for _, t := range temps {
+			// Temporary objects that fail to be deleted are left under the tmp prefix, whose
+			// bucket lifecycle rule should expire them.
+			_ = u.Bucket.Delete(ctx, t)
+		}
+	}()
+	for level := 0; len(srcs) > maxComposeSources; level++ {
+		var next []string
+		for i := 0; i < len(srcs); i += maxComposeSources {
+			end := i + maxComposeSources
+			if end > len(srcs) {
+				end = len(srcs)
+			}
+			t := u.tempObject(dst, id, level, len(next))
+			if _, _, err := u.Bucket.Compose(ctx, t, srcs[i:end], nil); err != nil {
+				return 0, 0, fmt.Errorf("could not compose %s: %v", t, err)
+			}
+			temps = append(temps, t)
+			next = append(next, t)
+		}
+		srcs = next
+	}
+	gen, size, err := u.Bucket.Compose(ctx, dst, srcs, metadata)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not compose %s: %v", dst, err)
+	}
+	return gen, size, nil
+}
+
+func (u *Uploader) readManifest(ctx context.Context, dst string) (*Manifest, error) {
+	name := u.manifestObject(dst)
+	data, err := u.Bucket.Read(ctx, name)
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read manifest %s: %v", name, err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		// A broken manifest only costs checking every chunk.
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (u *Uploader) writeManifest(ctx context.Context, dst string, m *Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	name := u.manifestObject(dst)
+	if err := u.Bucket.Write(ctx, name, data); err != nil {
+		return fmt.Errorf("could not write manifest %s: %v", name, err)
+	}
+	return nil
+}
+
+// gear are the random values of the gear rolling hash, one per byte value. They are generated
+// with splitmix64 from a fixed seed: changing them would change where chunks are cut, and make the
+// next upload of every file upload all its chunks.
+var gear = func() [256]uint64 {
+	var g [256]uint64
+	x := uint64(0x5ce0c4d1)
+	for i := range g {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		g[i] = z ^ (z >> 31)
+	}
+	return g
+}()
+
+// chunkMask has 21 bits set, so that a cut happens on average every 2 MiB. The high bits of the
+// hash are used as they depend on the last 64 bytes, the low ones only on the last few.
+const chunkMask = uint64(1<<21-1) << 43
+
+// Split splits the content of |r| into content-defined chunks and calls |fn| on each in order.
+// The chunk passed to |fn| is only valid until it returns. Empty content is a single empty chunk.
+func Split(r io.Reader, fn func(chunk []byte) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	buf := make([]byte, 0, MaxChunkSize)
+	var h uint64
+	called := false
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		if len(buf) < MinChunkSize {
+			continue
+		}
+		h = (h << 1) + gear[b]
+		if h&chunkMask == 0 || len(buf) == MaxChunkSize {
+			if err := fn(buf); err != nil {
+				return err
+			}
+			called = true
+			buf, h = buf[:0], 0
+		}
+	}
+	if len(buf) > 0 || !called {
+		return fn(buf)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkupload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memBucket is a bucket in memory.
+type memBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gen     int64
+	writes  int
+	fail    string
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{objects: map[string][]byte{}}
+}
+
+func (b *memBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.objects[name]
+	return ok, nil
+}
+
+func (b *memBucket) Read(ctx context.Context, name string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[name]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return data, nil
+}
+
+func (b *memBucket) Write(ctx context.Context, name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail != "" && strings.Contains(name, b.fail) {
+		return fmt.Errorf("injected failure")
+	}
+	b.objects[name] = append([]byte(nil), data...)
+	b.writes++
+	return nil
+}
+
+func (b *memBucket) Compose(ctx context.Context, dst string, srcs []string, metadata map[string]string) (int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(srcs) == 0 || len(srcs) > maxComposeSources {
+		return 0, 0, fmt.Errorf("compose of %d sources", len(srcs))
+	}
+	var data []byte
+	for _, s := range srcs {
+		src, ok := b.objects[s]
+		if !ok {
+			return 0, 0, fmt.Errorf("no object %s", s)
+		}
+		data = append(data, src...)
+	}
+	b.objects[dst] = data
+	b.gen++
+	return b.gen, int64(len(data)), nil
+}
+
+func (b *memBucket) Delete(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[name]; !ok {
+		return ErrNotExist
+	}
+	delete(b.objects, name)
+	return nil
+}
+
+func TestSplit(t *testing.T) {
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	var sizes []int
+	var joined []byte
+	if err := Split(bytes.NewReader(data), func(chunk []byte) error {
+		sizes = append(sizes, len(chunk))
+		joined = append(joined, chunk...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, joined) {
+		t.Fatal("chunks don't add up to the content")
+	}
+	if len(sizes) < 2 {
+		t.Fatalf("Split() of %d bytes made %d chunks, want several", len(data), len(sizes))
+	}
+	for i, s := range sizes {
+		if s > MaxChunkSize || (s < MinChunkSize && i != len(sizes)-1) {
+			t.Errorf("chunk %d has %d bytes, want between %d and %d", i, s, MinChunkSize, MaxChunkSize)
+		}
+	}
+	// A run of identical bytes never matches the mask and is cut at the max size.
+	sizes = nil
+	if err := Split(bytes.NewReader(make([]byte, MaxChunkSize+10)), func(chunk []byte) error {
+		sizes = append(sizes, len(chunk))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[0] != MaxChunkSize {
+		t.Errorf("Split() of zeroes = chunks of %v, want a chunk of %d and the rest", sizes, MaxChunkSize)
+	}
+	calls := 0
+	if err := Split(bytes.NewReader(nil), func(chunk []byte) error {
+		calls++
+		return nil
+	}); err != nil || calls != 1 {
+		t.Errorf("Split() of no content made %d chunks, %v, want a single empty one", calls, err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 20<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	b := newMemBucket()
+	u := New(b, ".chunks")
+	md := map[string]string{"p4-change": "12"}
+
+	first, err := u.Upload(ctx, bytes.NewReader(data), "game.zip", md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Uploaded != first.Chunks || first.Size != int64(len(data)) {
+		t.Errorf("first Upload() = %+v, want all chunks uploaded and size %d", first, len(data))
+	}
+	if !bytes.Equal(b.objects["game.zip"], data) {
+		t.Fatal("uploaded object differs from the content")
+	}
+
+	// An edit in the middle of the file only changes the chunks around it.
+	edited := append([]byte(nil), data...)
+	copy(edited[10<<20:], []byte("patched"))
+	second, err := u.Upload(ctx, bytes.NewReader(edited), "game.zip", md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Uploaded == 0 || second.Uploaded > 2 {
+		t.Errorf("Upload() of an edit uploaded %d of %d chunks, want 1 or 2", second.Uploaded, second.Chunks)
+	}
+	if !bytes.Equal(b.objects["game.zip"], edited) {
+		t.Fatal("uploaded object differs from the edited content")
+	}
+
+	// Chunks are shared between objects.
+	third, err := u.Upload(ctx, bytes.NewReader(data), "game-copy.zip", md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Uploaded != 0 {
+		t.Errorf("Upload() of known content uploaded %d chunks, want none", third.Uploaded)
+	}
+}
+
+func TestUploadResumes(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 10<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	b := newMemBucket()
+	u := New(b, ".chunks")
+	// Fail the manifest write, ie. the last step.
+	b.fail = "manifests"
+	if _, err := u.Upload(ctx, bytes.NewReader(data), "game.zip", nil); err == nil {
+		t.Fatal("Upload() with a failing bucket succeeded, want error")
+	}
+	b.fail = ""
+	result, err := u.Upload(ctx, bytes.NewReader(data), "game.zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 0 {
+		t.Errorf("retried Upload() uploaded %d chunks again, want none", result.Uploaded)
+	}
+}
+
+func TestComposeLevels(t *testing.T) {
+	ctx := context.Background()
+	b := newMemBucket()
+	u := New(b, ".chunks")
+	var srcs []string
+	var want []byte
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("src%d", i)
+		b.objects[name] = []byte{byte(i)}
+		srcs = append(srcs, name)
+		want = append(want, byte(i))
+	}
+	if _, _, err := u.compose(ctx, "dst", srcs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.objects["dst"], want) {
+		t.Errorf("composed %v, want %v", b.objects["dst"], want)
+	}
+	for name := range b.objects {
+		if strings.Contains(name, "tmp") {
+			t.Errorf("temporary object %s left behind", name)
+		}
+	}
+}
+
+func TestComposeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	b := newMemBucket()
+	u := New(b, ".chunks")
+	// Two uploads of the same object must not mix each other's temporary objects.
+	var srcs [2][]string
+	var want [2][]byte
+	for j := range srcs {
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("src%d.%d", j, i)
+			b.objects[name] = []byte{byte(j), byte(i)}
+			srcs[j] = append(srcs[j], name)
+			want[j] = append(want[j], byte(j), byte(i))
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(srcs))
+	for j := range srcs {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			_, _, errs[j] = u.compose(ctx, "dst", srcs[j], nil)
+		}(j)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := b.objects["dst"]; !bytes.Equal(got, want[0]) && !bytes.Equal(got, want[1]) {
+		t.Errorf("composed %v, want the content of one of the uploads", got)
+	}
+}
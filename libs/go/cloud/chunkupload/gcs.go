@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkupload
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+
+	"cloud.google.com/go/storage"
+)
+
+// NewGCSBucket returns the Cloud Storage bucket |bkt| as a Bucket.
+func NewGCSBucket(bkt *storage.BucketHandle) Bucket {
+	return &gcsBucket{bkt: bkt}
+}
+
+type gcsBucket struct {
+	bkt *storage.BucketHandle
+}
+
+func (b *gcsBucket) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := b.bkt.Object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *gcsBucket) Read(ctx context.Context, name string) ([]byte, error) {
+	r, err := b.bkt.Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (b *gcsBucket) Write(ctx context.Context, name string, data []byte) error {
+	w := b.bkt.Object(name).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *gcsBucket) Compose(ctx context.Context, dst string, srcs []string, metadata map[string]string) (int64, int64, error) {
+	var objs []*storage.ObjectHandle
+	for _, s := range srcs {
+		objs = append(objs, b.bkt.Object(s))
+	}
+	c := b.bkt.Object(dst).ComposerFrom(objs...)
+	c.Metadata = metadata
+	attrs, err := c.Run(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return attrs.Generation, attrs.Size, nil
+}
+
+func (b *gcsBucket) Delete(ctx context.Context, name string) error {
+	err := b.bkt.Object(name).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrNotExist
+	}
+	return err
+}
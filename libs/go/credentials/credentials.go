@@ -0,0 +1,243 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package credentials resolves named credentials (GCP service accounts, p4 tickets, Swarm and
+// Jenkins logins...) from a chain of providers, so that tools don't each have their own way of
+// finding them.
+//
+// Credentials are named with lower_snake_case names, like "swarm_auth". Each provider maps a name
+// to its own storage: an environment variable, a file, a GCE metadata attribute or a secret.
+//
+// Usage:
+//      creds := credentials.Default()
+//      auth, err := credentials.Get(creds, credentials.SwarmAuth)
+//      ...
+//      user, password, err := credentials.SplitBasicAuth(auth)
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"sge-monorepo/environment/envinstall"
+	"sge-monorepo/libs/go/cloud/secretmanager"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// Well known credential names.
+const (
+	// GCPServiceAccount is the JSON key of a GCP service account.
+	GCPServiceAccount = "gcp_service_account"
+	// P4Ticket is a Perforce ticket, or password, for P4PASSWD.
+	P4Ticket = "p4_ticket"
+	// SwarmAuth is the "user:password" basic auth of Swarm.
+	SwarmAuth = "swarm_auth"
+	// JenkinsToken is the "user:token" basic auth of Jenkins.
+	JenkinsToken = "jenkins_token"
+)
+
+// EnvPrefix prefixes the environment variables holding credentials. The variable of a credential is
+// its upper cased name with the prefix, eg. SGE_CREDENTIAL_SWARM_AUTH.
+const EnvPrefix = "SGE_CREDENTIAL_"
+
+// ErrNotFound is returned when no provider has a credential.
+var ErrNotFound = errors.New("credential not found")
+
+// Provider is a source of credentials.
+type Provider interface {
+	// Name identifies the provider in error messages.
+	Name() string
+
+	// Lookup returns the value of the credential |name|. The boolean indicates whether the
+	// credential exists, which is different from a runtime error (eg. could not connect).
+	Lookup(name string) (string, bool, error)
+}
+
+// Chain is a Provider looking up credentials in each of its providers in order.
+type Chain []Provider
+
+// Name implements Provider.
+func (c Chain) Name() string {
+	var names []string
+	for _, p := range c {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Lookup implements Provider. The first provider having the credential wins.
+func (c Chain) Lookup(name string) (string, bool, error) {
+	for _, p := range c {
+		value, ok, err := p.Lookup(name)
+		if err != nil {
+			return "", false, fmt.Errorf("could not look up credential %q in %s: %v", name, p.Name(), err)
+		}
+		if ok {
+			return value, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Get returns the credential |name| from |p|, or an error wrapping ErrNotFound if missing.
+func Get(p Provider, name string) (string, error) {
+	value, ok, err := p.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: %q (looked up in %s)", ErrNotFound, name, p.Name())
+	}
+	return value, nil
+}
+
+// EnvVar returns the environment variable holding the credential |name|.
+func EnvVar(name string) string {
+	return EnvPrefix + strings.ToUpper(name)
+}
+
+// Inject returns the "VAR=value" environment entries passing the credentials |names| to a child
+// process, where the Env provider finds them. Meant to be appended to exec.Cmd.Env.
+func Inject(p Provider, names []string) ([]string, error) {
+	var env []string
+	for _, name := range names {
+		value, err := Get(p, name)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, EnvVar(name)+"="+value)
+	}
+	return env, nil
+}
+
+// SplitBasicAuth splits a "user:password" credential.
+func SplitBasicAuth(value string) (string, string, error) {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("credential is not of the form user:password")
+	}
+	return value[:i], value[i+1:], nil
+}
+
+// Default returns the provider chain for the environment the code runs in. Locally, credentials
+// come from the environment and from files in ~/.sge/credentials. In the cloud, they come from
+// the environment, the GCE instance metadata and the Secret Manager of the default project.
+func Default() Chain {
+	if envinstall.IsCloud() {
+		return Chain{Env(), Metadata(), SecretManager(nil)}
+	}
+	chain := Chain{Env()}
+	if home, err := os.UserHomeDir(); err == nil {
+		chain = append(chain, Dir(filepath.Join(home, ".sge", "credentials")))
+	}
+	return chain
+}
+
+// Env returns a provider reading credentials from environment variables named by EnvVar.
+func Env() Provider {
+	return envProvider{}
+}
+
+type envProvider struct{}
+
+func (envProvider) Name() string {
+	return "env"
+}
+
+func (envProvider) Lookup(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(EnvVar(name))
+	return value, ok, nil
+}
+
+// Dir returns a provider reading credentials from files named after them in |dir|. Trailing
+// newlines are trimmed.
+func Dir(dir string) Provider {
+	return dirProvider(dir)
+}
+
+type dirProvider string
+
+func (d dirProvider) Name() string {
+	return "dir " + string(d)
+}
+
+func (d dirProvider) Lookup(name string) (string, bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// Metadata returns a provider reading credentials from the GCE instance attributes. It never has
+// credentials outside of GCE.
+func Metadata() Provider {
+	return metadataProvider{}
+}
+
+type metadataProvider struct{}
+
+func (metadataProvider) Name() string {
+	return "metadata"
+}
+
+func (metadataProvider) Lookup(name string) (string, bool, error) {
+	if !metadata.OnGCE() {
+		return "", false, nil
+	}
+	value, err := metadata.InstanceAttributeValue(name)
+	if _, ok := err.(metadata.NotDefinedError); ok {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SecretManager returns a provider reading the latest version of secrets named after credentials.
+// If |secrets| is nil, the Secret Manager of the gcloud default project is used, created on first
+// lookup.
+func SecretManager(secrets secretmanager.SecretManager) Provider {
+	return &secretProvider{secrets: secrets}
+}
+
+type secretProvider struct {
+	once    sync.Once
+	secrets secretmanager.SecretManager
+	err     error
+}
+
+func (s *secretProvider) Name() string {
+	return "secretmanager"
+}
+
+func (s *secretProvider) Lookup(name string) (string, bool, error) {
+	s.once.Do(func() {
+		if s.secrets == nil {
+			s.secrets, s.err = secretmanager.NewFromDefaultProject()
+		}
+	})
+	if s.err != nil {
+		return "", false, s.err
+	}
+	return s.secrets.AccessLatest(name)
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSecrets is a secretmanager.SecretManager holding secrets in memory.
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) Project() string {
+	return "fake"
+}
+
+func (f fakeSecrets) AccessLatest(secret string) (string, bool, error) {
+	if secret == "broken" {
+		return "", false, fmt.Errorf("could not connect")
+	}
+	v, ok := f[secret]
+	return v, ok, nil
+}
+
+func (f fakeSecrets) Access(secret string, version int) (string, bool, error) {
+	return f.AccessLatest(secret)
+}
+
+func TestChain(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, SwarmAuth), []byte("user:file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, P4Ticket), []byte("ticket-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(EnvVar(P4Ticket), "ticket-from-env")
+	defer os.Unsetenv(EnvVar(P4Ticket))
+
+	chain := Chain{Env(), Dir(dir), SecretManager(fakeSecrets{JenkinsToken: "jenkins:token"})}
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{name: P4Ticket, want: "ticket-from-env"},
+		{name: SwarmAuth, want: "user:file"},
+		{name: JenkinsToken, want: "jenkins:token"},
+		{name: GCPServiceAccount, wantErr: ErrNotFound},
+	}
+	for _, tc := range tests {
+		got, err := Get(chain, tc.name)
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Get(%q): got error %v, want %v", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Get(%q): unexpected error: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("Get(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if _, err := Get(chain, "broken"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a failing provider: got %v, want a lookup error", err)
+	}
+}
+
+func TestInject(t *testing.T) {
+	chain := Chain{SecretManager(fakeSecrets{SwarmAuth: "user:password"})}
+	env, err := Inject(chain, []string{SwarmAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SGE_CREDENTIAL_SWARM_AUTH=user:password"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Inject = %v, want %v", env, want)
+	}
+	if _, err := Inject(chain, []string{JenkinsToken}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Inject of a missing credential: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestSplitBasicAuth(t *testing.T) {
+	user, password, err := SplitBasicAuth("user:pass:word")
+	if err != nil || user != "user" || password != "pass:word" {
+		t.Errorf(`SplitBasicAuth("user:pass:word") = %q, %q, %v`, user, password, err)
+	}
+	if _, _, err := SplitBasicAuth("nocolon"); err == nil {
+		t.Errorf("SplitBasicAuth without colon: want error")
+	}
+}
@@ -73,6 +73,65 @@ func CopyEx(src, dst string, perm os.FileMode) error {
 	return err
 }
 
+// IsLink returns whether |info|, as returned by os.Lstat, is a symlink or a Windows junction.
+// Depending on the Go version, junctions are reported as symlinks or as irregular files.
+func IsLink(info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return true
+	}
+	return runtime.GOOS == "windows" && info.Mode()&os.ModeIrregular != 0
+}
+
+// CopyLink creates a link at |dst| pointing where the link |src| points. Relative targets are
+// resolved against the directory of |src|, so the new link points to the same file wherever it
+// is. Windows junctions are recreated as junctions, which unlike symlinks need no privilege.
+func CopyLink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(src), target)
+	}
+	junction, err := isJunction(src)
+	if err != nil {
+		return err
+	}
+	if junction {
+		return createJunction(target, dst)
+	}
+	return os.Symlink(target, dst)
+}
+
+// Stage copies the file or directory |src| to |dst| with its permissions. Unlike CopyDir, links
+// are recreated with CopyLink rather than copying what they point to, so that trees of links, eg.
+// Bazel runfiles trees, are staged as is.
+func Stage(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case IsLink(info):
+		return CopyLink(src, dst)
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		children, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := Stage(filepath.Join(src, child.Name()), filepath.Join(dst, child.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return CopyEx(src, dst, info.Mode().Perm())
+}
+
 func CopyDir(src, dst string) error {
 	children, err := ioutil.ReadDir(src)
 	if err != nil {
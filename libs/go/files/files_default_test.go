@@ -0,0 +1,42 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyLinkRelative(t *testing.T) {
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "tool"), []byte("tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tool", filepath.Join(src, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "alias")
+	if err := CopyLink(filepath.Join(src, "alias"), dst); err != nil {
+		t.Fatal(err)
+	}
+	// The relative target is resolved against the directory of the original link.
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != "tool" {
+		t.Errorf("copied link reads %q, %v, want %q", got, err, "tool")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestStage(t *testing.T) {
+	root := t.TempDir()
+	// Directory links are junctions on Windows, which need no privilege to create.
+	dirLink := os.Symlink
+	if runtime.GOOS == "windows" {
+		dirLink = createJunction
+	}
+	lib := filepath.Join(root, "lib")
+	runfiles := filepath.Join(root, "tool.runfiles")
+	for _, dir := range []string{lib, runfiles} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(lib, "a.so"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(runfiles, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirLink(lib, filepath.Join(runfiles, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "tool.runfiles")
+	if err := Stage(runfiles, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "data.txt")); err != nil || string(got) != "data" {
+		t.Errorf("staged data.txt = %q, %v, want %q", got, err, "data")
+	}
+	staged := filepath.Join(dst, "lib")
+	info, err := os.Lstat(staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLink(info) {
+		t.Fatalf("lib was staged as %v, want a link", info.Mode())
+	}
+	if junction, err := isJunction(staged); err != nil || junction != (runtime.GOOS == "windows") {
+		t.Errorf("isJunction(%s) = %t, %v, want %t", staged, junction, err, runtime.GOOS == "windows")
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(staged, "a.so")); err != nil || string(got) != "a" {
+		t.Errorf("staged lib/a.so = %q, %v, want %q", got, err, "a")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package files
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// ioReparseTagMountPoint is the reparse tag of junctions, see
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/c8e77b37-3909-4fe6-a4ea-2b9d423b1ee4
+const ioReparseTagMountPoint = 0xA0000003
+
+// isJunction returns whether |p| is a junction rather than a symlink.
+func isJunction(p string) (bool, error) {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return false, err
+	}
+	var data syscall.Win32finddata
+	h, err := syscall.FindFirstFile(name, &data)
+	if err != nil {
+		return false, fmt.Errorf("could not find %s: %v", p, err)
+	}
+	syscall.FindClose(h)
+	// Reserved0 holds the reparse tag of reparse points.
+	return data.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT != 0 && data.Reserved0 == ioReparseTagMountPoint, nil
+}
+
+// createJunction creates the junction |link| to the directory |target|.
+func createJunction(target, link string) error {
+	if out, err := exec.Command("cmd", "/c", "mklink", "/J", link, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not create junction %s: %v: %s", link, err, out)
+	}
+	return nil
+}
+
+// lockFile takes the exclusive lock of |f|, waiting for it if |wait| is set.
+func lockFile(f *os.File, wait bool) error {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK)
+	if !wait {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	// Lock the first byte, which is enough as all the processes lock the same range.
+	ol := &windows.Overlapped{}
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, ol); err != nil {
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return ErrLocked
+		}
+		return fmt.Errorf("could not lock %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
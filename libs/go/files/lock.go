@@ -0,0 +1,62 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by TryLockFile when another process holds the lock.
+var ErrLocked = errors.New("file is locked")
+
+// Lock is an exclusive lock on a file, shared with other processes. It is released by Unlock or
+// when the process exits, so locks of crashed processes don't linger.
+type Lock struct {
+	f *os.File
+}
+
+// LockFile waits until it holds the lock of the file |path|, which is created if missing.
+func LockFile(path string) (*Lock, error) {
+	return lock(path, true)
+}
+
+// TryLockFile locks the file |path| like LockFile, but returns ErrLocked instead of waiting when
+// the lock is held.
+func TryLockFile(path string) (*Lock, error) {
+	return lock(path, false)
+}
+
+func lock(path string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock. The file is left in place, as removing it would race with processes
+// waiting for the lock.
+func (l *Lock) Unlock() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
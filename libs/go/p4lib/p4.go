@@ -18,6 +18,7 @@ package p4lib
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 )
@@ -56,9 +57,19 @@ type P4 interface {
 	// ChangeUpdate executes a p4 change command to update specified CL with new description
 	ChangeUpdate(desc string, cl int) error
 
+	// ChangeUpdateForce is ChangeUpdate with p4 change -f, which lets admins update the changes of
+	// other users.
+	ChangeUpdateForce(desc string, cl int) error
+
 	// Changes executes a p4 changes command and returns a slice of p4 change details.
+	// Queries over the limits of the server are split to fit; if results are still missing, the
+	// others are returned along with a truncated *LimitError.
 	Changes(args ...string) ([]Change, error)
 
+	// ChangeRisk fstats the files of the pending change |cl| and summarizes their risky
+	// conditions, eg. files locked or opened in other workspaces.
+	ChangeRisk(cl int) (*ChangeRisk, error)
+
 	// If clientName is empty, it returns the default P4CLIENT.
 	Client(clientName string) (*Client, error)
 
@@ -80,6 +91,16 @@ type P4 interface {
 	// DescribeShelved runs a "p4 describe" but returns the shelved files within a CL.
 	DescribeShelved(cls ...int) ([]Description, error)
 
+	// DescribeShelvedPartial is DescribeShelved in partial results mode: changes that can't be
+	// described, eg. because their shelves were deleted, don't fail the others. Returns the
+	// descriptions of the other changes, in the order of |cls|, and the errors of the failed ones by
+	// change number, nil if all changes were described.
+	DescribeShelvedPartial(cls ...int) ([]Description, map[int]error)
+
+	// DescribeWithMoves runs a "p4 describe" of |cl| with moves paired and the sources of integrated
+	// files annotated.
+	DescribeWithMoves(cl int) (*MovesDescription, error)
+
 	// Diff opens the P4Merge to diff between a local file and its revisions on the perforce server.
 	DiffFile(file string) error
 
@@ -91,6 +112,13 @@ type P4 interface {
 	// remotely on the perforce server.
 	Diff2(file0 string, file1 string) ([]Diff, error)
 
+	// Diff2At executes a "p4 diff2" between |file0| at revision |rev0| and |file1| at |rev1|.
+	Diff2At(file0 string, rev0 RevSpec, file1 string, rev1 RevSpec) ([]Diff, error)
+
+	// DiffShelf diffs the files shelved in |cl| against revision |against| with "p4 diff2", without
+	// a workspace. The zero RevSpec diffs against the revisions the files were opened at.
+	DiffShelf(cl int, against RevSpec) ([]ShelfDiff, error)
+
 	// Dirs invokes "p4 dirs" and returns a list of subdirectories in specific root folder.
 	Dirs(root string) ([]string, error)
 
@@ -107,12 +135,26 @@ type P4 interface {
 	// functionality. This is meant for advanced usage.
 	ExecCmdWithOptions(args []string, opts ...Option) (string, error)
 
+	// ExecCmdWithResult runs a p4 command like ExecCmdWithOptions and returns its output along
+	// with the advisory messages the server triggers or broker printed, see Warning.
+	ExecCmdWithResult(args []string, opts ...Option) (*Result, error)
+
 	// Files invokes "p4 files" which collects details about the specified file(s).  This is less detail than Fstat.
+	// Queries over the limits of the server are split to fit; if results are still missing, the
+	// others are returned along with a truncated *LimitError.
 	Files(args ...string) ([]FileDetails, error)
 
+	// FilesAt invokes "p4 files" on |paths| at revision |rev|.
+	FilesAt(rev RevSpec, paths ...string) ([]FileDetails, error)
+
 	// Fstat invokes a "p4 fstat" which collects details about the specified file(s).
+	// Queries over the limits of the server are split to fit; if results are still missing, the
+	// others are returned along with a truncated *LimitError.
 	Fstat(args ...string) (*FstatResult, error)
 
+	// FstatAt invokes a "p4 fstat" on |paths| at revision |rev|.
+	FstatAt(rev RevSpec, paths ...string) (*FstatResult, error)
+
 	// Grep executes a p4grep and returns details of files and lines matching input pattern.
 	// This is designed for small greps and has a limit of 10K files participating in each action.
 	Grep(pattern string, caseSensitive bool, depotPaths ...string) ([]Grep, error)
@@ -158,6 +200,9 @@ type P4 interface {
 	// Ignores executes the "p4 ignores -i file" command which tells if a file is ignored in P4IGNORE
 	Ignores(paths []string) (string, error)
 
+	// Limits invokes "p4 configure show" and returns the server-wide limits on queries.
+	Limits() (*Limits, error)
+
 	// Login returns the ticket and expiration for the specified user, or an
 	// error.
 	Login(user string) (string, time.Time, error)
@@ -172,14 +217,32 @@ type P4 interface {
 	// into a single string.
 	Print(args ...string) (string, error)
 
+	// PrintAt returns the contents of the file at |path| at revision |rev|, using "p4 print -q".
+	PrintAt(path string, rev RevSpec) (string, error)
+
 	// PrintEx invokes "p4 print" and retrieves the specified version(s) of file(s) from the server.
 	// This variant safely returns multiple files as a map, but doesn't accept
 	// any flags.
 	PrintEx(files ...string) ([]FileDetails, error)
 
+	// PrintText is PrintEx that also sets the charset of text files, detected unless given in
+	// |opts|, and transcodes their content from it to UTF-8. Shift-JIS files stored as "text", eg.
+	// localization files, are then readable rather than mangled.
+	PrintText(opts PrintOptions, files ...string) ([]FileDetails, error)
+
+	// PrintToStore is PrintEx that streams the contents to |store| instead of returning them in
+	// memory, compressed and deduplicated as configured by the store. The returned details have
+	// their ContentDigest set; use ReadContent to read them back.
+	PrintToStore(store *ContentStore, files ...string) ([]FileDetails, error)
+
 	// Reconcile invokes "p4 reconcile" and marks the inconsistencies between the workspace and the depot.
 	Reconcile(paths []string, cl int) (string, error)
 
+	// ReconcilePreview previews "p4 reconcile" on |paths| without opening any file, returning the
+	// files that would be added, edited, deleted or moved. Pass the paths of a subset of them to
+	// Reconcile to apply it.
+	ReconcilePreview(paths []string) (*Reconciliation, error)
+
 	// Revert invokes "p4 revert" on the given files.
 	Revert(paths []string, opts ...string) (string, error)
 
@@ -187,6 +250,8 @@ type P4 interface {
 	Set(key, value string) error
 
 	// Sizes invokes "p4 sizes" and returns info about file sizes and counts
+	// Queries over the limits of the server are split to fit; if results are still missing, the
+	// others are returned along with a truncated *LimitError.
 	Sizes(dirs ...string) (*SizeCollection, error)
 
 	// Submit submits the given CL.
@@ -252,7 +317,8 @@ func OutputOption(output io.Writer) Option {
 }
 
 type options struct {
-	output io.Writer
+	output   io.Writer
+	warnings *[]Warning
 }
 
 type fnOption func(*options)
@@ -281,6 +347,11 @@ type Client struct {
 	StreamAtChange string
 	ServerId       string
 	ChangeView     []string
+
+	// Extensions are the fields this package doesn't know about, eg. custom fields or fields of
+	// newer servers, by name without the colon. Lines of multi-line values are joined with "\n".
+	// They are written back as read, so that setting a client doesn't drop them.
+	Extensions map[string]string
 }
 
 type ClientOption string
@@ -380,6 +451,22 @@ func (c *Client) String() string {
 	if c.ServerId != "" {
 		fmt.Fprintf(&b, "ServerID:\t%s\n", c.ServerId)
 	}
+	var extensions []string
+	for name := range c.Extensions {
+		extensions = append(extensions, name)
+	}
+	sort.Strings(extensions)
+	for _, name := range extensions {
+		value := c.Extensions[name]
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&b, "%s:\t%s\n", name, value)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n", name)
+		for _, line := range strings.Split(value, "\n") {
+			fmt.Fprintf(&b, "\t%s\n", line)
+		}
+	}
 	if len(c.View) > 0 {
 		fmt.Fprintf(&b, "View:\n")
 		for _, viewEntry := range c.View {
@@ -573,6 +660,9 @@ type FileDetails struct {
 	Time      int64  // time of last action on this revision
 	FileSize  int    // size of this revision
 	Content   []byte
+	Charset   string // charset of the content in the depot, set by PrintText for text files
+	// SHA-256 digest of the content in a ContentStore, set by PrintToStore instead of Content
+	ContentDigest string
 }
 
 // FileStat contains information about a file that exists on the perforce server.
@@ -718,6 +808,9 @@ type StatsMap map[string]struct {
 	MinUs   int64 // Minimum execution time for the command (in microseconds).
 	MaxUs   int64 // Maximum execution time for the command (in microseconds).
 	TotalUs int64 // Total execution time for the command (in microseconds).
+	Tracked int   // Number of executions the server reported performance data for, see WithServerPerf.
+	// Sums of the performance data of the tracked executions, without the tables.
+	Server ServerPerf
 }
 
 var Stats = StatsMap{}
@@ -735,6 +828,21 @@ type impl struct {
 	passwd  string
 	tracer  Tracer
 	exePath string
+	// strict makes parsers of text output fail on lines they don't understand.
+	strict bool
+	// onWarning is called with the warnings printed during commands, see WithWarningHandler.
+	onWarning func(Warning)
+	// cache holds the results of read commands, see WithReadCache.
+	cache *readCache
+	// trackPerf runs commands with -Ztrack and onServerPerf, if set, is called with the performance
+	// data of the server, see WithServerPerf.
+	trackPerf    bool
+	onServerPerf func(ServerPerf)
+	// port is the server commands run against, empty for the one of P4PORT. commitPort is the
+	// commit server and commitCmds the commands always run there, see WithCommitServer.
+	port       string
+	commitPort string
+	commitCmds map[string]bool
 }
 
 func New() P4 {
@@ -755,3 +863,15 @@ func WithTracer(p4 P4, tracer Tracer) P4 {
 	}
 	return p4
 }
+
+// WithStrictParsing returns a P4 whose parsers of text output, eg. Opened or Users, fail with an
+// UnparsedError on lines they don't understand instead of skipping them, so that changes in the
+// output of p4 are noticed. If the provided interface doesn't support it, it is returned unchanged.
+func WithStrictParsing(p4 P4) P4 {
+	if parent, ok := p4.(*impl); ok {
+		child := *parent
+		child.strict = true
+		return &child
+	}
+	return p4
+}
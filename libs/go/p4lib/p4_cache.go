@@ -0,0 +1,190 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default time to live of the results of the read commands cached by WithReadCache.
+var DefaultReadCacheTTLs = map[string]time.Duration{
+	"info":   time.Minute,
+	"client": time.Minute,
+	"users":  5 * time.Minute,
+}
+
+// readCacheInvalidations maps write commands to the cached commands whose results they make stale.
+var readCacheInvalidations = map[string][]string{
+	"client": {"client", "info"},
+	"set":    {"client", "info"},
+	"user":   {"users"},
+}
+
+// ReadCacheOption configures the cache of WithReadCache.
+type ReadCacheOption func(*readCache)
+
+// CacheTTL sets how long the results of read command |cmd|, eg. "info", are cached. A zero TTL
+// disables caching for the command.
+func CacheTTL(cmd string, ttl time.Duration) ReadCacheOption {
+	return func(c *readCache) {
+		c.ttls[cmd] = ttl
+	}
+}
+
+// CacheInvalidation makes write command |cmd| drop the cached results of commands |cached|, on top
+// of the built-in invalidations, eg. for triggers that update users when clients change.
+func CacheInvalidation(cmd string, cached ...string) ReadCacheOption {
+	return func(c *readCache) {
+		c.invalidations[cmd] = append(c.invalidations[cmd], cached...)
+	}
+}
+
+// WithReadCache returns a P4 that caches the results of the read-only commands Info, Client and
+// Users for the TTLs in DefaultReadCacheTTLs, so that tools can call them repeatedly without
+// memoizing them. Running a write command that changes those results, eg. "client -i" or "set",
+// drops them from the cache. The cache is shared with the P4s derived from the returned one, eg.
+// with WithTracer. If the provided interface doesn't support it, it is returned unchanged.
+func WithReadCache(p4 P4, opts ...ReadCacheOption) P4 {
+	parent, ok := p4.(*impl)
+	if !ok {
+		return p4
+	}
+	cache := &readCache{
+		ttls:          map[string]time.Duration{},
+		invalidations: map[string][]string{},
+		entries:       map[string]cacheEntry{},
+		now:           time.Now,
+	}
+	for cmd, ttl := range DefaultReadCacheTTLs {
+		cache.ttls[cmd] = ttl
+	}
+	for cmd, cached := range readCacheInvalidations {
+		cache.invalidations[cmd] = append([]string{}, cached...)
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	child := *parent
+	child.cache = cache
+	return &child
+}
+
+// InvalidateReadCache drops the cached results of commands |cmds|, or of every command if none is
+// given, eg. after changing the server with another P4 or another process.
+func InvalidateReadCache(p4 P4, cmds ...string) {
+	if impl, ok := p4.(*impl); ok && impl.cache != nil {
+		impl.cache.invalidate(cmds...)
+	}
+}
+
+type cacheEntry struct {
+	output  string
+	expires time.Time
+}
+
+// readCache holds the output of read commands, keyed by their arguments and the server they ran
+// against, as P4s derived with WithCommitServer or CommitServer share the cache.
+type readCache struct {
+	ttls          map[string]time.Duration
+	invalidations map[string][]string
+	now           func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// cacheKey returns the key of the command with |args| run against |port|. The command comes first
+// for invalidate.
+func cacheKey(port string, args []string) string {
+	return strings.Join(append([]string{args[0], port}, args[1:]...), "\x00")
+}
+
+func (c *readCache) get(port string, args []string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(port, args)
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.output, true
+}
+
+func (c *readCache) put(port string, args []string, output string) {
+	ttl := c.ttls[args[0]]
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cacheKey(port, args)] = cacheEntry{output: output, expires: c.now().Add(ttl)}
+}
+
+// invalidate drops the entries of commands |cmds|, or every entry if |cmds| is empty.
+func (c *readCache) invalidate(cmds ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(cmds) == 0 {
+		c.entries = map[string]cacheEntry{}
+		return
+	}
+	for key := range c.entries {
+		cmd := strings.SplitN(key, "\x00", 2)[0]
+		for _, want := range cmds {
+			if cmd == want {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// onCommand drops the entries made stale by running the command with |args|. Commands that only
+// print a spec, eg. "client -o", don't change anything.
+func (c *readCache) onCommand(args []string) {
+	cached, ok := c.invalidations[args[0]]
+	if !ok {
+		return
+	}
+	for _, arg := range args[1:] {
+		if arg == "-o" {
+			return
+		}
+	}
+	c.invalidate(cached...)
+}
+
+// cachedCmd runs the read command with |args|, returning its cached output if the cache is
+// enabled and holds it.
+func (p4 *impl) cachedCmd(args ...string) (string, error) {
+	if p4.cache == nil {
+		return p4.ExecCmd(args...)
+	}
+	port := p4.serverPort(args[0])
+	if out, ok := p4.cache.get(port, args); ok {
+		return out, nil
+	}
+	out, err := p4.ExecCmd(args...)
+	if err == nil {
+		p4.cache.put(port, args, out)
+	}
+	return out, err
+}
@@ -248,7 +248,7 @@ func (p4 *impl) runCmdCb(cb interface{}, cmd string, args ...string) error {
 	cbid, handler := handlers.register(cb)
 	defer handlers.unregister(cbid)
 
-	init_us := C.p4runcb(C.p4str(cmd), C.p4str(p4.user), C.p4str(p4.passwd), input, C.p4str(joined), C.int(len(argv)), unsafe.Pointer(&argv[0]), C.int(cbid), C.bool(tag))
+	init_us := C.p4runcb(C.p4str(cmd), C.p4str(p4.serverPort(cmd)), C.p4str(p4.user), C.p4str(p4.passwd), input, C.p4str(joined), C.int(len(argv)), unsafe.Pointer(&argv[0]), C.int(cbid), C.bool(tag))
 
 	duration := time.Since(start)
 	updateStats(cmd, duration.Microseconds(), int64(init_us))
@@ -16,6 +16,7 @@
 #include <chrono>
 #include <deque>
 #include <iostream>
+#include <map>
 #include <memory>
 #include <mutex>
 #include <vector>
@@ -29,6 +30,10 @@ static const int kMaxClients = 16;
 
 class Pool {
 public:
+  // Clients of pools with a |port| connect to that server instead of the one of P4PORT.
+  explicit Pool(const std::string& port = "") : port_(port) {}
+  virtual ~Pool() {}
+
   std::shared_ptr<ClientApi> Client(int* ns, std::string* error, bool* fresh) {
 	const auto start = std::chrono::high_resolution_clock::now();
 	// Manipulate the queue of ready clients under fine grained locks.
@@ -43,6 +48,9 @@ public:
 	if (!client) {
 	  client.reset(new ClientApi());
 	  client->SetCharset("utf8");
+	  if (!port_.empty()) {
+		client->SetPort(port_.c_str());
+	  }
 	  SetProtocol(client.get());
 
 	  Error err;
@@ -83,11 +91,15 @@ protected:
   
 private:
   using ClientQueue = std::deque<std::unique_ptr<ClientApi>>;
+  std::string port_;
   std::mutex mu_;
   ClientQueue clients_;
 };
 
 class TagPool : public Pool {
+public:
+  explicit TagPool(const std::string& port = "") : Pool(port) {}
+
 protected:
   void SetProtocol(ClientApi* c) override {
 	c->SetProtocol("tag", "");
@@ -100,6 +112,24 @@ protected:
 static Pool defaultPool;
 static TagPool tagPool;
 
+// Pools of the clients connected to other servers than the one of P4PORT, eg. the commit server
+// when P4PORT is a replica, by port. They live as long as the process.
+static std::mutex portPoolsMu;
+static std::map<std::string, std::unique_ptr<Pool>> portPools;
+static std::map<std::string, std::unique_ptr<Pool>> tagPortPools;
+
+static Pool& PoolFor(const std::string& port, bool tag) {
+  if (port.empty()) {
+	return tag ? tagPool : defaultPool;
+  }
+  std::lock_guard<std::mutex> lock(portPoolsMu);
+  auto& pool = (tag ? tagPortPools : portPools)[port];
+  if (!pool) {
+	pool.reset(tag ? new TagPool(port) : new Pool(port));
+  }
+  return *pool;
+}
+
 // Declare prototypes for exported Go functions.
 extern "C" {
   void gop4apiHandleError(int cbid, char* err, int len);
@@ -174,14 +204,15 @@ private:
 };
 
 extern "C" {
-  int p4runcb(strview cmd, strview user, strview passwd, strview input,
+  int p4runcb(strview cmd, strview port, strview user, strview passwd, strview input,
 			  strview joined, int argc, void* argv, int cbid, bool tag) {
 	ClientCb cb(cbid, input);
 	std::string cmdstr(cmd.p, cmd.len);
+	std::string portStr(port.p, port.len);
 	std::string userStr(user.p, user.len);
 	std::string passwdStr(passwd.p, passwd.len);
 	int init_us = 0;
-	Pool& pool = tag ? tagPool : defaultPool;
+	Pool& pool = PoolFor(portStr, tag);
 	while (true) {
 	  std::string errmsg;
 	  bool fresh = false;
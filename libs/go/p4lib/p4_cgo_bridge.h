@@ -28,8 +28,9 @@ extern "C" {
 	int len;
   } strview;
 
-  // Runs a p4 command, sending output to the specified callback.
-  int p4runcb(strview cmd, strview user, strview passwd, strview input,
+  // Runs a p4 command, sending output to the specified callback. An empty
+  // port runs it against the server of P4PORT.
+  int p4runcb(strview cmd, strview port, strview user, strview passwd, strview input,
 			  strview joined, int argc, void* argv, int cb, bool tag);
 
 #ifdef __cplusplus
@@ -0,0 +1,330 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChangeBuilder creates a CL atomically: either all the staged operations end up in the CL (and
+// optionally shelved or submitted) or the CL is rolled back as if it never existed.
+//
+// Usage:
+//      cb := p4lib.NewChangeBuilder(p4, "Update vendored foo")
+//      cb.Edit("//depot/foo/version.txt")
+//      cb.Add("//depot/foo/new_file.txt")
+//      cb.Submit()
+//      result, err := cb.Build()
+//
+// Operations are applied in the order they were staged. Rolling back reverts the opened files with
+// "revert -k", so the workspace files are left untouched.
+type ChangeBuilder struct {
+	p4     P4
+	desc   string
+	ops    []changeOp
+	final  changeFinal
+	submit []string
+	dryRun bool
+}
+
+// ChangeResult describes the outcome of ChangeBuilder.Build.
+type ChangeResult struct {
+	// CL is the pending CL that was created. 0 for dry runs.
+	CL int
+
+	// Submitted is the CL number the change was submitted as. Perforce might renumber the CL on
+	// submit. 0 if the CL was not submitted.
+	Submitted int
+
+	// Plan is the list of p4 commands that were (or would have been for dry runs) executed.
+	Plan []string
+}
+
+type changeOpKind int
+
+const (
+	opAdd changeOpKind = iota
+	opEdit
+	opDelete
+	opMove
+	opReconcile
+)
+
+type changeOp struct {
+	kind  changeOpKind
+	paths []string
+}
+
+type changeFinal int
+
+const (
+	finalNone changeFinal = iota
+	finalShelve
+	finalSubmit
+)
+
+// NewChangeBuilder returns a ChangeBuilder that will create a CL with |desc| as description.
+func NewChangeBuilder(p4 P4, desc string) *ChangeBuilder {
+	return &ChangeBuilder{
+		p4:   p4,
+		desc: desc,
+	}
+}
+
+// Add stages marking |paths| for add. The files must exist in the workspace.
+func (cb *ChangeBuilder) Add(paths ...string) {
+	cb.ops = append(cb.ops, changeOp{kind: opAdd, paths: paths})
+}
+
+// Edit stages opening |paths| for edit. The files must exist in the depot.
+func (cb *ChangeBuilder) Edit(paths ...string) {
+	cb.ops = append(cb.ops, changeOp{kind: opEdit, paths: paths})
+}
+
+// Delete stages marking |paths| for delete. The files must exist in the depot.
+func (cb *ChangeBuilder) Delete(paths ...string) {
+	cb.ops = append(cb.ops, changeOp{kind: opDelete, paths: paths})
+}
+
+// Move stages moving |from| to |to|. |from| must exist in the depot.
+func (cb *ChangeBuilder) Move(from, to string) {
+	cb.ops = append(cb.ops, changeOp{kind: opMove, paths: []string{from, to}})
+}
+
+// Reconcile stages reconciling |paths| into the CL.
+func (cb *ChangeBuilder) Reconcile(paths ...string) {
+	cb.ops = append(cb.ops, changeOp{kind: opReconcile, paths: paths})
+}
+
+// Shelve makes Build shelve the CL once all operations are applied.
+func (cb *ChangeBuilder) Shelve() {
+	cb.final = finalShelve
+}
+
+// Submit makes Build submit the CL once all operations are applied. |options| are passed as is to
+// the submit command.
+func (cb *ChangeBuilder) Submit(options ...string) {
+	cb.final = finalSubmit
+	cb.submit = options
+}
+
+// DryRun makes Build only validate the preconditions and report the plan, without touching the
+// depot or the workspace.
+func (cb *ChangeBuilder) DryRun() {
+	cb.dryRun = true
+}
+
+// Build validates the preconditions of the staged operations, creates the CL and applies them.
+// On any failure the CL is rolled back: opened files are reverted and the CL is deleted.
+func (cb *ChangeBuilder) Build() (*ChangeResult, error) {
+	if err := cb.validate(); err != nil {
+		return nil, fmt.Errorf("precondition failed: %v", err)
+	}
+	result := &ChangeResult{}
+	if cb.dryRun {
+		result.Plan = append(result.Plan, "change")
+		for _, op := range cb.ops {
+			result.Plan = append(result.Plan, op.String())
+		}
+		if cmd := cb.finalString(); cmd != "" {
+			result.Plan = append(result.Plan, cmd)
+		}
+		return result, nil
+	}
+	cl, err := cb.p4.Change(cb.desc)
+	if err != nil {
+		return nil, fmt.Errorf("could not create CL: %v", err)
+	}
+	result.CL = cl
+	result.Plan = append(result.Plan, "change")
+	shelved := false
+	rollback := func(err error) (*ChangeResult, error) {
+		if rerr := cb.rollback(cl, shelved); rerr != nil {
+			return result, fmt.Errorf("%v; rollback of CL %d failed: %v", err, cl, rerr)
+		}
+		return result, err
+	}
+	for _, op := range cb.ops {
+		result.Plan = append(result.Plan, op.String())
+		if out, err := cb.apply(cl, op); err != nil {
+			return rollback(fmt.Errorf("%s failed: %v: %s", op.String(), err, out))
+		}
+	}
+	switch cb.final {
+	case finalShelve:
+		result.Plan = append(result.Plan, cb.finalString())
+		if out, err := cb.p4.ExecCmd("shelve", "-c", strconv.Itoa(cl)); err != nil {
+			return rollback(fmt.Errorf("could not shelve CL %d: %v: %s", cl, err, out))
+		}
+		shelved = true
+	case finalSubmit:
+		result.Plan = append(result.Plan, cb.finalString())
+		out, err := cb.p4.Submit(cl, cb.submit...)
+		if err != nil {
+			return rollback(fmt.Errorf("could not submit CL %d: %v: %s", cl, err, out))
+		}
+		result.Submitted = parseSubmittedCL(out, cl)
+	}
+	return result, nil
+}
+
+// validate checks that the staged operations can be applied to the current workspace.
+func (cb *ChangeBuilder) validate() error {
+	if strings.TrimSpace(cb.desc) == "" {
+		return fmt.Errorf("empty CL description")
+	}
+	if len(cb.ops) == 0 {
+		return fmt.Errorf("no operations staged")
+	}
+	seen := map[string]bool{}
+	for _, op := range cb.ops {
+		if len(op.paths) == 0 {
+			return fmt.Errorf("%s without paths", op.kind)
+		}
+		for _, p := range op.paths {
+			if seen[p] {
+				return fmt.Errorf("%s staged more than once", p)
+			}
+			seen[p] = true
+		}
+		switch op.kind {
+		case opAdd:
+			for _, p := range op.paths {
+				if _, err := os.Stat(p); err != nil {
+					return fmt.Errorf("cannot add %s: %v", p, err)
+				}
+			}
+		case opEdit, opDelete:
+			for _, p := range op.paths {
+				if err := cb.checkInDepot(p); err != nil {
+					return err
+				}
+			}
+		case opMove:
+			if err := cb.checkInDepot(op.paths[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkInDepot verifies that |path| exists at head and is not opened in the workspace.
+func (cb *ChangeBuilder) checkInDepot(path string) error {
+	fs, err := cb.p4.Fstat(path)
+	if err != nil {
+		return fmt.Errorf("could not fstat %s: %v", path, err)
+	}
+	if len(fs.FileStats) != 1 {
+		return fmt.Errorf("%s: expected 1 file, got %d", path, len(fs.FileStats))
+	}
+	stat := fs.FileStats[0]
+	if stat.HeadRev == 0 || strings.HasSuffix(stat.HeadAction, "delete") {
+		return fmt.Errorf("%s does not exist in the depot", path)
+	}
+	if stat.Action != "" {
+		return fmt.Errorf("%s is already opened for %s in CL %d", path, stat.Action, stat.Change)
+	}
+	return nil
+}
+
+func (cb *ChangeBuilder) apply(cl int, op changeOp) (string, error) {
+	switch op.kind {
+	case opAdd:
+		return cb.p4.Add(op.paths, "-c", strconv.Itoa(cl))
+	case opEdit:
+		return cb.p4.Edit(op.paths, cl)
+	case opDelete:
+		return cb.p4.Delete(op.paths, cl)
+	case opMove:
+		// p4 move requires the source to be opened for edit.
+		if out, err := cb.p4.Edit(op.paths[:1], cl); err != nil {
+			return out, err
+		}
+		return cb.p4.Move(cl, op.paths[0], op.paths[1])
+	case opReconcile:
+		return cb.p4.Reconcile(op.paths, cl)
+	}
+	return "", fmt.Errorf("unknown operation %d", op.kind)
+}
+
+// rollback reverts every file opened in |cl| and deletes it.
+func (cb *ChangeBuilder) rollback(cl int, shelved bool) error {
+	c := strconv.Itoa(cl)
+	if shelved {
+		if out, err := cb.p4.ExecCmd("shelve", "-d", "-c", c); err != nil {
+			return fmt.Errorf("could not delete shelved files: %v: %s", err, out)
+		}
+	}
+	if out, err := cb.p4.Revert([]string{"//..."}, "-k", "-c", c); err != nil {
+		return fmt.Errorf("could not revert files: %v: %s", err, out)
+	}
+	if out, err := cb.p4.ExecCmd("change", "-d", c); err != nil {
+		return fmt.Errorf("could not delete CL: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (cb *ChangeBuilder) finalString() string {
+	switch cb.final {
+	case finalShelve:
+		return "shelve"
+	case finalSubmit:
+		return strings.Join(append([]string{"submit"}, cb.submit...), " ")
+	}
+	return ""
+}
+
+func (k changeOpKind) String() string {
+	switch k {
+	case opAdd:
+		return "add"
+	case opEdit:
+		return "edit"
+	case opDelete:
+		return "delete"
+	case opMove:
+		return "move"
+	case opReconcile:
+		return "reconcile"
+	}
+	return "unknown"
+}
+
+func (op changeOp) String() string {
+	return fmt.Sprintf("%s %s", op.kind, strings.Join(op.paths, " "))
+}
+
+var p4SubmittedRe = regexp.MustCompile(`Change (\d+) (?:renamed change (\d+) and )?submitted`)
+
+// parseSubmittedCL returns the CL number reported by a "p4 submit" output, falling back to |cl|.
+func parseSubmittedCL(out string, cl int) int {
+	m := p4SubmittedRe.FindStringSubmatch(out)
+	if m == nil {
+		return cl
+	}
+	num := m[1]
+	if m[2] != "" {
+		num = m[2]
+	}
+	if n, err := strconv.Atoi(num); err == nil {
+		return n
+	}
+	return cl
+}
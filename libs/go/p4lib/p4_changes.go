@@ -37,13 +37,3 @@ func (cb *changecb) outputStat(stats map[string]string) error {
 	return nil
 }
 func (cb *changecb) tagProtocol() {}
-
-// Changes executes a p4 changes command and returns a slice of p4 change details
-func (p4 *impl) Changes(args ...string) ([]Change, error) {
-	cb := changecb{}
-	err := p4.runCmdCb(&cb, "changes", args...)
-	if err != nil {
-		return nil, err
-	}
-	return cb, nil
-}
@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Charsets of file content, named as by "p4 -C".
+const (
+	CharsetUtf8       = "utf8"
+	CharsetUtf8Bom    = "utf8-bom"
+	CharsetUtf16      = "utf16"
+	CharsetUtf16LeBom = "utf16le-bom"
+	CharsetUtf16BeBom = "utf16be-bom"
+	CharsetShiftJis   = "shiftjis"
+	CharsetEucJp      = "eucjp"
+	CharsetWinAnsi    = "winansi"
+	CharsetIso8859_1  = "iso8859-1"
+)
+
+// PrintOptions controls how PrintText returns the content of text files.
+type PrintOptions struct {
+	// Charset is the charset of the content in the depot. If empty, it is detected per file.
+	Charset string
+
+	// Raw returns the content as stored in the depot, without transcoding it to UTF-8. The
+	// charset is still detected.
+	Raw bool
+}
+
+// charsetEncodings are the encodings of the charsets that need transcoding to UTF-8.
+var charsetEncodings = map[string]encoding.Encoding{
+	CharsetUtf16LeBom: unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM),
+	CharsetUtf16BeBom: unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM),
+	CharsetShiftJis:   japanese.ShiftJIS,
+	CharsetEucJp:      japanese.EUCJP,
+	CharsetWinAnsi:    charmap.Windows1252,
+	CharsetIso8859_1:  charmap.ISO8859_1,
+}
+
+// DetectCharset returns the most likely charset of the text |data|. Content that isn't valid
+// UTF-8, UTF-16 with a BOM, EUC-JP or Shift-JIS is assumed to be "winansi".
+func DetectCharset(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return CharsetUtf8Bom
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return CharsetUtf16LeBom
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return CharsetUtf16BeBom
+	case utf8.Valid(data):
+		return CharsetUtf8
+	// Shift-JIS lead bytes of kana and most kanji are invalid in EUC-JP, but EUC-JP is almost
+	// always valid Shift-JIS, so EUC-JP is tried first.
+	case isEucJp(data):
+		return CharsetEucJp
+	case isShiftJis(data):
+		return CharsetShiftJis
+	}
+	return CharsetWinAnsi
+}
+
+// Transcode returns the text |data| in |charset| as UTF-8.
+func Transcode(data []byte, charset string) ([]byte, error) {
+	switch charset {
+	case CharsetUtf8, CharsetUtf8Bom, CharsetUtf16:
+		// The server translates utf16 files to the utf8 charset of the client.
+		return data, nil
+	}
+	enc, ok := charsetEncodings[charset]
+	if !ok {
+		return nil, fmt.Errorf("unknown charset %q", charset)
+	}
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not transcode from %s: %w", charset, err)
+	}
+	return out, nil
+}
+
+// decodeText sets the charset of |d| if it is a text file, and transcodes its content to UTF-8
+// unless |opts| asks for raw content.
+func decodeText(d *FileDetails, opts PrintOptions) error {
+	if !IsTextType(d.Type) {
+		return nil
+	}
+	switch strings.SplitN(d.Type, "+", 2)[0] {
+	case "unicode", "utf8":
+		d.Charset = CharsetUtf8
+	case "utf16":
+		d.Charset = CharsetUtf16
+	default:
+		d.Charset = opts.Charset
+		if d.Charset == "" {
+			d.Charset = DetectCharset(d.Content)
+		}
+	}
+	if opts.Raw {
+		return nil
+	}
+	content, err := Transcode(d.Content, d.Charset)
+	if err != nil {
+		return fmt.Errorf("%s: %w", d.DepotFile, err)
+	}
+	d.Content = content
+	return nil
+}
+
+// isEucJp returns whether |data| is valid EUC-JP with at least one multi-byte character.
+func isEucJp(data []byte) bool {
+	multi := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+			continue
+		case c == 0x8E:
+			// Half-width katakana.
+			if i+1 >= len(data) || data[i+1] < 0xA1 || data[i+1] > 0xDF {
+				return false
+			}
+			i++
+		case c == 0x8F:
+			// JIS X 0212.
+			if i+2 >= len(data) || !isEucJpByte(data[i+1]) || !isEucJpByte(data[i+2]) {
+				return false
+			}
+			i += 2
+		case isEucJpByte(c):
+			if i+1 >= len(data) || !isEucJpByte(data[i+1]) {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+		multi = true
+	}
+	return multi
+}
+
+func isEucJpByte(c byte) bool {
+	return c >= 0xA1 && c <= 0xFE
+}
+
+// isShiftJis returns whether |data| is valid Shift-JIS with at least one double-byte character.
+func isShiftJis(data []byte) bool {
+	double := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80 || (c >= 0xA1 && c <= 0xDF):
+			// ASCII or half-width katakana.
+			continue
+		case (c >= 0x81 && c <= 0x9F) || (c >= 0xE0 && c <= 0xFC):
+			if i+1 >= len(data) {
+				return false
+			}
+			t := data[i+1]
+			if t < 0x40 || t > 0xFC || t == 0x7F {
+				return false
+			}
+			i++
+			double = true
+		default:
+			return false
+		}
+	}
+	return double
+}
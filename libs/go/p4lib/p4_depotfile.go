@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DepotFileRefresh is how often a DepotFile reloads its file.
+const DepotFileRefresh = 5 * time.Minute
+
+// DepotFile loads a file of the depot, eg. the text proto of some settings, and reloads it
+// periodically, so that submitted changes apply without restarting long running services.
+type DepotFile struct {
+	p4    P4
+	path  string
+	parse func(text string) (interface{}, error)
+	// Now returns the current time. Tests replace it.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	value  interface{}
+	err    error
+	loaded time.Time
+}
+
+// NewDepotFile returns a DepotFile loading depot path |path|, eg. "//depot/ebert/links.textpb",
+// with |parse|.
+func NewDepotFile(p4 P4, path string, parse func(text string) (interface{}, error)) *DepotFile {
+	return &DepotFile{p4: p4, path: path, parse: parse, Now: time.Now}
+}
+
+// Get returns the file as parsed by the latest load that succeeded. When the file can't be loaded
+// or parsed, the last version that could is returned. Returns an error if none ever could.
+func (f *DepotFile) Get() (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.Now()
+	if !f.loaded.IsZero() && now.Sub(f.loaded) < DepotFileRefresh {
+		return f.value, f.err
+	}
+	// Failures are retried at the next refresh, not on every call.
+	f.loaded = now
+	value, err := f.load()
+	if err != nil {
+		glog.Warningf("%v", err)
+		if f.value == nil {
+			f.err = err
+		}
+		return f.value, f.err
+	}
+	f.value, f.err = value, nil
+	return value, nil
+}
+
+func (f *DepotFile) load() (interface{}, error) {
+	text, err := f.p4.Print("-q", f.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", f.path, err)
+	}
+	value, err := f.parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", f.path, err)
+	}
+	return value, nil
+}
@@ -68,3 +68,50 @@ func (p4 *impl) DescribeShelved(cls ...int) ([]Description, error) {
 	}
 	return cb, nil
 }
+
+// DescribeShelvedPartial runs DescribeShelved in partial results mode.
+func (p4 *impl) DescribeShelvedPartial(cls ...int) ([]Description, map[int]error) {
+	return DescribePartial(cls, p4.DescribeShelved)
+}
+
+// DescribePartial describes |cls| with |describe| in partial results mode: changes that can't be
+// described don't fail the others. Returns the descriptions of the changes that could be described,
+// in the order of |cls|, and the errors of the others by change number, nil if there are none.
+//
+// The changes are described in a single batch first. p4 reports errors for the whole batch, so if
+// it fails, the changes it didn't describe are retried one by one to get their own errors.
+func DescribePartial(cls []int, describe func(cls ...int) ([]Description, error)) ([]Description, map[int]error) {
+	batch, err := describe(cls...)
+	if err == nil && len(batch) == len(cls) {
+		return batch, nil
+	}
+	byCl := map[int]Description{}
+	for _, desc := range batch {
+		byCl[desc.Cl] = desc
+	}
+	errs := map[int]error{}
+	for _, cl := range cls {
+		if _, ok := byCl[cl]; ok {
+			continue
+		}
+		descs, err := describe(cl)
+		switch {
+		case err != nil:
+			errs[cl] = err
+		case len(descs) != 1:
+			errs[cl] = fmt.Errorf("expected 1 description of change %d, got %d", cl, len(descs))
+		default:
+			byCl[cl] = descs[0]
+		}
+	}
+	if len(errs) == 0 {
+		errs = nil
+	}
+	descs := make([]Description, 0, len(byCl))
+	for _, cl := range cls {
+		if desc, ok := byCl[cl]; ok {
+			descs = append(descs, desc)
+		}
+	}
+	return descs, errs
+}
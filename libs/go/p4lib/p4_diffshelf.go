@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ShelfHunk is a hunk of the unified diff of a shelved file.
+type ShelfHunk struct {
+	LeftStart  int
+	LeftLines  int
+	RightStart int
+	RightLines int
+	// Lines are the lines of the hunk prefixed with ' ' for context, '-' for lines only in the
+	// revision diffed against and '+' for lines only in the shelf.
+	Lines []string
+}
+
+// ShelfDiff is the diff of a file shelved in a change against another revision of the file.
+type ShelfDiff struct {
+	DepotPath string
+	Action    string
+	Type      string
+	// Left is the file spec the shelved file is diffed against, empty if there is no such
+	// revision, eg. for added files.
+	Left string
+	// Binary is set for files that aren't text. Their diffs have no hunks.
+	Binary bool
+	Hunks  []ShelfHunk
+}
+
+// DiffShelf diffs the files shelved in change |cl| against revision |against|, entirely on the
+// server, eg. against AtHead(). The zero RevSpec diffs against the revisions the files were opened
+// at. Added files are diffed against nothing and deleted files against nothing in the shelf.
+func (p4 *impl) DiffShelf(cl int, against RevSpec) ([]ShelfDiff, error) {
+	return diffShelf(p4, cl, against)
+}
+
+func diffShelf(p4 P4, cl int, against RevSpec) ([]ShelfDiff, error) {
+	if against.isRange {
+		return nil, fmt.Errorf("cannot diff shelf of %d against range %s", cl, against)
+	}
+	descs, err := p4.DescribeShelved(cl)
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) != 1 {
+		return nil, fmt.Errorf("expected 1 description for %d, got %d", cl, len(descs))
+	}
+	shelf := AtShelvedChange(cl)
+	diffs := make([]ShelfDiff, 0, len(descs[0].Files))
+	for _, f := range descs[0].Files {
+		d, err := diffShelvedFile(p4, &f, shelf, against)
+		if err != nil {
+			return nil, fmt.Errorf("could not diff %s: %v", shelf.Of(f.DepotPath), err)
+		}
+		diffs = append(diffs, *d)
+	}
+	return diffs, nil
+}
+
+// diffShelvedFile diffs the shelved file |f| at |shelf| against |against|, or against the revision
+// it was opened at if |against| is empty.
+func diffShelvedFile(p4 P4, f *FileAction, shelf, against RevSpec) (*ShelfDiff, error) {
+	d := &ShelfDiff{
+		DepotPath: f.DepotPath,
+		Action:    f.Action,
+		Type:      f.Type,
+		Binary:    !IsTextType(f.Type),
+	}
+	added := isAddAction(f.Action)
+	left := against
+	if left.spec == "" {
+		if added {
+			// Added files weren't opened at any revision.
+			left = AtNone()
+		} else {
+			left = AtRev(f.Revision)
+		}
+	}
+	if left != AtNone() {
+		d.Left = left.Of(f.DepotPath)
+	}
+	if d.Binary {
+		return d, nil
+	}
+	switch {
+	case isDeleteAction(f.Action):
+		if d.Left == "" {
+			return d, nil
+		}
+		content, err := p4.Print("-q", d.Left)
+		if err != nil {
+			return nil, err
+		}
+		d.Hunks = wholeFileHunks(content, '-')
+		return d, nil
+	case d.Left == "":
+		content, err := p4.Print("-q", shelf.Of(f.DepotPath))
+		if err != nil {
+			return nil, err
+		}
+		d.Hunks = wholeFileHunks(content, '+')
+		return d, nil
+	}
+	out, err := p4.ExecCmd("diff2", "-du", d.Left, shelf.Of(f.DepotPath))
+	if err != nil {
+		return nil, err
+	}
+	hunks, leftExists, err := parseUnifiedDiff(out)
+	if err != nil {
+		return nil, err
+	}
+	if !leftExists {
+		// Eg. a file added by the shelf, diffed against a revision before it was added elsewhere.
+		d.Left = ""
+		content, err := p4.Print("-q", shelf.Of(f.DepotPath))
+		if err != nil {
+			return nil, err
+		}
+		hunks = wholeFileHunks(content, '+')
+	}
+	d.Hunks = hunks
+	return d, nil
+}
+
+func isAddAction(action string) bool {
+	return action == "add" || action == "branch" || action == "move/add" || action == "import"
+}
+
+func isDeleteAction(action string) bool {
+	return action == "delete" || action == "move/delete" || action == "purge" || action == "archive"
+}
+
+// IsTextType returns whether the file type |t| holds text, eg. "text+x", "utf16" or the legacy
+// "ktext", as opposed to eg. "binary+l" or "apple".
+func IsTextType(t string) bool {
+	base := strings.SplitN(t, "+", 2)[0]
+	switch base {
+	case "symlink", "unicode", "utf8", "utf16":
+		return true
+	}
+	return strings.HasSuffix(base, "text")
+}
+
+// wholeFileHunks returns the hunk adding (|op| '+') or deleting (|op| '-') all of |content|.
+func wholeFileHunks(content string, op byte) []ShelfHunk {
+	if content == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	h := ShelfHunk{Lines: make([]string, 0, len(lines))}
+	for _, l := range lines {
+		h.Lines = append(h.Lines, string(op)+strings.TrimSuffix(l, "\r"))
+	}
+	if op == '+' {
+		h.RightStart, h.RightLines = 1, len(lines)
+	} else {
+		h.LeftStart, h.LeftLines = 1, len(lines)
+	}
+	return []ShelfHunk{h}
+}
+
+// hunkHeader matches the header of a unified diff hunk, eg. "@@ -1,3 +1,4 @@". Counts of 1 are
+// omitted.
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseUnifiedDiff parses the output of "p4 diff2 -du" of a single pair of files. Returns false if
+// the left file doesn't exist, which p4 reports as "<none>" without diffing.
+func parseUnifiedDiff(out string) ([]ShelfHunk, bool, error) {
+	var hunks []ShelfHunk
+	var h *ShelfHunk
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "==== ") {
+			if strings.HasPrefix(line, "==== <none>") {
+				return nil, false, nil
+			}
+			continue
+		}
+		if m := hunkHeader.FindStringSubmatch(line); m != nil {
+			hunks = append(hunks, ShelfHunk{
+				LeftStart:  atoiOr(m[1], 1),
+				LeftLines:  atoiOr(m[2], 1),
+				RightStart: atoiOr(m[3], 1),
+				RightLines: atoiOr(m[4], 1),
+			})
+			h = &hunks[len(hunks)-1]
+			continue
+		}
+		if h == nil || line == "" {
+			continue
+		}
+		switch line[0] {
+		case ' ', '-', '+':
+			h.Lines = append(h.Lines, line)
+		case '\\':
+			// "\ No newline at end of file".
+		default:
+			return nil, false, fmt.Errorf("unexpected diff line %q", line)
+		}
+	}
+	return hunks, true, nil
+}
+
+// atoiOr returns the integer of |s|, or |def| if |s| is empty.
+func atoiOr(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -36,13 +36,3 @@ func (fs *FstatResult) outputStat(stats map[string]string) error {
 	}
 	return nil
 }
-
-// Fstat invokes a "p4 fstat" which collects details about the specified file(s)
-func (p4 *impl) Fstat(args ...string) (*FstatResult, error) {
-	fs := &FstatResult{}
-	err := p4.runCmdCb(fs, "fstat", args...)
-	if err != nil {
-		return nil, err
-	}
-	return fs, nil
-}
@@ -143,6 +143,14 @@ func (p4 *impl) Change(desc string) (int, error) {
 
 // ChangeUpdate executes a p4 change command and creates a new changelist with specified description
 func (p4 *impl) ChangeUpdate(desc string, cl int) error {
+	return p4.changeUpdate(desc, cl, false)
+}
+
+func (p4 *impl) ChangeUpdateForce(desc string, cl int) error {
+	return p4.changeUpdate(desc, cl, true)
+}
+
+func (p4 *impl) changeUpdate(desc string, cl int, force bool) error {
 	stdOutErr, err := p4.ExecCmd("change", "-o", fmt.Sprintf("%d", cl))
 	if err != nil {
 		return err
@@ -169,7 +177,11 @@ func (p4 *impl) ChangeUpdate(desc string, cl int) error {
 
 	var b bytes.Buffer
 	b.Write([]byte(newDesc))
-	_, err = p4.execCmdWithStdin(&b, []string{"change", "-i"})
+	args := []string{"change", "-i"}
+	if force {
+		args = []string{"change", "-f", "-i"}
+	}
+	_, err = p4.execCmdWithStdin(&b, args)
 	return err
 }
 
@@ -181,7 +193,7 @@ func (p4 *impl) Client(clientName string) (*Client, error) {
 		args = append(args, clientName)
 	}
 
-	data, err := p4.ExecCmd(args...)
+	data, err := p4.cachedCmd(args...)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %s", err, data)
 	}
@@ -308,6 +320,15 @@ func parseClient(data string) (*Client, error) {
 				i += 1
 			}
 		default:
+			if name := strings.TrimSuffix(tokens[0], ":"); isFieldToken(tokens[0]) && !clientFields[name] && strings.HasPrefix(line, tokens[0]) {
+				var value string
+				value, i = readSpecField(lines, i, strings.TrimLeft(line[len(tokens[0]):], " \t"))
+				if client.Extensions == nil {
+					client.Extensions = map[string]string{}
+				}
+				client.Extensions[name] = value
+				break
+			}
 			isSingleLineField = true
 		}
 
@@ -365,6 +386,50 @@ func parseClient(data string) (*Client, error) {
 	return client, nil
 }
 
+// clientFields are the client spec fields parseClient knows about. Update and Access are set by
+// the server and ignored.
+var clientFields = map[string]bool{
+	"Client":         true,
+	"Update":         true,
+	"Access":         true,
+	"Owner":          true,
+	"Host":           true,
+	"Description":    true,
+	"Root":           true,
+	"AltRoots":       true,
+	"Options":        true,
+	"SubmitOptions":  true,
+	"LineEnd":        true,
+	"Stream":         true,
+	"StreamAtChange": true,
+	"ServerID":       true,
+	"View":           true,
+	"ChangeView":     true,
+}
+
+// readSpecField reads the value of a spec field whose line is followed by |lines|[|i|:] and that
+// has |rest| after its name. Values are either on the line of the field, or on the following
+// indented lines. Returns the value, with the lines of multi-line values joined with "\n", and the
+// index of the line following it.
+func readSpecField(lines []string, i int, rest string) (string, int) {
+	if rest != "" {
+		return rest, i
+	}
+	var values []string
+	for ; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line != "" && line[0] != '\t' && line[0] != ' ' {
+			break
+		}
+		values = append(values, strings.TrimPrefix(line, "\t"))
+	}
+	// Fields are separated by empty lines, which aren't part of the value.
+	for len(values) > 0 && strings.TrimSpace(values[len(values)-1]) == "" {
+		values = values[:len(values)-1]
+	}
+	return strings.Join(values, "\n"), i
+}
+
 var clientOptions = []ClientOption{
 	AllWrite,
 	Clobber,
@@ -582,6 +647,12 @@ func (p4 *impl) ExecCmdWithOptions(args []string, opts ...Option) (string, error
 	return p4.execCmdWithStdin(nil, args, opts...)
 }
 
+func (p4 *impl) ExecCmdWithResult(args []string, opts ...Option) (*Result, error) {
+	var warnings []Warning
+	output, err := p4.execCmdWithStdin(nil, args, append(opts, WarningsOption(&warnings))...)
+	return &Result{Output: output, Warnings: warnings}, err
+}
+
 // outputMultiplexer implements the io.Writer interface so that it can both store the the data
 // written internally and output it to an optional external io.Writer as well. This is used to
 // implement the OutputOption.
@@ -671,6 +742,9 @@ func (p4 *impl) execCmdWithStdin(stdin io.Reader, args []string, opts ...Option)
 	for _, opt := range opts {
 		opt.apply(&appliedOpts)
 	}
+	if p4.cache != nil {
+		p4.cache.onCommand(args)
+	}
 
 	if _, ok := useApi[args[0]]; ok {
 		b := buffer{input: stdin}
@@ -699,6 +773,17 @@ func (p4 *impl) execCmdWithStdin(stdin io.Reader, args []string, opts ...Option)
 	if p4.passwd != "" {
 		p4Args = append(p4Args, "-P", p4.passwd)
 	}
+	if port := p4.serverPort(args[0]); port != "" {
+		p4Args = append(p4Args, "-p", port)
+	}
+	if p4.trackPerf {
+		p4Args = append(p4Args, "-Ztrack")
+	}
+	// Warnings are only told apart from other messages by the severity tags of -s.
+	tagged := appliedOpts.warnings != nil || p4.onWarning != nil
+	if tagged {
+		p4Args = append(p4Args, "-s")
+	}
 	p4Args = append(p4Args, args...)
 	com := exec.Command(p4.exePath, p4Args...)
 
@@ -707,11 +792,42 @@ func (p4 *impl) execCmdWithStdin(stdin io.Reader, args []string, opts ...Option)
 	com.Stdin = stdin
 
 	// If the user defined another output buffer, we make sure it getrs redirected there as well.
+	// Stdout and stderr share one writer, so that os/exec writes them in order from one goroutine.
 	om := newOutputMultiplexer(appliedOpts.output)
-	com.Stdout = &om
-	com.Stderr = &om
+	var out io.Writer = &om
+	var to *taggedOutput
+	if tagged {
+		to = &taggedOutput{cmd: args[0], om: &om}
+		out = to
+	}
+	com.Stdout = out
+	com.Stderr = out
 	err := com.Run()
+	var warnings []Warning
+	if to != nil {
+		if ferr := to.flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+		warnings = to.warnings
+	}
 	output := om.internal.String()
+	if p4.trackPerf {
+		var perf *ServerPerf
+		if perf, output = splitServerPerf(args[0], output); perf != nil {
+			updateServerStats(perf)
+			if p4.onServerPerf != nil {
+				p4.onServerPerf(*perf)
+			}
+		}
+	}
+	for _, w := range warnings {
+		if p4.onWarning != nil {
+			p4.onWarning(w)
+		}
+		if appliedOpts.warnings != nil {
+			*appliedOpts.warnings = append(*appliedOpts.warnings, w)
+		}
+	}
 
 	if err != nil {
 		log.Println(com)
@@ -892,7 +1008,7 @@ func (p4 *impl) IndexDelete(name string, attrib int, values ...string) error {
 
 // Info executes the "p4 info" command which returns details about the current session
 func (p4 *impl) Info() (*Info, error) {
-	out, err := p4.ExecCmd("info")
+	out, err := p4.cachedCmd("info")
 	if err != nil {
 		return nil, err
 	}
@@ -913,41 +1029,6 @@ func (p4 *impl) Info() (*Info, error) {
 	}, nil
 }
 
-// Line is "<DEPOT_PATH>#<REVISION> - <LOCAL_PATH>"
-var haveRegex = regexp.MustCompile(`^(.+)#(\d+) - (.+)`)
-
-// haveParse only obtains the files in which Perforce returns a structured output for them
-// in the format "<DEPOT_PATH>#<REVISION> - <LOCAL_PATH>", which corresponds to a local file
-// correctly synced. Outside of that case, Perforce has a lot of different failure cases that expose
-// different output: file not found, file not in client, etc. and tracking each little difference
-// is error prone and fragile. Instead we search for the known success case and assume that non
-// conforming output equals to a non-have.
-func haveParse(have string) ([]File, error) {
-	input := strings.ReplaceAll(have, "\r", "")
-	var files []File
-	for i, line := range strings.Split(strings.TrimSuffix(input, "\n"), "\n") {
-		matches := haveRegex.FindStringSubmatch(line)
-		// We are best effort in trying to parse lines.
-		if matches == nil {
-			continue
-		}
-		revision, err := strconv.Atoi(matches[2])
-		if err != nil {
-			return nil, fmt.Errorf("wrong revision at line %d (%s): %v", i, line, err)
-		}
-		local, err := filepath.Abs(matches[3])
-		if err != nil {
-			return nil, fmt.Errorf("wrong local path at line %d (%s): %v", i, line, err)
-		}
-		files = append(files, File{
-			DepotPath: matches[1],
-			Revision:  revision,
-			LocalPath: local,
-		})
-	}
-	return files, nil
-}
-
 func (p4 *impl) Have(patterns ...string) ([]File, error) {
 	// Users can call this with thousands of patterns which would blow the command line limit for
 	// Windows, so we create a temp file for holding the command.
@@ -972,11 +1053,9 @@ func (p4 *impl) Have(patterns ...string) ([]File, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error running have (%v): %s", err, out)
 	}
-	return haveParse(out)
+	return parseHave(out, p4.strict)
 }
 
-var p4OpenedRe = regexp.MustCompile(`(//[^#]+)#[0-9]+ - (\S+) (\S+) (\S+) \((\S+)\)`)
-
 func (p4 *impl) Opened(change string) ([]OpenedFile, error) {
 	args := []string{"opened"}
 	if change != "" {
@@ -986,39 +1065,7 @@ func (p4 *impl) Opened(change string) ([]OpenedFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	var ret []OpenedFile
-	for _, line := range strings.Split(out, "\n") {
-		if m := p4OpenedRe.FindStringSubmatch(line); m != nil {
-			if len(m) != 6 {
-				return nil, fmt.Errorf("incorrect number of subgroups in %s", m[0])
-			}
-			at, err := GetActionType(m[2])
-			if err != nil {
-				return nil, fmt.Errorf("unhandled action type %s", line)
-			}
-			var cl int
-			change := m[3]
-			switch change {
-			case "change":
-				cl, err = strconv.Atoi(m[4])
-				if err != nil {
-					return nil, fmt.Errorf("could not parse %s: %v", line, err)
-				}
-			case "default":
-				cl = 0
-			default:
-				return nil, fmt.Errorf("could not parse %s", line)
-			}
-			ft, err := GetFileType(m[5])
-			ret = append(ret, OpenedFile{
-				Path:   m[1],
-				Status: at,
-				CL:     cl,
-				Type:   ft,
-			})
-		}
-	}
-	return ret, nil
+	return parseOpened(out, p4.strict)
 }
 
 func (p4 *impl) Ignores(paths []string) (string, error) {
@@ -1057,39 +1104,6 @@ func (p4 *impl) Set(key, value string) error {
 }
 
 // Sizes invokes "p4 sizes" and returns info about file sizes and counts
-func (p4 *impl) Sizes(dirs ...string) (*SizeCollection, error) {
-	sc := &SizeCollection{}
-
-	cmd := []string{"sizes", "-s"}
-	cmd = append(cmd, dirs...)
-	out, err := p4.ExecCmd(cmd...)
-	lines := strings.Split(out, "\n")
-	if len(lines) < 1 {
-		return nil, fmt.Errorf("couldn't read sizes")
-	}
-	for _, line := range lines {
-		words := strings.Split(line, " ")
-		if len(words) < 5 {
-			continue
-		}
-		fc, err := strconv.Atoi(words[len(words)-5])
-		if err != nil {
-			continue
-		}
-		fs, err := strconv.Atoi(words[len(words)-3])
-		if err != nil {
-			continue
-		}
-		sc.Sizes = append(sc.Sizes, Size{
-			DepotPath: words[0],
-			FileCount: uint64(fc),
-			FileSize:  uint64(fs),
-		})
-		sc.TotalFileCount += sc.Sizes[len(sc.Sizes)-1].FileCount
-		sc.TotalFileSize += sc.Sizes[len(sc.Sizes)-1].FileSize
-	}
-	return sc, err
-}
 
 func (p4 *impl) Submit(cl int, options ...string) (string, error) {
 	cmd := []string{"submit"}
@@ -1149,21 +1163,7 @@ func (p4 *impl) Tickets(args ...string) ([]Ticket, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	var tickets []Ticket
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		words := strings.Split(line, " ")
-		if len(words) >= 3 {
-			tickets = append(tickets, Ticket{
-				Name: words[0],
-				User: words[1][1 : len(words[1])-1],
-				ID:   strings.TrimSpace(words[2]),
-			})
-		}
-	}
-
-	return tickets, nil
+	return parseTickets(out, p4.strict)
 }
 
 func (p4 *impl) Trust(args ...string) error {
@@ -1184,36 +1184,11 @@ func (p4 *impl) Unshelve(cl int, args ...string) (string, error) {
 
 // Users executes the P4 Users command and returns a list of users belonging to current perforce server
 func (p4 *impl) Users() ([]User, error) {
-	out, err := p4.ExecCmd("users")
+	out, err := p4.cachedCmd("users")
 	if err != nil {
 		return nil, err
 	}
-
-	var users []User
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		// formt of output line is:
-		// username <email@domain> (real name) accessed YYYY/MM/DD
-		words := strings.Split(line, " ")
-		if len(words) >= 5 {
-			u := words[0]
-			e := words[1]
-			n := words[2]
-			for i := 3; i < len(words)-2; i++ {
-				n += words[i]
-			}
-			d := words[len(words)-1]
-			user := User{
-				User:     u,
-				Email:    e,
-				Name:     n,
-				Accessed: d,
-			}
-			users = append(users, user)
-		}
-	}
-
-	return users, nil
+	return parseUsers(out, p4.strict)
 }
 
 func userClientBuild(combined string) UserClient {
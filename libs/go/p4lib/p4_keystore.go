@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyStoreRetries is how many times KeyStore.Update retries on concurrent modifications.
+const keyStoreRetries = 3
+
+// KeyCodec encodes and decodes the values of a KeyStore.
+type KeyCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// JSONCodec stores values as JSON. It's the default codec of key stores.
+var JSONCodec KeyCodec = jsonCodec{}
+
+// KeyMigration upgrades an encoded value from one schema version to the next.
+type KeyMigration func(data []byte) ([]byte, error)
+
+// KeyStoreOption configures a KeyStore.
+type KeyStoreOption func(*KeyStore)
+
+// WithKeyCodec sets the codec used to encode values.
+func WithKeyCodec(codec KeyCodec) KeyStoreOption {
+	return func(s *KeyStore) {
+		s.codec = codec
+	}
+}
+
+// WithSchemaVersion sets the schema version of the values written by the store. |migrations[i]|
+// upgrades values from version i to i+1, so there must be one migration per version below
+// |version|. Values written without a version are version 0.
+func WithSchemaVersion(version int, migrations ...KeyMigration) KeyStoreOption {
+	return func(s *KeyStore) {
+		s.version = version
+		s.migrations = migrations
+	}
+}
+
+// KeyStore stores typed values in p4 keys named "<namespace>-<name>".
+//
+// Values are prefixed with their schema version ("v2:{...}") unless the version is 0, so that
+// stores can start from values written by hand or by older code. Values with an older version are
+// migrated when read, and written back with the current version on the next update.
+type KeyStore struct {
+	p4         P4
+	namespace  string
+	codec      KeyCodec
+	version    int
+	migrations []KeyMigration
+}
+
+// NewKeyStore returns a store for keys in |namespace|.
+func NewKeyStore(p4 P4, namespace string, opts ...KeyStoreOption) *KeyStore {
+	s := &KeyStore{
+		p4:        p4,
+		namespace: namespace,
+		codec:     JSONCodec,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Key returns the p4 key holding the value |name|.
+func (s *KeyStore) Key(name string) string {
+	return s.namespace + "-" + name
+}
+
+// Get decodes the value |name| into |v|. Returns false if the key has no value, leaving |v| as is.
+func (s *KeyStore) Get(name string, v interface{}) (bool, error) {
+	_, found, err := s.get(name, v)
+	return found, err
+}
+
+// Set encodes |v| into the value |name|, overwriting it.
+func (s *KeyStore) Set(name string, v interface{}) error {
+	raw, err := s.encode(v)
+	if err != nil {
+		return fmt.Errorf("could not encode %s: %v", s.Key(name), err)
+	}
+	return s.p4.KeySet(s.Key(name), raw)
+}
+
+// Update reads the value |name| into |v|, which must be a pointer, calls |mutate| to change it and
+// writes it back. The write is a check-and-set: if someone else wrote the value in between, |v| is
+// reset to its zero value, read again and |mutate| called again. As with KeyCas, the first write of
+// a key can't be checked.
+func (s *KeyStore) Update(name string, v interface{}, mutate func() error) error {
+	key := s.Key(name)
+	for i := 0; i < keyStoreRetries; i++ {
+		if i > 0 {
+			elem := reflect.ValueOf(v).Elem()
+			elem.Set(reflect.Zero(elem.Type()))
+		}
+		orig, found, err := s.get(name, v)
+		if err != nil {
+			return err
+		}
+		if err := mutate(); err != nil {
+			return err
+		}
+		updated, err := s.encode(v)
+		if err != nil {
+			return fmt.Errorf("could not encode %s: %v", key, err)
+		}
+		if !found {
+			return s.p4.KeySet(key, updated)
+		}
+		if updated == orig {
+			return nil
+		}
+		err = s.p4.KeyCas(key, orig, updated)
+		if errors.Is(err, ErrCasMismatch) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("could not update %s after %d attempts: %w", key, keyStoreRetries, ErrCasMismatch)
+}
+
+// Names returns the names of all the values in the store, sorted.
+func (s *KeyStore) Names() ([]string, error) {
+	keys, err := s.p4.Keys(s.Key("*"))
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.Key("")
+	var names []string
+	for key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			names = append(names, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// get decodes the value |name| into |v| and returns its raw value.
+func (s *KeyStore) get(name string, v interface{}) (string, bool, error) {
+	key := s.Key(name)
+	raw, err := s.p4.KeyGet(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	// "0" is what p4 returns for keys without a value.
+	if raw == "0" {
+		return "", false, nil
+	}
+	if err := s.decode(raw, v); err != nil {
+		return "", false, fmt.Errorf("could not decode %s: %v", key, err)
+	}
+	return raw, true, nil
+}
+
+var versionRe = regexp.MustCompile(`^v(\d+):`)
+
+func (s *KeyStore) encode(v interface{}) (string, error) {
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	if s.version == 0 {
+		return string(data), nil
+	}
+	return fmt.Sprintf("v%d:%s", s.version, data), nil
+}
+
+func (s *KeyStore) decode(raw string, v interface{}) error {
+	version := 0
+	data := []byte(raw)
+	if m := versionRe.FindStringSubmatch(raw); m != nil {
+		var err error
+		if version, err = strconv.Atoi(m[1]); err != nil {
+			return err
+		}
+		data = data[len(m[0]):]
+	}
+	if version > s.version {
+		return fmt.Errorf("schema version %d is newer than %d", version, s.version)
+	}
+	for ; version < s.version; version++ {
+		if version >= len(s.migrations) || s.migrations[version] == nil {
+			return fmt.Errorf("no migration from schema version %d", version)
+		}
+		var err error
+		if data, err = s.migrations[version](data); err != nil {
+			return fmt.Errorf("could not migrate from schema version %d: %v", version, err)
+		}
+	}
+	return s.codec.Unmarshal(data, v)
+}
@@ -0,0 +1,417 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrLimitExceeded matches the errors of queries the server refused for exceeding one of its
+// limits, eg. maxresults or maxscanrows.
+var ErrLimitExceeded = errors.New("p4 server limit exceeded")
+
+// LimitError is a query refused by the server for exceeding one of its limits.
+type LimitError struct {
+	// Limit is the name of the limit, eg. "maxresults".
+	Limit string
+	// Value is the value of the limit for the user, 0 if unknown.
+	Value int
+	// Truncated is set when the query was split to fit the limit but some of its parts couldn't
+	// be: the results are missing the parts in Paths, or the oldest results when Paths is empty.
+	Truncated bool
+	Paths     []string
+	err       error
+}
+
+func (e *LimitError) Error() string {
+	msg := fmt.Sprintf("p4 server limit %s exceeded", e.Limit)
+	if e.Value != 0 {
+		msg = fmt.Sprintf("p4 server limit %s (%d) exceeded", e.Limit, e.Value)
+	}
+	if e.Truncated {
+		if len(e.Paths) > 0 {
+			msg += fmt.Sprintf(", results truncated: missing %s", strings.Join(e.Paths, " "))
+		} else {
+			msg += ", results truncated"
+		}
+	}
+	return fmt.Sprintf("%s: %v", msg, e.err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.err
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// limitRegex matches the messages of the server when it refuses a query, eg.
+// "Request too large (over 500000); see 'p4 help maxresults'." or
+// "Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'."
+var limitRegex = regexp.MustCompile(`\(over ([\d.]+)[^)]*\);\s*see 'p4 help (max\w+)'`)
+
+// asLimitError returns |err| as a LimitError if it, or the command |output| that came with it, is
+// the server refusing a query for exceeding a limit. Returns nil otherwise.
+func asLimitError(err error, output string) *LimitError {
+	if err == nil {
+		return nil
+	}
+	var lerr *LimitError
+	if errors.As(err, &lerr) {
+		return lerr
+	}
+	m := limitRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		m = limitRegex.FindStringSubmatch(output)
+	}
+	if m == nil {
+		return nil
+	}
+	value, _ := strconv.ParseFloat(m[1], 64)
+	return &LimitError{Limit: m[2], Value: int(value), err: err}
+}
+
+// Limits are the server-wide limits on queries, 0 when unlimited. Limits of the groups of a user
+// take precedence, and are reported by LimitError when exceeded.
+type Limits struct {
+	MaxResults   int
+	MaxScanRows  int
+	MaxLockTime  int
+	MaxOpenFiles int
+	MaxMemory    int
+}
+
+// parseLimits parses the output of "p4 configure show", lines like "maxresults=500000 (configure)".
+func parseLimits(out string) *Limits {
+	limits := &Limits{}
+	fields := map[string]*int{
+		"maxresults":   &limits.MaxResults,
+		"maxscanrows":  &limits.MaxScanRows,
+		"maxlocktime":  &limits.MaxLockTime,
+		"maxopenfiles": &limits.MaxOpenFiles,
+		"maxmemory":    &limits.MaxMemory,
+	}
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		field, ok := fields[strings.TrimSpace(line[:i])]
+		if !ok {
+			continue
+		}
+		value := strings.Fields(line[i+1:])
+		if len(value) == 0 {
+			continue
+		}
+		if v, err := strconv.Atoi(value[0]); err == nil {
+			*field = v
+		}
+	}
+	return limits
+}
+
+// Limits invokes "p4 configure show" and returns the server-wide limits on queries.
+func (p4 *impl) Limits() (*Limits, error) {
+	out, err := p4.ExecCmd("configure", "show")
+	if err != nil {
+		return nil, fmt.Errorf("p4 configure show: %w: %s", err, out)
+	}
+	return parseLimits(out), nil
+}
+
+// splitArgs separates the trailing depot paths of |args| from the flags before them.
+func splitArgs(args []string) (flags, paths []string) {
+	i := len(args)
+	for i > 0 && strings.HasPrefix(args[i-1], "//") {
+		i--
+	}
+	return args[:i:i], args[i:]
+}
+
+// splitPath splits a "//dir/...", with an optional revision, into the files of the directory and
+// each of its subdirectories listed by |dirs|. Returns nil if |path| is any other path.
+func splitPath(path string, dirs func(root string) ([]string, error)) ([]string, error) {
+	rev := ""
+	if i := strings.IndexAny(path, "@#"); i >= 0 {
+		path, rev = path[:i], path[i:]
+	}
+	dir := strings.TrimSuffix(path, "/...")
+	if dir == path || strings.Contains(dir, "...") || strings.Contains(dir, "*") {
+		return nil, nil
+	}
+	subdirs, err := dirs(dir + "/*")
+	if err != nil {
+		return nil, err
+	}
+	parts := []string{dir + "/*" + rev}
+	for _, sub := range subdirs {
+		parts = append(parts, sub+"/..."+rev)
+	}
+	return parts, nil
+}
+
+// SplitQuery runs |query| on |paths| and, when the server refuses it for exceeding one of its
+// limits, on smaller parts of |paths| until each part fits: lists of paths are halved, and a single
+// "//dir/..." path is split into the files of the directory and each of its subdirectories, listed
+// by |dirs|. |query| must only keep the results of the parts that succeed.
+//
+// Parts without files are ignored. Parts that can't be split any further are skipped and reported
+// by a truncated LimitError listing their paths; any other error stops the query.
+func SplitQuery(paths []string, query func(paths []string) error, dirs func(root string) ([]string, error)) error {
+	return splitQuery(paths, query, dirs, false)
+}
+
+func splitQuery(paths []string, query func(paths []string) error, dirs func(root string) ([]string, error), part bool) error {
+	err := query(paths)
+	if part && err != nil && (errors.Is(err, ErrFileNotFound) || strings.Contains(err.Error(), "no such file(s)")) {
+		return nil
+	}
+	lerr := asLimitError(err, "")
+	if lerr == nil {
+		return err
+	}
+	var parts [][]string
+	if len(paths) > 1 {
+		parts = [][]string{paths[:len(paths)/2], paths[len(paths)/2:]}
+	} else if len(paths) == 1 {
+		split, err := splitPath(paths[0], dirs)
+		if err != nil {
+			return fmt.Errorf("couldn't split %s: %w", paths[0], err)
+		}
+		// A directory without subdirectories is only split into its files, which doesn't help.
+		if len(split) > 1 {
+			parts = [][]string{split}
+		}
+	}
+	if len(parts) == 0 {
+		lerr.Truncated = true
+		lerr.Paths = append([]string(nil), paths...)
+		return lerr
+	}
+	var truncated *LimitError
+	for _, p := range parts {
+		err := splitQuery(p, query, dirs, true)
+		var perr *LimitError
+		if errors.As(err, &perr) && perr.Truncated {
+			if truncated == nil {
+				truncated = perr
+			} else {
+				truncated.Paths = append(truncated.Paths, perr.Paths...)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if truncated != nil {
+		return truncated
+	}
+	return nil
+}
+
+// Fstat invokes a "p4 fstat" which collects details about the specified file(s). Queries over the
+// limits of the server are split by SplitQuery.
+func (p4 *impl) Fstat(args ...string) (*FstatResult, error) {
+	fs := &FstatResult{}
+	err := p4.runCmdCb(fs, "fstat", args...)
+	if asLimitError(err, "") == nil {
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+	flags, paths := splitArgs(args)
+	fs = &FstatResult{}
+	err = SplitQuery(paths, func(paths []string) error {
+		part := &FstatResult{}
+		if err := p4.runCmdCb(part, "fstat", append(flags, paths...)...); err != nil {
+			return err
+		}
+		if fs.Desc == "" {
+			fs.Desc = part.Desc
+		}
+		fs.FileStats = append(fs.FileStats, part.FileStats...)
+		return nil
+	}, p4.Dirs)
+	return fs, err
+}
+
+// Files invokes "p4 files". Queries over the limits of the server are split by SplitQuery.
+func (p4 *impl) Files(files ...string) ([]FileDetails, error) {
+	cb := printcb{}
+	err := p4.runCmdCb(&cb, "files", files...)
+	if err != nil && strings.Contains(err.Error(), "no such file(s).") {
+		return cb, ErrFileNotFound
+	}
+	if asLimitError(err, "") == nil {
+		return cb, err
+	}
+	flags, paths := splitArgs(files)
+	var details []FileDetails
+	err = SplitQuery(paths, func(paths []string) error {
+		part := printcb{}
+		if err := p4.runCmdCb(&part, "files", append(flags, paths...)...); err != nil {
+			return err
+		}
+		details = append(details, part...)
+		return nil
+	}, p4.Dirs)
+	return details, err
+}
+
+// Sizes invokes "p4 sizes -s" on |dirs|. Directories over the limits of the server are split by
+// SplitQuery and their sizes summed.
+func (p4 *impl) Sizes(dirs ...string) (*SizeCollection, error) {
+	sc, err := p4.sizes(dirs...)
+	if asLimitError(err, "") == nil {
+		return sc, err
+	}
+	sc = &SizeCollection{}
+	var truncated *LimitError
+	for _, dir := range dirs {
+		size := Size{DepotPath: dir}
+		err := SplitQuery([]string{dir}, func(paths []string) error {
+			part, err := p4.sizes(paths...)
+			if err != nil {
+				return err
+			}
+			size.FileCount += part.TotalFileCount
+			size.FileSize += part.TotalFileSize
+			return nil
+		}, p4.Dirs)
+		var lerr *LimitError
+		if errors.As(err, &lerr) && lerr.Truncated {
+			if truncated == nil {
+				truncated = lerr
+			} else {
+				truncated.Paths = append(truncated.Paths, lerr.Paths...)
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		sc.Sizes = append(sc.Sizes, size)
+		sc.TotalFileCount += size.FileCount
+		sc.TotalFileSize += size.FileSize
+	}
+	if truncated != nil {
+		return sc, truncated
+	}
+	return sc, nil
+}
+
+func (p4 *impl) sizes(dirs ...string) (*SizeCollection, error) {
+	cmd := []string{"sizes", "-s"}
+	cmd = append(cmd, dirs...)
+	out, err := p4.ExecCmd(cmd...)
+	if lerr := asLimitError(err, out); lerr != nil {
+		return nil, lerr
+	}
+	sc, parseErr := parseSizes(out, p4.strict)
+	if err != nil {
+		return sc, err
+	}
+	return sc, parseErr
+}
+
+// Changes executes a p4 changes command and returns a slice of p4 change details. Queries over the
+// limits of the server are split by SplitQuery, and queries that can't be split return only the
+// latest changes that fit.
+func (p4 *impl) Changes(args ...string) ([]Change, error) {
+	cb := changecb{}
+	err := p4.runCmdCb(&cb, "changes", args...)
+	lerr := asLimitError(err, "")
+	if lerr == nil {
+		if err != nil {
+			return nil, err
+		}
+		return cb, nil
+	}
+	flags, paths := splitArgs(args)
+	max := 0
+	for i, flag := range flags {
+		if flag == "-m" && i+1 < len(flags) {
+			max, _ = strconv.Atoi(flags[i+1])
+		}
+	}
+	byCl := map[int]Change{}
+	query := func(flags, paths []string) error {
+		part := changecb{}
+		if err := p4.runCmdCb(&part, "changes", append(flags, paths...)...); err != nil {
+			return err
+		}
+		for _, change := range part {
+			byCl[change.Cl] = change
+		}
+		return nil
+	}
+	if len(paths) > 0 {
+		err = SplitQuery(paths, func(paths []string) error {
+			return query(flags, paths)
+		}, p4.Dirs)
+	} else {
+		err = p4.latestChanges(flags, max, lerr, query)
+	}
+	changes := make([]Change, 0, len(byCl))
+	for _, change := range byCl {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Cl > changes[j].Cl
+	})
+	if max > 0 && len(changes) > max {
+		changes = changes[:max]
+	}
+	return changes, err
+}
+
+// latestChanges runs |query| with |flags| asking for no more changes than the maxresults limit,
+// for queries that failed with |lerr| and can't be split. Returns a truncated LimitError if it
+// could run the query.
+func (p4 *impl) latestChanges(flags []string, max int, lerr *LimitError, query func(flags, paths []string) error) error {
+	limit := 0
+	if lerr.Limit == "maxresults" {
+		limit = lerr.Value
+	}
+	if limit == 0 {
+		if limits, err := p4.Limits(); err == nil {
+			limit = limits.MaxResults
+		}
+	}
+	if limit == 0 || (max != 0 && max <= limit) {
+		return lerr
+	}
+	var limited []string
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == "-m" {
+			i++
+			continue
+		}
+		limited = append(limited, flags[i])
+	}
+	limited = append(limited, "-m", strconv.Itoa(limit))
+	if err := query(limited, nil); err != nil {
+		return err
+	}
+	lerr.Truncated = true
+	return lerr
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Binary assets that can't be merged have the +l file type modifier: only one workspace at a time
+// can open them. The helpers below tell who holds such files instead of failing with the terse
+// errors of p4 edit.
+
+// ErrExclusivelyLocked matches the errors of files another workspace opened exclusively.
+var ErrExclusivelyLocked = errors.New("file exclusively opened by another workspace")
+
+// Polling intervals of EditWithLockWait. The interval doubles after each poll, up to the maximum.
+var (
+	lockPollInterval    = time.Second
+	maxLockPollInterval = 30 * time.Second
+)
+
+// LockedFile is a file another workspace opened exclusively.
+type LockedFile struct {
+	// Path is the path the file was asked for, local or depot.
+	Path      string `json:"path"`
+	DepotPath string `json:"depotPath"`
+	// User and Client hold the file, empty if unknown.
+	User   string `json:"user"`
+	Client string `json:"client"`
+}
+
+// Owner returns the "user@client" holding the file.
+func (f *LockedFile) Owner() string {
+	if f.User == "" {
+		return "another workspace"
+	}
+	return f.User + "@" + f.Client
+}
+
+// ExclusiveLockError lists files that can't be opened for edit because other workspaces opened
+// them exclusively.
+type ExclusiveLockError struct {
+	Files []LockedFile
+	err   error
+}
+
+func (e *ExclusiveLockError) Error() string {
+	var msgs []string
+	for _, f := range e.Files {
+		msgs = append(msgs, fmt.Sprintf("%s is exclusively opened by %s", f.DepotPath, f.Owner()))
+	}
+	msg := strings.Join(msgs, ", ")
+	if e.err != nil {
+		return fmt.Sprintf("%s: %v", msg, e.err)
+	}
+	return msg
+}
+
+func (e *ExclusiveLockError) Unwrap() error {
+	return e.err
+}
+
+func (e *ExclusiveLockError) Is(target error) bool {
+	return target == ErrExclusivelyLocked
+}
+
+// exclusiveRegex matches the messages of p4 edit for files another workspace opened exclusively,
+// eg. "//depot/Content/Hero.uasset - can't edit exclusive file already opened".
+var exclusiveRegex = regexp.MustCompile(`(?m)^(//\S+) - can't \w+ exclusive file already opened`)
+
+// asExclusiveLockError returns |err| as an ExclusiveLockError if it, or the command |output| that
+// came with it, reports files opened exclusively by another workspace. Returns nil otherwise.
+func asExclusiveLockError(err error, output string) *ExclusiveLockError {
+	if err == nil {
+		return nil
+	}
+	var lerr *ExclusiveLockError
+	if errors.As(err, &lerr) {
+		return lerr
+	}
+	ms := exclusiveRegex.FindAllStringSubmatch(err.Error()+"\n"+output, -1)
+	if ms == nil {
+		return nil
+	}
+	lerr = &ExclusiveLockError{err: err}
+	seen := map[string]bool{}
+	for _, m := range ms {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			lerr.Files = append(lerr.Files, LockedFile{Path: m[1], DepotPath: m[1]})
+		}
+	}
+	return lerr
+}
+
+// exclusive returns whether files of type |fileType|, eg. "binary+l", are opened exclusively.
+func exclusive(fileType string) bool {
+	i := strings.Index(fileType, "+")
+	return i >= 0 && strings.Contains(fileType[i+1:], "l")
+}
+
+// CheckLockable returns nil if the files at |paths|, local or depot, can be opened for edit, and an
+// *ExclusiveLockError listing the ones another workspace opened exclusively otherwise. Files not
+// in the depot can be opened.
+func CheckLockable(p4 P4, paths []string) error {
+	var locked []LockedFile
+	for _, p := range paths {
+		fs, err := p4.Fstat(p)
+		if err != nil {
+			if notInDepot(err) {
+				continue
+			}
+			return fmt.Errorf("could not fstat %s: %v", p, err)
+		}
+		for _, st := range fs.FileStats {
+			if f := lockedFile(p, &st); f != nil {
+				locked = append(locked, *f)
+			}
+		}
+	}
+	if len(locked) == 0 {
+		return nil
+	}
+	return &ExclusiveLockError{Files: locked}
+}
+
+// lockedFile returns the file of |st| as a LockedFile if another workspace opened it exclusively,
+// nil otherwise.
+func lockedFile(path string, st *FileStat) *LockedFile {
+	// Files opened in this workspace are ours to edit.
+	if st.Action != "" || !exclusive(st.HeadType) {
+		return nil
+	}
+	owner := st.OtherLockOwner
+	if len(st.OtherOpens) > 0 {
+		owner = st.OtherOpens[0]
+	}
+	if owner == "" {
+		return nil
+	}
+	f := &LockedFile{Path: path, DepotPath: st.DepotFile, User: owner}
+	if i := strings.Index(owner, "@"); i >= 0 {
+		f.User, f.Client = owner[:i], owner[i+1:]
+	}
+	return f
+}
+
+// EditWithLockWait opens the files at |paths| for edit in changelist |cl| like P4.Edit, waiting
+// for at most |timeout| for the files other workspaces opened exclusively to be released. The
+// files are polled with backoff, and |wait|, if not nil, is called with the files still held
+// before every wait. Returns an *ExclusiveLockError if files are still held after |timeout|.
+func EditWithLockWait(p4 P4, paths []string, cl int, timeout time.Duration, wait func(*ExclusiveLockError)) (string, error) {
+	deadline := time.Now().Add(timeout)
+	interval := lockPollInterval
+	for {
+		err := CheckLockable(p4, paths)
+		if err == nil {
+			out, editErr := p4.Edit(paths, cl)
+			if editErr == nil {
+				return out, nil
+			}
+			// Another workspace may have opened the files since they were checked.
+			lerr := asExclusiveLockError(editErr, out)
+			if lerr == nil {
+				return out, editErr
+			}
+			if err = CheckLockable(p4, paths); err == nil {
+				err = lerr
+			}
+		}
+		var lerr *ExclusiveLockError
+		if !errors.As(err, &lerr) {
+			return "", err
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return "", fmt.Errorf("still held after %v: %w", timeout, lerr)
+		}
+		if wait != nil {
+			wait(lerr)
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > maxLockPollInterval {
+			interval = maxLockPollInterval
+		}
+	}
+}
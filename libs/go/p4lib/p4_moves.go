@@ -0,0 +1,305 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HowMovedFrom is how "p4 filelog" reports the source of a move/add.
+const HowMovedFrom = "moved from"
+
+// FileSource is a revision range a file was moved or integrated from.
+type FileSource struct {
+	// How the file was created from the source, eg. "moved from", "branch from", "copy from",
+	// "merge from", "add from" (branch with edit) or "edit from" (integrate with edit).
+	How       string
+	DepotPath string
+	// StartRev and EndRev delimit the revisions of the source, 0 is #none.
+	StartRev int
+	EndRev   int
+}
+
+// MovedFileAction is a FileAction with the other half of its move, if any, and its integration
+// sources.
+type MovedFileAction struct {
+	FileAction
+
+	// For a move/add, MovedFrom is the depot path of the paired move/delete and MovedFromRev the
+	// revision that was moved.
+	MovedFrom    string
+	MovedFromRev int
+
+	// For a move/delete, MovedTo is the depot path of the paired move/add.
+	MovedTo string
+
+	// Sources are the integration sources of the file, eg. for branches, integrations, and adds and
+	// edits of integrated files.
+	Sources []FileSource
+}
+
+// MovesDescription is a Description with moves paired and integration sources annotated.
+type MovesDescription struct {
+	Description
+
+	// Actions has an entry for every file of the change, in the same order as Description.Files.
+	Actions []MovedFileAction
+}
+
+// DescribeWithMoves describes |cl|, pairing the move/add and move/delete records of every move and
+// annotating the sources of integrated files. The shelved files are described for pending changes
+// with shelved files.
+//
+// Sources are taken from "p4 filelog" for submitted changes and from "p4 fstat" for pending ones.
+// Moves without source information (eg. from an older server) are paired by file name.
+func (p4 *impl) DescribeWithMoves(cl int) (*MovesDescription, error) {
+	descs, err := p4.Describe([]int{cl})
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) != 1 {
+		return nil, fmt.Errorf("expected 1 description for %d, got %d", cl, len(descs))
+	}
+	desc := descs[0]
+	pending := desc.Status == "pending"
+	if pending && desc.Shelved {
+		descs, err = p4.DescribeShelved(cl)
+		if err != nil {
+			return nil, err
+		}
+		if len(descs) != 1 {
+			return nil, fmt.Errorf("expected 1 shelved description for %d, got %d", cl, len(descs))
+		}
+		desc = descs[0]
+	}
+
+	var sources map[string][]FileSource
+	if pending {
+		sources, err = p4.pendingSources(cl, desc.Shelved)
+	} else {
+		sources, err = p4.submittedSources(desc.Files)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get sources of %d: %v", cl, err)
+	}
+	return &MovesDescription{
+		Description: desc,
+		Actions:     PairMoves(desc.Files, sources, !pending),
+	}, nil
+}
+
+// hasSources returns whether perforce may report sources for a file with |action|.
+func hasSources(action string) bool {
+	switch action {
+	case "move/add", "branch", "integrate", "add", "delete":
+		return true
+	}
+	return false
+}
+
+// submittedSources returns the sources of the submitted |files|, by depot path.
+func (p4 *impl) submittedSources(files []FileAction) (map[string][]FileSource, error) {
+	var specs []string
+	for _, f := range files {
+		if hasSources(f.Action) {
+			specs = append(specs, AtRev(f.Revision).Of(f.DepotPath))
+		}
+	}
+	cb := filelogcb{}
+	if len(specs) == 0 {
+		return cb, nil
+	}
+	if err := p4.runCmdCb(&cb, "filelog", append([]string{"-m1"}, specs...)...); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// pendingSources returns the sources of the files opened, or shelved, in the pending change |cl|.
+func (p4 *impl) pendingSources(cl int, shelved bool) (map[string][]FileSource, error) {
+	args := []string{"-Or", "-e", strconv.Itoa(cl)}
+	if shelved {
+		args = append(args, "-Rs")
+	}
+	fs, err := p4.Fstat(append(args, "//...")...)
+	if err != nil {
+		return nil, err
+	}
+	return fstatSources(fs.FileStats), nil
+}
+
+// fstatSources returns the sources of the opened files in |stats|, by depot path.
+func fstatSources(stats []FileStat) map[string][]FileSource {
+	sources := map[string][]FileSource{}
+	for _, s := range stats {
+		if s.MovedFile != "" && s.Action == "move/add" {
+			sources[s.DepotFile] = append(sources[s.DepotFile], FileSource{
+				How:       HowMovedFrom,
+				DepotPath: s.MovedFile,
+				EndRev:    s.MovedRev,
+			})
+		}
+		for i, from := range s.ResolveFromFiles {
+			src := FileSource{How: resolveHow(s.ResolveActions, i), DepotPath: from}
+			if i < len(s.ResolveStartFromRevs) {
+				src.StartRev = s.ResolveStartFromRevs[i]
+			}
+			if i < len(s.ResolveEndFromRevs) {
+				src.EndRev = s.ResolveEndFromRevs[i]
+			}
+			sources[s.DepotFile] = append(sources[s.DepotFile], src)
+		}
+	}
+	return sources
+}
+
+func resolveHow(actions []string, i int) string {
+	if i < len(actions) {
+		return actions[i]
+	}
+	return "integrate from"
+}
+
+// filelogcb collects the integration records of the first revision of every file of a
+// "p4 filelog -m1", by depot path.
+type filelogcb map[string][]FileSource
+
+func (cb *filelogcb) outputStat(stats map[string]string) error {
+	depotFile, ok := stats["depotFile"]
+	if !ok {
+		return fmt.Errorf("missing 'depotFile' in %v", stats)
+	}
+	// Integration records of revision 0 are keyed "how0,<n>", "file0,<n>", etc.
+	for i := 0; ; i++ {
+		how, ok := stats[fmt.Sprintf("how0,%d", i)]
+		if !ok {
+			break
+		}
+		src := FileSource{
+			How:       how,
+			DepotPath: stats[fmt.Sprintf("file0,%d", i)],
+			StartRev:  parseFilelogRev(stats[fmt.Sprintf("srev0,%d", i)]),
+			EndRev:    parseFilelogRev(stats[fmt.Sprintf("erev0,%d", i)]),
+		}
+		(*cb)[depotFile] = append((*cb)[depotFile], src)
+	}
+	return nil
+}
+
+func (cb *filelogcb) tagProtocol() {}
+
+// parseFilelogRev parses a revision of "p4 filelog", eg. "#3" or "#none".
+func parseFilelogRev(rev string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(rev, "#"))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// PairMoves pairs the move/add and move/delete records of |files| and annotates them with their
+// integration |sources|, by depot path. |submitted| tells whether |files| are the files of a
+// submitted change, in which case their revisions are the ones created by the change.
+//
+// A move/add is paired with the move/delete its "moved from" source names. The remaining move/adds
+// are paired with the move/delete of the same file name when it's unique, and finally if a single
+// move/add and a single move/delete are left, they are paired together.
+func PairMoves(files []FileAction, sources map[string][]FileSource, submitted bool) []MovedFileAction {
+	actions := make([]MovedFileAction, len(files))
+	deletes := map[string]int{}
+	for i, f := range files {
+		actions[i].FileAction = f
+		for _, src := range sources[f.DepotPath] {
+			if src.How != HowMovedFrom {
+				actions[i].Sources = append(actions[i].Sources, src)
+			}
+		}
+		if f.Action == "move/delete" {
+			deletes[f.DepotPath] = i
+		}
+	}
+
+	pair := func(add, del int) {
+		from := &actions[del]
+		rev := from.Revision
+		if submitted {
+			// The move/delete created a new revision, the one moved is the previous one.
+			rev--
+		}
+		actions[add].MovedFrom = from.DepotPath
+		actions[add].MovedFromRev = rev
+		from.MovedTo = actions[add].DepotPath
+		delete(deletes, from.DepotPath)
+	}
+
+	// Pair moves by source.
+	var adds []int
+	for i := range actions {
+		if actions[i].Action != "move/add" {
+			continue
+		}
+		paired := false
+		for _, src := range sources[actions[i].DepotPath] {
+			if src.How != HowMovedFrom {
+				continue
+			}
+			if del, ok := deletes[src.DepotPath]; ok {
+				pair(i, del)
+				if src.EndRev != 0 {
+					actions[i].MovedFromRev = src.EndRev
+				}
+				paired = true
+				break
+			}
+		}
+		if !paired {
+			adds = append(adds, i)
+		}
+	}
+
+	// Pair the remaining moves by file name.
+	byName := func(indices []int) map[string][]int {
+		names := map[string][]int{}
+		for _, i := range indices {
+			name := path.Base(actions[i].DepotPath)
+			names[name] = append(names[name], i)
+		}
+		return names
+	}
+	var unpaired []int
+	for _, del := range deletes {
+		unpaired = append(unpaired, del)
+	}
+	sort.Ints(unpaired)
+	deleteNames := byName(unpaired)
+	var left []int
+	for name, is := range byName(adds) {
+		if len(is) == 1 && len(deleteNames[name]) == 1 {
+			pair(is[0], deleteNames[name][0])
+		} else {
+			left = append(left, is...)
+		}
+	}
+	if len(left) == 1 && len(deletes) == 1 {
+		for _, del := range deletes {
+			pair(left[0], del)
+		}
+	}
+	return actions
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFileLocked is returned when opening files that another user locked.
+var ErrFileLocked = errors.New("file locked by another user")
+
+// OpenState is the state of a workspace file, as far as writing to it is concerned.
+type OpenState struct {
+	// Path is the local path of the file.
+	Path string
+	// DepotPath is empty if the file isn't in the depot.
+	DepotPath string
+	// Action is the open action in this workspace, eg. "edit", empty if not opened.
+	Action string
+	// CL is the changelist the file is opened in, 0 for the default changelist.
+	CL int
+	// Writable is whether the local file is writable, or missing. Files opened in the workspace
+	// are writable, but so are files made writable behind the back of Perforce.
+	Writable bool
+	// OpenedBy are the "user@client" of other workspaces that have the file opened.
+	OpenedBy []string
+	// LockedBy is the "user@client" holding a lock on the file, if any.
+	LockedBy string
+}
+
+// Opened returns whether the file is opened in the workspace.
+func (s *OpenState) Opened() bool {
+	return s.Action != ""
+}
+
+// Advisory returns a warning to show before writing to the file, or "" if there is none. Perforce
+// doesn't stop several users from editing the same file, but it's worth knowing before editing
+// binary assets that can't be merged.
+func (s *OpenState) Advisory() string {
+	switch {
+	case s.LockedBy != "":
+		return fmt.Sprintf("%s is locked by %s", s.Path, s.LockedBy)
+	case len(s.OpenedBy) > 0:
+		return fmt.Sprintf("%s is also opened by %s", s.Path, strings.Join(s.OpenedBy, ", "))
+	case s.DepotPath != "" && !s.Opened() && s.Writable:
+		return fmt.Sprintf("%s is writable but not opened for edit", s.Path)
+	}
+	return ""
+}
+
+// FileOpener helps tools, like editors and build tools, write to workspace files, which are
+// read-only until opened for edit. Files are opened in a changelist managed by the opener, found
+// by its description so that it's reused across runs.
+//
+// Usage:
+//      o := p4lib.NewFileOpener(p4, "Files edited by the Unreal editor")
+//      states, err := o.Open(`C:\ws\game\Config\DefaultGame.ini`)
+type FileOpener struct {
+	p4   P4
+	desc string
+
+	mu sync.Mutex
+	cl int
+}
+
+// NewFileOpener returns an opener that opens files in the pending changelist with description
+// |desc|, creating it when needed.
+func NewFileOpener(p4 P4, desc string) *FileOpener {
+	return &FileOpener{p4: p4, desc: desc}
+}
+
+// Check returns the state of the files at local |paths|, in the same order.
+func (o *FileOpener) Check(paths ...string) ([]OpenState, error) {
+	states := make([]OpenState, 0, len(paths))
+	for _, p := range paths {
+		s, err := o.check(p)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, *s)
+	}
+	return states, nil
+}
+
+func (o *FileOpener) check(p string) (*OpenState, error) {
+	s := &OpenState{Path: p, Writable: writable(p)}
+	fs, err := o.p4.Fstat(p)
+	if err != nil {
+		if notInDepot(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("could not fstat %s: %v", p, err)
+	}
+	if len(fs.FileStats) == 0 {
+		return s, nil
+	}
+	st := fs.FileStats[0]
+	s.DepotPath = st.DepotFile
+	s.Action = st.Action
+	s.CL = st.Change
+	s.OpenedBy = st.OtherOpens
+	if st.OtherLock0 {
+		s.LockedBy = st.OtherLockOwner
+	}
+	return s, nil
+}
+
+// Open opens the files at local |paths| for edit in the managed changelist, unless they are
+// already opened or not in the depot. Files locked by another user make Open fail with
+// ErrFileLocked before opening anything, and files other workspaces opened exclusively with an
+// *ExclusiveLockError. Returns the state of the files after opening them.
+func (o *FileOpener) Open(paths ...string) ([]OpenState, error) {
+	states, err := o.Check(paths...)
+	if err != nil {
+		return nil, err
+	}
+	var toOpen []string
+	for _, s := range states {
+		if s.LockedBy != "" && !s.Opened() {
+			return nil, fmt.Errorf("%w: %s", ErrFileLocked, s.Advisory())
+		}
+		if s.DepotPath != "" && !s.Opened() {
+			toOpen = append(toOpen, s.Path)
+		}
+	}
+	if len(toOpen) == 0 {
+		return states, nil
+	}
+	cl, err := o.managedCL()
+	if err != nil {
+		return nil, err
+	}
+	if out, err := o.p4.Edit(toOpen, cl); err != nil {
+		if lerr := asExclusiveLockError(err, out); lerr != nil {
+			return nil, lerr
+		}
+		return nil, fmt.Errorf("could not open files for edit: %v: %s", err, out)
+	}
+	return o.Check(paths...)
+}
+
+// managedCL returns the managed changelist, finding or creating it when needed.
+func (o *FileOpener) managedCL() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	info, err := o.p4.Info()
+	if err != nil {
+		return 0, err
+	}
+	changes, err := o.p4.Changes("-l", "-s", "pending", "-c", info.Client)
+	if err != nil {
+		return 0, fmt.Errorf("could not get pending changelists of %s: %v", info.Client, err)
+	}
+	// The managed CL may have been submitted or deleted since it was last used.
+	for _, c := range changes {
+		if c.Cl == o.cl {
+			return o.cl, nil
+		}
+	}
+	for _, c := range changes {
+		if strings.TrimSpace(c.Description) == strings.TrimSpace(o.desc) {
+			o.cl = c.Cl
+			return o.cl, nil
+		}
+	}
+	if o.cl, err = o.p4.Change(o.desc); err != nil {
+		return 0, fmt.Errorf("could not create changelist: %v", err)
+	}
+	return o.cl, nil
+}
+
+// Watch polls the files at local |paths| every |interval| and sends their state every time one of
+// them becomes writable, eg. because another tool opened it for edit. The channel is closed when
+// |ctx| is done.
+func (o *FileOpener) Watch(ctx context.Context, interval time.Duration, paths ...string) <-chan OpenState {
+	ch := make(chan OpenState)
+	// Take the initial state before returning, so that changes made right after are noticed.
+	was := map[string]bool{}
+	for _, p := range paths {
+		was[p] = writable(p)
+	}
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, p := range paths {
+				now := writable(p)
+				if now == was[p] {
+					continue
+				}
+				was[p] = now
+				if !now {
+					continue
+				}
+				s, err := o.check(p)
+				if err != nil {
+					// Still report the file as writable, without the Perforce state.
+					s = &OpenState{Path: p, Writable: true}
+				}
+				select {
+				case ch <- *s:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// writable returns whether the local file at |p| can be written, ie. it's missing or not read-only.
+func writable(p string) bool {
+	info, err := os.Stat(p)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return info.Mode().Perm()&0200 != 0
+}
+
+func notInDepot(err error) bool {
+	if errors.Is(err, ErrFileNotFound) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "no such file(s)") || strings.Contains(msg, "not in client view") || strings.Contains(msg, "not under client's root")
+}
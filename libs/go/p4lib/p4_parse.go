@@ -0,0 +1,282 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Parsers of the text output of p4 commands. The output of these commands isn't structured, so
+// the parsers only understand the known line formats. By default they skip the lines they don't
+// understand, in strict mode they report them with an UnparsedError.
+// testdata/p4output holds real outputs of the commands, which tests parse in strict mode.
+
+// UnparsedLine is a line of output a parser didn't understand.
+type UnparsedLine struct {
+	// Line is the 1-based number of the line in the output.
+	Line int
+	Text string
+}
+
+// UnparsedError is returned in strict mode when the output of a command has lines the parser
+// doesn't understand, eg. because a new server version changed the output format.
+type UnparsedError struct {
+	Cmd   string
+	Lines []UnparsedLine
+}
+
+func (e *UnparsedError) Error() string {
+	return fmt.Sprintf("p4 %s: %d unparsed line(s), first at line %d: %q", e.Cmd, len(e.Lines), e.Lines[0].Line, e.Lines[0].Text)
+}
+
+// outputParser keeps track of the lines of the output of |cmd| that a parser skips.
+type outputParser struct {
+	cmd      string
+	strict   bool
+	unparsed []UnparsedLine
+}
+
+// lines returns the non-empty lines of |out| and their 1-based line numbers. Carriage returns are
+// dropped, as Windows clients print them.
+func (op *outputParser) lines(out string) ([]string, []int) {
+	var lines []string
+	var numbers []int
+	for i, line := range strings.Split(strings.ReplaceAll(out, "\r", ""), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+		numbers = append(numbers, i+1)
+	}
+	return lines, numbers
+}
+
+// skip records line |n| as not understood.
+func (op *outputParser) skip(n int, line string) {
+	if op.strict {
+		op.unparsed = append(op.unparsed, UnparsedLine{Line: n, Text: line})
+	}
+}
+
+// err returns an UnparsedError if lines were skipped in strict mode.
+func (op *outputParser) err() error {
+	if len(op.unparsed) == 0 {
+		return nil
+	}
+	return &UnparsedError{Cmd: op.cmd, Lines: op.unparsed}
+}
+
+// Line is "<DEPOT_PATH>#<REVISION> - <LOCAL_PATH>"
+var haveRegex = regexp.MustCompile(`^(.+)#(\d+) - (.+)`)
+
+// haveMessages are the messages of p4 have for patterns without synced files.
+var haveMessages = []string{
+	"file(s) not in client",
+	"file(s) not on client",
+	"no such file(s)",
+	"no file(s) at that changelist number",
+	"protected namespace - access denied",
+}
+
+// haveParse is parseHave in non-strict mode.
+func haveParse(have string) ([]File, error) {
+	return parseHave(have, false)
+}
+
+// parseHave only obtains the files in which Perforce returns a structured output for them
+// in the format "<DEPOT_PATH>#<REVISION> - <LOCAL_PATH>", which corresponds to a local file
+// correctly synced. Outside of that case, Perforce has a lot of different failure cases that expose
+// different output: file not found, file not in client, etc. Non conforming output equals to a
+// non-have, and in strict mode the known failure messages are accepted.
+func parseHave(have string, strict bool) ([]File, error) {
+	op := &outputParser{cmd: "have", strict: strict}
+	var files []File
+	lines, numbers := op.lines(have)
+	for i, line := range lines {
+		matches := haveRegex.FindStringSubmatch(line)
+		if matches == nil {
+			if !isMessage(line, haveMessages) {
+				op.skip(numbers[i], line)
+			}
+			continue
+		}
+		revision, err := strconv.Atoi(matches[2])
+		if err != nil {
+			return nil, fmt.Errorf("wrong revision at line %d (%s): %v", numbers[i], line, err)
+		}
+		local, err := filepath.Abs(matches[3])
+		if err != nil {
+			return nil, fmt.Errorf("wrong local path at line %d (%s): %v", numbers[i], line, err)
+		}
+		files = append(files, File{
+			DepotPath: matches[1],
+			Revision:  revision,
+			LocalPath: local,
+		})
+	}
+	return files, op.err()
+}
+
+// isMessage returns whether |line| is one of |messages|, possibly prefixed by the pattern it is
+// about, eg. "//depot/foo/... - file(s) not in client.". Messages are lowercase without the final
+// period, as their case and punctuation vary between server versions.
+func isMessage(line string, messages []string) bool {
+	line = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(line), "."))
+	for _, msg := range messages {
+		if line == msg || strings.HasSuffix(line, " - "+msg) {
+			return true
+		}
+	}
+	return false
+}
+
+var p4OpenedRe = regexp.MustCompile(`(//[^#]+)#[0-9]+ - (\S+) (\S+) (\S+) \((\S+)\)`)
+
+// openedMessages are the outputs of p4 opened when no file is opened.
+var openedMessages = []string{
+	"file(s) not opened on this client",
+	"file(s) not opened anywhere",
+}
+
+// parseOpened parses the output of p4 opened. File types are parsed without their modifiers, eg.
+// "text+k" is text. Unknown file types are FileTypeLen, in strict mode they are reported.
+func parseOpened(out string, strict bool) ([]OpenedFile, error) {
+	op := &outputParser{cmd: "opened", strict: strict}
+	var ret []OpenedFile
+	lines, numbers := op.lines(out)
+	for i, line := range lines {
+		m := p4OpenedRe.FindStringSubmatch(line)
+		if m == nil {
+			if !isMessage(line, openedMessages) {
+				op.skip(numbers[i], line)
+			}
+			continue
+		}
+		at, err := GetActionType(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("unhandled action type %s", line)
+		}
+		var cl int
+		switch m[3] {
+		case "change":
+			cl, err = strconv.Atoi(m[4])
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %s: %v", line, err)
+			}
+		case "default":
+			cl = 0
+		default:
+			return nil, fmt.Errorf("could not parse %s", line)
+		}
+		ft, err := GetFileType(strings.SplitN(m[5], "+", 2)[0])
+		if err != nil {
+			op.skip(numbers[i], line)
+		}
+		ret = append(ret, OpenedFile{
+			Path:   m[1],
+			Status: at,
+			CL:     cl,
+			Type:   ft,
+		})
+	}
+	return ret, op.err()
+}
+
+// Line is "<PATH> <COUNT> files <SIZE> bytes", followed by the deleted files with -a.
+var sizesRegex = regexp.MustCompile(`^(.+?) (\d+) files? (\d+) bytes?(?: .*)?$`)
+
+// parseSizes parses the output of p4 sizes -s.
+func parseSizes(out string, strict bool) (*SizeCollection, error) {
+	op := &outputParser{cmd: "sizes", strict: strict}
+	sc := &SizeCollection{}
+	lines, numbers := op.lines(out)
+	for i, line := range lines {
+		m := sizesRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			op.skip(numbers[i], line)
+			continue
+		}
+		fc, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			op.skip(numbers[i], line)
+			continue
+		}
+		fs, err := strconv.ParseUint(m[3], 10, 64)
+		if err != nil {
+			op.skip(numbers[i], line)
+			continue
+		}
+		sc.Sizes = append(sc.Sizes, Size{
+			DepotPath: m[1],
+			FileCount: fc,
+			FileSize:  fs,
+		})
+		sc.TotalFileCount += fc
+		sc.TotalFileSize += fs
+	}
+	return sc, op.err()
+}
+
+// Line is "<SERVER> (<USER>) <TICKET>".
+var ticketRegex = regexp.MustCompile(`^(\S+) \((\S*)\) (\S+)$`)
+
+// parseTickets parses the output of p4 tickets.
+func parseTickets(out string, strict bool) ([]Ticket, error) {
+	op := &outputParser{cmd: "tickets", strict: strict}
+	var tickets []Ticket
+	lines, numbers := op.lines(out)
+	for i, line := range lines {
+		m := ticketRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			op.skip(numbers[i], line)
+			continue
+		}
+		tickets = append(tickets, Ticket{
+			Name: m[1],
+			User: m[2],
+			ID:   m[3],
+		})
+	}
+	return tickets, op.err()
+}
+
+// Line is "<USER> <<EMAIL>> (<FULL NAME>) accessed <DATE>".
+var userRegex = regexp.MustCompile(`^(\S+) <([^>]*)> \((.*)\) accessed (\S+)$`)
+
+// parseUsers parses the output of p4 users. Emails are returned without their angle brackets and
+// full names without their parentheses.
+func parseUsers(out string, strict bool) ([]User, error) {
+	op := &outputParser{cmd: "users", strict: strict}
+	var users []User
+	lines, numbers := op.lines(out)
+	for i, line := range lines {
+		m := userRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			op.skip(numbers[i], line)
+			continue
+		}
+		users = append(users, User{
+			User:     m[1],
+			Email:    m[2],
+			Name:     m[3],
+			Accessed: m[4],
+		})
+	}
+	return users, op.err()
+}
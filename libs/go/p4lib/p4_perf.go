@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerPerf is the performance data the server reports about a command when run with -Ztrack:
+// the time the command took on the server and the time it waited for and held the locks of the
+// db tables. It tells a slow command from a slow or contended server.
+type ServerPerf struct {
+	// Command is the p4 command the data is about, eg. "sync".
+	Command string
+	// Lapse is the time the server spent on the command.
+	Lapse time.Duration
+	// The total times spent waiting for and holding the locks of all the tables.
+	ReadLockWait  time.Duration
+	ReadLockHeld  time.Duration
+	WriteLockWait time.Duration
+	WriteLockHeld time.Duration
+	// Tables are the db tables used by the command, in the order the server reported them.
+	Tables []TablePerf
+}
+
+// LockWait returns the total time the command waited for locks.
+func (sp *ServerPerf) LockWait() time.Duration {
+	return sp.ReadLockWait + sp.WriteLockWait
+}
+
+// LockHeld returns the total time the command held locks.
+func (sp *ServerPerf) LockHeld() time.Duration {
+	return sp.ReadLockHeld + sp.WriteLockHeld
+}
+
+// TablePerf is the use of a db table by a command, eg. "db.rev".
+type TablePerf struct {
+	Name        string
+	PagesIn     int
+	PagesOut    int
+	PagesCached int
+	ReadLocks   int
+	WriteLocks  int
+	// The times spent waiting for and holding the locks of the table.
+	ReadLockWait  time.Duration
+	ReadLockHeld  time.Duration
+	WriteLockWait time.Duration
+	WriteLockHeld time.Duration
+}
+
+// WithServerPerf returns a P4 that runs commands with -Ztrack, adds the performance data the
+// server reports to Stats and calls |handler|, if not nil, with it, eg. to attach it to traces.
+// The data is removed from the output of commands, so that parsers don't see it. If the provided
+// interface doesn't support it, it is returned unchanged. Commands run through the p4 API, eg.
+// fstat and print, don't report performance data.
+func WithServerPerf(p4 P4, handler func(ServerPerf)) P4 {
+	if parent, ok := p4.(*impl); ok {
+		child := *parent
+		child.trackPerf = true
+		child.onServerPerf = handler
+		return &child
+	}
+	return p4
+}
+
+const trackPrefix = "--- "
+
+var (
+	trackLapseRegex = regexp.MustCompile(`^lapse (\S+)$`)
+	trackPagesRegex = regexp.MustCompile(`^pages in\+out\+cached (\d+)\+(\d+)\+(\d+)$`)
+	trackLocksRegex = regexp.MustCompile(`^locks read/write (\d+)/(\d+)`)
+	trackTotalRegex = regexp.MustCompile(`^total lock wait\+held read/write (\S+)\+(\S+)/(\S+)\+(\S+)$`)
+)
+
+// splitServerPerf parses the -Ztrack data at the end of the |output| of |cmd| and returns it along
+// with the output without it. Returns nil and the output as is if it has no -Ztrack data.
+func splitServerPerf(cmd, output string) (*ServerPerf, string) {
+	lines := strings.SplitAfter(output, "\n")
+	// The data is the trailing block of lines with the track prefix, starting with the lapse.
+	start := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimRight(lines[i], "\r\n")
+		if line == "" && i == len(lines)-1 {
+			continue
+		}
+		if !strings.HasPrefix(line, trackPrefix) {
+			break
+		}
+		if strings.HasPrefix(line, trackPrefix+"lapse ") {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil, output
+	}
+	perf := &ServerPerf{Command: cmd}
+	var table *TablePerf
+	for _, line := range lines[start:] {
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, trackPrefix) {
+			continue
+		}
+		line = strings.TrimPrefix(line, trackPrefix)
+		// Table stats are indented under the name of the table.
+		indented := strings.HasPrefix(line, " ")
+		line = strings.TrimSpace(line)
+		if !indented {
+			table = nil
+			if strings.HasPrefix(line, "db.") {
+				perf.Tables = append(perf.Tables, TablePerf{Name: line})
+				table = &perf.Tables[len(perf.Tables)-1]
+			} else if m := trackLapseRegex.FindStringSubmatch(line); m != nil {
+				perf.Lapse = parseTrackDuration(m[1])
+			}
+			continue
+		}
+		if table == nil {
+			continue
+		}
+		if m := trackPagesRegex.FindStringSubmatch(line); m != nil {
+			table.PagesIn, _ = strconv.Atoi(m[1])
+			table.PagesOut, _ = strconv.Atoi(m[2])
+			table.PagesCached, _ = strconv.Atoi(m[3])
+		} else if m := trackLocksRegex.FindStringSubmatch(line); m != nil {
+			table.ReadLocks, _ = strconv.Atoi(m[1])
+			table.WriteLocks, _ = strconv.Atoi(m[2])
+		} else if m := trackTotalRegex.FindStringSubmatch(line); m != nil {
+			table.ReadLockWait = parseTrackDuration(m[1])
+			table.ReadLockHeld = parseTrackDuration(m[2])
+			table.WriteLockWait = parseTrackDuration(m[3])
+			table.WriteLockHeld = parseTrackDuration(m[4])
+			perf.ReadLockWait += table.ReadLockWait
+			perf.ReadLockHeld += table.ReadLockHeld
+			perf.WriteLockWait += table.WriteLockWait
+			perf.WriteLockHeld += table.WriteLockHeld
+		}
+	}
+	return perf, strings.Join(lines[:start], "")
+}
+
+// parseTrackDuration parses a -Ztrack duration, eg. ".042s" or "5ms". Returns 0 if it's invalid.
+func parseTrackDuration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// updateServerStats adds |perf| to the Stats of its command.
+func updateServerStats(perf *ServerPerf) {
+	lockStats.Lock()
+	defer lockStats.Unlock()
+
+	stat, ok := Stats[perf.Command]
+	if !ok {
+		stat.MinUs = math.MaxInt64
+	}
+	stat.Tracked++
+	stat.Server.Command = perf.Command
+	stat.Server.Lapse += perf.Lapse
+	stat.Server.ReadLockWait += perf.ReadLockWait
+	stat.Server.ReadLockHeld += perf.ReadLockHeld
+	stat.Server.WriteLockWait += perf.WriteLockWait
+	stat.Server.WriteLockHeld += perf.WriteLockHeld
+	Stats[perf.Command] = stat
+}
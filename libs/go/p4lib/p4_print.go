@@ -85,11 +85,15 @@ func (p4 *impl) PrintEx(files ...string) ([]FileDetails, error) {
 	return cb, err
 }
 
-func (p4 *impl) Files(files ...string) ([]FileDetails, error) {
-	cb := printcb{}
-	err := p4.runCmdCb(&cb, "files", files...)
-	if err != nil && strings.Contains(err.Error(), "no such file(s).") {
-		return cb, ErrFileNotFound
+func (p4 *impl) PrintText(opts PrintOptions, files ...string) ([]FileDetails, error) {
+	details, err := p4.PrintEx(files...)
+	if err != nil {
+		return details, err
 	}
-	return cb, err
+	for i := range details {
+		if err := decodeText(&details[i], opts); err != nil {
+			return nil, err
+		}
+	}
+	return details, nil
 }
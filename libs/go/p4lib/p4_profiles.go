@@ -0,0 +1,359 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ViewProfile is a named template of client view mappings, eg. "code" or "code+editor", so that
+// users can pick a curated subset of the depot rather than write their own view.
+type ViewProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Include are the names of profiles whose mappings come before the ones of this profile.
+	Include []string `json:"include,omitempty"`
+	// View are mappings "<depot path> [<path relative to the client root>]", eg.
+	// "//depot/game/Source/... game/Source/...". Without a client path, the depot path without its
+	// leading "//" is used. Depot paths can start with "-" or "+" as in client views.
+	View []string `json:"view,omitempty"`
+}
+
+// ViewProfiles is a set of view profiles, usually stored in a JSON file in the depot:
+//
+//      {"profiles": [
+//        {"name": "code", "view": ["//depot/game/Source/... game/Source/..."]},
+//        {"name": "editor", "include": ["code"], "view": ["//depot/game/Content/... game/Content/..."]}
+//      ]}
+//
+// Mappings of a client that aren't in any profile are personal mappings. Applying a profile
+// replaces the mappings of profiles and keeps the personal ones after them, so they still win
+// over the profile. Mappings dropped from the profiles file become personal mappings of the
+// clients that had them.
+type ViewProfiles struct {
+	Profiles []ViewProfile `json:"profiles"`
+}
+
+// ProfileChange is the change of a client view to a profile.
+type ProfileChange struct {
+	Client  string
+	Profile string
+	// From is the profile the client currently matches, empty if none.
+	From string
+	// View is the new view of the client.
+	View []ViewEntry
+	// Added and Removed are the mappings added to and removed from the view.
+	Added   []ViewEntry
+	Removed []ViewEntry
+	// FileDelta and SizeDelta are the estimated files and bytes that syncing the new view adds,
+	// negative if it removes more than it adds. Mappings are sized independently, so files
+	// mapped by several added or removed mappings are counted several times.
+	FileDelta int64
+	SizeDelta int64
+}
+
+// ParseViewProfiles parses a JSON profiles file. Profile names must be unique and included
+// profiles must exist, without cycles.
+func ParseViewProfiles(data []byte) (*ViewProfiles, error) {
+	var ps ViewProfiles
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, fmt.Errorf("could not parse view profiles: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, p := range ps.Profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("view profile without a name")
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("duplicate view profile %q", p.Name)
+		}
+		seen[p.Name] = true
+		for _, m := range p.View {
+			if _, err := profileMapping(m, "client"); err != nil {
+				return nil, fmt.Errorf("view profile %q: %v", p.Name, err)
+			}
+		}
+	}
+	for _, p := range ps.Profiles {
+		if _, err := ps.View(p.Name, "client"); err != nil {
+			return nil, err
+		}
+	}
+	return &ps, nil
+}
+
+// LoadViewProfiles reads the profiles file at |depotPath|.
+func LoadViewProfiles(p4 P4, depotPath string) (*ViewProfiles, error) {
+	data, err := p4.Print("-q", depotPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not print %s: %v", depotPath, err)
+	}
+	return ParseViewProfiles([]byte(data))
+}
+
+func (ps *ViewProfiles) find(name string) (*ViewProfile, bool) {
+	for i := range ps.Profiles {
+		if ps.Profiles[i].Name == name {
+			return &ps.Profiles[i], true
+		}
+	}
+	return nil, false
+}
+
+// View returns the mappings of profile |name| for client |client|, included profiles first.
+// Mappings included several times are only kept the first time.
+func (ps *ViewProfiles) View(name, client string) ([]ViewEntry, error) {
+	var view []ViewEntry
+	seen := map[ViewEntry]bool{}
+	var add func(name string, stack []string) error
+	add = func(name string, stack []string) error {
+		for _, s := range stack {
+			if s == name {
+				return fmt.Errorf("view profile %q includes itself: %s", name, strings.Join(append(stack, name), " -> "))
+			}
+		}
+		p, ok := ps.find(name)
+		if !ok {
+			return fmt.Errorf("unknown view profile %q", name)
+		}
+		stack = append(stack, name)
+		for _, inc := range p.Include {
+			if err := add(inc, stack); err != nil {
+				return err
+			}
+		}
+		for _, m := range p.View {
+			e, err := profileMapping(m, client)
+			if err != nil {
+				return fmt.Errorf("view profile %q: %v", name, err)
+			}
+			if !seen[e] {
+				seen[e] = true
+				view = append(view, e)
+			}
+		}
+		return nil
+	}
+	if err := add(name, nil); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// profileMapping expands a profile mapping to a view entry of |client|.
+func profileMapping(m, client string) (ViewEntry, error) {
+	fields := strings.Fields(m)
+	if len(fields) == 0 || len(fields) > 2 {
+		return ViewEntry{}, fmt.Errorf("invalid mapping %q, want \"<depot path> [<client path>]\"", m)
+	}
+	src := fields[0]
+	depot := strings.TrimLeft(src, "-+")
+	if !strings.HasPrefix(depot, "//") {
+		return ViewEntry{}, fmt.Errorf("invalid mapping %q, depot path must start with //", m)
+	}
+	dst := strings.TrimPrefix(depot, "//")
+	if len(fields) == 2 {
+		dst = strings.TrimPrefix(fields[1], "/")
+	}
+	return ViewEntry{Source: src, Destination: "//" + client + "/" + dst}, nil
+}
+
+// managed returns all the mappings of all profiles for |client|.
+func (ps *ViewProfiles) managed(client string) (map[ViewEntry]bool, error) {
+	managed := map[ViewEntry]bool{}
+	for _, p := range ps.Profiles {
+		for _, m := range p.View {
+			e, err := profileMapping(m, client)
+			if err != nil {
+				return nil, err
+			}
+			managed[e] = true
+		}
+	}
+	return managed, nil
+}
+
+// Current returns the profile that |client| matches, the one with the most mappings among the
+// profiles whose mappings are all in the view of the client. Returns "" if there is none.
+func (ps *ViewProfiles) Current(client *Client) string {
+	inView := map[ViewEntry]bool{}
+	for _, e := range client.View {
+		inView[e] = true
+	}
+	best, bestLen := "", 0
+	for _, p := range ps.Profiles {
+		view, err := ps.View(p.Name, client.Client)
+		if err != nil || len(view) <= bestLen {
+			continue
+		}
+		all := true
+		for _, e := range view {
+			all = all && inView[e]
+		}
+		if all {
+			best, bestLen = p.Name, len(view)
+		}
+	}
+	return best
+}
+
+// Merge returns the view of |client| with profile |name|: the mappings of the profile followed by
+// the personal mappings of the client.
+func (ps *ViewProfiles) Merge(client *Client, name string) ([]ViewEntry, error) {
+	view, err := ps.View(name, client.Client)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := ps.managed(client.Client)
+	if err != nil {
+		return nil, err
+	}
+	inView := map[ViewEntry]bool{}
+	for _, e := range view {
+		inView[e] = true
+	}
+	for _, e := range client.View {
+		if managed[e] || inView[e] {
+			continue
+		}
+		inView[e] = true
+		view = append(view, e)
+	}
+	return view, nil
+}
+
+// PlanProfile computes the change of client |clientName| to profile |name| without applying it,
+// including the estimated sync size delta. The current client is used if |clientName| is empty.
+func (ps *ViewProfiles) PlanProfile(p4 P4, clientName, name string) (*ProfileChange, error) {
+	client, err := p4.Client(clientName)
+	if err != nil {
+		return nil, err
+	}
+	change, err := ps.plan(client, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := sizeProfileChange(p4, change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+func (ps *ViewProfiles) plan(client *Client, name string) (*ProfileChange, error) {
+	if client.Stream != "" {
+		return nil, fmt.Errorf("client %s is a stream client, its view comes from stream %s", client.Client, client.Stream)
+	}
+	view, err := ps.Merge(client, name)
+	if err != nil {
+		return nil, err
+	}
+	change := &ProfileChange{
+		Client:  client.Client,
+		Profile: name,
+		From:    ps.Current(client),
+		View:    view,
+	}
+	oldView := map[ViewEntry]bool{}
+	for _, e := range client.View {
+		oldView[e] = true
+	}
+	newView := map[ViewEntry]bool{}
+	for _, e := range view {
+		newView[e] = true
+		if !oldView[e] {
+			change.Added = append(change.Added, e)
+		}
+	}
+	for _, e := range client.View {
+		if !newView[e] {
+			change.Removed = append(change.Removed, e)
+		}
+	}
+	return change, nil
+}
+
+// sizeProfileChange estimates the sync delta of the change from the sizes of the depot paths of
+// the added and removed mappings. Exclusions count against their mapping.
+func sizeProfileChange(p4 P4, change *ProfileChange) error {
+	sign := map[string]int64{}
+	for _, e := range change.Added {
+		sign[strings.TrimLeft(e.Source, "-+")] += mappingSign(e)
+	}
+	for _, e := range change.Removed {
+		sign[strings.TrimLeft(e.Source, "-+")] -= mappingSign(e)
+	}
+	var paths []string
+	for p, s := range sign {
+		if s != 0 {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+	sc, err := p4.Sizes(paths...)
+	if err != nil {
+		return fmt.Errorf("could not size the view change: %v", err)
+	}
+	for _, s := range sc.Sizes {
+		change.FileDelta += sign[s.DepotPath] * int64(s.FileCount)
+		change.SizeDelta += sign[s.DepotPath] * int64(s.FileSize)
+	}
+	return nil
+}
+
+func mappingSign(e ViewEntry) int64 {
+	if strings.HasPrefix(e.Source, "-") {
+		return -1
+	}
+	return 1
+}
+
+// ApplyProfile switches client |clientName| to profile |name|, the current client if empty. The
+// view is replaced in a single client update. If |sync| is set the client is then synced, which
+// needs |p4| to use that client; if the sync fails the previous view is restored, and the files
+// already synced are brought back in line by the next sync.
+func (ps *ViewProfiles) ApplyProfile(p4 P4, clientName, name string, sync bool) (*ProfileChange, error) {
+	client, err := p4.Client(clientName)
+	if err != nil {
+		return nil, err
+	}
+	change, err := ps.plan(client, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 && !sync {
+		return change, nil
+	}
+	updated := *client
+	updated.View = change.View
+	if out, err := p4.ClientSet(&updated); err != nil {
+		return nil, fmt.Errorf("could not update client %s: %v: %s", client.Client, err, out)
+	}
+	if !sync {
+		return change, nil
+	}
+	if _, err := p4.Sync([]string{"//" + client.Client + "/..."}); err != nil {
+		if out, rerr := p4.ClientSet(client); rerr != nil {
+			return nil, fmt.Errorf("could not sync client %s: %v; could not restore its view either: %v: %s", client.Client, err, rerr, out)
+		}
+		return nil, fmt.Errorf("could not sync client %s, its previous view was restored: %v", client.Client, err)
+	}
+	return change, nil
+}
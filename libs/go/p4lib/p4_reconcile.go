@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReconcileCandidate is a file that "p4 reconcile" would open.
+type ReconcileCandidate struct {
+	// Action is one of ActionAdd, ActionEdit, ActionDelete, ActionMoveAdd or ActionMoveDelete.
+	Action    ActionType
+	DepotPath string
+	LocalPath string
+	// Revision is the revision of the file in the workspace, 0 for adds.
+	Revision int
+	Type     string
+
+	// For a move/add, MovedFrom is the depot path of the paired move/delete.
+	MovedFrom string
+	// For a move/delete, MovedTo is the depot path of the paired move/add.
+	MovedTo string
+}
+
+// Reconciliation is the result of previewing "p4 reconcile".
+type Reconciliation struct {
+	Candidates []ReconcileCandidate
+}
+
+// Filter returns the candidates with any of the |actions|.
+func (r *Reconciliation) Filter(actions ...ActionType) []ReconcileCandidate {
+	var ret []ReconcileCandidate
+	for _, c := range r.Candidates {
+		for _, a := range actions {
+			if c.Action == a {
+				ret = append(ret, c)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// Paths returns the local paths to pass to Reconcile to apply only the candidates for which
+// |selected| returns true. Moves are applied whole: selecting either half of a move selects both.
+func (r *Reconciliation) Paths(selected func(ReconcileCandidate) bool) []string {
+	byDepot := map[string]ReconcileCandidate{}
+	for _, c := range r.Candidates {
+		byDepot[c.DepotPath] = c
+	}
+	seen := map[string]bool{}
+	var paths []string
+	add := func(c ReconcileCandidate) {
+		if !seen[c.LocalPath] {
+			seen[c.LocalPath] = true
+			paths = append(paths, c.LocalPath)
+		}
+	}
+	for _, c := range r.Candidates {
+		if !selected(c) {
+			continue
+		}
+		add(c)
+		for _, other := range []string{c.MovedFrom, c.MovedTo} {
+			if o, ok := byDepot[other]; ok && other != "" {
+				add(o)
+			}
+		}
+	}
+	return paths
+}
+
+// ReconcilePreview previews "p4 reconcile -m" on |paths|, without opening any file. Renames are
+// detected and returned as paired move/add and move/delete candidates.
+func (p4 *impl) ReconcilePreview(paths []string) (*Reconciliation, error) {
+	cb := reconcilecb{}
+	args := append([]string{"-n", "-m"}, paths...)
+	if err := p4.runCmdCb(&cb, "reconcile", args...); err != nil {
+		if strings.Contains(err.Error(), "no file(s) to reconcile") {
+			return &Reconciliation{}, nil
+		}
+		return nil, err
+	}
+	return cb.reconciliation()
+}
+
+// reconcilecb collects the tagged output of "p4 reconcile -n".
+type reconcilecb []map[string]string
+
+func (cb *reconcilecb) outputStat(stats map[string]string) error {
+	if _, ok := stats["depotFile"]; !ok {
+		return fmt.Errorf("missing 'depotFile' in %v", stats)
+	}
+	*cb = append(*cb, stats)
+	return nil
+}
+
+func (cb *reconcilecb) outputInfo(level int, info string) error {
+	return nil
+}
+
+func (cb *reconcilecb) tagProtocol() {}
+
+func (cb reconcilecb) reconciliation() (*Reconciliation, error) {
+	r := &Reconciliation{}
+	var moves []FileAction
+	sources := map[string][]FileSource{}
+	moveIndex := map[string]int{}
+	for _, stats := range cb {
+		action, err := GetActionType(stats["action"])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected action for %s: %v", stats["depotFile"], err)
+		}
+		c := ReconcileCandidate{
+			Action:    action,
+			DepotPath: stats["depotFile"],
+			LocalPath: stats["clientFile"],
+			Type:      stats["type"],
+		}
+		if rev, ok := stats["workRev"]; ok {
+			if c.Revision, err = strconv.Atoi(rev); err != nil {
+				return nil, fmt.Errorf("could not parse workRev of %s: %v", c.DepotPath, err)
+			}
+		}
+		if action == ActionMoveAdd || action == ActionMoveDelete {
+			moveIndex[c.DepotPath] = len(r.Candidates)
+			moves = append(moves, FileAction{DepotPath: c.DepotPath, Action: stats["action"], Revision: c.Revision})
+			// Newer servers name the other half of the move.
+			if from := stats["movedFile"]; from != "" && action == ActionMoveAdd {
+				sources[c.DepotPath] = []FileSource{{How: HowMovedFrom, DepotPath: from}}
+			}
+		}
+		r.Candidates = append(r.Candidates, c)
+	}
+	for _, m := range PairMoves(moves, sources, false) {
+		c := &r.Candidates[moveIndex[m.DepotPath]]
+		c.MovedFrom = m.MovedFrom
+		c.MovedTo = m.MovedTo
+	}
+	return r, nil
+}
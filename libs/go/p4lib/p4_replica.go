@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"time"
+)
+
+// Commands may be served by a replica of the commit server, eg. when P4PORT points to a forwarding
+// replica or an edge server. Replicas lag behind the commit server, so a change submitted moments
+// ago may not be visible there yet. The helpers below are for reads that can't be stale.
+
+// ErrNotReplicated is returned by WaitForChange when the change didn't show up in time.
+var ErrNotReplicated = fmt.Errorf("change not replicated")
+
+// Polling intervals of WaitForChange. The interval doubles after each poll, up to the maximum.
+var (
+	replicaPollInterval    = 250 * time.Millisecond
+	maxReplicaPollInterval = 5 * time.Second
+)
+
+// WithCommitServer returns a P4 that knows the commit server is at |port|, eg. "ssl:commit:1666",
+// while the other commands go to the server of P4PORT. Commands |cmds|, eg. "describe" or "key",
+// always run against the commit server, and CommitServer returns a P4 running all of them there.
+// An empty |port| means P4PORT is the commit server. If the provided interface doesn't support it,
+// it is returned unchanged.
+func WithCommitServer(p4 P4, port string, cmds ...string) P4 {
+	if parent, ok := p4.(*impl); ok {
+		child := *parent
+		child.commitPort = port
+		child.commitCmds = map[string]bool{}
+		for _, cmd := range cmds {
+			child.commitCmds[cmd] = true
+		}
+		return &child
+	}
+	return p4
+}
+
+// CommitServer returns a P4 running all its commands against the commit server set with
+// WithCommitServer, for reads that must see the latest submits. Returns |p4| unchanged if no commit
+// server was set, in which case P4PORT is the commit server.
+func CommitServer(p4 P4) P4 {
+	if parent, ok := p4.(*impl); ok && parent.commitPort != "" {
+		child := *parent
+		child.port = parent.commitPort
+		return &child
+	}
+	return p4
+}
+
+// serverPort returns the port command |cmd| runs against, empty for the one of P4PORT.
+func (p4 *impl) serverPort(cmd string) string {
+	if p4.commitCmds[cmd] {
+		return p4.commitPort
+	}
+	return p4.port
+}
+
+// WaitForChange polls |p4| until change |cl| is submitted there, for at most |timeout|. It lets
+// CI steps running against a replica wait for the change they were triggered by before acting on
+// it. Returns an error wrapping ErrNotReplicated if the change isn't visible in time.
+func WaitForChange(p4 P4, cl int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	interval := replicaPollInterval
+	var lastErr error
+	for {
+		descs, err := p4.Describe([]int{cl})
+		switch {
+		case err != nil:
+			// Replicas don't know about changes they haven't seen yet.
+			lastErr = err
+		case len(descs) != 1:
+			lastErr = fmt.Errorf("%d changes described", len(descs))
+		case descs[0].Status != "submitted":
+			lastErr = fmt.Errorf("change is %s", descs[0].Status)
+		default:
+			return nil
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return fmt.Errorf("change %d after %v: %w (%v)", cl, timeout, ErrNotReplicated, lastErr)
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > maxReplicaPollInterval {
+			interval = maxReplicaPollInterval
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RevSpec is a perforce revision specifier, the part of a file spec that follows the path, eg. the
+// "@123" in "//depot/foo@123". The zero value specifies no revision, which most commands interpret
+// as the head revision.
+//
+// Usage:
+//      content, err := p4.PrintAt("//depot/foo.txt", p4lib.AtChange(123))
+//      files, err := p4.FilesAt(p4lib.AtHave(), "//depot/...")
+//      spec := p4lib.AtShelvedChange(456).Of("//depot/foo.txt") // "//depot/foo.txt@=456"
+type RevSpec struct {
+	spec    string
+	isRange bool
+}
+
+// AtChange specifies the revision as of a submitted change, "@<cl>".
+func AtChange(cl int) RevSpec {
+	return RevSpec{spec: "@" + strconv.Itoa(cl)}
+}
+
+// AtShelvedChange specifies the revision shelved in a pending change, "@=<cl>".
+func AtShelvedChange(cl int) RevSpec {
+	return RevSpec{spec: "@=" + strconv.Itoa(cl)}
+}
+
+// AtRev specifies a file revision number, "#<rev>".
+func AtRev(rev int) RevSpec {
+	return RevSpec{spec: "#" + strconv.Itoa(rev)}
+}
+
+// AtHave specifies the revision synced to the workspace, "#have".
+func AtHave() RevSpec {
+	return RevSpec{spec: "#have"}
+}
+
+// AtHead specifies the head revision, "#head".
+func AtHead() RevSpec {
+	return RevSpec{spec: "#head"}
+}
+
+// AtNone specifies the nonexistent revision, "#none".
+func AtNone() RevSpec {
+	return RevSpec{spec: "#none"}
+}
+
+// AtDate specifies the revision as of a date, "@yyyy/mm/dd:hh:mm:ss". The date is formatted in the
+// location of |t|, while perforce interprets it in the time zone of the server.
+func AtDate(t time.Time) RevSpec {
+	return RevSpec{spec: "@" + t.Format("2006/01/02:15:04:05")}
+}
+
+// AtLabel specifies the revision tagged by a label, "@<label>". Fails if |label| is not a valid
+// label name.
+func AtLabel(label string) (RevSpec, error) {
+	if label == "" {
+		return RevSpec{}, fmt.Errorf("empty label")
+	}
+	if _, err := strconv.Atoi(label); err == nil {
+		return RevSpec{}, fmt.Errorf("label %q cannot be purely numeric", label)
+	}
+	if strings.ContainsAny(label, "@#%*,/ \t\n") || strings.Contains(label, "...") {
+		return RevSpec{}, fmt.Errorf("label %q contains invalid characters", label)
+	}
+	return RevSpec{spec: "@" + label}, nil
+}
+
+// Range specifies all the revisions from |from| to |to|, eg. "@100,@200". Fails if either end is
+// empty or is itself a range.
+func Range(from, to RevSpec) (RevSpec, error) {
+	if from.spec == "" || to.spec == "" {
+		return RevSpec{}, fmt.Errorf("range ends must not be empty")
+	}
+	if from.isRange || to.isRange {
+		return RevSpec{}, fmt.Errorf("range ends must not be ranges")
+	}
+	return RevSpec{spec: from.spec + "," + to.spec, isRange: true}, nil
+}
+
+// String returns the revision specifier as used by perforce, eg. "@123".
+func (r RevSpec) String() string {
+	return r.spec
+}
+
+// Of returns the file spec of |path| at this revision. Any '@' or '#' in |path| is escaped so that
+// perforce doesn't take it as part of the revision specifier. '%' is not escaped, so paths already
+// escaped by perforce (eg. depot paths from "p4 fstat") can be used as is. Wildcards are kept.
+func (r RevSpec) Of(path string) string {
+	return escapePath(path) + r.spec
+}
+
+// OfAll returns the file specs of |paths| at this revision.
+func (r RevSpec) OfAll(paths []string) []string {
+	specs := make([]string, 0, len(paths))
+	for _, p := range paths {
+		specs = append(specs, r.Of(p))
+	}
+	return specs
+}
+
+var pathEscaper = strings.NewReplacer("@", "%40", "#", "%23")
+
+// escapePath escapes the characters perforce reserves for revision specifiers.
+func escapePath(path string) string {
+	return pathEscaper.Replace(path)
+}
+
+// PrintAt returns the contents of the file at |path| at revision |rev|.
+func (p4 *impl) PrintAt(path string, rev RevSpec) (string, error) {
+	return p4.Print("-q", rev.Of(path))
+}
+
+// Diff2At diffs the file at |file0| at revision |rev0| against |file1| at revision |rev1|.
+func (p4 *impl) Diff2At(file0 string, rev0 RevSpec, file1 string, rev1 RevSpec) ([]Diff, error) {
+	return p4.Diff2(rev0.Of(file0), rev1.Of(file1))
+}
+
+// FilesAt returns the details of the files matching |paths| at revision |rev|.
+func (p4 *impl) FilesAt(rev RevSpec, paths ...string) ([]FileDetails, error) {
+	return p4.Files(rev.OfAll(paths)...)
+}
+
+// FstatAt returns the stats of the files matching |paths| at revision |rev|.
+func (p4 *impl) FstatAt(rev RevSpec, paths ...string) (*FstatResult, error) {
+	return p4.Fstat(rev.OfAll(paths)...)
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RiskKind is a risky condition of a file in a pending change.
+type RiskKind string
+
+const (
+	// RiskLockedByOther is a file locked by another workspace. The change can't be submitted.
+	RiskLockedByOther RiskKind = "locked"
+	// RiskOpenedElsewhere is a file also opened in other workspaces, which may submit first.
+	RiskOpenedElsewhere RiskKind = "opened-elsewhere"
+	// RiskNeedsResolve is a file with pending resolves, or opened at a revision older than head.
+	// The change can't be submitted before resolving it.
+	RiskNeedsResolve RiskKind = "needs-resolve"
+	// RiskExclusive is a file of an exclusive checkout type (+l), which can't be merged.
+	RiskExclusive RiskKind = "exclusive"
+)
+
+// Blocking returns whether the condition prevents submitting the change.
+func (k RiskKind) Blocking() bool {
+	return k == RiskLockedByOther || k == RiskNeedsResolve
+}
+
+// FileRisk is a risky condition of a file.
+type FileRisk struct {
+	DepotFile string   `json:"depotFile"`
+	Kind      RiskKind `json:"kind"`
+	// Users are the "user@client" of the other workspaces involved, if any.
+	Users []string `json:"users,omitempty"`
+	// Detail is a human readable explanation.
+	Detail string `json:"detail"`
+}
+
+// ChangeRisk summarizes the risky conditions of the files of a pending change.
+type ChangeRisk struct {
+	Cl    int `json:"cl"`
+	Files int `json:"files"`
+	// Risks are sorted by depot file, a file can have several.
+	Risks []FileRisk `json:"risks"`
+}
+
+// Count returns the number of risks of kind |kind|.
+func (r *ChangeRisk) Count(kind RiskKind) int {
+	n := 0
+	for _, risk := range r.Risks {
+		if risk.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Blocking returns whether any risk prevents submitting the change.
+func (r *ChangeRisk) Blocking() bool {
+	for _, risk := range r.Risks {
+		if risk.Kind.Blocking() {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary returns a one line summary, eg. "2 files locked, 1 file opened elsewhere", or "" if
+// there are no risks.
+func (r *ChangeRisk) Summary() string {
+	var parts []string
+	for _, k := range []struct {
+		kind RiskKind
+		text string
+	}{
+		{RiskLockedByOther, "locked"},
+		{RiskNeedsResolve, "needing resolve"},
+		{RiskOpenedElsewhere, "opened elsewhere"},
+		{RiskExclusive, "of exclusive type"},
+	} {
+		switch n := r.Count(k.kind); n {
+		case 0:
+		case 1:
+			parts = append(parts, "1 file "+k.text)
+		default:
+			parts = append(parts, fmt.Sprintf("%d files %s", n, k.text))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// IsExclusiveType returns whether the file type |t| has the exclusive checkout modifier, eg.
+// "binary+l" or "ubinary+Fl".
+func IsExclusiveType(t string) bool {
+	i := strings.Index(t, "+")
+	return i >= 0 && strings.Contains(t[i+1:], "l")
+}
+
+// ChangeRisk fstats the files of the pending change |cl| and summarizes their risky conditions.
+// The files of a change without opened files are taken from its shelf. Pending resolves are only
+// known for changes of the current workspace; for others, files opened at an older revision than
+// head are reported as needing resolve.
+func (p4 *impl) ChangeRisk(cl int) (*ChangeRisk, error) {
+	return changeRisk(p4, cl)
+}
+
+func changeRisk(p4 P4, cl int) (*ChangeRisk, error) {
+	descs, err := p4.Describe([]int{cl})
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) != 1 {
+		return nil, fmt.Errorf("expected 1 description for %d, got %d", cl, len(descs))
+	}
+	desc := descs[0]
+	if desc.Status != "pending" {
+		return nil, fmt.Errorf("change %d is not pending", cl)
+	}
+	if len(desc.Files) == 0 && desc.Shelved {
+		shelved, err := p4.DescribeShelved(cl)
+		if err != nil {
+			return nil, err
+		}
+		if len(shelved) == 1 {
+			desc.Files = shelved[0].Files
+		}
+	}
+	report := &ChangeRisk{Cl: cl, Files: len(desc.Files)}
+	if len(desc.Files) == 0 {
+		return report, nil
+	}
+	opened := map[string]FileAction{}
+	var paths []string
+	for _, f := range desc.Files {
+		opened[f.DepotPath] = f
+		paths = append(paths, f.DepotPath)
+	}
+	fs, err := p4.Fstat(append([]string{"-Or"}, paths...)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not fstat files of %d: %v", cl, err)
+	}
+	owner := desc.User + "@" + desc.Client
+	for _, st := range fs.FileStats {
+		f, ok := opened[st.DepotFile]
+		if !ok {
+			continue
+		}
+		report.Risks = append(report.Risks, fileRisks(&st, &f, cl, owner)...)
+	}
+	sort.SliceStable(report.Risks, func(i, j int) bool {
+		return report.Risks[i].DepotFile < report.Risks[j].DepotFile
+	})
+	return report, nil
+}
+
+// fileRisks returns the risks of file |f| of change |cl| owned by |owner|, with fstat |st|.
+func fileRisks(st *FileStat, f *FileAction, cl int, owner string) []FileRisk {
+	var risks []FileRisk
+	if st.OtherLock0 && st.OtherLockOwner != owner {
+		risks = append(risks, FileRisk{
+			DepotFile: st.DepotFile,
+			Kind:      RiskLockedByOther,
+			Users:     []string{st.OtherLockOwner},
+			Detail:    fmt.Sprintf("locked by %s", st.OtherLockOwner),
+		})
+	}
+	// The workspace of the change is reported as an "other" open unless it's the current one.
+	var others []string
+	for i, o := range st.OtherOpens {
+		if o == owner || (i < len(st.OtherChanges) && st.OtherChanges[i] == cl) {
+			continue
+		}
+		others = append(others, o)
+	}
+	if len(others) > 0 {
+		risks = append(risks, FileRisk{
+			DepotFile: st.DepotFile,
+			Kind:      RiskOpenedElsewhere,
+			Users:     others,
+			Detail:    fmt.Sprintf("also opened by %s", strings.Join(others, ", ")),
+		})
+	}
+	switch {
+	case st.Unresolved > 0:
+		risks = append(risks, FileRisk{
+			DepotFile: st.DepotFile,
+			Kind:      RiskNeedsResolve,
+			Detail:    fmt.Sprintf("%d unresolved integration(s)", st.Unresolved),
+		})
+	case f.Revision > 0 && f.Revision < st.HeadRev && st.HeadAction != "delete":
+		risks = append(risks, FileRisk{
+			DepotFile: st.DepotFile,
+			Kind:      RiskNeedsResolve,
+			Detail:    fmt.Sprintf("opened at #%d, head is #%d", f.Revision, st.HeadRev),
+		})
+	}
+	fileType := f.Type
+	if fileType == "" {
+		fileType = st.HeadType
+	}
+	if IsExclusiveType(fileType) {
+		risks = append(risks, FileRisk{
+			DepotFile: st.DepotFile,
+			Kind:      RiskExclusive,
+			Detail:    fmt.Sprintf("exclusive checkout type %s", fileType),
+		})
+	}
+	return risks
+}
@@ -0,0 +1,387 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ContentStoreOption configures a ContentStore.
+type ContentStoreOption func(*ContentStore)
+
+// WithCompression gzips the content written to the store. Reads decompress it transparently.
+func WithCompression() ContentStoreOption {
+	return func(s *ContentStore) {
+		s.compress = true
+	}
+}
+
+// ContentStore keeps file contents on disk, addressed by the SHA-256 digest of the content.
+//
+// Identical contents are stored once: batch-printing many revisions of a review usually fetches
+// the same content several times (unchanged revisions, branched files), and only the first copy
+// hits the disk. Contents are hashed as they stream in and only written when the store doesn't
+// have them yet, through a temp file renamed into place so that a store can be shared by several
+// processes.
+type ContentStore struct {
+	dir      string
+	compress bool
+
+	mu    sync.Mutex
+	stats ContentStoreStats
+}
+
+// ContentStoreStats counts what was written to a ContentStore by this process.
+type ContentStoreStats struct {
+	Files   int   // contents written, including duplicates
+	Deduped int   // contents already in the store
+	Bytes   int64 // uncompressed size of the contents written
+	Stored  int64 // bytes added to the disk
+}
+
+// NewContentStore returns a store keeping its contents under |dir|, which is created if needed.
+func NewContentStore(dir string, opts ...ContentStoreOption) (*ContentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create content store: %v", err)
+	}
+	s := &ContentStore{dir: dir}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Dir returns the directory of the store.
+func (s *ContentStore) Dir() string {
+	return s.dir
+}
+
+// Stats returns the counters of the store.
+func (s *ContentStore) Stats() ContentStoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// path returns the path of the content with |digest|. Compressed and plain contents are kept apart
+// so that stores with different options can share a directory.
+func (s *ContentStore) path(digest string) string {
+	if s.compress {
+		return filepath.Join(s.dir, digest+".gz")
+	}
+	return filepath.Join(s.dir, digest)
+}
+
+// Put writes the content read from |r| to the store and returns its digest.
+func (s *ContentStore) Put(r io.Reader) (string, error) {
+	w := s.create()
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort()
+		return "", fmt.Errorf("could not write content: %v", err)
+	}
+	return w.commit()
+}
+
+// Open returns a reader of the content with |digest|, decompressed if needed.
+func (s *ContentStore) Open(digest string) (io.ReadCloser, error) {
+	if !validDigest(digest) {
+		return nil, fmt.Errorf("invalid content digest %q", digest)
+	}
+	f, err := os.Open(s.path(digest))
+	if err != nil {
+		return nil, err
+	}
+	if !s.compress {
+		return f, nil
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read content %s: %v", digest, err)
+	}
+	return &gzipReadCloser{Reader: z, file: f}, nil
+}
+
+// Get returns the content with |digest|.
+func (s *ContentStore) Get(digest string) ([]byte, error) {
+	r, err := s.Open(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Has returns whether the store has the content with |digest|.
+func (s *ContentStore) Has(digest string) bool {
+	if !validDigest(digest) {
+		return false
+	}
+	_, err := os.Stat(s.path(digest))
+	return err == nil
+}
+
+// RemoveAll deletes the store and its contents.
+func (s *ContentStore) RemoveAll() error {
+	return os.RemoveAll(s.dir)
+}
+
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil && strings.ToLower(digest) == digest
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipReadCloser) Close() error {
+	err := r.Reader.Close()
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// spillSize is how much of a content is kept in memory before it's streamed to a temp file.
+// Smaller contents are hashed before touching the disk, and aren't written at all when the store
+// already has them.
+const spillSize = 1 << 20
+
+// contentWriter streams one content to the store, hashing it on the way. The content is buffered
+// until it reaches spillSize, then written to a temp file of the store.
+type contentWriter struct {
+	store *ContentStore
+	hash  hash.Hash
+	size  int64
+	buf   bytes.Buffer
+	file  *os.File // temp file of the content, once spilled
+	z     *gzip.Writer
+	w     io.Writer // writes to file, compressing if needed
+}
+
+func (s *ContentStore) create() *contentWriter {
+	return &contentWriter{store: s, hash: sha256.New()}
+}
+
+func (cw *contentWriter) Write(data []byte) (int, error) {
+	cw.hash.Write(data)
+	cw.size += int64(len(data))
+	if cw.file != nil {
+		return cw.w.Write(data)
+	}
+	cw.buf.Write(data)
+	if cw.buf.Len() >= spillSize {
+		if err := cw.spill(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// spill moves the buffered content to a temp file of the store, where the rest of it goes.
+func (cw *contentWriter) spill() error {
+	f, err := ioutil.TempFile(cw.store.dir, ".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create content: %v", err)
+	}
+	cw.file = f
+	cw.w = f
+	if cw.store.compress {
+		cw.z = gzip.NewWriter(f)
+		cw.w = cw.z
+	}
+	_, err = cw.w.Write(cw.buf.Bytes())
+	cw.buf = bytes.Buffer{}
+	return err
+}
+
+// abort drops the content written so far.
+func (cw *contentWriter) abort() {
+	cw.buf = bytes.Buffer{}
+	if cw.file != nil {
+		cw.file.Close()
+		os.Remove(cw.file.Name())
+	}
+}
+
+// commit moves the content into the store, unless the store already has it, and returns its
+// digest.
+func (cw *contentWriter) commit() (string, error) {
+	digest := hex.EncodeToString(cw.hash.Sum(nil))
+	s := cw.store
+	dst := s.path(digest)
+	_, err := os.Stat(dst)
+	deduped := err == nil
+	if !deduped && cw.file == nil {
+		if err := cw.spill(); err != nil {
+			cw.abort()
+			return "", err
+		}
+	}
+	var stored int64
+	if cw.file != nil {
+		if cw.z != nil {
+			if err := cw.z.Close(); err != nil {
+				cw.abort()
+				return "", fmt.Errorf("could not compress content: %v", err)
+			}
+		}
+		info, err := cw.file.Stat()
+		if err == nil {
+			err = cw.file.Close()
+		}
+		if err != nil {
+			cw.abort()
+			return "", fmt.Errorf("could not write content: %v", err)
+		}
+		if deduped {
+			os.Remove(cw.file.Name())
+		} else if err := os.Rename(cw.file.Name(), dst); err != nil {
+			os.Remove(cw.file.Name())
+			return "", fmt.Errorf("could not store content %s: %v", digest, err)
+		} else {
+			stored = info.Size()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Files++
+	s.stats.Bytes += cw.size
+	if deduped {
+		s.stats.Deduped++
+	}
+	s.stats.Stored += stored
+	return digest, nil
+}
+
+// storecb is the callback handler of PrintToStore. It streams the content of each file to the store
+// instead of keeping it in memory.
+type storecb struct {
+	store   *ContentStore
+	details []FileDetails
+	pending *contentWriter
+	err     error
+}
+
+// flush commits the content of the last file.
+func (cb *storecb) flush() error {
+	if cb.pending == nil {
+		return nil
+	}
+	size := cb.pending.size
+	digest, err := cb.pending.commit()
+	cb.pending = nil
+	if err != nil {
+		return err
+	}
+	d := &cb.details[len(cb.details)-1]
+	d.ContentDigest = digest
+	d.FileSize = int(size)
+	return nil
+}
+
+func (cb *storecb) outputStat(stats map[string]string) error {
+	if err := cb.flush(); err != nil {
+		cb.err = err
+		return err
+	}
+	pc := printcb(cb.details)
+	if err := pc.outputStat(stats); err != nil {
+		return err
+	}
+	cb.details = pc
+	cb.pending = cb.store.create()
+	return nil
+}
+
+func (cb *storecb) outputBinary(data []byte) error {
+	if cb.pending == nil {
+		return fmt.Errorf("expected stats before payload")
+	}
+	if _, err := cb.pending.Write(data); err != nil {
+		cb.err = fmt.Errorf("could not write content: %v", err)
+		return cb.err
+	}
+	return nil
+}
+
+func (cb *storecb) outputText(data string) error {
+	return cb.outputBinary([]byte(data))
+}
+
+// onRetry abandons the partial results. Contents already committed stay in the store, the retry
+// dedupes them.
+func (cb *storecb) onRetry(context, err string) {
+	if cb.pending != nil {
+		cb.pending.abort()
+		cb.pending = nil
+	}
+	cb.details = nil
+	cb.err = nil
+}
+
+func (cb *storecb) tagProtocol() {}
+
+// PrintToStore is PrintEx writing the contents of the files to |store| rather than to memory. The
+// returned details have their ContentDigest and FileSize set instead of their Content.
+func (p4 *impl) PrintToStore(store *ContentStore, files ...string) ([]FileDetails, error) {
+	cb := storecb{store: store}
+	err := p4.runCmdCb(&cb, "print", files...)
+	if cb.err != nil {
+		err = cb.err
+	}
+	notFound := err != nil && strings.Contains(err.Error(), "no such file(s).")
+	if err != nil && !notFound {
+		if cb.pending != nil {
+			cb.pending.abort()
+		}
+		return nil, err
+	}
+	if err := cb.flush(); err != nil {
+		return nil, err
+	}
+	if notFound {
+		return cb.details, ErrFileNotFound
+	}
+	return cb.details, nil
+}
+
+// ReadContent returns the content of |d|, from |store| if it was printed by PrintToStore.
+func ReadContent(store *ContentStore, d *FileDetails) ([]byte, error) {
+	if d.ContentDigest == "" {
+		return d.Content, nil
+	}
+	data, err := store.Get(d.ContentDigest)
+	if err != nil {
+		return nil, fmt.Errorf("could not read content of %s#%d: %v", d.DepotFile, d.Rev, err)
+	}
+	return data, nil
+}
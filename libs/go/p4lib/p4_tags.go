@@ -0,0 +1,296 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Keys of the tags of the CL description conventions.
+const (
+	// TagBug lists the bugs a CL is about, eg. "BUG=b/1234, 5678".
+	TagBug = "BUG"
+	// TagFix lists the bugs a CL fixes, written like TagBug.
+	TagFix = "FIX"
+	// TagTested tells how a CL was tested, eg. "TESTED=unit tests".
+	TagTested = "TESTED"
+	// TagNoPresubmit asks to skip the presubmit and gives why, eg. "NO_PRESUBMIT=rollback of cl/12".
+	TagNoPresubmit = "NO_PRESUBMIT"
+	// TagTest tells how a CL was tested, eg. "Test: ran the game".
+	TagTest = "Test"
+	// TagReviewedBy names a reviewer who approved a CL, eg. "Reviewed-by: alice".
+	TagReviewedBy = "Reviewed-by"
+)
+
+// TagSpec describes a tag of the CL description conventions.
+type TagSpec struct {
+	Key string
+	// Colon tags are written "Key: value", other tags "KEY=value". Colon tags are only recognized
+	// in the trailing tag block of a description, as "Key: value" lines are common in text.
+	Colon bool
+	// Indented tags are also recognized after leading whitespace, with whitespace around the "=".
+	Indented bool
+	// Validate returns an error if the non-empty value of the tag is invalid. Optional. Empty
+	// values, eg. of tags left blank from a description template, are valid.
+	Validate func(value string) error
+}
+
+func (s *TagSpec) render(value string) string {
+	if s.Colon {
+		return fmt.Sprintf("%s: %s", s.Key, value)
+	}
+	return fmt.Sprintf("%s=%s", s.Key, value)
+}
+
+func (s *TagSpec) regexp() *regexp.Regexp {
+	key := regexp.QuoteMeta(s.Key)
+	switch {
+	case s.Colon:
+		return regexp.MustCompile(`^` + key + `:(.*)$`)
+	case s.Indented:
+		return regexp.MustCompile(`^\s*` + key + `\s*=(.*)$`)
+	default:
+		return regexp.MustCompile(`^` + key + `=(.*)$`)
+	}
+}
+
+func validateBugs(value string) error {
+	_, err := ParseBugs(value)
+	return err
+}
+
+// TagSpecs are the tags recognized in CL descriptions.
+var TagSpecs = []*TagSpec{
+	{Key: TagBug, Validate: validateBugs},
+	{Key: TagFix, Validate: validateBugs},
+	{Key: TagTested},
+	{Key: TagNoPresubmit, Indented: true},
+	{Key: TagTest, Colon: true},
+	{Key: TagReviewedBy, Colon: true},
+}
+
+var tagRegexps = func() map[*TagSpec]*regexp.Regexp {
+	ret := map[*TagSpec]*regexp.Regexp{}
+	for _, s := range TagSpecs {
+		ret[s] = s.regexp()
+	}
+	return ret
+}()
+
+// FindTagSpec returns the spec of the tag with |key|.
+func FindTagSpec(key string) (*TagSpec, bool) {
+	for _, s := range TagSpecs {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Tag is a tag found in a CL description.
+type Tag struct {
+	// Key is the key of the tag as in its TagSpec.
+	Key   string
+	Value string
+}
+
+// TaggedDescription is a CL description split into its text and its tags.
+type TaggedDescription struct {
+	// Text is the description without the tag lines.
+	Text string
+	// Tags are in the order they appear in the description.
+	Tags []Tag
+}
+
+// ParseTaggedDescription splits |desc| into its text and the tags of TagSpecs. Tags are whole
+// lines, conventionally at the end. "KEY=value" tags may appear anywhere, while "Key: value" tags
+// are only recognized in the trailing tag block: the last paragraph, when all its lines are tags.
+func ParseTaggedDescription(desc string) *TaggedDescription {
+	lines := strings.Split(desc, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	block := trailingBlock(lines)
+	td := &TaggedDescription{}
+	var text []string
+	for i, line := range lines {
+		if tag, ok := parseTag(line, i >= block); ok {
+			td.Tags = append(td.Tags, tag)
+			continue
+		}
+		text = append(text, line)
+	}
+	td.Text = strings.TrimSpace(strings.Join(text, "\n"))
+	return td
+}
+
+// trailingBlock returns the index of the first line of the trailing tag block of |lines|, or
+// len(lines) if it has none.
+func trailingBlock(lines []string) int {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	start := end
+	for start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+		start--
+	}
+	for _, line := range lines[start:end] {
+		if _, ok := parseTag(line, true); !ok {
+			return len(lines)
+		}
+	}
+	return start
+}
+
+// parseTag parses a tag line. Colon tags are only parsed when |colon| is set.
+func parseTag(line string, colon bool) (Tag, bool) {
+	for _, s := range TagSpecs {
+		if s.Colon && !colon {
+			continue
+		}
+		if m := tagRegexps[s].FindStringSubmatch(line); m != nil {
+			return Tag{Key: s.Key, Value: strings.TrimSpace(m[1])}, true
+		}
+	}
+	return Tag{}, false
+}
+
+// Get returns the values of the tags with |key|.
+func (td *TaggedDescription) Get(key string) []string {
+	var values []string
+	for _, t := range td.Tags {
+		if t.Key == key {
+			values = append(values, t.Value)
+		}
+	}
+	return values
+}
+
+// First returns the value of the first tag with |key|.
+func (td *TaggedDescription) First(key string) (string, bool) {
+	for _, t := range td.Tags {
+		if t.Key == key {
+			return t.Value, true
+		}
+	}
+	return "", false
+}
+
+// Add appends a tag.
+func (td *TaggedDescription) Add(key, value string) {
+	td.Tags = append(td.Tags, Tag{Key: key, Value: value})
+}
+
+// Set replaces the tags with |key| by a single tag, appended if there was none.
+func (td *TaggedDescription) Set(key, value string) {
+	var tags []Tag
+	set := false
+	for _, t := range td.Tags {
+		if t.Key != key {
+			tags = append(tags, t)
+		} else if !set {
+			tags = append(tags, Tag{Key: key, Value: value})
+			set = true
+		}
+	}
+	if !set {
+		tags = append(tags, Tag{Key: key, Value: value})
+	}
+	td.Tags = tags
+}
+
+// Bugs returns the bug ids of the tags with |key|, eg. TagBug or TagFix. Tags with invalid bugs
+// are skipped, and the first of their errors is returned along with the ids of the other tags.
+func (td *TaggedDescription) Bugs(key string) ([]int, error) {
+	var ids []int
+	var firstErr error
+	for _, v := range td.Get(key) {
+		bugs, err := ParseBugs(v)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", key, err)
+			}
+			continue
+		}
+		ids = append(ids, bugs...)
+	}
+	return ids, firstErr
+}
+
+// Validate returns an error listing the tags whose value isn't valid.
+func (td *TaggedDescription) Validate() error {
+	var errs []string
+	for _, t := range td.Tags {
+		s, ok := FindTagSpec(t.Key)
+		if !ok || s.Validate == nil || t.Value == "" {
+			continue
+		}
+		if err := s.Validate(t.Value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s.render(t.Value), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid description tags:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// String renders the description with its tags at the end, separated from the text by an empty
+// line.
+func (td *TaggedDescription) String() string {
+	var lines []string
+	if td.Text != "" {
+		lines = append(lines, td.Text)
+		if len(td.Tags) > 0 {
+			lines = append(lines, "")
+		}
+	}
+	for _, t := range td.Tags {
+		s, ok := FindTagSpec(t.Key)
+		if !ok {
+			s = &TagSpec{Key: t.Key}
+		}
+		lines = append(lines, s.render(t.Value))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+var bugIDRe = regexp.MustCompile(`^(?:https://)?(?:b/)?(\d+)$`)
+
+// ParseBugs parses a comma separated list of bugs, given as ids, "b/<id>" or "https://b/<id>".
+// "none" stands for no bug, eg. "BUG=none".
+func ParseBugs(value string) ([]int, error) {
+	var ids []int
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.EqualFold(item, "none") {
+			continue
+		}
+		m := bugIDRe.FindStringSubmatch(item)
+		if m == nil {
+			return nil, fmt.Errorf("missing bug id in %q", item)
+		}
+		id, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bug id %q: %v", item, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
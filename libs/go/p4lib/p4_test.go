@@ -18,13 +18,27 @@ package p4lib
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"sge-monorepo/libs/go/sgetest"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
 )
 
 func TestActions(t *testing.T) {
@@ -725,6 +739,77 @@ View:
 	}
 }
 
+func TestClientExtensions(t *testing.T) {
+	content := `# A Perforce Client Specification, with fields from a newer server and custom fields.
+
+Client:	ext-client
+
+Update:	2020/06/03 21:12:40
+
+Owner:	ext-owner
+
+Type:	writeable
+
+Backup:	enable
+
+Root:	/home/ext
+
+Options:	allwrite noclobber nocompress unlocked nomodtime normdir
+
+SubmitOptions:	submitunchanged
+
+LineEnd:	local
+
+BuildNotes:
+	First line of the notes.
+	Second line: with a colon.
+
+View:
+	//depot/... //ext-client/...
+`
+	got, err := parseClient(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Type":       "writeable",
+		"Backup":     "enable",
+		"BuildNotes": "First line of the notes.\nSecond line: with a colon.",
+	}
+	if diff := cmp.Diff(want, got.Extensions); diff != "" {
+		t.Errorf("wrong Extensions. Diff (-want +got):\n%s", diff)
+	}
+	if len(got.View) != 1 {
+		t.Errorf("got View %v, want 1 entry", got.View)
+	}
+	wantStr := `Client:	ext-client
+Owner:	ext-owner
+Root:	/home/ext
+Options:	allwrite noclobber nocompress unlocked nomodtime normdir
+SubmitOptions:	submitunchanged
+LineEnd:	local
+Backup:	enable
+BuildNotes:
+	First line of the notes.
+	Second line: with a colon.
+Type:	writeable
+View:
+	//depot/... //ext-client/...
+`
+	gotStr := got.String()
+	if diff := cmp.Diff(wantStr, gotStr); diff != "" {
+		t.Errorf("wrong client. Diff (-want +got):\n%s", diff)
+	}
+	// Writing back and parsing again keeps the extensions.
+	again, err := parseClient(gotStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, again); diff != "" {
+		t.Errorf("round trip changed the client. Diff (-want +got):\n%s", diff)
+	}
+}
+
 func TestAddClientOption(t *testing.T) {
 	options := []ClientOption{}
 	options, err := AppendClientOption(options, AllWrite)
@@ -937,3 +1022,2340 @@ func TestVerifyCL(t *testing.T) {
 		}
 	}
 }
+
+// changeP4 fakes the subset of P4 used by ChangeBuilder, recording every command it gets.
+type changeP4 struct {
+	P4
+	cmds     []string
+	failCmd  string
+	inDepot  map[string]bool
+	submitAs int
+}
+
+func (p4 *changeP4) record(args ...string) (string, error) {
+	cmd := fmt.Sprint(args)
+	p4.cmds = append(p4.cmds, cmd)
+	if p4.failCmd != "" && args[0] == p4.failCmd {
+		return "boom", fmt.Errorf("%s failed", args[0])
+	}
+	return "", nil
+}
+
+func (p4 *changeP4) Change(desc string) (int, error) {
+	_, err := p4.record("change", desc)
+	return 42, err
+}
+
+func (p4 *changeP4) Fstat(args ...string) (*FstatResult, error) {
+	if !p4.inDepot[args[0]] {
+		return nil, ErrFileNotFound
+	}
+	return &FstatResult{FileStats: []FileStat{{DepotFile: args[0], HeadRev: 1, HeadAction: "edit"}}}, nil
+}
+
+func (p4 *changeP4) Add(paths []string, options ...string) (string, error) {
+	return p4.record(append(append([]string{"add"}, options...), paths...)...)
+}
+
+func (p4 *changeP4) Edit(paths []string, cl int) (string, error) {
+	return p4.record(append([]string{"edit", fmt.Sprint(cl)}, paths...)...)
+}
+
+func (p4 *changeP4) Revert(paths []string, opts ...string) (string, error) {
+	return p4.record(append(append([]string{"revert"}, opts...), paths...)...)
+}
+
+func (p4 *changeP4) Submit(cl int, options ...string) (string, error) {
+	if _, err := p4.record("submit", fmt.Sprint(cl)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Change %d renamed change %d and submitted.", cl, p4.submitAs), nil
+}
+
+func (p4 *changeP4) ExecCmd(args ...string) (string, error) {
+	return p4.record(args...)
+}
+
+func TestChangeBuilder(t *testing.T) {
+	added := filepath.Join(t.TempDir(), "added.txt")
+	if err := ioutil.WriteFile(added, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	newFake := func() *changeP4 {
+		return &changeP4{inDepot: map[string]bool{"//depot/edit.txt": true}, submitAs: 50}
+	}
+	tests := []struct {
+		name      string
+		failCmd   string
+		build     func(cb *ChangeBuilder)
+		wantErr   bool
+		wantCmds  []string
+		wantPlan  []string
+		submitted int
+	}{
+		{
+			name: "submit",
+			build: func(cb *ChangeBuilder) {
+				cb.Edit("//depot/edit.txt")
+				cb.Add(added)
+				cb.Submit()
+			},
+			wantCmds: []string{
+				"[change desc]",
+				"[edit 42 //depot/edit.txt]",
+				fmt.Sprintf("[add -c 42 %s]", added),
+				"[submit 42]",
+			},
+			wantPlan:  []string{"change", "edit //depot/edit.txt", "add " + added, "submit"},
+			submitted: 50,
+		},
+		{
+			name: "rollback on failure",
+			build: func(cb *ChangeBuilder) {
+				cb.Edit("//depot/edit.txt")
+				cb.Add(added)
+				cb.Shelve()
+			},
+			failCmd: "shelve",
+			wantErr: true,
+			wantCmds: []string{
+				"[change desc]",
+				"[edit 42 //depot/edit.txt]",
+				fmt.Sprintf("[add -c 42 %s]", added),
+				"[shelve -c 42]",
+				"[revert -k -c 42 //...]",
+				"[change -d 42]",
+			},
+			wantPlan: []string{"change", "edit //depot/edit.txt", "add " + added, "shelve"},
+		},
+		{
+			name: "dry run",
+			build: func(cb *ChangeBuilder) {
+				cb.Edit("//depot/edit.txt")
+				cb.Submit("-f", "revertunchanged")
+				cb.DryRun()
+			},
+			wantPlan: []string{"change", "edit //depot/edit.txt", "submit -f revertunchanged"},
+		},
+		{
+			name: "edit of missing file",
+			build: func(cb *ChangeBuilder) {
+				cb.Edit("//depot/missing.txt")
+			},
+			wantErr: true,
+		},
+		{
+			name: "path staged twice",
+			build: func(cb *ChangeBuilder) {
+				cb.Edit("//depot/edit.txt")
+				cb.Delete("//depot/edit.txt")
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p4 := newFake()
+			p4.failCmd = test.failCmd
+			cb := NewChangeBuilder(p4, "desc")
+			test.build(cb)
+			result, err := cb.Build()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Build() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.wantCmds, p4.cmds); diff != "" {
+				t.Errorf("commands diff (-want +got):\n%s", diff)
+			}
+			if result == nil {
+				return
+			}
+			if diff := cmp.Diff(test.wantPlan, result.Plan); diff != "" {
+				t.Errorf("plan diff (-want +got):\n%s", diff)
+			}
+			if result.Submitted != test.submitted {
+				t.Errorf("Submitted = %d, want %d", result.Submitted, test.submitted)
+			}
+		})
+	}
+}
+
+func TestRevSpec(t *testing.T) {
+	mustRange := func(from, to RevSpec) RevSpec {
+		r, err := Range(from, to)
+		if err != nil {
+			t.Fatalf("Range(%q, %q) failed: %v", from, to, err)
+		}
+		return r
+	}
+	mustLabel := func(label string) RevSpec {
+		r, err := AtLabel(label)
+		if err != nil {
+			t.Fatalf("AtLabel(%q) failed: %v", label, err)
+		}
+		return r
+	}
+	testCases := []struct {
+		rev  RevSpec
+		path string
+		want string
+	}{
+		{rev: RevSpec{}, path: "//depot/foo.txt", want: "//depot/foo.txt"},
+		{rev: AtChange(123), path: "//depot/foo.txt", want: "//depot/foo.txt@123"},
+		{rev: AtShelvedChange(456), path: "//depot/foo.txt", want: "//depot/foo.txt@=456"},
+		{rev: AtRev(3), path: "//depot/foo.txt", want: "//depot/foo.txt#3"},
+		{rev: AtHave(), path: "//depot/...", want: "//depot/...#have"},
+		{rev: AtHead(), path: "//depot/*.go", want: "//depot/*.go#head"},
+		{rev: AtNone(), path: "//depot/foo.txt", want: "//depot/foo.txt#none"},
+		{
+			rev:  AtDate(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)),
+			path: "//depot/foo.txt",
+			want: "//depot/foo.txt@2021/03/04:05:06:07",
+		},
+		{rev: mustLabel("release-1.2"), path: "//depot/foo.txt", want: "//depot/foo.txt@release-1.2"},
+		{
+			rev:  mustRange(AtChange(100), AtChange(200)),
+			path: "//depot/...",
+			want: "//depot/...@100,@200",
+		},
+		{
+			rev:  mustRange(AtRev(2), AtHead()),
+			path: "//depot/foo.txt",
+			want: "//depot/foo.txt#2,#head",
+		},
+		// Revision specifier characters in paths are escaped, already escaped paths are kept.
+		{rev: AtChange(1), path: "//depot/a@b#c.txt", want: "//depot/a%40b%23c.txt@1"},
+		{rev: AtChange(1), path: "//depot/a%40b.txt", want: "//depot/a%40b.txt@1"},
+	}
+	for _, tc := range testCases {
+		if got := tc.rev.Of(tc.path); got != tc.want {
+			t.Errorf("%q.Of(%q): want %q, got %q", tc.rev, tc.path, tc.want, got)
+		}
+	}
+
+	got := AtHave().OfAll([]string{"//depot/a.txt", "//depot/b.txt"})
+	want := []string{"//depot/a.txt#have", "//depot/b.txt#have"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("OfAll mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, label := range []string{"", "123", "foo@bar", "foo#bar", "foo bar", "foo,bar", "foo*", "foo...", "foo/bar"} {
+		if _, err := AtLabel(label); err == nil {
+			t.Errorf("AtLabel(%q): want error", label)
+		}
+	}
+
+	r := mustRange(AtChange(1), AtChange(2))
+	invalidRanges := [][2]RevSpec{
+		{RevSpec{}, AtChange(2)},
+		{AtChange(1), RevSpec{}},
+		{r, AtChange(3)},
+		{AtChange(0), r},
+	}
+	for _, ends := range invalidRanges {
+		if _, err := Range(ends[0], ends[1]); err == nil {
+			t.Errorf("Range(%q, %q): want error", ends[0], ends[1])
+		}
+	}
+}
+
+func TestFilelogSources(t *testing.T) {
+	stats := []map[string]string{
+		{
+			"depotFile": "//depot/new/foo.cc",
+			"rev0":      "1",
+			"change0":   "120",
+			"action0":   "move/add",
+			"how0,0":    "moved from",
+			"file0,0":   "//depot/old/foo.cc",
+			"srev0,0":   "#none",
+			"erev0,0":   "#4",
+		},
+		{
+			"depotFile": "//depot/rel/bar.cc",
+			"rev0":      "1",
+			"change0":   "120",
+			"action0":   "add",
+			"how0,0":    "add from",
+			"file0,0":   "//depot/main/bar.cc",
+			"srev0,0":   "#2",
+			"erev0,0":   "#7",
+		},
+		{
+			"depotFile": "//depot/rel/baz.cc",
+			"rev0":      "3",
+			"change0":   "120",
+			"action0":   "edit",
+		},
+	}
+	cb := filelogcb{}
+	for _, s := range stats {
+		if err := cb.outputStat(s); err != nil {
+			t.Fatalf("outputStat(%v): %v", s, err)
+		}
+	}
+	want := filelogcb{
+		"//depot/new/foo.cc": {{How: "moved from", DepotPath: "//depot/old/foo.cc", StartRev: 0, EndRev: 4}},
+		"//depot/rel/bar.cc": {{How: "add from", DepotPath: "//depot/main/bar.cc", StartRev: 2, EndRev: 7}},
+	}
+	if diff := cmp.Diff(want, cb); diff != "" {
+		t.Errorf("filelog sources mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPairMoves(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     []FileAction
+		sources   map[string][]FileSource
+		submitted bool
+		want      []MovedFileAction
+	}{
+		{
+			// Renames within a directory, where file names differ.
+			name: "submitted rename",
+			files: []FileAction{
+				{DepotPath: "//depot/game/old_name.cc", Revision: 5, Action: "move/delete"},
+				{DepotPath: "//depot/game/new_name.cc", Revision: 1, Action: "move/add"},
+				{DepotPath: "//depot/game/BUILD", Revision: 8, Action: "edit"},
+			},
+			sources: map[string][]FileSource{
+				"//depot/game/new_name.cc": {{How: HowMovedFrom, DepotPath: "//depot/game/old_name.cc", EndRev: 4}},
+			},
+			submitted: true,
+			want: []MovedFileAction{
+				{
+					FileAction: FileAction{DepotPath: "//depot/game/old_name.cc", Revision: 5, Action: "move/delete"},
+					MovedTo:    "//depot/game/new_name.cc",
+				},
+				{
+					FileAction:   FileAction{DepotPath: "//depot/game/new_name.cc", Revision: 1, Action: "move/add"},
+					MovedFrom:    "//depot/game/old_name.cc",
+					MovedFromRev: 4,
+				},
+				{FileAction: FileAction{DepotPath: "//depot/game/BUILD", Revision: 8, Action: "edit"}},
+			},
+		},
+		{
+			// Directory move without sources, as reported by older servers.
+			name: "directory move by name",
+			files: []FileAction{
+				{DepotPath: "//some-depot/ThirdParty/ADO/ADO.Build.cs", Revision: 2, Action: "move/delete"},
+				{DepotPath: "//some-depot/ThirdParty/ADO/ADO.tps", Revision: 2, Action: "move/delete"},
+				{DepotPath: "//other-depot/third_party/ADO/ADO.Build.cs", Revision: 1, Action: "move/add"},
+				{DepotPath: "//other-depot/third_party/ADO/ADO.tps", Revision: 1, Action: "move/add"},
+			},
+			submitted: true,
+			want: []MovedFileAction{
+				{
+					FileAction: FileAction{DepotPath: "//some-depot/ThirdParty/ADO/ADO.Build.cs", Revision: 2, Action: "move/delete"},
+					MovedTo:    "//other-depot/third_party/ADO/ADO.Build.cs",
+				},
+				{
+					FileAction: FileAction{DepotPath: "//some-depot/ThirdParty/ADO/ADO.tps", Revision: 2, Action: "move/delete"},
+					MovedTo:    "//other-depot/third_party/ADO/ADO.tps",
+				},
+				{
+					FileAction:   FileAction{DepotPath: "//other-depot/third_party/ADO/ADO.Build.cs", Revision: 1, Action: "move/add"},
+					MovedFrom:    "//some-depot/ThirdParty/ADO/ADO.Build.cs",
+					MovedFromRev: 1,
+				},
+				{
+					FileAction:   FileAction{DepotPath: "//other-depot/third_party/ADO/ADO.tps", Revision: 1, Action: "move/add"},
+					MovedFrom:    "//some-depot/ThirdParty/ADO/ADO.tps",
+					MovedFromRev: 1,
+				},
+			},
+		},
+		{
+			// Pending rename without sources, the last move/add and move/delete left are paired.
+			name: "pending rename",
+			files: []FileAction{
+				{DepotPath: "//depot/a/x.txt", Revision: 3, Action: "move/delete"},
+				{DepotPath: "//depot/a/y.txt", Revision: 1, Action: "move/add"},
+			},
+			want: []MovedFileAction{
+				{
+					FileAction: FileAction{DepotPath: "//depot/a/x.txt", Revision: 3, Action: "move/delete"},
+					MovedTo:    "//depot/a/y.txt",
+				},
+				{
+					FileAction:   FileAction{DepotPath: "//depot/a/y.txt", Revision: 1, Action: "move/add"},
+					MovedFrom:    "//depot/a/x.txt",
+					MovedFromRev: 3,
+				},
+			},
+		},
+		{
+			// Two files renamed to the same name in different directories can't be paired by name.
+			name: "ambiguous names",
+			files: []FileAction{
+				{DepotPath: "//depot/a/util.h", Revision: 2, Action: "move/delete"},
+				{DepotPath: "//depot/b/util.h", Revision: 2, Action: "move/delete"},
+				{DepotPath: "//depot/c/util.h", Revision: 1, Action: "move/add"},
+				{DepotPath: "//depot/d/util.h", Revision: 1, Action: "move/add"},
+			},
+			want: []MovedFileAction{
+				{FileAction: FileAction{DepotPath: "//depot/a/util.h", Revision: 2, Action: "move/delete"}},
+				{FileAction: FileAction{DepotPath: "//depot/b/util.h", Revision: 2, Action: "move/delete"}},
+				{FileAction: FileAction{DepotPath: "//depot/c/util.h", Revision: 1, Action: "move/add"}},
+				{FileAction: FileAction{DepotPath: "//depot/d/util.h", Revision: 1, Action: "move/add"}},
+			},
+		},
+		{
+			// Branch with edit and integrations are annotated with their sources.
+			name: "integrations",
+			files: []FileAction{
+				{DepotPath: "//depot/rel/bar.cc", Revision: 1, Action: "add"},
+				{DepotPath: "//depot/rel/baz.cc", Revision: 1, Action: "branch"},
+				{DepotPath: "//depot/rel/qux.cc", Revision: 4, Action: "integrate"},
+			},
+			sources: map[string][]FileSource{
+				"//depot/rel/bar.cc": {{How: "add from", DepotPath: "//depot/main/bar.cc", EndRev: 7}},
+				"//depot/rel/baz.cc": {{How: "branch from", DepotPath: "//depot/main/baz.cc", EndRev: 2}},
+				"//depot/rel/qux.cc": {{How: "copy from", DepotPath: "//depot/main/qux.cc", StartRev: 3, EndRev: 5}},
+			},
+			submitted: true,
+			want: []MovedFileAction{
+				{
+					FileAction: FileAction{DepotPath: "//depot/rel/bar.cc", Revision: 1, Action: "add"},
+					Sources:    []FileSource{{How: "add from", DepotPath: "//depot/main/bar.cc", EndRev: 7}},
+				},
+				{
+					FileAction: FileAction{DepotPath: "//depot/rel/baz.cc", Revision: 1, Action: "branch"},
+					Sources:    []FileSource{{How: "branch from", DepotPath: "//depot/main/baz.cc", EndRev: 2}},
+				},
+				{
+					FileAction: FileAction{DepotPath: "//depot/rel/qux.cc", Revision: 4, Action: "integrate"},
+					Sources:    []FileSource{{How: "copy from", DepotPath: "//depot/main/qux.cc", StartRev: 3, EndRev: 5}},
+				},
+			},
+		},
+		{
+			// Pending moves report their source through fstat.
+			name: "pending fstat sources",
+			files: []FileAction{
+				{DepotPath: "//depot/a/x.txt", Revision: 3, Action: "move/delete"},
+				{DepotPath: "//depot/a/z.txt", Revision: 6, Action: "move/delete"},
+				{DepotPath: "//depot/b/x.txt", Revision: 1, Action: "move/add"},
+			},
+			sources: fstatSources([]FileStat{
+				{DepotFile: "//depot/b/x.txt", Action: "move/add", MovedFile: "//depot/a/z.txt", MovedRev: 6},
+			}),
+			want: []MovedFileAction{
+				{FileAction: FileAction{DepotPath: "//depot/a/x.txt", Revision: 3, Action: "move/delete"}},
+				{
+					FileAction: FileAction{DepotPath: "//depot/a/z.txt", Revision: 6, Action: "move/delete"},
+					MovedTo:    "//depot/b/x.txt",
+				},
+				{
+					FileAction:   FileAction{DepotPath: "//depot/b/x.txt", Revision: 1, Action: "move/add"},
+					MovedFrom:    "//depot/a/z.txt",
+					MovedFromRev: 6,
+				},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got := PairMoves(tc.files, tc.sources, tc.submitted)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: PairMoves mismatch (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestReconcilePreview(t *testing.T) {
+	stats := []map[string]string{
+		{"depotFile": "//depot/src/new.cc", "clientFile": "/ws/src/new.cc", "action": "add", "type": "text"},
+		{"depotFile": "//depot/src/main.cc", "clientFile": "/ws/src/main.cc", "workRev": "4", "action": "edit", "type": "text"},
+		{"depotFile": "//depot/src/old.cc", "clientFile": "/ws/src/old.cc", "workRev": "2", "action": "move/delete", "type": "text"},
+		{"depotFile": "//depot/lib/old.cc", "clientFile": "/ws/lib/old.cc", "workRev": "1", "action": "move/add", "type": "text"},
+		{"depotFile": "//depot/src/gone.h", "clientFile": "/ws/src/gone.h", "workRev": "7", "action": "delete", "type": "text"},
+	}
+	cb := reconcilecb{}
+	for _, s := range stats {
+		if err := cb.outputStat(s); err != nil {
+			t.Fatalf("outputStat(%v): %v", s, err)
+		}
+	}
+	r, err := cb.reconciliation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReconcileCandidate{
+		{Action: ActionAdd, DepotPath: "//depot/src/new.cc", LocalPath: "/ws/src/new.cc", Type: "text"},
+		{Action: ActionEdit, DepotPath: "//depot/src/main.cc", LocalPath: "/ws/src/main.cc", Revision: 4, Type: "text"},
+		{Action: ActionMoveDelete, DepotPath: "//depot/src/old.cc", LocalPath: "/ws/src/old.cc", Revision: 2, Type: "text", MovedTo: "//depot/lib/old.cc"},
+		{Action: ActionMoveAdd, DepotPath: "//depot/lib/old.cc", LocalPath: "/ws/lib/old.cc", Revision: 1, Type: "text", MovedFrom: "//depot/src/old.cc"},
+		{Action: ActionDelete, DepotPath: "//depot/src/gone.h", LocalPath: "/ws/src/gone.h", Revision: 7, Type: "text"},
+	}
+	if diff := cmp.Diff(want, r.Candidates); diff != "" {
+		t.Errorf("candidates mismatch (-want +got):\n%s", diff)
+	}
+	if got := r.Filter(ActionAdd, ActionDelete); len(got) != 2 {
+		t.Errorf("Filter(add, delete) = %v, want 2 candidates", got)
+	}
+	// Selecting one half of a move selects the whole move.
+	paths := r.Paths(func(c ReconcileCandidate) bool {
+		return c.Action == ActionMoveAdd || c.Action == ActionEdit
+	})
+	if diff := cmp.Diff([]string{"/ws/src/main.cc", "/ws/lib/old.cc", "/ws/src/old.cc"}, paths); diff != "" {
+		t.Errorf("Paths mismatch (-want +got):\n%s", diff)
+	}
+	if err := cb.outputStat(map[string]string{"action": "add"}); err == nil {
+		t.Errorf("outputStat without depotFile: want error")
+	}
+}
+
+// fakeKeys implements the key functions of P4 over a map.
+type fakeKeys struct {
+	P4
+	keys map[string]string
+	// beforeCas is called before every check-and-set, to simulate concurrent writers.
+	beforeCas func()
+}
+
+func (f *fakeKeys) KeyGet(key string) (string, error) {
+	if v, ok := f.keys[key]; ok {
+		return v, nil
+	}
+	return "0", ErrKeyNotFound
+}
+
+func (f *fakeKeys) KeySet(key, val string) error {
+	f.keys[key] = val
+	return nil
+}
+
+func (f *fakeKeys) KeyCas(key, oldval, newval string) error {
+	if f.beforeCas != nil {
+		f.beforeCas()
+	}
+	if f.keys[key] != oldval {
+		return ErrCasMismatch
+	}
+	f.keys[key] = newval
+	return nil
+}
+
+func (f *fakeKeys) Keys(pattern string) (map[string]string, error) {
+	ret := map[string]string{}
+	for k, v := range f.keys {
+		if ok, _ := filepath.Match(pattern, k); ok {
+			ret[k] = v
+		}
+	}
+	return ret, nil
+}
+
+func TestKeyStore(t *testing.T) {
+	type value struct {
+		Count int
+		Names []string `json:",omitempty"`
+	}
+	p4 := &fakeKeys{keys: map[string]string{
+		"test-legacy": `{"Count": 3}`,
+		"other-a":     `{"Count": 1}`,
+	}}
+	store := NewKeyStore(p4, "test")
+
+	var v value
+	if found, err := store.Get("missing", &v); err != nil || found {
+		t.Errorf("Get(missing) = %v, %v; want false, nil", found, err)
+	}
+	if found, err := store.Get("legacy", &v); err != nil || !found || v.Count != 3 {
+		t.Errorf("Get(legacy) = %v, %v, %+v; want true, nil, Count 3", found, err, v)
+	}
+	if err := store.Set("new", &value{Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := p4.keys["test-new"]; got != `{"Count":1}` {
+		t.Errorf("test-new = %q, want unversioned JSON", got)
+	}
+
+	// Concurrent writes make the update retry from the new value.
+	writes := 0
+	p4.beforeCas = func() {
+		if writes == 0 {
+			p4.keys["test-new"] = `{"Count":10,"Names":["bob"]}`
+		}
+		writes++
+	}
+	v = value{}
+	err := store.Update("new", &v, func() error {
+		v.Count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p4.keys["test-new"]; got != `{"Count":11,"Names":["bob"]}` || writes != 2 {
+		t.Errorf("test-new = %q after %d writes, want Count 11 after 2", got, writes)
+	}
+	p4.beforeCas = func() {
+		p4.keys["test-new"] = fmt.Sprintf(`{"Count":%d}`, 20+writes)
+		writes++
+	}
+	// Unchanged values aren't written.
+	if err := store.Update("new", &v, func() error { return nil }); err != nil || writes != 2 {
+		t.Errorf("Update with a no-op mutation = %v after %d writes, want nil after 2", err, writes)
+	}
+	err = store.Update("new", &v, func() error {
+		v.Count++
+		return nil
+	})
+	if !errors.Is(err, ErrCasMismatch) {
+		t.Errorf("Update with constant conflicts = %v, want ErrCasMismatch", err)
+	}
+	p4.beforeCas = nil
+
+	names, err := store.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"legacy", "new"}, names); diff != "" {
+		t.Errorf("Names mismatch (-want +got):\n%s", diff)
+	}
+
+	// Versioned stores migrate older values when reading them.
+	type valueV2 struct {
+		Total int
+	}
+	v2 := NewKeyStore(p4, "test", WithSchemaVersion(2,
+		func(data []byte) ([]byte, error) { return data, nil },
+		func(data []byte) ([]byte, error) {
+			var old value
+			if err := json.Unmarshal(data, &old); err != nil {
+				return nil, err
+			}
+			return json.Marshal(valueV2{Total: old.Count})
+		},
+	))
+	var nv valueV2
+	err = v2.Update("legacy", &nv, func() error {
+		nv.Total *= 2
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p4.keys["test-legacy"]; got != `v2:{"Total":6}` {
+		t.Errorf("test-legacy = %q, want migrated to v2", got)
+	}
+	if _, err := store.Get("legacy", &v); err == nil {
+		t.Errorf("Get of a newer schema version: want error")
+	}
+}
+
+// openerP4 fakes the subset of P4 used by FileOpener. Opening a file for edit makes it writable.
+type openerP4 struct {
+	P4
+	stats   map[string]FileStat
+	pending []Change
+	created int
+	edits   []string
+}
+
+func (p4 *openerP4) Fstat(args ...string) (*FstatResult, error) {
+	st, ok := p4.stats[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("%s - no such file(s).", args[0])
+	}
+	return &FstatResult{FileStats: []FileStat{st}}, nil
+}
+
+func (p4 *openerP4) Info() (*Info, error) {
+	return &Info{User: "user", Client: "ws"}, nil
+}
+
+func (p4 *openerP4) Changes(args ...string) ([]Change, error) {
+	return p4.pending, nil
+}
+
+func (p4 *openerP4) Change(desc string) (int, error) {
+	p4.created++
+	cl := 100 + p4.created
+	p4.pending = append(p4.pending, Change{Cl: cl, Client: "ws", Description: desc + "\n"})
+	return cl, nil
+}
+
+func (p4 *openerP4) Edit(paths []string, cl int) (string, error) {
+	for _, p := range paths {
+		p4.edits = append(p4.edits, fmt.Sprintf("%s@%d", filepath.Base(p), cl))
+		st := p4.stats[p]
+		st.Action = "edit"
+		st.Change = cl
+		p4.stats[p] = st
+		if err := os.Chmod(p, 0644); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func TestFileOpener(t *testing.T) {
+	dir := t.TempDir()
+	newFile := func(name string) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, nil, 0444); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	clean, opened, locked, local := newFile("clean.ini"), newFile("opened.ini"), newFile("locked.uasset"), newFile("local.txt")
+	fake := &openerP4{
+		stats: map[string]FileStat{
+			clean:  {DepotFile: "//depot/clean.ini"},
+			opened: {DepotFile: "//depot/opened.ini", Action: "edit", Change: 7, OtherOpens: []string{"bob@bobws"}},
+			locked: {DepotFile: "//depot/locked.uasset", OtherLock0: true, OtherLockOwner: "alice@alicews"},
+		},
+		pending: []Change{{Cl: 7, Client: "ws", Description: "Something else\n"}},
+	}
+	o := NewFileOpener(fake, "Files edited by tools")
+
+	states, err := o.Check(clean, opened, locked, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var advisories []string
+	for _, s := range states {
+		advisories = append(advisories, s.Advisory())
+	}
+	want := []string{
+		"",
+		opened + " is also opened by bob@bobws",
+		locked + " is locked by alice@alicews",
+		"",
+	}
+	if diff := cmp.Diff(want, advisories); diff != "" {
+		t.Errorf("advisories (-want +got):\n%s", diff)
+	}
+
+	if _, err := o.Open(clean, locked); !errors.Is(err, ErrFileLocked) {
+		t.Errorf("Open of a locked file: got %v, want ErrFileLocked", err)
+	}
+	states, err = o.Open(clean, opened, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !states[0].Opened() || !states[0].Writable || states[0].CL != 101 {
+		t.Errorf("Open: got %+v, want opened in CL 101 and writable", states[0])
+	}
+	// A new opener reuses the pending CL with the same description.
+	if _, err := NewFileOpener(fake, "Files edited by tools").Open(newFile("other.ini")); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"clean.ini@101"}, fake.edits); diff != "" {
+		t.Errorf("edits (-want +got):\n%s", diff)
+	}
+	if fake.created != 1 {
+		t.Errorf("created %d CLs, want 1", fake.created)
+	}
+}
+
+func TestFileOpenerWatch(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "watched.ini")
+	if err := ioutil.WriteFile(p, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	fake := &openerP4{stats: map[string]FileStat{p: {DepotFile: "//depot/watched.ini"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := NewFileOpener(fake, "desc").Watch(ctx, time.Millisecond, p)
+	if _, err := fake.Edit([]string{p}, 3); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-ch:
+		if s.Path != p || !s.Writable || s.Action != "edit" {
+			t.Errorf("Watch: got %+v, want %s opened for edit", s, p)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Watch: no notification")
+	}
+	cancel()
+	for range ch {
+	}
+}
+
+// riskP4 fakes the subset of P4 used by changeRisk.
+type riskP4 struct {
+	P4
+	desc  Description
+	stats []FileStat
+}
+
+func (p4 *riskP4) Describe(cls []int) ([]Description, error) {
+	return []Description{p4.desc}, nil
+}
+
+func (p4 *riskP4) Fstat(args ...string) (*FstatResult, error) {
+	return &FstatResult{FileStats: p4.stats}, nil
+}
+
+func TestChangeRisk(t *testing.T) {
+	fake := &riskP4{
+		desc: Description{
+			Cl:     10,
+			User:   "alice",
+			Client: "alice-ws",
+			Status: "pending",
+			Files: []FileAction{
+				{DepotPath: "//depot/a.uasset", Revision: 3, Type: "binary+l"},
+				{DepotPath: "//depot/b.go", Revision: 2, Type: "text"},
+				{DepotPath: "//depot/c.go", Revision: 5, Type: "text"},
+			},
+		},
+		stats: []FileStat{
+			{
+				DepotFile:      "//depot/a.uasset",
+				HeadRev:        3,
+				OtherLock0:     true,
+				OtherLockOwner: "bob@bob-ws",
+				OtherOpens:     []string{"alice@alice-ws", "bob@bob-ws"},
+				OtherChanges:   []int{10, 11},
+			},
+			{DepotFile: "//depot/b.go", HeadRev: 4},
+			{DepotFile: "//depot/c.go", HeadRev: 5, OtherOpens: []string{"alice@alice-ws"}, OtherChanges: []int{10}},
+		},
+	}
+	got, err := changeRisk(fake, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ChangeRisk{
+		Cl:    10,
+		Files: 3,
+		Risks: []FileRisk{
+			{DepotFile: "//depot/a.uasset", Kind: RiskLockedByOther, Users: []string{"bob@bob-ws"}, Detail: "locked by bob@bob-ws"},
+			{DepotFile: "//depot/a.uasset", Kind: RiskOpenedElsewhere, Users: []string{"bob@bob-ws"}, Detail: "also opened by bob@bob-ws"},
+			{DepotFile: "//depot/a.uasset", Kind: RiskExclusive, Detail: "exclusive checkout type binary+l"},
+			{DepotFile: "//depot/b.go", Kind: RiskNeedsResolve, Detail: "opened at #2, head is #4"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("changeRisk (-want +got):\n%s", diff)
+	}
+	if !got.Blocking() {
+		t.Errorf("Blocking: want true")
+	}
+	wantSummary := "1 file locked, 1 file needing resolve, 1 file opened elsewhere, 1 file of exclusive type"
+	if s := got.Summary(); s != wantSummary {
+		t.Errorf("Summary: got %q, want %q", s, wantSummary)
+	}
+
+	fake.desc.Status = "submitted"
+	if _, err := changeRisk(fake, 10); err == nil {
+		t.Errorf("changeRisk of a submitted change: want error")
+	}
+}
+
+func TestDescribePartial(t *testing.T) {
+	shelves := map[int]bool{10: true, 12: true}
+	calls := 0
+	describe := func(cls ...int) ([]Description, error) {
+		calls++
+		var descs []Description
+		var errs []string
+		for _, cl := range cls {
+			if shelves[cl] {
+				descs = append(descs, Description{Cl: cl})
+			} else {
+				errs = append(errs, fmt.Sprintf("%d - no such changelist.", cl))
+			}
+		}
+		if len(errs) > 0 {
+			return descs, fmt.Errorf("p4 api error: %v", errs)
+		}
+		return descs, nil
+	}
+
+	descs, errs := DescribePartial([]int{12, 10}, describe)
+	if diff := cmp.Diff([]Description{{Cl: 12}, {Cl: 10}}, descs); diff != "" || errs != nil || calls != 1 {
+		t.Errorf("DescribePartial of existing changes: got errors %v after %d calls, diff (-want +got):\n%s", errs, calls, diff)
+	}
+
+	calls = 0
+	descs, errs = DescribePartial([]int{12, 11, 10}, describe)
+	if diff := cmp.Diff([]Description{{Cl: 12}, {Cl: 10}}, descs); diff != "" {
+		t.Errorf("DescribePartial with a missing change: diff (-want +got):\n%s", diff)
+	}
+	if len(errs) != 1 || errs[11] == nil {
+		t.Errorf("DescribePartial with a missing change: got errors %v, want one for 11", errs)
+	}
+	// The batch, then the missing change alone.
+	if calls != 2 {
+		t.Errorf("DescribePartial with a missing change: got %d calls, want 2", calls)
+	}
+}
+
+// shelfP4 fakes the subset of P4 used by diffShelf.
+type shelfP4 struct {
+	P4
+	desc Description
+	// files are the contents by file spec.
+	files map[string]string
+	// diffs are the outputs of diff2 by right file spec.
+	diffs map[string]string
+	cmds  []string
+}
+
+func (p4 *shelfP4) DescribeShelved(cls ...int) ([]Description, error) {
+	return []Description{p4.desc}, nil
+}
+
+func (p4 *shelfP4) Print(args ...string) (string, error) {
+	p4.cmds = append(p4.cmds, "print "+strings.Join(args, " "))
+	content, ok := p4.files[args[len(args)-1]]
+	if !ok {
+		return "", fmt.Errorf("%s - no such file(s).", args[len(args)-1])
+	}
+	return content, nil
+}
+
+func (p4 *shelfP4) ExecCmd(args ...string) (string, error) {
+	p4.cmds = append(p4.cmds, strings.Join(args, " "))
+	return p4.diffs[args[len(args)-1]], nil
+}
+
+func TestDiffShelf(t *testing.T) {
+	fake := &shelfP4{
+		desc: Description{
+			Cl:      10,
+			Shelved: true,
+			Files: []FileAction{
+				{DepotPath: "//depot/a.go", Revision: 3, Action: "edit", Type: "text"},
+				{DepotPath: "//depot/b.go", Revision: 1, Action: "add", Type: "text"},
+				{DepotPath: "//depot/c.go", Revision: 2, Action: "delete", Type: "text"},
+				{DepotPath: "//depot/d.uasset", Revision: 4, Action: "edit", Type: "binary+l"},
+			},
+		},
+		files: map[string]string{
+			"//depot/b.go@=10": "package b\n\nfunc B() {}\n",
+			"//depot/c.go#2":   "package c\n",
+		},
+		diffs: map[string]string{
+			"//depot/a.go@=10": strings.Join([]string{
+				"==== //depot/a.go#3 (text) - //depot/a.go@=10 (text) ==== content",
+				"@@ -1,3 +1,3 @@",
+				" package a",
+				"-var x = 1",
+				"+var x = 2",
+				" ",
+				"@@ -10 +10,2 @@",
+				" func A() {}",
+				"+func A2() {}",
+				"\\ No newline at end of file",
+				"",
+			}, "\n"),
+		},
+	}
+	got, err := diffShelf(fake, 10, RevSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ShelfDiff{
+		{
+			DepotPath: "//depot/a.go",
+			Action:    "edit",
+			Type:      "text",
+			Left:      "//depot/a.go#3",
+			Hunks: []ShelfHunk{
+				{LeftStart: 1, LeftLines: 3, RightStart: 1, RightLines: 3, Lines: []string{" package a", "-var x = 1", "+var x = 2", " "}},
+				{LeftStart: 10, LeftLines: 1, RightStart: 10, RightLines: 2, Lines: []string{" func A() {}", "+func A2() {}"}},
+			},
+		},
+		{
+			DepotPath: "//depot/b.go",
+			Action:    "add",
+			Type:      "text",
+			Hunks: []ShelfHunk{
+				{RightStart: 1, RightLines: 3, Lines: []string{"+package b", "+", "+func B() {}"}},
+			},
+		},
+		{
+			DepotPath: "//depot/c.go",
+			Action:    "delete",
+			Type:      "text",
+			Left:      "//depot/c.go#2",
+			Hunks: []ShelfHunk{
+				{LeftStart: 1, LeftLines: 1, Lines: []string{"-package c"}},
+			},
+		},
+		{
+			DepotPath: "//depot/d.uasset",
+			Action:    "edit",
+			Type:      "binary+l",
+			Left:      "//depot/d.uasset#4",
+			Binary:    true,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diffShelf (-want +got):\n%s", diff)
+	}
+	wantCmds := []string{
+		"diff2 -du //depot/a.go#3 //depot/a.go@=10",
+		"print -q //depot/b.go@=10",
+		"print -q //depot/c.go#2",
+	}
+	if diff := cmp.Diff(wantCmds, fake.cmds); diff != "" {
+		t.Errorf("diffShelf commands (-want +got):\n%s", diff)
+	}
+
+	// Against head, the added file doesn't exist on the left either.
+	fake.cmds = nil
+	fake.diffs["//depot/b.go@=10"] = "==== <none> - //depot/b.go@=10 ====\n"
+	fake.files["//depot/c.go#head"] = "package c\n"
+	got, err = diffShelf(fake, 10, AtHead())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[1].Left != "" || len(got[1].Hunks) != 1 || got[1].Hunks[0].RightLines != 3 {
+		t.Errorf("diffShelf against head of added file: got %+v, want the whole file added", got[1])
+	}
+	if got[2].Left != "//depot/c.go#head" {
+		t.Errorf("diffShelf against head of deleted file: got left %q, want //depot/c.go#head", got[2].Left)
+	}
+
+	if _, err := diffShelf(fake, 10, mustRange(t, AtChange(1), AtChange(2))); err == nil {
+		t.Errorf("diffShelf against a range: want error")
+	}
+}
+
+func mustRange(t *testing.T, from, to RevSpec) RevSpec {
+	t.Helper()
+	r, err := Range(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestIsTextType(t *testing.T) {
+	for typ, want := range map[string]bool{
+		"text":     true,
+		"text+x":   true,
+		"ktext":    true,
+		"utf16":    true,
+		"symlink":  true,
+		"binary+l": false,
+		"ubinary":  false,
+		"apple":    false,
+	} {
+		if got := IsTextType(typ); got != want {
+			t.Errorf("IsTextType(%q) = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func readP4Output(t *testing.T, name string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "p4output", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// outputParsers are the parsers of text output, by command.
+var outputParsers = map[string]func(out string, strict bool) (interface{}, error){
+	"have": func(out string, strict bool) (interface{}, error) {
+		return parseHave(out, strict)
+	},
+	"opened": func(out string, strict bool) (interface{}, error) {
+		return parseOpened(out, strict)
+	},
+	"sizes": func(out string, strict bool) (interface{}, error) {
+		return parseSizes(out, strict)
+	},
+	"tickets": func(out string, strict bool) (interface{}, error) {
+		return parseTickets(out, strict)
+	},
+	"users": func(out string, strict bool) (interface{}, error) {
+		return parseUsers(out, strict)
+	},
+}
+
+// TestParseGolden parses outputs captured from p4 servers. In strict mode, lines that the parsers
+// don't understand must be exactly the expected ones: any other means that the output format
+// drifted or that a parser changed behaviour.
+func TestParseGolden(t *testing.T) {
+	abs := func(p string) string {
+		a, err := filepath.Abs(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	testCases := []struct {
+		cmd  string
+		file string
+		want interface{}
+		// wantUnparsed are the lines reported in strict mode.
+		wantUnparsed []int
+	}{
+		{
+			cmd:  "opened",
+			file: "opened_2019.2.txt",
+			want: []OpenedFile{
+				{Path: "//depot/game/src/main.cc", Status: ActionEdit, CL: 0, Type: FileTypeText},
+				{Path: "//depot/game/src/version.h", Status: ActionEdit, CL: 4521, Type: FileTypeText},
+				{Path: "//depot/game/art/hero.psd", Status: ActionEdit, CL: 4521, Type: FileTypeBinary},
+				{Path: "//depot/game/src/new_file.cc", Status: ActionAdd, CL: 4530, Type: FileTypeText},
+				{Path: "//depot/game/src/old_name.cc", Status: ActionMoveDelete, CL: 4530, Type: FileTypeText},
+				{Path: "//depot/game/src/new_name.cc", Status: ActionMoveAdd, CL: 4530, Type: FileTypeText},
+				{Path: "//depot/game/tools/run.sh", Status: ActionEdit, CL: 0, Type: FileTypeText},
+				{Path: "//depot/game/docs/README", Status: ActionDelete, CL: 0, Type: FileTypeUtf8},
+			},
+		},
+		{
+			cmd:  "opened",
+			file: "opened_2023.1_crlf.txt",
+			want: []OpenedFile{
+				{Path: "//depot/game/src/main.cc", Status: ActionEdit, CL: 0, Type: FileTypeText},
+				{Path: "//depot/game/src/unicode.txt", Status: ActionAdd, CL: 812, Type: FileTypeUtf16},
+				{Path: "//depot/game/bin/tool.exe", Status: ActionEdit, CL: 812, Type: FileTypeBinary},
+			},
+		},
+		{
+			cmd:  "opened",
+			file: "opened_none.txt",
+			want: []OpenedFile(nil),
+		},
+		{
+			cmd:  "opened",
+			file: "opened_ja.txt",
+			want: []OpenedFile{
+				{Path: "//depot/game/src/main.cc", Status: ActionEdit, CL: 0, Type: FileTypeText},
+			},
+			wantUnparsed: []int{2},
+		},
+		{
+			cmd:  "users",
+			file: "users_2019.2.txt",
+			want: []User{
+				{User: "alice", Email: "alice@example.com", Name: "Alice Liddell", Accessed: "2021/03/01"},
+				{User: "bob", Email: "bob@example.com", Name: "Bob", Accessed: "2021/02/27"},
+				{User: "jnunez", Email: "jose.nunez@example.com", Name: "José Núñez de la Cruz", Accessed: "2020/12/15"},
+				{User: "swarm", Email: "swarm@perforce", Name: "Swarm (service)", Accessed: "2021/03/02"},
+				{User: "nomail", Email: "", Name: "No Mail", Accessed: "2019/07/04"},
+			},
+		},
+		{
+			cmd:  "users",
+			file: "users_crlf.txt",
+			want: []User{
+				{User: "alice", Email: "alice@example.com", Name: "Alice Liddell", Accessed: "2021/03/01"},
+				{User: "bob", Email: "bob@example.com", Name: "Bob", Accessed: "2021/02/27"},
+			},
+		},
+		{
+			// Output of p4 users -l, which Users doesn't run.
+			cmd:  "users",
+			file: "users_long.txt",
+			want: []User{
+				{User: "alice", Email: "alice@example.com", Name: "Alice Liddell", Accessed: "2021/03/01"},
+			},
+			wantUnparsed: []int{2},
+		},
+		{
+			cmd:  "tickets",
+			file: "tickets.txt",
+			want: []Ticket{
+				{Name: "localhost:1666", User: "alice", ID: "0A1B2C3D4E5F60718293A4B5C6D7E8F9"},
+				{Name: "ssl:perforce.example.com:1666", User: "swarm", ID: "99887766554433221100FFEEDDCCBBAA"},
+				{Name: "10.0.0.12:1666", User: "bob", ID: "00112233445566778899AABBCCDDEEFF"},
+			},
+		},
+		{
+			cmd:  "tickets",
+			file: "tickets_malformed.txt",
+			want: []Ticket{
+				{Name: "localhost:1666", User: "alice", ID: "0A1B2C3D4E5F60718293A4B5C6D7E8F9"},
+			},
+			wantUnparsed: []int{2, 3},
+		},
+		{
+			cmd:  "sizes",
+			file: "sizes.txt",
+			want: &SizeCollection{
+				Sizes: []Size{
+					{DepotPath: "//depot/game/...", FileCount: 12840, FileSize: 98765432100},
+					{DepotPath: "//depot/My Project/...", FileCount: 3, FileSize: 1024},
+					{DepotPath: "//depot/empty/...", FileCount: 0, FileSize: 0},
+				},
+				TotalFileCount: 12843,
+				TotalFileSize:  98765433124,
+			},
+		},
+		{
+			cmd:  "sizes",
+			file: "sizes_deleted.txt",
+			want: &SizeCollection{
+				Sizes:          []Size{{DepotPath: "//depot/game/...", FileCount: 12840, FileSize: 98765432100}},
+				TotalFileCount: 12840,
+				TotalFileSize:  98765432100,
+			},
+		},
+		{
+			cmd:  "have",
+			file: "have_2019.2.txt",
+			want: []File{
+				{DepotPath: "//depot/game/src/main.cc", Revision: 12, LocalPath: abs("/home/ci/ws/game/src/main.cc")},
+				{DepotPath: "//depot/game/src/util.cc", Revision: 3, LocalPath: abs("/home/ci/ws/game/src/util.cc")},
+			},
+		},
+		{
+			cmd:  "have",
+			file: "have_ja.txt",
+			want: []File{
+				{DepotPath: "//depot/game/src/main.cc", Revision: 12, LocalPath: abs("/home/ci/ws/game/src/main.cc")},
+			},
+			wantUnparsed: []int{2},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			out := readP4Output(t, tc.file)
+			parse := outputParsers[tc.cmd]
+			got, err := parse(out, false)
+			if err != nil {
+				t.Fatalf("non-strict parsing failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("wrong result. Diff (-want, +got):\n%s", diff)
+			}
+			strictGot, err := parse(out, true)
+			var gotUnparsed []int
+			var unparsedErr *UnparsedError
+			if errors.As(err, &unparsedErr) {
+				if unparsedErr.Cmd != tc.cmd {
+					t.Errorf("UnparsedError.Cmd = %q, want %q", unparsedErr.Cmd, tc.cmd)
+				}
+				for _, l := range unparsedErr.Lines {
+					gotUnparsed = append(gotUnparsed, l.Line)
+				}
+			} else if err != nil {
+				t.Fatalf("strict parsing failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantUnparsed, gotUnparsed); diff != "" {
+				t.Errorf("wrong unparsed lines. Diff (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(got, strictGot); diff != "" {
+				t.Errorf("strict parsing returned a different result. Diff (-non-strict, +strict):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestParseFuzz feeds the parsers with random mutations of the golden outputs, which must never
+// make them panic.
+func TestParseFuzz(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "p4output", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden outputs")
+	}
+	var corpus []string
+	for _, f := range files {
+		corpus = append(corpus, readP4Output(t, filepath.Base(f)))
+	}
+	// Fragments of p4 output that mutations insert.
+	tokens := []string{
+		"#", "#0", "#-1", " - ", "//", "(", ")", "()", "<", ">", "\r", "\n", "\r\n", " ", "+", "...",
+		"change", "default", "edit", "move/add", "files", "bytes", "accessed", "0", "99999999999999999999",
+		"ファイル",
+	}
+	rnd := rand.New(rand.NewSource(1))
+	mutate := func(s string) string {
+		b := []byte(s)
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			i := 0
+			if len(b) > 0 {
+				i = rnd.Intn(len(b) + 1)
+			}
+			switch rnd.Intn(5) {
+			case 0: // Truncate.
+				b = b[:i]
+			case 1: // Delete a range.
+				j := i + rnd.Intn(8)
+				if j > len(b) {
+					j = len(b)
+				}
+				b = append(b[:i:i], b[j:]...)
+			case 2: // Insert a token.
+				tok := tokens[rnd.Intn(len(tokens))]
+				b = append(b[:i:i], append([]byte(tok), b[i:]...)...)
+			case 3: // Replace a byte.
+				if i < len(b) {
+					b[i] = byte(rnd.Intn(256))
+				}
+			case 4: // Splice another output.
+				other := corpus[rnd.Intn(len(corpus))]
+				b = append(b[:i:i], other[rnd.Intn(len(other)+1):]...)
+			}
+		}
+		return string(b)
+	}
+	for i := 0; i < 5000; i++ {
+		in := mutate(corpus[rnd.Intn(len(corpus))])
+		for cmd, parse := range outputParsers {
+			for _, strict := range []bool{false, true} {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Fatalf("parsing %s output (strict=%v) panicked: %v\ninput: %q", cmd, strict, r, in)
+						}
+					}()
+					_, _ = parse(in, strict)
+				}()
+			}
+		}
+	}
+}
+
+func TestCharset(t *testing.T) {
+	const text = "メニュー設定: 開始\r\n"
+	encode := func(enc encoding.Encoding, s string) []byte {
+		b, err := enc.NewEncoder().Bytes([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	utf16le := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+		wantOut string
+	}{
+		{"ascii", []byte("plain\n"), CharsetUtf8, "plain\n"},
+		{"utf8", []byte(text), CharsetUtf8, text},
+		{"utf8 bom", append([]byte{0xEF, 0xBB, 0xBF}, text...), CharsetUtf8Bom, "\uFEFF" + text},
+		{"utf16le bom", encode(utf16le, text), CharsetUtf16LeBom, text},
+		{"shiftjis", encode(japanese.ShiftJIS, text), CharsetShiftJis, text},
+		{"eucjp", encode(japanese.EUCJP, text), CharsetEucJp, text},
+		{"winansi", encode(charmap.Windows1252, "Café\n"), CharsetWinAnsi, "Café\n"},
+		{"truncated shiftjis", encode(japanese.ShiftJIS, text)[:3], CharsetWinAnsi, "ƒ\uFFFDƒ"},
+	}
+	for _, tc := range tests {
+		if got := DetectCharset(tc.content); got != tc.want {
+			t.Errorf("%s: DetectCharset() = %q, want %q", tc.name, got, tc.want)
+			continue
+		}
+		d := FileDetails{DepotFile: "//depot/loc.txt", Type: "text", Content: tc.content}
+		if err := decodeText(&d, PrintOptions{}); err != nil {
+			t.Errorf("%s: decodeText() error: %v", tc.name, err)
+			continue
+		}
+		if d.Charset != tc.want || string(d.Content) != tc.wantOut {
+			t.Errorf("%s: decodeText() = %q, %q, want %q, %q", tc.name, d.Charset, d.Content, tc.want, tc.wantOut)
+		}
+	}
+
+	sjis := encode(japanese.ShiftJIS, text)
+	raw := FileDetails{Type: "text+k", Content: sjis}
+	if err := decodeText(&raw, PrintOptions{Raw: true}); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Charset != CharsetShiftJis || !bytes.Equal(raw.Content, sjis) {
+		t.Errorf("want raw content to be detected but left as is, got %q, %q", raw.Charset, raw.Content)
+	}
+	forced := FileDetails{Type: "text", Content: encode(charmap.Windows1252, "Café")}
+	if err := decodeText(&forced, PrintOptions{Charset: CharsetIso8859_1}); err != nil {
+		t.Fatal(err)
+	}
+	if forced.Charset != CharsetIso8859_1 || string(forced.Content) != "Café" {
+		t.Errorf("want the given charset to be used, got %q, %q", forced.Charset, forced.Content)
+	}
+	server := FileDetails{Type: "utf16", Content: []byte(text)}
+	if err := decodeText(&server, PrintOptions{Charset: CharsetShiftJis}); err != nil {
+		t.Fatal(err)
+	}
+	if server.Charset != CharsetUtf16 || string(server.Content) != text {
+		t.Errorf("want files translated by the server to be left as is, got %q, %q", server.Charset, server.Content)
+	}
+	binary := FileDetails{Type: "binary+l", Content: sjis}
+	if err := decodeText(&binary, PrintOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if binary.Charset != "" || !bytes.Equal(binary.Content, sjis) {
+		t.Errorf("want binary files to be left as is, got %q, %q", binary.Charset, binary.Content)
+	}
+	if err := decodeText(&FileDetails{Type: "text"}, PrintOptions{Charset: "klingon"}); err == nil {
+		t.Errorf("want error for unknown charset")
+	}
+}
+
+func TestAsLimitError(t *testing.T) {
+	tests := []struct {
+		err       error
+		output    string
+		wantLimit string
+		wantValue int
+	}{
+		{err: fmt.Errorf("p4 api error: Request too large (over 500000); see 'p4 help maxresults'."), wantLimit: "maxresults", wantValue: 500000},
+		{err: fmt.Errorf("exit status 1"), output: "Too many rows scanned (over 10000000); see 'p4 help maxscanrows'.", wantLimit: "maxscanrows", wantValue: 10000000},
+		{err: fmt.Errorf("Operation took too long (over 30.00 seconds); see 'p4 help maxlocktime'."), wantLimit: "maxlocktime", wantValue: 30},
+		{err: fmt.Errorf("p4 api error: //depot/foo/... - no such file(s).")},
+		{},
+	}
+	for _, test := range tests {
+		lerr := asLimitError(test.err, test.output)
+		if test.wantLimit == "" {
+			if lerr != nil {
+				t.Errorf("asLimitError(%v) = %v, want nil", test.err, lerr)
+			}
+			continue
+		}
+		if lerr == nil || lerr.Limit != test.wantLimit || lerr.Value != test.wantValue {
+			t.Errorf("asLimitError(%v) = %+v, want %s over %d", test.err, lerr, test.wantLimit, test.wantValue)
+			continue
+		}
+		if !errors.Is(lerr, ErrLimitExceeded) || !errors.Is(lerr, test.err) {
+			t.Errorf("asLimitError(%v) doesn't match ErrLimitExceeded and the original error", test.err)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	out := "P4LOG=log (-L)\nmaxresults=500000 (configure)\nmaxscanrows=10000000 (configure)\nmonitor=1 (configure)\n"
+	want := &Limits{MaxResults: 500000, MaxScanRows: 10000000}
+	if diff := cmp.Diff(want, parseLimits(out)); diff != "" {
+		t.Errorf("parseLimits() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSplitQuery(t *testing.T) {
+	// The files of a depot, queries of more than 2 files exceed maxresults.
+	files := []string{
+		"//depot/a/1", "//depot/a/2", "//depot/b/1", "//depot/c/1", "//depot/c/2", "//depot/c/3", "//depot/top",
+	}
+	tooLarge := fmt.Errorf("p4 api error: Request too large (over 2); see 'p4 help maxresults'.")
+	dirs := func(root string) ([]string, error) {
+		dir := strings.TrimSuffix(root, "/*") + "/"
+		seen := map[string]bool{}
+		var subdirs []string
+		for _, f := range files {
+			if rest := strings.TrimPrefix(f, dir); rest != f && strings.Contains(rest, "/") {
+				sub := dir + rest[:strings.Index(rest, "/")]
+				if !seen[sub] {
+					seen[sub] = true
+					subdirs = append(subdirs, sub)
+				}
+			}
+		}
+		return subdirs, nil
+	}
+	match := func(path string) []string {
+		var matched []string
+		for _, f := range files {
+			switch {
+			case strings.HasSuffix(path, "/..."):
+				if strings.HasPrefix(f, strings.TrimSuffix(path, "...")) {
+					matched = append(matched, f)
+				}
+			case strings.HasSuffix(path, "/*"):
+				dir := strings.TrimSuffix(path, "*")
+				if strings.HasPrefix(f, dir) && !strings.Contains(strings.TrimPrefix(f, dir), "/") {
+					matched = append(matched, f)
+				}
+			case f == path:
+				matched = append(matched, f)
+			}
+		}
+		return matched
+	}
+	tests := []struct {
+		name          string
+		paths         []string
+		want          []string
+		wantTruncated []string
+	}{
+		{
+			name:  "fits",
+			paths: []string{"//depot/a/..."},
+			want:  []string{"//depot/a/1", "//depot/a/2"},
+		},
+		{
+			name:  "split directory",
+			paths: []string{"//depot/..."},
+			want:  []string{"//depot/a/1", "//depot/a/2", "//depot/b/1", "//depot/top"},
+			// //depot/c has 3 files and no subdirectory to split into.
+			wantTruncated: []string{"//depot/c/..."},
+		},
+		{
+			name:  "halve paths",
+			paths: []string{"//depot/a/1", "//depot/b/1", "//depot/c/1", "//depot/top"},
+			want:  []string{"//depot/a/1", "//depot/b/1", "//depot/c/1", "//depot/top"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			err := SplitQuery(test.paths, func(paths []string) error {
+				var matched []string
+				for _, p := range paths {
+					matched = append(matched, match(p)...)
+				}
+				if len(matched) > 2 {
+					return tooLarge
+				}
+				if len(matched) == 0 {
+					return ErrFileNotFound
+				}
+				got = append(got, matched...)
+				return nil
+			}, dirs)
+			sort.Strings(got)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("SplitQuery() results diff (-want +got):\n%s", diff)
+			}
+			var lerr *LimitError
+			if test.wantTruncated == nil {
+				if err != nil {
+					t.Errorf("SplitQuery() = %v, want no error", err)
+				}
+				return
+			}
+			if !errors.As(err, &lerr) || !lerr.Truncated {
+				t.Fatalf("SplitQuery() = %v, want a truncated LimitError", err)
+			}
+			if diff := cmp.Diff(test.wantTruncated, lerr.Paths); diff != "" {
+				t.Errorf("SplitQuery() truncated paths diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+const testProfiles = `{"profiles": [
+  {"name": "code", "view": ["//depot/game/Source/... game/Source/...", "-//depot/game/Source/ThirdParty/... game/Source/ThirdParty/..."]},
+  {"name": "editor", "include": ["code"], "view": ["//depot/game/Content/... game/Content/..."]},
+  {"name": "tools", "view": ["//depot/tools/..."]}
+]}`
+
+func TestParseViewProfiles(t *testing.T) {
+	ps, err := ParseViewProfiles([]byte(testProfiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ps.View("editor", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ViewEntry{
+		{"//depot/game/Source/...", "//ws/game/Source/..."},
+		{"-//depot/game/Source/ThirdParty/...", "//ws/game/Source/ThirdParty/..."},
+		{"//depot/game/Content/...", "//ws/game/Content/..."},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("View(editor) diff (-want +got):\n%s", diff)
+	}
+	got, err = ps.View("tools", "ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]ViewEntry{{"//depot/tools/...", "//ws/depot/tools/..."}}, got); diff != "" {
+		t.Errorf("View(tools) diff (-want +got):\n%s", diff)
+	}
+
+	for name, data := range map[string]string{
+		"duplicate": `{"profiles": [{"name": "a"}, {"name": "a"}]}`,
+		"unknown":   `{"profiles": [{"name": "a", "include": ["b"]}]}`,
+		"cycle":     `{"profiles": [{"name": "a", "include": ["b"]}, {"name": "b", "include": ["a"]}]}`,
+		"mapping":   `{"profiles": [{"name": "a", "view": ["depot/..."]}]}`,
+	} {
+		if _, err := ParseViewProfiles([]byte(data)); err == nil {
+			t.Errorf("ParseViewProfiles(%s): got no error", name)
+		}
+	}
+}
+
+// profileP4 fakes the subset of p4lib.P4 used to apply view profiles.
+type profileP4 struct {
+	P4
+	client  Client
+	sets    int
+	syncErr error
+}
+
+func (p4 *profileP4) Client(string) (*Client, error) {
+	c := p4.client
+	c.View = append([]ViewEntry{}, p4.client.View...)
+	return &c, nil
+}
+
+func (p4 *profileP4) ClientSet(client *Client) (string, error) {
+	p4.sets++
+	p4.client = *client
+	return "", nil
+}
+
+func (p4 *profileP4) Sync(targets []string, options ...string) (string, error) {
+	return "", p4.syncErr
+}
+
+func (p4 *profileP4) Sizes(dirs ...string) (*SizeCollection, error) {
+	sizes := map[string]uint64{
+		"//depot/game/Source/...":            100,
+		"//depot/game/Source/ThirdParty/...": 30,
+		"//depot/game/Content/...":           1000,
+	}
+	sc := &SizeCollection{}
+	for _, d := range dirs {
+		sc.Sizes = append(sc.Sizes, Size{DepotPath: d, FileCount: sizes[d] / 10, FileSize: sizes[d]})
+	}
+	return sc, nil
+}
+
+func TestApplyViewProfile(t *testing.T) {
+	ps, err := ParseViewProfiles([]byte(testProfiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	personal := ViewEntry{"//depot/docs/...", "//ws/docs/..."}
+	p4 := &profileP4{client: Client{
+		Client: "ws",
+		View: []ViewEntry{
+			{"//depot/game/Source/...", "//ws/game/Source/..."},
+			{"-//depot/game/Source/ThirdParty/...", "//ws/game/Source/ThirdParty/..."},
+			personal,
+		},
+	}}
+
+	plan, err := ps.PlanProfile(p4, "", "editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.From != "code" || plan.FileDelta != 100 || plan.SizeDelta != 1000 || len(plan.Removed) != 0 {
+		t.Errorf("plan code -> editor: got from %q, %d files, %d bytes, removed %v", plan.From, plan.FileDelta, plan.SizeDelta, plan.Removed)
+	}
+	if p4.sets != 0 {
+		t.Errorf("planning updated the client")
+	}
+
+	if _, err := ps.ApplyProfile(p4, "", "editor", true); err != nil {
+		t.Fatal(err)
+	}
+	want := []ViewEntry{
+		{"//depot/game/Source/...", "//ws/game/Source/..."},
+		{"-//depot/game/Source/ThirdParty/...", "//ws/game/Source/ThirdParty/..."},
+		{"//depot/game/Content/...", "//ws/game/Content/..."},
+		personal,
+	}
+	if diff := cmp.Diff(want, p4.client.View); diff != "" {
+		t.Errorf("view after applying editor diff (-want +got):\n%s", diff)
+	}
+	if got := ps.Current(&p4.client); got != "editor" {
+		t.Errorf("Current() = %q, want editor", got)
+	}
+
+	plan, err = ps.PlanProfile(p4, "", "tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.FileDelta != -107 || plan.SizeDelta != -1070 {
+		t.Errorf("plan editor -> tools: got %d files, %d bytes", plan.FileDelta, plan.SizeDelta)
+	}
+
+	// A failed sync restores the previous view.
+	p4.syncErr = fmt.Errorf("connection lost")
+	if _, err := ps.ApplyProfile(p4, "", "tools", true); err == nil {
+		t.Fatal("ApplyProfile with a failed sync: got no error")
+	}
+	if diff := cmp.Diff(want, p4.client.View); diff != "" {
+		t.Errorf("view after a failed switch diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTaggedOutput(t *testing.T) {
+	var om outputMultiplexer
+	o := &taggedOutput{cmd: "submit", om: &om}
+	// Writes don't have to end at lines.
+	for _, chunk := range []string{
+		"info: Submitting change 12.\ninfo1: depotFile //depot/a.txt\nwar",
+		"ning: NOTICE: Server maintenance on Saturday 08:00-10:00 UTC, submits are disabled.\n",
+		"warning: [broker] //depot/old/... is deprecated, use //depot/new/...\n",
+		"warning: //depot/foo/... - file(s) up-to-date.\n",
+		"error: Submit validation failed -- fix problems then use 'p4 submit -c 12'.\n",
+		"error: 'check-tags' validation failed: NOTICE: BUG= is missing\n",
+		"Untagged line of a multi-line message\n",
+		"exit: 1\n",
+		"text: no newline",
+	} {
+		if _, err := o.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Warning{
+		{Command: "submit", Source: WarningTrigger, Kind: WarningMaintenance, Message: "Server maintenance on Saturday 08:00-10:00 UTC, submits are disabled."},
+		{Command: "submit", Source: WarningBroker, Kind: WarningDeprecation, Message: "//depot/old/... is deprecated, use //depot/new/..."},
+	}
+	if diff := cmp.Diff(want, o.warnings); diff != "" {
+		t.Errorf("warnings diff (-want +got):\n%s", diff)
+	}
+	// Only advisory messages of warning severity are taken out: trigger rejections are errors.
+	wantOutput := "Submitting change 12.\n" +
+		"... depotFile //depot/a.txt\n" +
+		"//depot/foo/... - file(s) up-to-date.\n" +
+		"Submit validation failed -- fix problems then use 'p4 submit -c 12'.\n" +
+		"'check-tags' validation failed: NOTICE: BUG= is missing\n" +
+		"Untagged line of a multi-line message\n" +
+		"no newline"
+	if got := om.internal.String(); got != wantOutput {
+		t.Errorf("output = %q, want %q", got, wantOutput)
+	}
+}
+
+func TestExecCmdWarnings(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake p4 is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "p4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "p4")
+	// The fake p4 tags its output like "p4 -s" when its first argument after -C utf8 is -s.
+	script := "#!/bin/sh\nif [ \"$3\" = -s ]; then\n" +
+		"echo 'info: //depot/a.txt#1 - added as /ws/a.txt'\necho 'warning: Maintenance: the server restarts at 22:00 UTC' >&2\n" +
+		"else\n" +
+		"echo '//depot/a.txt#1 - added as /ws/a.txt'\necho 'Maintenance: the server restarts at 22:00 UTC' >&2\nfi\n"
+	if err := ioutil.WriteFile(exe, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var handled []Warning
+	p4 := WithWarningHandler(&impl{exePath: exe}, func(w Warning) {
+		handled = append(handled, w)
+	})
+	result, err := p4.ExecCmdWithResult([]string{"sync"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Warning{{Command: "sync", Source: WarningTrigger, Kind: WarningMaintenance, Message: "the server restarts at 22:00 UTC"}}
+	if diff := cmp.Diff(want, result.Warnings); diff != "" {
+		t.Errorf("result warnings diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, handled); diff != "" {
+		t.Errorf("handled warnings diff (-want +got):\n%s", diff)
+	}
+	if result.Output != "//depot/a.txt#1 - added as /ws/a.txt\n" {
+		t.Errorf("output = %q, want the sync output only", result.Output)
+	}
+
+	// Without -s, messages can't be told apart and the output is left as is.
+	output, err := (&impl{exePath: exe}).ExecCmd("sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "//depot/a.txt#1 - added as /ws/a.txt\nMaintenance: the server restarts at 22:00 UTC\n"; output != want {
+		t.Errorf("untagged output = %q, want %q", output, want)
+	}
+}
+
+func TestContentStore(t *testing.T) {
+	// Big enough to spill to a temp file.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2*spillSize/16)
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			var opts []ContentStoreOption
+			if compress {
+				opts = append(opts, WithCompression())
+			}
+			store, err := NewContentStore(filepath.Join(t.TempDir(), "store"), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Simulate a print of three revisions, two of them identical, with the content of the
+			// first one split in several chunks.
+			cb := storecb{store: store}
+			files := []struct {
+				rev    string
+				chunks [][]byte
+			}{
+				{"1", [][]byte{big[:100], big[100:]}},
+				{"2", [][]byte{[]byte("changed\n")}},
+				{"3", [][]byte{big}},
+			}
+			for _, f := range files {
+				if err := cb.outputStat(map[string]string{"depotFile": "//depot/a.bin", "rev": f.rev}); err != nil {
+					t.Fatal(err)
+				}
+				for _, chunk := range f.chunks {
+					if err := cb.outputBinary(chunk); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := cb.flush(); err != nil {
+				t.Fatal(err)
+			}
+			details := cb.details
+			if len(details) != 3 {
+				t.Fatalf("got %d details, want 3", len(details))
+			}
+			if details[0].ContentDigest != details[2].ContentDigest {
+				t.Errorf("identical revisions have digests %s and %s", details[0].ContentDigest, details[2].ContentDigest)
+			}
+			for i, want := range [][]byte{big, []byte("changed\n"), big} {
+				got, err := ReadContent(store, &details[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("content of rev %d: got %d bytes, want %d", details[i].Rev, len(got), len(want))
+				}
+				if details[i].Content != nil {
+					t.Errorf("rev %d kept its content in memory", details[i].Rev)
+				}
+			}
+			entries, err := ioutil.ReadDir(store.Dir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("store has %d files, want 2", len(entries))
+			}
+			stats := store.Stats()
+			if stats.Files != 3 || stats.Deduped != 1 {
+				t.Errorf("got %d files and %d deduped, want 3 and 1", stats.Files, stats.Deduped)
+			}
+			if wantBytes := int64(2*len(big) + len("changed\n")); stats.Bytes != wantBytes {
+				t.Errorf("got %d bytes, want %d", stats.Bytes, wantBytes)
+			}
+			if compress && stats.Stored >= int64(len(big)) {
+				t.Errorf("stored %d bytes, want less than %d", stats.Stored, len(big))
+			}
+			digest, err := store.Put(bytes.NewReader(big))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digest != details[0].ContentDigest || store.Stats().Deduped != 2 {
+				t.Errorf("Put of a stored content wasn't deduped")
+			}
+			if _, err := store.Put(strings.NewReader("changed\n")); err != nil {
+				t.Fatal(err)
+			}
+			if got := store.Stats(); got.Deduped != 3 || got.Stored != stats.Stored {
+				t.Errorf("Put of a stored small content: got %d deduped and %d bytes stored, want 3 and %d", got.Deduped, got.Stored, stats.Stored)
+			}
+			if _, err := store.Get("../escape"); err == nil {
+				t.Errorf("Get of an invalid digest succeeded")
+			}
+		})
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake p4 is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	exe := filepath.Join(dir, "p4")
+	// The fake p4 logs the commands it runs and their server, skipping the global "-C utf8" flags.
+	script := fmt.Sprintf(`#!/bin/sh
+shift 2
+port=
+if [ "$1" = -p ]; then port=" $2"; shift 2; fi
+echo "$1$port" >> %s
+case "$1" in
+info) echo "User name: alice"; echo "Client name: ws" ;;
+users) echo "alice <alice@example.com> (Alice) accessed 2021/01/01" ;;
+esac
+`, calls)
+	if err := ioutil.WriteFile(exe, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	count := func(cmd string) int {
+		data, err := ioutil.ReadFile(calls)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == cmd {
+				n++
+			}
+		}
+		return n
+	}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	p4 := WithReadCache(&impl{exePath: exe}, CacheTTL("users", 0), CacheInvalidation("sync", "info"))
+	p4.(*impl).cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		info, err := p4.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.User != "alice" || info.Client != "ws" {
+			t.Errorf("Info() = %+v, want user alice and client ws", info)
+		}
+		if _, err := p4.Users(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := count("info"); got != 1 {
+		t.Errorf("info ran %d times, want 1", got)
+	}
+	if got := count("users"); got != 3 {
+		t.Errorf("users ran %d times with caching disabled, want 3", got)
+	}
+
+	// The cache is shared with derived P4s, and expires with the TTL.
+	traced := WithTracer(p4, func(string) func() { return func() {} })
+	now = now.Add(DefaultReadCacheTTLs["info"] - time.Second)
+	if _, err := traced.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if got := count("info"); got != 1 {
+		t.Errorf("info ran %d times before the TTL expired, want 1", got)
+	}
+	now = now.Add(time.Second)
+	if _, err := p4.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if got := count("info"); got != 2 {
+		t.Errorf("info ran %d times after the TTL expired, want 2", got)
+	}
+
+	// Write commands and explicit invalidation drop the cached results.
+	for i, invalidate := range []func() error{
+		func() error { _, err := p4.ExecCmd("set", "P4CLIENT=other"); return err },
+		func() error { _, err := p4.ExecCmd("sync"); return err },
+		func() error { InvalidateReadCache(p4, "info"); return nil },
+	} {
+		if err := invalidate(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p4.Info(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := count("info"), 3+i; got != want {
+			t.Errorf("info ran %d times after invalidation %d, want %d", got, i, want)
+		}
+	}
+	// Printing a spec doesn't change anything.
+	if _, err := p4.ExecCmd("client", "-o"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p4.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if got := count("info"); got != 5 {
+		t.Errorf("info ran %d times after client -o, want 5", got)
+	}
+
+	// Results of the commit server aren't mixed with the ones of P4PORT.
+	commit := CommitServer(WithCommitServer(p4, "commit:1666"))
+	for i := 0; i < 2; i++ {
+		if _, err := commit.Info(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := count("info commit:1666"); got != 1 {
+		t.Errorf("info ran %d times on the commit server, want 1", got)
+	}
+	if got := count("info"); got != 5 {
+		t.Errorf("info ran %d times on P4PORT after the commit server, want 5", got)
+	}
+}
+
+func TestSplitServerPerf(t *testing.T) {
+	output := `//depot/a.txt#3 - updating /ws/a.txt
+--- lapse .042s
+--- usage 10+5us 0+0io 0+0net 4096k 0pf
+--- rpc msgs/size in+out 2+3/0mb+0mb himarks 318788/2000 snd/rcv .000s/.000s
+--- db.have
+---   pages in+out+cached 4+2+3
+---   locks read/write 0/1 rows get+pos+scan put+del 0+1+2 1+0
+---   total lock wait+held read/write 0ms+0ms/3ms+12ms
+--- db.rev
+---   pages in+out+cached 12+0+10
+---   locks read/write 1/0 rows get+pos+scan put+del 0+1+30 0+0
+---   total lock wait+held read/write 1ms+5ms/0ms+0ms
+---   max lock wait+held read/write 1ms+5ms/0ms+0ms
+`
+	perf, rest := splitServerPerf("sync", output)
+	if want := "//depot/a.txt#3 - updating /ws/a.txt\n"; rest != want {
+		t.Errorf("splitServerPerf() output = %q, want %q", rest, want)
+	}
+	want := &ServerPerf{
+		Command:       "sync",
+		Lapse:         42 * time.Millisecond,
+		ReadLockWait:  time.Millisecond,
+		ReadLockHeld:  5 * time.Millisecond,
+		WriteLockWait: 3 * time.Millisecond,
+		WriteLockHeld: 12 * time.Millisecond,
+		Tables: []TablePerf{
+			{Name: "db.have", PagesIn: 4, PagesOut: 2, PagesCached: 3, WriteLocks: 1,
+				WriteLockWait: 3 * time.Millisecond, WriteLockHeld: 12 * time.Millisecond},
+			{Name: "db.rev", PagesIn: 12, PagesCached: 10, ReadLocks: 1,
+				ReadLockWait: time.Millisecond, ReadLockHeld: 5 * time.Millisecond},
+		},
+	}
+	if diff := cmp.Diff(want, perf); diff != "" {
+		t.Errorf("splitServerPerf() diff (-want +got):\n%s", diff)
+	}
+
+	// Lines looking like track data within the output are kept.
+	output = "--- a/file\n+++ b/file\n"
+	if perf, rest := splitServerPerf("print", output); perf != nil || rest != output {
+		t.Errorf("splitServerPerf(%q) = %+v, %q, want no data", output, perf, rest)
+	}
+}
+
+func TestWithServerPerf(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake p4 is a shell script")
+	}
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "p4")
+	// The fake p4 fails unless asked for track data, after the global "-C utf8" flags.
+	script := `#!/bin/sh
+[ "$3" = "-Ztrack" ] || exit 1
+echo "Change 12 created."
+echo "--- lapse 1.5s"
+echo "--- db.change"
+echo "---   total lock wait+held read/write 0ms+0ms/250ms+10ms"
+`
+	if err := ioutil.WriteFile(exe, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var got []ServerPerf
+	p4 := WithServerPerf(&impl{exePath: exe}, func(perf ServerPerf) {
+		got = append(got, perf)
+	})
+	before := Stats["perftest"]
+	out, err := p4.ExecCmd("perftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Change 12 created.\n" {
+		t.Errorf("ExecCmd() = %q, want the output without track data", out)
+	}
+	if len(got) != 1 || got[0].Lapse != 1500*time.Millisecond || got[0].LockWait() != 250*time.Millisecond {
+		t.Errorf("handler called with %+v, want a lapse of 1.5s and a lock wait of 250ms", got)
+	}
+	lockStats.Lock()
+	after := Stats["perftest"]
+	lockStats.Unlock()
+	if after.Tracked != before.Tracked+1 || after.Server.WriteLockHeld-before.Server.WriteLockHeld != 10*time.Millisecond {
+		t.Errorf("Stats = %+v, want one more tracked execution holding locks for 10ms", after)
+	}
+}
+
+func TestTaggedDescription(t *testing.T) {
+	desc := "Fix the loader\n\nBUG=b/12, 34\nSome notes.\nTest: not a tag here\n  NO_PRESUBMIT = rollback\n BUG=56\n\nReviewed-by: alice\nTest: ran it\n"
+	td := ParseTaggedDescription(desc)
+	if want := "Fix the loader\n\nSome notes.\nTest: not a tag here\n BUG=56"; td.Text != want {
+		t.Errorf("Text = %q, want %q", td.Text, want)
+	}
+	want := []Tag{
+		{TagBug, "b/12, 34"},
+		{TagNoPresubmit, "rollback"},
+		{TagReviewedBy, "alice"},
+		{TagTest, "ran it"},
+	}
+	if diff := cmp.Diff(want, td.Tags); diff != "" {
+		t.Errorf("Tags diff (-want +got):\n%s", diff)
+	}
+	bugs, err := td.Bugs(TagBug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]int{12, 34}, bugs); diff != "" {
+		t.Errorf("Bugs() diff (-want +got):\n%s", diff)
+	}
+	if err := td.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+
+	td.Set(TagBug, "78")
+	td.Add(TagFix, "90")
+	wantText := "Fix the loader\n\nSome notes.\nTest: not a tag here\n BUG=56\n\nBUG=78\nNO_PRESUBMIT=rollback\nReviewed-by: alice\nTest: ran it\nFIX=90\n"
+	if got := td.String(); got != wantText {
+		t.Errorf("String() = %q, want %q", got, wantText)
+	}
+	if diff := cmp.Diff(td, ParseTaggedDescription(td.String())); diff != "" {
+		t.Errorf("parsing a rendered description diff (-want +got):\n%s", diff)
+	}
+
+	// Colon tags are case sensitive and only count in the trailing tag block.
+	for _, desc := range []string{
+		"Fix\n\nreviewed-by: alice",
+		"Fix\n\nTest: ran it\nand more text",
+		"Fix\nTest: ran it",
+	} {
+		if tags := ParseTaggedDescription(desc).Tags; len(tags) != 0 {
+			t.Errorf("ParseTaggedDescription(%q).Tags = %v, want none", desc, tags)
+		}
+	}
+
+	// Template tags left blank and BUG=none are fine.
+	blank := ParseTaggedDescription("Cleanup\n\nBUG=none\nTESTED=\nReviewed-by:\n")
+	if err := blank.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	if bugs, err := blank.Bugs(TagBug); err != nil || len(bugs) != 0 {
+		t.Errorf("Bugs() = %v, %v, want no bug", bugs, err)
+	}
+
+	invalid := ParseTaggedDescription("Broken\n\nBUG=foo\nFIX=b/\nBUG=1\n")
+	err = invalid.Validate()
+	for _, want := range []string{"BUG=foo", "FIX=b/"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want error about %s", err, want)
+		}
+	}
+	if bugs, err := invalid.Bugs(TagBug); err == nil || !cmp.Equal(bugs, []int{1}) {
+		t.Errorf("Bugs() = %v, %v, want [1] and an error", bugs, err)
+	}
+}
+
+// replicaP4 fakes a replica that sees change 10 after |lag| describes.
+type replicaP4 struct {
+	P4
+	lag       int
+	describes int
+}
+
+func (p4 *replicaP4) Describe(cls []int) ([]Description, error) {
+	p4.describes++
+	if p4.describes <= p4.lag {
+		return nil, fmt.Errorf("p4 api error: %d - no such changelist.", cls[0])
+	}
+	return []Description{{Cl: cls[0], Status: "submitted"}}, nil
+}
+
+func TestWaitForChange(t *testing.T) {
+	defer func(interval, max time.Duration) {
+		replicaPollInterval, maxReplicaPollInterval = interval, max
+	}(replicaPollInterval, maxReplicaPollInterval)
+	replicaPollInterval, maxReplicaPollInterval = time.Millisecond, 2*time.Millisecond
+
+	p4 := &replicaP4{lag: 3}
+	if err := WaitForChange(p4, 10, time.Minute); err != nil {
+		t.Errorf("WaitForChange() = %v", err)
+	}
+	if p4.describes != 4 {
+		t.Errorf("WaitForChange() described %d times, want 4", p4.describes)
+	}
+	p4 = &replicaP4{lag: 1000}
+	if err := WaitForChange(p4, 10, 10*time.Millisecond); !errors.Is(err, ErrNotReplicated) {
+		t.Errorf("WaitForChange() of a lagging replica = %v, want ErrNotReplicated", err)
+	}
+}
+
+func TestCommitServer(t *testing.T) {
+	replica := WithCommitServer(New(), "ssl:commit:1666", "describe").(*impl)
+	if got := replica.serverPort("describe"); got != "ssl:commit:1666" {
+		t.Errorf("serverPort(describe) = %q, want the commit server", got)
+	}
+	if got := replica.serverPort("files"); got != "" {
+		t.Errorf("serverPort(files) = %q, want P4PORT", got)
+	}
+	if got := CommitServer(replica).(*impl).serverPort("files"); got != "ssl:commit:1666" {
+		t.Errorf("CommitServer().serverPort(files) = %q, want the commit server", got)
+	}
+	// Without commit server, P4PORT is the commit server.
+	if got := CommitServer(New()).(*impl).serverPort("files"); got != "" {
+		t.Errorf("CommitServer(New()).serverPort(files) = %q, want P4PORT", got)
+	}
+}
+
+// lockP4 fakes the subset of P4 used by the exclusive lock helpers. Files listed in |holders| are
+// opened exclusively by another workspace, which releases them after |polls| fstats.
+type lockP4 struct {
+	P4
+	types   map[string]string
+	holders map[string]string
+	polls   int
+	fstats  int
+	// racer opens the files between the check and the edit, once.
+	racer string
+	edits []string
+}
+
+func (p4 *lockP4) Fstat(args ...string) (*FstatResult, error) {
+	p4.fstats++
+	if p4.fstats > p4.polls {
+		p4.holders = nil
+	}
+	p := args[0]
+	t, ok := p4.types[p]
+	if !ok {
+		return nil, fmt.Errorf("%s - no such file(s).", p)
+	}
+	st := FileStat{DepotFile: p, HeadType: t}
+	if h := p4.holders[p]; h != "" {
+		st.OtherOpen = 1
+		st.OtherOpens = []string{h}
+		st.OtherLock0 = true
+		st.OtherLockOwner = h
+	}
+	return &FstatResult{FileStats: []FileStat{st}}, nil
+}
+
+func (p4 *lockP4) Edit(paths []string, cl int) (string, error) {
+	if p4.racer != "" {
+		p4.holders = map[string]string{paths[0]: p4.racer}
+		p4.polls = p4.fstats + 1
+		p4.racer = ""
+		return paths[0] + " - can't edit exclusive file already opened\n", fmt.Errorf("exit status 1")
+	}
+	p4.edits = append(p4.edits, paths...)
+	return "", nil
+}
+
+func TestAsExclusiveLockError(t *testing.T) {
+	out := "//depot/a.uasset - can't edit exclusive file already opened\n" +
+		"//depot/b.txt#3 - opened for edit\n" +
+		"//depot/c.umap - can't edit exclusive file already opened\n"
+	lerr := asExclusiveLockError(errors.New("exit status 1"), out)
+	if lerr == nil {
+		t.Fatal("asExclusiveLockError() = nil, want the exclusive files")
+	}
+	want := []LockedFile{
+		{Path: "//depot/a.uasset", DepotPath: "//depot/a.uasset"},
+		{Path: "//depot/c.umap", DepotPath: "//depot/c.umap"},
+	}
+	if diff := cmp.Diff(want, lerr.Files); diff != "" {
+		t.Errorf("asExclusiveLockError() diff (-want +got):\n%s", diff)
+	}
+	if !errors.Is(lerr, ErrExclusivelyLocked) {
+		t.Errorf("asExclusiveLockError() doesn't match ErrExclusivelyLocked")
+	}
+	if lerr := asExclusiveLockError(errors.New("exit status 1"), "//depot/b.txt - file(s) not on client"); lerr != nil {
+		t.Errorf("asExclusiveLockError() of another error = %v, want nil", lerr)
+	}
+}
+
+func TestCheckLockable(t *testing.T) {
+	p4 := &lockP4{
+		types: map[string]string{
+			"//depot/hero.uasset": "binary+l",
+			"//depot/map.umap":    "binary+Fl",
+			"//depot/config.ini":  "text",
+		},
+		holders: map[string]string{
+			"//depot/hero.uasset": "alice@alice-ws",
+			"//depot/config.ini":  "bob@bob-ws",
+		},
+		polls: 1000,
+	}
+	if err := CheckLockable(p4, []string{"//depot/map.umap", "//depot/config.ini", "//depot/new.txt"}); err != nil {
+		t.Errorf("CheckLockable() of free files = %v", err)
+	}
+	err := CheckLockable(p4, []string{"//depot/hero.uasset", "//depot/map.umap"})
+	var lerr *ExclusiveLockError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("CheckLockable() = %v, want an ExclusiveLockError", err)
+	}
+	want := []LockedFile{{Path: "//depot/hero.uasset", DepotPath: "//depot/hero.uasset", User: "alice", Client: "alice-ws"}}
+	if diff := cmp.Diff(want, lerr.Files); diff != "" {
+		t.Errorf("CheckLockable() diff (-want +got):\n%s", diff)
+	}
+	if got, want := err.Error(), "//depot/hero.uasset is exclusively opened by alice@alice-ws"; got != want {
+		t.Errorf("CheckLockable() error = %q, want %q", got, want)
+	}
+}
+
+func TestEditWithLockWait(t *testing.T) {
+	defer func(interval, max time.Duration) {
+		lockPollInterval, maxLockPollInterval = interval, max
+	}(lockPollInterval, maxLockPollInterval)
+	lockPollInterval, maxLockPollInterval = time.Millisecond, 2*time.Millisecond
+
+	paths := []string{"//depot/hero.uasset"}
+	newP4 := func(polls int) *lockP4 {
+		return &lockP4{
+			types:   map[string]string{"//depot/hero.uasset": "binary+l"},
+			holders: map[string]string{"//depot/hero.uasset": "alice@alice-ws"},
+			polls:   polls,
+		}
+	}
+	p4 := newP4(3)
+	waits := 0
+	if _, err := EditWithLockWait(p4, paths, 0, time.Minute, func(*ExclusiveLockError) { waits++ }); err != nil {
+		t.Fatalf("EditWithLockWait() = %v", err)
+	}
+	if waits != 3 || len(p4.edits) != 1 {
+		t.Errorf("EditWithLockWait() waited %d times and edited %v, want 3 waits and an edit", waits, p4.edits)
+	}
+
+	// The file is opened by someone else between the check and the edit.
+	p4 = newP4(0)
+	p4.racer = "bob@bob-ws"
+	if _, err := EditWithLockWait(p4, paths, 0, time.Minute, nil); err != nil || len(p4.edits) != 1 {
+		t.Errorf("EditWithLockWait() racing another workspace = %v, edits %v", err, p4.edits)
+	}
+
+	p4 = newP4(1000)
+	_, err := EditWithLockWait(p4, paths, 0, 10*time.Millisecond, nil)
+	var lerr *ExclusiveLockError
+	if !errors.As(err, &lerr) || lerr.Files[0].User != "alice" {
+		t.Errorf("EditWithLockWait() of a held file = %v, want an ExclusiveLockError", err)
+	}
+	if len(p4.edits) != 0 {
+		t.Errorf("EditWithLockWait() of a held file edited %v", p4.edits)
+	}
+}
+
+// printP4 prints |text|, or fails with |err|.
+type printP4 struct {
+	P4
+	text   string
+	err    error
+	prints int
+}
+
+func (p4 *printP4) Print(args ...string) (string, error) {
+	p4.prints++
+	return p4.text, p4.err
+}
+
+func TestDepotFile(t *testing.T) {
+	p4 := &printP4{err: errors.New("no such file")}
+	now := time.Unix(1000, 0)
+	f := NewDepotFile(p4, "//depot/settings.txt", func(text string) (interface{}, error) {
+		if text == "bad" {
+			return nil, errors.New("bad settings")
+		}
+		return text, nil
+	})
+	f.Now = func() time.Time { return now }
+	// No version could ever be loaded.
+	if _, err := f.Get(); err == nil {
+		t.Errorf("Get() of a missing file: got no error")
+	}
+	now = now.Add(DepotFileRefresh)
+	p4.err = nil
+	p4.text = "v1"
+	if got, err := f.Get(); err != nil || got != "v1" {
+		t.Errorf("Get() = %v, %v, want v1", got, err)
+	}
+	// Files are cached until the next refresh.
+	p4.text = "v2"
+	if got, _ := f.Get(); got != "v1" || p4.prints != 2 {
+		t.Errorf("Get() = %v after %d prints, want the cached v1 after 2", got, p4.prints)
+	}
+	// Versions that can't be parsed keep the previous one.
+	now = now.Add(DepotFileRefresh)
+	p4.text = "bad"
+	if got, err := f.Get(); err != nil || got != "v1" {
+		t.Errorf("Get() of a bad version = %v, %v, want v1", got, err)
+	}
+	now = now.Add(DepotFileRefresh)
+	p4.text = "v2"
+	if got, err := f.Get(); err != nil || got != "v2" {
+		t.Errorf("Get() = %v, %v, want v2", got, err)
+	}
+}
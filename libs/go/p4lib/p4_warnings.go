@@ -0,0 +1,203 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p4lib
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Sources of warnings.
+const (
+	// WarningBroker is a message of the p4 broker in front of the server.
+	WarningBroker = "broker"
+	// WarningTrigger is a message of a server trigger.
+	WarningTrigger = "trigger"
+)
+
+// Kinds of warnings.
+const (
+	// WarningMaintenance announces a maintenance window or an outage of the server.
+	WarningMaintenance = "maintenance"
+	// WarningDeprecation announces that paths or features are deprecated or moving.
+	WarningDeprecation = "deprecation"
+	// WarningNotice is any other advisory message.
+	WarningNotice = "notice"
+)
+
+// Warning is an advisory message printed by a server trigger or the broker along with the output
+// of a command, eg. "NOTICE: the server is read-only on Saturday from 08:00 UTC for maintenance".
+// Warnings are removed from the output of commands, so that parsers don't see them.
+type Warning struct {
+	// Command is the p4 command the warning was printed by, eg. "sync".
+	Command string `json:"command"`
+	// Source is one of the Warning{Broker,Trigger} constants.
+	Source string `json:"source"`
+	// Kind is one of the Warning{Maintenance,Deprecation,Notice} constants.
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("p4 %s: %s %s: %s", w.Command, w.Source, w.Kind, w.Message)
+}
+
+// Result is the output of a command along with the warnings printed by the server.
+type Result struct {
+	Output   string
+	Warnings []Warning
+}
+
+// WarningsOption collects the warnings printed during |p4.ExecCmdWithOptions| in |warnings|. The
+// command is run with "p4 -s", which tags the messages of the server with their severity: only
+// messages of warning severity with an advisory tag, eg. "NOTICE:", are warnings.
+func WarningsOption(warnings *[]Warning) Option {
+	return fnOption(func(opts *options) {
+		opts.warnings = warnings
+	})
+}
+
+// WithWarningHandler returns a P4 that calls |handler| with the warnings printed during any
+// command, eg. to show them to users. If the provided interface doesn't support it, it is returned
+// unchanged. Commands run through the p4 API, eg. fstat and print, don't report warnings.
+// Like with WarningsOption, commands are run with "p4 -s" to tell warnings from other messages.
+func WithWarningHandler(p4 P4, handler func(Warning)) P4 {
+	if parent, ok := p4.(*impl); ok {
+		child := *parent
+		child.onWarning = handler
+		return &child
+	}
+	return p4
+}
+
+// advisoryRegex matches the lines of advisory messages: a tag followed by a colon and the message,
+// eg. "NOTICE: ..." or "[broker] ...".
+var advisoryRegex = regexp.MustCompile(`^\s*(?:\[([A-Za-z0-9 _-]+)\]|([A-Za-z0-9 _-]+):)\s*(\S.*?)\s*$`)
+
+// advisoryTags maps the tags of advisory messages to their source and, when the tag tells it,
+// their kind. Other tags are not advisory messages, eg. "connect: Connection refused".
+var advisoryTags = map[string]Warning{
+	"broker":      {Source: WarningBroker},
+	"p4broker":    {Source: WarningBroker},
+	"advisory":    {Source: WarningTrigger},
+	"notice":      {Source: WarningTrigger},
+	"warning":     {Source: WarningTrigger},
+	"maintenance": {Source: WarningTrigger, Kind: WarningMaintenance},
+	"deprecated":  {Source: WarningTrigger, Kind: WarningDeprecation},
+	"deprecation": {Source: WarningTrigger, Kind: WarningDeprecation},
+}
+
+var (
+	maintenanceRegex = regexp.MustCompile(`(?i)maintenance|downtime|outage|read-only|upgrade`)
+	deprecationRegex = regexp.MustCompile(`(?i)deprecat|obsolete|retired|moved to|moving to`)
+)
+
+// ParseWarning returns the warning printed in |line| by command |cmd|, if it is an advisory
+// message.
+func ParseWarning(cmd, line string) (Warning, bool) {
+	m := advisoryRegex.FindStringSubmatch(line)
+	if m == nil {
+		return Warning{}, false
+	}
+	tag := m[1]
+	if tag == "" {
+		tag = m[2]
+	}
+	w, ok := advisoryTags[strings.ToLower(strings.TrimSpace(tag))]
+	if !ok {
+		return Warning{}, false
+	}
+	w.Command = cmd
+	w.Message = m[3]
+	if w.Kind == "" {
+		switch {
+		case maintenanceRegex.MatchString(w.Message):
+			w.Kind = WarningMaintenance
+		case deprecationRegex.MatchString(w.Message):
+			w.Kind = WarningDeprecation
+		default:
+			w.Kind = WarningNotice
+		}
+	}
+	return w, true
+}
+
+// severityRegex matches the severity tag "p4 -s" prints at the start of every line, eg. "info: "
+// or "info1: " for nested messages.
+var severityRegex = regexp.MustCompile(`^(info[0-9]?|text|error|warning|exit): ?`)
+
+// taggedOutput is the single writer of both the stdout and stderr of a command run with "p4 -s",
+// which tags every line with its severity. It removes the tags as lines come, so that the output
+// reads as without -s, and takes the advisory messages of warning severity out of the output.
+// Messages of other severities, eg. the errors of triggers rejecting a submit, are left as is.
+// As os/exec writes to the same writer from one goroutine at a time, it needs no lock.
+type taggedOutput struct {
+	cmd      string
+	om       *outputMultiplexer
+	partial  []byte
+	warnings []Warning
+}
+
+func (o *taggedOutput) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(o.partial[:i+1])
+		o.partial = o.partial[i+1:]
+		if err := o.line(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush handles the last line of the output when it doesn't end with a newline.
+func (o *taggedOutput) flush() error {
+	if len(o.partial) == 0 {
+		return nil
+	}
+	line := string(o.partial)
+	o.partial = nil
+	return o.line(line)
+}
+
+func (o *taggedOutput) line(line string) error {
+	m := severityRegex.FindStringSubmatch(line)
+	if m == nil {
+		// Lines of multi-line messages are only tagged once.
+		_, err := o.om.Write([]byte(line))
+		return err
+	}
+	text := line[len(m[0]):]
+	switch tag := m[1]; {
+	case tag == "exit":
+		return nil
+	case tag == "warning":
+		if w, ok := ParseWarning(o.cmd, strings.TrimRight(text, "\r\n")); ok {
+			o.warnings = append(o.warnings, w)
+			return nil
+		}
+	case strings.HasPrefix(tag, "info") && len(tag) > len("info"):
+		// Without -s, nested messages start with "... " for each level, eg. the fields of -ztag.
+		text = strings.Repeat("... ", int(tag[len(tag)-1]-'0')) + text
+	}
+	_, err := o.om.Write([]byte(text))
+	return err
+}
@@ -114,6 +114,26 @@ func main() {
 		for _, detail := range details {
 			fmt.Printf("file %s\n%s\n", detail.DepotFile, detail.Content)
 		}
+	case "printstore":
+		// Prints files to a compressed content store, reporting how much the dedup saved.
+		if len(args) < 3 {
+			fmt.Println("printstore takes a store directory and at least one file")
+			return
+		}
+		store, err := p4lib.NewContentStore(args[1], p4lib.WithCompression())
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			return
+		}
+		details, err := p4.PrintToStore(store, args[2:]...)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+		for _, detail := range details {
+			fmt.Printf("file %s#%d: %s\n", detail.DepotFile, detail.Rev, detail.ContentDigest)
+		}
+		stats := store.Stats()
+		fmt.Printf("%d files, %d deduped, %d bytes stored as %d\n", stats.Files, stats.Deduped, stats.Bytes, stats.Stored)
 	default:
 		r, err := p4.ExecCmd(args...)
 		if err != nil {
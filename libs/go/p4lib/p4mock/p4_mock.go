@@ -15,9 +15,10 @@
 // Mock implements a lightweight mock for the P4 interface.
 //
 // Usage:
-//      p4 := p4mock.New()
-//      p4.ClientResponses["my-client"] = ...
-//      ...
+//
+//	p4 := p4mock.New()
+//	p4.ClientResponses["my-client"] = ...
+//	...
 package p4mock
 
 import (
@@ -30,70 +31,83 @@ import (
 // Mock is meant to provide a lightweight mechanism to provide your own callbacks into p4lib.
 // Usage:
 //
-//      p4 := p4mock.New()
-//      p4.ClientFunc = func(clientName string) (*p4lib.Client, error) {
-//          if client, ok := someMap[clientName]; ok {
-//              return client, nil
-//          }
-//          return nil, fmt.Errorf("client % not expected", clientName)
-//      })
-//
-//      ...
+//	p4 := p4mock.New()
+//	p4.ClientFunc = func(clientName string) (*p4lib.Client, error) {
+//	    if client, ok := someMap[clientName]; ok {
+//	        return client, nil
+//	    }
+//	    return nil, fmt.Errorf("client % not expected", clientName)
+//	})
 //
-//      err := SomeCallThatRequiresPerforce(p4, args...)
+//	...
 //
+//	err := SomeCallThatRequiresPerforce(p4, args...)
 type Mock struct {
-	AddFunc                func(paths []string, options ...string) (string, error)
-	AddDirFunc             func(dir string, options ...string) (string, error)
-	ChangeFunc             func(desc string) (int, error)
-	ChangeUpdateFunc       func(desc string, cl int) error
-	ChangesFunc            func(args ...string) ([]p4lib.Change, error)
-	ClientFunc             func(clientName string) (*p4lib.Client, error)
-	ClientSetFunc          func(client *p4lib.Client) (string, error)
-	ClientsFunc            func() ([]string, error)
-	DeleteFunc             func(paths []string, cl int) (string, error)
-	DescribeFunc           func(cl []int) ([]p4lib.Description, error)
-	DescribeShelvedFunc    func(cls ...int) ([]p4lib.Description, error)
-	DiffFileFunc           func(file string) error
-	DiffFunc               func(file0 string, file1 string) ([]p4lib.Diff, error)
-	Diff2Func              func(file0 string, file1 string) ([]p4lib.Diff, error)
-	DirsFunc               func(root string) ([]string, error)
-	EditFunc               func(paths []string, cl int) (string, error)
-	ExecCmdFunc            func(args ...string) (string, error)
-	ExecCmdWithOptionsFunc func(args []string, opts ...p4lib.Option) (string, error)
-	FilesFunc              func(files ...string) ([]p4lib.FileDetails, error)
-	FstatFunc              func(args ...string) (*p4lib.FstatResult, error)
-	GrepFunc               func(pattern string, caseSensitive bool, depotPaths ...string) ([]p4lib.Grep, error)
-	GrepLargeFunc          func(pattern string, depotPath string, caseSensitive bool, status *p4lib.GrepStatus) error
-	HaveFunc               func(patterns ...string) ([]p4lib.File, error)
-	IndexFunc              func(name string, attr int, values ...string) error
-	IndexDeleteFunc        func(name string, attr int, values ...string) error
-	InfoFunc               func() (*p4lib.Info, error)
-	IgnoresFunc            func(paths []string) (string, error)
-	KeyGetFunc             func(key string) (string, error)
-	KeySetFunc             func(key, val string) error
-	KeyIncFunc             func(key string) (string, error)
-	KeyCasFunc             func(key, oldval, newval string) error
-	KeysFunc               func(pattern string) (map[string]string, error)
-	LoginFunc              func(user string) (string, time.Time, error)
-	OpenedFunc             func(change string) ([]p4lib.OpenedFile, error)
-	PrintFunc              func(args ...string) (string, error)
-	PrintExFunc            func(files ...string) ([]p4lib.FileDetails, error)
-	ReconcileFunc          func(paths []string, cl int) (string, error)
-	RevertFunc             func(paths []string, opts ...string) (string, error)
-	SetFunc                func(key, value string) error
-	SizesFunc              func(dirs ...string) (*p4lib.SizeCollection, error)
-	SubmitFunc             func(cl int, options ...string) (string, error)
-	SyncFunc               func(targets []string, options ...string) (string, error)
-	SyncSizeFunc           func(targets []string) (*p4lib.SyncSize, error)
-	TicketsFunc            func(args ...string) ([]p4lib.Ticket, error)
-	TrustFunc              func(args ...string) error
-	UnshelveFunc           func(cl int, args ...string) (string, error)
-	UsersFunc              func() ([]p4lib.User, error)
-	VerifiedUnshelveFunc   func(cl int) (string, error)
-	WhereFunc              func(path string) (string, error)
-	WhereExFunc            func(paths []string) ([]string, error)
-	MoveFunc               func(cl int, from string, to string) (string, error)
+	AddFunc                    func(paths []string, options ...string) (string, error)
+	AddDirFunc                 func(dir string, options ...string) (string, error)
+	ChangeFunc                 func(desc string) (int, error)
+	ChangeUpdateFunc           func(desc string, cl int) error
+	ChangeUpdateForceFunc      func(desc string, cl int) error
+	ChangesFunc                func(args ...string) ([]p4lib.Change, error)
+	ChangeRiskFunc             func(cl int) (*p4lib.ChangeRisk, error)
+	ClientFunc                 func(clientName string) (*p4lib.Client, error)
+	ClientSetFunc              func(client *p4lib.Client) (string, error)
+	ClientsFunc                func() ([]string, error)
+	DeleteFunc                 func(paths []string, cl int) (string, error)
+	DescribeFunc               func(cl []int) ([]p4lib.Description, error)
+	DescribeShelvedFunc        func(cls ...int) ([]p4lib.Description, error)
+	DescribeShelvedPartialFunc func(cls ...int) ([]p4lib.Description, map[int]error)
+	DescribeWithMovesFunc      func(cl int) (*p4lib.MovesDescription, error)
+	DiffFileFunc               func(file string) error
+	DiffFunc                   func(file0 string, file1 string) ([]p4lib.Diff, error)
+	Diff2Func                  func(file0 string, file1 string) ([]p4lib.Diff, error)
+	Diff2AtFunc                func(file0 string, rev0 p4lib.RevSpec, file1 string, rev1 p4lib.RevSpec) ([]p4lib.Diff, error)
+	DiffShelfFunc              func(cl int, against p4lib.RevSpec) ([]p4lib.ShelfDiff, error)
+	DirsFunc                   func(root string) ([]string, error)
+	EditFunc                   func(paths []string, cl int) (string, error)
+	ExecCmdFunc                func(args ...string) (string, error)
+	ExecCmdWithOptionsFunc     func(args []string, opts ...p4lib.Option) (string, error)
+	ExecCmdWithResultFunc      func(args []string, opts ...p4lib.Option) (*p4lib.Result, error)
+	FilesFunc                  func(files ...string) ([]p4lib.FileDetails, error)
+	FilesAtFunc                func(rev p4lib.RevSpec, paths ...string) ([]p4lib.FileDetails, error)
+	FstatFunc                  func(args ...string) (*p4lib.FstatResult, error)
+	FstatAtFunc                func(rev p4lib.RevSpec, paths ...string) (*p4lib.FstatResult, error)
+	GrepFunc                   func(pattern string, caseSensitive bool, depotPaths ...string) ([]p4lib.Grep, error)
+	GrepLargeFunc              func(pattern string, depotPath string, caseSensitive bool, status *p4lib.GrepStatus) error
+	HaveFunc                   func(patterns ...string) ([]p4lib.File, error)
+	IndexFunc                  func(name string, attr int, values ...string) error
+	IndexDeleteFunc            func(name string, attr int, values ...string) error
+	InfoFunc                   func() (*p4lib.Info, error)
+	IgnoresFunc                func(paths []string) (string, error)
+	KeyGetFunc                 func(key string) (string, error)
+	KeySetFunc                 func(key, val string) error
+	KeyIncFunc                 func(key string) (string, error)
+	KeyCasFunc                 func(key, oldval, newval string) error
+	KeysFunc                   func(pattern string) (map[string]string, error)
+	LimitsFunc                 func() (*p4lib.Limits, error)
+	LoginFunc                  func(user string) (string, time.Time, error)
+	OpenedFunc                 func(change string) ([]p4lib.OpenedFile, error)
+	PrintFunc                  func(args ...string) (string, error)
+	PrintAtFunc                func(path string, rev p4lib.RevSpec) (string, error)
+	PrintExFunc                func(files ...string) ([]p4lib.FileDetails, error)
+	PrintTextFunc              func(opts p4lib.PrintOptions, files ...string) ([]p4lib.FileDetails, error)
+	PrintToStoreFunc           func(store *p4lib.ContentStore, files ...string) ([]p4lib.FileDetails, error)
+	ReconcileFunc              func(paths []string, cl int) (string, error)
+	ReconcilePreviewFunc       func(paths []string) (*p4lib.Reconciliation, error)
+	RevertFunc                 func(paths []string, opts ...string) (string, error)
+	SetFunc                    func(key, value string) error
+	SizesFunc                  func(dirs ...string) (*p4lib.SizeCollection, error)
+	SubmitFunc                 func(cl int, options ...string) (string, error)
+	SyncFunc                   func(targets []string, options ...string) (string, error)
+	SyncSizeFunc               func(targets []string) (*p4lib.SyncSize, error)
+	TicketsFunc                func(args ...string) ([]p4lib.Ticket, error)
+	TrustFunc                  func(args ...string) error
+	UnshelveFunc               func(cl int, args ...string) (string, error)
+	UsersFunc                  func() ([]p4lib.User, error)
+	VerifiedUnshelveFunc       func(cl int) (string, error)
+	WhereFunc                  func(path string) (string, error)
+	WhereExFunc                func(paths []string) ([]string, error)
+	MoveFunc                   func(cl int, from string, to string) (string, error)
 }
 
 func New() Mock {
@@ -128,6 +142,13 @@ func (p4 Mock) ChangeUpdate(desc string, cl int) error {
 	return p4.ChangeUpdateFunc(desc, cl)
 }
 
+func (p4 Mock) ChangeUpdateForce(desc string, cl int) error {
+	if p4.ChangeUpdateForceFunc == nil {
+		return fmt.Errorf("ChangeUpdateForceFunc not set")
+	}
+	return p4.ChangeUpdateForceFunc(desc, cl)
+}
+
 func (p4 Mock) Changes(args ...string) ([]p4lib.Change, error) {
 	if p4.ChangesFunc == nil {
 		return nil, fmt.Errorf("Changes not set")
@@ -135,6 +156,13 @@ func (p4 Mock) Changes(args ...string) ([]p4lib.Change, error) {
 	return p4.ChangesFunc(args...)
 }
 
+func (p4 Mock) ChangeRisk(cl int) (*p4lib.ChangeRisk, error) {
+	if p4.ChangeRiskFunc == nil {
+		return nil, fmt.Errorf("ChangeRiskFunc not set")
+	}
+	return p4.ChangeRiskFunc(cl)
+}
+
 func (p4 Mock) Client(clientName string) (*p4lib.Client, error) {
 	if p4.ClientFunc == nil {
 		return nil, fmt.Errorf("Client not set")
@@ -177,6 +205,24 @@ func (p4 Mock) DescribeShelved(cls ...int) ([]p4lib.Description, error) {
 	return p4.DescribeShelvedFunc(cls...)
 }
 
+func (p4 Mock) DescribeShelvedPartial(cls ...int) ([]p4lib.Description, map[int]error) {
+	if p4.DescribeShelvedPartialFunc == nil {
+		errs := map[int]error{}
+		for _, cl := range cls {
+			errs[cl] = fmt.Errorf("DescribeShelvedPartialFunc not set")
+		}
+		return nil, errs
+	}
+	return p4.DescribeShelvedPartialFunc(cls...)
+}
+
+func (p4 Mock) DescribeWithMoves(cl int) (*p4lib.MovesDescription, error) {
+	if p4.DescribeWithMovesFunc == nil {
+		return nil, fmt.Errorf("DescribeWithMovesFunc not set")
+	}
+	return p4.DescribeWithMovesFunc(cl)
+}
+
 func (p4 Mock) DiffFile(file string) error {
 	if p4.DiffFileFunc == nil {
 		return fmt.Errorf("DiffFileFunc not set")
@@ -199,6 +245,20 @@ func (p4 Mock) Diff2(file0 string, file1 string) ([]p4lib.Diff, error) {
 	return p4.Diff2Func(file0, file1)
 }
 
+func (p4 Mock) Diff2At(file0 string, rev0 p4lib.RevSpec, file1 string, rev1 p4lib.RevSpec) ([]p4lib.Diff, error) {
+	if p4.Diff2AtFunc == nil {
+		return nil, fmt.Errorf("Diff2AtFunc not set")
+	}
+	return p4.Diff2AtFunc(file0, rev0, file1, rev1)
+}
+
+func (p4 Mock) DiffShelf(cl int, against p4lib.RevSpec) ([]p4lib.ShelfDiff, error) {
+	if p4.DiffShelfFunc == nil {
+		return nil, fmt.Errorf("DiffShelfFunc not set")
+	}
+	return p4.DiffShelfFunc(cl, against)
+}
+
 func (p4 Mock) Dirs(root string) ([]string, error) {
 	if p4.DirsFunc == nil {
 		return nil, fmt.Errorf("DirsFunc not set")
@@ -227,6 +287,13 @@ func (p4 Mock) ExecCmdWithOptions(args []string, opts ...p4lib.Option) (string,
 	return p4.ExecCmdWithOptionsFunc(args, opts...)
 }
 
+func (p4 Mock) ExecCmdWithResult(args []string, opts ...p4lib.Option) (*p4lib.Result, error) {
+	if p4.ExecCmdWithResultFunc == nil {
+		return nil, fmt.Errorf("ExecCmdWithResultFunc not set")
+	}
+	return p4.ExecCmdWithResultFunc(args, opts...)
+}
+
 func (p4 Mock) Files(files ...string) ([]p4lib.FileDetails, error) {
 	if p4.FilesFunc == nil {
 		return nil, fmt.Errorf("FilesFunc not set")
@@ -234,6 +301,13 @@ func (p4 Mock) Files(files ...string) ([]p4lib.FileDetails, error) {
 	return p4.FilesFunc(files...)
 }
 
+func (p4 Mock) FilesAt(rev p4lib.RevSpec, paths ...string) ([]p4lib.FileDetails, error) {
+	if p4.FilesAtFunc == nil {
+		return nil, fmt.Errorf("FilesAtFunc not set")
+	}
+	return p4.FilesAtFunc(rev, paths...)
+}
+
 func (p4 Mock) Fstat(args ...string) (*p4lib.FstatResult, error) {
 	if p4.FstatFunc == nil {
 		return nil, fmt.Errorf("FstatFunc not set")
@@ -241,6 +315,13 @@ func (p4 Mock) Fstat(args ...string) (*p4lib.FstatResult, error) {
 	return p4.FstatFunc(args...)
 }
 
+func (p4 Mock) FstatAt(rev p4lib.RevSpec, paths ...string) (*p4lib.FstatResult, error) {
+	if p4.FstatAtFunc == nil {
+		return nil, fmt.Errorf("FstatAtFunc not set")
+	}
+	return p4.FstatAtFunc(rev, paths...)
+}
+
 func (p4 Mock) Grep(pattern string, caseSensitive bool, depotPaths ...string) ([]p4lib.Grep, error) {
 	if p4.GrepFunc == nil {
 		return nil, fmt.Errorf("GrepFunc not set")
@@ -325,6 +406,13 @@ func (p4 Mock) Keys(pattern string) (map[string]string, error) {
 	return p4.KeysFunc(pattern)
 }
 
+func (p4 Mock) Limits() (*p4lib.Limits, error) {
+	if p4.LimitsFunc == nil {
+		return nil, fmt.Errorf("LimitsFunc not set")
+	}
+	return p4.LimitsFunc()
+}
+
 func (p4 Mock) Login(user string) (string, time.Time, error) {
 	if p4.LoginFunc == nil {
 		return "", time.Time{}, fmt.Errorf("LoginFunc not set")
@@ -346,6 +434,13 @@ func (p4 Mock) Print(args ...string) (string, error) {
 	return p4.PrintFunc(args...)
 }
 
+func (p4 Mock) PrintAt(path string, rev p4lib.RevSpec) (string, error) {
+	if p4.PrintAtFunc == nil {
+		return "", fmt.Errorf("PrintAtFunc not set")
+	}
+	return p4.PrintAtFunc(path, rev)
+}
+
 func (p4 Mock) PrintEx(files ...string) ([]p4lib.FileDetails, error) {
 	if p4.PrintExFunc == nil {
 		return nil, fmt.Errorf("PrintExFunc not set")
@@ -353,6 +448,20 @@ func (p4 Mock) PrintEx(files ...string) ([]p4lib.FileDetails, error) {
 	return p4.PrintExFunc(files...)
 }
 
+func (p4 Mock) PrintText(opts p4lib.PrintOptions, files ...string) ([]p4lib.FileDetails, error) {
+	if p4.PrintTextFunc == nil {
+		return nil, fmt.Errorf("PrintTextFunc not set")
+	}
+	return p4.PrintTextFunc(opts, files...)
+}
+
+func (p4 Mock) PrintToStore(store *p4lib.ContentStore, files ...string) ([]p4lib.FileDetails, error) {
+	if p4.PrintToStoreFunc == nil {
+		return nil, fmt.Errorf("PrintToStoreFunc not set")
+	}
+	return p4.PrintToStoreFunc(store, files...)
+}
+
 func (p4 Mock) Reconcile(paths []string, cl int) (string, error) {
 	if p4.ReconcileFunc == nil {
 		return "", fmt.Errorf("ReconcileFunc not set")
@@ -360,6 +469,13 @@ func (p4 Mock) Reconcile(paths []string, cl int) (string, error) {
 	return p4.ReconcileFunc(paths, cl)
 }
 
+func (p4 Mock) ReconcilePreview(paths []string) (*p4lib.Reconciliation, error) {
+	if p4.ReconcilePreviewFunc == nil {
+		return nil, fmt.Errorf("ReconcilePreviewFunc not set")
+	}
+	return p4.ReconcilePreviewFunc(paths)
+}
+
 func (p4 Mock) Revert(paths []string, opts ...string) (string, error) {
 	if p4.RevertFunc == nil {
 		return "", fmt.Errorf("RevertFunc not set")
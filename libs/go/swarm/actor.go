@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"sge-monorepo/libs/go/log"
+)
+
+// Headers attached to every request made on behalf of an Actor. Swarm ignores them, but they end up
+// in the access logs of the web server and any proxy in front of it.
+const (
+	actorPipelineHeader = "X-Sge-Pipeline"
+	actorRunHeader      = "X-Sge-Run-Id"
+)
+
+// Actor identifies an automated system acting through a Context, eg. a CI pipeline. Bots usually
+// share a single service account, so without an actor it is unclear which of them commented on or
+// voted on a review.
+//
+// When a Context has an actor:
+//   - Every comment added or updated gets a signature naming the actor (see Sign).
+//   - Every request carries the actor in its headers.
+//   - Every request that modifies Swarm is logged with the actor's audit label.
+type Actor struct {
+	// Pipeline is the name of the system acting, eg. "presubmit". Must not contain spaces.
+	Pipeline string
+
+	// RunID identifies the run of the pipeline, eg. a presubmit id. Must not contain spaces.
+	RunID string
+
+	// URL optionally points to the results of the run.
+	URL string
+}
+
+// Label returns the audit label of the actor, "<pipeline>/<run id>".
+func (a Actor) Label() string {
+	if a.RunID == "" {
+		return a.Pipeline
+	}
+	return a.Pipeline + "/" + a.RunID
+}
+
+// signatureRe matches a signature appended by Sign. The signature is always the last line.
+var signatureRe = regexp.MustCompile(`\n\n-- sge-bot pipeline=(\S+)(?: run=(\S+))?(?: url=(\S+))?$`)
+
+// Sign returns |body| with the signature of the actor appended. The signature is a single line in
+// the form:
+//
+//      -- sge-bot pipeline=presubmit run=1234-abcd url=https://ci/runs/1234-abcd
+//
+// Any previous signature is replaced, so signing is idempotent.
+func (a Actor) Sign(body string) string {
+	body = signatureRe.ReplaceAllString(body, "")
+	var sb strings.Builder
+	sb.WriteString(body)
+	sb.WriteString("\n\n-- sge-bot pipeline=")
+	sb.WriteString(a.Pipeline)
+	if a.RunID != "" {
+		sb.WriteString(" run=")
+		sb.WriteString(a.RunID)
+	}
+	if a.URL != "" {
+		sb.WriteString(" url=")
+		sb.WriteString(a.URL)
+	}
+	return sb.String()
+}
+
+// ParseSignature returns the actor that signed |body|, if any.
+func ParseSignature(body string) (Actor, bool) {
+	m := signatureRe.FindStringSubmatch(body)
+	if m == nil {
+		return Actor{}, false
+	}
+	return Actor{Pipeline: m[1], RunID: m[2], URL: m[3]}, true
+}
+
+// WithActor returns a copy of the context that acts on behalf of |actor|.
+func (ctx *Context) WithActor(actor Actor) *Context {
+	c := *ctx
+	c.Actor = &actor
+	return &c
+}
+
+// Impersonate returns a copy of the context that makes requests as |user|. Swarm has no header to
+// act as another user, so this authenticates with |ticket|, a perforce ticket of |user|. Only super
+// users can get tickets of other users, eg. with "p4 login -a -p <user>".
+//
+// If the context has an actor, comments made as |user| are still signed by it.
+func (ctx *Context) Impersonate(user, ticket string) *Context {
+	c := *ctx
+	c.Username = user
+	c.Password = ticket
+	return &c
+}
+
+// auditRequest labels a request with the actor of the context and logs it if it modifies Swarm.
+func (ctx *Context) auditRequest(req *http.Request) {
+	if ctx.Actor == nil {
+		return
+	}
+	req.Header.Set(actorPipelineHeader, ctx.Actor.Pipeline)
+	if ctx.Actor.RunID != "" {
+		req.Header.Set(actorRunHeader, ctx.Actor.RunID)
+	}
+	if req.Method != http.MethodGet {
+		log.Infof("swarm audit: %s %s as %s by %s", req.Method, req.URL.Path, ctx.Username, ctx.Actor.Label())
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"fmt"
+	"sort"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// Anchor is the position of an inline comment in a version of a review.
+type Anchor struct {
+	Comment int    `json:"comment"` // id of the comment
+	File    string `json:"file"`    // depot file
+	Version int    `json:"version"` // version of the review the position is in
+	Line    int    `json:"line"`    // right-side line, 0 if outdated
+	// Outdated is set when the commented line was changed or deleted since the comment was made,
+	// or the file can't be diffed between both versions. Line is then 0.
+	Outdated bool `json:"outdated"`
+}
+
+// MapLine maps |line| of the left file of |diffs| to the right file. Returns false if the line was
+// changed or deleted.
+func MapLine(diffs []p4lib.Diff, line int) (int, bool) {
+	sorted := append([]p4lib.Diff{}, diffs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].LeftStartLine < sorted[j].LeftStartLine })
+	delta := 0
+	for _, d := range sorted {
+		right := d.RightEndLine - d.RightStartLine + 1
+		left := d.LeftEndLine - d.LeftStartLine + 1
+		switch d.DiffType {
+		case p4lib.DiffAdd:
+			// Lines are added after LeftStartLine.
+			if line <= d.LeftStartLine {
+				return line + delta, true
+			}
+			delta += right
+		case p4lib.DiffDelete, p4lib.DiffChange:
+			if line < d.LeftStartLine {
+				return line + delta, true
+			}
+			if line <= d.LeftEndLine {
+				return 0, false
+			}
+			if d.DiffType == p4lib.DiffDelete {
+				right = 0
+			}
+			delta += right - left
+		}
+	}
+	return line + delta, true
+}
+
+// versionRev returns the revision of the files of |version| of |review|. Versions are 1-based.
+func versionRev(review *Review, version int) (p4lib.RevSpec, error) {
+	if version < 1 || version > len(review.Versions) {
+		return p4lib.RevSpec{}, fmt.Errorf("review %d has no version %d", review.ID, version)
+	}
+	v := review.Versions[version-1]
+	if v.Pending {
+		return p4lib.AtShelvedChange(v.Change), nil
+	}
+	return p4lib.AtChange(v.Change), nil
+}
+
+// ReanchorComments maps the inline comments of |review| to |version| of the review, so threads
+// follow the code they comment on as new versions are shelved. Lines are mapped with a diff of each
+// file between the version the comment was made on and |version|. Comments on the left side of
+// the diff and comments without a file are not anchored. Returns the anchors by comment id.
+func ReanchorComments(p4 p4lib.P4, review *Review, comments []Comment, version int) (map[int]Anchor, error) {
+	to, err := versionRev(review, version)
+	if err != nil {
+		return nil, fmt.Errorf("swarm.ReanchorComments: %w", err)
+	}
+	type diffKey struct {
+		file    string
+		version int
+	}
+	type diffResult struct {
+		diffs []p4lib.Diff
+		err   error
+	}
+	diffs := map[diffKey]diffResult{}
+	anchors := map[int]Anchor{}
+	for _, c := range comments {
+		cc := c.Context
+		if cc == nil || cc.File == "" || cc.RightLine == 0 {
+			continue
+		}
+		a := Anchor{Comment: c.ID, File: cc.File, Version: version, Line: cc.RightLine}
+		from := int(cc.Version)
+		if from == version || from == 0 {
+			// Comments without a version are on the latest version as of when they were made, which
+			// can't be told apart from the others, so they are left where they are.
+			anchors[c.ID] = a
+			continue
+		}
+		key := diffKey{cc.File, from}
+		r, ok := diffs[key]
+		if !ok {
+			fromRev, err := versionRev(review, from)
+			if err != nil {
+				r.err = err
+			} else {
+				r.diffs, r.err = p4.Diff2At(cc.File, fromRev, cc.File, to)
+			}
+			if r.err != nil {
+				log.Warningf("couldn't diff %s between versions %d and %d of review %d: %v", cc.File, from, version, review.ID, r.err)
+			}
+			diffs[key] = r
+		}
+		if r.err == nil {
+			a.Line, ok = MapLine(r.diffs, cc.RightLine)
+		}
+		if r.err != nil || !ok {
+			a.Line, a.Outdated = 0, true
+		}
+		anchors[c.ID] = a
+	}
+	return anchors, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive exports Swarm reviews, with their versions, comment threads and test runs, to a
+// stable JSON schema for archival outside Swarm, and imports them back into a Swarm instance, eg.
+// a test one.
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"sge-monorepo/libs/go/swarm"
+)
+
+// SchemaVersion is the version of the schema of archived reviews. Fields may be added without
+// changing it, it changes when fields change meaning or are removed.
+const SchemaVersion = 1
+
+// Review is an archived review.
+type Review struct {
+	Schema int `json:"schema"`
+	// Exported is the unix time the review was exported at.
+	Exported int64 `json:"exported"`
+
+	ID          int    `json:"id"`
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	State       string `json:"state"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+	// Changes are the changes of the review, Commits the submitted ones.
+	Changes      []int         `json:"changes"`
+	Commits      []int         `json:"commits,omitempty"`
+	Participants []Participant `json:"participants"`
+	Versions     []Version     `json:"versions"`
+	Threads      []Thread      `json:"threads,omitempty"`
+	TestRuns     []TestRun     `json:"testRuns,omitempty"`
+}
+
+// Participant is a participant of a review, sorted by user.
+type Participant struct {
+	User     string `json:"user"`
+	Required bool   `json:"required,omitempty"`
+	// Vote is 1 for an up vote, -1 for a down vote, cast on version VoteVersion.
+	Vote        int `json:"vote,omitempty"`
+	VoteVersion int `json:"voteVersion,omitempty"`
+	// Approvals are the versions the participant approved.
+	Approvals []int `json:"approvals,omitempty"`
+}
+
+// Version is a version of a review. Versions are numbered from 1.
+type Version struct {
+	Number  int    `json:"number"`
+	Change  int    `json:"change"`
+	Pending bool   `json:"pending,omitempty"`
+	Time    int64  `json:"time"`
+	User    string `json:"user"`
+}
+
+// Thread is a comment and its replies, oldest first. Threads without file are about the whole
+// review.
+type Thread struct {
+	File      string    `json:"file,omitempty"`
+	LeftLine  int       `json:"leftLine,omitempty"`
+	RightLine int       `json:"rightLine,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Comments  []Comment `json:"comments"`
+}
+
+// Comment is a comment of a thread.
+type Comment struct {
+	ID   int    `json:"id"`
+	User string `json:"user"`
+	Body string `json:"body"`
+	Time int64  `json:"time"`
+	// Edited is the unix time of the last edit, 0 if never edited.
+	Edited    int64    `json:"edited,omitempty"`
+	TaskState string   `json:"taskState,omitempty"`
+	Likes     []string `json:"likes,omitempty"`
+	Flags     []string `json:"flags,omitempty"`
+}
+
+// TestRun is a test run of a version of a review.
+type TestRun struct {
+	ID            int      `json:"id"`
+	Version       int      `json:"version"`
+	Test          string   `json:"test"`
+	Status        string   `json:"status"`
+	StartTime     int64    `json:"startTime"`
+	CompletedTime int64    `json:"completedTime,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	Messages      []string `json:"messages,omitempty"`
+}
+
+// Encode returns the JSON of |r|.
+func Encode(r *Review) ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// Decode parses a review written by Encode.
+func Decode(data []byte) (*Review, error) {
+	r := &Review{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("could not parse archived review: %v", err)
+	}
+	if r.Schema < 1 || r.Schema > SchemaVersion {
+		return nil, fmt.Errorf("unsupported archive schema version %d, want at most %d", r.Schema, SchemaVersion)
+	}
+	return r, nil
+}
+
+// Export returns review |id| of Swarm, with its comments and test runs.
+func Export(ctx *swarm.Context, id int) (*Review, error) {
+	sr, err := swarm.GetReview(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get review %d: %w", id, err)
+	}
+	if sr == nil {
+		return nil, fmt.Errorf("review %d not found", id)
+	}
+	r := fromSwarm(sr)
+	r.Exported = time.Now().Unix()
+	comments, err := swarm.GetCommentsForReview(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get comments of review %d: %w", id, err)
+	}
+	r.Threads = threads(comments.Comments)
+	for _, v := range r.Versions {
+		runs, err := swarm.TestRunDetails(ctx, id, v.Number)
+		if err != nil {
+			return nil, fmt.Errorf("could not get test runs of version %d of review %d: %w", v.Number, id, err)
+		}
+		for _, tr := range runs {
+			r.TestRuns = append(r.TestRuns, TestRun{
+				ID:            tr.ID,
+				Version:       tr.Version,
+				Test:          tr.Test,
+				Status:        tr.Status,
+				StartTime:     tr.StartTime,
+				CompletedTime: tr.CompletedTime,
+				URL:           tr.URL,
+				Messages:      tr.Messages,
+			})
+		}
+	}
+	sort.Slice(r.TestRuns, func(i, j int) bool { return r.TestRuns[i].ID < r.TestRuns[j].ID })
+	return r, nil
+}
+
+// fromSwarm returns the metadata and versions of |sr|.
+func fromSwarm(sr *swarm.Review) *Review {
+	r := &Review{
+		Schema:      SchemaVersion,
+		ID:          sr.ID,
+		Author:      sr.Author,
+		Description: sr.Description,
+		State:       sr.State,
+		Created:     int64(sr.Created),
+		Updated:     int64(sr.Updated),
+		Changes:     sr.Changes,
+		Commits:     sr.Commits,
+	}
+	for user, p := range sr.Participants {
+		r.Participants = append(r.Participants, Participant{
+			User:        user,
+			Required:    p.Required,
+			Vote:        p.Vote.Value,
+			VoteVersion: p.Vote.Version,
+			Approvals:   sr.Approvals[user],
+		})
+	}
+	sort.Slice(r.Participants, func(i, j int) bool { return r.Participants[i].User < r.Participants[j].User })
+	for i, v := range sr.Versions {
+		r.Versions = append(r.Versions, Version{
+			Number:  i + 1,
+			Change:  v.Change,
+			Pending: v.Pending,
+			Time:    int64(v.Time),
+			User:    v.User,
+		})
+	}
+	return r
+}
+
+// threads groups |comments| by the comment they reply to. Threads are sorted by their first
+// comment.
+func threads(comments []swarm.Comment) []Thread {
+	byID := map[int]*swarm.Comment{}
+	for i := range comments {
+		byID[comments[i].ID] = &comments[i]
+	}
+	// root returns the comment starting the thread of |c|.
+	root := func(c *swarm.Comment) *swarm.Comment {
+		for seen := map[int]bool{}; c.Context != nil && c.Context.Comment != 0 && !seen[c.ID]; {
+			seen[c.ID] = true
+			parent, ok := byID[c.Context.Comment]
+			if !ok {
+				break
+			}
+			c = parent
+		}
+		return c
+	}
+	index := map[int]int{}
+	var ret []Thread
+	sorted := append([]swarm.Comment(nil), comments...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	for i := range sorted {
+		c := &sorted[i]
+		r := root(byID[c.ID])
+		t, ok := index[r.ID]
+		if !ok {
+			t = len(ret)
+			index[r.ID] = t
+			thread := Thread{}
+			if r.Context != nil {
+				thread.File = r.Context.File
+				thread.LeftLine = r.Context.LeftLine
+				thread.RightLine = r.Context.RightLine
+				thread.Version = int(r.Context.Version)
+			}
+			ret = append(ret, thread)
+		}
+		comment := Comment{
+			ID:        c.ID,
+			User:      c.User,
+			Body:      c.Body,
+			Time:      int64(c.Time),
+			TaskState: c.TaskState,
+			Likes:     c.Likes,
+			Flags:     c.Flags,
+		}
+		if c.Edited != nil {
+			comment.Edited = int64(*c.Edited)
+		}
+		ret[t].Comments = append(ret[t].Comments, comment)
+	}
+	return ret
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/libs/go/swarm/swarmfake"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// addReview adds |review| to |server| as review |id| of alice with two versions, a comment thread
+// on a file, a review comment and a test run.
+func addReview(t *testing.T, server *swarmfake.Server, id int, review swarm.Review) {
+	t.Helper()
+	review.ID = id
+	review.Author = "alice"
+	review.Description = "Speed up blur"
+	review.Changes = []int{id - 2, id - 1}
+	review.Participants = map[string]swarm.Participant{
+		"alice": {},
+		"bob":   {Required: true, Vote: swarm.Vote{Value: 1, Version: 2}},
+	}
+	review.Approvals = map[string][]int{"bob": {2}}
+	review.Versions = []swarm.Version{
+		{Change: id - 2, Time: 100, User: "alice"},
+		{Change: id - 1, Time: 200, User: "alice"},
+	}
+	server.AddReview(review)
+	ctx := server.Context()
+	topic := fmt.Sprintf("reviews/%d", id)
+	root, err := swarm.AddCommentEx(ctx, &swarm.Comment{
+		Topic:   topic,
+		Body:    "Why not a compute shader?",
+		Context: &swarm.CommentContext{File: "//depot/render/blur.hlsl", RightLine: 12},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*swarm.Comment{
+		{Topic: topic, Body: "LGTM"},
+		{Topic: topic, Body: "Not supported on all platforms.", Context: &swarm.CommentContext{Comment: root.ID}},
+	} {
+		if _, err := swarm.AddCommentEx(ctx, c, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr, err := swarm.CreateTestRun(ctx, id, 2, "uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swarm.SendTestRunRequest(ctx, swarm.TestRunPass, swarmfake.UpdateURL(tr), "http://ci/1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clearTimes zeroes the times the fake server sets, to compare archives.
+func clearTimes(r *Review) {
+	r.Exported = 0
+	for i := range r.Threads {
+		for j := range r.Threads[i].Comments {
+			r.Threads[i].Comments[j].Time = 0
+		}
+	}
+	for i := range r.TestRuns {
+		r.TestRuns[i].StartTime = 0
+		r.TestRuns[i].CompletedTime = 0
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	server := swarmfake.New()
+	defer server.Close()
+	addReview(t, server, 12, swarm.Review{State: "approved", Commits: []int{11}, Created: 100, Updated: 300})
+
+	got, err := Export(server.Context(), 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Exported == 0 {
+		t.Errorf("Export() didn't set the export time")
+	}
+	clearTimes(got)
+	want := &Review{
+		Schema:      SchemaVersion,
+		ID:          12,
+		Author:      "alice",
+		Description: "Speed up blur",
+		State:       "approved",
+		Created:     100,
+		Updated:     300,
+		Changes:     []int{10, 11},
+		Commits:     []int{11},
+		Participants: []Participant{
+			{User: "alice"},
+			{User: "bob", Required: true, Vote: 1, VoteVersion: 2, Approvals: []int{2}},
+		},
+		Versions: []Version{
+			{Number: 1, Change: 10, Time: 100, User: "alice"},
+			{Number: 2, Change: 11, Time: 200, User: "alice"},
+		},
+		Threads: []Thread{
+			{
+				File:      "//depot/render/blur.hlsl",
+				RightLine: 12,
+				Comments: []Comment{
+					{ID: 1, User: "swarmfake", Body: "Why not a compute shader?"},
+					{ID: 3, User: "swarmfake", Body: "Not supported on all platforms."},
+				},
+			},
+			{Comments: []Comment{{ID: 2, User: "swarmfake", Body: "LGTM"}}},
+		},
+		TestRuns: []TestRun{{ID: 1, Version: 2, Test: "project:presubmit:test", Status: "pass", URL: "http://ci/1", Messages: []string{"presubmit was successful"}}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Export() diff (-want +got):\n%s", diff)
+	}
+
+	// The archive survives encoding.
+	data, err := Encode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, decoded); diff != "" {
+		t.Errorf("Decode(Encode()) diff (-want +got):\n%s", diff)
+	}
+	if _, err := Decode([]byte(`{"schema": 99}`)); err == nil {
+		t.Errorf("Decode() of a newer schema succeeded")
+	}
+
+	// Import into another instance.
+	test := swarmfake.New()
+	defer test.Close()
+	imported, err := Import(test.Context(), decoded, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Description != "Speed up blur" || imported.Changes[0] != 500 {
+		t.Errorf("Import() = %+v, want a review of change 500", imported)
+	}
+	comments := test.Comments(imported.ID)
+	var bodies []string
+	for _, c := range comments {
+		parent := 0
+		if c.Context != nil {
+			parent = c.Context.Comment
+		}
+		bodies = append(bodies, fmt.Sprintf("%d<-%d %s", c.ID, parent, c.Body))
+	}
+	wantBodies := []string{
+		"1<-0 " + Summary(decoded),
+		"2<-0 swarmfake wrote on 1970-01-01 00:00 UTC:\n\nWhy not a compute shader?",
+		"3<-2 swarmfake wrote on 1970-01-01 00:00 UTC:\n\nNot supported on all platforms.",
+		"4<-0 swarmfake wrote on 1970-01-01 00:00 UTC:\n\nLGTM",
+	}
+	if diff := cmp.Diff(wantBodies, bodies); diff != "" {
+		t.Errorf("imported comments diff (-want +got):\n%s", diff)
+	}
+	if c := comments[1].Context; c == nil || c.File != "//depot/render/blur.hlsl" || c.RightLine != 12 {
+		t.Errorf("imported comment context = %+v, want on blur.hlsl line 12", c)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	r := &Review{
+		ID:      12,
+		Author:  "alice",
+		State:   "approved",
+		Created: 86400,
+		Commits: []int{11},
+		Participants: []Participant{
+			{User: "alice"},
+			{User: "bob", Required: true, Vote: 1, VoteVersion: 2},
+			{User: "carol", Vote: -1, VoteVersion: 1},
+		},
+		TestRuns: []TestRun{{Version: 2, Test: "presubmit", Status: "pass", URL: "http://ci/1"}},
+	}
+	want := "Imported from archived review 12 by alice, created 1970-01-02 00:00 UTC, approved.\n" +
+		"Submitted in 11.\n" +
+		"- bob (required): +1 on version 2\n" +
+		"- carol: -1 on version 1\n" +
+		"Test run presubmit of version 2: pass http://ci/1\n"
+	if diff := cmp.Diff(want, Summary(r)); diff != "" {
+		t.Errorf("Summary() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestArchiveClosed(t *testing.T) {
+	server := swarmfake.New()
+	defer server.Close()
+	now := time.Unix(10000, 0)
+	old, recent := 1000, 9000
+	addReview(t, server, 12, swarm.Review{State: "approved", Commits: []int{11}, Updated: old})
+	addReview(t, server, 22, swarm.Review{State: "rejected", Updated: old})
+	addReview(t, server, 32, swarm.Review{State: "approved", Pending: true, Updated: old})
+	addReview(t, server, 42, swarm.Review{State: "needsReview", Updated: old})
+	addReview(t, server, 52, swarm.Review{State: "archived", Updated: recent})
+	addReview(t, server, 62, swarm.Review{State: "archived", Updated: old})
+
+	store := NewDirStore(t.TempDir())
+	if err := store.Put(62, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ArchiveClosed(server.Context(), store, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]int{12, 22}, got); diff != "" {
+		t.Errorf("ArchiveClosed() diff (-want +got):\n%s", diff)
+	}
+	data, err := store.Get(22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := Decode(data); err != nil || r.ID != 22 || len(r.Threads) != 2 {
+		t.Errorf("archived review 22 = %+v, %v", r, err)
+	}
+	if _, err := store.Get(32); err != ErrNotFound {
+		t.Errorf("Get() of a review still pending = %v, want ErrNotFound", err)
+	}
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ids)
+	if diff := cmp.Diff([]int{12, 22, 62}, ids); diff != "" {
+		t.Errorf("List() diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs implements an archived review store on Google Cloud Storage.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"sge-monorepo/libs/go/swarm/archive"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// NewStore returns a store that keeps archived reviews as objects under |prefix| in a GCS bucket.
+func NewStore(ctx context.Context, bucket, prefix string) (archive.Store, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCS client: %v", err)
+	}
+	return &gcsStore{
+		ctx:    ctx,
+		bkt:    client.Bucket(bucket),
+		prefix: prefix,
+	}, nil
+}
+
+type gcsStore struct {
+	ctx    context.Context
+	bkt    *storage.BucketHandle
+	prefix string
+}
+
+func (gs *gcsStore) object(id int) *storage.ObjectHandle {
+	return gs.bkt.Object(path.Join(gs.prefix, archive.Key(id)))
+}
+
+func (gs *gcsStore) Put(id int, data []byte) error {
+	w := gs.object(id).NewWriter(gs.ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (gs *gcsStore) Get(id int) ([]byte, error) {
+	r, err := gs.object(id).NewReader(gs.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, archive.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (gs *gcsStore) List() ([]int, error) {
+	// Objects are named as by object: directly under the prefix, if any.
+	q := &storage.Query{Delimiter: "/"}
+	if gs.prefix != "" {
+		q.Prefix = path.Clean(gs.prefix) + "/"
+	}
+	var ids []int
+	it := gs.bkt.Objects(gs.ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if id, ok := archive.ParseKey(strings.TrimPrefix(attrs.Name, q.Prefix)); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
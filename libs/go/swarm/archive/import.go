@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/swarm"
+)
+
+// Import restores archived review |r| into the Swarm instance of |ctx| as a review of |change|, a
+// pending change with shelved files of that instance. Comment threads are restored, as comments of
+// the user of |ctx| quoting their original author and time. Participants, votes and test runs
+// can't be restored as such, they are summed up in a first comment. Notifications aren't sent.
+func Import(ctx *swarm.Context, r *Review, change int) (*swarm.Review, error) {
+	sr, err := swarm.CreateReview(ctx, &swarm.NewReview{Change: change, Description: r.Description})
+	if err != nil {
+		return nil, fmt.Errorf("could not create review of change %d: %w", change, err)
+	}
+	topic := fmt.Sprintf("reviews/%d", sr.ID)
+	summary := &swarm.Comment{Topic: topic, Body: Summary(r)}
+	if _, err := swarm.AddCommentEx(ctx, summary, true); err != nil {
+		return nil, fmt.Errorf("could not add summary to review %d: %w", sr.ID, err)
+	}
+	for _, t := range r.Threads {
+		parent := 0
+		for _, c := range t.Comments {
+			comment := &swarm.Comment{
+				Topic: topic,
+				Body:  quote(&c),
+				Flags: c.Flags,
+			}
+			if parent != 0 {
+				comment.Context = &swarm.CommentContext{Comment: parent}
+			} else if t.File != "" {
+				comment.Context = &swarm.CommentContext{File: t.File, LeftLine: t.LeftLine, RightLine: t.RightLine}
+			}
+			added, err := swarm.AddCommentEx(ctx, comment, true)
+			if err != nil {
+				return nil, fmt.Errorf("could not add comment %d to review %d: %w", c.ID, sr.ID, err)
+			}
+			if parent == 0 {
+				parent = added.ID
+			}
+		}
+	}
+	return sr, nil
+}
+
+// Summary returns a description of the metadata of |r| that has no place in an imported review.
+func Summary(r *Review) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Imported from archived review %d by %s, created %s, %s.\n", r.ID, r.Author, formatTime(r.Created), r.State)
+	if len(r.Commits) > 0 {
+		var commits []string
+		for _, c := range r.Commits {
+			commits = append(commits, fmt.Sprint(c))
+		}
+		fmt.Fprintf(&b, "Submitted in %s.\n", strings.Join(commits, ", "))
+	}
+	for _, p := range r.Participants {
+		if p.User == r.Author {
+			continue
+		}
+		fmt.Fprintf(&b, "- %s", p.User)
+		if p.Required {
+			b.WriteString(" (required)")
+		}
+		switch {
+		case p.Vote > 0:
+			fmt.Fprintf(&b, ": +1 on version %d", p.VoteVersion)
+		case p.Vote < 0:
+			fmt.Fprintf(&b, ": -1 on version %d", p.VoteVersion)
+		}
+		b.WriteString("\n")
+	}
+	runs := append([]TestRun(nil), r.TestRuns...)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Version < runs[j].Version })
+	for _, tr := range runs {
+		fmt.Fprintf(&b, "Test run %s of version %d: %s", tr.Test, tr.Version, tr.Status)
+		if tr.URL != "" {
+			fmt.Fprintf(&b, " %s", tr.URL)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// quote returns the body of |c| as posted by someone else.
+func quote(c *Comment) string {
+	return fmt.Sprintf("%s wrote on %s:\n\n%s", c.User, formatTime(c.Time), c.Body)
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format("2006-01-02 15:04 MST")
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/swarm"
+)
+
+// ErrNotFound is returned by stores for reviews they don't have.
+var ErrNotFound = errors.New("archived review not found")
+
+// Store keeps archived reviews, encoded by Encode.
+type Store interface {
+	// Put stores |data| as archived review |id|, replacing any previous one.
+	Put(id int, data []byte) error
+	// Get returns archived review |id|, or ErrNotFound.
+	Get(id int) ([]byte, error)
+	// List returns the ids of the archived reviews, in any order.
+	List() ([]int, error)
+}
+
+// Key returns the name of archived review |id| in stores.
+func Key(id int) string {
+	return strconv.Itoa(id) + ".json"
+}
+
+// ParseKey returns the id of the archived review named |key| in stores, see Key.
+func ParseKey(key string) (int, bool) {
+	if !strings.HasSuffix(key, ".json") {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(key, ".json"))
+	return id, err == nil
+}
+
+// NewDirStore returns a store that keeps archived reviews as files under directory |root|.
+func NewDirStore(root string) Store {
+	return &dirStore{root: root}
+}
+
+type dirStore struct {
+	root string
+}
+
+func (ds *dirStore) Put(id int, data []byte) error {
+	if err := os.MkdirAll(ds.root, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(ds.root, Key(id)), data, 0644)
+}
+
+func (ds *dirStore) Get(id int) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ds.root, Key(id)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (ds *dirStore) List() ([]int, error) {
+	entries, err := ioutil.ReadDir(ds.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, e := range entries {
+		if id, ok := ParseKey(e.Name()); ok && !e.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// closedStates are the states of the reviews that may be closed, see Closed.
+const closedStates = "state[]=approved&state[]=rejected&state[]=archived"
+
+// Closed returns whether |r| is done with: submitted, rejected or archived.
+func Closed(r *swarm.Review) bool {
+	switch r.State {
+	case "rejected", "archived":
+		return true
+	case "approved":
+		return !bool(r.Pending) && len(r.Commits) > 0
+	}
+	return false
+}
+
+// ArchiveClosed exports to |store| the closed reviews last updated before |before| that it
+// doesn't have yet. Returns the ids of the reviews archived, ascending. Reviews that fail to
+// export are skipped and reported in the returned error, the others are still archived. The store
+// is listed once, rather than looked up for each of the closed reviews.
+func ArchiveClosed(ctx *swarm.Context, store Store, before time.Time) ([]int, error) {
+	reviews, err := swarm.GetReviews(ctx, closedStates)
+	if err != nil {
+		return nil, fmt.Errorf("could not get closed reviews: %w", err)
+	}
+	ids, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("could not list archived reviews: %w", err)
+	}
+	stored := map[int]bool{}
+	for _, id := range ids {
+		stored[id] = true
+	}
+	var archived []int
+	failed := 0
+	for i := range reviews.Reviews {
+		r := &reviews.Reviews[i]
+		if !Closed(r) || int64(r.Updated) >= before.Unix() || stored[r.ID] {
+			continue
+		}
+		if err := archive(ctx, store, r.ID); err != nil {
+			log.Warningf("could not archive review %d: %v", r.ID, err)
+			failed++
+			continue
+		}
+		archived = append(archived, r.ID)
+	}
+	sort.Ints(archived)
+	if failed > 0 {
+		return archived, fmt.Errorf("%d reviews failed to archive", failed)
+	}
+	return archived, nil
+}
+
+// archive exports review |id| to |store|.
+func archive(ctx *swarm.Context, store Store, id int) error {
+	r, err := Export(ctx, id)
+	if err != nil {
+		return err
+	}
+	data, err := Encode(r)
+	if err != nil {
+		return err
+	}
+	return store.Put(id, data)
+}
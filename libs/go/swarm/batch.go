@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"fmt"
+	"sync"
+
+	"sge-monorepo/libs/go/log"
+)
+
+// CommentBatch adds comments to a review with delayed notifications, and sends a single
+// notification for all of them when closed. Without it, participants get an email per comment.
+//
+// A CommentBatch is safe for concurrent use. Always close it, even on error paths, or the comments
+// already added are never notified:
+//
+//      batch := swarm.NewCommentBatch(ctx, review)
+//      defer batch.Close()
+//
+// or use WithCommentBatch, which does it for you.
+type CommentBatch struct {
+	ctx    *Context
+	review int
+
+	mu       sync.Mutex
+	pending  int
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// NewCommentBatch returns a batch of comments to |review|.
+func NewCommentBatch(ctx *Context, review int) *CommentBatch {
+	return &CommentBatch{ctx: ctx, review: review}
+}
+
+// Add adds |comment| to the review with its notification delayed until the batch is closed. The
+// topic of the comment defaults to the review of the batch.
+func (b *CommentBatch) Add(comment *Comment) (*Comment, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("swarm.CommentBatch: add to closed batch of review %d", b.review)
+	}
+	b.inFlight.Add(1)
+	b.mu.Unlock()
+	defer b.inFlight.Done()
+
+	c := *comment
+	if c.Topic == "" {
+		c.Topic = fmt.Sprintf("reviews/%d", b.review)
+	}
+	added, err := AddCommentEx(b.ctx, &c, true)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.pending++
+	b.mu.Unlock()
+	return added, nil
+}
+
+// Flush sends the notification for the comments added so far, if any. Returns any informational
+// message from Swarm.
+func (b *CommentBatch) Flush() (string, error) {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = 0
+	b.mu.Unlock()
+	if pending == 0 {
+		return "", nil
+	}
+	return SendNotifications(b.ctx, b.review)
+}
+
+// Close waits for the comments being added and flushes the batch. Comments can't be added to a
+// closed batch. Closing a batch more than once is a no-op.
+func (b *CommentBatch) Close() (string, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return "", nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+	b.inFlight.Wait()
+	return b.Flush()
+}
+
+// WithCommentBatch calls |fn| with a batch of comments to |review| and closes the batch when |fn|
+// returns, even if it fails or panics. Returns the message of the notification and the error of
+// |fn|, or of the notification if |fn| succeeded. Notification errors after |fn| failed are logged.
+func WithCommentBatch(ctx *Context, review int, fn func(*CommentBatch) error) (msg string, err error) {
+	batch := NewCommentBatch(ctx, review)
+	defer func() {
+		m, cerr := batch.Close()
+		msg = m
+		if cerr == nil {
+			return
+		}
+		cerr = fmt.Errorf("failed to send notifications for review %d: %v(%s)", review, cerr, m)
+		if err == nil {
+			err = cerr
+		} else {
+			log.Warningf("%v", cerr)
+		}
+	}()
+	return "", fn(batch)
+}
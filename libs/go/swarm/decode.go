@@ -0,0 +1,364 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"sge-monorepo/libs/go/log"
+)
+
+// Swarm is not consistent in how it serializes its responses: empty objects come back as empty
+// arrays, numbers come back quoted and booleans come back as numbers, depending on the endpoint and
+// on the Swarm version. The Decoder validates a response against the Go type it is decoded into and
+// coerces the known inconsistencies, reporting anything else as an error with the offending path.
+//
+// Coercions are controlled per field with the "swarm" struct tag, which holds a comma separated
+// list of rule names (eg. `swarm:"strnum,numbool"`). Some types (VersionID, SwarmBool) carry their
+// own rules wherever they appear. EmptyArrayAsObject is always allowed, as every object in the API
+// is subject to it.
+
+// Rule is a coercion that the decoder is allowed to apply to a value.
+type Rule int
+
+const (
+	// EmptyArrayAsObject accepts `[]` in place of an object or a map and decodes it as empty.
+	EmptyArrayAsObject Rule = 1 << iota
+
+	// StringAsNumber accepts a quoted number (eg. "12") in place of a number.
+	StringAsNumber
+
+	// NumberAsBool accepts a number in place of a boolean. Zero is false, anything else is true.
+	NumberAsBool
+
+	// StringAsBool accepts a quoted number or boolean (eg. "1", "true") in place of a boolean.
+	StringAsBool
+
+	// NumberAsString accepts a number in place of a string.
+	NumberAsString
+)
+
+var ruleNames = []struct {
+	rule Rule
+	name string
+}{
+	{EmptyArrayAsObject, "emptyarray"},
+	{StringAsNumber, "strnum"},
+	{NumberAsBool, "numbool"},
+	{StringAsBool, "strbool"},
+	{NumberAsString, "numstr"},
+}
+
+func (r Rule) String() string {
+	var names []string
+	for _, rn := range ruleNames {
+		if r&rn.rule != 0 {
+			names = append(names, rn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// typeRules are the coercions allowed for a type wherever it is used.
+var typeRules = map[reflect.Type]Rule{
+	reflect.TypeOf(VersionID(0)):     StringAsNumber,
+	reflect.TypeOf(SwarmBool(false)): NumberAsBool,
+}
+
+// Coercion describes a value that did not match its schema and was coerced.
+type Coercion struct {
+	Path  string // Path to the value within the response (eg. "review.participants.foo.required").
+	Rule  Rule   // Rule that was applied.
+	Value string // Value as received from Swarm.
+}
+
+func (c Coercion) String() string {
+	return fmt.Sprintf("%s: %s (%s)", c.Path, c.Rule, c.Value)
+}
+
+// Decoder decodes Swarm JSON responses, coercing the values allowed by the schema rules.
+type Decoder struct {
+	// Strict makes the decoder log and record every coercion it applies. Tests use it in order to
+	// keep track of the exact inconsistencies found in the server responses.
+	Strict bool
+
+	// Coercions holds the coercions applied so far. Only filled in strict mode.
+	Coercions []Coercion
+}
+
+// Decode validates |data| against the type of |v| and unmarshals it into |v|.
+func (d *Decoder) Decode(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("swarm.Decode: expected non-nil pointer, got %v", reflect.TypeOf(v))
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return err
+	}
+	tree, err := d.normalize("", tree, rv.Type().Elem(), 0)
+	if err != nil {
+		return err
+	}
+	normalized, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, v)
+}
+
+// Decode is a convenience function for decoding a Swarm response in non-strict mode.
+func Decode(data []byte, v interface{}) error {
+	var d Decoder
+	return d.Decode(data, v)
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	swarmPkgPath        = reflect.TypeOf(Context{}).PkgPath()
+)
+
+// normalize walks the JSON |value| alongside the type |t| it will be decoded into, returning a new
+// value that the standard json package can decode. |rules| are the coercions allowed by the field.
+func (d *Decoder) normalize(path string, value interface{}, t reflect.Type, rules Rule) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if value == nil {
+		return nil, nil
+	}
+	rules |= typeRules[t] | EmptyArrayAsObject
+	// Types from other packages that know how to decode themselves are left alone.
+	if t.PkgPath() != swarmPkgPath && t.PkgPath() != "" {
+		pt := reflect.PtrTo(t)
+		if pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType) {
+			return value, nil
+		}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return value, nil
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return d.emptyObject(path, value, t, rules)
+		}
+		fields := jsonFields(t)
+		for name, sub := range obj {
+			f, ok := lookupField(fields, name)
+			if !ok {
+				continue
+			}
+			n, err := d.normalize(joinPath(path, name), sub, f.typ, f.rules)
+			if err != nil {
+				return nil, err
+			}
+			obj[name] = n
+		}
+		return obj, nil
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return d.emptyObject(path, value, t, rules)
+		}
+		for key, sub := range obj {
+			n, err := d.normalize(joinPath(path, key), sub, t.Elem(), rules&^EmptyArrayAsObject)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = n
+		}
+		return obj, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte is base64 encoded as a string.
+			return value, nil
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, mismatch(path, value, t)
+		}
+		for i, sub := range list {
+			n, err := d.normalize(fmt.Sprintf("%s[%d]", path, i), sub, t.Elem(), rules&^EmptyArrayAsObject)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = n
+		}
+		return list, nil
+	case reflect.Bool:
+		switch x := value.(type) {
+		case bool:
+			return x, nil
+		case json.Number:
+			if rules&NumberAsBool != 0 {
+				d.coerce(path, NumberAsBool, value)
+				return x.String() != "0", nil
+			}
+		case string:
+			if rules&StringAsBool != 0 {
+				if b, err := strconv.ParseBool(x); err == nil {
+					d.coerce(path, StringAsBool, value)
+					return b, nil
+				}
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		switch x := value.(type) {
+		case json.Number:
+			return x, nil
+		case string:
+			if rules&StringAsNumber != 0 {
+				if _, err := strconv.ParseFloat(x, 64); err == nil {
+					d.coerce(path, StringAsNumber, value)
+					return json.Number(x), nil
+				}
+			}
+		}
+	case reflect.String:
+		switch x := value.(type) {
+		case string:
+			return x, nil
+		case json.Number:
+			if rules&NumberAsString != 0 {
+				d.coerce(path, NumberAsString, value)
+				return x.String(), nil
+			}
+		}
+	default:
+		return value, nil
+	}
+	return nil, mismatch(path, value, t)
+}
+
+// emptyObject handles a non-object |value| found where an object of type |t| was expected.
+func (d *Decoder) emptyObject(path string, value interface{}, t reflect.Type, rules Rule) (interface{}, error) {
+	if list, ok := value.([]interface{}); ok && len(list) == 0 && rules&EmptyArrayAsObject != 0 {
+		d.coerce(path, EmptyArrayAsObject, value)
+		return map[string]interface{}{}, nil
+	}
+	return nil, mismatch(path, value, t)
+}
+
+func (d *Decoder) coerce(path string, rule Rule, value interface{}) {
+	if !d.Strict {
+		return
+	}
+	raw, _ := json.Marshal(value)
+	c := Coercion{
+		Path:  path,
+		Rule:  rule,
+		Value: string(raw),
+	}
+	log.Warningf("swarm: coerced %v", c)
+	d.Coercions = append(d.Coercions, c)
+}
+
+func mismatch(path string, value interface{}, t reflect.Type) error {
+	raw, _ := json.Marshal(value)
+	if path == "" {
+		path = "<root>"
+	}
+	return fmt.Errorf("swarm: invalid value %s for %q, expected %v", raw, path, t)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+type jsonField struct {
+	name  string
+	typ   reflect.Type
+	rules Rule
+}
+
+// jsonFields returns the fields of struct |t| as seen by encoding/json, including the ones promoted
+// from embedded structs.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, jsonField{
+			name:  name,
+			typ:   sf.Type,
+			rules: parseRules(sf.Tag.Get("swarm")),
+		})
+	}
+	return fields
+}
+
+// lookupField finds the field for a JSON key the same way encoding/json does: exact match first,
+// case insensitive otherwise.
+func lookupField(fields []jsonField, name string) (jsonField, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return jsonField{}, false
+}
+
+func parseRules(tag string) Rule {
+	var rules Rule
+	for _, name := range strings.Split(tag, ",") {
+		for _, rn := range ruleNames {
+			if rn.name == strings.TrimSpace(name) {
+				rules |= rn.rule
+			}
+		}
+	}
+	return rules
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Change is a changelist whose description is rendered or synced with a review.
+type Change struct {
+	CL          int
+	User        string
+	Status      string
+	Description string
+	// Files are the depot paths of the files of the changelist, or of its shelf if it's pending
+	// with nothing opened.
+	Files []string
+}
+
+// Changes reads and updates changelists. Package swarmp4 implements it with Perforce, so that this
+// package doesn't depend on p4lib.
+type Changes interface {
+	// Change returns changelist |cl|.
+	Change(cl int) (*Change, error)
+	// UpdateDescription sets the description of pending changelist |cl| to |desc|.
+	UpdateDescription(cl int, desc string) error
+}
+
+// DescriptionFields are the fields available to description templates.
+type DescriptionFields struct {
+	// CL is the changelist of the review.
+	CL int
+	// Author is the user who owns the changelist.
+	Author string
+	// Summary is the first line of the description.
+	Summary string
+	// Body is the rest of the description, without the tags of the other fields.
+	Body string
+	// Bugs are the ids of the BUG= tags.
+	Bugs []int
+	// Tested are the test instructions of the TESTED= tag.
+	Tested string
+	// Paths are the depot directories with files affected by the change, eg. "//depot/game/...".
+	Paths []string
+}
+
+// DefaultDescriptionTemplate renders a description following the conventions checked by presubmits.
+const DefaultDescriptionTemplate = `{{.Summary}}
+{{if .Body}}
+{{.Body}}
+{{end}}{{if .Paths}}
+Affected paths:
+{{range .Paths}}  {{.}}
+{{end}}{{end}}{{if or .Bugs .Tested}}
+{{end}}{{if .Bugs}}BUG={{join .Bugs}}
+{{end}}{{if .Tested}}TESTED={{.Tested}}
+{{end}}`
+
+var descriptionFuncs = template.FuncMap{
+	"join": func(ids []int) string {
+		var strs []string
+		for _, id := range ids {
+			strs = append(strs, strconv.Itoa(id))
+		}
+		return strings.Join(strs, ",")
+	},
+}
+
+// RenderDescription renders the text template |tmpl| with |fields|. Templates can use the "join"
+// function to join bug ids with commas.
+func RenderDescription(tmpl string, fields *DescriptionFields) (string, error) {
+	t, err := template.New("description").Funcs(descriptionFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("swarm.RenderDescription: invalid template: %w", err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, fields); err != nil {
+		return "", fmt.Errorf("swarm.RenderDescription: %w", err)
+	}
+	return b.String(), nil
+}
+
+var (
+	bugTag    = regexp.MustCompile(`^BUG=(.*)$`)
+	testedTag = regexp.MustCompile(`^TESTED=(.*)$`)
+	// pathsSection matches the affected paths rendered by DefaultDescriptionTemplate, so that
+	// re-rendering a description doesn't repeat them.
+	pathsSection = regexp.MustCompile(`(?m)^Affected paths:\n(  //.*\n?)*`)
+)
+
+// FieldsFromChange returns the description fields of changelist |change|.
+func FieldsFromChange(change *Change) (*DescriptionFields, error) {
+	fields := &DescriptionFields{
+		CL:     change.CL,
+		Author: change.User,
+	}
+	var body []string
+	text := pathsSection.ReplaceAllString(change.Description, "")
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := bugTag.FindStringSubmatch(line); m != nil {
+			for _, s := range strings.Split(m[1], ",") {
+				s = strings.TrimSpace(s)
+				if s == "" {
+					continue
+				}
+				id, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("swarm.FieldsFromChange: invalid bug %q in change %d", s, change.CL)
+				}
+				fields.Bugs = append(fields.Bugs, id)
+			}
+			continue
+		}
+		if m := testedTag.FindStringSubmatch(line); m != nil {
+			fields.Tested = strings.TrimSpace(m[1])
+			continue
+		}
+		if fields.Summary == "" && len(body) == 0 {
+			fields.Summary = line
+			continue
+		}
+		body = append(body, line)
+	}
+	fields.Body = strings.TrimSpace(strings.Join(body, "\n"))
+	dirs := map[string]bool{}
+	for _, f := range change.Files {
+		// path.Dir would clean the leading "//" of depot paths.
+		if i := strings.LastIndex(f, "/"); i > 1 {
+			dirs[f[:i]+"/..."] = true
+		}
+	}
+	for d := range dirs {
+		fields.Paths = append(fields.Paths, d)
+	}
+	sort.Strings(fields.Paths)
+	return fields, nil
+}
+
+// FieldsForChange returns the description fields of changelist |cl| of |changes|.
+func FieldsForChange(changes Changes, cl int) (*DescriptionFields, error) {
+	change, err := changes.Change(cl)
+	if err != nil {
+		return nil, fmt.Errorf("swarm.FieldsForChange: %w", err)
+	}
+	return FieldsFromChange(change)
+}
+
+// SyncAction is what SyncDescription does to bring descriptions in sync.
+type SyncAction int
+
+const (
+	// SyncNone means that both descriptions are already the same.
+	SyncNone SyncAction = iota
+	// SyncToReview means the change description was edited and is copied to the review.
+	SyncToReview
+	// SyncToChange means the review description was edited and is copied to the change.
+	SyncToChange
+	// SyncConflict means both descriptions were edited since they were last in sync.
+	SyncConflict
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SyncNone:
+		return "none"
+	case SyncToReview:
+		return "to review"
+	case SyncToChange:
+		return "to change"
+	case SyncConflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("SyncAction(%d)", int(a))
+}
+
+// ReconcileDescriptions returns how to sync the |review| and |change| descriptions, given the
+// |base| description they had when last in sync, and the description they should both get. An
+// empty |base| means they were never synced, in which case the change description wins. Trailing
+// whitespace and line endings are ignored, as Perforce and Swarm don't keep them the same way.
+func ReconcileDescriptions(base, review, change string) (SyncAction, string) {
+	b, r, c := normalizeDescription(base), normalizeDescription(review), normalizeDescription(change)
+	switch {
+	case r == c:
+		return SyncNone, c
+	case b == "" || r == b:
+		return SyncToReview, c
+	case c == b:
+		return SyncToChange, r
+	}
+	return SyncConflict, ""
+}
+
+func normalizeDescription(desc string) string {
+	lines := strings.Split(strings.ReplaceAll(desc, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// DescriptionSync is what SyncDescription did.
+type DescriptionSync struct {
+	Action SyncAction
+	// Description is the synced description, to be kept as the next base. Empty on conflicts.
+	Description string
+	// Change is the description the changelist had before the sync.
+	Change string
+}
+
+// SyncDescription brings the descriptions of |review| and of its changelist |cl| in sync, copying
+// whichever was edited since |base|, the description they had when last in sync. If both were
+// edited, nothing is updated and the action is SyncConflict, for the user to merge them.
+func SyncDescription(ctx *Context, changes Changes, review *Review, cl int, base string) (*DescriptionSync, error) {
+	change, err := changes.Change(cl)
+	if err != nil {
+		return nil, fmt.Errorf("swarm.SyncDescription: %w", err)
+	}
+	action, desc := ReconcileDescriptions(base, review.Description, change.Description)
+	switch action {
+	case SyncToReview:
+		if _, err := UpdateDescription(ctx, review.ID, desc); err != nil {
+			return nil, fmt.Errorf("swarm.SyncDescription: %w", err)
+		}
+	case SyncToChange:
+		if err := changes.UpdateDescription(cl, desc); err != nil {
+			return nil, fmt.Errorf("swarm.SyncDescription: %w", err)
+		}
+	}
+	return &DescriptionSync{Action: action, Description: desc, Change: change.Description}, nil
+}
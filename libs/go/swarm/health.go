@@ -0,0 +1,314 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, wrapped, by requests that weren't sent because Swarm has been
+// failing. See Breaker. Write requests failing with it are queued like when Swarm is unreachable.
+var ErrCircuitOpen = errors.New("swarm degraded, request not sent")
+
+// healthEndpoint is probed by Health. It is cheap for Swarm to answer.
+const healthEndpoint = "api/v9/version"
+
+// probeTimeout bounds how long Health waits for Swarm.
+const probeTimeout = 5 * time.Second
+
+// BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all requests fast, until its cooldown is over.
+	BreakerOpen
+	// BreakerHalfOpen lets a single request through to find out whether Swarm recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// MarshalText encodes the state as its name, eg. in JSON.
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Breaker is a circuit breaker for the requests of a Context. It tracks the rate of requests that
+// fail because Swarm can't be reached over a rolling window, and opens when it gets too high: for
+// a cooldown, requests fail immediately with ErrCircuitOpen instead of waiting for Swarm to time
+// out. After the cooldown a single request is let through, and its outcome closes the breaker or
+// opens it again. Requests rejected by Swarm, eg. with invalid arguments, are not failures.
+//
+// Contexts made for the users of a server should share the breaker of the server:
+//
+//      ctx.Breaker = swarm.NewBreaker()
+//
+// A Breaker is safe for concurrent use.
+type Breaker struct {
+	// Window is how far back requests count towards the error rate.
+	Window time.Duration
+	// MinRequests is how many requests the window must have for the breaker to open.
+	MinRequests int
+	// FailureRate is the rate of failed requests, between 0 and 1, that opens the breaker.
+	FailureRate float64
+	// Cooldown is how long the breaker stays open before letting a request through.
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	now      func() time.Time
+	outcomes []outcome
+	state    BreakerState
+	openedAt time.Time
+	probing  bool
+	lastErr  error
+}
+
+// outcome is the outcome of a request at a time.
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// BreakerStatus is a snapshot of a Breaker.
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+	// Requests is the number of requests in the rolling window.
+	Requests int `json:"requests"`
+	// ErrorRate is the rate of failed requests in the rolling window.
+	ErrorRate float64 `json:"errorRate"`
+	// OpenedAt is when the breaker last opened, zero if it never did.
+	OpenedAt time.Time `json:"openedAt"`
+	// LastError is the last failure, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// NewBreaker returns a breaker that opens for 30 seconds when at least half of the requests, and
+// at least 5, failed within the last minute.
+func NewBreaker() *Breaker {
+	return &Breaker{
+		Window:      time.Minute,
+		MinRequests: 5,
+		FailureRate: 0.5,
+		Cooldown:    30 * time.Second,
+		now:         time.Now,
+	}
+}
+
+// allow returns ErrCircuitOpen if a request must not be sent. A nil breaker allows everything.
+func (b *Breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record records the outcome of a request let through by allow.
+func (b *Breaker) record(err error) {
+	if b == nil || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	failed := isUnreachable(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if failed {
+		b.lastErr = err
+	}
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(now)
+		} else {
+			b.close()
+		}
+	case BreakerClosed:
+		b.prune(now)
+		b.outcomes = append(b.outcomes, outcome{now, failed})
+		if requests, rate := b.rate(); requests >= b.MinRequests && rate >= b.FailureRate {
+			b.open(now)
+		}
+	}
+	// Requests let through before the breaker opened don't change an open breaker.
+}
+
+// probed records the outcome of a health probe, which bypasses the breaker: a successful probe
+// closes it, a failed one counts as a failed request.
+func (b *Breaker) probed(err error) {
+	if b == nil {
+		return
+	}
+	if err == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.state != BreakerClosed {
+			b.close()
+		}
+		return
+	}
+	b.record(err)
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.outcomes = nil
+}
+
+func (b *Breaker) close() {
+	b.state = BreakerClosed
+	b.probing = false
+	b.outcomes = nil
+}
+
+// prune drops the outcomes out of the window.
+func (b *Breaker) prune(now time.Time) {
+	i := 0
+	for i < len(b.outcomes) && now.Sub(b.outcomes[i].at) > b.Window {
+		i++
+	}
+	b.outcomes = b.outcomes[i:]
+}
+
+// rate returns the number of requests in the window and the rate of failed ones.
+func (b *Breaker) rate() (int, float64) {
+	if len(b.outcomes) == 0 {
+		return 0, 0
+	}
+	failures := 0
+	for _, o := range b.outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+	return len(b.outcomes), float64(failures) / float64(len(b.outcomes))
+}
+
+// Status returns the current state of the breaker. A nil breaker is always closed.
+func (b *Breaker) Status() BreakerStatus {
+	if b == nil {
+		return BreakerStatus{State: BreakerClosed}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	if state == BreakerOpen && b.now().Sub(b.openedAt) >= b.Cooldown {
+		// The next request will be let through.
+		state = BreakerHalfOpen
+	}
+	b.prune(b.now())
+	requests, rate := b.rate()
+	status := BreakerStatus{
+		State:     state,
+		Requests:  requests,
+		ErrorRate: rate,
+		OpenedAt:  b.openedAt,
+	}
+	if b.lastErr != nil {
+		status.LastError = b.lastErr.Error()
+	}
+	return status
+}
+
+// HealthStatus is the health of Swarm as seen from a Context.
+type HealthStatus struct {
+	// Healthy is whether Swarm answered the probe, even if with an error.
+	Healthy bool `json:"healthy"`
+	// Latency is how long the probe took.
+	Latency time.Duration `json:"latency"`
+	// Error is why the probe failed, if it did.
+	Error string `json:"error,omitempty"`
+	// Breaker is the status of the breaker of the context.
+	Breaker BreakerStatus `json:"breaker"`
+	// Transport is the instrumentation of the transport of the context, nil if it isn't a
+	// Transport.
+	Transport *TransportStats `json:"transport,omitempty"`
+}
+
+// Degraded returns whether requests to Swarm are likely to fail or be slow, eg. for UIs to show a
+// "Swarm degraded" banner.
+func (h *HealthStatus) Degraded() bool {
+	return !h.Healthy || h.Breaker.State != BreakerClosed
+}
+
+// Health probes a cheap Swarm endpoint and returns whether Swarm can be reached, along with the
+// status of the breaker of the context. The probe doesn't wait for more than a few seconds and bypasses the
+// breaker, so it can tell when Swarm recovers: a successful probe closes the breaker.
+func Health(ctx *Context) *HealthStatus {
+	probeCtx := *ctx
+	c, cancel := context.WithTimeout(ctx.baseContext(), probeTimeout)
+	defer cancel()
+	probeCtx.Ctx = c
+	start := time.Now()
+	_, err := sendSwarmRequest(&probeCtx, "GET", healthEndpoint, jsonEncoded, nil)
+	// Swarm answering with an error, eg. for bad credentials, is still up.
+	h := &HealthStatus{
+		Healthy: err == nil || !isUnreachable(err),
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	if h.Healthy {
+		ctx.Breaker.probed(nil)
+	} else {
+		ctx.Breaker.probed(err)
+	}
+	h.Breaker = ctx.Breaker.Status()
+	if t := ctx.transport(); t != nil {
+		stats := t.Stats()
+		h.Transport = &stats
+	}
+	return h
+}
+
+// baseContext returns the context requests are made with.
+func (ctx *Context) baseContext() context.Context {
+	if ctx.Ctx != nil {
+		return ctx.Ctx
+	}
+	return context.Background()
+}
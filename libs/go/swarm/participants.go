@@ -0,0 +1,100 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrReviewUpdated is returned when changing the participants of a review that was updated since
+// the caller last fetched it. The caller should fetch the review again and retry.
+var ErrReviewUpdated = errors.New("review was updated concurrently")
+
+// JoinReview adds the logged in user as an optional reviewer of |review|. |updated| is the Updated
+// time of the review as last seen by the caller, see UpdateParticipants.
+func JoinReview(ctx *Context, review, updated int) (*Review, error) {
+	return UpdateParticipants(ctx, review, updated, func(ps map[string]Participant) {
+		if _, ok := ps[ctx.Username]; !ok {
+			ps[ctx.Username] = Participant{}
+		}
+	})
+}
+
+// LeaveReview removes the logged in user from the reviewers of |review|. |updated| is the Updated
+// time of the review as last seen by the caller, see UpdateParticipants.
+func LeaveReview(ctx *Context, review, updated int) (*Review, error) {
+	return UpdateParticipants(ctx, review, updated, func(ps map[string]Participant) {
+		delete(ps, ctx.Username)
+	})
+}
+
+// SetRequired makes |user| a required or an optional reviewer of |review|, adding them to the
+// reviewers if needed. |updated| is the Updated time of the review as last seen by the caller, see
+// UpdateParticipants.
+func SetRequired(ctx *Context, review, updated int, user string, required bool) (*Review, error) {
+	return UpdateParticipants(ctx, review, updated, func(ps map[string]Participant) {
+		p := ps[user]
+		p.Required = required
+		ps[user] = p
+	})
+}
+
+// UpdateParticipants applies |update| to the participants of |review| and patches its reviewers
+// accordingly. The author is never a reviewer, whatever |update| does. If |updated| isn't 0 and
+// the review was updated after that time, nothing is patched and the error wraps
+// ErrReviewUpdated, so that changes made since the caller fetched the review aren't silently
+// overwritten. Swarm has no conditional updates, so changes made between the check and the patch
+// can still be lost.
+func UpdateParticipants(ctx *Context, review, updated int, update func(ps map[string]Participant)) (*Review, error) {
+	r, err := GetReview(ctx, review)
+	if err != nil {
+		return nil, fmt.Errorf("swarm.UpdateParticipants: %w", err)
+	}
+	if r == nil {
+		return nil, fmt.Errorf("swarm.UpdateParticipants: review %d not found", review)
+	}
+	if updated != 0 && r.Updated != updated {
+		return nil, fmt.Errorf("swarm.UpdateParticipants: review %d updated at %d, after %d: %w", review, r.Updated, updated, ErrReviewUpdated)
+	}
+	ps := map[string]Participant{}
+	for u, p := range r.Participants {
+		ps[u] = p
+	}
+	update(ps)
+	patch := ParticipantsPatch(r.Author, ps)
+	return PatchReview(ctx, review, patch)
+}
+
+// ParticipantsPatch returns the patch setting the reviewers of a review by |author| to
+// participants |ps|.
+func ParticipantsPatch(author string, ps map[string]Participant) *ReviewPatch {
+	// Empty lists rather than nil ones, which encode as null, so that removing the last reviewer
+	// clears the list.
+	patch := &ReviewPatch{Reviewers: []string{}, RequiredReviewers: []string{}}
+	for u, p := range ps {
+		switch {
+		case u == author:
+		case p.Required:
+			patch.RequiredReviewers = append(patch.RequiredReviewers, u)
+		default:
+			patch.Reviewers = append(patch.Reviewers, u)
+		}
+	}
+	sort.Strings(patch.Reviewers)
+	sort.Strings(patch.RequiredReviewers)
+	return patch
+}
@@ -0,0 +1,328 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"sge-monorepo/libs/go/files"
+	"sge-monorepo/libs/go/log"
+)
+
+// ErrQueued is returned, wrapped, by write requests that couldn't reach Swarm and were queued to be
+// retried later. See Queue.
+var ErrQueued = errors.New("swarm unreachable, request queued")
+
+// commentSkew is how much earlier than its queueing time a comment may appear in Swarm and still be
+// considered the queued one, to account for clock differences with the Swarm server.
+const commentSkew = 5 * time.Minute
+
+// unreachableError is returned when a request couldn't reach Swarm, eg. on network failures.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+// isUnreachable returns whether |err| is due to Swarm being unreachable, as opposed to Swarm
+// rejecting the request or the caller cancelling it.
+func isUnreachable(err error) bool {
+	var ue *unreachableError
+	return errors.As(err, &ue) && !errors.Is(err, context.Canceled)
+}
+
+// Queue persists the votes and comments that fail because Swarm can't be reached, eg. on a flaky
+// VPN, and retries them the next time a vote or comment is made through a Context using the queue,
+// or when Flush is called. Tools typically flush on start up:
+//
+//      q, err := swarm.UserQueue()
+//      ...
+//      ctx.Queue = q
+//      if _, err := q.Flush(ctx); err != nil { ... }
+//
+// Each queued request has a de-duplication token: votes and comment edits replace any queued vote
+// on the same review or edit of the same comment, and identical comments are only queued once.
+// Comments are only replayed if Swarm doesn't already have them, as a request may have reached
+// Swarm even if its response didn't make it back. Queued comments are notified when replayed, even
+// if they were made with delayed notifications.
+//
+// A Queue is safe for concurrent use, by goroutines and by processes sharing its file: changes are
+// made under a lock file next to the queue file.
+type Queue struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewQueue returns a queue kept in file |path|. The file is created on first use.
+func NewQueue(path string) *Queue {
+	return &Queue{path: path}
+}
+
+// UserQueue returns the queue of the current user, shared by all tools.
+func UserQueue() (*Queue, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(filepath.Join(dir, "swarm", "queue.json")), nil
+}
+
+// queuedRequest is a write request waiting to be sent to Swarm.
+type queuedRequest struct {
+	// Token de-duplicates requests, a request replaces any queued one with the same token.
+	Token    string          `json:"token"`
+	Host     string          `json:"host"`
+	Port     int             `json:"port"`
+	Username string          `json:"username"`
+	Action   string          `json:"action"`
+	Endpoint string          `json:"endpoint"`
+	Payload  json.RawMessage `json:"payload"`
+	// Time is the unix time the request was first queued.
+	Time int64 `json:"time"`
+}
+
+// Len returns the number of queued requests.
+func (q *Queue) Len() (int, error) {
+	// The queue file is replaced atomically, reading it needs no lock.
+	reqs, err := q.load()
+	return len(reqs), err
+}
+
+// lock locks the queue against other goroutines and processes, and returns the function unlocking
+// it. The file lock is enough across processes, the mutex keeps goroutines from piling up on it.
+func (q *Queue) lock() (func(), error) {
+	q.mu.Lock()
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+	l, err := files.LockFile(q.path + ".lock")
+	if err != nil {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("could not lock swarm queue %s: %v", q.path, err)
+	}
+	return func() {
+		if err := l.Unlock(); err != nil {
+			log.Warningf("swarm: could not unlock queue %s: %v", q.path, err)
+		}
+		q.mu.Unlock()
+	}, nil
+}
+
+// add queues a request to |endpoint| made through |ctx|.
+func (q *Queue) add(ctx *Context, action, endpoint string, payload []byte) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	reqs, err := q.load()
+	if err != nil {
+		return err
+	}
+	qr := queuedRequest{
+		Host:     ctx.Host,
+		Port:     ctx.Port,
+		Username: ctx.Username,
+		Action:   action,
+		Endpoint: endpoint,
+		Payload:  payload,
+		Time:     time.Now().Unix(),
+	}
+	qr.Token = requestToken(&qr)
+	for i, r := range reqs {
+		if r.Token == qr.Token {
+			reqs = append(reqs[:i], reqs[i+1:]...)
+			break
+		}
+	}
+	return q.save(append(reqs, qr))
+}
+
+// requestToken returns the de-duplication token of a request. Votes and comment edits are keyed by
+// their endpoint, so the latest one wins, new comments by their content.
+func requestToken(qr *queuedRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%d\x00%s\x00%s %s\x00", qr.Host, qr.Port, qr.Username, qr.Action, qr.Endpoint)
+	if qr.Endpoint == commentsEndpoint {
+		h.Write(qr.Payload)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Flush sends the queued requests made as the user of |ctx| to its Swarm server, in the order they
+// were made, and returns how many were replayed. Requests that Swarm rejects are logged and dropped.
+// Flushing stops at the first request that can't reach Swarm, the remaining ones stay queued. The
+// queue stays locked while flushing, so that requests are replayed once.
+func (q *Queue) Flush(ctx *Context) (int, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	reqs, err := q.load()
+	if err != nil || len(reqs) == 0 {
+		return 0, err
+	}
+	// Replays must not be queued again.
+	c := *ctx
+	c.Queue = nil
+	var kept []queuedRequest
+	sent := 0
+	for i, qr := range reqs {
+		if qr.Host != ctx.Host || qr.Port != ctx.Port || qr.Username != ctx.Username {
+			kept = append(kept, qr)
+			continue
+		}
+		err := replay(&c, &qr)
+		if isUnreachable(err) {
+			kept = append(kept, reqs[i:]...)
+			if serr := q.save(kept); serr != nil {
+				return sent, serr
+			}
+			return sent, err
+		}
+		if err != nil {
+			log.Warningf("swarm: dropping queued %s %s: %v", qr.Action, qr.Endpoint, err)
+			continue
+		}
+		sent++
+	}
+	return sent, q.save(kept)
+}
+
+// replay sends queued request |qr|.
+func replay(ctx *Context, qr *queuedRequest) error {
+	payload := []byte(qr.Payload)
+	if qr.Endpoint == commentsEndpoint {
+		var ca CommentAdd
+		if err := json.Unmarshal(payload, &ca); err != nil {
+			return err
+		}
+		posted, err := commentPosted(ctx, &ca, qr.Time)
+		if err != nil || posted {
+			return err
+		}
+		// Whoever delayed the notification is long gone and won't send it.
+		ca.DelayNotification = ""
+		if payload, err = json.Marshal(ca); err != nil {
+			return err
+		}
+	}
+	_, err := doSwarmRequest(ctx, qr.Action, qr.Endpoint, jsonEncoded, payload)
+	return err
+}
+
+// commentPosted returns whether Swarm already has comment |ca| made by the user of |ctx| around
+// unix time |queued|.
+func commentPosted(ctx *Context, ca *CommentAdd, queued int64) (bool, error) {
+	comments, err := GetComments(ctx, "topic="+ca.Topic)
+	if err != nil {
+		return false, err
+	}
+	since := queued - int64(commentSkew.Seconds())
+	for _, c := range comments.Comments {
+		if c.User == ctx.Username && c.Body == ca.Body && int64(c.Time) >= since {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *Queue) load() ([]queuedRequest, error) {
+	data, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var reqs []queuedRequest
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		return nil, fmt.Errorf("could not parse swarm queue %s: %v", q.path, err)
+	}
+	return reqs, nil
+}
+
+// save writes the queue through a temporary file, so that it is never left half written. Must be
+// called with the queue locked.
+func (q *Queue) save(reqs []queuedRequest) error {
+	if len(reqs) == 0 {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(reqs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// doQueuedRequest is doSwarmRequest for votes and comments: queued requests are sent first and, if
+// Swarm can't be reached, the request is queued and an error wrapping ErrQueued is returned.
+func (ctx *Context) doQueuedRequest(action, endpoint string, req, resp interface{}) error {
+	if ctx.Queue == nil {
+		return ctx.doSwarmRequest(action, endpoint, req, resp)
+	}
+	if _, err := ctx.Queue.Flush(ctx); err != nil && !isUnreachable(err) {
+		log.Warningf("swarm: could not send queued requests: %v", err)
+	}
+	err := ctx.doSwarmRequest(action, endpoint, req, resp)
+	if !isUnreachable(err) {
+		return err
+	}
+	payload, merr := json.Marshal(req)
+	if merr != nil {
+		return err
+	}
+	if qerr := ctx.Queue.add(ctx, action, endpoint, payload); qerr != nil {
+		return fmt.Errorf("%v, could not queue the request: %v", err, qerr)
+	}
+	return fmt.Errorf("%w: %v", ErrQueued, err)
+}
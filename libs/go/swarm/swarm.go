@@ -36,6 +36,8 @@ import (
 const (
 	formEncoded = "application/x-www-form-urlencoded"
 	jsonEncoded = "application/json"
+
+	commentsEndpoint = "api/v9/comments"
 )
 
 // Context represents the associated state needed to communicate with Swarm.
@@ -46,9 +48,24 @@ type Context struct {
 	Password string // Credentials.
 
 	// Client is an HTTP client to be used for http request.
-	// Users of the library can set it to override the default one.
+	// Users of the library can set it to override the default one, which sends requests over
+	// DefaultTransport. See Transport.
 	Client *http.Client
 	Ctx    context.Context
+
+	// Strict logs every coercion applied when decoding Swarm responses. See Decoder.
+	Strict bool
+
+	// Actor is the automated system on whose behalf requests are made, if any. See WithActor.
+	Actor *Actor
+
+	// Queue, if set, keeps the votes and comments that fail because Swarm can't be reached, to
+	// retry them later. See Queue.
+	Queue *Queue
+
+	// Breaker, if set, fails requests fast while Swarm is failing instead of waiting for each of
+	// them to time out. See Breaker.
+	Breaker *Breaker
 }
 
 // New returns a context with which to make Swarm requests.
@@ -169,14 +186,14 @@ type CommitStatus struct {
 
 // Participant details the vote for a participiant in a review
 type Participant struct {
-	Required bool `json:"required"`
+	Required bool `json:"required" swarm:"strbool"` // quorum participants come back as "1"
 	Vote     Vote `json:"vote"`
 }
 
 // Vote contains a vote (+1 for upvote,-1 for downvote) and version of review it was applied to
 type Vote struct {
 	Value   int  `json:"value"`
-	Version int  `json:"version"`
+	Version int  `json:"version" swarm:"strnum"`
 	IsStale bool `json:"isStale"`
 }
 
@@ -232,6 +249,15 @@ type ReviewPatch struct {
 	RequiredReviewers []string `json:"requiredReviewers"`
 }
 
+// NewReview contains the fields used to request a review of a change.
+type NewReview struct {
+	Change            int      `json:"change"`
+	Description       string   `json:"description,omitempty"`
+	Reviewers         []string `json:"reviewers,omitempty"`
+	RequiredReviewers []string `json:"requiredReviewers,omitempty"`
+	ReviewerGroups    []string `json:"reviewerGroups,omitempty"`
+}
+
 // TestDetails shows the start and times of tests
 type TestDetails struct {
 	StartTimes []int `json:"startTimes"` // array of unix times for test starts
@@ -252,22 +278,22 @@ type User struct {
 
 // Version contains details about a swarm review version
 type Version struct {
-	AddChangeMode        string `json:"addChangeMode"`        //
-	Change               int    `json:"change"`               // changelist number
-	Difference           int    `json:"difference"`           //
-	Pending              bool   `json:"pending"`              // cl status
-	Stream               string `json:"stream"`               //
-	StreamSpecDifference int    `json:"streamSpecDifference"` //
-	TestRuns             []int  `json:"testRuns"`             // indices of text runs
-	Time                 int    `json:"time"`                 // unix time
-	User                 string `json:"user"`                 // user name
+	AddChangeMode        string `json:"addChangeMode"`           //
+	Change               int    `json:"change"`                  // changelist number
+	Difference           int    `json:"difference"`              //
+	Pending              bool   `json:"pending" swarm:"numbool"` // cl status
+	Stream               string `json:"stream"`                  //
+	StreamSpecDifference int    `json:"streamSpecDifference"`    //
+	TestRuns             []int  `json:"testRuns"`                // indices of text runs
+	Time                 int    `json:"time"`                    // unix time
+	User                 string `json:"user"`                    // user name
 }
 
 // TestRun contains details about a test run for a swarm review
 type TestRun struct {
 	ID            int      `json:"id"`
-	Change        int      `json:"change"`
-	Version       int      `json:"version"`
+	Change        int      `json:"change" swarm:"strnum"`
+	Version       int      `json:"version" swarm:"strnum"`
 	Test          string   `json:"test"`
 	StartTime     int64    `json:"startTime"`
 	CompletedTime int64    `json:"completedTime"`
@@ -490,7 +516,7 @@ func GetOpenReviews(ctx *Context, username string) (ReviewCollection, error) {
 
 func getCommentsPage(ctx *Context, after int, args string) (CommentCollection, error) {
 	var cc CommentCollection
-	endpoint := "api/v9/comments"
+	endpoint := commentsEndpoint
 	if after != 0 {
 		if len(args) > 0 {
 			args += "&"
@@ -501,7 +527,7 @@ func getCommentsPage(ctx *Context, after int, args string) (CommentCollection, e
 		endpoint += "?" + args
 	}
 	if err := ctx.doSwarmRequest("GET", endpoint, nil, &cc); err != nil {
-		return cc, fmt.Errorf("swarm.getCommentsPage %v", err)
+		return cc, fmt.Errorf("swarm.getCommentsPage %w", err)
 	}
 	return cc, nil
 }
@@ -533,14 +559,18 @@ func GetCommentsForReview(ctx *Context, reviewIndex int) (CommentCollection, err
 // https://www.perforce.com/manuals/swarm/Content/Swarm/swarm-apidoc_endpoint_comments.html#Edit_a_Comment
 func UpdateComment(ctx *Context, comment *Comment) error {
 	endpoint := fmt.Sprintf("api/v9/comments/%d", comment.ID)
+	body := comment.Body
+	if ctx.Actor != nil {
+		body = ctx.Actor.Sign(body)
+	}
 	scu := CommentUpdate{
-		Body:  comment.Body,
+		Body:  body,
 		ID:    comment.ID,
 		Topic: comment.Topic,
 		Flags: comment.Flags,
 	}
-	if err := ctx.doSwarmRequest("PATCH", endpoint, scu, nil); err != nil {
-		return fmt.Errorf("swarm.UpdateComment %v", err)
+	if err := ctx.doQueuedRequest("PATCH", endpoint, scu, nil); err != nil {
+		return fmt.Errorf("swarm.UpdateComment %w", err)
 	}
 	return nil
 }
@@ -552,8 +582,12 @@ func AddComment(ctx *Context, comment *Comment) error {
 	return err
 }
 func AddCommentEx(ctx *Context, comment *Comment, delayNotification bool) (*Comment, error) {
+	body := comment.Body
+	if ctx.Actor != nil {
+		body = ctx.Actor.Sign(body)
+	}
 	sca := CommentAdd{
-		Body:    comment.Body,
+		Body:    body,
 		Topic:   comment.Topic,
 		Context: &CommentAddContext{},
 		Flags:   comment.Flags,
@@ -584,8 +618,8 @@ func AddCommentEx(ctx *Context, comment *Comment, delayNotification bool) (*Comm
 			Context string `json:"context"`
 		}
 	}
-	if err := ctx.doSwarmRequest("POST", "api/v9/comments", sca, &response); err != nil {
-		return nil, fmt.Errorf("swarm.AddCommentEx %v", err)
+	if err := ctx.doQueuedRequest("POST", commentsEndpoint, sca, &response); err != nil {
+		return nil, fmt.Errorf("swarm.AddCommentEx %w", err)
 	}
 	if response.Error != "" {
 		return nil, fmt.Errorf("swarm.AddCommentEx %s : %s", response.Error, response.Details.Context)
@@ -632,8 +666,8 @@ func SetVote(ctx *Context, review int, vote string) error {
 		IsValid  bool        `json:"isValid"`
 		Messages interface{} `json:"messages"`
 	}
-	if err := ctx.doSwarmRequest("POST", fmt.Sprintf("api/v9/reviews/%d/vote", review), v, &response); err != nil {
-		return fmt.Errorf("swarm.SetVote %v", err)
+	if err := ctx.doQueuedRequest("POST", fmt.Sprintf("api/v9/reviews/%d/vote", review), v, &response); err != nil {
+		return fmt.Errorf("swarm.SetVote %w", err)
 	}
 	return nil
 }
@@ -652,6 +686,20 @@ func PatchReview(ctx *Context, review int, patch *ReviewPatch) (*Review, error)
 	return response.Review, nil
 }
 
+// CreateReview requests a review of a pending change. The change must have shelved files.
+func CreateReview(ctx *Context, review *NewReview) (*Review, error) {
+	var response struct {
+		Review *Review `json:"review"`
+	}
+	if err := ctx.doSwarmRequest("POST", "api/v9/reviews", review, &response); err != nil {
+		return nil, fmt.Errorf("swarm.CreateReview: %w", err)
+	}
+	if response.Review == nil {
+		return nil, fmt.Errorf("swarm.CreateReview invalid response")
+	}
+	return response.Review, nil
+}
+
 // UpdateDescription updates the description for the specified review.
 func UpdateDescription(ctx *Context, review int, description string) (*Review, error) {
 	return PatchReview(ctx, review, &ReviewPatch{
@@ -725,6 +773,12 @@ func GetActionDashboard(ctx *Context) ([]Review, error) {
 // in the review page.
 // If successful, returns the body of the response provided by Swarm.
 func SendTestRunRequest(ctx *Context, responseType TestRunResponseType, updateUrl, resultsUrl string) (string, error) {
+	return SendTestRunMessages(ctx, responseType, updateUrl, resultsUrl, nil)
+}
+
+// SendTestRunMessages is like SendTestRunRequest, but shows |messages| in the review page instead
+// of the default message of |responseType|.
+func SendTestRunMessages(ctx *Context, responseType TestRunResponseType, updateUrl, resultsUrl string, messages []string) (string, error) {
 	// |updateUrl| is normally a full url (https://foo.com/bar) in which the host is very possibly
 	// different to the one we're using to communicate with Swarm. We need to strip the host part
 	// in order to use it and an endpoint.
@@ -743,11 +797,11 @@ func SendTestRunRequest(ctx *Context, responseType TestRunResponseType, updateUr
 	var payload []byte
 	switch responseType {
 	case TestRunStart:
-		payload, err = createTestRunPayload("update", "presubmit is starting", resultsUrl)
+		payload, err = createTestRunPayload("update", "presubmit is starting", resultsUrl, messages)
 	case TestRunPass:
-		payload, err = createTestRunPayload("pass", "presubmit was successful", resultsUrl)
+		payload, err = createTestRunPayload("pass", "presubmit was successful", resultsUrl, messages)
 	case TestRunFail:
-		payload, err = createTestRunPayload("fail", "presubmit failed", resultsUrl)
+		payload, err = createTestRunPayload("fail", "presubmit failed", resultsUrl, messages)
 	default:
 		return "", fmt.Errorf("invalid request type: %v", responseType)
 	}
@@ -811,7 +865,18 @@ func TestRunDetails(ctx *Context, review, version int) (map[int]TestRun, error)
 // doSwarmRequest sends an HTTP request to swarm, returning the byte payload is successful.
 // |action| is an HTTP action (GET, POST, etc.).
 // |endpoint| is the path to be queried by the request (eg. https://sge-swarm:9000/<ENDPOINT>).
+// Requests fail fast while the breaker of the context is open.
 func doSwarmRequest(ctx *Context, action, endpoint, encoding string, payload []byte) ([]byte, error) {
+	if err := ctx.Breaker.allow(); err != nil {
+		return nil, &unreachableError{fmt.Errorf("%s %v: %w", action, BuildUrl(ctx, endpoint), err)}
+	}
+	data, err := sendSwarmRequest(ctx, action, endpoint, encoding, payload)
+	ctx.Breaker.record(err)
+	return data, err
+}
+
+// sendSwarmRequest is doSwarmRequest without the breaker.
+func sendSwarmRequest(ctx *Context, action, endpoint, encoding string, payload []byte) ([]byte, error) {
 	url := BuildUrl(ctx, endpoint)
 	req, err := http.NewRequestWithContext(ctx.Ctx, action, url, bytes.NewBuffer(payload))
 	if err != nil {
@@ -819,11 +884,12 @@ func doSwarmRequest(ctx *Context, action, endpoint, encoding string, payload []b
 	}
 	req.SetBasicAuth(ctx.Username, ctx.Password)
 	req.Header.Set("Content-Type", encoding)
+	ctx.auditRequest(req)
 
 	client := ctx.client()
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, &unreachableError{err}
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
@@ -834,6 +900,11 @@ func doSwarmRequest(ctx *Context, action, endpoint, encoding string, payload []b
 	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusAccepted {
 		log.Warningf("unexpected status for %s %v: %v (%s)", action, url, resp.Status, data)
 	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		// Proxies in front of Swarm answer these when it is down.
+		return nil, &unreachableError{fmt.Errorf("%s %v: %v", action, url, resp.Status)}
+	}
 
 	// Don't bother checking the status code since Swarm sometimes returns
 	// unexpected status codes on success.  Instead, check if the response
@@ -857,7 +928,7 @@ func (ctx *Context) client() *http.Client {
 	if ctx.Client != nil {
 		return ctx.Client
 	}
-	return &http.Client{}
+	return defaultClient
 }
 
 func (ctx *Context) doSwarmRequest(action, endpoint string, req, resp interface{}) error {
@@ -874,7 +945,8 @@ func (ctx *Context) doSwarmRequest(action, endpoint string, req, resp interface{
 		return err
 	}
 	if resp != nil {
-		if err := json.Unmarshal(payload, resp); err != nil {
+		d := Decoder{Strict: ctx.Strict}
+		if err := d.Decode(payload, resp); err != nil {
 			return fmt.Errorf("couldn't unmarshal json '%s' to %v: %v", payload, reflect.TypeOf(resp).Name(), err)
 		}
 	}
@@ -893,11 +965,15 @@ func BuildUrl(context *Context, endpoint string) string {
 	return url
 }
 
-func createTestRunPayload(status, body, resultsUrl string) ([]byte, error) {
+// createTestRunPayload returns the test run response with |messages|, or |body| if there are none.
+func createTestRunPayload(status, body, resultsUrl string, messages []string) ([]byte, error) {
+	if len(messages) == 0 {
+		messages = []string{body}
+	}
 	message := &TestRunResponse{
 		Status:   status,
 		Url:      resultsUrl,
-		Messages: []string{body},
+		Messages: messages,
 	}
 	return json.Marshal(message)
 }
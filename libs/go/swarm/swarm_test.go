@@ -0,0 +1,1044 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestDecodeGolden decodes responses captured from a Swarm server in strict mode. Any change in the
+// coercions applied means that either the schema or the decoder changed behaviour.
+func TestDecodeGolden(t *testing.T) {
+	testCases := []struct {
+		file          string
+		target        func() interface{}
+		wantCoercions []string
+		check         func(t *testing.T, v interface{})
+	}{
+		{
+			file:   "review.json",
+			target: func() interface{} { return &struct{ Review *Review }{} },
+			wantCoercions: []string{
+				`review.approvals: emptyarray ([])`,
+				`review.commitStatus: emptyarray ([])`,
+				`review.participants.alice: emptyarray ([])`,
+				`review.participants.bob.required: strbool ("1")`,
+				`review.participants.bob.vote.version: strnum ("2")`,
+				`review.pending: numbool (1)`,
+				`review.versions[0].pending: numbool (1)`,
+			},
+			check: func(t *testing.T, v interface{}) {
+				review := v.(*struct{ Review *Review }).Review
+				want := map[string]Participant{
+					"alice": {},
+					"bob":   {Required: true, Vote: Vote{Value: 1, Version: 2}},
+					"carol": {Required: true, Vote: Vote{Value: -1, Version: 1, IsStale: true}},
+				}
+				if diff := cmp.Diff(want, review.Participants); diff != "" {
+					t.Errorf("participants diff (-want +got):\n%s", diff)
+				}
+				if !bool(review.Pending) || !review.Versions[0].Pending {
+					t.Errorf("want pending review and version, got %v and %v", review.Pending, review.Versions[0].Pending)
+				}
+			},
+		},
+		{
+			file:   "reviews.json",
+			target: func() interface{} { return &ReviewCollection{} },
+			wantCoercions: []string{
+				`reviews[0].participants.bob: emptyarray ([])`,
+				`reviews[0].versions[0].pending: numbool (0)`,
+				`reviews[1].commitStatus: emptyarray ([])`,
+				`reviews[1].participants: emptyarray ([])`,
+				`reviews[1].pending: numbool (1)`,
+			},
+			check: func(t *testing.T, v interface{}) {
+				rc := v.(*ReviewCollection)
+				if len(rc.Reviews) != 2 || rc.LastSeen != 12001 {
+					t.Fatalf("want 2 reviews and lastSeen 12001, got %d and %d", len(rc.Reviews), rc.LastSeen)
+				}
+				if got := rc.Reviews[0].CommitStatus.Status; got != "Committed" {
+					t.Errorf("want commit status Committed, got %q", got)
+				}
+				if diff := cmp.Diff(map[string][]int{"alice": {1, 2}}, rc.Reviews[1].Approvals); diff != "" {
+					t.Errorf("approvals diff (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			file:   "comments.json",
+			target: func() interface{} { return &CommentCollection{} },
+			wantCoercions: []string{
+				`comments[0].context: emptyarray ([])`,
+				`comments[1].context.version: strnum ("2")`,
+			},
+			check: func(t *testing.T, v interface{}) {
+				cc := v.(*CommentCollection)
+				if len(cc.Comments) != 2 {
+					t.Fatalf("want 2 comments, got %d", len(cc.Comments))
+				}
+				ctx := cc.Comments[1].Context
+				if ctx == nil || ctx.Version != 2 || ctx.RightLine != 42 {
+					t.Errorf("want context with version 2 and right line 42, got %+v", ctx)
+				}
+			},
+		},
+		{
+			file: "testruns.json",
+			target: func() interface{} {
+				return &struct {
+					Data struct{ Testruns TestRunsMap }
+				}{}
+			},
+			wantCoercions: []string{
+				`data.testruns.17.change: strnum ("12346")`,
+				`data.testruns.17.version: strnum ("1")`,
+			},
+		},
+		{
+			file: "testruns_empty.json",
+			target: func() interface{} {
+				return &struct {
+					Data struct{ Testruns TestRunsMap }
+				}{}
+			},
+			wantCoercions: []string{
+				`data.testruns: emptyarray ([])`,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		d := Decoder{Strict: true}
+		v := tc.target()
+		if err := d.Decode(readGolden(t, tc.file), v); err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.file, err)
+			continue
+		}
+		var got []string
+		for _, c := range d.Coercions {
+			got = append(got, c.String())
+		}
+		// Objects are walked in map order.
+		sort.Strings(got)
+		if diff := cmp.Diff(tc.wantCoercions, got); diff != "" {
+			t.Errorf("%s: coercions diff (-want +got):\n%s", tc.file, diff)
+		}
+		if tc.check != nil {
+			tc.check(t, v)
+		}
+	}
+}
+
+func TestDecodeRules(t *testing.T) {
+	type fields struct {
+		Num     int    `json:"num"`
+		Bool    bool   `json:"bool"`
+		Str     string `json:"str"`
+		NumStr  string `json:"numStr" swarm:"numstr"`
+		StrBool bool   `json:"strBool" swarm:"strbool"`
+	}
+	testCases := []struct {
+		input   string
+		want    fields
+		wantErr string
+	}{
+		{
+			input: `{"num": 1, "bool": true, "str": "a", "numStr": 7, "strBool": "true"}`,
+			want:  fields{Num: 1, Bool: true, Str: "a", NumStr: "7", StrBool: true},
+		},
+		{
+			input:   `{"num": "1"}`,
+			wantErr: `"num"`,
+		},
+		{
+			input:   `{"bool": 1}`,
+			wantErr: `"bool"`,
+		},
+		{
+			input:   `{"str": 1}`,
+			wantErr: `"str"`,
+		},
+		{
+			input:   `{"strBool": "maybe"}`,
+			wantErr: `"strBool"`,
+		},
+		{
+			input: `[]`,
+			want:  fields{},
+		},
+		{
+			input:   `[1]`,
+			wantErr: `"<root>"`,
+		},
+	}
+	for _, tc := range testCases {
+		var got fields
+		err := Decode([]byte(tc.input), &got)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Decode(%s): want error containing %s, got %v", tc.input, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Decode(%s): unexpected error: %v", tc.input, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Decode(%s) diff (-want +got):\n%s", tc.input, diff)
+		}
+	}
+}
+
+func TestGetReviewDecodesGolden(t *testing.T) {
+	golden := readGolden(t, "review.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v9/reviews/12345" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(golden)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+	ctx.Strict = true
+	review, err := GetReview(ctx, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.ID != 12345 || review.Author != "alice" || len(review.Versions) != 2 {
+		t.Errorf("unexpected review: %+v", review)
+	}
+}
+
+func TestActor(t *testing.T) {
+	actor := Actor{Pipeline: "presubmit", RunID: "1234-abcd", URL: "https://ci/runs/1234-abcd"}
+	signed := actor.Sign("Presubmit failed.")
+	want := "Presubmit failed.\n\n-- sge-bot pipeline=presubmit run=1234-abcd url=https://ci/runs/1234-abcd"
+	if signed != want {
+		t.Errorf("Sign: want %q, got %q", want, signed)
+	}
+	if resigned := actor.Sign(signed); resigned != signed {
+		t.Errorf("Sign of signed body: want %q, got %q", signed, resigned)
+	}
+	other := Actor{Pipeline: "publish"}
+	if got, want := other.Sign(signed), "Presubmit failed.\n\n-- sge-bot pipeline=publish"; got != want {
+		t.Errorf("Sign by other actor: want %q, got %q", want, got)
+	}
+	if got, ok := ParseSignature(signed); !ok || got != actor {
+		t.Errorf("ParseSignature: want %+v, got %+v (%v)", actor, got, ok)
+	}
+	if got, ok := ParseSignature("-- sge-bot pipeline=presubmit\nnot a signature"); ok {
+		t.Errorf("ParseSignature of unsigned body: want no actor, got %+v", got)
+	}
+
+	// Comments are signed and requests labelled.
+	var gotBody string
+	var gotHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeaders = r.Header
+		var add CommentAdd
+		if err := json.NewDecoder(r.Body).Decode(&add); err != nil {
+			t.Errorf("could not decode comment: %v", err)
+		}
+		gotBody = add.Body
+		w.Write([]byte(`{"comment": {"id": 1}}`))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "bot", "password").WithActor(actor)
+	if err := AddComment(ctx, &Comment{Topic: "reviews/1", Body: "Presubmit failed."}); err != nil {
+		t.Fatal(err)
+	}
+	if gotBody != want {
+		t.Errorf("comment body: want %q, got %q", want, gotBody)
+	}
+	if got := gotHeaders.Get(actorPipelineHeader); got != "presubmit" {
+		t.Errorf("pipeline header: want presubmit, got %q", got)
+	}
+	if got := gotHeaders.Get(actorRunHeader); got != "1234-abcd" {
+		t.Errorf("run header: want 1234-abcd, got %q", got)
+	}
+
+	impersonated := ctx.Impersonate("alice", "TICKET")
+	if impersonated.Username != "alice" || impersonated.Password != "TICKET" || impersonated.Actor == nil {
+		t.Errorf("unexpected impersonated context: %+v", impersonated)
+	}
+	if ctx.Username != "bot" {
+		t.Errorf("Impersonate modified the original context: %+v", ctx)
+	}
+}
+
+func TestCommentBatch(t *testing.T) {
+	var lock sync.Mutex
+	var topics []string
+	notified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/api/v9/comments":
+			var add CommentAdd
+			if err := json.NewDecoder(r.Body).Decode(&add); err != nil {
+				t.Errorf("could not decode comment: %v", err)
+			}
+			if add.DelayNotification != "true" {
+				t.Errorf("comment to %s without delayed notification", add.Topic)
+			}
+			if add.Body == "fail" {
+				w.Write([]byte(`{"error": "invalid comment"}`))
+				return
+			}
+			topics = append(topics, add.Topic)
+			w.Write([]byte(`{"comment": {"id": 1}}`))
+		case "/api/v9/comments/notify":
+			if err := r.ParseForm(); err != nil {
+				t.Error(err)
+			}
+			if got := r.PostForm.Get("topic"); got != "reviews/7" {
+				t.Errorf("notification topic: want reviews/7, got %q", got)
+			}
+			notified++
+			w.Write([]byte(`{"isValid": true, "message": "sent"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+
+	msg, err := WithCommentBatch(ctx, 7, func(batch *CommentBatch) error {
+		for i := 0; i < 3; i++ {
+			if _, err := batch.Add(&Comment{Body: "lgtm"}); err != nil {
+				return err
+			}
+		}
+		_, err := batch.Add(&Comment{Body: "fail"})
+		return err
+	})
+	if err == nil {
+		t.Errorf("WithCommentBatch: want error of the failed comment")
+	}
+	if msg != "sent" || notified != 1 {
+		t.Errorf("want a single notification, got %d (message %q)", notified, msg)
+	}
+	if want := []string{"reviews/7", "reviews/7", "reviews/7"}; !cmp.Equal(want, topics) {
+		t.Errorf("topics: want %v, got %v", want, topics)
+	}
+
+	// Empty batches don't notify, and closed batches can't be added to.
+	batch := NewCommentBatch(ctx, 7)
+	if _, err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if notified != 1 {
+		t.Errorf("empty batch sent a notification")
+	}
+	if _, err := batch.Add(&Comment{Body: "late"}); err == nil {
+		t.Errorf("Add to closed batch: want error")
+	}
+}
+
+func TestDescriptionTemplate(t *testing.T) {
+	desc := &Change{
+		CL:   42,
+		User: "alice",
+		Description: "Fix the flaky loader\r\n\r\nRetry when the asset server is busy.\n\n" +
+			"Affected paths:\n  //depot/old/...\n\nBUG=12, 34\nTESTED=ran the loader tests\n",
+		Files: []string{
+			"//depot/game/loader/loader.go",
+			"//depot/game/loader/retry.go",
+			"//depot/libs/net/busy.go",
+		},
+	}
+	fields, err := FieldsFromChange(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFields := &DescriptionFields{
+		CL:      42,
+		Author:  "alice",
+		Summary: "Fix the flaky loader",
+		Body:    "Retry when the asset server is busy.",
+		Bugs:    []int{12, 34},
+		Tested:  "ran the loader tests",
+		Paths:   []string{"//depot/game/loader/...", "//depot/libs/net/..."},
+	}
+	if diff := cmp.Diff(wantFields, fields); diff != "" {
+		t.Errorf("FieldsFromChange (-want +got):\n%s", diff)
+	}
+	got, err := RenderDescription(DefaultDescriptionTemplate, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Fix the flaky loader
+
+Retry when the asset server is busy.
+
+Affected paths:
+  //depot/game/loader/...
+  //depot/libs/net/...
+
+BUG=12,34
+TESTED=ran the loader tests
+`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RenderDescription (-want +got):\n%s", diff)
+	}
+	// Rendering is stable: the rendered description gives back the same fields.
+	desc.Description = got
+	again, err := FieldsFromChange(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(fields, again); diff != "" {
+		t.Errorf("FieldsFromChange of rendered description (-want +got):\n%s", diff)
+	}
+	if _, err := RenderDescription("{{.Nope", fields); err == nil {
+		t.Errorf("RenderDescription of invalid template: want error")
+	}
+}
+
+func TestReconcileDescriptions(t *testing.T) {
+	tests := []struct {
+		name           string
+		base, r, c     string
+		wantAction     SyncAction
+		wantSyncedDesc string
+	}{
+		{"in sync", "a", "a\n", "a\r\n", SyncNone, "a"},
+		{"change edited", "a", "a", "b", SyncToReview, "b"},
+		{"review edited", "a", "b", "a", SyncToChange, "b"},
+		{"both edited", "a", "b", "c", SyncConflict, ""},
+		{"never synced", "", "b", "c", SyncToReview, "c"},
+	}
+	for _, tc := range tests {
+		action, desc := ReconcileDescriptions(tc.base, tc.r, tc.c)
+		if action != tc.wantAction || desc != tc.wantSyncedDesc {
+			t.Errorf("%s: got %v %q, want %v %q", tc.name, action, desc, tc.wantAction, tc.wantSyncedDesc)
+		}
+	}
+}
+
+// descChanges fakes a changelist whose description is synced.
+type descChanges struct {
+	desc string
+}
+
+func (c *descChanges) Change(cl int) (*Change, error) {
+	return &Change{CL: cl, Status: "pending", Description: c.desc}, nil
+}
+
+func (c *descChanges) UpdateDescription(cl int, desc string) error {
+	c.desc = desc
+	return nil
+}
+
+func TestSyncDescription(t *testing.T) {
+	reviewDesc := "original"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			var patch ReviewPatch
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Errorf("could not decode patch: %v", err)
+			}
+			reviewDesc = *patch.Description
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"review": map[string]interface{}{"id": 1, "description": reviewDesc},
+		})
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+	changes := &descChanges{desc: "edited in p4\n"}
+	sync := func(base string) *DescriptionSync {
+		t.Helper()
+		result, err := SyncDescription(ctx, changes, &Review{ID: 1, Description: reviewDesc}, 10, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := sync("original")
+	if reviewDesc != "edited in p4" || result.Action != SyncToReview || result.Description != "edited in p4" {
+		t.Errorf("sync to review: got review %q and %+v", reviewDesc, result)
+	}
+	reviewDesc = "edited in swarm"
+	if result = sync(result.Description); result.Action != SyncToChange || changes.desc != "edited in swarm" {
+		t.Errorf("sync to change: got change description %q and %+v", changes.desc, result)
+	}
+	reviewDesc, changes.desc = "swarm again", "p4 again"
+	want := &DescriptionSync{Action: SyncConflict, Change: "p4 again"}
+	if diff := cmp.Diff(want, sync(result.Description)); diff != "" || reviewDesc != "swarm again" || changes.desc != "p4 again" {
+		t.Errorf("sync of conflicting edits diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCreateReview(t *testing.T) {
+	var got NewReview
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v9/reviews" {
+			t.Errorf("got request %s %s, want POST /api/v9/reviews", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("could not decode review: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"review": map[string]interface{}{"id": 12, "changes": []int{got.Change}},
+		})
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+
+	want := NewReview{Change: 10, Description: "update foo", Reviewers: []string{"alice"}}
+	review, err := CreateReview(ctx, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.ID != 12 {
+		t.Errorf("got review %d, want 12", review.ID)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected request (-want +got):\n%s", diff)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	var lock sync.Mutex
+	down := true
+	var votes, posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v9/reviews/7/vote":
+			var v struct {
+				Vote struct {
+					Value string `json:"value"`
+				} `json:"vote"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+				t.Errorf("could not decode vote: %v", err)
+			}
+			votes = append(votes, v.Vote.Value)
+			w.Write([]byte(`{"isValid": true}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v9/comments":
+			var add CommentAdd
+			if err := json.NewDecoder(r.Body).Decode(&add); err != nil {
+				t.Errorf("could not decode comment: %v", err)
+			}
+			if add.DelayNotification != "" {
+				t.Errorf("replayed comment %q with delayed notification", add.Body)
+			}
+			posted = append(posted, add.Body)
+			w.Write([]byte(`{"comment": {"id": 2}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v9/comments":
+			if r.URL.Query().Get("after") != "" {
+				w.Write([]byte(`{"comments": []}`))
+				return
+			}
+			// The response of this comment was lost, but Swarm got it.
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"comments": []map[string]interface{}{
+					{"id": 1, "body": "already there", "user": "user", "time": time.Now().Unix(), "topic": "reviews/7"},
+				},
+				"lastSeen": 1,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+	ctx.Queue = NewQueue(filepath.Join(t.TempDir(), "queue.json"))
+
+	for _, vote := range []string{"down", "up"} {
+		if err := SetVote(ctx, 7, vote); !errors.Is(err, ErrQueued) {
+			t.Errorf("SetVote(%s) = %v, want ErrQueued", vote, err)
+		}
+	}
+	for _, body := range []string{"looks good", "already there", "looks good"} {
+		if _, err := AddCommentEx(ctx, &Comment{Body: body, Topic: "reviews/7"}, true); !errors.Is(err, ErrQueued) {
+			t.Errorf("AddCommentEx(%s) = %v, want ErrQueued", body, err)
+		}
+	}
+	// The latest vote replaces the first one, the duplicate comment is only queued once.
+	if n, err := ctx.Queue.Len(); err != nil || n != 3 {
+		t.Errorf("Len() = %d, %v, want 3", n, err)
+	}
+
+	// Other users' requests stay queued.
+	other := *ctx
+	other.Username = "other"
+	if n, err := ctx.Queue.Flush(&other); err != nil || n != 0 {
+		t.Errorf("Flush() as other user = %d, %v, want 0", n, err)
+	}
+
+	lock.Lock()
+	down = false
+	lock.Unlock()
+	if n, err := ctx.Queue.Flush(ctx); err != nil || n != 3 {
+		t.Errorf("Flush() = %d, %v, want 3", n, err)
+	}
+	if want := []string{"up"}; !cmp.Equal(want, votes) {
+		t.Errorf("votes: want %v, got %v", want, votes)
+	}
+	if want := []string{"looks good"}; !cmp.Equal(want, posted) {
+		t.Errorf("comments: want %v, got %v", want, posted)
+	}
+	if n, err := ctx.Queue.Len(); err != nil || n != 0 {
+		t.Errorf("Len() after Flush = %d, %v, want 0", n, err)
+	}
+}
+
+func TestQueueConcurrent(t *testing.T) {
+	// Queues on the same file, as used by several processes.
+	path := filepath.Join(t.TempDir(), "queue.json")
+	ctx := New("http://swarm", 80, "user", "password")
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf(`{"body": "comment %d"}`, i))
+			if err := NewQueue(path).add(ctx, http.MethodPost, commentsEndpoint, payload); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got, err := NewQueue(path).Len(); err != nil || got != n {
+		t.Errorf("Len() = %d, %v, want %d", got, err, n)
+	}
+}
+
+func TestParticipants(t *testing.T) {
+	// The review as kept by the fake Swarm server.
+	participants := map[string]Participant{
+		"author": {},
+		"alice":  {Required: true},
+	}
+	updated := 100
+	var patches []ReviewPatch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v9/reviews/5" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var patch ReviewPatch
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Errorf("could not decode patch: %v", err)
+			}
+			patches = append(patches, patch)
+			participants = map[string]Participant{"author": {}}
+			for _, u := range patch.Reviewers {
+				participants[u] = Participant{}
+			}
+			for _, u := range patch.RequiredReviewers {
+				participants[u] = Participant{Required: true}
+			}
+			updated++
+		}
+		ps := map[string]interface{}{}
+		for u, p := range participants {
+			if p.Required {
+				ps[u] = map[string]interface{}{"required": "1"}
+			} else {
+				ps[u] = []interface{}{}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"review": map[string]interface{}{"id": 5, "author": "author", "participants": ps, "updated": updated},
+		})
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := New("http://"+u.Hostname(), port, "bob", "password")
+
+	r, err := JoinReview(ctx, 5, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReviewPatch{Reviewers: []string{"bob"}, RequiredReviewers: []string{"alice"}}
+	if diff := cmp.Diff(want, patches[len(patches)-1]); diff != "" {
+		t.Errorf("JoinReview: unexpected patch (-want +got):\n%s", diff)
+	}
+	if r.Updated != 101 {
+		t.Errorf("JoinReview: got review updated at %d, want 101", r.Updated)
+	}
+
+	// Changes based on a stale review are rejected.
+	if _, err := SetRequired(ctx, 5, 100, "bob", true); !errors.Is(err, ErrReviewUpdated) {
+		t.Errorf("SetRequired on stale review: got %v, want ErrReviewUpdated", err)
+	}
+	if len(patches) != 1 {
+		t.Errorf("SetRequired on stale review: got %d patches, want 1", len(patches))
+	}
+
+	if _, err := SetRequired(ctx, 5, 101, "bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetRequired(ctx, 5, 0, "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	want = ReviewPatch{Reviewers: []string{"alice"}, RequiredReviewers: []string{"bob"}}
+	if diff := cmp.Diff(want, patches[len(patches)-1]); diff != "" {
+		t.Errorf("SetRequired: unexpected patch (-want +got):\n%s", diff)
+	}
+
+	if _, err := LeaveReview(ctx, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	want = ReviewPatch{Reviewers: []string{"alice"}, RequiredReviewers: []string{}}
+	if diff := cmp.Diff(want, patches[len(patches)-1]); diff != "" {
+		t.Errorf("LeaveReview: unexpected patch (-want +got):\n%s", diff)
+	}
+	if _, ok := participants["bob"]; ok {
+		t.Errorf("LeaveReview: bob is still a participant: %v", participants)
+	}
+}
+
+func TestMapLine(t *testing.T) {
+	// Left file: 1..10. Right file: line 2 is deleted, 2 lines are added after 4, lines 7-8 are
+	// changed into 3 lines.
+	diffs := []p4lib.Diff{
+		{LeftStartLine: 7, LeftEndLine: 8, RightStartLine: 8, RightEndLine: 10, DiffType: p4lib.DiffChange},
+		{LeftStartLine: 2, LeftEndLine: 2, RightStartLine: 1, RightEndLine: 1, DiffType: p4lib.DiffDelete},
+		{LeftStartLine: 4, LeftEndLine: 4, RightStartLine: 4, RightEndLine: 5, DiffType: p4lib.DiffAdd},
+	}
+	for _, tc := range []struct {
+		line, want int
+		ok         bool
+	}{
+		{1, 1, true},
+		{2, 0, false},
+		{3, 2, true},
+		{4, 3, true},
+		{5, 6, true},
+		{6, 7, true},
+		{7, 0, false},
+		{8, 0, false},
+		{9, 11, true},
+		{10, 12, true},
+	} {
+		got, ok := MapLine(diffs, tc.line)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("MapLine(%d) = %d, %v; want %d, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// diffP4 fakes the subset of p4lib.P4 used to reanchor comments.
+type diffP4 struct {
+	p4lib.P4
+	diffs map[string][]p4lib.Diff
+	calls int
+}
+
+func (p4 *diffP4) Diff2At(file0 string, rev0 p4lib.RevSpec, file1 string, rev1 p4lib.RevSpec) ([]p4lib.Diff, error) {
+	p4.calls++
+	key := file0 + rev0.String() + " " + file1 + rev1.String()
+	d, ok := p4.diffs[key]
+	if !ok {
+		return nil, errors.New("no such file(s)")
+	}
+	return d, nil
+}
+
+func TestReanchorComments(t *testing.T) {
+	review := &Review{
+		ID: 1,
+		Versions: []Version{
+			{Change: 10, Pending: true},
+			{Change: 11, Pending: true},
+			{Change: 12},
+		},
+	}
+	p4 := &diffP4{diffs: map[string][]p4lib.Diff{
+		"//a.go@=10 //a.go@12": {{LeftStartLine: 1, LeftEndLine: 1, RightStartLine: 2, RightEndLine: 4, DiffType: p4lib.DiffAdd}},
+		"//a.go@=11 //a.go@12": {{LeftStartLine: 5, LeftEndLine: 5, RightStartLine: 5, RightEndLine: 5, DiffType: p4lib.DiffChange}},
+	}}
+	comment := func(id int, file string, version, line int) Comment {
+		return Comment{ID: id, Context: &CommentContext{File: file, Version: VersionID(version), RightLine: line}}
+	}
+	comments := []Comment{
+		comment(1, "//a.go", 1, 5),
+		comment(2, "//a.go", 1, 1),
+		comment(3, "//a.go", 2, 5),
+		comment(4, "//a.go", 3, 7),
+		comment(5, "//b.go", 1, 3),
+		comment(6, "", 1, 0),
+		{ID: 7},
+	}
+	got, err := ReanchorComments(p4, review, comments, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]Anchor{
+		1: {Comment: 1, File: "//a.go", Version: 3, Line: 8},
+		2: {Comment: 2, File: "//a.go", Version: 3, Line: 1},
+		3: {Comment: 3, File: "//a.go", Version: 3, Outdated: true},
+		4: {Comment: 4, File: "//a.go", Version: 3, Line: 7},
+		5: {Comment: 5, File: "//b.go", Version: 3, Outdated: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReanchorComments() diff (-want +got):\n%s", diff)
+	}
+	if p4.calls != 3 {
+		t.Errorf("got %d diffs, want 3: one per file and version", p4.calls)
+	}
+	if _, err := ReanchorComments(p4, review, comments, 4); err == nil {
+		t.Error("ReanchorComments of an unknown version: got no error")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var lock sync.Mutex
+	down := true
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v9/version":
+			w.Write([]byte(`{"version": "SWARM/2020.1"}`))
+		case "/api/v9/reviews/1":
+			w.Write([]byte(`{"review": {"id": 1}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	breaker := NewBreaker()
+	breaker.now = func() time.Time { return now }
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+	ctx.Breaker = breaker
+
+	// get gets a review and returns whether the request reached the server.
+	get := func() (bool, error) {
+		t.Helper()
+		lock.Lock()
+		before := requests
+		lock.Unlock()
+		_, err := GetReview(ctx, 1)
+		lock.Lock()
+		defer lock.Unlock()
+		return requests > before, err
+	}
+	for i := 0; i < breaker.MinRequests; i++ {
+		if sent, err := get(); !sent || err == nil {
+			t.Fatalf("request %d: sent = %t, err = %v, want a failed request", i, sent, err)
+		}
+	}
+	if sent, err := get(); sent || !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("request with open breaker: sent = %t, err = %v, want ErrCircuitOpen", sent, err)
+	}
+	if got := breaker.Status(); got.State != BreakerOpen || got.LastError == "" {
+		t.Errorf("Status() = %+v, want open with the last error", got)
+	}
+
+	// After the cooldown a single request goes through, failing opens the breaker again.
+	now = now.Add(breaker.Cooldown)
+	if got := breaker.Status().State; got != BreakerHalfOpen {
+		t.Errorf("Status().State after cooldown = %v, want half-open", got)
+	}
+	if sent, err := get(); !sent || err == nil {
+		t.Errorf("request after cooldown: sent = %t, err = %v, want a failed request", sent, err)
+	}
+	if sent, err := get(); sent || !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("request after failed probe: sent = %t, err = %v, want ErrCircuitOpen", sent, err)
+	}
+	if h := Health(ctx); h.Healthy || !h.Degraded() {
+		t.Errorf("Health() while down = %+v, want unhealthy", h)
+	}
+
+	// Health probes bypass the breaker and close it once Swarm is back.
+	lock.Lock()
+	down = false
+	lock.Unlock()
+	h := Health(ctx)
+	if !h.Healthy || h.Degraded() || h.Breaker.State != BreakerClosed {
+		t.Errorf("Health() once up = %+v, want healthy with a closed breaker", h)
+	}
+	if sent, err := get(); !sent || err != nil {
+		t.Errorf("request once up: sent = %t, err = %v, want success", sent, err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var lock sync.Mutex
+	conns := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte(`{"review": {"id": 1}}`))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			conns++
+			lock.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const maxConns = 4
+	transport := NewTransport(nil)
+	transport.Base.(*http.Transport).MaxConnsPerHost = maxConns
+	ctx := New("http://"+u.Hostname(), port, "user", "password")
+	ctx.Client = &http.Client{Transport: transport}
+
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := GetReview(ctx, 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if conns > maxConns {
+		t.Errorf("%d requests opened %d connections, want at most %d", requests, conns, maxConns)
+	}
+	stats := Health(ctx).Transport
+	if stats == nil {
+		t.Fatal("Health().Transport = nil, want the stats of the transport")
+	}
+	// The health probe is a request too.
+	if stats.InFlight != 0 || stats.Requests != requests+1 || stats.Errors != 0 {
+		t.Errorf("Stats() = %+v, want %d finished requests without errors", stats, requests+1)
+	}
+	total := 0
+	for _, n := range stats.Latency {
+		total += n
+	}
+	if total != stats.Requests || len(stats.Latency) != len(LatencyBuckets)+1 {
+		t.Errorf("Stats().Latency = %v, want %d requests in %d buckets", stats.Latency, stats.Requests, len(LatencyBuckets)+1)
+	}
+}
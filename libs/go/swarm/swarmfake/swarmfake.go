@@ -0,0 +1,460 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package swarmfake implements an in-memory Swarm server for tests. It serves the subset of the
+// Swarm API used by the CI and the review archive: reviews, comments and test runs.
+//
+// Usage:
+//      server := swarmfake.New()
+//      defer server.Close()
+//      server.AddReview(swarm.Review{ID: 1, Author: "alice", Changes: []int{2}})
+//      ctx := server.Context()
+//      ...
+//      comments := server.Comments(1)
+package swarmfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"sge-monorepo/libs/go/swarm"
+)
+
+var (
+	reviewRe   = regexp.MustCompile(`^/api/v9/reviews/(\d+)$`)
+	testRunsRe = regexp.MustCompile(`^/api/v10/reviews/(\d+)/testruns$`)
+	updateRe   = regexp.MustCompile(`^/api/v10/testruns/(\d+)/([^/]+)$`)
+)
+
+// Update is an update of a test run received by the server.
+type Update struct {
+	Status   string
+	URL      string
+	Messages []string
+}
+
+// Server is a fake Swarm server. It is safe for concurrent use.
+type Server struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	reviews  map[int]*swarm.Review
+	comments []swarm.Comment
+	testRuns []swarm.TestRun
+	updates  map[int][]Update
+}
+
+// New starts a fake Swarm server without any review.
+func New() *Server {
+	s := &Server{
+		reviews: map[int]*swarm.Review{},
+		updates: map[int][]Update{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v9/version", s.handleVersion)
+	mux.HandleFunc("/api/v9/reviews", s.handleReviews)
+	mux.HandleFunc("/api/v9/reviews/", s.handleReview)
+	mux.HandleFunc("/api/v9/comments", s.handleComments)
+	mux.HandleFunc("/api/v10/reviews/", s.handleTestRuns)
+	mux.HandleFunc("/api/v10/testruns/", s.handleUpdate)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// URL returns the base url of the server, eg. "http://127.0.0.1:1234".
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Context returns a Swarm context that talks to the server.
+func (s *Server) Context() *swarm.Context {
+	u, _ := url.Parse(s.server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	ctx := swarm.New("http://"+u.Hostname(), port, "swarmfake", "")
+	ctx.Strict = true
+	return ctx
+}
+
+// AddReview adds or replaces a review.
+func (s *Server) AddReview(review swarm.Review) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reviews[review.ID] = &review
+}
+
+// Review returns review |id|, with the test status set by the last test run update.
+func (s *Server) Review(id int) (swarm.Review, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reviews[id]
+	if !ok {
+		return swarm.Review{}, false
+	}
+	return *r, true
+}
+
+// Comments returns the comments posted on review |id|, oldest first.
+func (s *Server) Comments(id int) []swarm.Comment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topic := fmt.Sprintf("reviews/%d", id)
+	var ret []swarm.Comment
+	for _, c := range s.comments {
+		if c.Topic == topic {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// TestRuns returns the test runs of review |id|, oldest first.
+func (s *Server) TestRuns(id int) []swarm.TestRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []swarm.TestRun
+	for _, tr := range s.testRuns {
+		if tr.Change == id {
+			ret = append(ret, tr)
+		}
+	}
+	return ret
+}
+
+// Updates returns the updates received for test run |id|, oldest first.
+func (s *Server) Updates(id int) []Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Update(nil), s.updates[id]...)
+}
+
+// UpdateURL returns the url the CI posts the results of |tr| to, as Ebert builds it. The host is
+// not the server's: runners only use the path of update urls.
+func UpdateURL(tr *swarm.TestRun) string {
+	return fmt.Sprintf("https://swarm.invalid/api/v10/testruns/%d/%s", tr.ID, tr.UUID)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"version": "swarmfake", "year": "2021"})
+}
+
+// pageSize is the number of reviews or comments per page when the request doesn't set max.
+const pageSize = 100
+
+func (s *Server) handleReviews(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listReviews(w, r)
+	case http.MethodPost:
+		s.createReview(w, r)
+	default:
+		notFound(w)
+	}
+}
+
+// listReviews lists the reviews in the states of the state[] parameters, newest first. Pages end
+// before the review of the after parameter.
+func (s *Server) listReviews(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	states := map[string]bool{}
+	for _, st := range q["state[]"] {
+		states[st] = true
+	}
+	after, _ := strconv.Atoi(q.Get("after"))
+	max := maxParam(q)
+	s.mu.Lock()
+	var ids []int
+	for id, review := range s.reviews {
+		if (len(states) == 0 || states[review.State]) && (after == 0 || id < after) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	total := len(ids)
+	if len(ids) > max {
+		ids = ids[:max]
+	}
+	rc := swarm.ReviewCollection{Reviews: []swarm.Review{}, TotalCount: total}
+	for _, id := range ids {
+		rc.Reviews = append(rc.Reviews, *s.reviews[id])
+		rc.LastSeen = id
+	}
+	s.mu.Unlock()
+	writeJSON(w, rc)
+}
+
+// createReview requests a review of a change, as its author.
+func (s *Server) createReview(w http.ResponseWriter, r *http.Request) {
+	var req swarm.NewReview
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	now := int(time.Now().Unix())
+	review := swarm.Review{
+		Author:       user,
+		Changes:      []int{req.Change},
+		Created:      now,
+		Updated:      now,
+		Description:  req.Description,
+		Participants: map[string]swarm.Participant{user: {}},
+		Pending:      true,
+		State:        "needsReview",
+		Versions:     []swarm.Version{{Change: req.Change, Pending: true, Time: now, User: user}},
+	}
+	for _, u := range req.Reviewers {
+		review.Participants[u] = swarm.Participant{}
+	}
+	for _, u := range req.RequiredReviewers {
+		review.Participants[u] = swarm.Participant{Required: true}
+	}
+	s.mu.Lock()
+	review.ID = req.Change + 1
+	for id := range s.reviews {
+		if id >= review.ID {
+			review.ID = id + 1
+		}
+	}
+	s.reviews[review.ID] = &review
+	s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"review": review})
+}
+
+func (s *Server) handleReview(w http.ResponseWriter, r *http.Request) {
+	m := reviewRe.FindStringSubmatch(r.URL.Path)
+	if m == nil || (r.Method != http.MethodGet && r.Method != http.MethodPatch) {
+		notFound(w)
+		return
+	}
+	id, _ := strconv.Atoi(m[1])
+	if _, ok := s.Review(id); !ok {
+		notFound(w)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		// Only description patches are supported, reviewers are left alone.
+		var patch swarm.ReviewPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if patch.Description != nil {
+			s.mu.Lock()
+			s.reviews[id].Description = *patch.Description
+			s.mu.Unlock()
+		}
+	}
+	review, _ := s.Review(id)
+	writeJSON(w, map[string]interface{}{"review": review})
+}
+
+func (s *Server) handleComments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listComments(w, r)
+	case http.MethodPost:
+		s.addComment(w, r)
+	default:
+		notFound(w)
+	}
+}
+
+// listComments lists the comments of the topic parameter, oldest first. Pages start after the
+// comment of the after parameter.
+func (s *Server) listComments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	topic := q.Get("topic")
+	after, _ := strconv.Atoi(q.Get("after"))
+	max := maxParam(q)
+	cc := swarm.CommentCollection{Comments: []swarm.Comment{}}
+	s.mu.Lock()
+	for _, c := range s.comments {
+		if len(cc.Comments) == max {
+			break
+		}
+		if (topic == "" || c.Topic == topic) && c.ID > after {
+			cc.Comments = append(cc.Comments, c)
+			cc.LastSeen = c.ID
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, cc)
+}
+
+func (s *Server) addComment(w http.ResponseWriter, r *http.Request) {
+	var add swarm.CommentAdd
+	if err := json.NewDecoder(r.Body).Decode(&add); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	s.mu.Lock()
+	c := swarm.Comment{
+		ID:    len(s.comments) + 1,
+		Body:  add.Body,
+		Topic: add.Topic,
+		Flags: add.Flags,
+		Time:  int(time.Now().Unix()),
+		User:  user,
+	}
+	// Swarm answers with the context it attached the comment to, left out for review comments.
+	if ac := add.Context; ac != nil && (ac.File != "" || ac.Comment != 0) {
+		version, _ := strconv.Atoi(ac.Version)
+		c.Context = &swarm.CommentContext{
+			Comment:   ac.Comment,
+			File:      ac.File,
+			LeftLine:  ac.LeftLine,
+			Line:      ac.RightLine,
+			RightLine: ac.RightLine,
+			Review:    reviewID(add.Topic),
+			Version:   swarm.VersionID(version),
+		}
+	}
+	s.comments = append(s.comments, c)
+	if review, ok := s.reviews[reviewID(add.Topic)]; ok {
+		review.Comments = append(review.Comments, c.ID)
+	}
+	s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"comment": c})
+}
+
+func (s *Server) handleTestRuns(w http.ResponseWriter, r *http.Request) {
+	m := testRunsRe.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		notFound(w)
+		return
+	}
+	id, _ := strconv.Atoi(m[1])
+	if _, ok := s.Review(id); !ok {
+		notFound(w)
+		return
+	}
+	if r.Method == http.MethodGet {
+		version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+		runs := swarm.TestRunsMap{}
+		for _, tr := range s.TestRuns(id) {
+			if version == 0 || tr.Version == version {
+				runs[tr.ID] = tr
+			}
+		}
+		writeJSON(w, map[string]interface{}{"data": map[string]interface{}{"testruns": runs}})
+		return
+	}
+	var req struct {
+		Version   int    `json:"version"`
+		StartTime int64  `json:"startTime"`
+		Status    string `json:"status"`
+		Test      string `json:"test"`
+		UUID      string `json:"uuid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	tr := swarm.TestRun{
+		ID:        len(s.testRuns) + 1,
+		Change:    id,
+		Version:   req.Version,
+		Test:      req.Test,
+		StartTime: req.StartTime,
+		Status:    req.Status,
+		UUID:      req.UUID,
+	}
+	s.testRuns = append(s.testRuns, tr)
+	s.reviews[id].TestStatus = tr.Status
+	s.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"data": map[string]interface{}{"testruns": []swarm.TestRun{tr}}})
+}
+
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	m := updateRe.FindStringSubmatch(r.URL.Path)
+	if m == nil || r.Method != http.MethodPost {
+		notFound(w)
+		return
+	}
+	id, _ := strconv.Atoi(m[1])
+	var resp swarm.TestRunResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := id - 1
+	if idx < 0 || idx >= len(s.testRuns) || s.testRuns[idx].UUID != m[2] {
+		notFound(w)
+		return
+	}
+	tr := &s.testRuns[idx]
+	tr.Status = resp.Status
+	tr.URL = resp.Url
+	tr.Messages = resp.Messages
+	if resp.Status == "pass" || resp.Status == "fail" {
+		tr.CompletedTime = time.Now().Unix()
+	}
+	if review, ok := s.reviews[tr.Change]; ok {
+		review.TestStatus = tr.Status
+	}
+	s.updates[id] = append(s.updates[id], Update{
+		Status:   resp.Status,
+		URL:      resp.Url,
+		Messages: resp.Messages,
+	})
+	writeJSON(w, map[string]interface{}{"isValid": true})
+}
+
+// maxParam returns the max parameter of a list request, the page size if unset.
+func maxParam(q url.Values) int {
+	if max, err := strconv.Atoi(q.Get("max")); err == nil && max > 0 {
+		return max
+	}
+	return pageSize
+}
+
+// reviewID returns the id of the review of a comment topic, or 0 if it's not a review.
+func reviewID(topic string) int {
+	var id int
+	if _, err := fmt.Sscanf(topic, "reviews/%d", &id); err != nil {
+		return 0
+	}
+	return id
+}
+
+// notFound answers like Swarm does for missing resources: a response its clients see as invalid.
+func notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{"isValid": false, "error": "Not Found"})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarmfake
+
+import (
+	"testing"
+
+	"sge-monorepo/libs/go/swarm"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServer(t *testing.T) {
+	server := New()
+	defer server.Close()
+	server.AddReview(swarm.Review{ID: 10, Author: "alice", Changes: []int{11}})
+	ctx := server.Context()
+
+	review, err := swarm.GetReview(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.Author != "alice" {
+		t.Errorf("got author %q, want alice", review.Author)
+	}
+	if _, err := swarm.GetReview(ctx, 12); err == nil {
+		t.Errorf("GetReview of a missing review succeeded")
+	}
+	if _, err := swarm.UpdateDescription(ctx, 10, "edited"); err != nil {
+		t.Fatal(err)
+	}
+	if review, _ := server.Review(10); review.Description != "edited" {
+		t.Errorf("got description %q, want edited", review.Description)
+	}
+
+	tr, err := swarm.CreateTestRun(ctx, 10, 1, "token.v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swarm.SendTestRunMessages(ctx, swarm.TestRunFail, UpdateURL(tr), "http://ci/1", []string{"lint failed"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []Update{{Status: "fail", URL: "http://ci/1", Messages: []string{"lint failed"}}}
+	if diff := cmp.Diff(want, server.Updates(tr.ID)); diff != "" {
+		t.Errorf("Updates() diff (-want +got):\n%s", diff)
+	}
+	runs, err := swarm.TestRunDetails(ctx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runs[tr.ID].Status; got != "fail" {
+		t.Errorf("got test run status %q, want fail", got)
+	}
+	if review, _ := server.Review(10); review.TestStatus != "fail" {
+		t.Errorf("got review test status %q, want fail", review.TestStatus)
+	}
+	if _, err := swarm.SendTestRunRequest(ctx, swarm.TestRunPass, "https://swarm.invalid/api/v10/testruns/1/other", ""); err == nil {
+		t.Errorf("update with the wrong uuid succeeded")
+	}
+
+	if err := swarm.AddComment(ctx, &swarm.Comment{Topic: "reviews/10", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	comments := server.Comments(10)
+	if len(comments) != 1 || comments[0].Body != "hello" {
+		t.Errorf("got comments %v, want one saying hello", comments)
+	}
+	if health := swarm.Health(ctx); !health.Healthy {
+		t.Errorf("server isn't healthy: %s", health.Error)
+	}
+}
+
+func TestListAndCreate(t *testing.T) {
+	server := New()
+	defer server.Close()
+	ctx := server.Context()
+	for id := 1; id <= 150; id++ {
+		state := "needsReview"
+		if id%2 == 0 {
+			state = "rejected"
+		}
+		server.AddReview(swarm.Review{ID: id, State: state})
+	}
+	rc, err := swarm.GetReviews(ctx, "state[]=rejected&max=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.Reviews) != 75 || rc.Reviews[0].ID != 150 {
+		t.Errorf("GetReviews() returned %d reviews, want the 75 rejected ones, newest first", len(rc.Reviews))
+	}
+
+	review, err := swarm.CreateReview(ctx, &swarm.NewReview{Change: 200, Description: "new", Reviewers: []string{"bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.ID != 201 || review.Author != "swarmfake" || len(review.Participants) != 2 {
+		t.Errorf("CreateReview() = %+v, want review 201 of swarmfake with bob", review)
+	}
+
+	topic := "reviews/201"
+	for i := 0; i < 120; i++ {
+		if err := swarm.AddComment(ctx, &swarm.Comment{Topic: topic, Body: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply := &swarm.Comment{Topic: topic, Body: "reply", Context: &swarm.CommentContext{Comment: 1}}
+	if err := swarm.AddComment(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := swarm.GetCommentsForReview(ctx, 201)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.Comments) != 121 {
+		t.Fatalf("GetCommentsForReview() returned %d comments, want 121", len(cc.Comments))
+	}
+	if c := cc.Comments[120].Context; c == nil || c.Comment != 1 {
+		t.Errorf("reply context = %+v, want a reply to comment 1", c)
+	}
+}
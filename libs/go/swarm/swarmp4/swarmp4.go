@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package swarmp4 implements the interfaces through which package swarm reads Perforce, so that
+// users of swarm that don't touch changelists don't depend on p4lib.
+package swarmp4
+
+import (
+	"fmt"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+)
+
+// Changes returns the changelists of |p4| as swarm.Changes. Only the changes of the user of |p4|
+// can be updated.
+func Changes(p4 p4lib.P4) swarm.Changes {
+	return &changes{p4: p4}
+}
+
+// AdminChanges is Changes for admins, which updates descriptions with p4 change -f so that the
+// changes of other users can be updated, eg. by bots syncing the descriptions of all reviews.
+func AdminChanges(p4 p4lib.P4) swarm.Changes {
+	return &changes{p4: p4, force: true}
+}
+
+type changes struct {
+	p4    p4lib.P4
+	force bool
+}
+
+func (c *changes) Change(cl int) (*swarm.Change, error) {
+	descs, err := c.p4.Describe([]int{cl})
+	if err != nil {
+		return nil, fmt.Errorf("could not describe change %d: %w", cl, err)
+	}
+	if len(descs) != 1 {
+		return nil, fmt.Errorf("change %d not found", cl)
+	}
+	desc := descs[0]
+	if len(desc.Files) == 0 && desc.Status == "pending" {
+		if shelved, err := c.p4.DescribeShelved(cl); err == nil && len(shelved) == 1 {
+			desc.Files = shelved[0].Files
+		}
+	}
+	change := &swarm.Change{
+		CL:          desc.Cl,
+		User:        desc.User,
+		Status:      desc.Status,
+		Description: desc.Description,
+	}
+	for _, f := range desc.Files {
+		change.Files = append(change.Files, f.DepotPath)
+	}
+	return change, nil
+}
+
+func (c *changes) UpdateDescription(cl int, desc string) error {
+	update := c.p4.ChangeUpdate
+	if c.force {
+		update = c.p4.ChangeUpdateForce
+	}
+	if err := update(desc, cl); err != nil {
+		return fmt.Errorf("could not update change %d: %w", cl, err)
+	}
+	return nil
+}
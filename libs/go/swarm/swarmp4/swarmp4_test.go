@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarmp4
+
+import (
+	"testing"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/swarm"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChanges(t *testing.T) {
+	desc := "Fix the loader\n"
+	p4 := p4mock.Mock{
+		DescribeFunc: func(cls []int) ([]p4lib.Description, error) {
+			return []p4lib.Description{{Cl: cls[0], User: "alice", Status: "pending", Description: desc}}, nil
+		},
+		DescribeShelvedFunc: func(cls ...int) ([]p4lib.Description, error) {
+			return []p4lib.Description{{Cl: cls[0], Files: []p4lib.FileAction{{DepotPath: "//depot/game/loader.go"}}}}, nil
+		},
+		ChangeUpdateFunc: func(d string, cl int) error {
+			desc = d
+			return nil
+		},
+		ChangeUpdateForceFunc: func(d string, cl int) error {
+			desc = "forced: " + d
+			return nil
+		},
+	}
+	changes := Changes(p4)
+	got, err := changes.Change(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &swarm.Change{
+		CL:          42,
+		User:        "alice",
+		Status:      "pending",
+		Description: "Fix the loader\n",
+		Files:       []string{"//depot/game/loader.go"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Change(42) diff (-want +got):\n%s", diff)
+	}
+	if err := changes.UpdateDescription(42, "Fix the loader again"); err != nil {
+		t.Fatal(err)
+	}
+	if desc != "Fix the loader again" {
+		t.Errorf("UpdateDescription(42) set %q, want Fix the loader again", desc)
+	}
+	if err := AdminChanges(p4).UpdateDescription(42, "Fix the loader"); err != nil {
+		t.Fatal(err)
+	}
+	if desc != "forced: Fix the loader" {
+		t.Errorf("UpdateDescription(42) by an admin set %q, want a forced update", desc)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swarm
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Connection limits of the transports made by NewTransport.
+const (
+	// DefaultMaxConnsPerHost bounds the connections to a Swarm host. Requests past it wait for a
+	// connection to be free.
+	DefaultMaxConnsPerHost = 32
+	// DefaultMaxIdleConnsPerHost is how many connections to a Swarm host are kept open for reuse.
+	DefaultMaxIdleConnsPerHost = 16
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram of a Transport.
+var LatencyBuckets = []time.Duration{
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	400 * time.Millisecond,
+	2 * time.Second,
+	10 * time.Second,
+}
+
+// DefaultTransport is used by the contexts without a Client.
+var DefaultTransport = NewTransport(nil)
+
+var defaultClient = &http.Client{Transport: DefaultTransport}
+
+// Transport sends the requests of contexts over a pool of reused connections, and keeps track of
+// the requests in flight and of their latency. Bulk operations, eg. commenting the results of many
+// tests, share a bounded number of connections instead of opening one per request, which exhausts
+// the sockets of Windows machines. Share a transport between the contexts of a process:
+//
+//      transport := swarm.NewTransport(nil)
+//      ctx.Client = &http.Client{Transport: transport}
+//
+// A Transport is safe for concurrent use.
+type Transport struct {
+	// Base sends the requests. NewTransport sets it to a pooled *http.Transport, which can be
+	// wrapped, eg. for tracing.
+	Base http.RoundTripper
+
+	mu       sync.Mutex
+	inFlight int
+	requests int
+	errors   int
+	total    time.Duration
+	// latency counts the finished requests by LatencyBuckets, with a last bucket for the slower.
+	latency []int
+}
+
+// TransportStats is a snapshot of the instrumentation of a Transport.
+type TransportStats struct {
+	// InFlight is the number of requests sent whose response wasn't read yet.
+	InFlight int `json:"inFlight"`
+	// Requests is the number of finished requests.
+	Requests int `json:"requests"`
+	// Errors is the number of requests that got no response, eg. because Swarm can't be reached.
+	Errors int `json:"errors"`
+	// Mean is the mean latency of the finished requests.
+	Mean time.Duration `json:"mean"`
+	// Latency counts the finished requests by latency: Latency[i] requests took at most
+	// LatencyBuckets[i], and the last count is the requests slower than all buckets.
+	Latency []int `json:"latency"`
+}
+
+// NewTransport returns a transport with HTTP/2 and connections pooled by host, using |tlsConfig|
+// for HTTPS if not nil.
+func NewTransport(tlsConfig *tls.Config) *Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &Transport{
+		Base: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        4 * DefaultMaxIdleConnsPerHost,
+			MaxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+			MaxConnsPerHost:     DefaultMaxConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		latency: make([]int, len(LatencyBuckets)+1),
+	}
+}
+
+// RoundTrip implements http.RoundTripper. A request is in flight until the body of its response
+// is closed.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.inFlight++
+	t.mu.Unlock()
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		t.done(start, err)
+		return nil, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: func() { t.done(start, nil) }}
+	return resp, nil
+}
+
+// done records a request started at |start| as finished.
+func (t *Transport) done(start time.Time, err error) {
+	elapsed := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	t.requests++
+	if err != nil {
+		t.errors++
+	}
+	t.total += elapsed
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if elapsed <= bound {
+			bucket = i
+			break
+		}
+	}
+	t.latency[bucket]++
+}
+
+// Stats returns a snapshot of the instrumentation of the transport.
+func (t *Transport) Stats() TransportStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := TransportStats{
+		InFlight: t.inFlight,
+		Requests: t.requests,
+		Errors:   t.errors,
+		Latency:  append([]int(nil), t.latency...),
+	}
+	if t.requests > 0 {
+		stats.Mean = t.total / time.Duration(t.requests)
+	}
+	return stats
+}
+
+// trackedBody calls done once, when closed.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// transport returns the Transport of the context, nil if its client has another kind.
+func (ctx *Context) transport() *Transport {
+	t, _ := ctx.client().Transport.(*Transport)
+	return t
+}
@@ -16,9 +16,11 @@ package main
 
 import (
     "fmt"
+    "io/ioutil"
     "os"
     "os/exec"
     "path/filepath"
+    "regexp"
 )
 
 var protoGenDirName = "proto-gen"
@@ -32,6 +34,19 @@ func buildProto(cwd, proto string, includes []string, out string, options ...str
     for _, o := range options {
         args = append(args, "--go_opt", o)
     }
+    // Protos defining gRPC services also need protoc-gen-go-grpc in path.
+    protoPath := proto
+    if !filepath.IsAbs(protoPath) {
+        protoPath = filepath.Join(cwd, proto)
+    }
+    if hasService, err := definesService(protoPath); err != nil {
+        return err
+    } else if hasService {
+        args = append(args, "--go-grpc_out", out)
+        for _, o := range options {
+            args = append(args, "--go-grpc_opt", o)
+        }
+    }
     args = append(args, proto)
     fmt.Println("Executing:", args)
     cmd := exec.Command(args[0], args[1:]...)
@@ -43,6 +58,17 @@ func buildProto(cwd, proto string, includes []string, out string, options ...str
     return nil
 }
 
+var serviceRe = regexp.MustCompile(`(?m)^service\s+\w+`)
+
+// definesService returns whether the proto file defines a gRPC service.
+func definesService(proto string) (bool, error) {
+    content, err := ioutil.ReadFile(proto)
+    if err != nil {
+        return false, fmt.Errorf("could not read %q: %w", proto, err)
+    }
+    return serviceRe.Match(content), nil
+}
+
 // verifyGeneratedModule ensures a go.mod file exists in each generated proto so that we can
 // maintain our directory structure.
 func verifyGeneratedModule(gen string) error {
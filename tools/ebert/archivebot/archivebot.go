@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary archivebot archives closed reviews outside Swarm: reviews submitted, rejected or archived
+// more than -months ago are exported, with their comment threads and test runs, to -archive. It's
+// meant to run as a cron unit, with the same flags and credentials as Ebert.
+//
+// With -restore, it instead imports an archived review into the Swarm instance it's pointed at,
+// eg. a test one, as a review of the pending change -change:
+//      archivebot -archive=gs://bucket/reviews -restore=1234 -change=5678
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/swarm/archive"
+	"sge-monorepo/libs/go/swarm/archive/gcs"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+)
+
+var (
+	location = flag.String("archive", "", "Where reviews are archived: gs://bucket/prefix or a local directory.")
+	months   = flag.Int("months", 6, "Archive closed reviews last updated more than this many months ago.")
+	restore  = flag.Int("restore", 0, "If set, imports this archived review instead of archiving reviews.")
+	change   = flag.Int("change", 0, "Pending change with shelved files the review restored with -restore is created for.")
+
+	// sgeb passes the invocation proto to cron units, archivebot doesn't need it.
+	_ = flag.String("tool-invocation", "", "Path to the sgeb tool invocation. Unused.")
+)
+
+func newStore(location string) (archive.Store, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return archive.NewDirStore(location), nil
+	}
+	bucket := strings.TrimPrefix(location, "gs://")
+	prefix := ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")
+	}
+	store, err := gcs.NewStore(context.Background(), bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not open review archive %s: %w", location, err)
+	}
+	return store, nil
+}
+
+func run(ctx *ebert.Context, store archive.Store) error {
+	if *restore != 0 {
+		return restoreReview(ctx, store)
+	}
+	before := time.Now().AddDate(0, -*months, 0)
+	archived, err := archive.ArchiveClosed(&ctx.Swarm, store, before)
+	log.Infof("archived %d reviews closed before %s", len(archived), before.Format("2006-01-02"))
+	return err
+}
+
+func restoreReview(ctx *ebert.Context, store archive.Store) error {
+	if *change == 0 {
+		return fmt.Errorf("-restore needs the -change to create the review for")
+	}
+	data, err := store.Get(*restore)
+	if err != nil {
+		return fmt.Errorf("could not get archived review %d: %w", *restore, err)
+	}
+	r, err := archive.Decode(data)
+	if err != nil {
+		return err
+	}
+	review, err := archive.Import(&ctx.Swarm, r, *change)
+	if err != nil {
+		return err
+	}
+	log.Infof("restored archived review %d as review %d", r.ID, review.ID)
+	return nil
+}
+
+func main() {
+	flags.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+
+	if *location == "" {
+		log.Errorf("-archive is required")
+		os.Exit(2)
+	}
+	store, err := newStore(*location)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	ctx, err := ebert.NewContext()
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := run(ctx, store); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package artifacts stores the files CI attaches to reviews, eg. the screenshots or logs of a
+// presubmit check. Artifacts are keyed by review, review version, check and name.
+package artifacts
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxSize is the maximum size of an artifact.
+const MaxSize = 32 << 20
+
+// ErrNotFound is returned when an artifact doesn't exist.
+var ErrNotFound = errors.New("artifact not found")
+
+// Artifact describes a stored artifact.
+type Artifact struct {
+	Review  int    `json:"review"`
+	Version int    `json:"version"`
+	Check   string `json:"check"`
+	Name    string `json:"name"`
+	// ContentType is the content type the artifact was uploaded with.
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	// Time is the unix time of the upload.
+	Time int64 `json:"time"`
+}
+
+// Kind returns how the review page renders the artifact: "image", "log" or "file".
+func (a *Artifact) Kind() string {
+	ct, _, _ := mime.ParseMediaType(a.ContentType)
+	switch {
+	case previewableImages[ct]:
+		return "image"
+	case strings.HasPrefix(ct, "text/") || ct == "application/json":
+		return "log"
+	}
+	return "file"
+}
+
+// ServedContentType returns the content type to serve the artifact with. Artifacts are uploaded by
+// CI and served from the Ebert origin, so nothing that can run scripts is served as such: text, eg.
+// HTML, is served as plain text, and anything else but images, eg. SVG, as a download.
+func (a *Artifact) ServedContentType() string {
+	switch a.Kind() {
+	case "image":
+		return a.ContentType
+	case "log":
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// previewableImages are the image types that browsers render and that can't run scripts.
+var previewableImages = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// Store keeps artifacts.
+type Store interface {
+	// Put stores |data| as artifact |a|, replacing any artifact with the same key. The size and
+	// time of |a| are set by the store.
+	Put(a *Artifact, data []byte) error
+	// Get returns an artifact and its content, or ErrNotFound.
+	Get(review, version int, check, name string) (*Artifact, []byte, error)
+	// List returns the artifacts of a review, sorted by version, check and name.
+	List(review int) ([]Artifact, error)
+}
+
+// Validate checks that |a| can be stored and fills its content type from its name or |data| if
+// unset.
+func Validate(a *Artifact, data []byte) error {
+	switch {
+	case a.Review <= 0:
+		return fmt.Errorf("invalid review %d", a.Review)
+	case a.Version <= 0:
+		return fmt.Errorf("invalid version %d", a.Version)
+	case a.Check == "":
+		return errors.New("missing check")
+	case a.Name == "" || a.Name == "." || a.Name == ".." || strings.ContainsAny(a.Name, `/\`):
+		return fmt.Errorf("invalid artifact name %q", a.Name)
+	case len(data) > MaxSize:
+		return fmt.Errorf("artifact %s is %d bytes, larger than %d", a.Name, len(data), MaxSize)
+	}
+	if a.ContentType == "" || a.ContentType == "application/octet-stream" {
+		a.ContentType = mime.TypeByExtension(path.Ext(a.Name))
+		if a.ContentType == "" {
+			a.ContentType = http.DetectContentType(data)
+		}
+	}
+	return nil
+}
+
+// Key returns the path of an artifact relative to the root of a store. Checks are escaped as they
+// are labels like "check_test://foo:tests".
+func Key(review, version int, check, name string) string {
+	return path.Join(strconv.Itoa(review), strconv.Itoa(version), url.QueryEscape(check), name)
+}
+
+// ParseKey returns the artifact of path |k| relative to the root of a store, the inverse of Key.
+func ParseKey(k string) (*Artifact, error) {
+	parts := strings.Split(k, "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid artifact key %q", k)
+	}
+	review, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact key %q: %w", k, err)
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact key %q: %w", k, err)
+	}
+	check, err := url.QueryUnescape(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact key %q: %w", k, err)
+	}
+	return &Artifact{Review: review, Version: version, Check: check, Name: parts[3]}, nil
+}
+
+// Sort sorts artifacts by version, check and name.
+func Sort(arts []Artifact) {
+	sort.Slice(arts, func(i, j int) bool {
+		a, b := arts[i], arts[j]
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		if a.Check != b.Check {
+			return a.Check < b.Check
+		}
+		return a.Name < b.Name
+	})
+}
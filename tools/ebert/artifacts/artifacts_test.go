@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package artifacts
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestDirStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := NewDirStore(root)
+
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A rest of the image")
+	uploads := []struct {
+		a    Artifact
+		data []byte
+	}{
+		{Artifact{Review: 7, Version: 2, Check: "check_test://foo:tests", Name: "shot.png"}, png},
+		{Artifact{Review: 7, Version: 1, Check: "format", Name: "output.txt"}, []byte("all good\n")},
+		{Artifact{Review: 7, Version: 2, Check: "check_test://foo:tests", Name: "page.html"}, []byte("<html><script></script></html>")},
+		{Artifact{Review: 8, Version: 1, Check: "format", Name: "other.log"}, []byte("other review\n")},
+	}
+	for _, u := range uploads {
+		a := u.a
+		if err := store.Put(&a, u.data); err != nil {
+			t.Fatalf("Put(%s): %v", a.Name, err)
+		}
+		if a.Size != int64(len(u.data)) {
+			t.Errorf("Put(%s) size = %d, want %d", a.Name, a.Size, len(u.data))
+		}
+	}
+
+	got, err := store.List(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Artifact{
+		{Review: 7, Version: 1, Check: "format", Name: "output.txt", ContentType: "text/plain; charset=utf-8", Size: 9},
+		{Review: 7, Version: 2, Check: "check_test://foo:tests", Name: "page.html", ContentType: "text/html; charset=utf-8", Size: 30},
+		{Review: 7, Version: 2, Check: "check_test://foo:tests", Name: "shot.png", ContentType: "image/png", Size: int64(len(png))},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Artifact{}, "Time")); diff != "" {
+		t.Errorf("List(7) diff (-want +got):\n%s", diff)
+	}
+	var kinds []string
+	for _, a := range got {
+		kinds = append(kinds, a.Kind()+" "+a.ServedContentType())
+	}
+	wantKinds := []string{
+		"log text/plain; charset=utf-8",
+		"log text/plain; charset=utf-8",
+		"image image/png",
+	}
+	if diff := cmp.Diff(wantKinds, kinds); diff != "" {
+		t.Errorf("kinds diff (-want +got):\n%s", diff)
+	}
+
+	a, data, err := store.Get(7, 2, "check_test://foo:tests", "shot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ContentType != "image/png" || string(data) != string(png) {
+		t.Errorf("Get(shot.png) = %q, %q", a.ContentType, data)
+	}
+	if _, _, err := store.Get(7, 3, "format", "output.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+	}
+	if arts, err := store.List(9); err != nil || len(arts) != 0 {
+		t.Errorf("List(9) = %v, %v, want none", arts, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, a := range []Artifact{
+		{Review: 0, Version: 1, Check: "format", Name: "a.log"},
+		{Review: 1, Version: 0, Check: "format", Name: "a.log"},
+		{Review: 1, Version: 1, Check: "", Name: "a.log"},
+		{Review: 1, Version: 1, Check: "format", Name: "../a.log"},
+		{Review: 1, Version: 1, Check: "format", Name: ".."},
+		{Review: 1, Version: 1, Check: "format", Name: `dir\a.log`},
+	} {
+		if err := Validate(&a, nil); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want error", a)
+		}
+	}
+	a := Artifact{Review: 1, Version: 1, Check: "format", Name: "big.log"}
+	if err := Validate(&a, make([]byte, MaxSize+1)); err == nil {
+		t.Errorf("Validate(too large) succeeded, want error")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package artifacts
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// NewDirStore returns a store that keeps artifacts as files under directory |root|, for
+// development. Content types aren't kept, they are guessed from the names and contents of files.
+func NewDirStore(root string) Store {
+	return &dirStore{root: root}
+}
+
+type dirStore struct {
+	root string
+}
+
+func (ds *dirStore) Put(a *Artifact, data []byte) error {
+	if err := Validate(a, data); err != nil {
+		return err
+	}
+	p := filepath.Join(ds.root, filepath.FromSlash(Key(a.Review, a.Version, a.Check, a.Name)))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		return err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	a.Size = info.Size()
+	a.Time = info.ModTime().Unix()
+	return nil
+}
+
+func (ds *dirStore) Get(review, version int, check, name string) (*Artifact, []byte, error) {
+	a := &Artifact{Review: review, Version: version, Check: check, Name: name}
+	p := filepath.Join(ds.root, filepath.FromSlash(Key(review, version, check, name)))
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if err := ds.stat(a, p); err != nil {
+		return nil, nil, err
+	}
+	return a, data, nil
+}
+
+func (ds *dirStore) List(review int) ([]Artifact, error) {
+	dir := filepath.Join(ds.root, strconv.Itoa(review))
+	var arts []Artifact
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(ds.root, p)
+		if err != nil {
+			return err
+		}
+		a, err := ParseKey(filepath.ToSlash(rel))
+		if err != nil {
+			return nil
+		}
+		if err := ds.stat(a, p); err != nil {
+			return err
+		}
+		arts = append(arts, *a)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	Sort(arts)
+	return arts, nil
+}
+
+// stat fills the content type, size and time of artifact |a| stored at |p|.
+func (ds *dirStore) stat(a *Artifact, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Content sniffing only looks at the first 512 bytes.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if err := Validate(a, head[:n]); err != nil {
+		return err
+	}
+	a.Size = info.Size()
+	a.Time = info.ModTime().Unix()
+	return nil
+}
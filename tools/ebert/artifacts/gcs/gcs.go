@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs implements an artifact store on Google Cloud Storage.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"sge-monorepo/tools/ebert/artifacts"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// NewStore returns a store that keeps artifacts as objects under |prefix| in a GCS bucket.
+func NewStore(ctx context.Context, bucket, prefix string) (artifacts.Store, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCS client: %v", err)
+	}
+	return &gcsStore{
+		ctx:    ctx,
+		bkt:    client.Bucket(bucket),
+		prefix: prefix,
+	}, nil
+}
+
+type gcsStore struct {
+	ctx    context.Context
+	bkt    *storage.BucketHandle
+	prefix string
+}
+
+func (gs *gcsStore) Put(a *artifacts.Artifact, data []byte) error {
+	if err := artifacts.Validate(a, data); err != nil {
+		return err
+	}
+	w := gs.bkt.Object(path.Join(gs.prefix, artifacts.Key(a.Review, a.Version, a.Check, a.Name))).NewWriter(gs.ctx)
+	w.ContentType = a.ContentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	a.Size = w.Attrs().Size
+	a.Time = w.Attrs().Created.Unix()
+	return nil
+}
+
+func (gs *gcsStore) Get(review, version int, check, name string) (*artifacts.Artifact, []byte, error) {
+	r, err := gs.bkt.Object(path.Join(gs.prefix, artifacts.Key(review, version, check, name))).NewReader(gs.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, artifacts.ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &artifacts.Artifact{
+		Review:      review,
+		Version:     version,
+		Check:       check,
+		Name:        name,
+		ContentType: r.Attrs.ContentType,
+		Size:        r.Attrs.Size,
+		Time:        r.Attrs.LastModified.Unix(),
+	}, data, nil
+}
+
+func (gs *gcsStore) List(review int) ([]artifacts.Artifact, error) {
+	dir := path.Join(gs.prefix, strconv.Itoa(review)) + "/"
+	var arts []artifacts.Artifact
+	it := gs.bkt.Objects(gs.ctx, &storage.Query{Prefix: dir})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		a, err := artifacts.ParseKey(strings.TrimPrefix(strings.TrimPrefix(attrs.Name, gs.prefix), "/"))
+		if err != nil {
+			continue
+		}
+		a.ContentType = attrs.ContentType
+		a.Size = attrs.Size
+		a.Time = attrs.Updated.Unix()
+		arts = append(arts, *a)
+	}
+	artifacts.Sort(arts)
+	return arts, nil
+}
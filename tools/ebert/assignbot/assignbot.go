@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary assignbot adds reviewers to new reviews nobody was asked to look at, picking them from the
+// advisory reviewer suggestions computed from the history and OWNERS of the changed files. It's
+// meant to run as a cron unit, with the same flags and credentials as Ebert.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sge-monorepo/build/cicd/presubmit/reviewers"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+	"sge-monorepo/tools/ebert/handlers/draft"
+	"sge-monorepo/tools/ebert/handlers/review"
+)
+
+var (
+	count    = flag.Int("count", 2, "Number of reviewers added to each review.")
+	minScore = flag.Float64("min_score", 1, "Minimum score of the suggestions added as reviewers.")
+	maxAge   = flag.Duration("max_age", 24*time.Hour, "Reviews created longer ago than this are left alone.")
+	dryRun   = flag.Bool("dry_run", false, "Log the assignments instead of making them.")
+	// sgeb passes the invocation proto to cron units, assignbot doesn't need it.
+	_ = flag.String("tool-invocation", "", "Path to the sgeb tool invocation. Unused.")
+)
+
+// assignState is the state kept for each review looked at, so that it's only assigned once.
+type assignState struct {
+	// Time is the unix time the review was looked at.
+	Time int64
+	// Users are the users added as reviewers, none if no suggestion was good enough.
+	Users []string
+}
+
+// needsReviewers returns whether |review| was created after |now| - max_age and has no reviewers.
+func needsReviewers(review *swarm.Review, now time.Time) bool {
+	if now.Sub(time.Unix(int64(review.Created), 0)) > *maxAge {
+		return false
+	}
+	for u := range review.Participants {
+		if u != review.Author {
+			return false
+		}
+	}
+	return true
+}
+
+// pick returns the best |count| suggestions scoring at least min_score.
+func pick(suggestions []review.Suggestion) []review.Suggestion {
+	var ret []review.Suggestion
+	for _, s := range suggestions {
+		if len(ret) == *count {
+			break
+		}
+		if s.Score >= *minScore {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// body returns the comment telling why the |picked| reviewers were added.
+func body(picked []review.Suggestion) string {
+	var lines []string
+	for _, s := range picked {
+		lines = append(lines, fmt.Sprintf("@%s (%s)", s.User, s.Reason))
+	}
+	return fmt.Sprintf("This review had no reviewers, so %s from the history of the changed files: %s. Feel free to change them.",
+		plural(len(picked)), strings.Join(lines, ", "))
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return "a reviewer was suggested"
+	}
+	return "reviewers were suggested"
+}
+
+func run(ctx *ebert.Context, now time.Time) error {
+	reviews, err := swarm.GetReviews(&ctx.Swarm, "state[]=needsReview")
+	if err != nil {
+		return fmt.Errorf("could not get open reviews: %v", err)
+	}
+	// Drafts aren't ready for reviewers yet.
+	drafts, err := draft.All(ctx)
+	if err != nil {
+		return err
+	}
+	store := p4lib.NewKeyStore(ctx.P4, "ebert-assign")
+	failed := 0
+	for i := range reviews.Reviews {
+		r := &reviews.Reviews[i]
+		if drafts[r.ID] != nil || !needsReviewers(r, now) {
+			continue
+		}
+		if err := assignReview(ctx, store, r, now); err != nil {
+			log.Warningf("could not assign reviewers to review %d: %v", r.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d reviews failed", failed, len(reviews.Reviews))
+	}
+	return nil
+}
+
+func assignReview(ctx *ebert.Context, store *p4lib.KeyStore, r *swarm.Review, now time.Time) error {
+	name := strconv.Itoa(r.ID)
+	var state assignState
+	found, err := store.Get(name, &state)
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+	suggestions, err := review.SuggestReviewers(ctx, r, reviewers.Options{Now: now})
+	if err != nil {
+		return err
+	}
+	picked := pick(suggestions)
+	var users []string
+	for _, s := range picked {
+		users = append(users, s.User)
+	}
+	log.Infof("review %d: assigning %v", r.ID, users)
+	if *dryRun {
+		return nil
+	}
+	if len(picked) > 0 {
+		_, err := swarm.UpdateParticipants(&ctx.Swarm, r.ID, r.Updated, func(ps map[string]swarm.Participant) {
+			for _, u := range users {
+				if _, ok := ps[u]; !ok {
+					ps[u] = swarm.Participant{}
+				}
+			}
+		})
+		if errors.Is(err, swarm.ErrReviewUpdated) {
+			// The author is likely adding reviewers, look again on the next run.
+			log.Infof("review %d: updated meanwhile, skipping", r.ID)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		comment := &swarm.Comment{
+			Topic: fmt.Sprintf("reviews/%d", r.ID),
+			Body:  body(picked),
+		}
+		if err := swarm.AddComment(&ctx.Swarm, comment); err != nil {
+			return err
+		}
+	}
+	return store.Set(name, &assignState{Time: now.Unix(), Users: users})
+}
+
+func main() {
+	flags.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+
+	ctx, err := ebert.NewContext()
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := run(ctx, time.Now()); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
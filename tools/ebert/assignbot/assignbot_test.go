@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"sge-monorepo/build/cicd/presubmit/reviewers"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/handlers/review"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNeedsReviewers(t *testing.T) {
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) int {
+		return int(now.Add(-d).Unix())
+	}
+	testCases := []struct {
+		desc         string
+		created      int
+		participants []string
+		want         bool
+	}{
+		{desc: "new without reviewers", created: ago(time.Hour), participants: []string{"alice"}, want: true},
+		{desc: "new without participants", created: ago(time.Hour), want: true},
+		{desc: "new with reviewers", created: ago(time.Hour), participants: []string{"alice", "bob"}},
+		{desc: "old without reviewers", created: ago(48 * time.Hour), participants: []string{"alice"}},
+	}
+	for _, tc := range testCases {
+		r := &swarm.Review{Author: "alice", Created: tc.created, Participants: map[string]swarm.Participant{}}
+		for _, u := range tc.participants {
+			r.Participants[u] = swarm.Participant{}
+		}
+		if got := needsReviewers(r, now); got != tc.want {
+			t.Errorf("%s: needsReviewers() = %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	suggestion := func(user string, score float64, reason string) review.Suggestion {
+		return review.Suggestion{Suggestion: reviewers.Suggestion{User: user, Score: score}, Reason: reason}
+	}
+	suggestions := []review.Suggestion{
+		suggestion("bob", 3, "owns 3 files"),
+		suggestion("carol", 1.5, "authored 2 recent changes"),
+		suggestion("dave", 1.2, "owns 1 file"),
+		suggestion("erin", 0.1, "authored 1 recent change"),
+	}
+	picked := pick(suggestions)
+	var users []string
+	for _, s := range picked {
+		users = append(users, s.User)
+	}
+	if diff := cmp.Diff([]string{"bob", "carol"}, users); diff != "" {
+		t.Errorf("picked users diff (-want +got):\n%s", diff)
+	}
+	want := "This review had no reviewers, so reviewers were suggested from the history of the changed files: @bob (owns 3 files), @carol (authored 2 recent changes). Feel free to change them."
+	if got := body(picked); got != want {
+		t.Errorf("body() = %q, want %q", got, want)
+	}
+	if got := pick(suggestions[3:]); len(got) != 0 {
+		t.Errorf("picked %v below the minimum score", got)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary descsyncbot keeps the descriptions of open reviews in sync with the ones of their pending
+// changes, so that edits made in Swarm or with p4 change reach the description checked at submit.
+// Reviews whose descriptions were both edited are left for their author to merge in Ebert. It's
+// meant to run as a cron unit, with the same flags and credentials as Ebert, whose p4 user must be
+// an admin to update the changes of other users.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+	"sge-monorepo/tools/ebert/handlers/review"
+)
+
+var (
+	// sgeb passes the invocation proto to cron units, descsyncbot doesn't need it.
+	_ = flag.String("tool-invocation", "", "Path to the sgeb tool invocation. Unused.")
+)
+
+func run(ctx *ebert.Context) error {
+	reviews, err := swarm.GetReviews(&ctx.Swarm, "state[]=needsReview&state[]=needsRevision&state[]=approved")
+	if err != nil {
+		return fmt.Errorf("could not get open reviews: %v", err)
+	}
+	failed, conflicts := 0, 0
+	for i := range reviews.Reviews {
+		r := &reviews.Reviews[i]
+		result, err := review.SyncDescription(ctx, r)
+		if err != nil {
+			log.Warningf("could not sync description of review %d: %v", r.ID, err)
+			failed++
+			continue
+		}
+		if result.Conflict != nil {
+			log.Infof("review %d: description and change %d were both edited", r.ID, result.CL)
+			conflicts++
+		}
+	}
+	log.Infof("synced %d reviews, %d with conflicts", len(reviews.Reviews)-failed, conflicts)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d reviews failed", failed, len(reviews.Reviews))
+	}
+	return nil
+}
+
+func main() {
+	flags.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+
+	ctx, err := ebert.NewContext()
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := run(ctx); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
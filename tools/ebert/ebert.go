@@ -37,6 +37,32 @@
 //   `ebert --dev --cert=<path to cert.pem> --key=<path to cert.key>`
 // Mostly useful for testing SSL
 //
+// * storing CI artifacts
+//   `ebert --dev --artifacts=<directory or gs://bucket/prefix>`
+// Artifacts attached to reviews by presubmit runs are served in the review
+// page's CI panel.  Without --artifacts, attaching artifacts fails.
+//
+// * queueing CI requests
+//   `ebert --queue=<project>/<prefix>`
+// Presubmit requests are sent to a Pub/Sub queue that CI runners pull from,
+// rather than to Jenkins, and every submit queues a postsubmit request.
+//
+// * linking external systems
+//   `ebert --links=<depot path of a linkify.Config text proto>`
+// References to external systems in descriptions and comments, eg. issue
+// keys, are returned as links by the review and comments handlers.  Rules
+// are reloaded every few minutes, so submitted changes apply without a
+// restart.
+//
+// * checking submit policies
+//   `ebert --submit_policy=<depot path of a presubmit.SubmitPolicy text proto>`
+// /ebert/policy/:rid evaluates the rules of the policy against a review, eg.
+// minimum approvals or office hours, and the review page lists the rules the
+// change violates.  /trigger/change-submit?change=<cl>, called by a Perforce
+// change-submit trigger, fails submits of changes that violate the policy.
+// The presubmit runner enforces the same policy when its environment sets
+// submit_policy.
+//
 // General structure:
 // Ebert is an HTTP server that generally serves two types of data.
 // * HTML pages (dashboard, reviews, browser)
@@ -58,23 +84,46 @@
 // REST handlers is in rest.go, but the actual handlers are distributed by
 // function, and may reside in the same file as the HTML handler (for example,
 // many REST handlers used by the review page are defined in review.go).
+// Pages that need several REST resources at once can POST them as a list to
+// /ebert/batch, which resolves them concurrently and returns all the results
+// in a single response (see BatchFetch in util.js).
+//
+// The handlers under /ebert/m are a compact API for approving reviews from a
+// phone or a chat bot: the reviews waiting for the user, a summary of a review
+// with the file counts of its latest version, and approve/vote actions. They
+// accept an "Authorization: Bearer <token>" header in place of a browser
+// session; tokens are issued to a session by POSTing to /ebert/m/token.
 
 package main
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
+	"sge-monorepo/build/cicd/cirunner/queue"
+	"sge-monorepo/build/cicd/presubmit/policy"
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/log/cloudlog"
+	"sge-monorepo/tools/ebert/artifacts"
+	"sge-monorepo/tools/ebert/artifacts/gcs"
 	"sge-monorepo/tools/ebert/ebert"
 	"sge-monorepo/tools/ebert/flags"
+	"sge-monorepo/tools/ebert/guidelines"
 	"sge-monorepo/tools/ebert/handlers/browse"
 	"sge-monorepo/tools/ebert/handlers/comments"
 	"sge-monorepo/tools/ebert/handlers/dashboard"
+	"sge-monorepo/tools/ebert/handlers/draft"
 	"sge-monorepo/tools/ebert/handlers/files"
+	"sge-monorepo/tools/ebert/handlers/mobile"
+	"sge-monorepo/tools/ebert/handlers/prefs"
+	"sge-monorepo/tools/ebert/handlers/presence"
 	"sge-monorepo/tools/ebert/handlers/project"
 	"sge-monorepo/tools/ebert/handlers/review"
+	"sge-monorepo/tools/ebert/handlers/tokens"
 	"sge-monorepo/tools/ebert/handlers/trigger"
+	"sge-monorepo/tools/ebert/handlers/unresolved"
+	"sge-monorepo/tools/ebert/linkify"
 	"sge-monorepo/tools/ebert/watcher"
 
 	"contrib.go.opencensus.io/exporter/stackdriver"
@@ -90,6 +139,35 @@ const ebertVersion = "0.0.1"
 const swarmHost = "INSERT_HOST"
 const swarmPort = 9000
 
+// newArtifactStore returns the artifact store at |location|, "gs://bucket/prefix" or a directory.
+func newArtifactStore(location string) (artifacts.Store, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return artifacts.NewDirStore(location), nil
+	}
+	bucket := strings.TrimPrefix(location, "gs://")
+	prefix := ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")
+	}
+	store, err := gcs.NewStore(context.Background(), bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not open artifact store %s: %w", location, err)
+	}
+	return store, nil
+}
+
+func newQueue(location string) (queue.Queue, error) {
+	i := strings.Index(location, "/")
+	if i <= 0 || i == len(location)-1 {
+		return nil, fmt.Errorf("invalid queue %q, want <project>/<prefix>", location)
+	}
+	q, err := queue.NewPubSubQueue(context.Background(), location[:i], location[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("could not open queue %s: %w", location, err)
+	}
+	return q, nil
+}
+
 func main() {
 	flags.Parse()
 
@@ -139,15 +217,40 @@ func main() {
 	dotfns["projects"] = project.HandleProjects
 	dotfns["review/:suffix"] = review.Handle
 	restfns["/file/:path"] = files.Handle
+	restfns["/ebert/admin/queue/projects"] = review.QueueProjects
+	restfns["/ebert/admin/tokens"] = tokens.Admin
 	restfns["/ebert/approve/:rid"] = review.Approve
+	restfns["/ebert/artifacts/:rid"] = review.Artifacts
 	restfns["/ebert/browse/history/:path"] = browse.History
 	restfns["/ebert/comments/:rid"] = comments.Handle
 	restfns["/ebert/comments/:rid/:cid"] = comments.Handle
+	restfns["/ebert/comments/anchors/:rid"] = comments.Anchors
 	restfns["/ebert/comments/read/:cid"] = comments.MarkRead
+	restfns["/ebert/description/:rid"] = review.Description
 	restfns["/ebert/diff"] = review.Diff
+	restfns["/ebert/m/approve/:rid"] = mobile.Approve
+	restfns["/ebert/m/pending"] = mobile.Pending
+	restfns["/ebert/m/review/:rid"] = mobile.Review
+	restfns["/ebert/m/token"] = mobile.Tokens
+	restfns["/ebert/m/vote/:rid"] = mobile.Vote
+	restfns["/ebert/draft/:rid"] = draft.Handle
+	restfns["/ebert/explain/:rid"] = review.Explain
 	restfns["/ebert/pairs"] = review.Pairs
+	restfns["/ebert/policy/:rid"] = review.Policy
+	restfns["/ebert/prefs/timezone"] = prefs.TimeZone
+	restfns["/ebert/presence/:rid"] = presence.Handle
+	restfns["/ebert/presence/events/:rid"] = presence.Events
+	restfns["/ebert/queue"] = review.QueueDepth
 	restfns["/ebert/review/:rid"] = review.HandleRest
+	restfns["/ebert/reviewers/:rid"] = review.Reviewers
+	restfns["/ebert/risk/:rid"] = review.Risk
+	restfns["/ebert/snooze"] = dashboard.Snoozes
+	restfns["/ebert/snooze/:rid"] = dashboard.SnoozeReview
+	restfns["/ebert/swarm/health"] = review.SwarmHealth
 	restfns["/ebert/testruns/:rid"] = review.TestRuns
+	restfns["/ebert/tokens"] = tokens.Tokens
+	restfns["/ebert/tokens/rotate"] = tokens.Rotate
+	restfns["/ebert/unresolved/:rid"] = unresolved.Handle
 	restfns["/ebert/users"] = review.Users
 	restfns["/trigger/:trigger"] = trigger.Handle
 
@@ -156,6 +259,30 @@ func main() {
 		log.Errorf("%v", err)
 		return
 	}
+	if flags.Artifacts != "" {
+		ectx.Artifacts, err = newArtifactStore(flags.Artifacts)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+	}
+	if flags.Queue != "" {
+		ectx.Queue, err = newQueue(flags.Queue)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+		ectx.Jenkins = queue.NewRemote(ectx.Jenkins, ectx.Queue)
+	}
+	if flags.Links != "" {
+		ectx.Links = linkify.NewSource(ectx.P4, flags.Links)
+	}
+	if flags.Policy != "" {
+		ectx.Policy = policy.NewSource(ectx.P4, flags.Policy)
+	}
+	if flags.Guidelines {
+		ectx.Guidelines = guidelines.NewSource(ectx.P4)
+	}
 
 	bgctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -26,11 +26,16 @@ import (
 	"sync"
 	"time"
 
+	"sge-monorepo/build/cicd/cirunner/queue"
 	"sge-monorepo/build/cicd/jenkins"
+	"sge-monorepo/build/cicd/presubmit/policy"
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/p4lib"
 	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/artifacts"
 	"sge-monorepo/tools/ebert/flags"
+	"sge-monorepo/tools/ebert/guidelines"
+	"sge-monorepo/tools/ebert/linkify"
 
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats"
@@ -44,6 +49,51 @@ type Context struct {
 	Swarm     swarm.Context
 	P4        p4lib.P4
 	Jenkins   jenkins.Remote
+	Artifacts artifacts.Store // Files attached to reviews by CI, nil if not configured.
+	Queue     queue.Queue     // CI request queue, nil if requests go to Jenkins.
+	Links     *linkify.Source // Rules linking references to external systems, nil if not configured.
+	Policy    *policy.Source  // Submit policy of reviews, nil if not configured.
+	// Guidelines are the review guidelines of the files of reviews, nil if disabled.
+	Guidelines *guidelines.Source
+	// P4Warnings collects the advisory messages of the p4 commands run for a request, eg.
+	// maintenance windows, nil outside of requests.
+	P4Warnings *P4Warnings
+}
+
+// P4Warnings are the advisory messages printed by the server triggers or broker during the p4
+// commands of a request, for the UI to show them.
+type P4Warnings struct {
+	mu       sync.Mutex
+	warnings []p4lib.Warning
+}
+
+func (pw *P4Warnings) add(w p4lib.Warning) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for _, seen := range pw.warnings {
+		if seen == w {
+			return
+		}
+	}
+	pw.warnings = append(pw.warnings, w)
+}
+
+// List returns the warnings collected so far, without duplicates.
+func (pw *P4Warnings) List() []p4lib.Warning {
+	if pw == nil {
+		return nil
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return append([]p4lib.Warning(nil), pw.warnings...)
+}
+
+// watchP4 returns |p4| reporting its warnings to the context, if it collects them.
+func (ctx *Context) watchP4(p4 p4lib.P4) p4lib.P4 {
+	if ctx.P4Warnings == nil {
+		return p4
+	}
+	return p4lib.WithWarningHandler(p4, ctx.P4Warnings.add)
 }
 
 // UserContext returns a login Context for the user making the request.
@@ -68,7 +118,7 @@ func (ctx *Context) Login(user string) (*Context, error) {
 		return nil, err
 	}
 	userCtx.Swarm.Password = ticket
-	userCtx.P4 = p4lib.NewForUser(user, ticket)
+	userCtx.P4 = ctx.watchP4(p4lib.NewForUser(user, ticket))
 
 	return &userCtx, nil
 }
@@ -109,12 +159,32 @@ func (ctx *Context) Trace(r *http.Request) *Context {
 	// Create a Swarm context based on the Ebert context and request context.
 	sctx := ctx.Swarm
 	sctx.Ctx = rctx
-	return &Context{
-		Ctx:       rctx,
-		P4:        p4lib.WithTracer(ctx.P4, tracer),
-		Swarm:     sctx,
-		Jenkins:   ctx.Jenkins,
+	tctx := &Context{
+		Ctx:        rctx,
+		Swarm:      sctx,
+		Jenkins:    ctx.Jenkins,
+		Artifacts:  ctx.Artifacts,
+		Queue:      ctx.Queue,
+		Links:      ctx.Links,
+		Policy:     ctx.Policy,
+		Guidelines: ctx.Guidelines,
+		P4Warnings: &P4Warnings{},
 	}
+	p4 := p4lib.WithTracer(ctx.P4, tracer)
+	if flags.P4Track {
+		// Annotate the request with the server side of its p4 commands, to tell slow commands from
+		// a slow or contended server.
+		p4 = p4lib.WithServerPerf(p4, func(perf p4lib.ServerPerf) {
+			span.Annotate([]trace.Attribute{
+				trace.StringAttribute("command", perf.Command),
+				trace.Int64Attribute("lapse_ms", perf.Lapse.Milliseconds()),
+				trace.Int64Attribute("lock_wait_ms", perf.LockWait().Milliseconds()),
+				trace.Int64Attribute("lock_held_ms", perf.LockHeld().Milliseconds()),
+			}, "p4 server perf")
+		})
+	}
+	tctx.P4 = tctx.watchP4(p4)
+	return tctx
 }
 
 var ticketsMutex sync.Mutex
@@ -198,8 +268,10 @@ func NewContext() (*Context, error) {
 			Password: passwd,
 			Ctx:      context.Background(),
 			Client: &http.Client{
-				Transport: &ochttp.Transport{},
+				Transport: tracedSwarmTransport(nil),
 			},
+			// Shared by the contexts of all users, see Login.
+			Breaker: swarm.NewBreaker(),
 		},
 		P4:        p4,
 		Jenkins:   remote,
@@ -207,19 +279,45 @@ func NewContext() (*Context, error) {
 	if flags.ApiAddr != "" {
 		ctx.Swarm.Host = flags.ApiHost
 		ctx.Swarm.Client = &http.Client{
-			Transport: &ochttp.Transport{
-				Base: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						ServerName: flags.ApiHost,
-					},
-				},
-			},
+			Transport: tracedSwarmTransport(&tls.Config{
+				ServerName: flags.ApiHost,
+			}),
 		}
 	}
 	return ctx, nil
 }
 
+// tracedSwarmTransport returns a transport reusing connections to Swarm and tracing requests.
+func tracedSwarmTransport(tlsConfig *tls.Config) *swarm.Transport {
+	t := swarm.NewTransport(tlsConfig)
+	t.Base = &ochttp.Transport{Base: t.Base}
+	return t
+}
+
+// Blob is a handler result served as is, with its content type, eg. an artifact uploaded by CI.
+type Blob struct {
+	ContentType string
+	Data        []byte
+	// Download serves the blob as an attachment named |Name| rather than inline.
+	Download bool
+	Name     string
+}
+
+// requestUserKey is the request context key of the user authenticated by other means than the
+// browser session.
+type requestUserKey struct{}
+
+// WithUser returns |r| authenticated as |user|, eg. by an API token, for UserFromRequest to return.
+func WithUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestUserKey{}, user))
+}
+
 func UserFromRequest(r *http.Request) (string, error) {
+	if r != nil {
+		if user, ok := r.Context().Value(requestUserKey{}).(string); ok {
+			return user, nil
+		}
+	}
 	// Fallback to the user the process is running as.  This is really only
 	// useful during development.
 	current, err := user.Current()
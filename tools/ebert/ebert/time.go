@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebert
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+
+	// Embed the time zone database, the servers may not have one.
+	_ "time/tzdata"
+)
+
+const userTimeZoneKeyFmt = "ebert-user-timezone-%v"
+
+// Timestamp is a point in time as sent in API payloads. All the representations are computed
+// server-side so that every page shows times the same way.
+type Timestamp struct {
+	// Unix is the number of seconds since the epoch.
+	Unix int64 `json:"unix"`
+	// ISO is the time in ISO8601 format, in the time zone of the user.
+	ISO string `json:"iso"`
+	// Relative is the time relative to when the payload was built, eg. "3h ago".
+	Relative string `json:"relative"`
+}
+
+// NewTimestamp returns the timestamp of |unix| in location |loc|, relative to |now|. Unset times
+// (0) result in an empty timestamp.
+func NewTimestamp(unix int64, loc *time.Location, now time.Time) Timestamp {
+	if unix == 0 {
+		return Timestamp{}
+	}
+	t := time.Unix(unix, 0).In(loc)
+	return Timestamp{
+		Unix:     unix,
+		ISO:      FormatISO(t),
+		Relative: RelativeTime(t, now),
+	}
+}
+
+// FormatISO formats |t| as ISO8601.
+func FormatISO(t time.Time) string {
+	return t.Format(time.RFC3339)
+}
+
+// RelativeTime returns a short description of |t| relative to |now|, eg. "5m ago" or "in 2d".
+// Times more than 4 weeks away are returned as dates in the location of |t|.
+func RelativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	var s string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		s = fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		s = fmt.Sprintf("%dh", int(d/time.Hour))
+	case d < 7*24*time.Hour:
+		s = fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	case d < 28*24*time.Hour:
+		s = fmt.Sprintf("%dw", int(d/(7*24*time.Hour)))
+	default:
+		if t.Year() == now.In(t.Location()).Year() {
+			return t.Format("Jan 2")
+		}
+		return t.Format("Jan 2, 2006")
+	}
+	if future {
+		return "in " + s
+	}
+	return s + " ago"
+}
+
+// UserTimeZone returns the name of the time zone preferred by |user|, or "" if the user has no
+// preference.
+func (ctx *Context) UserTimeZone(user string) (string, error) {
+	tz, err := ctx.P4.KeyGet(fmt.Sprintf(userTimeZoneKeyFmt, user))
+	if errors.Is(err, p4lib.ErrKeyNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	// Unset keys read as "0".
+	if tz = strings.TrimSpace(tz); tz == "0" {
+		return "", nil
+	}
+	return tz, nil
+}
+
+// SetUserTimeZone stores |tz| as the time zone preferred by |user|. |tz| must be an IANA time zone
+// name, eg. "Europe/Stockholm".
+func (ctx *Context) SetUserTimeZone(user, tz string) error {
+	if tz == "" {
+		return fmt.Errorf("empty time zone")
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return fmt.Errorf("invalid time zone %q: %w", tz, err)
+	}
+	return ctx.P4.KeySet(fmt.Sprintf(userTimeZoneKeyFmt, user), tz)
+}
+
+// UserLocation returns the location used to format times for |user|. Falls back to UTC if the user
+// has no valid preference.
+func (ctx *Context) UserLocation(user string) *time.Location {
+	tz, err := ctx.UserTimeZone(user)
+	if err != nil || tz == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebert
+
+import (
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+)
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{now.Add(-30 * time.Second), "just now"},
+		{now.Add(30 * time.Second), "just now"},
+		{now.Add(-5 * time.Minute), "5m ago"},
+		{now.Add(-3*time.Hour - 59*time.Minute), "3h ago"},
+		{now.Add(2 * time.Hour), "in 2h"},
+		{now.Add(-2 * 24 * time.Hour), "2d ago"},
+		{now.Add(-15 * 24 * time.Hour), "2w ago"},
+		{time.Date(2021, 3, 4, 8, 0, 0, 0, time.UTC), "Mar 4"},
+		{time.Date(2020, 12, 24, 8, 0, 0, 0, time.UTC), "Dec 24, 2020"},
+	}
+	for _, test := range tests {
+		if got := RelativeTime(test.t, now); got != test.want {
+			t.Errorf("RelativeTime(%v) = %q, want %q", test.t, got, test.want)
+		}
+	}
+}
+
+func TestNewTimestamp(t *testing.T) {
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	loc, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewTimestamp(now.Add(-time.Hour).Unix(), loc, now)
+	want := Timestamp{
+		Unix:     now.Add(-time.Hour).Unix(),
+		ISO:      "2021-06-15T13:00:00+02:00",
+		Relative: "1h ago",
+	}
+	if got != want {
+		t.Errorf("NewTimestamp() = %+v, want %+v", got, want)
+	}
+	if got := NewTimestamp(0, loc, now); got != (Timestamp{}) {
+		t.Errorf("NewTimestamp(0) = %+v, want empty", got)
+	}
+}
+
+func TestUserTimeZone(t *testing.T) {
+	keys := map[string]string{}
+	ctx := &Context{P4: p4mock.Mock{
+		KeyGetFunc: func(key string) (string, error) {
+			if v, ok := keys[key]; ok {
+				return v, nil
+			}
+			return "0", p4lib.ErrKeyNotFound
+		},
+		KeySetFunc: func(key, val string) error {
+			keys[key] = val
+			return nil
+		},
+	}}
+	if loc := ctx.UserLocation("alice"); loc != time.UTC {
+		t.Errorf("UserLocation() without preference = %v, want UTC", loc)
+	}
+	if err := ctx.SetUserTimeZone("alice", "Not/AZone"); err == nil {
+		t.Errorf("SetUserTimeZone(Not/AZone) succeeded, want error")
+	}
+	if err := ctx.SetUserTimeZone("alice", "America/Los_Angeles"); err != nil {
+		t.Fatalf("SetUserTimeZone() failed: %v", err)
+	}
+	if loc := ctx.UserLocation("alice"); loc.String() != "America/Los_Angeles" {
+		t.Errorf("UserLocation() = %v, want America/Los_Angeles", loc)
+	}
+	if loc := ctx.UserLocation("bob"); loc != time.UTC {
+		t.Errorf("UserLocation(bob) = %v, want UTC", loc)
+	}
+}
@@ -33,6 +33,13 @@ var (
 	CloudLogID string
 	DevMode    bool
 	Jenkins    string
+	Artifacts  string
+	Queue      string
+	Links      string
+	Policy     string
+	Admins     string
+	P4Track    bool
+	Guidelines bool
 )
 
 // Parse parses the flags contained in this package, including default values derived from the environment.
@@ -48,6 +55,13 @@ func Parse() {
 	flag.StringVar(&CloudLogID, "cloud_log_id", "", "If set, uses Cloud Logging with the given ID")
 	flag.BoolVar(&DevMode, "dev", false, "If enabled, relax authentication.")
 	flag.StringVar(&Jenkins, "jenkins", "", "Jenkins Host")
+	flag.StringVar(&Queue, "queue", "", "Pub/Sub queue CI runners pull presubmit and postsubmit requests from, as <project>/<prefix>. If empty, presubmits are sent to Jenkins.")
+	flag.StringVar(&Links, "links", "", "Depot path of the text proto of rules linking references to external systems in descriptions and comments, eg. //depot/ebert/links.textpb.")
+	flag.StringVar(&Policy, "submit_policy", "", "Depot path of the text proto of the submit policy of reviews, eg. //depot/ebert/policy.textpb. If empty, reviews have no policy.")
+	flag.BoolVar(&Guidelines, "review_guidelines", true, "If enabled, reviews show the REVIEW_GUIDELINES.md files closest to the files they change.")
+	flag.StringVar(&Admins, "admins", "", "Comma-separated users allowed to issue API tokens to service accounts and to revoke any token.")
+	flag.BoolVar(&P4Track, "p4_track", false, "If enabled, runs p4 commands with -Ztrack and annotates the request traces with the server lapse and lock times.")
+	flag.StringVar(&Artifacts, "artifacts", "", "Where CI artifacts attached to reviews are stored: gs://bucket/prefix or a local directory. If empty, artifacts are disabled.")
 
 	if v, ok := os.LookupEnv("P4USER"); ok {
 		P4User = v
@@ -61,6 +75,9 @@ func Parse() {
 	if v, ok := os.LookupEnv("EBERT_KEY"); ok {
 		Key = v
 	}
+	if v, ok := os.LookupEnv("EBERT_ARTIFACTS"); ok {
+		Artifacts = v
+	}
 	if v, ok := os.LookupEnv("SWARM_HOST"); ok {
 		ApiHost = v
 	}
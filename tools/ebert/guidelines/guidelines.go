@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package guidelines finds the review guidelines that apply to the files of a review. Teams keep
+// the conventions reviewers should check in REVIEW_GUIDELINES.md files next to their code, and the
+// guideline of a file is the closest one in its directory or above, as for OWNERS files.
+package guidelines
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// FileName is the name of guideline files.
+const FileName = "REVIEW_GUIDELINES.md"
+
+// refreshInterval is how long a Source keeps the guideline files it read.
+const refreshInterval = 5 * time.Minute
+
+// Guideline is a guideline file and the files of a review it applies to.
+type Guideline struct {
+	// Path is the depot path of the guideline file.
+	Path string `json:"path"`
+	// Files are the depot paths of the files the guideline is the closest one of, sorted.
+	Files []string `json:"files"`
+	// HTML is the guideline rendered from Markdown, see Render.
+	HTML string `json:"html"`
+}
+
+// Source reads guideline files from the depot. Files, and the lack of them, are cached for a few
+// minutes, as reviews are loaded far more often than guidelines change.
+type Source struct {
+	p4  p4lib.P4
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cached
+	// fetching holds the reads in progress by path, so that concurrent requests missing the
+	// same guidelines wait for a single print instead of printing them again.
+	fetching map[string]*fetch
+}
+
+type cached struct {
+	// html is the rendered guideline, empty if there is no guideline file.
+	html   string
+	loaded time.Time
+}
+
+// fetch is a read of guideline files in progress. done is closed once they are cached, or err set.
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewSource returns a source reading guideline files with |p4|.
+func NewSource(p4 p4lib.P4) *Source {
+	return &Source{p4: p4, now: time.Now, cache: map[string]cached{}, fetching: map[string]*fetch{}}
+}
+
+// Find returns the guidelines of the depot files |files|, sorted by path. A nil Source finds none.
+func (s *Source) Find(files []string) ([]Guideline, error) {
+	if s == nil {
+		return nil, nil
+	}
+	candidates := map[string]bool{}
+	for _, f := range files {
+		for _, g := range guidelineFiles(f) {
+			candidates[g] = true
+		}
+	}
+	html, err := s.load(candidates)
+	if err != nil {
+		return nil, err
+	}
+	byPath := map[string]*Guideline{}
+	for _, f := range files {
+		for _, g := range guidelineFiles(f) {
+			if html[g] == "" {
+				continue
+			}
+			if byPath[g] == nil {
+				byPath[g] = &Guideline{Path: g, HTML: html[g]}
+			}
+			byPath[g].Files = append(byPath[g].Files, f)
+			break
+		}
+	}
+	var ret []Guideline
+	for _, g := range byPath {
+		sort.Strings(g.Files)
+		ret = append(ret, *g)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret, nil
+}
+
+// load returns the rendered guidelines of the |paths| that exist, reading the ones that aren't
+// cached. Files are printed without holding the lock, so that a slow depot doesn't stall the reviews
+// whose guidelines are cached, and files already being read by another request are waited for.
+func (s *Source) load(paths map[string]bool) (map[string]string, error) {
+	ret := map[string]string{}
+	var missing []string
+	waits := map[string]*fetch{}
+	f := &fetch{done: make(chan struct{})}
+	s.mu.Lock()
+	now := s.now()
+	for p := range paths {
+		if c, ok := s.cache[p]; ok && now.Sub(c.loaded) < refreshInterval {
+			ret[p] = c.html
+		} else if other, ok := s.fetching[p]; ok {
+			waits[p] = other
+		} else {
+			missing = append(missing, p)
+			s.fetching[p] = f
+		}
+	}
+	s.mu.Unlock()
+	if len(missing) > 0 {
+		f.err = s.print(missing, now)
+		close(f.done)
+		if f.err != nil {
+			return nil, f.err
+		}
+		for _, p := range missing {
+			waits[p] = f
+		}
+	}
+	for _, w := range waits {
+		<-w.done
+		if w.err != nil {
+			return nil, w.err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range waits {
+		ret[p] = s.cache[p].html
+	}
+	return ret, nil
+}
+
+// print reads and caches the guideline files |paths|, missing ones included, and marks them as no
+// longer being fetched.
+func (s *Source) print(paths []string, now time.Time) error {
+	sort.Strings(paths)
+	details, err := s.p4.PrintEx(paths...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range paths {
+		delete(s.fetching, p)
+	}
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	for _, p := range paths {
+		s.cache[p] = cached{loaded: now}
+	}
+	for _, d := range details {
+		// Deleted files are printed empty, and guide nothing.
+		s.cache[d.DepotFile] = cached{html: Render(string(d.Content)), loaded: now}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, p4lib.ErrFileNotFound) || strings.Contains(err.Error(), "no such file(s)")
+}
+
+// guidelineFiles returns the guideline files that may apply to depot file |f|, closest first, eg.
+// "//depot/a/REVIEW_GUIDELINES.md" then "//depot/REVIEW_GUIDELINES.md" for "//depot/a/b.go".
+func guidelineFiles(f string) []string {
+	var ret []string
+	dir := path.Dir(strings.TrimPrefix(f, "//"))
+	for dir != "." && dir != "/" {
+		ret = append(ret, "//"+dir+"/"+FileName)
+		dir = path.Dir(dir)
+	}
+	return ret
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guidelines
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRender(t *testing.T) {
+	md := `# Rendering
+
+Check the **frame budget** of
+new passes, see [the doc](https://docs.example.com/render) or [this](javascript:alert(1)).
+
+- [ ] Shaders compile on all platforms
+- [x] No new ` + "`" + `<global>` + "`" + ` state
+* keep snake_case names, _really_
+
+1. Profile
+2. Ship
+
+` + "```" + `
+make <target>
+` + "```" + `
+Done — ünïcode & <b>tags</b>.`
+	want := `<h3>Rendering</h3>
+<p>Check the <strong>frame budget</strong> of new passes, see <a href="https://docs.example.com/render" target="_blank" rel="noopener">the doc</a> or [this](javascript:alert(1)).</p>
+<ul>
+<li><input type="checkbox" disabled> Shaders compile on all platforms</li>
+<li><input type="checkbox" disabled checked> No new <code>&lt;global&gt;</code> state</li>
+<li>keep snake_case names, <em>really</em></li>
+</ul>
+<ol>
+<li>Profile</li>
+<li>Ship</li>
+</ol>
+<pre><code>make &lt;target&gt;</code></pre>
+<p>Done — ünïcode &amp; &lt;b&gt;tags&lt;/b&gt;.</p>
+`
+	if diff := cmp.Diff(want, Render(md)); diff != "" {
+		t.Errorf("Render() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFind(t *testing.T) {
+	depot := map[string]string{
+		"//depot/REVIEW_GUIDELINES.md":        "Be nice.",
+		"//depot/render/REVIEW_GUIDELINES.md": "- [ ] Profile",
+		// Deleted guidelines are printed empty.
+		"//depot/audio/REVIEW_GUIDELINES.md": "",
+	}
+	var printed [][]string
+	down := false
+	p4 := p4mock.New()
+	p4.PrintExFunc = func(files ...string) ([]p4lib.FileDetails, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		printed = append(printed, files)
+		var ret []p4lib.FileDetails
+		var err error
+		for _, f := range files {
+			if content, ok := depot[f]; ok {
+				ret = append(ret, p4lib.FileDetails{DepotFile: f, Content: []byte(content)})
+			} else {
+				err = fmt.Errorf("%s - no such file(s)", f)
+			}
+		}
+		return ret, err
+	}
+	s := NewSource(p4)
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	files := []string{
+		"//depot/render/pass.cc",
+		"//depot/render/shaders/blur.hlsl",
+		"//depot/audio/mixer.cc",
+		"//depot/README.md",
+		"//other/file.txt",
+	}
+	got, err := s.Find(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Guideline{
+		{
+			Path: "//depot/REVIEW_GUIDELINES.md",
+			// The audio guideline was deleted, the parent one applies.
+			Files: []string{"//depot/README.md", "//depot/audio/mixer.cc"},
+			HTML:  "<p>Be nice.</p>\n",
+		},
+		{
+			Path:  "//depot/render/REVIEW_GUIDELINES.md",
+			Files: []string{"//depot/render/pass.cc", "//depot/render/shaders/blur.hlsl"},
+			HTML:  "<ul>\n<li><input type=\"checkbox\" disabled> Profile</li>\n</ul>\n",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Find() diff (-want +got):\n%s", diff)
+	}
+	if len(printed) != 1 || len(printed[0]) != 5 {
+		t.Errorf("printed %v, want the 5 candidate guideline files at once", printed)
+	}
+
+	// Guidelines are cached, missing ones too.
+	if _, err := s.Find(files); err != nil {
+		t.Fatal(err)
+	}
+	if len(printed) != 1 {
+		t.Errorf("printed %v, want the guidelines to be cached", printed)
+	}
+	now = now.Add(refreshInterval)
+	depot["//depot/audio/REVIEW_GUIDELINES.md"] = "Mind the latency."
+	got, err = s.Find([]string{"//depot/audio/mixer.cc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Path != "//depot/audio/REVIEW_GUIDELINES.md" {
+		t.Errorf("Find() after refresh = %v, want the audio guideline", got)
+	}
+
+	down = true
+	now = now.Add(refreshInterval)
+	if _, err := s.Find(files); err == nil {
+		t.Errorf("Find() with p4 down succeeded, want error")
+	}
+
+	var nilSource *Source
+	if got, err := nilSource.Find(files); got != nil || err != nil {
+		t.Errorf("Find() of nil Source = %v, %v; want nothing", got, err)
+	}
+}
+
+func TestFindConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	prints := 0
+	p4 := p4mock.New()
+	p4.PrintExFunc = func(files ...string) ([]p4lib.FileDetails, error) {
+		prints++
+		started <- struct{}{}
+		if files[0] == "//slow/REVIEW_GUIDELINES.md" {
+			<-release
+		}
+		var ret []p4lib.FileDetails
+		for _, f := range files {
+			ret = append(ret, p4lib.FileDetails{DepotFile: f, Content: []byte("Be nice.")})
+		}
+		return ret, nil
+	}
+	s := NewSource(p4)
+	if _, err := s.Find([]string{"//fast/a.go"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// Two requests for the slow guideline: only one prints it, the other waits for it.
+	errs := make(chan error, 2)
+	find := func() {
+		got, err := s.Find([]string{"//slow/a.go"})
+		if err == nil && len(got) != 1 {
+			err = fmt.Errorf("Find() = %v, want the slow guideline", got)
+		}
+		errs <- err
+	}
+	go find()
+	<-started
+	go find()
+
+	// Cached guidelines are served while the slow one is printed.
+	got, err := s.Find([]string{"//fast/a.go"})
+	if err != nil || len(got) != 1 {
+		t.Errorf("Find() of a cached guideline during a print = %v, %v; want it", got, err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if prints != 2 {
+		t.Errorf("printed %d times, want once per guideline", prints)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guidelines
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	headingRE = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	bulletRE  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	orderedRE = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	taskRE    = regexp.MustCompile(`^\[([ xX])\]\s+(.*)$`)
+	linkRE    = regexp.MustCompile(`^\[([^\]]+)\]\(([^)\s]+)\)`)
+	safeURLRE = regexp.MustCompile(`^(?:https?://|mailto:|/|#)`)
+)
+
+// Render renders the Markdown of a guideline file as HTML. Only the subset guidelines need is
+// supported: headings, paragraphs, bullet, numbered and task lists, fenced code blocks, and inline
+// code, emphasis and links. Everything else is escaped, so the result can be inserted as is.
+// Headings are demoted by two levels to fit in the review page.
+func Render(md string) string {
+	var sb strings.Builder
+	var para []string
+	list := "" // "ul" or "ol" while in a list.
+	flushPara := func() {
+		if len(para) > 0 {
+			fmt.Fprintf(&sb, "<p>%s</p>\n", inline(strings.Join(para, " ")))
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			fmt.Fprintf(&sb, "</%s>\n", list)
+			list = ""
+		}
+	}
+	openList := func(kind string) {
+		flushPara()
+		if list != kind {
+			closeList()
+			fmt.Fprintf(&sb, "<%s>\n", kind)
+			list = kind
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushPara()
+			closeList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			fmt.Fprintf(&sb, "<pre><code>%s</code></pre>\n", html.EscapeString(strings.Join(code, "\n")))
+		case trimmed == "":
+			flushPara()
+			closeList()
+		case headingRE.MatchString(trimmed):
+			flushPara()
+			closeList()
+			m := headingRE.FindStringSubmatch(trimmed)
+			level := len(m[1]) + 2
+			if level > 6 {
+				level = 6
+			}
+			fmt.Fprintf(&sb, "<h%d>%s</h%d>\n", level, inline(m[2]), level)
+		case bulletRE.MatchString(line):
+			openList("ul")
+			item := bulletRE.FindStringSubmatch(line)[1]
+			if m := taskRE.FindStringSubmatch(item); m != nil {
+				checked := ""
+				if m[1] != " " {
+					checked = " checked"
+				}
+				fmt.Fprintf(&sb, "<li><input type=\"checkbox\" disabled%s> %s</li>\n", checked, inline(m[2]))
+			} else {
+				fmt.Fprintf(&sb, "<li>%s</li>\n", inline(item))
+			}
+		case orderedRE.MatchString(line):
+			openList("ol")
+			fmt.Fprintf(&sb, "<li>%s</li>\n", inline(orderedRE.FindStringSubmatch(line)[1]))
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flushPara()
+	closeList()
+	return sb.String()
+}
+
+// inline renders the inline Markdown of a line of text.
+func inline(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		rest := s[i:]
+		switch {
+		case c == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end >= 0 {
+				fmt.Fprintf(&sb, "<code>%s</code>", html.EscapeString(rest[1:1+end]))
+				i += end + 2
+				continue
+			}
+		case strings.HasPrefix(rest, "**"):
+			if end := strings.Index(rest[2:], "**"); end > 0 {
+				fmt.Fprintf(&sb, "<strong>%s</strong>", inline(rest[2:2+end]))
+				i += end + 4
+				continue
+			}
+		case (c == '*' || c == '_') && (i == 0 || !isWordByte(s[i-1])):
+			// Underscores within words, eg. snake_case, aren't emphasis.
+			if end := strings.IndexByte(rest[1:], c); end > 0 {
+				fmt.Fprintf(&sb, "<em>%s</em>", inline(rest[1:1+end]))
+				i += end + 2
+				continue
+			}
+		case c == '[':
+			if m := linkRE.FindStringSubmatch(rest); m != nil && safeURLRE.MatchString(m[2]) {
+				fmt.Fprintf(&sb, "<a href=\"%s\" target=\"_blank\" rel=\"noopener\">%s</a>", html.EscapeString(m[2]), inline(m[1]))
+				i += len(m[0])
+				continue
+			}
+		}
+		// Other bytes are copied as is, as they may be part of multi-byte characters.
+		if strings.IndexByte(`&<>"'`, c) >= 0 {
+			sb.WriteString(html.EscapeString(string(c)))
+		} else {
+			sb.WriteByte(c)
+		}
+		i++
+	}
+	return sb.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
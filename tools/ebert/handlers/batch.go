@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// MaxBatchSize is the maximum number of requests accepted in a single batch.
+const MaxBatchSize = 32
+
+// BatchRequest is a single resource request within a batch.
+type BatchRequest struct {
+	// ID identifies the request within the batch. Echoed back in the response.
+	ID string `json:"id"`
+	// Method is the http method of the request. Defaults to GET.
+	Method string `json:"method"`
+	// Path is the path and query of the resource, eg. "/ebert/review/1234".
+	Path string `json:"path"`
+	// Body is sent as the request body, as is.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// BatchResponse is the result of a single BatchRequest.
+type BatchResponse struct {
+	ID     string      `json:"id"`
+	Status int         `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Batch returns a handler that takes a POST with a json list of BatchRequest, resolves them
+// concurrently against |mux| and returns the list of BatchResponse in the same order.
+// This lets pages get all the resources they need in a single round trip.
+func Batch(mux *Mux) Handler {
+	return handlerFunc(func(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+		if r.Method != http.MethodPost {
+			return nil, ebert.NewError(
+				fmt.Errorf("batch: unexpected method %s", r.Method),
+				"Batch requires POST",
+				http.StatusMethodNotAllowed,
+			)
+		}
+		var reqs []BatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			return nil, ebert.NewError(
+				fmt.Errorf("batch:decode: %w", err),
+				fmt.Sprintf("Invalid batch: %v", err),
+				http.StatusBadRequest,
+			)
+		}
+		if len(reqs) > MaxBatchSize {
+			return nil, ebert.NewError(
+				fmt.Errorf("batch: %d requests", len(reqs)),
+				fmt.Sprintf("Batch exceeds the maximum of %d requests", MaxBatchSize),
+				http.StatusBadRequest,
+			)
+		}
+		responses := make([]BatchResponse, len(reqs))
+		var wg sync.WaitGroup
+		for i, req := range reqs {
+			wg.Add(1)
+			go func(i int, req BatchRequest) {
+				defer wg.Done()
+				responses[i] = serveBatched(ctx, r, mux, req)
+			}(i, req)
+		}
+		wg.Wait()
+		return responses, nil
+	})
+}
+
+// serveBatched resolves a single request of a batch. |parent| is the batch request, from which
+// headers (and thus the user's credentials) are inherited.
+func serveBatched(ctx *ebert.Context, parent *http.Request, mux *Mux, req BatchRequest) BatchResponse {
+	resp := BatchResponse{ID: req.ID, Status: http.StatusOK}
+	fail := func(code int, err error) BatchResponse {
+		resp.Status = code
+		resp.Error = err.Error()
+		return resp
+	}
+	if !strings.HasPrefix(req.Path, "/") {
+		return fail(http.StatusBadRequest, fmt.Errorf("path %q must be absolute", req.Path))
+	}
+	if strings.SplitN(req.Path, "?", 2)[0] == parent.URL.Path {
+		return fail(http.StatusBadRequest, fmt.Errorf("batches cannot be nested"))
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	sub, err := http.NewRequestWithContext(parent.Context(), method, req.Path, body)
+	if err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	sub.Header = parent.Header.Clone()
+	sub.Host = parent.Host
+	sub.RemoteAddr = parent.RemoteAddr
+	if body == nil {
+		sub.Header.Del("Content-Type")
+	} else {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+	sub.Header.Del("Content-Length")
+	out, err := mux.Serve(ctx, sub)
+	if err != nil {
+		var e *ebert.Error
+		switch {
+		case errors.As(err, &e):
+			return fail(e.Code, err)
+		case errors.Is(err, ErrRouteNotFound):
+			return fail(http.StatusNotFound, err)
+		default:
+			return fail(http.StatusInternalServerError, err)
+		}
+	}
+	switch data := out.(type) {
+	case func(io.Writer) error:
+		return fail(http.StatusBadRequest, fmt.Errorf("%s is not a REST resource", req.Path))
+	case []byte:
+		// Raw bytes are already encoded by the handler, pass them as a string.
+		resp.Data = string(data)
+	default:
+		resp.Data = data
+	}
+	return resp
+}
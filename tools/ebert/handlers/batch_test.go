@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+func TestBatch(t *testing.T) {
+	mux := &Mux{}
+	handlers := map[string]interface{}{
+		"/ebert/review/:rid": func(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+			return args.rid, nil
+		},
+		"/ebert/echo": func(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+			body, err := ioutil.ReadAll(r.Body)
+			return r.Method + " " + string(body), err
+		},
+		"/ebert/raw": func(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+			return []byte("raw"), nil
+		},
+		"/ebert/fail": func(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+			return nil, ebert.NewError(errors.New("fail"), "Forbidden", http.StatusForbidden)
+		},
+	}
+	for pattern, handler := range handlers {
+		if err := mux.Handle(pattern, handler); err != nil {
+			t.Fatalf("adding handler %s failed: %v", pattern, err)
+		}
+	}
+	if err := mux.Handle("/ebert/batch", Batch(mux)); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `[
+		{"id": "review", "path": "/ebert/review/123"},
+		{"id": "echo", "method": "POST", "path": "/ebert/echo", "body": {"a": 1}},
+		{"id": "raw", "path": "/ebert/raw"},
+		{"id": "fail", "path": "/ebert/fail"},
+		{"id": "missing", "path": "/ebert/missing"},
+		{"id": "nested", "method": "POST", "path": "/ebert/batch"}
+	]`
+	r, err := http.NewRequest("POST", "http://test.com/ebert/batch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := mux.Serve(nil, r)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	responses := got.([]BatchResponse)
+	// Errors from the handlers are not compared, only their status.
+	for i := range responses {
+		if responses[i].Status != http.StatusOK {
+			responses[i].Error = ""
+		}
+	}
+	want := []BatchResponse{
+		{ID: "review", Status: http.StatusOK, Data: 123},
+		{ID: "echo", Status: http.StatusOK, Data: `POST {"a": 1}`},
+		{ID: "raw", Status: http.StatusOK, Data: "raw"},
+		{ID: "fail", Status: http.StatusForbidden},
+		{ID: "missing", Status: http.StatusNotFound},
+		{ID: "nested", Status: http.StatusBadRequest},
+	}
+	if !reflect.DeepEqual(want, responses) {
+		t.Errorf("batch result mismatch: want %v, got %v", want, responses)
+	}
+
+	// Batches must be POSTed.
+	r, err = http.NewRequest("GET", "http://test.com/ebert/batch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mux.Serve(nil, r); err == nil {
+		t.Errorf("want error for GET batch")
+	}
+}
@@ -28,6 +28,9 @@ import (
 	"sge-monorepo/libs/go/p4lib"
 	"sge-monorepo/libs/go/swarm"
 	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers/draft"
+	"sge-monorepo/tools/ebert/handlers/review"
+	"sge-monorepo/tools/ebert/linkify"
 )
 
 const (
@@ -108,6 +111,12 @@ func Handle(ctx *ebert.Context, r *http.Request, args *struct {
 		if bgErr != nil {
 			return nil, bgErr
 		}
+		if only, ok := review.PresubmitCommand(comment.Body); ok && args.publish {
+			// The comment is already posted, so don't fail the request if the run can't start.
+			if _, err := review.RunPresubmit(ctx, rid, only); err != nil {
+				log.Warningf("couldn't start presubmit of %d requested by %s: %v", rid, user, err)
+			}
+		}
 		return r, nil
 	case http.MethodDelete:
 		// DELETE is for deleting (draft) comments.
@@ -116,7 +125,14 @@ func Handle(ctx *ebert.Context, r *http.Request, args *struct {
 	return nil, fmt.Errorf("unexpected method: %s", r.Method)
 }
 
-func getComments(ctx *ebert.Context, user string, rid int) (*swarm.CommentCollection, error) {
+// Comments are the comments of a review.
+type Comments struct {
+	swarm.CommentCollection
+	// Links are the references to external systems in the bodies of comments, by comment id.
+	Links map[int][]linkify.Link `json:"links,omitempty"`
+}
+
+func getComments(ctx *ebert.Context, user string, rid int) (*Comments, error) {
 	type asyncComments struct {
 		comments *swarm.CommentCollection
 		err      error
@@ -146,7 +162,17 @@ func getComments(ctx *ebert.Context, user string, rid int) (*swarm.CommentCollec
 		}
 	}
 
-	return &comments, err
+	cs := &Comments{CommentCollection: comments}
+	l := ctx.Links.Linkifier()
+	for _, c := range comments.Comments {
+		if links := l.Links(c.Body); len(links) > 0 {
+			if cs.Links == nil {
+				cs.Links = map[int][]linkify.Link{}
+			}
+			cs.Links[c.ID] = links
+		}
+	}
+	return cs, err
 }
 
 func getDraftComments(ctx *ebert.Context, user string, rid int) (*swarm.CommentCollection, error) {
@@ -313,6 +339,9 @@ func swarmCommentKey(cid int) string {
 // only write back if the comment has not changed in the meantime.  If the
 // comment has changed, we retry the entire operation.
 func MarkRead(ctx *ebert.Context, r *http.Request, args *struct{ cid int }) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
 	cid := args.cid
 	if cid < 0 {
 		return nil, fmt.Errorf("Can't mark draft comments as read")
@@ -360,6 +389,52 @@ func MarkRead(ctx *ebert.Context, r *http.Request, args *struct{ cid int }) (int
 	return struct{}{}, nil
 }
 
+// Anchors maps the inline comments of review |rid|, drafts included, to a version of the review,
+// the latest one if |version| isn't set, eg.
+//
+//      {"version": 3, "anchors": {"123": {"comment": 123, "file": "//a.go", "version": 3, "line": 8}}}
+//
+// Comments whose lines were changed since they were made are marked as outdated.
+func Anchors(ctx *ebert.Context, r *http.Request, args *struct {
+	rid     int
+	version int
+}) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	user, err := ebert.UserFromRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine user: %w", err)
+	}
+	rev, err := swarm.GetReview(&ctx.Swarm, args.rid)
+	if err != nil {
+		return nil, err
+	}
+	version := args.version
+	if version == 0 {
+		version = len(rev.Versions)
+	}
+	if version < 1 || version > len(rev.Versions) {
+		return nil, ebert.NewError(
+			fmt.Errorf("review %d has no version %d", args.rid, version),
+			fmt.Sprintf("Review %d has no version %d", args.rid, version),
+			http.StatusBadRequest,
+		)
+	}
+	comments, err := getComments(ctx, user, args.rid)
+	if err != nil {
+		return nil, err
+	}
+	anchors, err := swarm.ReanchorComments(ctx.P4, rev, comments.Comments, version)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"version": version,
+		"anchors": anchors,
+	}, nil
+}
+
 func deleteComment(ctx *ebert.Context, user string, rid, cid int) (int, error) {
 	if cid >= 0 {
 		return 0, fmt.Errorf("can only delete draft comments, id = %d", cid)
@@ -418,43 +493,56 @@ func publishComments(ctx *ebert.Context, comment *swarm.Comment, user string, ri
 
 	published := &commentUpdates{}
 	published.Comments = make([]swarm.Comment, 0, len(publish.Comments))
-	var errs errors
-	lock := &sync.Mutex{}
-	wg := &sync.WaitGroup{}
-	for _, c := range publish.Comments {
-		wg.Add(1)
-		go func(comment swarm.Comment) {
-			defer wg.Done()
-			cid := comment.ID
-			comment.ID = 0
-			added, err := swarm.AddCommentEx(&uctx.Swarm, &comment, true)
-			if err == nil && cid < 0 {
-				// Succesfully published a draft comment, so delete the draft.
-				_, err = deleteComment(ctx, user, rid, cid)
-			}
+	publishAll := func(add func(*swarm.Comment) (*swarm.Comment, error)) error {
+		var errs errors
+		lock := &sync.Mutex{}
+		wg := &sync.WaitGroup{}
+		for _, c := range publish.Comments {
+			wg.Add(1)
+			go func(comment swarm.Comment) {
+				defer wg.Done()
+				cid := comment.ID
+				comment.ID = 0
+				added, err := add(&comment)
+				if err == nil && cid < 0 {
+					// Succesfully published a draft comment, so delete the draft.
+					_, err = deleteComment(ctx, user, rid, cid)
+				}
 
-			lock.Lock()
-			defer lock.Unlock()
-			if err != nil {
-				log.Warningf("failed publishing comment: %v", err)
-				errs = append(errs, err)
-				return
-			}
-			if cid < 0 {
-				published.Drafts = append(published.Drafts, cid)
-			}
-			published.Comments = append(published.Comments, *added)
-		}(c)
+				lock.Lock()
+				defer lock.Unlock()
+				if err != nil {
+					log.Warningf("failed publishing comment: %v", err)
+					errs = append(errs, err)
+					return
+				}
+				if cid < 0 {
+					published.Drafts = append(published.Drafts, cid)
+				}
+				published.Comments = append(published.Comments, *added)
+			}(c)
+		}
+		wg.Wait()
+		if len(errs) != 0 {
+			return errs
+		}
+		return nil
 	}
-
-	wg.Wait()
-	msg, err := swarm.SendNotifications(&uctx.Swarm, rid)
+	d, err := draft.Get(ctx, rid)
 	if err != nil {
-		errs = append(errs, fmt.Errorf("failed to send notifications: %v(%s)", err, msg))
-	}
+		log.Warningf("publishComments get draft: %v", err)
+	}
+	if d != nil {
+		// Notifications of comments on drafts are held until the review is published.
+		err = publishAll(func(c *swarm.Comment) (*swarm.Comment, error) {
+			return swarm.AddCommentEx(&uctx.Swarm, c, true)
+		})
+		return published, err
+	}
+	// A single notification is sent for all the comments once they are published.
+	msg, err := swarm.WithCommentBatch(&uctx.Swarm, rid, func(batch *swarm.CommentBatch) error {
+		return publishAll(batch.Add)
+	})
 	published.Message = msg
-	if len(errs) != 0 {
-		return published, errs
-	}
-	return published, nil
+	return published, err
 }
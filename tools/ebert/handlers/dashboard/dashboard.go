@@ -23,14 +23,46 @@ import (
 	"sort"
 	"time"
 
+	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/swarm"
 	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers/draft"
 )
 
 var (
 	maxChanges = flag.Int("max_changes", 128, "Maximum # of changes to consider when looking for pending/recently submitted CLs.")
 )
 
+// review is a Swarm review with its times formatted for the user.
+type review struct {
+	swarm.Review
+	// UpdatedDate shadows the server formatted date of Swarm with an ISO8601 one.
+	UpdatedDate string          `json:"updatedDate"`
+	CreatedTime ebert.Timestamp `json:"createdTime"`
+	UpdatedTime ebert.Timestamp `json:"updatedTime"`
+	// Snooze is the snooze of the review by the user, if any.
+	Snooze *Snooze `json:"snooze,omitempty"`
+	// Reminder is set when the snooze has ended and the user hasn't dismissed it yet.
+	Reminder bool `json:"reminder,omitempty"`
+	// Draft is set when the author marked the review as draft.
+	Draft *draft.Draft `json:"draft,omitempty"`
+}
+
+// withTimes formats the times of |reviews| in location |loc|, relative to |now|.
+func withTimes(reviews []swarm.Review, loc *time.Location, now time.Time) []review {
+	result := make([]review, 0, len(reviews))
+	for _, r := range reviews {
+		updated := ebert.NewTimestamp(int64(r.Updated), loc, now)
+		result = append(result, review{
+			Review:      r,
+			UpdatedDate: updated.ISO,
+			CreatedTime: ebert.NewTimestamp(int64(r.Created), loc, now),
+			UpdatedTime: updated,
+		})
+	}
+	return result
+}
+
 func Handle(ctx *ebert.Context, r *http.Request) (interface{}, error) {
 	user, err := ebert.UserFromRequest(r)
 	if err != nil {
@@ -48,15 +80,81 @@ func Handle(ctx *ebert.Context, r *http.Request) (interface{}, error) {
 			http.StatusInternalServerError,
 		)
 	}
+	tz, err := ctx.UserTimeZone(user)
+	if err != nil {
+		log.Warningf("couldn't get time zone of %s: %v", user, err)
+	}
+	loc := ctx.UserLocation(user)
+	now := time.Now()
+	sections := map[string][]review{
+		"incoming":  withTimes(info["incoming"], loc, now),
+		"outgoing":  withTimes(info["outgoing"], loc, now),
+		"pending":   withTimes(info["pending"], loc, now),
+		"submitted": withTimes(info["submitted"], loc, now),
+	}
+	store := snoozeStore(ctx)
+	snoozes, err := userSnoozes(store, user)
+	if err != nil {
+		log.Warningf("%v", err)
+	}
+	if gone := applySnoozes(sections, snoozes, now); len(gone) > 0 {
+		// Forget the snoozes of reviews that left the dashboard, they can't remind of anything.
+		err := updateSnoozes(store, user, func(snoozes map[int]*Snooze) {
+			for _, rid := range gone {
+				delete(snoozes, rid)
+			}
+		})
+		if err != nil {
+			log.Warningf("couldn't forget snoozes of %s: %v", user, err)
+		}
+	}
+	drafts, err := draft.All(ctx)
+	if err != nil {
+		log.Warningf("%v", err)
+	}
+	applyDrafts(sections, drafts, user)
 	return map[string]interface{}{
 		"user":      user,
-		"incoming":  info["incoming"],
-		"outgoing":  info["outgoing"],
-		"pending":   info["pending"],
-		"submitted": info["submitted"],
+		"timezone":  tz,
+		"incoming":  sections["incoming"],
+		"outgoing":  sections["outgoing"],
+		"pending":   sections["pending"],
+		"submitted": sections["submitted"],
+		"snoozed":   sections["snoozed"],
+		"drafts":    sections["drafts"],
 	}, nil
 }
 
+// applyDrafts moves the draft reviews of |user| to the "drafts" section and removes the drafts of
+// other users from all |sections|, as drafts aren't ready for their reviewers yet.
+func applyDrafts(sections map[string][]review, drafts map[int]*draft.Draft, user string) {
+	mine := []review{}
+	seen := map[int]bool{}
+	for name, reviews := range sections {
+		if name == "pending" || name == "submitted" {
+			continue
+		}
+		kept := []review{}
+		for _, r := range reviews {
+			d := drafts[r.ID]
+			if d == nil {
+				kept = append(kept, r)
+				continue
+			}
+			if r.Author == user && !seen[r.ID] {
+				r.Draft = d
+				mine = append(mine, r)
+			}
+			seen[r.ID] = true
+		}
+		sections[name] = kept
+	}
+	sort.Slice(mine, func(i, j int) bool {
+		return mine[i].ID > mine[j].ID
+	})
+	sections["drafts"] = mine
+}
+
 func dashboard(ctx *ebert.Context, user string) (map[string][]swarm.Review, error) {
 	ctx, err := ctx.Login(user)
 	if err != nil {
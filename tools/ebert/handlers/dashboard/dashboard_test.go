@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dashboard
+
+import (
+	"testing"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/handlers/draft"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApplyDrafts(t *testing.T) {
+	newReview := func(id int, author string) review {
+		return review{Review: swarm.Review{ID: id, Author: author}}
+	}
+	sections := map[string][]review{
+		"incoming":  {newReview(1, "bob"), newReview(2, "bob"), newReview(3, "alice")},
+		"outgoing":  {newReview(3, "alice"), newReview(4, "alice")},
+		"snoozed":   {newReview(5, "alice")},
+		"submitted": {newReview(6, "alice")},
+	}
+	drafts := map[int]*draft.Draft{
+		2: {Author: "bob"},
+		3: {Author: "alice"},
+		5: {Author: "alice"},
+		6: {Author: "alice"},
+	}
+	applyDrafts(sections, drafts, "alice")
+	got := map[string][]int{}
+	for name, reviews := range sections {
+		got[name] = []int{}
+		for _, r := range reviews {
+			got[name] = append(got[name], r.ID)
+		}
+	}
+	want := map[string][]int{
+		"incoming":  {1},
+		"outgoing":  {4},
+		"snoozed":   {},
+		"submitted": {6},
+		"drafts":    {5, 3},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("applyDrafts() sections diff (-want +got):\n%s", diff)
+	}
+}
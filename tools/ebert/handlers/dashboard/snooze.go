@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// Snooze hides a review from the dashboard of a user until a time or until the review gets a new
+// version. When it ends, the review is back on the dashboard as a reminder until the user
+// dismisses it.
+type Snooze struct {
+	// Until is the unix time the snooze ends at, 0 if it only ends with a new version.
+	Until int64 `json:"until,omitempty"`
+	// Versions is the number of versions of the review when it was snoozed until a new version, 0
+	// if the snooze only ends at Until.
+	Versions int `json:"versions,omitempty"`
+	// Note is a personal reminder shown when the snooze ends.
+	Note string `json:"note,omitempty"`
+}
+
+// Due returns whether the snooze of a review with |versions| versions has ended at |now|.
+func (s *Snooze) Due(now time.Time, versions int) bool {
+	if s.Until != 0 && now.Unix() >= s.Until {
+		return true
+	}
+	return s.Versions != 0 && versions > s.Versions
+}
+
+// snoozeStore keeps the snoozes of each user by review id, so that the dashboards of a user agree
+// across browsers and devices.
+func snoozeStore(ctx *ebert.Context) *p4lib.KeyStore {
+	return p4lib.NewKeyStore(ctx.P4, "ebert-snooze")
+}
+
+// userSnoozes returns the snoozes of |user| by review id.
+func userSnoozes(store *p4lib.KeyStore, user string) (map[int]*Snooze, error) {
+	snoozes := map[int]*Snooze{}
+	if _, err := store.Get(user, &snoozes); err != nil {
+		return nil, fmt.Errorf("couldn't get snoozes of %s: %w", user, err)
+	}
+	return snoozes, nil
+}
+
+// updateSnoozes calls |mutate| on the snoozes of |user| and stores them.
+func updateSnoozes(store *p4lib.KeyStore, user string, mutate func(map[int]*Snooze)) error {
+	var snoozes map[int]*Snooze
+	return store.Update(user, &snoozes, func() error {
+		if snoozes == nil {
+			snoozes = map[int]*Snooze{}
+		}
+		mutate(snoozes)
+		return nil
+	})
+}
+
+// Snoozes returns the snoozes of the user by review id.
+func Snoozes(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+	user, err := ebert.UserFromRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine user: %w", err)
+	}
+	return userSnoozes(snoozeStore(ctx), user)
+}
+
+// SnoozeReview snoozes (POST) review |rid| on the dashboard of the user until a time, until the
+// review gets a new version, or whichever comes first, with an optional note shown when the snooze
+// ends:
+//
+//      {"until": 1617267600, "newVersion": true, "note": "Check the perf numbers"}
+//
+// DELETE ends the snooze, or dismisses the reminder once it has ended.
+func SnoozeReview(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	user, err := ebert.UserFromRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine user: %w", err)
+	}
+	store := snoozeStore(ctx)
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Until      int64  `json:"until"`
+			NewVersion bool   `json:"newVersion"`
+			Note       string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, ebert.NewError(
+				fmt.Errorf("couldn't decode snooze: %w", err),
+				"Malformed snooze",
+				http.StatusBadRequest,
+			)
+		}
+		if req.Until != 0 && req.Until <= time.Now().Unix() {
+			return nil, ebert.NewError(
+				fmt.Errorf("snooze of review %d ends in the past: %d", args.rid, req.Until),
+				"Reviews can only be snoozed until a future time",
+				http.StatusBadRequest,
+			)
+		}
+		if req.Until == 0 && !req.NewVersion {
+			return nil, ebert.NewError(
+				fmt.Errorf("snooze of review %d never ends", args.rid),
+				"Reviews are snoozed until a time or until a new version",
+				http.StatusBadRequest,
+			)
+		}
+		snooze := &Snooze{Until: req.Until, Note: req.Note}
+		if req.NewVersion {
+			review, err := swarm.GetReview(&ctx.Swarm, args.rid)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't get review %d: %w", args.rid, err)
+			}
+			snooze.Versions = len(review.Versions)
+		}
+		err := updateSnoozes(store, user, func(snoozes map[int]*Snooze) {
+			snoozes[args.rid] = snooze
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't snooze review %d for %s: %w", args.rid, user, err)
+		}
+		return snooze, nil
+	case http.MethodDelete:
+		err := updateSnoozes(store, user, func(snoozes map[int]*Snooze) {
+			delete(snoozes, args.rid)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't end snooze of review %d for %s: %w", args.rid, user, err)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
+
+// applySnoozes moves the reviews of the "incoming" and "outgoing" |sections| with an ongoing snooze
+// to the "snoozed" section, and marks those whose snooze ended as reminders. Returns the review ids
+// of |snoozes| that are no longer on the dashboard, eg. because they were committed.
+func applySnoozes(sections map[string][]review, snoozes map[int]*Snooze, now time.Time) []int {
+	seen := map[int]bool{}
+	snoozed := []review{}
+	for _, name := range []string{"incoming", "outgoing"} {
+		kept := []review{}
+		for _, r := range sections[name] {
+			s := snoozes[r.ID]
+			if s == nil {
+				kept = append(kept, r)
+				continue
+			}
+			r.Snooze = s
+			if s.Due(now, len(r.Versions)) {
+				r.Reminder = true
+				kept = append(kept, r)
+			} else if !seen[r.ID] {
+				snoozed = append(snoozed, r)
+			}
+			seen[r.ID] = true
+		}
+		sections[name] = kept
+	}
+	sections["snoozed"] = snoozed
+	var gone []int
+	for rid := range snoozes {
+		if !seen[rid] {
+			gone = append(gone, rid)
+		}
+	}
+	return gone
+}
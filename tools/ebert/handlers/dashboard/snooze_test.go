@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dashboard
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnoozeDue(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		desc     string
+		snooze   Snooze
+		versions int
+		want     bool
+	}{
+		{"until a future time", Snooze{Until: 2000}, 1, false},
+		{"until a past time", Snooze{Until: 1000}, 1, true},
+		{"until a new version without one", Snooze{Versions: 2}, 2, false},
+		{"until a new version with one", Snooze{Versions: 2}, 3, true},
+		{"until a new version or a past time", Snooze{Until: 500, Versions: 2}, 2, true},
+	}
+	for _, tc := range tests {
+		if got := tc.snooze.Due(now, tc.versions); got != tc.want {
+			t.Errorf("%s: Due() = %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestApplySnoozes(t *testing.T) {
+	newReview := func(id, versions int) review {
+		return review{Review: swarm.Review{ID: id, Versions: make([]swarm.Version, versions)}}
+	}
+	sections := map[string][]review{
+		"incoming": {newReview(1, 1), newReview(2, 1), newReview(3, 2)},
+		"outgoing": {newReview(4, 1)},
+	}
+	snoozes := map[int]*Snooze{
+		2: {Until: 2000},
+		3: {Versions: 1, Note: "look again"},
+		4: {Versions: 1},
+		5: {Until: 2000},
+	}
+	gone := applySnoozes(sections, snoozes, time.Unix(1000, 0))
+	got := map[string][]string{}
+	for name, reviews := range sections {
+		got[name] = []string{}
+		for _, r := range reviews {
+			got[name] = append(got[name], fmt.Sprintf("%d reminder=%v", r.ID, r.Reminder))
+		}
+	}
+	want := map[string][]string{
+		"incoming": {"1 reminder=false", "3 reminder=true"},
+		"outgoing": {},
+		"snoozed":  {"2 reminder=false", "4 reminder=false"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("applySnoozes() sections diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int{5}, gone); diff != "" {
+		t.Errorf("applySnoozes() gone diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSnoozeReview(t *testing.T) {
+	keys := map[string]string{}
+	ctx := &ebert.Context{P4: p4mock.Mock{
+		KeyGetFunc: func(key string) (string, error) {
+			if v, ok := keys[key]; ok {
+				return v, nil
+			}
+			return "0", p4lib.ErrKeyNotFound
+		},
+		KeySetFunc: func(key, val string) error {
+			keys[key] = val
+			return nil
+		},
+		KeyCasFunc: func(key, oldval, newval string) error {
+			if keys[key] != oldval {
+				return p4lib.ErrCasMismatch
+			}
+			keys[key] = newval
+			return nil
+		},
+	}}
+	user, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snooze := func(method string, rid int, body string) error {
+		r := httptest.NewRequest(method, fmt.Sprintf("/ebert/snooze/%d", rid), strings.NewReader(body))
+		_, err := SnoozeReview(ctx, r, &struct{ rid int }{rid})
+		return err
+	}
+
+	until := time.Now().Add(time.Hour).Unix()
+	if err := snooze(http.MethodPost, 7, fmt.Sprintf(`{"until": %d, "note": "after lunch"}`, until)); err != nil {
+		t.Fatal(err)
+	}
+	if err := snooze(http.MethodPost, 8, fmt.Sprintf(`{"until": %d}`, until)); err != nil {
+		t.Fatal(err)
+	}
+	if err := snooze(http.MethodPost, 9, `{"until": 1}`); err == nil {
+		t.Errorf("snooze until a past time: got no error")
+	}
+	if err := snooze(http.MethodPost, 9, `{"note": "forever"}`); err == nil {
+		t.Errorf("snooze without an end: got no error")
+	}
+	if err := snooze(http.MethodDelete, 8, ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := userSnoozes(snoozeStore(ctx), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]*Snooze{7: {Until: until, Note: "after lunch"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("snoozes diff (-want +got):\n%s", diff)
+	}
+}
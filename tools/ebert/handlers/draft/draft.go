@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package draft contains the handler marking reviews as drafts. A draft review is work in progress
+// of its author: it's kept out of the queues of its reviewers, nobody is nagged about it, and the
+// notifications of its comments are held until the author publishes it.
+package draft
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// Draft is a review marked as draft by its author.
+type Draft struct {
+	Author string `json:"author"`
+	// Since is the unix time the review was marked as draft.
+	Since int64 `json:"since"`
+}
+
+// Swarm has no draft state. Drafts are "needsRevision" there, the state of reviews waiting on their
+// author, so that they also leave the queues of reviewers in Swarm. Publishing a draft asks for
+// reviews again.
+const (
+	swarmDraftState     = "needsRevision"
+	swarmPublishedState = "needsReview"
+)
+
+// draftsName is the name of the value holding all the drafts. Drafts are few and are read together
+// by the dashboard and the nag bot, so they share a single key.
+const draftsName = "reviews"
+
+// draftStore keeps the drafts by review id.
+func draftStore(ctx *ebert.Context) *p4lib.KeyStore {
+	return p4lib.NewKeyStore(ctx.P4, "ebert-review-draft")
+}
+
+// All returns the draft reviews by review id.
+func All(ctx *ebert.Context) (map[int]*Draft, error) {
+	drafts := map[int]*Draft{}
+	if _, err := draftStore(ctx).Get(draftsName, &drafts); err != nil {
+		return nil, fmt.Errorf("couldn't get draft reviews: %w", err)
+	}
+	return drafts, nil
+}
+
+// Get returns the draft of review |rid|, nil if the review isn't a draft.
+func Get(ctx *ebert.Context, rid int) (*Draft, error) {
+	drafts, err := All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return drafts[rid], nil
+}
+
+// updateDrafts calls |mutate| on the drafts and stores them.
+func updateDrafts(ctx *ebert.Context, mutate func(map[int]*Draft) error) error {
+	var drafts map[int]*Draft
+	return draftStore(ctx).Update(draftsName, &drafts, func() error {
+		if drafts == nil {
+			drafts = map[int]*Draft{}
+		}
+		return mutate(drafts)
+	})
+}
+
+// Handle returns (GET) the draft of review |rid|, null if it isn't one, marks the review as draft
+// (POST) or publishes it (DELETE). Only the author of a review can mark it as draft or publish it.
+// Publishing sends the notifications held while the review was a draft.
+func Handle(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	if r.Method == http.MethodGet {
+		return Get(ctx, args.rid)
+	}
+	uctx, err := ctx.UserContext(r)
+	if err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	user := uctx.Swarm.Username
+	review, err := swarm.GetReview(&ctx.Swarm, args.rid)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get review %d: %w", args.rid, err)
+	}
+	if review.Author != user {
+		return nil, ebert.NewError(
+			fmt.Errorf("%s isn't the author of review %d", user, args.rid),
+			"Only the author of a review can mark it as draft or publish it",
+			http.StatusForbidden,
+		)
+	}
+	switch r.Method {
+	case http.MethodPost:
+		return markDraft(uctx, review, time.Now())
+	case http.MethodDelete:
+		return nil, publish(uctx, review)
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
+
+// newDraft returns the draft of |review| marked at |now|, or an error if the review isn't open.
+func newDraft(review *swarm.Review, now time.Time) (*Draft, error) {
+	if len(review.Commits) != 0 || (review.State != swarmPublishedState && review.State != swarmDraftState) {
+		return nil, ebert.NewError(
+			fmt.Errorf("review %d is %s", review.ID, review.State),
+			"Only open reviews can be marked as draft",
+			http.StatusBadRequest,
+		)
+	}
+	return &Draft{Author: review.Author, Since: now.Unix()}, nil
+}
+
+func markDraft(uctx *ebert.Context, review *swarm.Review, now time.Time) (*Draft, error) {
+	d, err := newDraft(review, now)
+	if err != nil {
+		return nil, err
+	}
+	err = updateDrafts(uctx, func(drafts map[int]*Draft) error {
+		if prev := drafts[review.ID]; prev != nil {
+			d = prev
+			return nil
+		}
+		drafts[review.ID] = d
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't mark review %d as draft: %w", review.ID, err)
+	}
+	if review.State != swarmDraftState {
+		if _, err := swarm.SetState(&uctx.Swarm, review.ID, swarmDraftState); err != nil {
+			// The draft still hides the review in Ebert.
+			log.Warningf("couldn't set state of draft review %d: %v", review.ID, err)
+		}
+	}
+	return d, nil
+}
+
+func publish(uctx *ebert.Context, review *swarm.Review) error {
+	var d *Draft
+	err := updateDrafts(uctx, func(drafts map[int]*Draft) error {
+		d = drafts[review.ID]
+		delete(drafts, review.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't publish review %d: %w", review.ID, err)
+	}
+	if d == nil {
+		return nil
+	}
+	if review.State == swarmDraftState {
+		if _, err := swarm.SetState(&uctx.Swarm, review.ID, swarmPublishedState); err != nil {
+			log.Warningf("couldn't set state of published review %d: %v", review.ID, err)
+		}
+	}
+	if msg, err := swarm.SendNotifications(&uctx.Swarm, review.ID); err != nil {
+		return fmt.Errorf("published review %d but couldn't send its notifications: %v(%s)", review.ID, err, msg)
+	}
+	return nil
+}
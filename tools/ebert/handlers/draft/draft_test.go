@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package draft
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewDraft(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		desc    string
+		review  swarm.Review
+		wantErr bool
+	}{
+		{"needs review", swarm.Review{ID: 1, Author: "alice", State: "needsReview"}, false},
+		{"needs revision", swarm.Review{ID: 2, Author: "alice", State: "needsRevision"}, false},
+		{"approved", swarm.Review{ID: 3, Author: "alice", State: "approved"}, true},
+		{"committed", swarm.Review{ID: 4, Author: "alice", State: "needsReview", Commits: []int{5}}, true},
+	}
+	for _, tc := range tests {
+		d, err := newDraft(&tc.review, now)
+		if tc.wantErr {
+			var e *ebert.Error
+			if !errors.As(err, &e) || e.Code != http.StatusBadRequest {
+				t.Errorf("%s: newDraft() error = %v, want bad request", tc.desc, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: newDraft() error = %v", tc.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(&Draft{Author: "alice", Since: 1000}, d); diff != "" {
+			t.Errorf("%s: newDraft() diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	keys := map[string]string{}
+	ctx := &ebert.Context{P4: p4mock.Mock{
+		KeyGetFunc: func(key string) (string, error) {
+			if v, ok := keys[key]; ok {
+				return v, nil
+			}
+			return "0", p4lib.ErrKeyNotFound
+		},
+		KeySetFunc: func(key, val string) error {
+			keys[key] = val
+			return nil
+		},
+		KeyCasFunc: func(key, oldval, newval string) error {
+			if keys[key] != oldval {
+				return p4lib.ErrCasMismatch
+			}
+			keys[key] = newval
+			return nil
+		},
+	}}
+	for _, rid := range []int{7, 8} {
+		rid := rid
+		err := updateDrafts(ctx, func(drafts map[int]*Draft) error {
+			drafts[rid] = &Draft{Author: "alice", Since: int64(rid)}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := updateDrafts(ctx, func(drafts map[int]*Draft) error {
+		delete(drafts, 7)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]*Draft{8: {Author: "alice", Since: 8}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("All() diff (-want +got):\n%s", diff)
+	}
+	if d, err := Get(ctx, 7); err != nil || d != nil {
+		t.Errorf("Get(7) = %v, %v, want nil, nil", d, err)
+	}
+}
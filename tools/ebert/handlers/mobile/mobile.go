@@ -0,0 +1,257 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mobile contains a small set of handlers for approving reviews on the go, eg. from a phone
+// or a chat bot. Payloads are kept compact and requests can be authenticated by an API token rather
+// than a browser session.
+package mobile
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers/review"
+)
+
+// maxTitle is the maximum length in runes of the title of a review.
+const maxTitle = 100
+
+// Item is the compact form of a review.
+type Item struct {
+	ID      int    `json:"id"`
+	Author  string `json:"author"`
+	Title   string `json:"title"`
+	State   string `json:"state"`
+	Updated int    `json:"updated"`
+	Up      int    `json:"up,omitempty"`
+	Down    int    `json:"down,omitempty"`
+	// Required is set when the user is a required reviewer.
+	Required bool `json:"required,omitempty"`
+	// Vote is the current vote of the user, 0 if none or stale.
+	Vote int `json:"vote,omitempty"`
+}
+
+// Summary is a review with the top-level stats of its latest version.
+type Summary struct {
+	Item
+	Description string `json:"description"`
+	Change      int    `json:"change"`
+	Version     int    `json:"version"`
+	TestStatus  string `json:"testStatus,omitempty"`
+	// Votes are the current votes by user.
+	Votes map[string]int `json:"votes,omitempty"`
+	Stats DiffStats      `json:"stats"`
+}
+
+// DiffStats counts the files of a change.
+type DiffStats struct {
+	Files int `json:"files"`
+	// Actions is the number of files by action, eg. {"edit": 3, "add": 1}.
+	Actions map[string]int `json:"actions"`
+	Binary  int            `json:"binary,omitempty"`
+}
+
+// title returns the first line of |desc|, shortened to maxTitle runes.
+func title(desc string) string {
+	line := strings.TrimSpace(desc)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if runes := []rune(line); len(runes) > maxTitle {
+		line = string(runes[:maxTitle-1]) + "…"
+	}
+	return line
+}
+
+// newItem returns the compact form of |r| for |user|.
+func newItem(r *swarm.Review, user string) Item {
+	item := Item{
+		ID:      r.ID,
+		Author:  r.Author,
+		Title:   title(r.Description),
+		State:   r.State,
+		Updated: r.Updated,
+	}
+	for name, p := range r.Participants {
+		if p.Vote.IsStale {
+			continue
+		}
+		if p.Vote.Value > 0 {
+			item.Up++
+		} else if p.Vote.Value < 0 {
+			item.Down++
+		}
+		if name == user {
+			item.Vote = p.Vote.Value
+		}
+	}
+	if p, ok := r.Participants[user]; ok {
+		item.Required = p.Required
+	}
+	return item
+}
+
+// pendingFor returns the reviews of |reviews| waiting for a vote of |user| at |now|, latest first.
+// Reviews of the user, committed reviews and reviews untouched for a month are left out, as on the
+// dashboard.
+func pendingFor(reviews []swarm.Review, user string, now time.Time) []Item {
+	items := []Item{}
+	for i := range reviews {
+		r := &reviews[i]
+		if r.Author == user || len(r.Commits) != 0 || r.State != "needsReview" {
+			continue
+		}
+		if now.Sub(time.Unix(int64(r.Updated), 0)) > 30*24*time.Hour {
+			continue
+		}
+		if _, ok := r.Participants[user]; !ok {
+			continue
+		}
+		item := newItem(r, user)
+		if item.Vote != 0 {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID > items[j].ID
+	})
+	return items
+}
+
+// diffStats counts the files of |desc|.
+func diffStats(desc *p4lib.Description) DiffStats {
+	stats := DiffStats{Actions: map[string]int{}}
+	for _, f := range desc.Files {
+		stats.Files++
+		stats.Actions[f.Action]++
+		if strings.Contains(f.Type, "binary") {
+			stats.Binary++
+		}
+	}
+	return stats
+}
+
+// Pending returns the reviews waiting for a vote of the user.
+func Pending(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+	uctx, err := userContext(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	user := uctx.Swarm.Username
+	rc, err := swarm.GetOpenReviews(&uctx.Swarm, user)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get open reviews of %s: %w", user, err)
+	}
+	return pendingFor(rc.Reviews, user, time.Now()), nil
+}
+
+// Review returns the summary of review |rid|.
+func Review(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	uctx, err := userContext(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := swarm.GetReview(&uctx.Swarm, args.rid)
+	if err != nil {
+		return nil, ebert.NewError(
+			fmt.Errorf("couldn't get review %d: %w", args.rid, err),
+			fmt.Sprintf("No review numbered %d", args.rid),
+			http.StatusNotFound,
+		)
+	}
+	summary := &Summary{
+		Item:        newItem(rev, uctx.Swarm.Username),
+		Description: rev.Description,
+		TestStatus:  rev.TestStatus,
+		Version:     len(rev.Versions),
+		Votes:       map[string]int{},
+	}
+	for name, p := range rev.Participants {
+		if p.Vote.Value != 0 && !p.Vote.IsStale {
+			summary.Votes[name] = p.Vote.Value
+		}
+	}
+	if len(rev.Versions) == 0 {
+		return summary, nil
+	}
+	latest := rev.Versions[len(rev.Versions)-1]
+	summary.Change = latest.Change
+	var descs []p4lib.Description
+	if latest.Pending {
+		descs, err = uctx.P4.DescribeShelved(latest.Change)
+	} else {
+		descs, err = uctx.P4.Describe([]int{latest.Change})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe change %d of review %d: %w", latest.Change, args.rid, err)
+	}
+	if len(descs) > 0 {
+		summary.Stats = diffStats(&descs[0])
+	}
+	return summary, nil
+}
+
+// Approve (POST) approves review |rid| as the user and returns it.
+func Approve(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method: %s", r.Method)
+	}
+	uctx, err := userContext(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := review.ApproveAs(uctx, args.rid)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't approve review %d: %w", args.rid, err)
+	}
+	return newItem(rev, uctx.Swarm.Username), nil
+}
+
+// Vote (POST) votes "up", "down" or "clear" on review |rid| as the user and returns it.
+func Vote(ctx *ebert.Context, r *http.Request, args *struct {
+	rid  int
+	vote string
+}) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method: %s", r.Method)
+	}
+	switch args.vote {
+	case "up", "down", "clear":
+	default:
+		return nil, ebert.NewError(
+			fmt.Errorf("invalid vote %q on review %d", args.vote, args.rid),
+			"Votes are up, down or clear",
+			http.StatusBadRequest,
+		)
+	}
+	uctx, err := userContext(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := swarm.SetVote(&uctx.Swarm, args.rid, args.vote); err != nil {
+		return nil, fmt.Errorf("couldn't vote on review %d: %w", args.rid, err)
+	}
+	rev, err := swarm.GetReview(&uctx.Swarm, args.rid)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get review %d: %w", args.rid, err)
+	}
+	return newItem(rev, uctx.Swarm.Username), nil
+}
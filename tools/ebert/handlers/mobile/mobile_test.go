@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers/tokens"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPendingFor(t *testing.T) {
+	now := time.Unix(1617267600, 0)
+	updated := int(now.Add(-time.Hour).Unix())
+	vote := func(value int, stale bool) swarm.Participant {
+		return swarm.Participant{Vote: swarm.Vote{Value: value, IsStale: stale}}
+	}
+	reviews := []swarm.Review{
+		{ID: 1, Author: "bob", State: "needsReview", Updated: updated, Description: "Fix the build\n\nDetails.",
+			Participants: map[string]swarm.Participant{"me": {Required: true}, "eve": vote(1, false)}},
+		{ID: 2, Author: "bob", State: "needsReview", Updated: updated, Description: "Voted",
+			Participants: map[string]swarm.Participant{"me": vote(1, false)}},
+		{ID: 3, Author: "bob", State: "needsReview", Updated: updated, Description: "Stale vote",
+			Participants: map[string]swarm.Participant{"me": vote(-1, true), "eve": vote(-1, false)}},
+		{ID: 4, Author: "me", State: "needsReview", Updated: updated, Description: "Mine",
+			Participants: map[string]swarm.Participant{"me": {}}},
+		{ID: 5, Author: "bob", State: "needsReview", Updated: updated, Commits: []int{12}, Description: "Committed",
+			Participants: map[string]swarm.Participant{"me": {}}},
+		{ID: 6, Author: "bob", State: "needsReview", Updated: int(now.Add(-40 * 24 * time.Hour).Unix()), Description: "Old",
+			Participants: map[string]swarm.Participant{"me": {}}},
+		{ID: 7, Author: "bob", State: "approved", Updated: updated, Description: "Approved",
+			Participants: map[string]swarm.Participant{"me": {}}},
+	}
+	got := pendingFor(reviews, "me", now)
+	want := []Item{
+		{ID: 3, Author: "bob", Title: "Stale vote", State: "needsReview", Updated: updated, Down: 1},
+		{ID: 1, Author: "bob", Title: "Fix the build", State: "needsReview", Updated: updated, Up: 1, Required: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("pendingFor() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDiffStats(t *testing.T) {
+	got := diffStats(&p4lib.Description{Files: []p4lib.FileAction{
+		{Action: "edit", Type: "text"},
+		{Action: "edit", Type: "binary+l"},
+		{Action: "add", Type: "text"},
+	}})
+	want := DiffStats{Files: 3, Actions: map[string]int{"edit": 2, "add": 1}, Binary: 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diffStats() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	keys := map[string]string{}
+	ctx := &ebert.Context{P4: p4mock.Mock{
+		KeyGetFunc: func(key string) (string, error) {
+			if v, ok := keys[key]; ok {
+				return v, nil
+			}
+			return "0", p4lib.ErrKeyNotFound
+		},
+		KeySetFunc: func(key, val string) error {
+			keys[key] = val
+			return nil
+		},
+		KeyCasFunc: func(key, oldval, newval string) error {
+			if keys[key] != oldval {
+				return p4lib.ErrCasMismatch
+			}
+			keys[key] = newval
+			return nil
+		},
+	}}
+	user, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, secret string) *http.Request {
+		r := httptest.NewRequest(method, "/ebert/m/token", nil)
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		return r
+	}
+
+	res, err := Tokens(ctx, request(http.MethodPost, ""), &struct{ name string }{"phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := res.(map[string]string)["token"]
+	for key := range keys {
+		if key != "ebert-token-"+tokens.Hash(secret) {
+			t.Errorf("token stored as %s, want its hash", key)
+		}
+	}
+	token, err := tokens.NewStore(ctx.P4).Lookup(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.User != user || token.Name != "phone" || !token.Allows(tokens.User) {
+		t.Errorf("Lookup() = %+v, want user %s named phone with the user scope", token, user)
+	}
+	if _, err := Tokens(ctx, request(http.MethodPost, secret), &struct{ name string }{}); err == nil {
+		t.Errorf("token issued by a token: got no error")
+	}
+	if _, err := userContext(ctx, request(http.MethodGet, "bogus")); err == nil {
+		t.Errorf("userContext() with an unknown token: got no error")
+	}
+	if _, err := Tokens(ctx, request(http.MethodDelete, secret), &struct{ name string }{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.NewStore(ctx.P4).Lookup(secret); err != tokens.ErrBadToken {
+		t.Errorf("Lookup() of a revoked token: got %v, want %v", err, tokens.ErrBadToken)
+	}
+}
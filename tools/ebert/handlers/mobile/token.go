@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers/tokens"
+)
+
+// userContext returns a login context for the user making the request, identified by its bearer
+// token if it has one and by its session otherwise.
+func userContext(ctx *ebert.Context, r *http.Request) (*ebert.Context, error) {
+	secret, ok := tokens.Bearer(r)
+	if !ok {
+		return ctx.UserContext(r)
+	}
+	token, err := tokens.NewStore(ctx.P4).Lookup(secret)
+	if err != nil {
+		return nil, ebert.NewError(err, "Invalid API token", http.StatusUnauthorized)
+	}
+	return ctx.Login(token.User)
+}
+
+// Tokens issues (POST) an API token for the user, named after the "name" form value, and returns
+// its secret. The secret is only returned once, and is sent as "Authorization: Bearer <secret>".
+// DELETE revokes the bearer token of the request.
+//
+// The tokens have the User scope, as the mobile handlers vote and approve as the user. Tokens are
+// only issued to browser sessions, so that a leaked token can't mint more of them.
+func Tokens(ctx *ebert.Context, r *http.Request, args *struct{ name string }) (interface{}, error) {
+	store := tokens.NewStore(ctx.P4)
+	switch r.Method {
+	case http.MethodPost:
+		if _, ok := tokens.Bearer(r); ok {
+			return nil, ebert.NewError(
+				fmt.Errorf("token request authenticated by a token"),
+				"API tokens can't issue other tokens",
+				http.StatusForbidden,
+			)
+		}
+		user, err := ebert.UserFromRequest(r)
+		if err != nil {
+			return nil, ebert.NewError(
+				fmt.Errorf("couldn't determine user: %w", err),
+				"Couldn't determine identity",
+				http.StatusUnauthorized,
+			)
+		}
+		secret, err := store.Issue(tokens.Token{User: user, Name: args.name, Scopes: []tokens.Scope{tokens.User}})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"user": user, "token": secret}, nil
+	case http.MethodDelete:
+		secret, ok := tokens.Bearer(r)
+		if !ok {
+			return nil, ebert.NewError(
+				fmt.Errorf("no bearer token to revoke"),
+				"Missing API token",
+				http.StatusBadRequest,
+			)
+		}
+		if err := store.Revoke(tokens.Hash(secret)); err != nil {
+			if errors.Is(err, tokens.ErrBadToken) {
+				return nil, ebert.NewError(err, "Invalid API token", http.StatusUnauthorized)
+			}
+			return nil, fmt.Errorf("couldn't revoke token: %w", err)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
@@ -58,13 +58,21 @@ type route struct {
 //   /a/b
 type Mux struct {
 	Prefix string
-	routes []route
+	// Authorize, if set, is called with the requests matching a route before they're served, eg. to
+	// check the scopes of an API token. Requests it returns an error for aren't served.
+	Authorize func(r *http.Request) error
+	routes    []route
 }
 
 // Serve routes a http.Request to the correct implementation.
 func (m *Mux) Serve(ctx *ebert.Context, r *http.Request) (interface{}, error) {
 	for _, route := range m.routes {
 		if route.matcher.MatchString(r.URL.Path) {
+			if m.Authorize != nil {
+				if err := m.Authorize(r); err != nil {
+					return nil, err
+				}
+			}
 			return route.handler.Serve(ctx, r)
 		}
 	}
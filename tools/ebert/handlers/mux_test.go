@@ -116,3 +116,42 @@ func TestMux(t *testing.T) {
 		}
 	}
 }
+
+func TestMuxAuthorize(t *testing.T) {
+	errDenied := errors.New("denied")
+	mux := &Mux{Authorize: func(r *http.Request) error {
+		if r.Method != http.MethodGet {
+			return errDenied
+		}
+		return nil
+	}}
+	if err := mux.Handle("/a", func(*ebert.Context, *http.Request, *struct{}) (interface{}, error) {
+		return 1, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method  string
+		url     string
+		want    interface{}
+		wantErr error
+	}{
+		{method: http.MethodGet, url: "http://test.com/a", want: 1},
+		{method: http.MethodPost, url: "http://test.com/a", wantErr: errDenied},
+		// Unknown routes aren't authorized.
+		{method: http.MethodPost, url: "http://test.com/b", wantErr: ErrRouteNotFound},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mux.Serve(&ebert.Context{}, r)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s %s: got error %v, want %v", test.method, test.url, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("%s %s: got %v, want %v", test.method, test.url, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prefs contains the handlers for user preferences.
+package prefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// TimeZone gets (GET) or sets (POST) the time zone the user wants times displayed in:
+//
+//      {"timezone": "Europe/Stockholm"}
+//
+// Users without a preference get an empty time zone, and times are displayed in UTC.
+func TimeZone(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+	user, err := ebert.UserFromRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine user: %w", err)
+	}
+	var pref struct {
+		TimeZone string `json:"timezone"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		pref.TimeZone, err = ctx.UserTimeZone(user)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get time zone of %s: %w", user, err)
+		}
+		return pref, nil
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&pref); err != nil {
+			return nil, ebert.NewError(
+				fmt.Errorf("couldn't decode time zone: %w", err),
+				"Malformed time zone preference",
+				http.StatusBadRequest,
+			)
+		}
+		if err := ctx.SetUserTimeZone(user, pref.TimeZone); err != nil {
+			return nil, ebert.NewError(
+				err,
+				fmt.Sprintf("Invalid time zone: %q", pref.TimeZone),
+				http.StatusBadRequest,
+			)
+		}
+		return pref, nil
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// viewerTTL is how long a viewer stays present without any update.
+	viewerTTL = 45 * time.Second
+	// typingTTL is how long a typing indicator lasts without being refreshed.
+	typingTTL = 10 * time.Second
+)
+
+// Viewer is a browser session looking at a review.
+type Viewer struct {
+	User    string `json:"user"`
+	Session string `json:"session"`
+	// File is the depot path of the file being viewed, empty for the review itself.
+	File string `json:"file"`
+	// Typing is set while the user writes a comment on File, at Line if it's an inline comment.
+	Typing bool `json:"typing"`
+	Line   int  `json:"line"`
+
+	lastSeen time.Time
+	typedAt  time.Time
+}
+
+// Hub tracks the viewers of every review and broadcasts changes to subscribers. Presence is kept in
+// memory only, it's lost when Ebert restarts and browsers rebuild it with their next update.
+type Hub struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	reviews map[int]map[string]*Viewer
+	subs    map[int]map[chan []Viewer]bool
+}
+
+// NewHub returns an empty hub.
+func NewHub() *Hub {
+	return &Hub{
+		now:     time.Now,
+		reviews: map[int]map[string]*Viewer{},
+		subs:    map[int]map[chan []Viewer]bool{},
+	}
+}
+
+// Update sets the state of the viewer with session |v.Session| on review |rid|.
+func (h *Hub) Update(rid int, v Viewer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	viewers := h.reviews[rid]
+	if viewers == nil {
+		viewers = map[string]*Viewer{}
+		h.reviews[rid] = viewers
+	}
+	old := viewers[v.Session]
+	v.lastSeen = now
+	if v.Typing {
+		v.typedAt = now
+	}
+	viewers[v.Session] = &v
+	changed := h.expire(rid)
+	if old == nil || old.User != v.User || old.File != v.File || old.Typing != v.Typing || old.Line != v.Line {
+		changed = true
+	}
+	if changed {
+		h.broadcast(rid)
+	}
+}
+
+// Touch keeps the viewer with |session| on review |rid| present, without changing its state.
+func (h *Hub) Touch(rid int, session string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v, ok := h.reviews[rid][session]; ok {
+		v.lastSeen = h.now()
+	}
+}
+
+// Leave removes the viewer with |session| from review |rid|.
+func (h *Hub) Leave(rid int, session string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.reviews[rid][session]; !ok {
+		return
+	}
+	delete(h.reviews[rid], session)
+	if len(h.reviews[rid]) == 0 {
+		delete(h.reviews, rid)
+	}
+	h.broadcast(rid)
+}
+
+// Expire drops the viewers of review |rid| that went away and the typing indicators that weren't
+// refreshed, broadcasting the change if there was any.
+func (h *Hub) Expire(rid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.expire(rid) {
+		h.broadcast(rid)
+	}
+}
+
+// Viewers returns the current viewers of review |rid|, sorted by user.
+func (h *Hub) Viewers(rid int) []Viewer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.expire(rid) {
+		h.broadcast(rid)
+	}
+	return h.viewers(rid)
+}
+
+// Subscribe returns a channel receiving the viewers of review |rid| every time they change, starting
+// with the current ones. Only the latest state is kept for slow receivers. The returned function
+// must be called to unsubscribe.
+func (h *Hub) Subscribe(rid int) (<-chan []Viewer, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []Viewer, 1)
+	if h.subs[rid] == nil {
+		h.subs[rid] = map[chan []Viewer]bool{}
+	}
+	h.subs[rid][ch] = true
+	ch <- h.viewers(rid)
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[rid], ch)
+		if len(h.subs[rid]) == 0 {
+			delete(h.subs, rid)
+		}
+	}
+}
+
+// expire must be called with the lock held. Returns whether any viewer changed.
+func (h *Hub) expire(rid int) bool {
+	now := h.now()
+	changed := false
+	for session, v := range h.reviews[rid] {
+		if now.Sub(v.lastSeen) > viewerTTL {
+			delete(h.reviews[rid], session)
+			changed = true
+		} else if v.Typing && now.Sub(v.typedAt) > typingTTL {
+			v.Typing = false
+			v.Line = 0
+			changed = true
+		}
+	}
+	if len(h.reviews[rid]) == 0 {
+		delete(h.reviews, rid)
+	}
+	return changed
+}
+
+// viewers must be called with the lock held.
+func (h *Hub) viewers(rid int) []Viewer {
+	viewers := make([]Viewer, 0, len(h.reviews[rid]))
+	for _, v := range h.reviews[rid] {
+		viewers = append(viewers, *v)
+	}
+	sort.Slice(viewers, func(i, j int) bool {
+		if viewers[i].User != viewers[j].User {
+			return viewers[i].User < viewers[j].User
+		}
+		return viewers[i].Session < viewers[j].Session
+	})
+	return viewers
+}
+
+// broadcast must be called with the lock held.
+func (h *Hub) broadcast(rid int) {
+	if len(h.subs[rid]) == 0 {
+		return
+	}
+	viewers := h.viewers(rid)
+	for ch := range h.subs[rid] {
+		// Replace any state the subscriber didn't receive yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- viewers
+	}
+}
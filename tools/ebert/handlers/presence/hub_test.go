@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func users(viewers []Viewer) []string {
+	var ret []string
+	for _, v := range viewers {
+		u := v.User
+		if v.Typing {
+			u += "*"
+		}
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHub(t *testing.T) {
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	h := NewHub()
+	h.now = func() time.Time { return now }
+
+	updates, unsubscribe := h.Subscribe(1)
+	defer unsubscribe()
+	expect := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-updates:
+			if !equal(users(got), want) {
+				t.Errorf("update: want %v, got %v", want, users(got))
+			}
+		default:
+			t.Errorf("want update %v, got none", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-updates:
+			t.Errorf("want no update, got %v", users(got))
+		default:
+		}
+	}
+
+	expect()
+	h.Update(1, Viewer{User: "bob", Session: "b1"})
+	h.Update(1, Viewer{User: "alice", Session: "a1", File: "//depot/foo.cc"})
+	// Only the latest state is kept.
+	expect("alice", "bob")
+	h.Update(1, Viewer{User: "bob", Session: "b1"})
+	expectNone()
+	h.Update(2, Viewer{User: "carol", Session: "c1"})
+	expectNone()
+	if got := h.Viewers(2); !equal(users(got), []string{"carol"}) {
+		t.Errorf("Viewers(2) = %v, want carol", users(got))
+	}
+
+	h.Update(1, Viewer{User: "alice", Session: "a1", File: "//depot/foo.cc", Typing: true, Line: 12})
+	expect("alice*", "bob")
+
+	// Typing indicators and viewers expire without updates.
+	now = now.Add(typingTTL + time.Second)
+	h.Touch(1, "b1")
+	h.Expire(1)
+	expect("alice", "bob")
+	now = now.Add(viewerTTL - typingTTL)
+	h.Expire(1)
+	expect("bob")
+
+	h.Leave(1, "b1")
+	expect()
+	if got := h.Viewers(1); len(got) != 0 {
+		t.Errorf("Viewers(1) = %v, want none", got)
+	}
+}
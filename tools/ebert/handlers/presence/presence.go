@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package presence contains the handlers telling reviewers who else is looking at a review, and
+// who is writing a comment, so that they don't duplicate work on big changes.
+package presence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// heartbeat is how often open event streams keep their viewer present and expire the others.
+const heartbeat = 5 * time.Second
+
+var hub = NewHub()
+
+type presence struct {
+	Viewers []Viewer `json:"viewers"`
+}
+
+// Handle gets (GET) the viewers of a review, or updates (POST) the state of the viewer making the
+// request. Browsers without an event stream open must POST at least every 45s to stay present, and
+// every 10s while typing.
+func Handle(ctx *ebert.Context, r *http.Request, args *struct {
+	rid     int
+	session string
+	file    string
+	typing  bool
+	line    int
+	leave   bool
+}) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return presence{hub.Viewers(args.rid)}, nil
+	case http.MethodPost:
+		user, err := ebert.UserFromRequest(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't determine user: %w", err)
+		}
+		if args.session == "" {
+			return nil, ebert.NewError(
+				fmt.Errorf("missing session"),
+				"Missing presence session",
+				http.StatusBadRequest,
+			)
+		}
+		if args.leave {
+			hub.Leave(args.rid, args.session)
+		} else {
+			hub.Update(args.rid, Viewer{
+				User:    user,
+				Session: args.session,
+				File:    args.file,
+				Typing:  args.typing,
+				Line:    args.line,
+			})
+		}
+		return presence{hub.Viewers(args.rid)}, nil
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
+
+// Events streams the viewers of a review as server-sent events while the request is open. The viewer
+// making the request is present for as long as the stream is. Every change is sent as:
+//
+//      event: presence
+//      data: {"viewers": [{"user": "alice", "session": "...", "file": "", "typing": false, "line": 0}]}
+func Events(ctx *ebert.Context, r *http.Request, args *struct {
+	rid     int
+	session string
+	file    string
+}) (interface{}, error) {
+	user, err := ebert.UserFromRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine user: %w", err)
+	}
+	if args.session == "" {
+		return nil, ebert.NewError(
+			fmt.Errorf("missing session"),
+			"Missing presence session",
+			http.StatusBadRequest,
+		)
+	}
+	return func(w io.Writer) error {
+		rw, ok := w.(http.ResponseWriter)
+		if !ok {
+			return fmt.Errorf("presence events need an http.ResponseWriter, got %T", w)
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return fmt.Errorf("presence events need streaming responses")
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		// Keep proxies from buffering the stream.
+		rw.Header().Set("X-Accel-Buffering", "no")
+
+		updates, unsubscribe := hub.Subscribe(args.rid)
+		defer unsubscribe()
+		hub.Update(args.rid, Viewer{User: user, Session: args.session, File: args.file})
+		defer hub.Leave(args.rid, args.session)
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return nil
+			case viewers := <-updates:
+				data, err := json.Marshal(presence{viewers})
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "event: presence\ndata: %s\n\n", data); err != nil {
+					return nil
+				}
+			case <-ticker.C:
+				hub.Touch(args.rid, args.session)
+				hub.Expire(args.rid)
+				// Comments keep idle connections open through proxies.
+				if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+					return nil
+				}
+			}
+			flusher.Flush()
+		}
+	}, nil
+}
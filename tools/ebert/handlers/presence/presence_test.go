@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers"
+)
+
+func TestHandle(t *testing.T) {
+	h, err := handlers.Wrap("/ebert/presence/:rid", Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ebert.Context{}
+	r := httptest.NewRequest(http.MethodPost, "/ebert/presence/4972?session=s1&file=//depot/foo.cc&line=12&typing=true", nil)
+	if _, err := h.Serve(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.Serve(ctx, httptest.NewRequest(http.MethodGet, "/ebert/presence/4972", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewers := got.(presence).Viewers
+	if len(viewers) == 1 {
+		viewers[0].lastSeen, viewers[0].typedAt = time.Time{}, time.Time{}
+	}
+	want := Viewer{User: user, Session: "s1", File: "//depot/foo.cc", Typing: true, Line: 12}
+	if len(viewers) != 1 || viewers[0] != want {
+		t.Errorf("GET /ebert/presence/4972 = %+v, want [%+v]", viewers, want)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/ebert/presence/4972?session=s1&leave=1", nil)
+	if _, err := h.Serve(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := hub.Viewers(4972); len(got) != 0 {
+		t.Errorf("Viewers(4972) after leaving = %+v, want none", got)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/ebert/presence/4972", nil)
+	if _, err := h.Serve(ctx, r); err == nil {
+		t.Errorf("POST without session: got no error")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package review
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/artifacts"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// ArtifactInfo is an artifact as listed for the review page.
+type ArtifactInfo struct {
+	artifacts.Artifact
+	// Kind is how the artifact is rendered, see artifacts.Artifact.Kind.
+	Kind string `json:"kind"`
+	// URL serves the artifact content.
+	URL string `json:"url"`
+}
+
+// Artifacts lists (GET), serves (GET with |name|) or attaches (POST) the artifacts of review
+// |rid|, eg. screenshots or logs of presubmit checks. Listing can be restricted to a |version|.
+// POST stores the request body as artifact |name| of |check| on |version|, with the content type
+// of the request:
+//
+//      curl -X POST -H "Content-Type: image/png" --data-binary @shot.png \
+//          "https://ebert/ebert/artifacts/1234?version=2&check=check_test://foo:tests&name=shot.png"
+func Artifacts(ctx *ebert.Context, r *http.Request, args *struct {
+	rid     int
+	version int
+	check   string
+	name    string
+}) (interface{}, error) {
+	if ctx.Artifacts == nil {
+		return nil, ebert.NewError(errors.New("no artifact store"), "Artifacts are not enabled", http.StatusNotImplemented)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if args.name == "" {
+			return listArtifacts(ctx.Artifacts, args.rid, args.version)
+		}
+		return serveArtifact(ctx.Artifacts, args.rid, args.version, args.check, args.name)
+	case http.MethodPost, http.MethodPut:
+		return attachArtifact(ctx, r, args.rid, args.version, args.check, args.name)
+	default:
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+}
+
+// listArtifacts returns the artifacts of review |rid|, of all versions if |version| is 0.
+func listArtifacts(store artifacts.Store, rid, version int) ([]ArtifactInfo, error) {
+	arts, err := store.List(rid)
+	if err != nil {
+		return nil, fmt.Errorf("could not list artifacts of review %d: %w", rid, err)
+	}
+	infos := []ArtifactInfo{}
+	for _, a := range arts {
+		if version != 0 && a.Version != version {
+			continue
+		}
+		infos = append(infos, ArtifactInfo{
+			Artifact: a,
+			Kind:     a.Kind(),
+			URL:      artifactURL(&a),
+		})
+	}
+	return infos, nil
+}
+
+func serveArtifact(store artifacts.Store, rid, version int, check, name string) (*ebert.Blob, error) {
+	a, data, err := store.Get(rid, version, check, name)
+	if errors.Is(err, artifacts.ErrNotFound) {
+		return nil, ebert.NewError(err, fmt.Sprintf("No artifact %s of %s on version %d", name, check, version), http.StatusNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read artifact %s of review %d: %w", name, rid, err)
+	}
+	return &ebert.Blob{
+		ContentType: a.ServedContentType(),
+		Data:        data,
+		Download:    a.Kind() == "file",
+		Name:        a.Name,
+	}, nil
+}
+
+// attachArtifact stores the body of |r| as an artifact of an existing version of review |rid|.
+func attachArtifact(ctx *ebert.Context, r *http.Request, rid, version int, check, name string) (*ArtifactInfo, error) {
+	review, err := swarm.GetReview(&ctx.Swarm, rid)
+	if err != nil {
+		return nil, fmt.Errorf("could not get review %d: %w", rid, err)
+	}
+	if version <= 0 || version > len(review.Versions) {
+		return nil, ebert.NewError(
+			fmt.Errorf("review %d has %d versions, got %d", rid, len(review.Versions), version),
+			fmt.Sprintf("Invalid version %d of review %d", version, rid),
+			http.StatusBadRequest,
+		)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, artifacts.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read artifact %s: %w", name, err)
+	}
+	a := &artifacts.Artifact{
+		Review:      rid,
+		Version:     version,
+		Check:       check,
+		Name:        name,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	if err := artifacts.Validate(a, data); err != nil {
+		return nil, ebert.NewError(err, err.Error(), http.StatusBadRequest)
+	}
+	if err := ctx.Artifacts.Put(a, data); err != nil {
+		return nil, fmt.Errorf("could not store artifact %s of review %d: %w", name, rid, err)
+	}
+	return &ArtifactInfo{Artifact: *a, Kind: a.Kind(), URL: artifactURL(a)}, nil
+}
+
+// artifactURL returns the URL serving the content of |a|.
+func artifactURL(a *artifacts.Artifact) string {
+	q := url.Values{}
+	q.Set("version", fmt.Sprint(a.Version))
+	q.Set("check", a.Check)
+	q.Set("name", a.Name)
+	return fmt.Sprintf("/ebert/artifacts/%d?%s", a.Review, q.Encode())
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package review
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/libs/go/swarm/swarmp4"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// The description of a review is a copy of the one of its pending change, which is what presubmits
+// and submit triggers check. Edits made on either side are copied to the other one, based on the
+// description both had when they were last in sync, kept in p4 keys by review id.
+
+// descSyncState is the state kept for each review whose description is synced.
+type descSyncState struct {
+	// CL is the pending change the review was synced with.
+	CL int `json:"cl"`
+	// Base is the description the review and the change had when last in sync.
+	Base string `json:"base"`
+}
+
+// DescriptionConflict has the descriptions to merge when the review and its pending change were
+// both edited since they were last in sync.
+type DescriptionConflict struct {
+	Base   string `json:"base"`
+	Review string `json:"review"`
+	Change string `json:"change"`
+}
+
+// DescriptionSync is the outcome of syncing the description of a review with its pending change.
+type DescriptionSync struct {
+	// Action is what the sync did: "none", "to review", "to change" or "conflict", or "merged" when
+	// a conflict was resolved.
+	Action string `json:"action"`
+	// CL is the pending change of the review, 0 if it was submitted.
+	CL int `json:"cl"`
+	// Description is the synced description, empty on conflicts.
+	Description string `json:"description,omitempty"`
+	// Conflict is set when both descriptions were edited. Nothing is updated until it's resolved.
+	Conflict *DescriptionConflict `json:"conflict,omitempty"`
+}
+
+func descSyncStore(ctx *ebert.Context) *p4lib.KeyStore {
+	return p4lib.NewKeyStore(ctx.P4, "ebert-desc-sync")
+}
+
+// Description syncs (POST) the description of review |rid| with the one of its pending change,
+// returning the descriptions to merge if both were edited. POSTing the merged |description| sets it
+// on both, which only the author of the review can do.
+func Description(ctx *ebert.Context, r *http.Request, args *struct {
+	rid         int
+	description string
+}) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	uctx, err := ctx.UserContext(r)
+	if err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	review, err := swarm.GetReview(&uctx.Swarm, args.rid)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get review %d: %w", args.rid, err)
+	}
+	if args.description != "" {
+		if uctx.Swarm.Username != review.Author {
+			return nil, ebert.NewError(
+				fmt.Errorf("%s merging the description of review %d of %s", uctx.Swarm.Username, review.ID, review.Author),
+				"Only the author of the review can merge its description",
+				http.StatusForbidden,
+			)
+		}
+		return resolveDescription(ctx, &uctx.Swarm, review, args.description)
+	}
+	return syncDescription(ctx, &uctx.Swarm, review, false)
+}
+
+// SyncDescription syncs the description of |review| with the one of its pending change, copying
+// whichever was edited since they were last in sync. Submitted reviews aren't synced. When both
+// descriptions were edited, nothing is updated and the result has the conflict to merge.
+//
+// Changes are updated with p4 change -f, as most belong to other users: the p4 user of |ctx| must
+// be an admin.
+func SyncDescription(ctx *ebert.Context, review *swarm.Review) (*DescriptionSync, error) {
+	return syncDescription(ctx, &ctx.Swarm, review, false)
+}
+
+// syncDescription is SyncDescription, with the review updated as the user of |sctx|, and |edited|
+// telling that the review description was just edited in Ebert. The review is then taken as the
+// edited side of a change synced for the first time, which would win otherwise.
+func syncDescription(ctx *ebert.Context, sctx *swarm.Context, review *swarm.Review, edited bool) (*DescriptionSync, error) {
+	cl := pendingChange(review)
+	if cl == 0 {
+		return &DescriptionSync{Action: swarm.SyncNone.String()}, nil
+	}
+	store := descSyncStore(ctx)
+	name := strconv.Itoa(review.ID)
+	var state descSyncState
+	if _, err := store.Get(name, &state); err != nil {
+		return nil, fmt.Errorf("couldn't get description sync of review %d: %w", review.ID, err)
+	}
+	changes := swarmp4.AdminChanges(ctx.P4)
+	base := state.Base
+	if state.CL != cl {
+		// Never synced with this change, eg. the author moved the review to a new one.
+		base = ""
+		if edited {
+			change, err := changes.Change(cl)
+			if err != nil {
+				return nil, err
+			}
+			base = change.Description
+		}
+	}
+	synced, err := swarm.SyncDescription(sctx, changes, review, cl, base)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sync description of review %d: %w", review.ID, err)
+	}
+	result := &DescriptionSync{Action: synced.Action.String(), CL: cl, Description: synced.Description}
+	switch synced.Action {
+	case swarm.SyncConflict:
+		result.Conflict = &DescriptionConflict{Base: base, Review: review.Description, Change: synced.Change}
+		return result, nil
+	case swarm.SyncNone:
+	default:
+		log.Infof("review %d: synced description with change %d (%s)", review.ID, cl, synced.Action)
+	}
+	next := descSyncState{CL: cl, Base: synced.Description}
+	if next != state {
+		if err := store.Set(name, &next); err != nil {
+			return nil, fmt.Errorf("couldn't set description sync of review %d: %w", review.ID, err)
+		}
+	}
+	return result, nil
+}
+
+// resolveDescription sets the merged description |desc| on |review|, as the user of |sctx|, and on
+// its pending change.
+func resolveDescription(ctx *ebert.Context, sctx *swarm.Context, review *swarm.Review, desc string) (*DescriptionSync, error) {
+	cl := pendingChange(review)
+	if cl == 0 {
+		return nil, ebert.NewError(
+			fmt.Errorf("review %d has no pending change", review.ID),
+			"Only the description of pending reviews can be merged",
+			http.StatusBadRequest,
+		)
+	}
+	if _, err := swarm.UpdateDescription(sctx, review.ID, desc); err != nil {
+		return nil, fmt.Errorf("couldn't update description of review %d: %w", review.ID, err)
+	}
+	if err := swarmp4.AdminChanges(ctx.P4).UpdateDescription(cl, desc); err != nil {
+		return nil, err
+	}
+	state := &descSyncState{CL: cl, Base: desc}
+	if err := descSyncStore(ctx).Set(strconv.Itoa(review.ID), state); err != nil {
+		return nil, fmt.Errorf("couldn't set description sync of review %d: %w", review.ID, err)
+	}
+	return &DescriptionSync{Action: "merged", CL: cl, Description: desc}, nil
+}
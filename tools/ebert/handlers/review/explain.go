@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package review
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"sge-monorepo/build/cicd/presubmit/explain"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// Explain returns the graph of the checks run by the last presubmit of review |rid|, from the
+// changed files to the presubmits they matched and the checks those expanded to. It's JSON unless
+// |format| is "dot", which renders it for graphviz:
+//
+//      curl "https://ebert/ebert/explain/1234?format=dot" | dot -Tsvg > checks.svg
+func Explain(ctx *ebert.Context, r *http.Request, args *struct {
+	rid    int
+	format string
+}) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	if args.format != "" && args.format != "json" && args.format != "dot" {
+		return nil, ebert.NewError(fmt.Errorf("unknown format %q", args.format), "Format must be json or dot", http.StatusBadRequest)
+	}
+	run, err := explain.Load(ctx.P4, args.rid)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the presubmit graph of review %d: %w", args.rid, err)
+	}
+	if run == nil {
+		return nil, ebert.NewError(errors.New("no presubmit graph"), "No presubmit ran on this review yet", http.StatusNotFound)
+	}
+	if args.format != "dot" {
+		return run, nil
+	}
+	var sb strings.Builder
+	if err := run.Graph.WriteDot(&sb); err != nil {
+		return nil, err
+	}
+	return &ebert.Blob{
+		ContentType: "text/vnd.graphviz; charset=utf-8",
+		Data:        []byte(sb.String()),
+	}, nil
+}
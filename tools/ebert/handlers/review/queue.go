@@ -0,0 +1,100 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package review
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sge-monorepo/build/cicd/cirunner/queue"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers/tokens"
+)
+
+// QueueProjects gets the projects CI runners share presubmits fairly between, with the number of
+// presubmits they are running. Admins can add or change a project by POSTing its name with any of
+// its comma separated paths, weight and max_running, eg. to give a team more runners at runtime.
+func QueueProjects(ctx *ebert.Context, r *http.Request, args *struct{ name, paths, weight, max_running string }) (interface{}, error) {
+	if ctx.Queue == nil {
+		return nil, ebert.NewError(fmt.Errorf("no queue"), "CI requests are not queued", http.StatusNotImplemented)
+	}
+	scheduler := queue.NewScheduler(ctx.P4)
+	switch r.Method {
+	case http.MethodGet:
+		return scheduler.Status()
+	case http.MethodPost:
+		user, err := ebert.UserFromRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		if !tokens.IsAdmin(user) {
+			return nil, ebert.NewError(
+				fmt.Errorf("%s isn't an admin", user),
+				"Only admins can change queue projects",
+				http.StatusForbidden,
+			)
+		}
+		project, err := updatedProject(scheduler, args.name, args.paths, args.weight, args.max_running)
+		if err != nil {
+			return nil, ebert.NewError(err, err.Error(), http.StatusBadRequest)
+		}
+		if err := scheduler.SetProject(project); err != nil {
+			return nil, ebert.NewError(err, err.Error(), http.StatusBadRequest)
+		}
+		log.Infof("%s set queue project %s: paths %v, weight %g, max running %d", user, project.Name, project.Paths, project.Weight, project.MaxRunning)
+		return project, nil
+	}
+	return nil, fmt.Errorf("unexpected method %s", r.Method)
+}
+
+// updatedProject returns project |name| with the fields that are set changed.
+func updatedProject(scheduler *queue.Scheduler, name, paths, weight, maxRunning string) (*queue.Project, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing project name")
+	}
+	status, err := scheduler.Status()
+	if err != nil {
+		return nil, err
+	}
+	project := &queue.Project{Name: name}
+	for _, st := range status {
+		if st.Name == name {
+			p := st.Project
+			project = &p
+		}
+	}
+	if paths != "" {
+		project.Paths = nil
+		for _, p := range strings.Split(paths, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				project.Paths = append(project.Paths, p)
+			}
+		}
+	}
+	if weight != "" {
+		if project.Weight, err = strconv.ParseFloat(weight, 64); err != nil {
+			return nil, fmt.Errorf("invalid weight %q", weight)
+		}
+	}
+	if maxRunning != "" {
+		if project.MaxRunning, err = strconv.Atoi(maxRunning); err != nil {
+			return nil, fmt.Errorf("invalid max_running %q", maxRunning)
+		}
+	}
+	return project, nil
+}
@@ -16,22 +16,28 @@
 package review
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"sge-monorepo/build/cicd/cirunner/protos/cirunnerpb"
+	"sge-monorepo/build/cicd/presubmit/policy"
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/p4lib"
 	"sge-monorepo/libs/go/swarm"
 	"sge-monorepo/tools/ebert/diff"
 	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/guidelines"
+	"sge-monorepo/tools/ebert/handlers/draft"
+	"sge-monorepo/tools/ebert/linkify"
 )
 
 var clRegex = regexp.MustCompile(`^(?:" )?(\d+)(?: \/")?`)
@@ -65,6 +71,7 @@ func Handle(ctx *ebert.Context, r *http.Request, args *struct{ suffix string })
 	if err != nil {
 		return nil, err
 	}
+	review.formatTimes(ctx, user)
 
 	version := 1
 	cl := id
@@ -89,16 +96,25 @@ func Handle(ctx *ebert.Context, r *http.Request, args *struct{ suffix string })
 	}, nil
 }
 
+// Approve (POST) approves review |rid| as the user.
 func Approve(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
 	uctx, err := ctx.UserContext(r)
 	if err != nil {
 		return nil, fmt.Errorf("login error: %w", err)
 	}
+	return ApproveAs(uctx, args.rid)
+}
 
-	review, err := swarm.SetState(&uctx.Swarm, args.rid, "approved")
+// ApproveAs approves review |rid| as the user of the login context |uctx|, upvoting it if it was
+// already approved.
+func ApproveAs(uctx *ebert.Context, rid int) (*swarm.Review, error) {
+	review, err := swarm.SetState(&uctx.Swarm, rid, "approved")
 	if err != nil {
 		// Check if review is already approved.
-		annotated, _, ferr := fetchReview(ctx, args.rid)
+		annotated, _, ferr := fetchReview(uctx, rid)
 		if ferr != nil || annotated.State != "approved" {
 			// Failed to get review or review wasn't approved, so return
 			// the original error.
@@ -108,7 +124,7 @@ func Approve(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (inte
 		// Ensure this user has upvoted the review.
 		participant, ok := annotated.Participants[uctx.Swarm.Username]
 		if !ok || participant.Vote.Value <= 0 || participant.Vote.IsStale {
-			err = swarm.SetVote(&uctx.Swarm, args.rid, "up")
+			err = swarm.SetVote(&uctx.Swarm, rid, "up")
 		}
 	}
 	return review, err
@@ -144,7 +160,15 @@ func Diff(ctx *ebert.Context, r *http.Request, args *struct {
 		return fmt.Sprintf("=nothing to diff for %s/%s - %s", from, to, action), nil
 	}
 
-	details, err := ctx.P4.PrintEx(revs...)
+	if strings.Contains(fileType, "binary") {
+		diff, err := binaryDiff(ctx, revs, strings.Contains(action, "delete"))
+		if err != nil {
+			return fmt.Sprintf("=diff failed: %v", err), err
+		}
+		return map[string]interface{}{"response": diff}, nil
+	}
+	// Text in legacy encodings, eg. Shift-JIS localization files, is diffed as UTF-8.
+	details, err := ctx.P4.PrintText(p4lib.PrintOptions{}, revs...)
 	if err != nil {
 		return fmt.Sprintf("=diff failed: %v", err), err
 	}
@@ -166,13 +190,7 @@ func Diff(ctx *ebert.Context, r *http.Request, args *struct {
 		fromContent, toContent = toContent, fromContent
 	}
 
-	var diff interface{}
-	if strings.Contains(fileType, "binary") {
-		diff, err = binaryDiff(ctx, fromContent, toContent)
-	} else {
-		diff, err = textDiff(ctx, fromContent, toContent)
-	}
-
+	diff, err := textDiff(ctx, fromContent, toContent)
 	if err != nil {
 		return nil, ebert.NewError(
 			fmt.Errorf("failed to build diffs from '%s' to '%s': %w", from, to, err),
@@ -191,21 +209,211 @@ func Pairs(ctx *ebert.Context, r *http.Request, args *struct {
 	return getFilePairs(ctx, args.base, args.curr, args.currPending, true)
 }
 
+// TestRuns gets (GET) or starts (POST) the test runs of a version of a review. POST takes an
+// optional |only| argument, the comma separated checks to restrict the presubmit to.
 func TestRuns(ctx *ebert.Context, r *http.Request, args *struct {
 	rid     int
 	version int
+	only    string
 }) (interface{}, error) {
 	switch r.Method {
 	case http.MethodGet:
 		return swarm.TestRunDetails(&ctx.Swarm, args.rid, args.version)
 	case http.MethodPost:
-		return runTests(ctx, args.rid, args.version)
+		return runTests(ctx, args.rid, args.version, splitOnly(args.only))
 	default:
 		return nil, fmt.Errorf("unexpected method %s", r.Method)
 	}
 }
 
-func runTests(ctx *ebert.Context, rid, version int) (interface{}, error) {
+// QueueDepth gets the number of CI requests waiting in every lane of the queue, eg.
+// {"presubmit": 3, "postsubmit": 1}.
+func QueueDepth(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+	if ctx.Queue == nil {
+		return nil, ebert.NewError(errors.New("no queue"), "CI requests are not queued", http.StatusNotImplemented)
+	}
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	return ctx.Queue.Depth()
+}
+
+// SwarmHealth probes Swarm and gets its health along with the state of the circuit breaker of
+// Ebert, for the UI to tell whether Swarm is degraded.
+func SwarmHealth(ctx *ebert.Context, r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	return swarm.Health(&ctx.Swarm), nil
+}
+
+// Risk gets the risky conditions of the files of the pending change of a review, eg. files locked
+// or opened in other workspaces, for the review page banner. Submitted reviews have no risks.
+func Risk(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	review, _, err := fetchReview(ctx, args.rid)
+	if err != nil {
+		return nil, err
+	}
+	cl := pendingChange(review.Review)
+	if cl == 0 {
+		return &p4lib.ChangeRisk{}, nil
+	}
+	return ctx.P4.ChangeRisk(cl)
+}
+
+// Policy evaluates the submit policy against review |rid|, eg.
+//
+//      {"enabled": true, "violations": [{"rule": "two-approvals", "message": "..."}]}
+//
+// The review page lists the violations.
+func Policy(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	result := map[string]interface{}{
+		"enabled":    ctx.Policy != nil,
+		"violations": []policy.Violation{},
+	}
+	if ctx.Policy == nil {
+		return result, nil
+	}
+	review, _, err := fetchReview(ctx, args.rid)
+	if err != nil {
+		return nil, err
+	}
+	change, err := latestChange(ctx, review.Review)
+	if err != nil {
+		return nil, err
+	}
+	violations, err := EvaluatePolicy(ctx, change, review.Review)
+	if err != nil {
+		return nil, err
+	}
+	if violations != nil {
+		result["violations"] = violations
+	}
+	return result, nil
+}
+
+// EvaluatePolicy evaluates the submit policy against |change| and its |review|, nil if it has
+// none. The policy sees the presubmit as passed or failed from the test status of the review,
+// without the names of the checks. Returns no violations when Ebert has no submit policy.
+func EvaluatePolicy(ctx *ebert.Context, change *p4lib.Description, review *swarm.Review) ([]policy.Violation, error) {
+	if ctx.Policy == nil {
+		return nil, nil
+	}
+	p, err := ctx.Policy.Policy()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load submit policy: %w", err)
+	}
+	in := &policy.Input{Change: change, Review: review, Now: time.Now()}
+	if review != nil {
+		switch review.TestStatus {
+		case "pass":
+			in.Presubmit = &policy.Presubmit{Success: true}
+		case "fail":
+			in.Presubmit = &policy.Presubmit{Success: false}
+		}
+	}
+	return p.Evaluate(in), nil
+}
+
+// latestChange describes the change of the latest version of |review|, with its shelved files if
+// it's pending. Returns nil for reviews without versions.
+func latestChange(ctx *ebert.Context, review *swarm.Review) (*p4lib.Description, error) {
+	if len(review.Versions) == 0 {
+		return nil, nil
+	}
+	cl := review.Versions[len(review.Versions)-1].Change
+	var descs []p4lib.Description
+	var err error
+	if cl == pendingChange(review) {
+		descs, err = ctx.P4.DescribeShelved(cl)
+	} else {
+		descs, err = ctx.P4.Describe([]int{cl})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe change %d: %w", cl, err)
+	}
+	if len(descs) == 0 {
+		return nil, nil
+	}
+	return &descs[0], nil
+}
+
+// reviewGuidelines returns the review guidelines of the files of the latest version of |review|.
+func reviewGuidelines(ctx *ebert.Context, review *swarm.Review) ([]guidelines.Guideline, error) {
+	if ctx.Guidelines == nil {
+		return nil, nil
+	}
+	change, err := latestChange(ctx, review)
+	if err != nil || change == nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range change.Files {
+		files = append(files, f.DepotPath)
+	}
+	return ctx.Guidelines.Find(files)
+}
+
+// pendingChange returns the pending change of the author of |review|, 0 if it was submitted.
+func pendingChange(review *swarm.Review) int {
+	if !review.Pending {
+		return 0
+	}
+	committed := map[int]bool{}
+	for _, c := range review.Commits {
+		committed[c] = true
+	}
+	for i := len(review.Changes) - 1; i >= 0; i-- {
+		if !committed[review.Changes[i]] {
+			return review.Changes[i]
+		}
+	}
+	return 0
+}
+
+// presubmitCommandRE matches a comment line requesting a presubmit run, eg.
+// "/presubmit --only=format,check_test://foo:tests".
+var presubmitCommandRE = regexp.MustCompile(`^/presubmit(?:\s+(?:--?only=)?(\S+))?\s*$`)
+
+// PresubmitCommand returns whether a comment |body| requests a presubmit run, and the checks the
+// run is restricted to, if any. The request must be on a line of its own:
+//
+//      /presubmit
+//      /presubmit --only=format,check_test://foo:tests
+func PresubmitCommand(body string) ([]string, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		if m := presubmitCommandRE.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			return splitOnly(m[1]), true
+		}
+	}
+	return nil, false
+}
+
+// splitOnly splits a comma separated list of check selectors.
+func splitOnly(only string) []string {
+	var selectors []string
+	for _, s := range strings.Split(only, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			selectors = append(selectors, s)
+		}
+	}
+	return selectors
+}
+
+// RunPresubmit starts a presubmit run of the latest version of review |rid|, restricted to the
+// |only| checks if not empty.
+func RunPresubmit(ctx *ebert.Context, rid int, only []string) (interface{}, error) {
+	return runTests(ctx, rid, 0, only)
+}
+
+// runTests starts a presubmit run of |version| of review |rid|, or of its latest version if 0.
+func runTests(ctx *ebert.Context, rid, version int, only []string) (interface{}, error) {
 	if ctx.Jenkins == nil {
 		return nil, fmt.Errorf("can't connect to Jenkins")
 	}
@@ -216,6 +424,9 @@ func runTests(ctx *ebert.Context, rid, version int) (interface{}, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't fetch review %d: %w", rid, err)
 	}
+	if version == 0 {
+		version = len(review.Versions)
+	}
 	if version <= 0 || version > len(review.Versions) {
 		return nil, fmt.Errorf("can't run tests for invalid version %d of review %d", version, rid)
 	}
@@ -244,6 +455,7 @@ func runTests(ctx *ebert.Context, rid, version int) (interface{}, error) {
 		Review:    int64(rid),
 		Change:    int64(change),
 		UpdateUrl: swarmURL,
+		Only:      only,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("error triggering CI/CD: %w", err)
@@ -257,7 +469,16 @@ func HandleRest(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (i
 
 	if r.Method == http.MethodGet {
 		review, _, err := fetchReview(ctx, rid)
-		return review, err
+		if err != nil {
+			return nil, err
+		}
+		if user, err := ebert.UserFromRequest(r); err == nil {
+			review.formatTimes(ctx, user)
+		}
+		if review.Guidelines, err = reviewGuidelines(ctx, review.Review); err != nil {
+			log.Warningf("couldn't find review guidelines of review %d: %v", rid, err)
+		}
+		return review, nil
 	}
 
 	if r.Method != http.MethodPatch {
@@ -297,6 +518,12 @@ func HandleRest(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (i
 		if review, err = fakeReview(ctx, rid); err != nil {
 			return nil, err
 		}
+	} else if patch.Description != nil {
+		// Keep the pending change in sync, its description is the one checked at submit.
+		review.DescriptionSync, err = syncDescription(ctx, &uctx.Swarm, review.Review, true)
+		if err != nil {
+			log.Warningf("couldn't sync description of review %d: %v", rid, err)
+		}
 	}
 
 	bugErr := <-bugChan
@@ -316,6 +543,28 @@ type Review struct {
 	Bugs  []int  `json:"bugs"`
 	Fixes []int  `json:"fixes"`
 	Fake  bool   `json:"fake"`
+	// Draft is set when the author marked the review as draft.
+	Draft *draft.Draft `json:"draft,omitempty"`
+	// Links are the references to external systems in the description.
+	Links []linkify.Link `json:"links,omitempty"`
+	// DescriptionSync is set when the description was edited, with the conflict to merge if the
+	// description of the pending change was edited too.
+	DescriptionSync *DescriptionSync `json:"descriptionSync,omitempty"`
+	// Guidelines are the review guidelines closest to the files of the review.
+	Guidelines []guidelines.Guideline `json:"guidelines,omitempty"`
+
+	CreatedTime ebert.Timestamp `json:"createdTime"`
+	UpdatedTime ebert.Timestamp `json:"updatedTime"`
+}
+
+// formatTimes formats the times of the review for |user|. The server formatted UpdatedDate of Swarm
+// is replaced with an ISO8601 one.
+func (r *Review) formatTimes(ctx *ebert.Context, user string) {
+	loc := ctx.UserLocation(user)
+	now := time.Now()
+	r.CreatedTime = ebert.NewTimestamp(int64(r.Created), loc, now)
+	r.UpdatedTime = ebert.NewTimestamp(int64(r.Updated), loc, now)
+	r.UpdatedDate = r.UpdatedTime.ISO
 }
 
 // Users returns a list of all p4 users.
@@ -340,9 +589,9 @@ func (f fileRev) String() string {
 		return ""
 	}
 	if f.cl != 0 {
-		return fmt.Sprintf("%s@=%d", f.name, f.cl)
+		return p4lib.AtShelvedChange(f.cl).Of(f.name)
 	}
-	return fmt.Sprintf("%s#%d", f.name, f.rev)
+	return p4lib.AtRev(f.rev).Of(f.name)
 }
 func (f fileRev) MarshalJSON() ([]byte, error) {
 	json := fmt.Sprintf("\"%v\"", f)
@@ -370,14 +619,23 @@ func getFilePairs(ctx *ebert.Context, baseCl, currCl int, currPending, shelved b
 	if baseCl != 0 {
 		cls = append(cls, baseCl)
 	}
-	descs, err := func(cls []int, shelved bool) ([]p4lib.Description, error) {
-		if shelved {
-			return ctx.P4.DescribeShelved(cls...)
+	var descs []p4lib.Description
+	if shelved {
+		var errs map[int]error
+		descs, errs = ctx.P4.DescribeShelvedPartial(cls...)
+		if err := errs[currCl]; err != nil {
+			return nil, fmt.Errorf("failed to retrieve cl data: %v", err)
+		}
+		if err := errs[baseCl]; err != nil {
+			// The shelf of an older version may have been deleted, diff against the depot instead.
+			log.Warningf("couldn't describe base %d of %d, diffing against the depot: %v", baseCl, currCl, err)
+			baseCl, cls = 0, cls[:1]
+		}
+	} else {
+		var err error
+		if descs, err = ctx.P4.Describe(cls); err != nil {
+			return nil, fmt.Errorf("failed to retrieve cl data: %v", err)
 		}
-		return ctx.P4.Describe(cls)
-	}(cls, shelved)
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve cl data: %v", err)
 	}
 	if len(descs) != len(cls) {
 		return nil, fmt.Errorf("expected %d descs from %v, got %d", len(cls), cls, len(descs))
@@ -385,6 +643,10 @@ func getFilePairs(ctx *ebert.Context, baseCl, currCl int, currPending, shelved b
 	files := make(map[string]*FilePair)
 
 	currDesc := &descs[0]
+	moves, err := movedFrom(ctx, currCl, currDesc)
+	if err != nil {
+		log.Warningf("couldn't pair moves of %d: %v", currCl, err)
+	}
 	// Set up filepairs based on curr CL.
 	for _, fa := range currDesc.Files {
 		rev := fa.Revision
@@ -397,8 +659,10 @@ func getFilePairs(ctx *ebert.Context, baseCl, currCl int, currPending, shelved b
 			rev = rev - 1
 		}
 		fromRev := fileRev{}
-		if fa.FromFile != "" {
-			// This is a move/add, so our diff base is FromFile#FromRev.
+		if from, ok := moves[fa.DepotPath]; ok {
+			// This is a move/add, so our diff base is the moved file.
+			fromRev = from
+		} else if fa.FromFile != "" {
 			fromRev = fileRev{name: fa.FromFile, rev: fa.FromRev}
 		} else if fa.Action != "add" {
 			// For any other action that isn't "add", assume the diff base
@@ -520,6 +784,32 @@ func getFilePairs(ctx *ebert.Context, baseCl, currCl int, currPending, shelved b
 	return files, nil
 }
 
+// movedFrom returns the files moved by |cl|, described by |desc|, by the depot path they were moved
+// to.
+func movedFrom(ctx *ebert.Context, cl int, desc *p4lib.Description) (map[string]fileRev, error) {
+	hasMoves := false
+	for _, fa := range desc.Files {
+		if fa.Action == "move/add" {
+			hasMoves = true
+			break
+		}
+	}
+	if !hasMoves {
+		return nil, nil
+	}
+	moves, err := ctx.P4.DescribeWithMoves(cl)
+	if err != nil {
+		return nil, err
+	}
+	from := map[string]fileRev{}
+	for _, fa := range moves.Actions {
+		if fa.MovedFrom != "" {
+			from[fa.DepotPath] = fileRev{name: fa.MovedFrom, rev: fa.MovedFromRev}
+		}
+	}
+	return from, nil
+}
+
 func textDiff(ctx *ebert.Context, from, to []byte) (string, error) {
 	diff, err := diff.Compute(from, to)
 	if err != nil {
@@ -540,53 +830,91 @@ func textDiff(ctx *ebert.Context, from, to []byte) (string, error) {
 	return diff, nil
 }
 
-func binaryDiff(ctx *ebert.Context, from, to []byte) (interface{}, error) {
-	fromType := http.DetectContentType(from)
-	toType := http.DetectContentType(to)
-	if (len(from) > 0 && !strings.HasPrefix(fromType, "image")) || (len(to) > 0 && !strings.HasPrefix(toType, "image")) {
-		if bytes.Compare(from, to) == 0 {
-			return "=Binary files are identical.", nil
-		}
+// binaryDiff diffs the binary revisions |revs|, ordered as in Diff. They are printed to a temporary
+// content store rather than to memory: identical files are told apart by their digests, and only
+// images, which the UI shows side by side, are read back.
+func binaryDiff(ctx *ebert.Context, revs []string, deleted bool) (interface{}, error) {
+	dir, err := ioutil.TempDir("", "ebert-diff")
+	if err != nil {
+		return nil, err
+	}
+	store, err := p4lib.NewContentStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.RemoveAll()
+	details, err := ctx.P4.PrintToStore(store, revs...)
+	if err != nil {
+		return nil, err
+	}
+	if len(details) != len(revs) {
+		return nil, fmt.Errorf("expected %d files, got %d", len(revs), len(details))
+	}
+	to := &details[0]
+	var from *p4lib.FileDetails
+	if len(details) > 1 {
+		from = &details[1]
+	}
+	if deleted {
+		// See Diff: deletes only print the 'from' revision.
+		from, to = to, from
+	}
+	fromType, err := detectContentType(store, from)
+	if err != nil {
+		return nil, err
+	}
+	toType, err := detectContentType(store, to)
+	if err != nil {
+		return nil, err
+	}
+	if (fromType != "" && !strings.HasPrefix(fromType, "image")) || (toType != "" && !strings.HasPrefix(toType, "image")) {
 		switch {
+		case from != nil && to != nil && from.ContentDigest == to.ContentDigest:
+			return "=Binary files are identical.", nil
 		case from == nil:
-			return fmt.Sprintf("+<binary file (%d bytes)>", len(to)), nil
+			return fmt.Sprintf("+<binary file (%d bytes)>", to.FileSize), nil
 		case to == nil:
-			return fmt.Sprintf("-<binary file (%d bytes)>", len(from)), nil
+			return fmt.Sprintf("-<binary file (%d bytes)>", from.FileSize), nil
 		default:
-			return fmt.Sprintf("-Binary files differ (%d bytes).\n+Binary files differ (%d bytes).", len(from), len(to)), nil
+			return fmt.Sprintf("-Binary files differ (%d bytes).\n+Binary files differ (%d bytes).", from.FileSize, to.FileSize), nil
 		}
 	}
 	response := map[string]string{}
-	if len(from) > 0 {
-		response["from"] = fmt.Sprintf("data:%s;base64,%s", fromType, base64.StdEncoding.EncodeToString(from))
-	}
-	if len(to) > 0 {
-		response["to"] = fmt.Sprintf("data:%s;base64,%s", toType, base64.StdEncoding.EncodeToString(to))
+	for key, d := range map[string]*p4lib.FileDetails{"from": from, "to": to} {
+		if d == nil || d.FileSize == 0 {
+			continue
+		}
+		content, err := p4lib.ReadContent(store, d)
+		if err != nil {
+			return nil, err
+		}
+		contentType := fromType
+		if key == "to" {
+			contentType = toType
+		}
+		response[key] = fmt.Sprintf("data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(content))
 	}
 	return response, nil
 }
 
-var (
-	bugRE       = regexp.MustCompile(`^(BUG=|FIX=)`)
-	bugurlRE = regexp.MustCompile(`(?:https://)?(?:b/)?(\d+)`)
-)
-
-func parseBugs(line string) ([]int, error) {
-	var ids []int
-	for _, item := range strings.Split(line, ",") {
-		item := strings.TrimSpace(item)
-		matches := bugurlRE.FindStringSubmatch(item)
-		if len(matches) == 2 && matches[1] != "" {
-			id, err := strconv.Atoi(matches[1])
-			if err != nil {
-				return nil, err
-			}
-			ids = append(ids, id)
-		} else {
-			return nil, fmt.Errorf("missing bug id in %s", item)
-		}
+// detectContentType returns the content type of |d|, printed to |store|, from its first bytes.
+// Missing and empty files have no type.
+func detectContentType(store *p4lib.ContentStore, d *p4lib.FileDetails) (string, error) {
+	if d == nil || d.FileSize == 0 {
+		return "", nil
 	}
-	return ids, nil
+	r, err := store.Open(d.ContentDigest)
+	if err != nil {
+		return "", fmt.Errorf("could not read content of %s#%d: %v", d.DepotFile, d.Rev, err)
+	}
+	defer r.Close()
+	// DetectContentType considers at most 512 bytes.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("could not read content of %s#%d: %v", d.DepotFile, d.Rev, err)
+	}
+	return http.DetectContentType(head[:n]), nil
 }
 
 // AnnotateReview converts a raw Swarm Review to an Ebert Review.
@@ -605,7 +933,11 @@ func annotateReview(ctx *ebert.Context, review *Review) error {
 	}
 	review.Bugs = bugs
 	review.Fixes = fixes
+	review.Links = ctx.Links.Linkifier().Links(review.Description)
 
+	if review.Draft, err = draft.Get(ctx, review.ID); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -616,68 +948,30 @@ type aux struct {
 	Fixes []int
 }
 
-func reviewAux(ctx *ebert.Context, key string) (*aux, string, error) {
-	raw, err := ctx.P4.KeyGet(key)
-	var a aux
-	// "0" indicates not found.
-	if err != nil || raw == "0" {
-		return &a, "", err
-	}
-	if err = json.Unmarshal([]byte(raw), &a); err != nil {
-		return &a, raw, fmt.Errorf("unmarshal(%s) error: %w", raw, err)
-	}
-	return &a, raw, err
+// auxStore returns the store of auxiliary review information.
+func auxStore(ctx *ebert.Context) *p4lib.KeyStore {
+	return p4lib.NewKeyStore(ctx.P4, "ebert-review-aux")
 }
 
 func bugsFromAux(ctx *ebert.Context, rid int, description string) ([]int, []int, error) {
-	a, _, err := reviewAux(ctx, auxKeyForReview(rid))
-	if err != nil {
+	var a aux
+	if _, err := auxStore(ctx).Get(auxNameForReview(rid), &a); err != nil {
 		return nil, nil, err
 	}
 
 	bugs, fixes := bugsFromDescription(description)
 	bugs = mergeIds(bugs, a.Bugs)
 	fixes = mergeIds(fixes, a.Fixes)
-	return bugs, fixes, err
+	return bugs, fixes, nil
 }
 
 func updateBugs(ctx *ebert.Context, rid int, bugs, fixes []int) error {
-	key := auxKeyForReview(rid)
-	// Update auxiliary info transactionally, retrying up to 3 times.
-	for i := 0; i < 3; i++ {
-		a, orig, err := reviewAux(ctx, key)
-		// Unfortunately there's no way to distinguish "0" from not found.
-		unset := orig == ""
-		if err != nil && !unset {
-			return err
-		}
-
+	var a aux
+	return auxStore(ctx).Update(auxNameForReview(rid), &a, func() error {
 		a.Bugs = bugs
 		a.Fixes = fixes
-
-		updated, err := json.Marshal(&a)
-		if err != nil {
-			return err
-		}
-
-		if unset {
-			// KeyCas doesn't work unless the key already had a value, so just
-			// use KeySet.  This does introduce a race condition on the first
-			// write to a key.
-			return ctx.P4.KeySet(key, string(updated))
-		}
-		err = ctx.P4.KeyCas(key, orig, string(updated))
-		if err == p4lib.ErrCasMismatch {
-			select {
-			case <-ctx.Ctx.Done():
-				return fmt.Errorf("update bugs context done")
-			default:
-			}
-			continue
-		}
-		return err
-	}
-	return fmt.Errorf("update bugs too many retries")
+		return nil
+	})
 }
 
 func mergeIds(fromDesc, fromKeys []int) []int {
@@ -694,8 +988,10 @@ next:
 	return merged
 }
 
-func auxKeyForReview(id int) string {
-	return fmt.Sprintf("ebert-review-aux-%x", 0xffffffff-id)
+// auxNameForReview returns the name of the auxiliary information of review |id|. Names sort from
+// the newest review to the oldest.
+func auxNameForReview(id int) string {
+	return fmt.Sprintf("%x", 0xffffffff-id)
 }
 
 func fetchReview(ctx *ebert.Context, id int) (*Review, bool, error) {
@@ -749,26 +1045,16 @@ func rawReview(ctx *ebert.Context, id int) (*Review, error) {
 }
 
 func bugsFromDescription(description string) ([]int, []int) {
-	// Extract bug info from description.
-	lines := strings.Split(description, "\n")
-	var bugs, fixes []int
-	for _, line := range lines {
-		if match := bugRE.FindString(line); match != "" {
-			ids, err := parseBugs(line[len(match):])
-			if err != nil {
-				// Don't fail the function if we can't parse bugs.
-				log.Warningf("error parsing bug ids: %v", err)
-			}
-			if match == "BUG=" {
-				bugs = append(bugs, ids...)
-			}
-			if match == "FIX=" {
-				fixes = append(fixes, ids...)
-			}
-			continue
-		}
+	td := p4lib.ParseTaggedDescription(description)
+	bugs, err := td.Bugs(p4lib.TagBug)
+	if err != nil {
+		// Don't fail the function if we can't parse bugs.
+		log.Warningf("error parsing bug ids: %v", err)
+	}
+	fixes, err := td.Bugs(p4lib.TagFix)
+	if err != nil {
+		log.Warningf("error parsing bug ids: %v", err)
 	}
-
 	return bugs, fixes
 }
 
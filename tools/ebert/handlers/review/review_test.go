@@ -15,11 +15,23 @@
 package review
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
+	"sge-monorepo/build/cicd/presubmit/explain"
 	"sge-monorepo/libs/go/p4lib"
 	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/libs/go/swarm/swarmfake"
+	"sge-monorepo/tools/ebert/artifacts"
 	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/guidelines"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -180,16 +192,95 @@ func TestGetFilePairs(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:        "deleted-base-shelf",
+			baseCl:      1,
+			currCl:      2,
+			currPending: true,
+			descriptions: map[int]p4lib.Description{
+				2: p4lib.Description{
+					Files: []p4lib.FileAction{
+						p4lib.FileAction{
+							DepotPath: "//a/b",
+							Revision:  2,
+							Action:    "edit",
+							Type:      "text",
+							Digest:    "b2",
+						},
+					},
+				},
+			},
+			want: map[string]*FilePair{
+				"//a/b": &FilePair{
+					From:     fileRev{name: "//a/b", rev: 2},
+					To:       fileRev{name: "//a/b", cl: 2},
+					Action:   "edit",
+					FileType: "text",
+				},
+			},
+		},
+		{
+			name:        "pending-move",
+			baseCl:      0,
+			currCl:      2,
+			currPending: true,
+			descriptions: map[int]p4lib.Description{
+				2: p4lib.Description{
+					Files: []p4lib.FileAction{
+						p4lib.FileAction{
+							DepotPath: "//a/old",
+							Revision:  3,
+							Action:    "move/delete",
+							Type:      "text",
+						},
+						p4lib.FileAction{
+							DepotPath: "//a/new",
+							Revision:  1,
+							Action:    "move/add",
+							Type:      "text",
+						},
+					},
+				},
+			},
+			want: map[string]*FilePair{
+				"//a/old": &FilePair{
+					From:     fileRev{name: "//a/old", rev: 3},
+					To:       fileRev{name: "//a/new", cl: 2},
+					Action:   "move/delete",
+					FileType: "text",
+				},
+				"//a/new": &FilePair{
+					From:     fileRev{name: "//a/old", rev: 3},
+					To:       fileRev{name: "//a/new", cl: 2},
+					Action:   "move/add",
+					FileType: "text",
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
 		p4 := p4mock.New()
-		p4.DescribeShelvedFunc = func(cls ...int) ([]p4lib.Description, error) {
-			descs := make([]p4lib.Description, 0, len(cls))
-			for _, cl := range cls {
-				descs = append(descs, test.descriptions[cl])
-			}
-			return descs, nil
+		p4.DescribeShelvedPartialFunc = func(cls ...int) ([]p4lib.Description, map[int]error) {
+			return p4lib.DescribePartial(cls, func(cls ...int) ([]p4lib.Description, error) {
+				descs := make([]p4lib.Description, 0, len(cls))
+				for _, cl := range cls {
+					desc, ok := test.descriptions[cl]
+					if !ok {
+						return descs, fmt.Errorf("%d - no such changelist", cl)
+					}
+					desc.Cl = cl
+					descs = append(descs, desc)
+				}
+				return descs, nil
+			})
+		}
+		p4.DescribeWithMovesFunc = func(cl int) (*p4lib.MovesDescription, error) {
+			desc := test.descriptions[cl]
+			return &p4lib.MovesDescription{
+				Description: desc,
+				Actions:     p4lib.PairMoves(desc.Files, nil, !test.currPending),
+			}, nil
 		}
 		ctx := &ebert.Context{P4: p4}
 
@@ -262,3 +353,340 @@ func TestExtractBugsFromDescription(t *testing.T) {
 		}
 	}
 }
+
+func TestPresubmitCommand(t *testing.T) {
+	tests := []struct {
+		body   string
+		want   []string
+		wantOk bool
+	}{
+		{body: "/presubmit", wantOk: true},
+		{body: "LGTM, but let's rerun.\n  /presubmit  \n", wantOk: true},
+		{body: "/presubmit --only=format,check_test://foo:tests", want: []string{"format", "check_test://foo:tests"}, wantOk: true},
+		{body: "/presubmit -only=format", want: []string{"format"}, wantOk: true},
+		{body: "/presubmit format,,lint", want: []string{"format", "lint"}, wantOk: true},
+		{body: "please run /presubmit", wantOk: false},
+		{body: "/presubmits", wantOk: false},
+	}
+	for _, test := range tests {
+		got, ok := PresubmitCommand(test.body)
+		if ok != test.wantOk {
+			t.Errorf("PresubmitCommand(%q) ok = %t, want %t", test.body, ok, test.wantOk)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("PresubmitCommand(%q) diff (-want +got):\n%s", test.body, diff)
+		}
+	}
+}
+
+func TestPendingChange(t *testing.T) {
+	tests := []struct {
+		review swarm.Review
+		want   int
+	}{
+		{swarm.Review{Pending: true, Changes: []int{10, 12}}, 12},
+		{swarm.Review{Pending: true, Changes: []int{10, 12}, Commits: []int{12}}, 10},
+		{swarm.Review{Pending: false, Changes: []int{10}, Commits: []int{10}}, 0},
+	}
+	for _, tc := range tests {
+		if got := pendingChange(&tc.review); got != tc.want {
+			t.Errorf("pendingChange(%+v) = %d, want %d", tc.review, got, tc.want)
+		}
+	}
+}
+
+func TestSyncDescription(t *testing.T) {
+	server := swarmfake.New()
+	defer server.Close()
+	server.AddReview(swarm.Review{ID: 1, Author: "alice", Pending: true, Changes: []int{10}, Description: "original"})
+	keys := map[string]string{}
+	changeDesc := "original\n"
+	ctx := &ebert.Context{
+		Swarm: *server.Context(),
+		P4: p4mock.Mock{
+			KeyGetFunc: func(key string) (string, error) {
+				if v, ok := keys[key]; ok {
+					return v, nil
+				}
+				return "0", p4lib.ErrKeyNotFound
+			},
+			KeySetFunc: func(key, val string) error {
+				keys[key] = val
+				return nil
+			},
+			DescribeFunc: func(cls []int) ([]p4lib.Description, error) {
+				return []p4lib.Description{{Cl: cls[0], Description: changeDesc}}, nil
+			},
+			// Reviews of other users are synced too, changes are updated as an admin.
+			ChangeUpdateForceFunc: func(desc string, cl int) error {
+				changeDesc = desc
+				return nil
+			},
+		},
+	}
+	sync := func(edited bool) *DescriptionSync {
+		t.Helper()
+		r, _ := server.Review(1)
+		result, err := syncDescription(ctx, &ctx.Swarm, &r, edited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// The review description is edited in Ebert before the first sync.
+	if _, err := swarm.UpdateDescription(&ctx.Swarm, 1, "edited in ebert"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sync(true); got.Action != "to change" || changeDesc != "edited in ebert" {
+		t.Errorf("sync of review edit = %+v, change description %q", got, changeDesc)
+	}
+	// The change description is edited with p4 change.
+	changeDesc = "edited in p4"
+	if got := sync(false); got.Action != "to review" {
+		t.Errorf("sync of change edit = %+v, want to review", got)
+	}
+	if r, _ := server.Review(1); r.Description != "edited in p4" {
+		t.Errorf("got review description %q, want edited in p4", r.Description)
+	}
+	// Both are edited.
+	changeDesc = "p4 again"
+	if _, err := swarm.UpdateDescription(&ctx.Swarm, 1, "ebert again"); err != nil {
+		t.Fatal(err)
+	}
+	want := &DescriptionSync{
+		Action:   "conflict",
+		CL:       10,
+		Conflict: &DescriptionConflict{Base: "edited in p4", Review: "ebert again", Change: "p4 again"},
+	}
+	if diff := cmp.Diff(want, sync(true)); diff != "" {
+		t.Errorf("sync of conflicting edits diff (-want +got):\n%s", diff)
+	}
+	r, _ := server.Review(1)
+	if _, err := resolveDescription(ctx, &ctx.Swarm, &r, "merged"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sync(false); got.Action != "none" || changeDesc != "merged" {
+		t.Errorf("sync after merge = %+v, change description %q", got, changeDesc)
+	}
+
+	// Only the author of the review merges its description.
+	user, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Swarm.Username = user
+	req := httptest.NewRequest(http.MethodPost, "/ebert/description/1", nil)
+	args := &struct {
+		rid         int
+		description string
+	}{rid: 1, description: "not mine"}
+	if _, err := Description(ctx, req, args); err == nil || changeDesc != "merged" {
+		t.Errorf("Description() merged by %s, not the author: got %v and change description %q, want error", user, err, changeDesc)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	root, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := artifacts.NewDirStore(root)
+	for _, a := range []artifacts.Artifact{
+		{Review: 5, Version: 1, Check: "format", Name: "format.txt"},
+		{Review: 5, Version: 2, Check: "check_test://foo:tests", Name: "report.html"},
+		{Review: 5, Version: 2, Check: "check_test://foo:tests", Name: "dump.pdf"},
+	} {
+		if err := store.Put(&a, []byte("<html>content</html>")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos, err := listArtifacts(store, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Kind+" "+info.URL)
+	}
+	want := []string{
+		"file /ebert/artifacts/5?check=check_test%3A%2F%2Ffoo%3Atests&name=dump.pdf&version=2",
+		"log /ebert/artifacts/5?check=check_test%3A%2F%2Ffoo%3Atests&name=report.html&version=2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("listArtifacts() diff (-want +got):\n%s", diff)
+	}
+
+	blob, err := serveArtifact(store, 5, 2, "check_test://foo:tests", "report.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBlob := &ebert.Blob{
+		ContentType: "text/plain; charset=utf-8",
+		Data:        []byte("<html>content</html>"),
+		Name:        "report.html",
+	}
+	if diff := cmp.Diff(wantBlob, blob); diff != "" {
+		t.Errorf("serveArtifact() diff (-want +got):\n%s", diff)
+	}
+	var e *ebert.Error
+	if _, err := serveArtifact(store, 5, 1, "format", "missing.txt"); !errors.As(err, &e) || e.Code != http.StatusNotFound {
+		t.Errorf("serveArtifact(missing) error = %v, want not found", err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	keys := map[string]string{}
+	ctx := &ebert.Context{
+		P4: p4mock.Mock{
+			KeyGetFunc: func(key string) (string, error) {
+				if v, ok := keys[key]; ok {
+					return v, nil
+				}
+				return "0", p4lib.ErrKeyNotFound
+			},
+			KeySetFunc: func(key, val string) error {
+				keys[key] = val
+				return nil
+			},
+		},
+	}
+	get := func(format string) (interface{}, error) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/ebert/explain/7", nil)
+		return Explain(ctx, r, &struct {
+			rid    int
+			format string
+		}{7, format})
+	}
+	var e *ebert.Error
+	if _, err := get(""); !errors.As(err, &e) || e.Code != http.StatusNotFound {
+		t.Errorf("Explain() before any presubmit error = %v, want not found", err)
+	}
+
+	g := &explain.Graph{}
+	g.AddNode(explain.Node{ID: "file", Kind: explain.KindFile, Label: "foo.go"})
+	g.AddNode(explain.Node{ID: "ps", Kind: explain.KindPresubmit, Label: "CICD[0]"})
+	g.AddEdge(explain.Edge{From: "file", To: "ps", Include: "..."})
+	if err := explain.Save(ctx.P4, 7, &explain.Run{Change: 8, Graph: g}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run, ok := out.(*explain.Run); !ok || run.Change != 8 || len(run.Graph.Edges) != 1 {
+		t.Errorf("Explain() = %+v, want the stored run", out)
+	}
+	out, err = get("dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, ok := out.(*ebert.Blob)
+	if !ok || !strings.Contains(string(blob.Data), `"file" -> "ps" [label="..."];`) {
+		t.Errorf("Explain(dot) = %+v, want the graph in dot", out)
+	}
+	if _, err := get("svg"); !errors.As(err, &e) || e.Code != http.StatusBadRequest {
+		t.Errorf("Explain(svg) error = %v, want bad request", err)
+	}
+}
+
+func TestReviewGuidelines(t *testing.T) {
+	p4 := p4mock.New()
+	p4.DescribeShelvedFunc = func(cls ...int) ([]p4lib.Description, error) {
+		return []p4lib.Description{{Cl: cls[0], Files: []p4lib.FileAction{{DepotPath: "//depot/render/pass.cc"}}}}, nil
+	}
+	p4.DescribeFunc = func(cls []int) ([]p4lib.Description, error) {
+		return []p4lib.Description{{Cl: cls[0], Files: []p4lib.FileAction{{DepotPath: "//depot/audio/mixer.cc"}}}}, nil
+	}
+	p4.PrintExFunc = func(files ...string) ([]p4lib.FileDetails, error) {
+		var ret []p4lib.FileDetails
+		for _, f := range files {
+			if f == "//depot/render/REVIEW_GUIDELINES.md" {
+				ret = append(ret, p4lib.FileDetails{DepotFile: f, Content: []byte("Profile it.")})
+			}
+		}
+		return ret, nil
+	}
+	ctx := &ebert.Context{P4: p4}
+	pending := &swarm.Review{Pending: true, Changes: []int{10}, Versions: []swarm.Version{{Change: 10}}}
+	if got, err := reviewGuidelines(ctx, pending); err != nil || got != nil {
+		t.Errorf("reviewGuidelines() without source = %v, %v, want none", got, err)
+	}
+
+	ctx.Guidelines = guidelines.NewSource(p4)
+	got, err := reviewGuidelines(ctx, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []guidelines.Guideline{{
+		Path:  "//depot/render/REVIEW_GUIDELINES.md",
+		Files: []string{"//depot/render/pass.cc"},
+		HTML:  "<p>Profile it.</p>\n",
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("reviewGuidelines(pending) diff (-want +got):\n%s", diff)
+	}
+	submitted := &swarm.Review{Changes: []int{10}, Commits: []int{11}, Versions: []swarm.Version{{Change: 11}}}
+	if got, err := reviewGuidelines(ctx, submitted); err != nil || got != nil {
+		t.Errorf("reviewGuidelines(submitted) = %v, %v, want none", got, err)
+	}
+}
+
+func TestBinaryDiff(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+	contents := map[string]string{
+		"//depot/a.bin#1":    "\x00\x01blob",
+		"//depot/a.bin#2":    "\x00\x01blob",
+		"//depot/b.bin#1":    "\x00\x01old",
+		"//depot/b.bin#2":    "\x00\x01newer",
+		"//depot/icon.png#1": png,
+	}
+	p4 := p4mock.New()
+	p4.PrintToStoreFunc = func(store *p4lib.ContentStore, files ...string) ([]p4lib.FileDetails, error) {
+		var ret []p4lib.FileDetails
+		for _, f := range files {
+			digest, err := store.Put(strings.NewReader(contents[f]))
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, p4lib.FileDetails{DepotFile: f, ContentDigest: digest, FileSize: len(contents[f])})
+		}
+		return ret, nil
+	}
+	ctx := &ebert.Context{P4: p4}
+	type args = struct{ from, to, fileType, action string }
+	tests := []struct {
+		args args
+		want interface{}
+	}{
+		{
+			args: args{from: "//depot/a.bin#1", to: "//depot/a.bin#2", fileType: "binary", action: "edit"},
+			want: "=Binary files are identical.",
+		},
+		{
+			args: args{from: "//depot/b.bin#1", to: "//depot/b.bin#2", fileType: "binary", action: "edit"},
+			want: "-Binary files differ (5 bytes).\n+Binary files differ (7 bytes).",
+		},
+		{
+			args: args{from: "//depot/b.bin#1", fileType: "binary", action: "delete"},
+			want: "-<binary file (5 bytes)>",
+		},
+		{
+			args: args{to: "//depot/icon.png#1", fileType: "binary+F", action: "add"},
+			want: map[string]string{"to": "data:image/png;base64,iVBORw0KGgoAAAAAAAAAAAAAAAAAAAAA"},
+		},
+	}
+	for _, test := range tests {
+		got, err := Diff(ctx, nil, &test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{"response": test.want}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Diff(%+v) diff (-want +got):\n%s", test.args, diff)
+		}
+	}
+}
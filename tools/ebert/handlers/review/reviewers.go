@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package review
+
+import (
+	"fmt"
+	"net/http"
+
+	"sge-monorepo/build/cicd/presubmit/reviewers"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// Suggestion is a suggested reviewer along with a readable reason, eg. "owns 2 files".
+type Suggestion struct {
+	reviewers.Suggestion
+	Reason string `json:"reason"`
+}
+
+// Reviewers suggests reviewers for review |rid| from the history and the OWNERS of its files, for
+// the reviewer picker, eg.
+//
+//      {"suggestions": [{"user": "alice", "score": 2.4, "owned": 2, "authored": 1, "reviewed": 0,
+//                        "reason": "owns 2 files, authored 1 recent change"}]}
+//
+// The author of the review is never suggested, its current reviewers are.
+func Reviewers(ctx *ebert.Context, r *http.Request, args *struct{ rid int }) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	review, _, err := fetchReview(ctx, args.rid)
+	if err != nil {
+		return nil, err
+	}
+	suggestions, err := SuggestReviewers(ctx, review.Review, reviewers.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"suggestions": suggestions}, nil
+}
+
+// SuggestReviewers suggests reviewers for the latest version of |review|, see package reviewers.
+// The author of the review and the Swarm user of Ebert are added to the excluded users of |opts|.
+func SuggestReviewers(ctx *ebert.Context, review *swarm.Review, opts reviewers.Options) ([]Suggestion, error) {
+	change, err := latestChange(ctx, review)
+	if err != nil {
+		return nil, err
+	}
+	ret := []Suggestion{}
+	if change == nil {
+		return ret, nil
+	}
+	var files []string
+	for _, f := range change.Files {
+		files = append(files, f.DepotPath)
+	}
+	opts.Exclude = append(opts.Exclude, review.Author, ctx.Swarm.Username)
+	engine := &reviewers.Engine{
+		P4:        ctx.P4,
+		Owners:    reviewers.DepotOwners(ctx.P4),
+		Reviewers: reviewers.SwarmReviewers(&ctx.Swarm),
+	}
+	suggestions, err := engine.Suggest(files, opts)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't suggest reviewers for review %d: %w", review.ID, err)
+	}
+	for _, s := range suggestions {
+		ret = append(ret, Suggestion{Suggestion: s, Reason: s.Reason()})
+	}
+	return ret, nil
+}
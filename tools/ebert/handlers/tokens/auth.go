@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// routeScope is the scope required by the requests for the paths starting with prefix.
+type routeScope struct {
+	prefix string
+	scope  Scope
+}
+
+// routeScopes are the scopes required by paths whatever the method. Paths that change reviews
+// are listed too, so that a read-only token can't act through a handler that accepts GET.
+var routeScopes = []routeScope{
+	{"/trigger/", CI},
+	{"/ebert/approve/", User},
+	{"/ebert/m/approve/", User},
+	{"/ebert/m/vote/", User},
+}
+
+// writeScopes are the scopes required by the requests other than GET and HEAD. Writes to paths
+// not listed require the User scope.
+var writeScopes = []routeScope{
+	// The requests of a batch are authorized one by one.
+	{"/ebert/batch", Read},
+	{"/ebert/comments/", Comment},
+	{"/ebert/draft/", Comment},
+	{"/ebert/testruns/", CI},
+	{"/ebert/artifacts/", CI},
+	{"/ebert/tokens/rotate", Read},
+}
+
+// RequiredScope returns the scope a token needs for a |method| request for |path|.
+func RequiredScope(method, path string) Scope {
+	for _, rs := range routeScopes {
+		if strings.HasPrefix(path, rs.prefix) {
+			return rs.scope
+		}
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return Read
+	}
+	for _, rs := range writeScopes {
+		if strings.HasPrefix(path, rs.prefix) {
+			return rs.scope
+		}
+	}
+	return User
+}
+
+// Bearer returns the secret of the bearer token of |r|, if any.
+func Bearer(r *http.Request) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	secret := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	return secret, secret != ""
+}
+
+// tokenKey is the request context key of the token a request was authenticated with.
+type tokenKey struct{}
+
+// FromRequest returns the token |r| was authenticated with by Middleware, if any.
+func FromRequest(r *http.Request) (*Info, bool) {
+	info, ok := r.Context().Value(tokenKey{}).(*Info)
+	return info, ok
+}
+
+// authenticate returns |r| authenticated by its bearer token, if it has one.
+func authenticate(store *Store, r *http.Request) (*http.Request, error) {
+	secret, ok := Bearer(r)
+	if !ok {
+		return r, nil
+	}
+	id := Hash(secret)
+	token, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	r = ebert.WithUser(r, token.User)
+	return r.WithContext(context.WithValue(r.Context(), tokenKey{}, &Info{ID: id, Token: *token})), nil
+}
+
+// Middleware authenticates the requests with a bearer token as the user of the token, for
+// ebert.UserFromRequest to return it, and rejects the requests with an unknown or revoked token.
+// Requests without a token are passed on as is, to be authenticated by their session.
+func Middleware(ctx *ebert.Context, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authed, err := authenticate(NewStore(ctx.P4), r)
+		if err != nil {
+			if errors.Is(err, ErrBadToken) {
+				http.Error(w, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+			log.Errorf("couldn't authenticate API token: %v", err)
+			http.Error(w, "Couldn't check API token", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, authed)
+	})
+}
+
+// Authorize returns an error if |r| was authenticated by a token lacking the scope the request
+// requires. It's the Authorize hook of the handlers.Mux, so that the requests of a batch are
+// authorized too.
+func Authorize(r *http.Request) error {
+	info, ok := FromRequest(r)
+	if !ok {
+		return nil
+	}
+	scope := RequiredScope(r.Method, r.URL.Path)
+	if info.Allows(scope) {
+		return nil
+	}
+	return ebert.NewError(
+		fmt.Errorf("token %s of %s lacks scope %s for %s %s", info.ID[:8], info.User, scope, r.Method, r.URL.Path),
+		fmt.Sprintf("API token lacks the %q scope", scope),
+		http.StatusForbidden,
+	)
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+)
+
+// Issued is a newly issued token. It's the only time its secret is returned.
+type Issued struct {
+	Info
+	Secret string `json:"token"`
+}
+
+// IsAdmin returns whether |user| is one of the admins set by the -admins flag.
+func IsAdmin(user string) bool {
+	for _, admin := range strings.Split(flags.Admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// isServiceAccount returns whether |user| is a Perforce user of type service. Unknown users are
+// reported as standard users by "p4 user -o".
+func isServiceAccount(p4 p4lib.P4, user string) (bool, error) {
+	out, err := p4.ExecCmd("user", "-o", user)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "Type:" {
+			return fields[1] == "service", nil
+		}
+	}
+	return false, nil
+}
+
+// sessionUser returns the user of the browser session of |r|. Requests authenticated by a token
+// are refused, so that a leaked token can't mint or revoke other tokens.
+func sessionUser(r *http.Request) (string, error) {
+	if _, ok := Bearer(r); ok {
+		return "", ebert.NewError(
+			fmt.Errorf("token request authenticated by a token"),
+			"API tokens can't manage other tokens",
+			http.StatusForbidden,
+		)
+	}
+	user, err := ebert.UserFromRequest(r)
+	if err != nil {
+		return "", ebert.NewError(
+			fmt.Errorf("couldn't determine user: %w", err),
+			"Couldn't determine identity",
+			http.StatusUnauthorized,
+		)
+	}
+	return user, nil
+}
+
+// badToken returns the error for the requests for the unknown or revoked token |id|.
+func badToken(err error, id string) error {
+	if errors.Is(err, ErrBadToken) {
+		return ebert.NewError(
+			fmt.Errorf("token %q: %w", id, err),
+			"Unknown or revoked API token",
+			http.StatusNotFound,
+		)
+	}
+	return err
+}
+
+// issue issues |token| and returns it with its secret.
+func issue(store *Store, token Token) (*Issued, error) {
+	secret, err := store.Issue(token)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := store.Lookup(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Issued{Info: Info{ID: Hash(secret), Token: *issued}, Secret: secret}, nil
+}
+
+// Tokens lists (GET) the valid tokens of the user, without their secrets. POST issues a token
+// for the user named "name" with the comma-separated "scopes", read-only by default, and DELETE
+// revokes the token "id" of the user.
+//
+// Tokens are only managed from browser sessions.
+func Tokens(ctx *ebert.Context, r *http.Request, args *struct{ id, name, scopes string }) (interface{}, error) {
+	user, err := sessionUser(r)
+	if err != nil {
+		return nil, err
+	}
+	store := NewStore(ctx.P4)
+	switch r.Method {
+	case http.MethodGet:
+		all, err := store.List()
+		if err != nil {
+			return nil, err
+		}
+		mine := []Info{}
+		for _, info := range all {
+			if info.User == user && info.Revoked == 0 {
+				mine = append(mine, info)
+			}
+		}
+		return mine, nil
+	case http.MethodPost:
+		scopes, err := ParseScopes(args.scopes)
+		if err != nil {
+			return nil, ebert.NewError(err, err.Error(), http.StatusBadRequest)
+		}
+		issued, err := issue(store, Token{User: user, Name: args.name, Scopes: scopes})
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("issued API token %s %q of %s with scopes %v", issued.ID[:8], args.name, user, scopes)
+		return issued, nil
+	case http.MethodDelete:
+		token, err := store.Get(args.id)
+		if err == nil && token.User != user {
+			err = ErrBadToken
+		}
+		if err == nil {
+			err = store.Revoke(args.id)
+		}
+		if err != nil {
+			return nil, badToken(err, args.id)
+		}
+		log.Infof("%s revoked API token %s", user, args.id[:8])
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
+
+// Rotate (POST) replaces a token by a new one with the same user, name and scopes, revokes it
+// and returns the new token. Bots rotate the bearer token of the request, users rotate their
+// token "id" from a browser session.
+func Rotate(ctx *ebert.Context, r *http.Request, args *struct{ id string }) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method: %s", r.Method)
+	}
+	store := NewStore(ctx.P4)
+	id := args.id
+	if secret, ok := Bearer(r); ok {
+		id = Hash(secret)
+	} else {
+		user, err := sessionUser(r)
+		if err != nil {
+			return nil, err
+		}
+		token, err := store.Get(id)
+		if err == nil && token.User != user && !IsAdmin(user) {
+			err = ErrBadToken
+		}
+		if err != nil {
+			return nil, badToken(err, id)
+		}
+	}
+	secret, token, err := store.Rotate(id)
+	if err != nil {
+		return nil, badToken(err, id)
+	}
+	log.Infof("rotated API token %s of %s", id[:8], token.User)
+	return &Issued{Info: Info{ID: Hash(secret), Token: *token}, Secret: secret}, nil
+}
+
+// Admin lists (GET) all the tokens, revoked ones included. POST issues a token to the service
+// account "user", named "name" with the comma-separated "scopes", and DELETE revokes any token
+// "id". It's restricted to the admins set by the -admins flag, from a browser session.
+func Admin(ctx *ebert.Context, r *http.Request, args *struct{ id, user, name, scopes string }) (interface{}, error) {
+	admin, err := sessionUser(r)
+	if err != nil {
+		return nil, err
+	}
+	if !IsAdmin(admin) {
+		return nil, ebert.NewError(
+			fmt.Errorf("%s isn't an admin", admin),
+			"Only admins can manage the tokens of others",
+			http.StatusForbidden,
+		)
+	}
+	store := NewStore(ctx.P4)
+	switch r.Method {
+	case http.MethodGet:
+		return store.List()
+	case http.MethodPost:
+		if args.user == "" {
+			return nil, ebert.NewError(
+				fmt.Errorf("service token without user"),
+				"Missing service account",
+				http.StatusBadRequest,
+			)
+		}
+		scopes, err := ParseScopes(args.scopes)
+		if err != nil {
+			return nil, ebert.NewError(err, err.Error(), http.StatusBadRequest)
+		}
+		// Service tokens of people would let admins impersonate them.
+		service, err := isServiceAccount(ctx.P4, args.user)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get the type of user %s: %w", args.user, err)
+		}
+		if !service {
+			return nil, ebert.NewError(
+				fmt.Errorf("%s issuing a service token to %s, which isn't a service account", admin, args.user),
+				fmt.Sprintf("%s isn't a Perforce service user", args.user),
+				http.StatusBadRequest,
+			)
+		}
+		issued, err := issue(store, Token{
+			User:    args.user,
+			Name:    args.name,
+			Scopes:  scopes,
+			Service: true,
+			Issuer:  admin,
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("%s issued API token %s %q of service account %s with scopes %v", admin, issued.ID[:8], args.name, args.user, scopes)
+		return issued, nil
+	case http.MethodDelete:
+		if err := store.Revoke(args.id); err != nil {
+			return nil, badToken(err, args.id)
+		}
+		log.Infof("%s revoked API token %s", admin, args.id[:8])
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected method: %s", r.Method)
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tokens manages the API tokens letting devices, bots and service accounts call Ebert
+// without a browser session. Tokens are sent as "Authorization: Bearer <secret>" and have scopes
+// limiting what they can do. Only the hashes of their secrets are stored.
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// ErrBadToken is returned for unknown or revoked tokens.
+var ErrBadToken = errors.New("unknown or revoked API token")
+
+// Scope is something a token is allowed to do.
+type Scope string
+
+const (
+	// Read lets a token get resources. Every token can read.
+	Read Scope = "read"
+	// Comment lets a token post, edit and resolve comments and drafts.
+	Comment Scope = "comment"
+	// CI lets a token update the test runs and artifacts of reviews and fire the triggers.
+	CI Scope = "ci"
+	// User lets a token do anything its user can, eg. vote. Tokens issued before scopes existed
+	// have it.
+	User Scope = "user"
+)
+
+// scopes are the known scopes.
+var scopes = []Scope{Read, Comment, CI, User}
+
+// ParseScopes parses a comma-separated list of scopes. An empty list is read-only.
+func ParseScopes(list string) ([]Scope, error) {
+	var parsed []Scope
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, s := range scopes {
+			if Scope(name) == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope %q", name)
+		}
+		parsed = append(parsed, Scope(name))
+	}
+	if len(parsed) == 0 {
+		parsed = []Scope{Read}
+	}
+	return parsed, nil
+}
+
+// Token is an API token letting a device or bot act as a user.
+type Token struct {
+	User string `json:"user"`
+	// Name tells the tokens of a user apart, eg. "phone" or "chat".
+	Name string `json:"name,omitempty"`
+	// Scopes are what the token is allowed to do. Tokens without scopes have the User scope.
+	Scopes []Scope `json:"scopes,omitempty"`
+	// Service is set on the tokens of service accounts, which are issued by an admin.
+	Service bool `json:"service,omitempty"`
+	// Issuer is the user who issued the token, if not its user.
+	Issuer  string `json:"issuer,omitempty"`
+	Created int64  `json:"created"`
+	// Revoked is the unix time the token was revoked at, 0 while it's valid.
+	Revoked int64 `json:"revoked,omitempty"`
+}
+
+// Allows returns whether the token has |scope|.
+func (t *Token) Allows(scope Scope) bool {
+	if scope == Read || len(t.Scopes) == 0 {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope || s == User {
+			return true
+		}
+	}
+	return false
+}
+
+// Info is a token with its ID, as listed.
+type Info struct {
+	// ID is the hash of the secret of the token, which identifies it without giving it away.
+	ID string `json:"id"`
+	Token
+}
+
+// Hash returns the ID of the token with |secret|.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+var idRE = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Store keeps the API tokens in p4 keys by ID.
+type Store struct {
+	keys *p4lib.KeyStore
+}
+
+// NewStore returns the store of the tokens of the server of |p4|.
+func NewStore(p4 p4lib.P4) *Store {
+	return &Store{keys: p4lib.NewKeyStore(p4, "ebert-token")}
+}
+
+// Issue stores |token| under a new secret and returns the secret.
+func (s *Store) Issue(token Token) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("couldn't generate token: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	token.Created = time.Now().Unix()
+	token.Revoked = 0
+	if err := s.keys.Set(Hash(secret), &token); err != nil {
+		return "", fmt.Errorf("couldn't store token of %s: %w", token.User, err)
+	}
+	return secret, nil
+}
+
+// Get returns the valid token |id|.
+func (s *Store) Get(id string) (*Token, error) {
+	if !idRE.MatchString(id) {
+		return nil, ErrBadToken
+	}
+	token := &Token{}
+	found, err := s.keys.Get(id, token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get token: %w", err)
+	}
+	if !found || token.User == "" || token.Revoked != 0 {
+		return nil, ErrBadToken
+	}
+	return token, nil
+}
+
+// Lookup returns the valid token with |secret|.
+func (s *Store) Lookup(secret string) (*Token, error) {
+	return s.Get(Hash(secret))
+}
+
+// Revoke revokes the token |id|.
+func (s *Store) Revoke(id string) error {
+	if !idRE.MatchString(id) {
+		return ErrBadToken
+	}
+	var token Token
+	return s.keys.Update(id, &token, func() error {
+		if token.User == "" {
+			return ErrBadToken
+		}
+		if token.Revoked == 0 {
+			token.Revoked = time.Now().Unix()
+		}
+		return nil
+	})
+}
+
+// Rotate replaces the valid token |id| by a new token with the same user, name and scopes, and
+// returns the secret of the new token. The old token is revoked once the new one is stored.
+func (s *Store) Rotate(id string) (string, *Token, error) {
+	token, err := s.Get(id)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := s.Issue(*token)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.Revoke(id); err != nil {
+		return "", nil, fmt.Errorf("couldn't revoke rotated token: %w", err)
+	}
+	rotated, err := s.Lookup(secret)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, rotated, nil
+}
+
+// List returns all the tokens, revoked ones included, sorted by ID.
+func (s *Store) List() ([]Info, error) {
+	ids, err := s.keys.Names()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list tokens: %w", err)
+	}
+	infos := []Info{}
+	for _, id := range ids {
+		info := Info{ID: id}
+		found, err := s.keys.Get(id, &info.Token)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get token %s: %w", id, err)
+		}
+		if found && info.User != "" {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokens
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/p4lib/p4mock"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeContext returns a context whose p4 keys are held in memory.
+func fakeContext() *ebert.Context {
+	keys := map[string]string{}
+	return &ebert.Context{P4: p4mock.Mock{
+		KeyGetFunc: func(key string) (string, error) {
+			if v, ok := keys[key]; ok {
+				return v, nil
+			}
+			return "0", p4lib.ErrKeyNotFound
+		},
+		KeySetFunc: func(key, val string) error {
+			keys[key] = val
+			return nil
+		},
+		KeyCasFunc: func(key, oldval, newval string) error {
+			if keys[key] != oldval {
+				return p4lib.ErrCasMismatch
+			}
+			keys[key] = newval
+			return nil
+		},
+		KeysFunc: func(pattern string) (map[string]string, error) {
+			matched := map[string]string{}
+			for k, v := range keys {
+				if ok, _ := path.Match(pattern, k); ok {
+					matched[k] = v
+				}
+			}
+			return matched, nil
+		},
+		ExecCmdFunc: func(args ...string) (string, error) {
+			// Users named *-bot are service users.
+			typ := "standard"
+			if strings.HasSuffix(args[len(args)-1], "-bot") {
+				typ = "service"
+			}
+			return "User:\t" + args[len(args)-1] + "\n\nType:\t" + typ + "\n", nil
+		},
+	}}
+}
+
+func request(method, url, secret string) *http.Request {
+	r := httptest.NewRequest(method, url, nil)
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return r
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []Scope
+		wantErr bool
+	}{
+		{list: "", want: []Scope{Read}},
+		{list: "comment, ci", want: []Scope{Comment, CI}},
+		{list: "admin", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseScopes(test.list)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseScopes(%q) error = %v, want error %v", test.list, err, test.wantErr)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("ParseScopes(%q) diff (-want +got):\n%s", test.list, diff)
+		}
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   Scope
+	}{
+		{http.MethodGet, "/ebert/review/12", Read},
+		{http.MethodPost, "/ebert/comments/12", Comment},
+		{http.MethodDelete, "/ebert/draft/12", Comment},
+		{http.MethodPost, "/ebert/testruns/12", CI},
+		{http.MethodGet, "/trigger/submit", CI},
+		{http.MethodPost, "/ebert/batch", Read},
+		{http.MethodPost, "/ebert/approve/12", User},
+		{http.MethodGet, "/ebert/approve/12", User},
+		{http.MethodGet, "/ebert/m/vote/12", User},
+	}
+	for _, test := range tests {
+		if got := RequiredScope(test.method, test.path); got != test.want {
+			t.Errorf("RequiredScope(%s, %s) = %s, want %s", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ctx := fakeContext()
+	store := NewStore(ctx.P4)
+	secret, err := store.Issue(Token{User: "ci-bot", Scopes: []Scope{CI}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		Code int
+		User string
+		Err  string
+	}
+	serve := func(r *http.Request) result {
+		var res result
+		h := Middleware(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res.User, _ = ebert.UserFromRequest(r)
+			if err := Authorize(r); err != nil {
+				res.Err = err.Error()
+			}
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		res.Code = w.Code
+		return res
+	}
+	session, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		r    *http.Request
+		want result
+	}{
+		{
+			name: "session",
+			r:    request(http.MethodPost, "/ebert/approve/1", ""),
+			want: result{Code: http.StatusOK, User: session},
+		},
+		{
+			name: "read",
+			r:    request(http.MethodGet, "/ebert/review/1", secret),
+			want: result{Code: http.StatusOK, User: "ci-bot"},
+		},
+		{
+			name: "in scope",
+			r:    request(http.MethodPost, "/ebert/testruns/1", secret),
+			want: result{Code: http.StatusOK, User: "ci-bot"},
+		},
+		{
+			name: "out of scope",
+			r:    request(http.MethodPost, "/ebert/comments/1", secret),
+			want: result{Code: http.StatusOK, User: "ci-bot", Err: `API token lacks the "comment" scope`},
+		},
+		{
+			name: "unknown token",
+			r:    request(http.MethodGet, "/ebert/review/1", "bogus"),
+			want: result{Code: http.StatusUnauthorized},
+		},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, serve(test.r)); diff != "" {
+			t.Errorf("%s: diff (-want +got):\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	ctx := fakeContext()
+	user, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type args = struct{ id, name, scopes string }
+
+	res, err := Tokens(ctx, request(http.MethodPost, "/ebert/tokens", ""), &args{name: "chat", scopes: "comment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := res.(*Issued)
+	if issued.User != user || issued.ID != Hash(issued.Secret) {
+		t.Errorf("Tokens(POST) = %+v, want a token of %s identified by its hash", issued, user)
+	}
+	if _, err := Tokens(ctx, request(http.MethodPost, "/ebert/tokens", issued.Secret), &args{}); err == nil {
+		t.Errorf("token issued by a token: got no error")
+	}
+	if _, err := Tokens(ctx, request(http.MethodPost, "/ebert/tokens", ""), &args{scopes: "everything"}); err == nil {
+		t.Errorf("token with an unknown scope: got no error")
+	}
+
+	// Bots rotate their own token.
+	res, err = Rotate(ctx, request(http.MethodPost, "/ebert/tokens/rotate", issued.Secret), &struct{ id string }{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := res.(*Issued)
+	if diff := cmp.Diff([]Scope{Comment}, rotated.Scopes); diff != "" || rotated.Name != "chat" {
+		t.Errorf("Rotate() = %+v, want the name and scopes of the rotated token", rotated)
+	}
+	store := NewStore(ctx.P4)
+	if _, err := store.Lookup(issued.Secret); !errors.Is(err, ErrBadToken) {
+		t.Errorf("Lookup() of a rotated token: got %v, want %v", err, ErrBadToken)
+	}
+
+	res, err = Tokens(ctx, request(http.MethodGet, "/ebert/tokens", ""), &args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos := res.([]Info); len(infos) != 1 || infos[0].ID != rotated.ID {
+		t.Errorf("Tokens(GET) = %+v, want the rotated token only", infos)
+	}
+	if _, err := Tokens(ctx, request(http.MethodDelete, "/ebert/tokens", ""), &args{id: rotated.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Lookup(rotated.Secret); !errors.Is(err, ErrBadToken) {
+		t.Errorf("Lookup() of a revoked token: got %v, want %v", err, ErrBadToken)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	ctx := fakeContext()
+	user, err := ebert.UserFromRequest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type args = struct{ id, user, name, scopes string }
+	defer func(admins string) { flags.Admins = admins }(flags.Admins)
+
+	flags.Admins = ""
+	if _, err := Admin(ctx, request(http.MethodGet, "/ebert/admin/tokens", ""), &args{}); err == nil {
+		t.Errorf("Admin() by a non-admin: got no error")
+	}
+
+	flags.Admins = "someone," + user
+	res, err := Admin(ctx, request(http.MethodPost, "/ebert/admin/tokens", ""), &args{user: "ci-bot", name: "presubmit", scopes: "ci,comment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := res.(*Issued)
+	want := Token{User: "ci-bot", Name: "presubmit", Scopes: []Scope{CI, Comment}, Service: true, Issuer: user, Created: issued.Created}
+	if diff := cmp.Diff(want, issued.Token); diff != "" {
+		t.Errorf("Admin(POST) diff (-want +got):\n%s", diff)
+	}
+	if _, err := Admin(ctx, request(http.MethodDelete, "/ebert/admin/tokens", ""), &args{id: issued.ID}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = Admin(ctx, request(http.MethodGet, "/ebert/admin/tokens", ""), &args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos := res.([]Info); len(infos) != 1 || infos[0].Revoked == 0 {
+		t.Errorf("Admin(GET) = %+v, want the revoked service token", infos)
+	}
+	if _, err := Admin(ctx, request(http.MethodPost, "/ebert/admin/tokens", ""), &args{user: "alice", scopes: "read"}); err == nil {
+		t.Errorf("Admin(POST) of a token of a person: got no error")
+	}
+	if _, err := Admin(ctx, request(http.MethodDelete, "/ebert/admin/tokens", ""), &args{id: "nope"}); err == nil {
+		t.Errorf("Admin(DELETE) of an unknown token: got no error")
+	}
+}
@@ -21,10 +21,13 @@
 package trigger
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"sge-monorepo/build/cicd/cirunner/queue"
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/swarm"
 	"sge-monorepo/tools/ebert/ebert"
@@ -43,16 +46,64 @@ func Handle(ectx *ebert.Context, r *http.Request, args *struct{ trigger string }
 		if err != nil {
 			return "error", err
 		}
+	case "change-submit":
+		change, err := strconv.Atoi(r.FormValue("change"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid change id in change-submit trigger: %w", err)
+		}
+		if err := CheckSubmit(ectx, change); err != nil {
+			return "error", err
+		}
 	default:
 		return "error", fmt.Errorf("unhandled trigger: '%s'", args.trigger)
 	}
 	return "ok", nil
 }
 
-// PostSubmit processes submitted changes by updating associated reviews.
+// CheckSubmit enforces the submit policy on |change| before it is submitted, along with its
+// review if it has one. It fails, which fails the submit, when the change violates the policy.
+func CheckSubmit(ctx *ebert.Context, change int) error {
+	if ctx.Policy == nil {
+		return nil
+	}
+	descs, err := ctx.P4.Describe([]int{change})
+	if err != nil || len(descs) != 1 {
+		return fmt.Errorf("couldn't describe change %d: %v", change, err)
+	}
+	reviews, err := swarm.GetReviewsForChangelists(&ctx.Swarm, []int{change})
+	if err != nil {
+		return fmt.Errorf("couldn't find reviews for %d: %w", change, err)
+	}
+	var r *swarm.Review
+	if len(reviews.Reviews) > 0 {
+		r = &reviews.Reviews[0]
+	}
+	violations, err := review.EvaluatePolicy(ctx, &descs[0], r)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("Change %d violates the submit policy:", change)}
+	for _, v := range violations {
+		lines = append(lines, "* "+v.String())
+	}
+	msg := strings.Join(lines, "\n")
+	return ebert.NewError(errors.New(msg), msg, http.StatusForbidden)
+}
+
+// PostSubmit processes submitted changes by updating associated reviews, and queues a postsubmit
+// run if CI requests are queued.
 func PostSubmit(ctx *ebert.Context, change int) error {
 	log.Infof("change %d submitted", change)
 
+	if ctx.Queue != nil {
+		if err := ctx.Queue.Enqueue(queue.NewPostsubmitRequest()); err != nil {
+			log.Errorf("couldn't queue postsubmit for %d: %v", change, err)
+		}
+	}
+
 	reviews, err := swarm.GetReviewsForChangelists(&ctx.Swarm, []int{change})
 	if err != nil {
 		return fmt.Errorf("couldn't find reviews for %d: %w", change, err)
@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unresolved contains the handler counting the unresolved comment threads of reviews.
+package unresolved
+
+import (
+	"fmt"
+	"net/http"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+)
+
+// NagFlag flags the reminders posted by the nag bot. They are ignored when computing statistics, so
+// that reminders neither count as threads nor as activity.
+const NagFlag = "ebert-nag"
+
+// Stats are the comment thread statistics of a review.
+type Stats struct {
+	Review     int `json:"review"`
+	Threads    int `json:"threads"`
+	Unresolved int `json:"unresolved"`
+	// ByAuthor counts the unresolved threads by the user who started them.
+	ByAuthor map[string]int `json:"byAuthor"`
+	// LastActivity is the unix time of the latest comment or comment update, 0 if there is none.
+	LastActivity int `json:"lastActivity"`
+}
+
+// Compute returns the thread statistics of review |rid| from its |comments|. As in the review page,
+// a thread with replies is resolved when all its replies are, and a thread without replies when
+// its comment is flagged as resolved.
+func Compute(rid int, comments []swarm.Comment) *Stats {
+	stats := &Stats{
+		Review:   rid,
+		ByAuthor: map[string]int{},
+	}
+	children := map[int][]*swarm.Comment{}
+	var roots []*swarm.Comment
+	for i := range comments {
+		c := &comments[i]
+		if hasFlag(c, NagFlag) {
+			continue
+		}
+		if c.Updated > stats.LastActivity {
+			stats.LastActivity = c.Updated
+		}
+		if c.Time > stats.LastActivity {
+			stats.LastActivity = c.Time
+		}
+		if c.Context != nil && c.Context.Comment != 0 {
+			children[c.Context.Comment] = append(children[c.Context.Comment], c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	var resolved func(c *swarm.Comment) bool
+	resolved = func(c *swarm.Comment) bool {
+		replies := children[c.ID]
+		if len(replies) == 0 {
+			return hasFlag(c, "resolved")
+		}
+		for _, r := range replies {
+			if !resolved(r) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, c := range roots {
+		stats.Threads++
+		if !resolved(c) {
+			stats.Unresolved++
+			stats.ByAuthor[c.User]++
+		}
+	}
+	return stats
+}
+
+// ForReview returns the thread statistics of review |rid|.
+func ForReview(ctx *ebert.Context, rid int) (*Stats, error) {
+	comments, err := swarm.GetCommentsForReview(&ctx.Swarm, rid)
+	if err != nil {
+		return nil, fmt.Errorf("could not get comments of review %d: %w", rid, err)
+	}
+	return Compute(rid, comments.Comments), nil
+}
+
+// Handle gets the thread statistics of a review, eg. for the UI to show "3 unresolved".
+func Handle(ctx *ebert.Context, r *http.Request, args *struct {
+	rid int
+}) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("unexpected method: %s", r.Method)
+	}
+	return ForReview(ctx, args.rid)
+}
+
+func hasFlag(c *swarm.Comment, flag string) bool {
+	for _, f := range c.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unresolved
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/libs/go/swarm/swarmfake"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/handlers"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompute(t *testing.T) {
+	reply := func(id, to int, user string, time int, flags ...string) swarm.Comment {
+		return swarm.Comment{
+			ID:      id,
+			User:    user,
+			Time:    time,
+			Flags:   flags,
+			Context: &swarm.CommentContext{Comment: to},
+		}
+	}
+	comments := []swarm.Comment{
+		// Resolved without replies.
+		reply(1, 0, "bob", 100, "resolved"),
+		// Unresolved without replies.
+		reply(2, 0, "bob", 110),
+		// Resolved by its only reply, even if the first comment isn't.
+		reply(3, 0, "carol", 120),
+		reply(4, 3, "alice", 130, "resolved"),
+		// Unresolved because a nested reply isn't resolved.
+		reply(5, 0, "carol", 140, "resolved"),
+		reply(6, 5, "alice", 150, "resolved"),
+		reply(7, 6, "carol", 160),
+		// Comments without context are threads too.
+		{ID: 8, User: "bob", Time: 90, Updated: 200},
+		// Reminders are ignored.
+		reply(9, 0, "swarm", 300, NagFlag),
+	}
+	want := &Stats{
+		Review:       42,
+		Threads:      5,
+		Unresolved:   3,
+		ByAuthor:     map[string]int{"bob": 2, "carol": 1},
+		LastActivity: 200,
+	}
+	if diff := cmp.Diff(want, Compute(42, comments)); diff != "" {
+		t.Errorf("Compute mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	server := swarmfake.New()
+	defer server.Close()
+	server.AddReview(swarm.Review{ID: 7, Author: "alice", Changes: []int{8}})
+	ctx := &ebert.Context{Swarm: *server.Context()}
+	if err := swarm.AddComment(&ctx.Swarm, &swarm.Comment{Topic: "reviews/7", Body: "nit"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := handlers.Wrap("/ebert/unresolved/:rid", Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.Serve(ctx, httptest.NewRequest(http.MethodGet, "/ebert/unresolved/7", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := got.(*Stats); stats.Review != 7 || stats.Unresolved != 1 {
+		t.Errorf("GET /ebert/unresolved/7 = %+v, want 1 unresolved thread of review 7", stats)
+	}
+}
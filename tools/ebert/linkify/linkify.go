@@ -0,0 +1,199 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package linkify finds references to external systems in review descriptions and comments, eg.
+// issue keys, design docs or crash ids, and turns them into links. Rules mapping regular
+// expressions to URL templates are configured in the monorepo, see protos/linkify.proto.
+package linkify
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"sge-monorepo/tools/ebert/linkify/protos/linkifypb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Link is a reference to an external system found in a text.
+type Link struct {
+	// Rule is the name of the rule that made the link.
+	Rule string `json:"rule"`
+	// Text is the linked text.
+	Text string `json:"text"`
+	URL  string `json:"url"`
+	// Start and End are the byte offsets of the linked text.
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Linkifier finds links in texts. A nil Linkifier finds none.
+type Linkifier struct {
+	rules []rule
+}
+
+type rule struct {
+	name string
+	re   *regexp.Regexp
+	url  []segment
+}
+
+// segment is a part of a URL template: either literal text or the group of a match.
+type segment struct {
+	text  string
+	group int // -1 for literal text.
+}
+
+// placeholderRE matches the placeholders of URL templates: $$, $0 to $9 and ${name}.
+var placeholderRE = regexp.MustCompile(`\$(?:\$|(\d)|\{(\w+)\})`)
+
+// New returns a linkifier applying the rules of |cfg|. Rules apply in order: text linked by a rule
+// isn't linked by later ones.
+func New(cfg *linkifypb.Config) (*Linkifier, error) {
+	l := &Linkifier{}
+	names := map[string]bool{}
+	for i, r := range cfg.GetRule() {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid pattern: %w", r.Name, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("rule %q: pattern %q matches empty text", r.Name, r.Pattern)
+		}
+		tmpl, err := parseTemplate(r.Url, re)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		l.rules = append(l.rules, rule{name: r.Name, re: re, url: tmpl})
+	}
+	return l, nil
+}
+
+// Parse returns a linkifier applying the rules of text proto |text|.
+func Parse(text string) (*Linkifier, error) {
+	cfg := &linkifypb.Config{}
+	if err := proto.UnmarshalText(text, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse linkify rules: %w", err)
+	}
+	return New(cfg)
+}
+
+// parseTemplate splits URL template |tmpl| into segments, checking that its placeholders are
+// groups of |re| and that it expands to an http or https URL.
+func parseTemplate(tmpl string, re *regexp.Regexp) ([]segment, error) {
+	if tmpl == "" {
+		return nil, errors.New("missing URL")
+	}
+	var segs []segment
+	last := 0
+	for _, m := range placeholderRE.FindAllStringSubmatchIndex(tmpl, -1) {
+		if m[0] > last {
+			segs = append(segs, segment{text: tmpl[last:m[0]], group: -1})
+		}
+		last = m[1]
+		switch {
+		case m[2] >= 0:
+			g, _ := strconv.Atoi(tmpl[m[2]:m[3]])
+			if g > re.NumSubexp() {
+				return nil, fmt.Errorf("URL %q refers to group %d, pattern has %d", tmpl, g, re.NumSubexp())
+			}
+			segs = append(segs, segment{group: g})
+		case m[4] >= 0:
+			name := tmpl[m[4]:m[5]]
+			g := re.SubexpIndex(name)
+			if g < 0 {
+				return nil, fmt.Errorf("URL %q refers to unknown group %q", tmpl, name)
+			}
+			segs = append(segs, segment{group: g})
+		default:
+			segs = append(segs, segment{text: "$", group: -1})
+		}
+	}
+	if last < len(tmpl) {
+		segs = append(segs, segment{text: tmpl[last:], group: -1})
+	}
+	// Groups are query escaped, so they can't change the scheme or host of the URL.
+	u, err := url.Parse(expand(segs, func(int) string { return "x" }))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", tmpl, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("URL %q isn't an http or https URL", tmpl)
+	}
+	return segs, nil
+}
+
+// expand returns the URL of template |segs|, with the values of groups returned by |group|.
+func expand(segs []segment, group func(g int) string) string {
+	var u []byte
+	for _, s := range segs {
+		if s.group < 0 {
+			u = append(u, s.text...)
+		} else {
+			u = append(u, url.QueryEscape(group(s.group))...)
+		}
+	}
+	return string(u)
+}
+
+// Links returns the links found in |text|, sorted by offset.
+func (l *Linkifier) Links(text string) []Link {
+	if l == nil {
+		return nil
+	}
+	var links []Link
+	// linked reports whether [start, end) overlaps a link made by a previous rule.
+	linked := func(start, end int) bool {
+		for _, lk := range links {
+			if start < lk.End && lk.Start < end {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range l.rules {
+		var found []Link
+		for _, m := range r.re.FindAllStringSubmatchIndex(text, -1) {
+			if m[0] == m[1] || linked(m[0], m[1]) {
+				continue
+			}
+			found = append(found, Link{
+				Rule: r.name,
+				Text: text[m[0]:m[1]],
+				URL: expand(r.url, func(g int) string {
+					if m[2*g] < 0 {
+						return ""
+					}
+					return text[m[2*g]:m[2*g+1]]
+				}),
+				Start: m[0],
+				End:   m[1],
+			})
+		}
+		links = append(links, found...)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Start < links[j].Start })
+	return links
+}
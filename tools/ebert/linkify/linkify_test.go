@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linkify
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/p4lib"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const rules = `
+rule {
+  name: "jira"
+  pattern: "\\b([A-Z][A-Z0-9]+-\\d+)\\b"
+  url: "https://jira.example.com/browse/$1"
+}
+rule {
+  name: "doc"
+  pattern: "go/doc/(?P<id>[\\w-]+)"
+  url: "https://docs.example.com/document/d/${id}"
+}
+rule {
+  name: "crash"
+  pattern: "crash:(\\S+)"
+  url: "https://crash.example.com/report?id=$1&$$"
+}
+rule {
+  name: "anyid"
+  pattern: "[A-Z]+-\\d+"
+  url: "https://other.example.com/$0"
+}
+`
+
+func TestLinks(t *testing.T) {
+	l, err := Parse(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		text string
+		want []Link
+	}{
+		{
+			text: "Nothing to link here.",
+		},
+		{
+			text: "Fix GAME-123 and ENGINE2-7.\nSee go/doc/design-1.",
+			want: []Link{
+				{Rule: "jira", Text: "GAME-123", URL: "https://jira.example.com/browse/GAME-123", Start: 4, End: 12},
+				{Rule: "jira", Text: "ENGINE2-7", URL: "https://jira.example.com/browse/ENGINE2-7", Start: 17, End: 26},
+				{Rule: "doc", Text: "go/doc/design-1", URL: "https://docs.example.com/document/d/design-1", Start: 32, End: 47},
+			},
+		},
+		{
+			// Groups are escaped, so they can't add query parameters.
+			text: "crash:a&b=c d",
+			want: []Link{
+				{Rule: "crash", Text: "crash:a&b=c", URL: "https://crash.example.com/report?id=a%26b%3Dc&$", Start: 0, End: 11},
+			},
+		},
+		{
+			// Text linked by jira isn't linked again by anyid, but anyid links what jira doesn't.
+			text: "xGAME-1 GAME-2",
+			want: []Link{
+				{Rule: "anyid", Text: "GAME-1", URL: "https://other.example.com/GAME-1", Start: 1, End: 7},
+				{Rule: "jira", Text: "GAME-2", URL: "https://jira.example.com/browse/GAME-2", Start: 8, End: 14},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got := l.Links(tc.text)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Links(%q): diff (-want, +got):\n%s", tc.text, diff)
+		}
+	}
+}
+
+func TestNilLinkifier(t *testing.T) {
+	var l *Linkifier
+	if got := l.Links("GAME-123"); got != nil {
+		t.Errorf("Links of nil Linkifier = %v, want nil", got)
+	}
+	var s *Source
+	if got := s.Linkifier(); got != nil {
+		t.Errorf("Linkifier of nil Source = %v, want nil", got)
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	testCases := []struct {
+		rules string
+		want  string
+	}{
+		{`rule { pattern: "a" url: "https://a/" }`, "no name"},
+		{`rule { name: "a" pattern: "a" url: "https://a/" } rule { name: "a" pattern: "b" url: "https://b/" }`, "duplicate"},
+		{`rule { name: "a" pattern: "(" url: "https://a/" }`, "invalid pattern"},
+		{`rule { name: "a" pattern: "a*" url: "https://a/" }`, "matches empty"},
+		{`rule { name: "a" pattern: "a" }`, "missing URL"},
+		{`rule { name: "a" pattern: "(a)" url: "https://a/$2" }`, "group 2"},
+		{`rule { name: "a" pattern: "(a)" url: "https://a/${id}" }`, "unknown group"},
+		{`rule { name: "a" pattern: "a" url: "javascript:alert(1)" }`, "http"},
+		{`rule { name: "a" pattern: "(a)" url: "$1" }`, "http"},
+		{`rule { name: "a" pattern: "a" url: "/relative" }`, "http"},
+		{`rule { bogus: 1 }`, "parse"},
+	}
+	for _, tc := range testCases {
+		_, err := Parse(tc.rules)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%q) = %v, want error containing %q", tc.rules, err, tc.want)
+		}
+	}
+}
+
+type fakeP4 struct {
+	p4lib.P4
+	text   string
+	err    error
+	prints int
+}
+
+func (p4 *fakeP4) Print(args ...string) (string, error) {
+	p4.prints++
+	return p4.text, p4.err
+}
+
+func TestSource(t *testing.T) {
+	p4 := &fakeP4{text: rules}
+	now := time.Unix(1000, 0)
+	s := NewSource(p4, "//depot/ebert/links.textpb")
+	s.file.Now = func() time.Time { return now }
+
+	if got := len(s.Linkifier().Links("GAME-1")); got != 1 {
+		t.Fatalf("got %d links, want 1", got)
+	}
+	// Rules are cached.
+	p4.text = ""
+	s.Linkifier()
+	if p4.prints != 1 {
+		t.Errorf("got %d prints, want 1", p4.prints)
+	}
+	// Rules that can't be loaded keep the previous ones.
+	now = now.Add(p4lib.DepotFileRefresh)
+	p4.err = errors.New("no such file")
+	if got := len(s.Linkifier().Links("GAME-1")); got != 1 {
+		t.Errorf("got %d links after a load failure, want 1", got)
+	}
+	now = now.Add(p4lib.DepotFileRefresh)
+	p4.err = nil
+	p4.text = `rule { name: "a" pattern: "(" url: "https://a/" }`
+	if got := len(s.Linkifier().Links("GAME-1")); got != 1 {
+		t.Errorf("got %d links after invalid rules, want 1", got)
+	}
+	// Newer rules replace the previous ones.
+	now = now.Add(p4lib.DepotFileRefresh)
+	p4.text = ""
+	if got := len(s.Linkifier().Links("GAME-1")); got != 0 {
+		t.Errorf("got %d links with no rules, want 0", got)
+	}
+	if p4.prints != 4 {
+		t.Errorf("got %d prints, want 4", p4.prints)
+	}
+}
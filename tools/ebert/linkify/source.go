@@ -0,0 +1,43 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linkify
+
+import (
+	"sge-monorepo/libs/go/p4lib"
+)
+
+// Source loads linkify rules from a text proto in the depot and reloads them periodically, so that
+// submitted rule changes apply without restarting Ebert.
+type Source struct {
+	file *p4lib.DepotFile
+}
+
+// NewSource returns a source loading rules from depot path |path|, eg. "//depot/ebert/links.textpb".
+func NewSource(p4 p4lib.P4, path string) *Source {
+	return &Source{file: p4lib.NewDepotFile(p4, path, func(text string) (interface{}, error) {
+		return Parse(text)
+	})}
+}
+
+// Linkifier returns a linkifier of the latest rules. When rules can't be loaded, the last rules
+// that could are used. A nil Source returns a nil Linkifier, which finds no links.
+func (s *Source) Linkifier() *Linkifier {
+	if s == nil {
+		return nil
+	}
+	l, _ := s.file.Get()
+	linkifier, _ := l.(*Linkifier)
+	return linkifier
+}
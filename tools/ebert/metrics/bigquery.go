@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// maxInsertRows is the number of rows inserted per request, as recommended by BigQuery.
+const maxInsertRows = 500
+
+// sink is where rows are exported to.
+type sink interface {
+	// Table returns the schema of a table, nil if it doesn't exist.
+	Table(name string) (*bq.TableSchema, error)
+	// CreateTable creates a table.
+	CreateTable(t *table) error
+	// AddFields adds fields to the schema of an existing table.
+	AddFields(name string, schema *bq.TableSchema) error
+	// Insert inserts rows in a table.
+	Insert(name string, rows []row) error
+}
+
+// ensureTable creates table |t| or, if it exists, adds the fields it lacks. Fields with another
+// type or mode than expected are an error, as the schema only ever grows.
+func ensureTable(s sink, t *table) error {
+	schema, err := s.Table(t.name)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return s.CreateTable(t)
+	}
+	missing, err := missingFields(schema, t)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	schema.Fields = append(schema.Fields, missing...)
+	return s.AddFields(t.name, schema)
+}
+
+// missingFields returns the fields of |t| that |schema| lacks.
+func missingFields(schema *bq.TableSchema, t *table) ([]*bq.TableFieldSchema, error) {
+	have := map[string]*bq.TableFieldSchema{}
+	for _, f := range schema.Fields {
+		have[f.Name] = f
+	}
+	var missing []*bq.TableFieldSchema
+	for _, f := range t.fields {
+		h, ok := have[f.Name]
+		if !ok {
+			if f.Mode == "REQUIRED" {
+				return nil, fmt.Errorf("table %s: required field %s can't be added to an existing table", t.name, f.Name)
+			}
+			missing = append(missing, f)
+			continue
+		}
+		if !strings.EqualFold(h.Type, f.Type) || !strings.EqualFold(modeOf(h), modeOf(f)) {
+			return nil, fmt.Errorf("table %s: field %s is %s %s, want %s %s", t.name, f.Name, modeOf(h), h.Type, modeOf(f), f.Type)
+		}
+	}
+	return missing, nil
+}
+
+// modeOf returns the mode of a field, which BigQuery leaves empty for NULLABLE.
+func modeOf(f *bq.TableFieldSchema) string {
+	if f.Mode == "" {
+		return "NULLABLE"
+	}
+	return f.Mode
+}
+
+// bigQuery is a sink writing to the tables of a BigQuery dataset.
+type bigQuery struct {
+	ctx     context.Context
+	svc     *bq.Service
+	project string
+	dataset string
+}
+
+func newBigQuery(ctx context.Context, project, dataset string) (*bigQuery, error) {
+	svc, err := bq.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create BigQuery client: %v", err)
+	}
+	return &bigQuery{
+		ctx:     ctx,
+		svc:     svc,
+		project: project,
+		dataset: dataset,
+	}, nil
+}
+
+func (b *bigQuery) Table(name string) (*bq.TableSchema, error) {
+	t, err := b.svc.Tables.Get(b.project, b.dataset, name).Context(b.ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get table %s: %v", name, err)
+	}
+	if t.Schema == nil {
+		return &bq.TableSchema{}, nil
+	}
+	return t.Schema, nil
+}
+
+func (b *bigQuery) CreateTable(t *table) error {
+	bt := &bq.Table{
+		TableReference: &bq.TableReference{
+			ProjectId: b.project,
+			DatasetId: b.dataset,
+			TableId:   t.name,
+		},
+		Description: t.desc,
+		Schema:      &bq.TableSchema{Fields: t.fields},
+		TimePartitioning: &bq.TimePartitioning{
+			Type:  "DAY",
+			Field: t.partition,
+		},
+	}
+	if _, err := b.svc.Tables.Insert(b.project, b.dataset, bt).Context(b.ctx).Do(); err != nil {
+		return fmt.Errorf("could not create table %s: %v", t.name, err)
+	}
+	return nil
+}
+
+func (b *bigQuery) AddFields(name string, schema *bq.TableSchema) error {
+	if _, err := b.svc.Tables.Patch(b.project, b.dataset, name, &bq.Table{Schema: schema}).Context(b.ctx).Do(); err != nil {
+		return fmt.Errorf("could not update the schema of table %s: %v", name, err)
+	}
+	return nil
+}
+
+func (b *bigQuery) Insert(name string, rows []row) error {
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > maxInsertRows {
+			n = maxInsertRows
+		}
+		req := &bq.TableDataInsertAllRequest{}
+		for _, r := range rows[:n] {
+			req.Rows = append(req.Rows, &bq.TableDataInsertAllRequestRows{
+				InsertId: r.id,
+				Json:     r.values,
+			})
+		}
+		resp, err := b.svc.Tabledata.InsertAll(b.project, b.dataset, name, req).Context(b.ctx).Do()
+		if err != nil {
+			return fmt.Errorf("could not insert rows in table %s: %v", name, err)
+		}
+		if len(resp.InsertErrors) > 0 {
+			var msgs []string
+			for _, ie := range resp.InsertErrors {
+				for _, e := range ie.Errors {
+					msgs = append(msgs, fmt.Sprintf("row %s: %s", rows[ie.Index].id, e.Message))
+				}
+			}
+			return fmt.Errorf("could not insert %d rows in table %s: %s", len(resp.InsertErrors), name, strings.Join(msgs, "; "))
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary metrics exports review metrics of Ebert to BigQuery, for org-wide dashboards that don't
+// have to scrape Swarm: the lifecycle events of reviews, the outcomes of their presubmits and the
+// time reviewers take to respond. It's meant to run as a cron unit, with the same flags and
+// credentials as Ebert. Each run exports what happened since the previous one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+)
+
+var (
+	project  = flag.String("project", "", "Cloud project of the BigQuery dataset.")
+	dataset  = flag.String("dataset", "ebert", "BigQuery dataset the metrics tables are in.")
+	backfill = flag.Duration("backfill", 30*24*time.Hour, "How far back the first run exports.")
+	dryRun   = flag.Bool("dry_run", false, "Log the number of rows instead of exporting them.")
+	// sgeb passes the invocation proto to cron units, the exporter doesn't need it.
+	_ = flag.String("tool-invocation", "", "Path to the sgeb tool invocation. Unused.")
+)
+
+// exportState is the state kept between runs.
+type exportState struct {
+	// Time is the unix time up to which events were exported.
+	Time int64
+}
+
+// collect returns the rows of the events that happened in |w|.
+func collect(ctx *ebert.Context, w window) (rows, error) {
+	// Swarm can't filter reviews by update time, so all are listed.
+	reviews, err := swarm.GetReviews(&ctx.Swarm, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not get reviews: %v", err)
+	}
+	rs := rows{}
+	for i := range reviews.Reviews {
+		review := &reviews.Reviews[i]
+		if !w.contains(int64(review.Updated)) {
+			continue
+		}
+		d, err := fetchReview(ctx, review)
+		if err != nil {
+			return nil, err
+		}
+		rs.addReview(d, w)
+	}
+	return rs, nil
+}
+
+func fetchReview(ctx *ebert.Context, review *swarm.Review) (*reviewData, error) {
+	comments, err := swarm.GetCommentsForReview(&ctx.Swarm, review.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get comments of review %d: %v", review.ID, err)
+	}
+	d := &reviewData{
+		review:   review,
+		comments: comments.Comments,
+		runs:     map[int]map[int]swarm.TestRun{},
+	}
+	for v := 1; v <= len(review.Versions); v++ {
+		runs, err := swarm.TestRunDetails(&ctx.Swarm, review.ID, v)
+		if err != nil {
+			return nil, fmt.Errorf("could not get test runs of review %d: %v", review.ID, err)
+		}
+		d.runs[v] = runs
+	}
+	return d, nil
+}
+
+// export creates or updates the tables and inserts the rows.
+func export(s sink, rs rows) error {
+	for _, t := range tables {
+		if err := ensureTable(s, t); err != nil {
+			return err
+		}
+	}
+	for _, t := range tables {
+		if len(rs[t.name]) == 0 {
+			continue
+		}
+		if err := s.Insert(t.name, rs[t.name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run(ctx *ebert.Context, s sink, now time.Time) error {
+	store := p4lib.NewKeyStore(ctx.P4, "ebert-metrics")
+	var state exportState
+	if _, err := store.Get("export", &state); err != nil {
+		return err
+	}
+	w := window{from: now.Add(-*backfill), to: now}
+	if state.Time != 0 {
+		w.from = time.Unix(state.Time, 0)
+	}
+	// Rows are only inserted once all reviews were read, so that a failed run exports nothing and
+	// the next one starts from the same time.
+	rs, err := collect(ctx, w)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		log.Infof("%s: %d rows from %v to %v", t.name, len(rs[t.name]), w.from, w.to)
+	}
+	if *dryRun {
+		return nil
+	}
+	if err := export(s, rs); err != nil {
+		return err
+	}
+	return store.Set("export", &exportState{Time: now.Unix()})
+}
+
+func main() {
+	flags.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+
+	if *project == "" {
+		log.Errorf("-project must be set")
+		os.Exit(1)
+	}
+	ctx, err := ebert.NewContext()
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	s, err := newBigQuery(ctx.Ctx, *project, *dataset)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := run(ctx, s, time.Now()); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
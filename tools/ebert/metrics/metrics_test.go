@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/sgetest"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/handlers/unresolved"
+
+	"github.com/google/go-cmp/cmp"
+	bq "google.golang.org/api/bigquery/v2"
+)
+
+func TestAddReview(t *testing.T) {
+	start := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) int {
+		return int(start.Add(d).Unix())
+	}
+	d := &reviewData{
+		review: &swarm.Review{
+			ID:      10,
+			Author:  "alice",
+			Created: at(-time.Hour),
+			Updated: at(5 * time.Hour),
+			State:   "approved",
+			Versions: []swarm.Version{
+				{Change: 100, Time: at(-time.Hour), User: "alice"},
+				{Change: 101, Time: at(2 * time.Hour), User: "alice"},
+			},
+			CommitStatus: swarm.CommitStatus{Change: 102, Committer: "alice", End: at(30 * time.Hour)},
+		},
+		comments: []swarm.Comment{
+			{ID: 1, User: "bob", Time: at(-30 * time.Minute)},
+			{ID: 2, User: "bob", Time: at(time.Hour), Context: &swarm.CommentContext{Version: 2}},
+			{ID: 3, User: "carol", Time: at(3 * time.Hour)},
+			{ID: 4, User: "alice", Time: at(4 * time.Hour)},
+			{ID: 5, User: "nagbot", Time: at(4 * time.Hour), Flags: []string{unresolved.NagFlag}},
+		},
+		runs: map[int]map[int]swarm.TestRun{
+			2: {
+				7: {Test: "presubmit", Status: "fail", StartTime: int64(at(2 * time.Hour)), CompletedTime: int64(at(3 * time.Hour))},
+				8: {Test: "presubmit", Status: "running", StartTime: int64(at(3 * time.Hour))},
+			},
+		},
+	}
+	// The window starts after the review was created and ends before it was committed.
+	rs := rows{}
+	rs.addReview(d, window{from: start, to: start.Add(24 * time.Hour)})
+
+	ids := map[string][]string{}
+	for name, trs := range rs {
+		for _, r := range trs {
+			ids[name] = append(ids[name], r.id)
+		}
+	}
+	want := map[string][]string{
+		"review_events": {
+			"review_events/10/version/2",
+			"review_events/10/comment/2",
+			"review_events/10/comment/3",
+			"review_events/10/comment/4",
+			fmt.Sprintf("review_events/10/state/approved/%d", at(5*time.Hour)),
+		},
+		"presubmits": {
+			"presubmits/10/2/7",
+		},
+		"reviewer_latency": {
+			"reviewer_latency/10/carol",
+		},
+	}
+	if diff := cmp.Diff(want, ids); diff != "" {
+		t.Errorf("row ids diff (-want +got):\n%s", diff)
+	}
+
+	presubmit := rs["presubmits"][0].values
+	if presubmit["status"] != "fail" || presubmit["duration_seconds"] != int64(3600) {
+		t.Errorf("presubmit row = %v, want a failure of 3600s", presubmit)
+	}
+	latency := rs["reviewer_latency"][0].values
+	if latency["latency_seconds"] != 4*3600 || latency["response_time"] != "2021-06-15T15:00:00Z" {
+		t.Errorf("latency row = %v, want a latency of 4h", latency)
+	}
+	comment := rs["review_events"][1].values
+	if comment["version"] != 2 || comment["user"] != "bob" || comment["author"] != "alice" {
+		t.Errorf("comment row = %v, want version 2 by bob on a review of alice", comment)
+	}
+}
+
+// fakeSink is a sink keeping tables in memory.
+type fakeSink struct {
+	schemas map[string]*bq.TableSchema
+	rows    map[string][]row
+}
+
+func (s *fakeSink) Table(name string) (*bq.TableSchema, error) {
+	return s.schemas[name], nil
+}
+
+func (s *fakeSink) CreateTable(t *table) error {
+	s.schemas[t.name] = &bq.TableSchema{Fields: t.fields}
+	return nil
+}
+
+func (s *fakeSink) AddFields(name string, schema *bq.TableSchema) error {
+	s.schemas[name] = schema
+	return nil
+}
+
+func (s *fakeSink) Insert(name string, rows []row) error {
+	s.rows[name] = append(s.rows[name], rows...)
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	s := &fakeSink{
+		schemas: map[string]*bq.TableSchema{
+			// An older version of the table, without the url field.
+			"presubmits": {Fields: presubmitsTable.fields[:len(presubmitsTable.fields)-1]},
+		},
+		rows: map[string][]row{},
+	}
+	rs := rows{}
+	rs.add(eventsTable, "1/created", map[string]bq.JsonValue{"review_id": 1})
+	if err := export(s, rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, tb := range tables {
+		if s.schemas[tb.name] == nil || len(s.schemas[tb.name].Fields) != len(tb.fields) {
+			t.Errorf("table %s has schema %v, want %d fields", tb.name, s.schemas[tb.name], len(tb.fields))
+		}
+	}
+	if got := len(s.rows["review_events"]); got != 1 {
+		t.Errorf("got %d review_events rows, want 1", got)
+	}
+
+	// Fields are never retyped.
+	s.schemas["reviewer_latency"] = &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+		field("review_id", "STRING", "REQUIRED", ""),
+	}}
+	err := export(s, rows{})
+	if err := sgetest.CmpErr(err, "field review_id is REQUIRED STRING"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/handlers/unresolved"
+
+	bq "google.golang.org/api/bigquery/v2"
+)
+
+// table is a BigQuery table the exporter writes to. The schema is stable: fields may be added,
+// always as NULLABLE, but never renamed, retyped or removed, so that dashboards keep working.
+type table struct {
+	name string
+	desc string
+	// partition is the TIMESTAMP field the table is partitioned by, by day.
+	partition string
+	fields    []*bq.TableFieldSchema
+}
+
+func field(name, typ, mode, desc string) *bq.TableFieldSchema {
+	return &bq.TableFieldSchema{Name: name, Type: typ, Mode: mode, Description: desc}
+}
+
+var (
+	eventsTable = &table{
+		name:      "review_events",
+		desc:      "Lifecycle events of Ebert reviews.",
+		partition: "time",
+		fields: []*bq.TableFieldSchema{
+			field("review_id", "INTEGER", "REQUIRED", "Swarm review id."),
+			field("event", "STRING", "REQUIRED", "One of created, version, comment, committed, state."),
+			field("time", "TIMESTAMP", "REQUIRED", "When the event happened."),
+			field("user", "STRING", "NULLABLE", "User who caused the event."),
+			field("author", "STRING", "NULLABLE", "Author of the review."),
+			field("version", "INTEGER", "NULLABLE", "Review version the event applies to."),
+			field("change", "INTEGER", "NULLABLE", "Changelist of the version or of the commit."),
+			field("state", "STRING", "NULLABLE", "State of the review, for state events."),
+		},
+	}
+	presubmitsTable = &table{
+		name:      "presubmits",
+		desc:      "Outcomes of the presubmit test runs of Ebert reviews.",
+		partition: "completed_time",
+		fields: []*bq.TableFieldSchema{
+			field("review_id", "INTEGER", "REQUIRED", "Swarm review id."),
+			field("version", "INTEGER", "REQUIRED", "Review version the presubmit ran on."),
+			field("run_id", "INTEGER", "REQUIRED", "Swarm test run id."),
+			field("test", "STRING", "NULLABLE", "Name of the test run."),
+			field("status", "STRING", "REQUIRED", "Outcome of the test run, eg. pass or fail."),
+			field("start_time", "TIMESTAMP", "NULLABLE", "When the test run started."),
+			field("completed_time", "TIMESTAMP", "REQUIRED", "When the test run completed."),
+			field("duration_seconds", "INTEGER", "NULLABLE", "Duration of the test run."),
+			field("author", "STRING", "NULLABLE", "Author of the review."),
+			field("url", "STRING", "NULLABLE", "Link to the results of the test run."),
+		},
+	}
+	latencyTable = &table{
+		name:      "reviewer_latency",
+		desc:      "Time reviewers of Ebert reviews took to first respond.",
+		partition: "response_time",
+		fields: []*bq.TableFieldSchema{
+			field("review_id", "INTEGER", "REQUIRED", "Swarm review id."),
+			field("reviewer", "STRING", "REQUIRED", "Reviewer who responded."),
+			field("author", "STRING", "NULLABLE", "Author of the review."),
+			field("requested_time", "TIMESTAMP", "REQUIRED", "When the review was requested."),
+			field("response_time", "TIMESTAMP", "REQUIRED", "When the reviewer first commented."),
+			field("latency_seconds", "INTEGER", "REQUIRED", "Time between request and first response."),
+		},
+	}
+	tables = []*table{eventsTable, presubmitsTable, latencyTable}
+)
+
+// row is a row to insert in a table. The id lets BigQuery drop rows inserted twice by retries.
+type row struct {
+	id     string
+	values map[string]bq.JsonValue
+}
+
+// rows are the rows to insert, by table name.
+type rows map[string][]row
+
+func (rs rows) add(t *table, id string, values map[string]bq.JsonValue) {
+	rs[t.name] = append(rs[t.name], row{id: fmt.Sprintf("%s/%s", t.name, id), values: values})
+}
+
+// window is the time range of the events to export, from (exclusive) to (inclusive).
+type window struct {
+	from, to time.Time
+}
+
+func (w window) contains(unix int64) bool {
+	t := time.Unix(unix, 0)
+	return unix > 0 && t.After(w.from) && !t.After(w.to)
+}
+
+func timestamp(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// reviewData is what the rows of a review are derived from.
+type reviewData struct {
+	review   *swarm.Review
+	comments []swarm.Comment
+	// runs are the test runs of the review by version.
+	runs map[int]map[int]swarm.TestRun
+}
+
+// addReview adds the rows of the events of |d| that happened in |w|.
+func (rs rows) addReview(d *reviewData, w window) {
+	r := d.review
+	event := func(id, name string, unix int64, values map[string]bq.JsonValue) {
+		if !w.contains(unix) {
+			return
+		}
+		values["review_id"] = r.ID
+		values["event"] = name
+		values["time"] = timestamp(unix)
+		values["author"] = r.Author
+		rs.add(eventsTable, fmt.Sprintf("%d/%s", r.ID, id), values)
+	}
+
+	event("created", "created", int64(r.Created), map[string]bq.JsonValue{
+		"user":    r.Author,
+		"version": 1,
+	})
+	for i, v := range r.Versions {
+		if i == 0 {
+			continue
+		}
+		event(fmt.Sprintf("version/%d", i+1), "version", int64(v.Time), map[string]bq.JsonValue{
+			"user":    v.User,
+			"version": i + 1,
+			"change":  v.Change,
+		})
+	}
+	comments := reviewComments(d.comments)
+	for _, c := range comments {
+		values := map[string]bq.JsonValue{"user": c.User}
+		if c.Context != nil && c.Context.Version > 0 {
+			values["version"] = int(c.Context.Version)
+		}
+		event(fmt.Sprintf("comment/%d", c.ID), "comment", int64(c.Time), values)
+	}
+	if cs := r.CommitStatus; cs.End > 0 {
+		event(fmt.Sprintf("committed/%d", cs.Change), "committed", int64(cs.End), map[string]bq.JsonValue{
+			"user":   cs.Committer,
+			"change": cs.Change,
+		})
+	}
+	// Swarm doesn't keep the history of states, the current one is reported as of the last update.
+	event(fmt.Sprintf("state/%s/%d", r.State, r.Updated), "state", int64(r.Updated), map[string]bq.JsonValue{
+		"state": r.State,
+	})
+
+	var versions []int
+	for v := range d.runs {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for _, v := range versions {
+		var ids []int
+		for id := range d.runs[v] {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			run := d.runs[v][id]
+			if run.Status == "" || run.Status == "running" || !w.contains(run.CompletedTime) {
+				continue
+			}
+			values := map[string]bq.JsonValue{
+				"review_id":      r.ID,
+				"version":        v,
+				"run_id":         id,
+				"test":           run.Test,
+				"status":         run.Status,
+				"completed_time": timestamp(run.CompletedTime),
+				"author":         r.Author,
+				"url":            run.URL,
+			}
+			if run.StartTime > 0 {
+				values["start_time"] = timestamp(run.StartTime)
+				values["duration_seconds"] = run.CompletedTime - run.StartTime
+			}
+			rs.add(presubmitsTable, fmt.Sprintf("%d/%d/%d", r.ID, v, id), values)
+		}
+	}
+
+	// The latency of a reviewer is the time until their first comment. Swarm doesn't record when
+	// reviewers were added nor when they voted, so the review creation is the request time.
+	first := map[string]int{}
+	for _, c := range comments {
+		if c.User == r.Author {
+			continue
+		}
+		if t, ok := first[c.User]; !ok || c.Time < t {
+			first[c.User] = c.Time
+		}
+	}
+	var reviewers []string
+	for u := range first {
+		reviewers = append(reviewers, u)
+	}
+	sort.Strings(reviewers)
+	for _, u := range reviewers {
+		t := first[u]
+		if !w.contains(int64(t)) || t < r.Created {
+			continue
+		}
+		rs.add(latencyTable, fmt.Sprintf("%d/%s", r.ID, u), map[string]bq.JsonValue{
+			"review_id":       r.ID,
+			"reviewer":        u,
+			"author":          r.Author,
+			"requested_time":  timestamp(int64(r.Created)),
+			"response_time":   timestamp(int64(t)),
+			"latency_seconds": t - r.Created,
+		})
+	}
+}
+
+// reviewComments returns the comments of people on a review, leaving out the reminders of the
+// nag bot.
+func reviewComments(comments []swarm.Comment) []swarm.Comment {
+	var ret []swarm.Comment
+	for _, c := range comments {
+		nag := false
+		for _, f := range c.Flags {
+			if f == unresolved.NagFlag {
+				nag = true
+			}
+		}
+		if !nag {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary nagbot reminds authors and reviewers of open reviews that sit with unresolved comments or
+// without activity for longer than an SLA. It's meant to run as a cron unit, with the same flags and
+// credentials as Ebert.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+	"sge-monorepo/tools/ebert/handlers/draft"
+	"sge-monorepo/tools/ebert/handlers/unresolved"
+)
+
+var (
+	sla    = flag.Duration("sla", 72*time.Hour, "Reviews without activity for longer than this are nagged about.")
+	renag  = flag.Duration("renag", 24*time.Hour, "Minimum time between two reminders on the same review.")
+	dryRun = flag.Bool("dry_run", false, "Log the reminders instead of posting them.")
+	// sgeb passes the invocation proto to cron units, nagbot doesn't need it.
+	_ = flag.String("tool-invocation", "", "Path to the sgeb tool invocation. Unused.")
+)
+
+// nagState is the state kept for each nagged review.
+type nagState struct {
+	// Time is the unix time of the last reminder.
+	Time int64
+}
+
+// nag is a reminder to post on a review.
+type nag struct {
+	users  []string
+	reason string
+}
+
+// decide returns the reminder to post on |review| with comment statistics |stats| at |now|, or nil
+// if none is due. |lastNag| is the time of the last reminder on the review, zero if there was none.
+func decide(review *swarm.Review, stats *unresolved.Stats, now, lastNag time.Time) *nag {
+	if !lastNag.IsZero() && now.Sub(lastNag) < *renag {
+		return nil
+	}
+	lastActivity := review.Updated
+	if stats.LastActivity > lastActivity {
+		lastActivity = stats.LastActivity
+	}
+	idle := now.Sub(time.Unix(int64(lastActivity), 0))
+	if idle < *sla {
+		return nil
+	}
+	idleFor := idle.Truncate(time.Hour)
+	if stats.Unresolved > 0 {
+		// The author has to address comments from reviewers, and reviewers to answer the author.
+		users := map[string]bool{review.Author: true}
+		for u := range stats.ByAuthor {
+			users[u] = true
+		}
+		return &nag{
+			users:  sortedUsers(users),
+			reason: fmt.Sprintf("%d unresolved comment thread(s) without activity for %v", stats.Unresolved, idleFor),
+		}
+	}
+	// Without unresolved comments, the review is waiting on its reviewers.
+	users := map[string]bool{}
+	for u := range review.Participants {
+		if u != review.Author {
+			users[u] = true
+		}
+	}
+	if len(users) == 0 {
+		users[review.Author] = true
+	}
+	return &nag{
+		users:  sortedUsers(users),
+		reason: fmt.Sprintf("no activity for %v", idleFor),
+	}
+}
+
+func sortedUsers(users map[string]bool) []string {
+	var ret []string
+	for u := range users {
+		ret = append(ret, u)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (n *nag) body() string {
+	var mentions []string
+	for _, u := range n.users {
+		mentions = append(mentions, "@"+u)
+	}
+	return fmt.Sprintf("Reminder: this review has %s. %s, please take a look.", n.reason, strings.Join(mentions, " "))
+}
+
+func run(ctx *ebert.Context, now time.Time) error {
+	reviews, err := swarm.GetReviews(&ctx.Swarm, "state[]=needsReview&state[]=needsRevision")
+	if err != nil {
+		return fmt.Errorf("could not get open reviews: %v", err)
+	}
+	// Drafts are waiting on their authors, who know it.
+	drafts, err := draft.All(ctx)
+	if err != nil {
+		return err
+	}
+	store := p4lib.NewKeyStore(ctx.P4, "ebert-nag")
+	failed := 0
+	for i := range reviews.Reviews {
+		review := &reviews.Reviews[i]
+		if drafts[review.ID] != nil {
+			continue
+		}
+		if err := nagReview(ctx, store, review, now); err != nil {
+			log.Warningf("could not nag about review %d: %v", review.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d reviews failed", failed, len(reviews.Reviews))
+	}
+	return nil
+}
+
+func nagReview(ctx *ebert.Context, store *p4lib.KeyStore, review *swarm.Review, now time.Time) error {
+	name := strconv.Itoa(review.ID)
+	var state nagState
+	if _, err := store.Get(name, &state); err != nil {
+		return err
+	}
+	var lastNag time.Time
+	if state.Time != 0 {
+		lastNag = time.Unix(state.Time, 0)
+	}
+	stats, err := unresolved.ForReview(ctx, review.ID)
+	if err != nil {
+		return err
+	}
+	n := decide(review, stats, now, lastNag)
+	if n == nil {
+		return nil
+	}
+	log.Infof("review %d: nagging %v about %s", review.ID, n.users, n.reason)
+	if *dryRun {
+		return nil
+	}
+	comment := &swarm.Comment{
+		Topic: fmt.Sprintf("reviews/%d", review.ID),
+		Body:  n.body(),
+		Flags: []string{unresolved.NagFlag},
+	}
+	if err := swarm.AddComment(&ctx.Swarm, comment); err != nil {
+		return err
+	}
+	return store.Set(name, &nagState{Time: now.Unix()})
+}
+
+func main() {
+	flags.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+
+	ctx, err := ebert.NewContext()
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := run(ctx, time.Now()); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
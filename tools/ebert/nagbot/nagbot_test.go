@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/handlers/unresolved"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecide(t *testing.T) {
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) int {
+		return int(now.Add(-d).Unix())
+	}
+	review := &swarm.Review{
+		ID:     1,
+		Author: "alice",
+		Participants: map[string]swarm.Participant{
+			"alice": {},
+			"bob":   {},
+			"carol": {},
+		},
+	}
+	testCases := []struct {
+		desc      string
+		updated   int
+		stats     unresolved.Stats
+		lastNag   time.Time
+		wantUsers []string
+	}{
+		{
+			desc:    "recent activity",
+			updated: ago(time.Hour),
+			stats:   unresolved.Stats{Unresolved: 1, ByAuthor: map[string]int{"bob": 1}},
+		},
+		{
+			desc:      "idle with unresolved comments",
+			updated:   ago(100 * time.Hour),
+			stats:     unresolved.Stats{Unresolved: 2, ByAuthor: map[string]int{"bob": 1, "alice": 1}},
+			wantUsers: []string{"alice", "bob"},
+		},
+		{
+			desc:    "recent comment on idle review",
+			updated: ago(100 * time.Hour),
+			stats:   unresolved.Stats{Unresolved: 1, ByAuthor: map[string]int{"bob": 1}, LastActivity: ago(time.Hour)},
+		},
+		{
+			desc:      "idle without comments",
+			updated:   ago(100 * time.Hour),
+			wantUsers: []string{"bob", "carol"},
+		},
+		{
+			desc:    "nagged recently",
+			updated: ago(100 * time.Hour),
+			lastNag: now.Add(-time.Hour),
+		},
+		{
+			desc:      "nagged long ago",
+			updated:   ago(100 * time.Hour),
+			lastNag:   now.Add(-48 * time.Hour),
+			wantUsers: []string{"bob", "carol"},
+		},
+	}
+	for _, tc := range testCases {
+		r := *review
+		r.Updated = tc.updated
+		n := decide(&r, &tc.stats, now, tc.lastNag)
+		var got []string
+		if n != nil {
+			got = n.users
+		}
+		if diff := cmp.Diff(tc.wantUsers, got); diff != "" {
+			t.Errorf("[%s] nagged users mismatch (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
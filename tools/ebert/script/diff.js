@@ -228,7 +228,16 @@ function diffLines(file, diff, pairs, comments) {
       }
     }
     if (ci.comment.context.rightLine != 0) {
-      const i = matchContext(ci.comment.context, lines, rightlines, 'right');
+      // Comments made on other versions are placed where their anchor maps them, and not at all
+      // if their line was changed since.
+      let context = ci.comment.context;
+      if (ci.anchor && ci.anchor.outdated) {
+        continue;
+      }
+      if (ci.anchor) {
+        context = Object.assign({}, context, { rightLine: ci.anchor.line });
+      }
+      const i = matchContext(context, lines, rightlines, 'right');
       if (i >= 0 && i < lines.length) {
         let j = 0;
         for (; j < lines[i].comments.length; j++) {
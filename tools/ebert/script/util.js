@@ -38,39 +38,157 @@ function ReviewColor(review) {
   }
 }
 
-function Linkify(rawDescription) {
-  const regexs = [{
-    // web links:
-    // - start with whitespace (tab, space, newline), colon, semi,
-    //   dash, open paren, open bracket
-    // - followed by the literal "http://" or "https://"
-    // - end with 1 or more non-whitespace, close-paren, close bracket
-    re: /[\s:;(\[-](https?:\/\/[^\s)\]]+)/g,
-    subfunc: (match) =>
-      `<a target='_blank' href='${match}'>${match}</a>`,
-  }, {
-    // Bug links:
-    // - start with whitespace (tab, space, newline), colon, semi,
-    //   dash, open paren, open bracket
-    // - followed by the literal "b/"
-    // - end with 1 or more digits
-    re: /[\s:;(\[-](b\/\d+)/g,
-    subfunc: (match) =>
-      `<a target='_blank' href='http://${match}'>${match}</a>`,
-  }];
+// EscapeHTML escapes |text| for use in HTML.
+function EscapeHTML(text) {
+  return text.replace(/[&<>"']/g, (c) => ({
+    '&': '&amp;',
+    '<': '&lt;',
+    '>': '&gt;',
+    '"': '&quot;',
+    "'": '&#39;',
+  })[c]);
+}
+
+// Linkify returns |rawText| as HTML, turning web and bug links into anchors, as
+// well as the |links| to external systems found by the server, if any.
+function Linkify(rawText, links) {
+  // Web and bug links:
+  // - start with whitespace (tab, space, newline), colon, semi,
+  //   dash, open paren, open bracket
+  // - followed by the literal "http://" or "https://" and 1 or more
+  //   non-whitespace, close-paren, close bracket, for web links
+  // - or followed by the literal "b/" and 1 or more digits, for bug links
+  const re = /([\s:;(\[-])(?:(https?:\/\/[^\s)\]]+)|(b\/\d+))/g;
+  const anchor = (url, text) =>
+    `<a target='_blank' href='${EscapeHTML(url)}'>${EscapeHTML(text)}</a>`;
+  const linkifyText = (text) => {
+    let html = '';
+    let last = 0;
+    for (const match of text.matchAll(re)) {
+      const [all, before, web, bug] = match;
+      html += EscapeHTML(text.slice(last, match.index) + before);
+      html += web ? anchor(web, web) : anchor(`http://${bug}`, bug);
+      last = match.index + all.length;
+    }
+    return html + EscapeHTML(text.slice(last));
+  };
 
-  let linkified = rawDescription;
+  // The server reports links by their byte offsets in the UTF-8 text.
+  const bytes = new TextEncoder().encode(rawText || '');
+  const decoder = new TextDecoder();
+  let html = '';
+  let last = 0;
+  for (const link of links || []) {
+    if (link.start < last) {
+      continue;
+    }
+    html += linkifyText(decoder.decode(bytes.subarray(last, link.start)));
+    html += anchor(link.url, decoder.decode(bytes.subarray(link.start, link.end)));
+    last = link.end;
+  }
+  return html + linkifyText(decoder.decode(bytes.subarray(last)));
+}
 
-  regexs.forEach((regex) => {
-    let matches = linkified.matchAll(regex.re);
-    let matched = {};
-    for (const match of matches) {
-      if (matched[match[1]]) {
-        continue;
+// BatchFetch resolves several ebert REST requests in a single round trip.
+// |requests| maps an id to either a path or a {method, path, body} object.
+// Returns a promise of an object mapping each id to its decoded response.
+// Requests that failed map to an Error with the status of the response.
+// Batches larger than the server accepts are split, and sent concurrently.
+function BatchFetch(requests) {
+  const batch = Object.entries(requests).map(([id, req]) =>
+    Object.assign({id: id}, typeof req === 'string' ? {path: req} : req));
+  let chunks = [];
+  for (let i = 0; i < batch.length; i += MAX_BATCH_SIZE) {
+    chunks.push(batch.slice(i, i + MAX_BATCH_SIZE));
+  }
+  return Promise.all(chunks.map(fetchBatch)).then(function(responses) {
+    let results = {};
+    for (const response of responses.flat()) {
+      if (response.status >= 200 && response.status < 300) {
+        results[response.id] = response.data;
+      } else {
+        results[response.id] = new Error(response.error);
+        results[response.id].status = response.status;
       }
-      matched[match[1]] = true;
-      linkified = linkified.replaceAll(match[1], regex.subfunc(match[1]));
     }
-  })
-  return linkified;
+    return results;
+  });
+}
+
+// MAX_BATCH_SIZE is the most requests /ebert/batch takes at once, see
+// handlers.MaxBatchSize.
+const MAX_BATCH_SIZE = 32;
+
+function fetchBatch(batch) {
+  return fetch('/ebert/batch', {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json'
+    },
+    body: JSON.stringify(batch),
+  }).then(function(res) {
+    ShowP4Warnings(res);
+    ShowSwarmState(res);
+    if (!res.ok) {
+      return res.text().then(msg => { throw msg });
+    }
+    return res.json();
+  });
+}
+
+// ShowSwarmState shows a "Swarm degraded" banner while the Swarm circuit
+// breaker of the server, attached to the fetch response |res|, isn't closed:
+// requests to Swarm fail fast instead of timing out. The banner goes away once
+// a response says Swarm is back.
+function ShowSwarmState(res) {
+  const state = res.headers.get('X-Ebert-Swarm-State');
+  let banner = document.getElementById('swarm-degraded');
+  if (!state) {
+    if (banner) {
+      banner.remove();
+    }
+    return;
+  }
+  if (!banner) {
+    banner = document.createElement('div');
+    banner.id = 'swarm-degraded';
+    banner.className = 'swarm-degraded';
+    document.body.prepend(banner);
+  }
+  banner.textContent = state === 'open' ?
+    'Swarm degraded: reviews can\'t be loaded or updated until it recovers.' :
+    'Swarm degraded: checking whether it recovered.';
+}
+
+// ShowP4Warnings shows the advisory messages of the Perforce server, eg.
+// maintenance windows, that the server attached to the fetch response |res|.
+// Each message is shown once per page in a banner at the top of the page.
+function ShowP4Warnings(res) {
+  const header = res.headers.get('X-Ebert-P4-Warnings');
+  if (!header) {
+    return;
+  }
+  let warnings;
+  try {
+    warnings = JSON.parse(header);
+  } catch (e) {
+    console.warn('invalid p4 warnings', header, e);
+    return;
+  }
+  let banner = document.getElementById('p4-warnings');
+  if (!banner) {
+    banner = document.createElement('div');
+    banner.id = 'p4-warnings';
+    banner.className = 'p4-warnings';
+    document.body.prepend(banner);
+  }
+  for (const w of warnings) {
+    const text = `Perforce ${w.kind}: ${w.message}`;
+    if ([...banner.children].some(el => el.textContent === text)) {
+      continue;
+    }
+    const el = document.createElement('div');
+    el.textContent = text;
+    banner.appendChild(el);
+  }
 }
@@ -33,9 +33,11 @@ import (
 
 	"sge-monorepo/libs/go/log"
 	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
 	"sge-monorepo/tools/ebert/ebert"
 	"sge-monorepo/tools/ebert/flags"
 	"sge-monorepo/tools/ebert/handlers"
+	"sge-monorepo/tools/ebert/handlers/tokens"
 
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats/view"
@@ -48,6 +50,12 @@ var assetsFS embed.FS
 
 const (
 	avatarUrlFmt = "https://picsum.photos/200"
+	// p4WarningsHeader holds the advisory messages of the Perforce server printed while serving a
+	// request, as a JSON list of p4lib.Warning.
+	p4WarningsHeader = "X-Ebert-P4-Warnings"
+	// swarmStateHeader holds the state of the Swarm circuit breaker when it isn't closed, eg.
+	// "open", for the UI to show that Swarm is degraded.
+	swarmStateHeader = "X-Ebert-Swarm-State"
 )
 
 var (
@@ -67,6 +75,8 @@ func handleError(w http.ResponseWriter, err error) {
 	if errors.As(err, &e) {
 		log.Errorf("underlying error: %v", e.Unwrap())
 		code = e.Code
+	} else if errors.Is(err, swarm.ErrCircuitOpen) {
+		code = http.StatusServiceUnavailable
 	} else {
 		log.Errorf("error: %v", err)
 	}
@@ -179,7 +189,7 @@ func newWebui(ctx *ebert.Context, port int, done chan struct{}) (*http.Server, e
 		},
 	})
 
-	mux := &handlers.Mux{}
+	mux := &handlers.Mux{Authorize: tokens.Authorize}
 	// for path, h := range dotfns {
 	// 	matches := patternRE.FindStringSubmatchIndex(path)
 	// 	name := path[:matches[3]]
@@ -229,12 +239,16 @@ func newWebui(ctx *ebert.Context, port int, done chan struct{}) (*http.Server, e
 			return nil, fmt.Errorf("couldn't install handler for %s: %w", pattern, err)
 		}
 	}
+	// The batch endpoint resolves several of the above requests in a single round trip.
+	if err := mux.Handle("/ebert/batch", handlers.Batch(mux)); err != nil {
+		return nil, fmt.Errorf("couldn't install batch handler: %w", err)
+	}
 
 	// The mux is used at the root handler -- any path that doesn't match
 	// another handler is first checked against the mux, and if that fails,
 	// show the not found page.  Everything using the mux is authenticated and
 	// instrumented
-	http.Handle("/", authenticate(servePages(ctx, mux)))
+	http.Handle("/", authenticate(ctx, servePages(ctx, mux)))
 
 	return ui, nil
 }
@@ -246,6 +260,15 @@ func servePages(baseCtx *ebert.Context, mux *handlers.Mux) http.Handler {
 		}
 		ctx := baseCtx.Trace(r)
 		out, err := mux.Serve(ctx, r)
+		if warnings := ctx.P4Warnings.List(); len(warnings) > 0 {
+			// The UI shows the advisory messages of the server, eg. maintenance windows.
+			if data, err := json.Marshal(warnings); err == nil {
+				w.Header().Set(p4WarningsHeader, string(data))
+			}
+		}
+		if state := ctx.Swarm.Breaker.Status().State; state != swarm.BreakerClosed {
+			w.Header().Set(swarmStateHeader, state.String())
+		}
 		if err != nil {
 			if errors.Is(err, handlers.ErrRouteNotFound) && r.URL.Path != "/" {
 				w.WriteHeader(http.StatusNotFound)
@@ -260,6 +283,15 @@ func servePages(baseCtx *ebert.Context, mux *handlers.Mux) http.Handler {
 			}
 			return
 		}
+		if blob, ok := out.(*ebert.Blob); ok {
+			w.Header().Set("Content-Type", blob.ContentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			if blob.Download {
+				w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": blob.Name}))
+			}
+			w.Write(blob.Data)
+			return
+		}
 		if raw, ok := out.([]byte); ok {
 			// If the mux gives back raw bytes, don't try JSON encoding.
 			// Assume things are already encoded and just pass it through.
@@ -279,7 +311,7 @@ func servePages(baseCtx *ebert.Context, mux *handlers.Mux) http.Handler {
 		}
 	})
 }
-func authenticate(handler http.Handler) http.Handler {
+func authenticate(ctx *ebert.Context, handler http.Handler) http.Handler {
 	instrumentedHandler := &ochttp.Handler{
 		Handler:          handler,
 		IsPublicEndpoint: true,
@@ -287,10 +319,18 @@ func authenticate(handler http.Handler) http.Handler {
 	}
 
 	if flags.DevMode {
-		return instrumentedHandler
+		return tokens.Middleware(ctx, instrumentedHandler)
 	}
 
-	return newHandler(instrumentedHandler, !flags.DevMode, http.StatusUnauthorized)
+	sessions := newHandler(instrumentedHandler, !flags.DevMode, http.StatusUnauthorized)
+	// Requests with an API token are authenticated by the token rather than by a session.
+	return tokens.Middleware(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := tokens.FromRequest(r); ok {
+			instrumentedHandler.ServeHTTP(w, r)
+			return
+		}
+		sessions.ServeHTTP(w, r)
+	}))
 }
 
 // newHandler wraps an existing http.Handler.
@@ -367,6 +367,17 @@ func fetchActionDashboard(ctx *gigantickContext) {
 	ctx.dashboardReviewsChan <- r
 }
 
+func flushSwarmQueue(ctx *gigantickContext) {
+	defer goRoutineUnregister(ctx, goRoutineRegister(ctx, "swarm queue", ctx.username))
+	n, err := ctx.swarm.Queue.Flush(&ctx.swarm)
+	if err != nil {
+		glog.Warningf("could not send queued swarm comments: %v", err)
+	}
+	if n > 0 {
+		glog.Infof("sent %d queued swarm comments", n)
+	}
+}
+
 func fetchFileData(ctx *gigantickContext, fd *fileData) {
 	defer goRoutineUnregister(ctx, goRoutineRegister(ctx, "print", fd.filename))
 	s, err := ctx.p4.Print(fd.filename)
@@ -475,6 +486,13 @@ func swarmInit(ctx *gigantickContext) error {
 		Username: gContext.username,
 		Password: ticket.ID,
 	}
+	// Comments made while Swarm is unreachable, eg. over a flaky VPN, are sent later.
+	if q, err := swarm.UserQueue(); err != nil {
+		glog.Warningf("could not open swarm queue: %v", err)
+	} else {
+		ctx.swarm.Queue = q
+		go flushSwarmQueue(ctx)
+	}
 
 	fetchReviewsForChangelists(ctx, ctx.pendingChanges)
 	fetchReviewsForChangelists(ctx, ctx.submittedChanges)
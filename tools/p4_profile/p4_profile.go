@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary p4_profile switches a Perforce client between the view profiles of a profiles file in
+// the depot, eg. "code" or "editor", keeping the personal mappings of the client.
+//
+// Usage:
+//      p4_profile -profiles=//depot/p4profiles.json list
+//      p4_profile -profiles=//depot/p4profiles.json plan editor
+//      p4_profile -profiles=//depot/p4profiles.json apply [-sync] editor
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"sge-monorepo/libs/go/p4lib"
+)
+
+func printChange(change *p4lib.ProfileChange) {
+	from := change.From
+	if from == "" {
+		from = "no profile"
+	}
+	fmt.Printf("Client %s: %s -> %s\n", change.Client, from, change.Profile)
+	for _, e := range change.Added {
+		fmt.Printf("  + %s %s\n", e.Source, e.Destination)
+	}
+	for _, e := range change.Removed {
+		fmt.Printf("  - %s %s\n", e.Source, e.Destination)
+	}
+	if change.FileDelta != 0 || change.SizeDelta != 0 {
+		fmt.Printf("Sync delta: %+d files, %+d bytes (estimated)\n", change.FileDelta, change.SizeDelta)
+	}
+}
+
+func run() error {
+	profilesPath := flag.String("profiles", "", "Depot path of the view profiles file.")
+	client := flag.String("client", "", "Client to change. Defaults to the current client.")
+	flag.Parse()
+	if *profilesPath == "" || flag.NArg() == 0 {
+		return fmt.Errorf("usage: p4_profile -profiles=<depot path> list|plan <profile>|apply [-sync] <profile>")
+	}
+	p4 := p4lib.New()
+	ps, err := p4lib.LoadViewProfiles(p4, *profilesPath)
+	if err != nil {
+		return err
+	}
+	switch flag.Arg(0) {
+	case "list":
+		c, err := p4.Client(*client)
+		if err != nil {
+			return err
+		}
+		current := ps.Current(c)
+		for _, p := range ps.Profiles {
+			marker := " "
+			if p.Name == current {
+				marker = "*"
+			}
+			fmt.Printf("%s %-20s %s\n", marker, p.Name, p.Description)
+		}
+		return nil
+	case "plan":
+		if flag.NArg() != 2 {
+			return fmt.Errorf("usage: p4_profile plan <profile>")
+		}
+		change, err := ps.PlanProfile(p4, *client, flag.Arg(1))
+		if err != nil {
+			return err
+		}
+		printChange(change)
+		return nil
+	case "apply":
+		flagSet := flag.NewFlagSet("apply", flag.ExitOnError)
+		sync := flagSet.Bool("sync", false, "Sync the client after changing its view, restoring the previous view if the sync fails.")
+		_ = flagSet.Parse(flag.Args()[1:])
+		if flagSet.NArg() != 1 {
+			return fmt.Errorf("usage: p4_profile apply [-sync] <profile>")
+		}
+		change, err := ps.ApplyProfile(p4, *client, flagSet.Arg(0), *sync)
+		if err != nil {
+			return err
+		}
+		printChange(change)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", flag.Arg(0))
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -144,12 +144,15 @@ func updateMetadataFile(mrRoot, path string, localRepo bool, metadata *metadatap
 	return nil
 }
 
-// createCl creates a CL containing changes to a given path.
-func createCl(root, pkgName, pkgPath string) error {
+// createCl creates a CL containing changes to a given path, or opens them in |cl| if not 0.
+func createCl(root, pkgName, pkgPath string, cl int) error {
 	p4 := p4lib.New()
-	cl, err := p4.Change(fmt.Sprintf("vendor %s into %s", pkgName, pkgPath))
-	if err != nil {
-		return fmt.Errorf("p4 changelist creation failed: %v", err)
+	if cl == 0 {
+		var err error
+		cl, err = p4.Change(fmt.Sprintf("vendor %s into %s", pkgName, pkgPath))
+		if err != nil {
+			return fmt.Errorf("p4 changelist creation failed: %v", err)
+		}
 	}
 	if _, err := p4.Reconcile([]string{filepath.Join(pkgPath, "...")}, cl); err != nil {
 		return fmt.Errorf("p4 add failed: %v", err)
@@ -239,7 +242,7 @@ func syncPackage(ctx *context, pkgPath, oldPkgPath, repoDeclPath string, entry *
 	if err := files.CopyDir(tempDir, pkgPath); err != nil {
 		return fmt.Errorf("failed to copy temporary package sync location to its final destinaltion (\"%s\" -> \"%s\", reason: %v)", tempDir, pkgPath, err)
 	}
-	if err := createCl(ctx.mrRoot, entry.Name, pkgPath); err != nil {
+	if err := createCl(ctx.mrRoot, entry.Name, pkgPath, ctx.cl); err != nil {
 		return fmt.Errorf("failed to create Changelist for the change. %q %q", tempDir, pkgPath)
 	}
 	if repoDeclPath != "" {
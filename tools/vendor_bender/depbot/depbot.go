@@ -0,0 +1,235 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary depbot proposes updates of the third party dependencies of the monorepo: the packages
+// vendored with vendor_bender and the requirements of the go.mod. For each dependency with a newer
+// upstream version, it creates a changelist with the update, opens a review for the owners of the
+// dependency and runs presubmit on it. It's meant to run as a cron unit, with the same flags and
+// credentials as Ebert.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/build/owners"
+	"sge-monorepo/libs/go/log"
+	"sge-monorepo/libs/go/p4lib"
+	"sge-monorepo/libs/go/swarm"
+	"sge-monorepo/tools/ebert/ebert"
+	"sge-monorepo/tools/ebert/flags"
+	"sge-monorepo/tools/ebert/handlers/review"
+	"sge-monorepo/tools/vendor_bender/git"
+	"sge-monorepo/tools/vendor_bender/golang"
+)
+
+var (
+	dryRun       = flag.Bool("dry_run", false, "Log the updates instead of proposing them.")
+	maxUpdates   = flag.Int("max_updates", 5, "Maximum number of updates proposed per run.")
+	modules      = flag.Bool("go_mod", true, "Also update the requirements of the monorepo go.mod.")
+	reviewers    = flag.String("reviewers", "", "Comma separated reviewers of dependencies without OWNERS.")
+	vendorBender = flag.String("vendor_bender", "bin/windows/vendor_bender.exe", "Path of vendor_bender, relative to the monorepo root.")
+	verbose      = flag.Bool("verbose", false, "Print the commands run to look up and vendor dependencies.")
+	// sgeb passes the invocation proto to cron units, depbot doesn't need it.
+	_ = flag.String("tool-invocation", "", "Path to the sgeb tool invocation. Unused.")
+)
+
+// proposal is the state kept for each dependency an update was proposed for.
+type proposal struct {
+	// Version is the proposed version.
+	Version string
+	// Review is the review of the update.
+	Review int
+}
+
+// toolUpstream looks up dependencies with the go and git tools.
+type toolUpstream struct {
+	mrRoot string
+}
+
+func (t *toolUpstream) goVersion(modPath string) (string, error) {
+	v, _, err := golang.ModVersion(t.mrRoot, modPath, "latest", *verbose)
+	return v, err
+}
+
+func (t *toolUpstream) gitCommit(url, ref string) (string, error) {
+	return git.CommitFromRef(t.mrRoot, url, ref, *verbose)
+}
+
+func (t *toolUpstream) moduleUpdates() ([]golang.ModuleUpdate, error) {
+	return golang.ModuleUpdates(t.mrRoot, *verbose)
+}
+
+func run(ctx *ebert.Context, mr monorepo.Monorepo) error {
+	updates, err := findUpdates(mr, &toolUpstream{mrRoot: mr.Root}, *modules, log.Warningf)
+	if err != nil {
+		return fmt.Errorf("could not find updates: %v", err)
+	}
+	store := p4lib.NewKeyStore(ctx.P4, "depbot")
+	proposed, failed := 0, 0
+	for _, u := range updates {
+		if proposed >= *maxUpdates {
+			log.Infof("proposed %d updates, leaving the others for the next run", proposed)
+			break
+		}
+		var prev proposal
+		if _, err := store.Get(u.key(), &prev); err != nil {
+			return err
+		}
+		if prev.Version == u.to {
+			continue
+		}
+		log.Infof("%s: updating %s from %s to %s", u.file, u.name, u.from, u.to)
+		if *dryRun {
+			continue
+		}
+		rid, err := propose(ctx, mr, u, prev.Review)
+		if err != nil {
+			log.Warningf("could not propose update of %s: %v", u.name, err)
+			failed++
+			continue
+		}
+		proposed++
+		if err := store.Set(u.key(), &proposal{Version: u.to, Review: rid}); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d updates failed", failed, failed+proposed)
+	}
+	return nil
+}
+
+// propose creates a changelist updating a dependency as described by |u|, opens a review for the
+// owners of the dependency and runs presubmit on it. Returns the ID of the review. |previous| is
+// the review of an earlier update of the dependency, 0 if none.
+func propose(ctx *ebert.Context, mr monorepo.Monorepo, u *update, previous int) (int, error) {
+	desc := description(u, previous)
+	cl, err := ctx.P4.Change(desc)
+	if err != nil {
+		return 0, fmt.Errorf("could not create changelist: %v", err)
+	}
+	// Files are only kept shelved, so the workspace is clean for the next update.
+	defer func() {
+		if _, err := ctx.P4.Revert([]string{"//..."}, "-w", "-c", strconv.Itoa(cl)); err != nil {
+			log.Warningf("could not revert change %d: %v", cl, err)
+		}
+	}()
+	if err := apply(ctx.P4, mr, u, cl); err != nil {
+		return 0, err
+	}
+	if _, err := ctx.P4.ExecCmd("shelve", "-f", "-c", strconv.Itoa(cl)); err != nil {
+		return 0, fmt.Errorf("could not shelve change %d: %v", cl, err)
+	}
+	reviewers, err := ownersOf(mr, u.file)
+	if err != nil {
+		return 0, err
+	}
+	r, err := swarm.CreateReview(&ctx.Swarm, &swarm.NewReview{
+		Change:      cl,
+		Description: desc,
+		Reviewers:   reviewers,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not create review of change %d: %v", cl, err)
+	}
+	log.Infof("review %d: updating %s, assigned to %v", r.ID, u.name, reviewers)
+	if _, err := review.RunPresubmit(ctx, r.ID, nil); err != nil {
+		// The review is still useful, presubmit can be run from Ebert.
+		log.Warningf("could not run presubmit on review %d: %v", r.ID, err)
+	}
+	return r.ID, nil
+}
+
+// apply makes the update |u| in changelist |cl|.
+func apply(p4 p4lib.P4, mr monorepo.Monorepo, u *update, cl int) error {
+	if u.kind == goModule {
+		files := []string{mr.ResolvePath("go.mod"), mr.ResolvePath("go.sum")}
+		if _, err := p4.Edit(files, cl); err != nil {
+			return fmt.Errorf("could not open go.mod for edit: %v", err)
+		}
+		return golang.GetModule(mr.Root, u.name, u.to, *verbose)
+	}
+	mf := mr.ResolvePath(u.file)
+	if _, err := p4.Edit([]string{mf}, cl); err != nil {
+		return fmt.Errorf("could not open %s for edit: %v", u.file, err)
+	}
+	in, err := ioutil.ReadFile(mf)
+	if err != nil {
+		return err
+	}
+	out, err := bumpManifest(string(in), u.name, u.from, u.to)
+	if err != nil {
+		return fmt.Errorf("could not update %s: %v", u.file, err)
+	}
+	if err := ioutil.WriteFile(mf, []byte(out), 0644); err != nil {
+		return err
+	}
+	// vendor_bender syncs the package to the new manifest and opens the changes in |cl|.
+	cmd := exec.Command(mr.ResolvePath(monorepo.NewPath(*vendorBender)), "vendor", fmt.Sprintf("-cl=%d", cl))
+	cmd.Dir = mr.Root
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("vendor_bender failed: %v\n%s", err, output)
+	}
+	return nil
+}
+
+// ownersOf returns the reviewers of a change to |file|: the users of its closest OWNERS file or the
+// -reviewers if there is none.
+func ownersOf(mr monorepo.Monorepo, file monorepo.Path) ([]string, error) {
+	set, err := owners.FindClosestOwnersForFile(mr, file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read owners of %s: %v", file, err)
+	}
+	var users []string
+	for _, owner := range set.Sorted() {
+		if owner == "" {
+			continue
+		}
+		// OWNERS list emails, Swarm wants users.
+		users = append(users, strings.SplitN(owner, "@", 2)[0])
+	}
+	if len(users) == 0 && *reviewers != "" {
+		users = strings.Split(*reviewers, ",")
+	}
+	return users, nil
+}
+
+func main() {
+	flags.Parse()
+	log.AddSink(log.NewGlog())
+	defer log.Shutdown()
+
+	mr, _, err := monorepo.NewFromPwd()
+	if err != nil {
+		log.Errorf("could not find the monorepo: %v", err)
+		os.Exit(1)
+	}
+	ctx, err := ebert.NewContext()
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := run(ctx, mr); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
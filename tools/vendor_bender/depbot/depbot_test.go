@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/tools/vendor_bender/golang"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testManifest = `# Pinned to releases.
+manifest_entry:  {
+  name:  "com_github_foo_bar"
+  go_src:  {
+    import_path:  "github.com/foo/bar"
+    version:  "v1.2.0"
+  }
+}
+manifest_entry:  {
+  name:  "baz"
+  git_src:  {
+    url:  "https://github.com/foo/baz.git"
+    ref:  "main"
+    commit:  "1111111111111111111111111111111111111111"
+  }
+}
+manifest_entry:  {
+  name:  "pinned"
+  git_src:  {
+    url:  "https://github.com/foo/pinned"
+    commit:  "2222222222222222222222222222222222222222"
+  }
+}
+manifest_entry:  {
+  name:  "com_github_foo_head"
+  go_src:  {
+    import_path:  "github.com/foo/head"
+    version:  "v1.2.1-0.20210301120000-abcdefabcdef"
+  }
+}
+`
+
+type fakeUpstream struct {
+	versions map[string]string
+	commits  map[string]string
+	modules  []golang.ModuleUpdate
+}
+
+func (f *fakeUpstream) goVersion(modPath string) (string, error) {
+	return f.versions[modPath], nil
+}
+
+func (f *fakeUpstream) gitCommit(url, ref string) (string, error) {
+	return f.commits[url+"@"+ref], nil
+}
+
+func (f *fakeUpstream) moduleUpdates() ([]golang.ModuleUpdate, error) {
+	return f.modules, nil
+}
+
+func writeFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindUpdates(t *testing.T) {
+	root, err := ioutil.TempDir("", "depbot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFile(t, filepath.Join(root, "third_party/go/MANIFEST"), testManifest)
+	// Manifests within vendored packages aren't vendor_bender's.
+	writeFile(t, filepath.Join(root, "third_party/go/bar/METADATA"), "")
+	writeFile(t, filepath.Join(root, "third_party/go/bar/MANIFEST"), `manifest_entry: { name: "nested" go_src: { import_path: "nested" version: "v0.1.0" } }`)
+	mr := monorepo.New(root, map[string]monorepo.Path{})
+
+	up := &fakeUpstream{
+		versions: map[string]string{
+			"github.com/foo/bar":  "v1.3.0",
+			"github.com/foo/head": "v1.2.0",
+			"nested":              "v0.2.0",
+		},
+		commits: map[string]string{
+			"https://github.com/foo/baz.git@main": "3333333333333333333333333333333333333333",
+		},
+		modules: []golang.ModuleUpdate{{Path: "golang.org/x/text", Version: "v0.3.5", Update: "v0.3.6"}},
+	}
+	warn := func(format string, args ...interface{}) {
+		t.Errorf("unexpected warning: "+format, args...)
+	}
+	got, err := findUpdates(mr, up, true, warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf := monorepo.NewPath("third_party/go/MANIFEST")
+	want := []*update{
+		{kind: goEntry, name: "com_github_foo_bar", file: mf, source: "github.com/foo/bar", from: "v1.2.0", to: "v1.3.0"},
+		{kind: gitEntry, name: "baz", file: mf, source: "https://github.com/foo/baz.git", from: "1111111111111111111111111111111111111111", to: "3333333333333333333333333333333333333333"},
+		{kind: goModule, name: "golang.org/x/text", file: "go.mod", source: "golang.org/x/text", from: "v0.3.5", to: "v0.3.6"},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(update{})); diff != "" {
+		t.Errorf("unexpected updates (-want +got):\n%s", diff)
+	}
+}
+
+func TestBumpManifest(t *testing.T) {
+	got, err := bumpManifest(testManifest, "baz", "1111111111111111111111111111111111111111", "3333333333333333333333333333333333333333")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(testManifest, `"1111111111111111111111111111111111111111"`, `"3333333333333333333333333333333333333333"`, 1)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected manifest (-want +got):\n%s", diff)
+	}
+	// Versions of other entries aren't changed.
+	if _, err := bumpManifest(testManifest, "baz", "v1.2.0", "v1.3.0"); err == nil {
+		t.Errorf("bumping the version of another entry: got no error")
+	}
+	if _, err := bumpManifest(testManifest, "missing", "v1.2.0", "v1.3.0"); err == nil {
+		t.Errorf("bumping a missing entry: got no error")
+	}
+}
+
+func TestDescription(t *testing.T) {
+	u := &update{
+		kind:   goEntry,
+		name:   "com_github_foo_head",
+		file:   "third_party/go/MANIFEST",
+		source: "github.com/foo/head",
+		from:   "v1.2.1-0.20210301120000-abcdefabcdef",
+		to:     "v1.3.0",
+	}
+	want := `Update com_github_foo_head from v1.2.1-0.20210301120000-abcdefabcdef to v1.3.0
+
+Dependency update proposed by depbot. github.com/foo/head is declared in //third_party/go/MANIFEST.
+
+Upstream changes:
+  https://pkg.go.dev/github.com/foo/head@v1.3.0
+  https://github.com/foo/head/compare/abcdefabcdef...v1.3.0
+
+Supersedes review 42.
+`
+	if diff := cmp.Diff(want, description(u, 42)); diff != "" {
+		t.Errorf("unexpected description (-want +got):\n%s", diff)
+	}
+}
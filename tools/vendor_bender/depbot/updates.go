@@ -0,0 +1,270 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"sge-monorepo/build/cicd/monorepo"
+	"sge-monorepo/tools/vendor_bender/golang"
+	"sge-monorepo/tools/vendor_bender/protos/manifestpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-version"
+)
+
+// updateKind is the kind of dependency an update is for.
+type updateKind int
+
+const (
+	// goEntry is a go_src entry of a vendor_bender MANIFEST.
+	goEntry updateKind = iota
+	// gitEntry is a git_src entry of a vendor_bender MANIFEST.
+	gitEntry
+	// goModule is a requirement of the monorepo go.mod.
+	goModule
+)
+
+// update is a newer upstream version of a dependency.
+type update struct {
+	kind updateKind
+	// name is the name of the manifest entry or the path of the Go module.
+	name string
+	// file is the MANIFEST or go.mod declaring the dependency.
+	file monorepo.Path
+	// source is the import path of Go dependencies, the URL of git ones.
+	source string
+	// from and to are the current and new versions, commits for git entries.
+	from, to string
+}
+
+// key identifies the dependency of an update across runs.
+func (u *update) key() string {
+	return fmt.Sprintf("%s:%s", u.file, u.name)
+}
+
+// upstream looks up the latest versions of dependencies.
+type upstream interface {
+	// goVersion returns the latest version of Go module |modPath|.
+	goVersion(modPath string) (string, error)
+	// gitCommit returns the commit |ref| of git repository |url| points to.
+	gitCommit(url, ref string) (string, error)
+	// moduleUpdates returns the requirements of the monorepo go.mod with newer versions.
+	moduleUpdates() ([]golang.ModuleUpdate, error)
+}
+
+// findUpdates returns the dependencies of the monorepo that have newer upstream versions: the
+// entries of the MANIFEST files under //third_party, then the requirements of the go.mod if
+// |modules| is set. Dependencies that can't be looked up are reported through |warn|.
+func findUpdates(mr monorepo.Monorepo, up upstream, modules bool, warn func(format string, args ...interface{})) ([]*update, error) {
+	manifests, err := findManifests(mr, "third_party")
+	if err != nil {
+		return nil, err
+	}
+	var updates []*update
+	for _, mf := range manifests {
+		in, err := ioutil.ReadFile(mr.ResolvePath(mf))
+		if err != nil {
+			return nil, err
+		}
+		manifest := &manifestpb.Manifest{}
+		if err := proto.UnmarshalText(string(in), manifest); err != nil {
+			return nil, fmt.Errorf("could not read MANIFEST file %s: %v", mf, err)
+		}
+		for _, entry := range manifest.ManifestEntry {
+			u, err := entryUpdate(up, mf, entry)
+			if err != nil {
+				warn("could not look up %s of %s: %v", entry.Name, mf, err)
+			} else if u != nil {
+				updates = append(updates, u)
+			}
+		}
+	}
+	if !modules {
+		return updates, nil
+	}
+	mods, err := up.moduleUpdates()
+	if err != nil {
+		warn("could not look up go.mod requirements: %v", err)
+		return updates, nil
+	}
+	for _, mod := range mods {
+		updates = append(updates, &update{
+			kind:   goModule,
+			name:   mod.Path,
+			file:   "go.mod",
+			source: mod.Path,
+			from:   mod.Version,
+			to:     mod.Update,
+		})
+	}
+	return updates, nil
+}
+
+// findManifests returns the MANIFEST files in |dir| and its subdirectories. Like vendor_bender, it
+// doesn't look into vendored packages, the directories with a METADATA file.
+func findManifests(mr monorepo.Monorepo, dir monorepo.Path) ([]monorepo.Path, error) {
+	abs := mr.ResolvePath(dir)
+	for _, name := range []string{"METADATA.textpb", "METADATA"} {
+		if _, err := os.Stat(path.Join(abs, name)); err == nil {
+			return nil, nil
+		}
+	}
+	var manifests []monorepo.Path
+	for _, name := range []string{"MANIFEST.textpb", "MANIFEST"} {
+		if info, err := os.Stat(path.Join(abs, name)); err == nil && !info.IsDir() {
+			manifests = append(manifests, monorepo.NewPath(path.Join(string(dir), name)))
+			break
+		}
+	}
+	children, err := ioutil.ReadDir(abs)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if !child.IsDir() {
+			continue
+		}
+		sub, err := findManifests(mr, monorepo.NewPath(path.Join(string(dir), child.Name())))
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, sub...)
+	}
+	return manifests, nil
+}
+
+// entryUpdate returns the update of manifest |entry| declared in |mf|, nil if it is up to date or
+// can't be updated automatically: git entries pinned to a commit without a ref to follow, and zip
+// and Rust entries.
+func entryUpdate(up upstream, mf monorepo.Path, entry *manifestpb.ManifestEntry) (*update, error) {
+	if src := entry.GetGoSrc(); src != nil {
+		latest, err := up.goVersion(src.ImportPath)
+		if err != nil {
+			return nil, err
+		}
+		if !newer(src.Version, latest) {
+			return nil, nil
+		}
+		return &update{kind: goEntry, name: entry.Name, file: mf, source: src.ImportPath, from: src.Version, to: latest}, nil
+	}
+	if src := entry.GetGitSrc(); src != nil && src.Ref != "" {
+		commit, err := up.gitCommit(src.Url, src.Ref)
+		if err != nil {
+			return nil, err
+		}
+		if commit == src.Commit {
+			return nil, nil
+		}
+		return &update{kind: gitEntry, name: entry.Name, file: mf, source: src.Url, from: src.Commit, to: commit}, nil
+	}
+	return nil, nil
+}
+
+// newer returns whether Go module version |to| is newer than |from|. A pseudo-version of a commit
+// past the latest release is newer than that release, so such dependencies aren't downgraded.
+func newer(from, to string) bool {
+	f, err := version.NewVersion(from)
+	if err != nil {
+		return from != to
+	}
+	t, err := version.NewVersion(to)
+	if err != nil {
+		return false
+	}
+	return t.GreaterThan(f)
+}
+
+// bumpManifest returns the content of MANIFEST |content| with the version or commit of entry
+// |name| changed from |from| to |to|. The rest of the file, eg. comments, is kept as is.
+func bumpManifest(content, name, from, to string) (string, error) {
+	nameRe := regexp.MustCompile(`(?m)^\s*name\s*:\s*"` + regexp.QuoteMeta(name) + `"`)
+	loc := nameRe.FindStringIndex(content)
+	if loc == nil {
+		return "", fmt.Errorf("no entry %q", name)
+	}
+	// The version belongs to the entry if it comes before the name of the next entry.
+	rest := content[loc[1]:]
+	end := len(rest)
+	if next := regexp.MustCompile(`(?m)^\s*name\s*:`).FindStringIndex(rest); next != nil {
+		end = next[0]
+	}
+	old := `"` + from + `"`
+	i := strings.Index(rest[:end], old)
+	if i < 0 {
+		return "", fmt.Errorf("entry %q has no version %q", name, from)
+	}
+	i += loc[1]
+	return content[:i] + `"` + to + `"` + content[i+len(old):], nil
+}
+
+// pseudoVersionRe matches the commit of a Go pseudo-version.
+var pseudoVersionRe = regexp.MustCompile(`\d{14}-([0-9a-f]{12})$`)
+
+// changelog returns links to the upstream changes of update |u|.
+func changelog(u *update) []string {
+	var links []string
+	repo := u.source
+	if u.kind != gitEntry {
+		links = append(links, fmt.Sprintf("https://pkg.go.dev/%s@%s", u.source, u.to))
+		repo = "https://" + u.source
+	}
+	repo = strings.TrimSuffix(repo, ".git")
+	if strings.HasPrefix(repo, "https://github.com/") && strings.Count(repo, "/") == 4 {
+		links = append(links, fmt.Sprintf("%s/compare/%s...%s", repo, gitRev(u.from), gitRev(u.to)))
+	}
+	return links
+}
+
+// gitRev returns the git revision of a Go module version or of a commit.
+func gitRev(v string) string {
+	if m := pseudoVersionRe.FindStringSubmatch(v); m != nil {
+		return m[1]
+	}
+	return strings.TrimSuffix(v, "+incompatible")
+}
+
+// description returns the changelist and review description of update |u|. |previous| is the
+// review of an earlier update of the same dependency, 0 if none.
+func description(u *update, previous int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Update %s from %s to %s\n\n", u.name, shortVersion(u.from), shortVersion(u.to))
+	fmt.Fprintf(&sb, "Dependency update proposed by depbot. %s is declared in //%s.\n", u.source, u.file)
+	if links := changelog(u); len(links) > 0 {
+		sb.WriteString("\nUpstream changes:\n")
+		for _, l := range links {
+			fmt.Fprintf(&sb, "  %s\n", l)
+		}
+	}
+	if previous != 0 {
+		fmt.Fprintf(&sb, "\nSupersedes review %d.\n", previous)
+	}
+	return sb.String()
+}
+
+// shortVersion shortens git commits for display.
+func shortVersion(v string) string {
+	if len(v) == 40 && !strings.HasPrefix(v, "v") {
+		return v[:12]
+	}
+	return v
+}
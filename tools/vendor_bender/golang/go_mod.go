@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golang
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ModuleUpdate is a requirement of the monorepo go.mod for which a newer version exists.
+type ModuleUpdate struct {
+	Path    string
+	Version string
+	Update  string
+}
+
+// ModuleUpdates returns the direct requirements of the go.mod at the monorepo root that have newer
+// versions, by order of module path.
+func ModuleUpdates(mrRoot string, verbose bool) ([]ModuleUpdate, error) {
+	cmd := exec.Command(goTool(mrRoot), "list", "-m", "-u", "-json", "all")
+	cmd.Dir = mrRoot
+	cmd.Env = append(os.Environ(), "GO111MODULE=on")
+	var stdoutBuf bytes.Buffer
+	cmd.Stdout = &stdoutBuf
+	if verbose {
+		fmt.Println(cmd)
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list failed: %v", err)
+	}
+	return parseModuleUpdates(&stdoutBuf)
+}
+
+// parseModuleUpdates parses the output of "go list -m -u -json", a stream of JSON modules.
+func parseModuleUpdates(r io.Reader) ([]ModuleUpdate, error) {
+	var updates []ModuleUpdate
+	dec := json.NewDecoder(r)
+	for {
+		var mod struct {
+			Path     string
+			Version  string
+			Main     bool
+			Indirect bool
+			Replace  *struct{}
+			Update   *struct{ Version string }
+		}
+		if err := dec.Decode(&mod); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse go list output: %v", err)
+		}
+		// Replaced modules don't come from upstream, updating their requirement changes nothing.
+		if mod.Main || mod.Indirect || mod.Replace != nil || mod.Update == nil {
+			continue
+		}
+		updates = append(updates, ModuleUpdate{
+			Path:    mod.Path,
+			Version: mod.Version,
+			Update:  mod.Update.Version,
+		})
+	}
+	return updates, nil
+}
+
+// GetModule changes the requirement on module |modPath| of the go.mod at the monorepo root to
+// |version|. The go.mod and go.sum files must be writable.
+func GetModule(mrRoot, modPath, version string, verbose bool) error {
+	cmd := exec.Command(goTool(mrRoot), "get", "-d", modPath+"@"+version)
+	cmd.Dir = mrRoot
+	cmd.Env = append(os.Environ(), "GO111MODULE=on")
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	if verbose {
+		fmt.Println(cmd)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go get %s@%s failed: %v\n%s", modPath, version, err, stderrBuf.String())
+	}
+	return nil
+}
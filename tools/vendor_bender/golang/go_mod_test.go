@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package golang
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseModuleUpdates(t *testing.T) {
+	out := `{
+	"Path": "sge-monorepo",
+	"Main": true
+}
+{
+	"Path": "github.com/foo/direct",
+	"Version": "v1.2.0",
+	"Update": {"Path": "github.com/foo/direct", "Version": "v1.3.1"}
+}
+{
+	"Path": "github.com/foo/current",
+	"Version": "v0.4.0"
+}
+{
+	"Path": "github.com/foo/indirect",
+	"Version": "v0.1.0",
+	"Update": {"Path": "github.com/foo/indirect", "Version": "v0.2.0"},
+	"Indirect": true
+}
+{
+	"Path": "github.com/foo/replaced",
+	"Version": "v0.0.0",
+	"Replace": {"Path": "./third_party/replaced"},
+	"Update": {"Path": "github.com/foo/replaced", "Version": "v0.5.0"}
+}
+`
+	got, err := parseModuleUpdates(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ModuleUpdate{{Path: "github.com/foo/direct", Version: "v1.2.0", Update: "v1.3.1"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected updates (-want +got):\n%s", diff)
+	}
+}
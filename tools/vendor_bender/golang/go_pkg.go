@@ -39,8 +39,7 @@ var nonWordRe = regexp.MustCompile(`\W+`)
 // the repository rule providing the module (if any), the true version,
 // and the sum.
 func ModVersion(mrRoot, modPath, query string, verbose bool) (version, sum string, err error) {
-	goTool := filepath.Join(mrRoot, "third_party/toolchains/go/1.14.3/bin/go.exe")
-	cmd := exec.Command(goTool, "mod", "download", "-json", "--", modPath+"@"+query)
+	cmd := exec.Command(goTool(mrRoot), "mod", "download", "-json", "--", modPath+"@"+query)
 	cmd.Env = append(os.Environ(), "GO111MODULE=on")
 	var stdoutBuf, stderrBuf bytes.Buffer
 	if verbose {
@@ -61,6 +60,11 @@ func ModVersion(mrRoot, modPath, query string, verbose bool) (version, sum strin
 	return result.Version, result.Sum, nil
 }
 
+// goTool returns the path of the go tool of the monorepo.
+func goTool(mrRoot string) string {
+	return filepath.Join(mrRoot, "third_party/toolchains/go/1.14.3/bin/go.exe")
+}
+
 // importPathToBazelRepoName converts a Go import path into a bazel repo name
 // following the guidelines in http://bazel.io/docs/be/functions.html#workspace
 func ImportPathToBazelRepoName(importpath string) string {
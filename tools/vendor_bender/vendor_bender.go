@@ -59,6 +59,7 @@ type context struct {
 	pkgCtxs    []pkgContext
 	pkgWsPaths map[string]string
 	verbose    bool
+	cl         int // changelist to open changes in, a new one per package if 0
 }
 
 type action interface {
@@ -171,7 +172,7 @@ func buildContext(root string, verbose bool) (context, error) {
 		}
 		idx += 1
 	}
-	return context{root, pkgCtxs, pkgWsPaths, verbose}, nil
+	return context{mrRoot: root, pkgCtxs: pkgCtxs, pkgWsPaths: pkgWsPaths, verbose: verbose}, nil
 }
 
 // Handles addition/delete/update logic
@@ -262,7 +263,9 @@ func vendor(ctx *context, args []string) error {
 	updateLabels := flags.Bool("update-labels", false, "Update labels for bazel")
 	dryRun := flags.Bool("dry-run", false, "Prints the plan without performing any IO")
 	diffDiv := flags.Bool("diff-divergences", false, "Opens the diff tool to diff the divergences")
+	cl := flags.Int("cl", 0, "Changelist to open all changes in, instead of a new one per package")
 	flags.Parse(args)
+	ctx.cl = *cl
 	plan, err := buildVendoringPlan(ctx, *updateLabels)
 	if err != nil {
 		return fmt.Errorf("failed to create a vendoring plan: %v", err)
@@ -301,11 +304,12 @@ func analyse(ctx *context, args []string) error {
 func printUsage() {
 	fmt.Println("usage: vendor_bender [-verbose] cmd <args> <options>")
 	fmt.Println("commands:")
-	fmt.Println("  - vendor [-update-labels] [-diff-divergences] [-dry-run]")
+	fmt.Println("  - vendor [-update-labels] [-diff-divergences] [-cl=<change>] [-dry-run]")
 	fmt.Println("    Reads MANIFEST files in the monorepo and resolves the state of the packages with manifest content")
 	fmt.Println("    args:")
 	fmt.Println("      -update-labels: Check and update all labels for consistency")
 	fmt.Println("      -diff-divergences: Opens the diff tool to diff the divergences")
+	fmt.Println("      -cl: Changelist to open all changes in, instead of a new one per package")
 	fmt.Println("      -dry-run: Prints the plan without performing any IO")
 	fmt.Println("  - regen [package] [-clean] [-dry-run]")
 	fmt.Println("    Generate BUILD files using the package type generator")